@@ -0,0 +1,101 @@
+/*
+Package adminauth authenticates the human operators of the api. Users log in with their
+username and password, of which only a bcrypt hash is stored, and are given a bearer token
+to send on every request after, as "Authorization: Bearer <token>". Like the secrets of
+the devices, only the SHA-256 of a token is stored.
+*/
+package adminauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Shortest password a user may be given
+const MinPasswordLength = 10
+
+// Longest password a user may be given, in bytes, bcrypt refuses anything longer
+const MaxPasswordLength = 72
+
+var (
+	// The username is unknown, the password is wrong, or the user is disabled, which one is never told
+	ErrInvalidLogin = errors.New("invalid username or password")
+	ErrMissingToken = errors.New("request has no bearer token")
+	// The token is unknown, expired, revoked, or its user was disabled
+	ErrInvalidToken = errors.New("invalid or expired token")
+	ErrForbidden    = errors.New("role not allowed")
+	ErrWeakPassword = errors.New("password is too short")
+	// Past MaxPasswordLength bytes, bcrypt can't hash it
+	ErrPasswordTooLong = errors.New("password is too long")
+)
+
+// Config holds how long the sessions last, and the user created when there is none
+type Config struct {
+	SessionTTL time.Duration
+	// bcrypt cost of the password hashes, the higher the slower a login is
+	PasswordCost int
+	/*
+		Created as an admin on startup, only while there are no users at all,
+		so the first operator can log in and create the others.
+	*/
+	BootstrapUser     string
+	BootstrapPassword string
+}
+
+// WithDefaults fills every value left out, sessions of 12 hours and the default bcrypt cost
+func (config Config) WithDefaults() Config {
+	if config.SessionTTL == 0 {
+		config.SessionTTL = 12 * time.Hour
+	}
+	if config.PasswordCost == 0 {
+		config.PasswordCost = bcrypt.DefaultCost
+	}
+	return config
+}
+
+// NewToken generates a bearer token, returning it with the hash that is stored
+func NewToken() (token string, tokenHash string, err error) {
+	raw := make([]byte, 32)
+	if _, err = rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(raw)
+	return token, HashToken(token), nil
+}
+
+// HashToken returns the hex SHA-256 of the token
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// BearerToken reads the token of an Authorization header, empty if it has none
+func BearerToken(header string) string {
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// HashPassword returns the bcrypt hash of the password, failing with ErrWeakPassword if it is too short
+func HashPassword(password string, cost int) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", ErrWeakPassword
+	}
+	if len(password) > MaxPasswordLength {
+		return "", ErrPasswordTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
@@ -0,0 +1,178 @@
+package adminauth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+Authenticator logs the users in and out, and finds the user of a bearer token.
+Disabling a user, or changing its password, revokes every session it has.
+*/
+type Authenticator struct {
+	users    repository.UserRepository
+	sessions repository.SessionRepository
+	config   Config
+	// Compared against when the username is unknown, so a login takes as long either way
+	decoyHash []byte
+}
+
+func NewAuthenticator(users repository.UserRepository, sessions repository.SessionRepository, config Config) *Authenticator {
+	config = config.WithDefaults()
+	decoyHash, _ := bcrypt.GenerateFromPassword([]byte("decoy password"), config.PasswordCost)
+	return &Authenticator{
+		users:     users,
+		sessions:  sessions,
+		config:    config,
+		decoyHash: decoyHash,
+	}
+}
+
+/*
+Bootstrap creates the bootstrap user as an admin, if one is configured and there are no
+users yet, reporting if it was created.
+*/
+func (authenticator *Authenticator) Bootstrap(ctx context.Context, now time.Time) (bool, error) {
+	if authenticator.config.BootstrapUser == "" {
+		return false, nil
+	}
+	count, err := authenticator.users.Count(ctx)
+	if err != nil || count > 0 {
+		return false, err
+	}
+
+	_, err = authenticator.CreateUser(ctx, authenticator.config.BootstrapUser,
+		authenticator.config.BootstrapPassword, repository.AdminRole, now)
+	return err == nil, err
+}
+
+func (authenticator *Authenticator) CreateUser(ctx context.Context, username, password string, role repository.UserRole, now time.Time) (repository.User, error) {
+	hash, err := HashPassword(password, authenticator.config.PasswordCost)
+	if err != nil {
+		return repository.User{}, err
+	}
+	return authenticator.users.Create(ctx, repository.NewUser{
+		Username:     username,
+		PasswordHash: hash,
+		Role:         role,
+		CreatedAt:    now.UnixMilli(),
+	})
+}
+
+// checkPassword returns the user if the password is its own, and it isn't disabled
+func (authenticator *Authenticator) checkPassword(ctx context.Context, username, password string) (repository.User, error) {
+	user, err := authenticator.users.GetByUsername(ctx, username)
+	if errors.Is(err, repository.NotFound) {
+		_ = bcrypt.CompareHashAndPassword(authenticator.decoyHash, []byte(password))
+		return repository.User{}, ErrInvalidLogin
+	}
+	if err != nil {
+		return repository.User{}, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil || user.DisabledAt.Valid {
+		return repository.User{}, ErrInvalidLogin
+	}
+	return user, nil
+}
+
+// Login checks the password of the user, and issues it a token that lasts for the session ttl
+func (authenticator *Authenticator) Login(ctx context.Context, username, password string, now time.Time) (string, repository.Session, repository.User, error) {
+	user, err := authenticator.checkPassword(ctx, username, password)
+	if err != nil {
+		return "", repository.Session{}, repository.User{}, err
+	}
+
+	token, tokenHash, err := NewToken()
+	if err != nil {
+		return "", repository.Session{}, repository.User{}, err
+	}
+	session, err := authenticator.sessions.Create(ctx, user.ID, tokenHash,
+		now.UnixMilli(), now.Add(authenticator.config.SessionTTL).UnixMilli())
+	if err != nil {
+		return "", repository.Session{}, repository.User{}, err
+	}
+	slog.Info("admin-auth", "login", user.Username, "role", user.Role.String())
+	return token, session, user, nil
+}
+
+// Authenticate returns the user of the token, as long as its session and the user are still valid
+func (authenticator *Authenticator) Authenticate(ctx context.Context, token string, now time.Time) (repository.User, error) {
+	if token == "" {
+		return repository.User{}, ErrMissingToken
+	}
+	session, err := authenticator.sessions.Valid(ctx, HashToken(token), now.UnixMilli())
+	if errors.Is(err, repository.NotFound) {
+		return repository.User{}, ErrInvalidToken
+	}
+	if err != nil {
+		return repository.User{}, err
+	}
+
+	user, err := authenticator.users.GetByID(ctx, session.UserFk)
+	if errors.Is(err, repository.NotFound) || (err == nil && user.DisabledAt.Valid) {
+		return repository.User{}, ErrInvalidToken
+	}
+	return user, err
+}
+
+// Logout revokes the session of the token
+func (authenticator *Authenticator) Logout(ctx context.Context, token string, now time.Time) error {
+	err := authenticator.sessions.Revoke(ctx, HashToken(token), now.UnixMilli())
+	if errors.Is(err, repository.NotFound) {
+		return ErrInvalidToken
+	}
+	return err
+}
+
+// UpdateUser changes the role of the user, disabling or enabling it, a disabled user is logged out everywhere
+func (authenticator *Authenticator) UpdateUser(ctx context.Context, id uint, role repository.UserRole, disabled bool, now time.Time) (repository.User, error) {
+	current, err := authenticator.users.GetByID(ctx, id)
+	if err != nil {
+		return repository.User{}, err
+	}
+	disabledAt := sql.NullInt64{}
+	if disabled {
+		// Disabling a disabled user keeps the date it was first disabled at
+		disabledAt = current.DisabledAt
+		if !disabledAt.Valid {
+			disabledAt = sql.NullInt64{Int64: now.UnixMilli(), Valid: true}
+		}
+	}
+
+	user, err := authenticator.users.Update(ctx, id, role, disabledAt)
+	if err != nil {
+		return repository.User{}, err
+	}
+	if disabled {
+		_, err = authenticator.sessions.RevokeAll(ctx, id, now.UnixMilli())
+	}
+	return user, err
+}
+
+// SetPassword replaces the password of the user, logging it out everywhere
+func (authenticator *Authenticator) SetPassword(ctx context.Context, id uint, password string, now time.Time) error {
+	hash, err := HashPassword(password, authenticator.config.PasswordCost)
+	if err != nil {
+		return err
+	}
+	if err = authenticator.users.SetPassword(ctx, id, hash); err != nil {
+		return err
+	}
+	_, err = authenticator.sessions.RevokeAll(ctx, id, now.UnixMilli())
+	return err
+}
+
+// ChangePassword replaces the password of the user after checking its current one, logging it out everywhere
+func (authenticator *Authenticator) ChangePassword(ctx context.Context, username, current, password string, now time.Time) error {
+	user, err := authenticator.checkPassword(ctx, username, current)
+	if err != nil {
+		return err
+	}
+	return authenticator.SetPassword(ctx, user.ID, password, now)
+}
@@ -0,0 +1,93 @@
+package adminauth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	authenticator := NewAuthenticator(repos.Users, repos.Sessions, Config{
+		SessionTTL:        time.Hour,
+		PasswordCost:      bcrypt.MinCost,
+		BootstrapUser:     "root",
+		BootstrapPassword: "bootstrap-password",
+	})
+	now := time.UnixMilli(1_000_000_000)
+
+	// Only created while there are no users
+	created, err := authenticator.Bootstrap(ctx, now)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	created, err = authenticator.Bootstrap(ctx, now)
+	assert.NoError(t, err)
+	assert.False(t, created)
+
+	_, err = authenticator.CreateUser(ctx, "viewer", "short", repository.ViewerRole, now)
+	assert.True(t, errors.Is(err, ErrWeakPassword))
+	_, err = authenticator.CreateUser(ctx, "viewer", strings.Repeat("p", MaxPasswordLength+1), repository.ViewerRole, now)
+	assert.True(t, errors.Is(err, ErrPasswordTooLong))
+	viewer, err := authenticator.CreateUser(ctx, "viewer", "viewer-password", repository.ViewerRole, now)
+	assert.NoError(t, err)
+	assert.NotEqual(t, "viewer-password", viewer.PasswordHash)
+
+	_, _, _, err = authenticator.Login(ctx, "viewer", "wrong-password", now)
+	assert.True(t, errors.Is(err, ErrInvalidLogin))
+	_, _, _, err = authenticator.Login(ctx, "nobody", "viewer-password", now)
+	assert.True(t, errors.Is(err, ErrInvalidLogin))
+	token, session, user, err := authenticator.Login(ctx, "viewer", "viewer-password", now)
+	assert.NoError(t, err)
+	assert.Equal(t, viewer.ID, user.ID)
+	assert.Equal(t, now.Add(time.Hour).UnixMilli(), session.ExpiresAt)
+
+	user, err = authenticator.Authenticate(ctx, token, now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, "viewer", user.Username)
+	_, err = authenticator.Authenticate(ctx, token, now.Add(time.Hour))
+	assert.True(t, errors.Is(err, ErrInvalidToken))
+	_, err = authenticator.Authenticate(ctx, "", now)
+	assert.True(t, errors.Is(err, ErrMissingToken))
+
+	assert.NoError(t, authenticator.Logout(ctx, token, now))
+	_, err = authenticator.Authenticate(ctx, token, now)
+	assert.True(t, errors.Is(err, ErrInvalidToken))
+	assert.True(t, errors.Is(authenticator.Logout(ctx, token, now), ErrInvalidToken))
+
+	// Disabling a user logs it out, and keeps it from logging in again
+	token, _, _, err = authenticator.Login(ctx, "viewer", "viewer-password", now)
+	assert.NoError(t, err)
+	user, err = authenticator.UpdateUser(ctx, viewer.ID, repository.OperatorRole, true, now)
+	assert.NoError(t, err)
+	assert.Equal(t, repository.OperatorRole, user.Role)
+	assert.True(t, user.DisabledAt.Valid)
+	_, err = authenticator.Authenticate(ctx, token, now)
+	assert.True(t, errors.Is(err, ErrInvalidToken))
+	_, _, _, err = authenticator.Login(ctx, "viewer", "viewer-password", now)
+	assert.True(t, errors.Is(err, ErrInvalidLogin))
+
+	// A new password logs the user out too
+	_, err = authenticator.UpdateUser(ctx, viewer.ID, repository.OperatorRole, false, now)
+	assert.NoError(t, err)
+	token, _, _, err = authenticator.Login(ctx, "viewer", "viewer-password", now)
+	assert.NoError(t, err)
+	assert.NoError(t, authenticator.SetPassword(ctx, viewer.ID, "another-password", now))
+	_, err = authenticator.Authenticate(ctx, token, now)
+	assert.True(t, errors.Is(err, ErrInvalidToken))
+	_, _, _, err = authenticator.Login(ctx, "viewer", "another-password", now)
+	assert.NoError(t, err)
+}
+
+func TestBearerToken(t *testing.T) {
+	assert.Equal(t, "abc", BearerToken("Bearer abc"))
+	assert.Equal(t, "abc", BearerToken("bearer  abc"))
+	assert.Equal(t, "", BearerToken("Basic abc"))
+	assert.Equal(t, "", BearerToken("abc"))
+}
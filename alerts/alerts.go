@@ -0,0 +1,111 @@
+/*
+Package alerts evaluates the alert rules against what the devices report. The threshold
+and rate of change rules are evaluated inline with the ingestion of each measurement, the
+absence of data rules by a worker checking every device once per interval, and the status
+rules on the connectivity events of the presence monitor, and on the stored connectivity
+at each check. The alerts that fire or resolve are written apart, by a writer of their own.
+A rule has a single alert open per device, firing until acknowledged, and open until the
+rule stops firing for it.
+*/
+package alerts
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/TomascpMarques/maestro/events"
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+var (
+	ErrInvalidRule = errors.New("invalid alert rule")
+	ErrNotFiring   = errors.New("alert isn't firing")
+)
+
+// Events published through the lifecycle of an alert
+const (
+	AlertFiring       events.Type = "alert-firing"
+	AlertAcknowledged events.Type = "alert-acknowledged"
+	AlertResolved     events.Type = "alert-resolved"
+)
+
+// Config holds how often the absence of data rules are checked
+type Config struct {
+	// Time between two checks of the absence of data rules
+	Interval time.Duration
+}
+
+// WithDefaults fills every value left out, a check every minute
+func (config Config) WithDefaults() Config {
+	if config.Interval == 0 {
+		config.Interval = time.Minute
+	}
+	return config
+}
+
+// Validate checks the values once filled
+func (config Config) Validate() error {
+	config = config.WithDefaults()
+	if config.Interval < 0 {
+		return fmt.Errorf("interval should be positive")
+	}
+	return nil
+}
+
+/*
+RuleRequest is a rule to create, scoped to the device of the serial id, the device type
+and the measurement type set, or every device when none is.
+*/
+type RuleRequest struct {
+	Name       string
+	Kind       repository.AlertKind
+	SerialId   string
+	DeviceType *repository.DeviceType
+	ValueType  *uint
+	Comparison repository.AlertComparison
+	Threshold  float64
+	// Without a measurement, for the absence of data rules, at least a minute
+	Window       time.Duration
+	Connectivity repository.Connectivity
+}
+
+// checkKind checks that the request holds what its kind of rule is evaluated on
+func (request RuleRequest) checkKind() error {
+	switch request.Kind {
+	case repository.ThresholdAlert, repository.RateAlert:
+		if request.Comparison > repository.Below {
+			return fmt.Errorf("%w: the comparison is either above or below", ErrInvalidRule)
+		}
+	case repository.AbsenceAlert:
+		if request.Window < time.Minute {
+			return fmt.Errorf("%w: the window of an absence rule is at least a minute", ErrInvalidRule)
+		}
+	case repository.StatusAlert:
+		if request.Connectivity != repository.Stale && request.Connectivity != repository.Offline {
+			return fmt.Errorf("%w: a status rule fires on the device going stale or offline", ErrInvalidRule)
+		}
+		if request.ValueType != nil {
+			return fmt.Errorf("%w: a status rule has no measurement type", ErrInvalidRule)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %d", ErrInvalidRule, request.Kind)
+	}
+	return nil
+}
+
+// inScope reports if the device is in the scope of the rule, whatever the measurement type
+func inScope(rule repository.AlertRule, device repository.Device) bool {
+	if rule.DeviceFk.Valid && uint(rule.DeviceFk.Int64) != device.ID {
+		return false
+	}
+	return !rule.DeviceType.Valid || repository.DeviceType(rule.DeviceType.Int64) == device.DeviceType
+}
+
+// crosses reports if the value is on the side of the threshold the rule fires on
+func crosses(rule repository.AlertRule, value float64) bool {
+	if rule.Comparison == repository.Below {
+		return value < rule.Threshold
+	}
+	return value > rule.Threshold
+}
@@ -0,0 +1,569 @@
+package alerts
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/events"
+	"github.com/TomascpMarques/maestro/measurementtypes"
+	"github.com/TomascpMarques/maestro/presence"
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+// connectivities maps the events of the presence monitor to the connectivity they report
+var connectivities = map[events.Type]repository.Connectivity{
+	presence.DeviceOnline:  repository.Online,
+	presence.DeviceStale:   repository.Stale,
+	presence.DeviceOffline: repository.Offline,
+}
+
+// sample is a measurement type published by a device
+type sample struct {
+	device    uint
+	valueType uint
+}
+
+// reading is the last value of a sample, for the rate of change rules
+type reading struct {
+	value float64
+	// Unix milliseconds, when the device measured it
+	at int64
+}
+
+// openAlert is the rule and device of an alert open
+type openAlert struct {
+	rule   uint
+	device uint
+}
+
+// transition is an alert to fire, or to resolve when not firing, queued for the writer
+type transition struct {
+	rule   repository.AlertRule
+	device repository.Device
+	firing bool
+	alert  repository.NewAlert
+}
+
+// queueSize is how many alerts can wait to be fired or resolved, more are evaluated again later
+const queueSize = 1000
+
+/*
+Engine evaluates the rules, kept in memory along with the alerts open. The alerts that
+fire or resolve are queued, and written by a single writer goroutine (Run), so ingesting
+a measurement never waits on the db.
+*/
+type Engine struct {
+	repo             repository.AlertRepository
+	devices          repository.DeviceRepository
+	measurements     repository.MeasurementRepository
+	deviceTypes      *devicetypes.Registry
+	measurementTypes *measurementtypes.Registry
+	bus              *events.Bus
+	config           Config
+
+	mutex sync.Mutex
+	rules []repository.AlertRule
+	last  map[sample]reading
+
+	// Devices with a connectivity event since the last check, ahead of the stored connectivity
+	heard map[uint]bool
+
+	// Held while an alert is queued to fire or resolve, so a rule never fires twice for a device
+	openMutex sync.Mutex
+	open      map[openAlert]bool
+
+	queue   chan transition
+	flushes chan chan struct{}
+}
+
+// Load creates the engine with the rules stored, and the alerts they have open
+func Load(
+	ctx context.Context,
+	repo repository.AlertRepository,
+	devices repository.DeviceRepository,
+	measurements repository.MeasurementRepository,
+	deviceTypes *devicetypes.Registry,
+	measurementTypes *measurementtypes.Registry,
+	bus *events.Bus,
+	config Config,
+) (*Engine, error) {
+	rules, err := repo.ListRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	alerts, err := repo.List(ctx, repository.AlertQuery{Open: true})
+	if err != nil {
+		return nil, err
+	}
+
+	engine := &Engine{
+		repo:             repo,
+		devices:          devices,
+		measurements:     measurements,
+		deviceTypes:      deviceTypes,
+		measurementTypes: measurementTypes,
+		bus:              bus,
+		config:           config.WithDefaults(),
+		rules:            rules,
+		last:             map[sample]reading{},
+		heard:            map[uint]bool{},
+		open:             map[openAlert]bool{},
+		queue:            make(chan transition, queueSize),
+		flushes:          make(chan chan struct{}),
+	}
+	for _, alert := range alerts {
+		engine.open[openAlert{alert.RuleFk, alert.DeviceFk}] = true
+	}
+	return engine, nil
+}
+
+// CreateRule checks the rule and stores it, it is evaluated from then on
+func (engine *Engine) CreateRule(ctx context.Context, request RuleRequest, actor string, now time.Time) (repository.AlertRule, error) {
+	if err := request.checkKind(); err != nil {
+		return repository.AlertRule{}, err
+	}
+	rule := repository.NewAlertRule{
+		Name:         request.Name,
+		Kind:         request.Kind,
+		Comparison:   request.Comparison,
+		Threshold:    request.Threshold,
+		WindowMillis: request.Window.Milliseconds(),
+		Connectivity: request.Connectivity,
+		CreatedBy:    actor,
+		CreatedAt:    now.UnixMilli(),
+	}
+	if request.SerialId != "" {
+		device, err := engine.devices.GetBySerial(ctx, request.SerialId)
+		if err != nil {
+			return repository.AlertRule{}, err
+		}
+		rule.DeviceFk = sql.NullInt64{Int64: int64(device.ID), Valid: true}
+	}
+	if request.DeviceType != nil {
+		if _, found := engine.deviceTypes.Get(*request.DeviceType); !found {
+			return repository.AlertRule{}, devicetypes.ErrUnknownType
+		}
+		rule.DeviceType = sql.NullInt64{Int64: int64(*request.DeviceType), Valid: true}
+	}
+	if request.ValueType != nil {
+		definition, found := engine.measurementTypes.Get(*request.ValueType)
+		if !found {
+			return repository.AlertRule{}, measurementtypes.ErrUnknownType
+		}
+		numeric := definition.Encoding == repository.FloatEncoding || definition.Encoding == repository.IntEncoding
+		if (request.Kind == repository.ThresholdAlert || request.Kind == repository.RateAlert) && !numeric {
+			return repository.AlertRule{}, fmt.Errorf("%w: %s values can't be compared to a threshold", ErrInvalidRule, definition.Encoding)
+		}
+		rule.ValueType = sql.NullInt64{Int64: int64(*request.ValueType), Valid: true}
+	}
+
+	created, err := engine.repo.CreateRule(ctx, rule)
+	if err != nil {
+		return repository.AlertRule{}, err
+	}
+	engine.mutex.Lock()
+	engine.rules = append(engine.rules, created)
+	engine.mutex.Unlock()
+
+	slog.Info("alerts", "status", "rule created", "rule", created.Name, "kind", created.Kind.String(), "actor", actor)
+	return created, nil
+}
+
+func (engine *Engine) Rules(ctx context.Context) ([]repository.AlertRule, error) {
+	return engine.repo.ListRules(ctx)
+}
+
+// DeleteRule stops evaluating the rule, deleting it with its alerts
+func (engine *Engine) DeleteRule(ctx context.Context, id uint, actor string) error {
+	if err := engine.repo.DeleteRule(ctx, id); err != nil {
+		return err
+	}
+	engine.mutex.Lock()
+	engine.rules = slices.DeleteFunc(engine.rules, func(rule repository.AlertRule) bool { return rule.ID == id })
+	engine.mutex.Unlock()
+
+	engine.openMutex.Lock()
+	for open := range engine.open {
+		if open.rule == id {
+			delete(engine.open, open)
+		}
+	}
+	engine.openMutex.Unlock()
+
+	slog.Info("alerts", "status", "rule deleted", "rule", id, "actor", actor)
+	return nil
+}
+
+func (engine *Engine) Alerts(ctx context.Context, query repository.AlertQuery) ([]repository.Alert, error) {
+	return engine.repo.List(ctx, query)
+}
+
+// Acknowledge marks the firing alert as seen, it stays open until its rule stops firing
+func (engine *Engine) Acknowledge(ctx context.Context, id uint, actor string, now time.Time) (repository.Alert, error) {
+	alert, err := engine.repo.Acknowledge(ctx, id, actor, now.UnixMilli())
+	if errors.Is(err, repository.NotFound) {
+		current, getErr := engine.repo.Get(ctx, id)
+		if getErr != nil {
+			return repository.Alert{}, getErr
+		}
+		return repository.Alert{}, fmt.Errorf("%w: it is %s", ErrNotFiring, current.State)
+	}
+	if err != nil {
+		return repository.Alert{}, err
+	}
+	engine.publish(AlertAcknowledged, alert, now)
+	return alert, nil
+}
+
+// rulesOf returns the rules of the kinds, the caller holds the lock
+func (engine *Engine) rulesOf(kinds ...repository.AlertKind) []repository.AlertRule {
+	rules := []repository.AlertRule{}
+	for _, rule := range engine.rules {
+		if slices.Contains(kinds, rule.Kind) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+/*
+Observe evaluates the threshold and rate of change rules on a measurement published by
+the device, as it is ingested, queuing the alerts that fire or resolve. Only the numeric
+values are evaluated, at the time the device measured them when it did, a value older
+than the last one doesn't change the rate.
+*/
+func (engine *Engine) Observe(device repository.Device, measurement repository.NewMeasurement) {
+	value, err := strconv.ParseFloat(measurement.Value, 64)
+	if err != nil {
+		return
+	}
+	at := measurement.ReceivedAt
+	if measurement.MeasuredAt.Valid {
+		at = measurement.MeasuredAt.Int64
+	}
+
+	engine.mutex.Lock()
+	key := sample{device.ID, measurement.ValueType}
+	previous, seen := engine.last[key]
+	if !seen || at > previous.at {
+		engine.last[key] = reading{value, at}
+	}
+	rules := engine.rulesOf(repository.ThresholdAlert, repository.RateAlert)
+	engine.mutex.Unlock()
+
+	for _, rule := range rules {
+		if !inScope(rule, device) || (rule.ValueType.Valid && uint(rule.ValueType.Int64) != measurement.ValueType) {
+			continue
+		}
+		alert := repository.NewAlert{Value: sql.NullFloat64{Float64: value, Valid: true}, FiredAt: measurement.ReceivedAt}
+		var firing bool
+		switch rule.Kind {
+		case repository.ThresholdAlert:
+			firing = crosses(rule, value)
+			alert.Detail = fmt.Sprintf("%g is %s %g", value, rule.Comparison, rule.Threshold)
+		case repository.RateAlert:
+			if !seen || at <= previous.at {
+				continue
+			}
+			rate := (value - previous.value) / (float64(at-previous.at) / float64(time.Minute.Milliseconds()))
+			firing = crosses(rule, rate)
+			alert.Detail = fmt.Sprintf("changing by %.3g per minute, %s %g", rate, rule.Comparison, rule.Threshold)
+		}
+		engine.evaluate(rule, device, firing, alert)
+	}
+}
+
+/*
+RunOnce checks the absence of data rules at the time, firing for the devices in their
+scope without a measurement for the window. Like the presence monitor, only the devices
+with the Ok status, seen at least once, are checked, the others are expected to be quiet.
+The status rules are checked against the stored connectivity, in case an event was missed,
+except for the devices with an event since the last check, the store catching up on them.
+*/
+func (engine *Engine) RunOnce(ctx context.Context, now time.Time) error {
+	engine.mutex.Lock()
+	rules := engine.rulesOf(repository.AbsenceAlert, repository.StatusAlert)
+	heard := engine.heard
+	engine.heard = map[uint]bool{}
+	engine.mutex.Unlock()
+	if len(rules) == 0 {
+		return nil
+	}
+
+	devices, err := engine.devices.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		window := time.Duration(rule.WindowMillis) * time.Millisecond
+		for _, device := range devices {
+			if !inScope(rule, device) {
+				continue
+			}
+			if rule.Kind == repository.StatusAlert {
+				if !heard[device.ID] {
+					engine.evaluate(rule, device, device.Connectivity >= rule.Connectivity, repository.NewAlert{
+						Detail: fmt.Sprintf("device is %s", device.Connectivity), FiredAt: now.UnixMilli(),
+					})
+				}
+				continue
+			}
+
+			firing, err := engine.absent(ctx, rule, device, now)
+			if err != nil {
+				return err
+			}
+			engine.evaluate(rule, device, firing, repository.NewAlert{
+				Detail: fmt.Sprintf("no measurement for %s", window), FiredAt: now.UnixMilli(),
+			})
+		}
+	}
+	return nil
+}
+
+// absent is whether the device, expected to publish, has no measurement for the window of the rule
+func (engine *Engine) absent(ctx context.Context, rule repository.AlertRule, device repository.Device, now time.Time) (bool, error) {
+	if device.DeviceStatus != repository.Ok || !device.LastSeenAt.Valid {
+		return false, nil
+	}
+	window := time.Duration(rule.WindowMillis) * time.Millisecond
+	query := repository.MeasurementQuery{
+		DeviceID:    device.ID,
+		ByAccessory: engine.deviceTypes.Role(device.DeviceType) == repository.AccessoryRole,
+		From:        now.Add(-window).UnixMilli(),
+		To:          now.UnixMilli(),
+		Limit:       1,
+	}
+	if rule.ValueType.Valid {
+		valueType := uint(rule.ValueType.Int64)
+		query.ValueType = &valueType
+	}
+	measurements, err := engine.measurements.Query(ctx, query)
+	if err != nil {
+		return false, err
+	}
+	return len(measurements) == 0, nil
+}
+
+// status evaluates the status rules on a connectivity event of the presence monitor
+func (engine *Engine) status(ctx context.Context, event events.Event) {
+	connectivity, found := connectivities[event.Type]
+	if !found {
+		return
+	}
+	engine.mutex.Lock()
+	rules := engine.rulesOf(repository.StatusAlert)
+	engine.mutex.Unlock()
+	if len(rules) == 0 {
+		return
+	}
+
+	device, err := engine.devices.GetBySerial(ctx, event.SerialId)
+	if err != nil {
+		slog.Error("alerts", "status", "failed to get the device of the event", "serial_id", event.SerialId, "cause", err.Error())
+		return
+	}
+	engine.mutex.Lock()
+	engine.heard[device.ID] = true
+	engine.mutex.Unlock()
+	for _, rule := range rules {
+		if inScope(rule, device) {
+			engine.evaluate(rule, device, connectivity >= rule.Connectivity, repository.NewAlert{
+				Detail: fmt.Sprintf("device is %s", connectivity), FiredAt: event.At.UnixMilli(),
+			})
+		}
+	}
+}
+
+/*
+Run writes the alerts queued, checks the absence of data and status rules each interval,
+and the status rules on every event, each in a goroutine of its own so a slow check never
+leaves the events to be dropped. It blocks until the context is done, writing what is
+still queued before returning.
+*/
+func (engine *Engine) Run(ctx context.Context) {
+	var workers sync.WaitGroup
+	defer workers.Wait()
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		engine.write(ctx)
+	}()
+	go func() {
+		defer workers.Done()
+		engine.check(ctx)
+	}()
+
+	subscription, unsubscribe := engine.bus.Subscribe(100)
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-subscription:
+			engine.status(ctx, event)
+		}
+	}
+}
+
+// check runs RunOnce each interval, until the context is done
+func (engine *Engine) check(ctx context.Context) {
+	ticker := time.NewTicker(engine.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := engine.RunOnce(ctx, time.Now()); err != nil && !errors.Is(err, context.Canceled) {
+			slog.Error("alerts", "check-failure", err.Error())
+		}
+	}
+}
+
+// write fires and resolves the alerts queued, until the context is done
+func (engine *Engine) write(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			// Writes what was queued before the shutdown
+			engine.drain(context.Background())
+			return
+		case queued := <-engine.queue:
+			engine.apply(ctx, queued)
+		case done := <-engine.flushes:
+			engine.drain(ctx)
+			close(done)
+		}
+	}
+}
+
+// drain writes every alert queued, without waiting for more
+func (engine *Engine) drain(ctx context.Context) {
+	for {
+		select {
+		case queued := <-engine.queue:
+			engine.apply(ctx, queued)
+		default:
+			return
+		}
+	}
+}
+
+/*
+Flush waits until every alert queued before the call is written, it is meant for tests
+and tooling, the writer keeps up on its own.
+*/
+func (engine *Engine) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case engine.flushes <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+evaluate queues the alert of the rule for the device to fire when firing, and the one open
+to resolve otherwise, at the FiredAt of the alert. Nothing is queued while the state of the
+alert stays the same, and when the queue is full, the alert is left as it was, to be
+evaluated again.
+*/
+func (engine *Engine) evaluate(rule repository.AlertRule, device repository.Device, firing bool, alert repository.NewAlert) {
+	engine.openMutex.Lock()
+	defer engine.openMutex.Unlock()
+
+	key := openAlert{rule.ID, device.ID}
+	if firing == engine.open[key] {
+		return
+	}
+	select {
+	case engine.queue <- transition{rule, device, firing, alert}:
+	default:
+		slog.Warn("alerts", "dropped", rule.Name, "serial_id", device.SerialId, "cause", "queue full")
+		return
+	}
+	if firing {
+		engine.open[key] = true
+	} else {
+		delete(engine.open, key)
+	}
+}
+
+/*
+apply fires or resolves the alert queued, publishing the change. An alert that fails to be
+written is marked back as it was, so the next evaluation queues it again.
+*/
+func (engine *Engine) apply(ctx context.Context, queued transition) {
+	rule, device, alert := queued.rule, queued.device, queued.alert
+	engine.mutex.Lock()
+	deleted := !slices.ContainsFunc(engine.rules, func(current repository.AlertRule) bool { return current.ID == rule.ID })
+	engine.mutex.Unlock()
+	if deleted {
+		return
+	}
+
+	key := openAlert{rule.ID, device.ID}
+	if !queued.firing {
+		resolved, err := engine.repo.Resolve(ctx, rule.ID, device.ID, alert.FiredAt)
+		if errors.Is(err, repository.NotFound) {
+			return
+		}
+		if err != nil {
+			slog.Error("alerts", "status", "failed to resolve the alert", "rule", rule.Name, "serial_id", device.SerialId, "cause", err.Error())
+			engine.openMutex.Lock()
+			engine.open[key] = true
+			engine.openMutex.Unlock()
+			return
+		}
+		slog.Info("alerts", "status", "alert resolved", "rule", rule.Name, "serial_id", device.SerialId)
+		engine.publish(AlertResolved, resolved, time.UnixMilli(alert.FiredAt))
+		return
+	}
+
+	alert.RuleFk, alert.DeviceFk = rule.ID, device.ID
+	fired, err := engine.repo.Fire(ctx, alert)
+	if errors.Is(err, repository.AlreadyExists) {
+		return
+	}
+	if err != nil {
+		slog.Error("alerts", "status", "failed to fire the alert", "rule", rule.Name, "serial_id", device.SerialId, "cause", err.Error())
+		engine.openMutex.Lock()
+		delete(engine.open, key)
+		engine.openMutex.Unlock()
+		return
+	}
+	slog.Warn("alerts", "status", "alert firing", "rule", rule.Name, "serial_id", device.SerialId, "detail", alert.Detail)
+	engine.publish(AlertFiring, fired, time.UnixMilli(alert.FiredAt))
+}
+
+func (engine *Engine) publish(eventType events.Type, alert repository.Alert, at time.Time) {
+	engine.bus.Publish(events.Event{
+		Type:     eventType,
+		SerialId: alert.SerialId,
+		At:       at,
+		Details: map[string]any{
+			"alert_id": alert.ID,
+			"rule":     alert.RuleName,
+			"detail":   alert.Detail,
+		},
+	})
+}
@@ -0,0 +1,291 @@
+package alerts
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/events"
+	"github.com/TomascpMarques/maestro/measurementtypes"
+	"github.com/TomascpMarques/maestro/presence"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+type testEngine struct {
+	*Engine
+	repos       repository.Repositories
+	received    <-chan events.Event
+	temperature uint
+	vector      uint
+}
+
+func newTestEngine(t *testing.T) testEngine {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	bus := events.NewBus()
+	received, unsubscribe := bus.Subscribe(10)
+	t.Cleanup(unsubscribe)
+
+	deviceTypes, err := devicetypes.Load(ctx, repos.DeviceTypes)
+	assert.NoError(t, err)
+	measurementTypes, err := measurementtypes.Load(ctx, repos.MeasurementTypes)
+	assert.NoError(t, err)
+	temperature, err := measurementTypes.Create(ctx, repository.NewMeasurementType{Name: "temperature", Unit: "°C"})
+	assert.NoError(t, err)
+	vector, err := measurementTypes.Create(ctx, repository.NewMeasurementType{
+		Name: "acceleration", Unit: "m/s²", Encoding: repository.VectorEncoding,
+	})
+	assert.NoError(t, err)
+
+	engine, err := Load(ctx, repos.Alerts, repos.Devices, repos.Measurements, deviceTypes, measurementTypes, bus, Config{})
+	assert.NoError(t, err)
+	running, stop := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		engine.Run(running)
+	}()
+	t.Cleanup(func() {
+		stop()
+		<-stopped
+	})
+	return testEngine{engine, repos, received, temperature.ID, vector.ID}
+}
+
+// flush waits for the alerts queued to be written
+func (engine testEngine) flush(t *testing.T) {
+	assert.NoError(t, engine.Flush(context.Background()))
+}
+
+func (engine testEngine) publish(t *testing.T, device repository.Device, valueType uint, value string, at time.Time) {
+	engine.Observe(device, repository.NewMeasurement{
+		PublishingDeviceFk: device.ID, Value: value, ValueType: valueType, ReceivedAt: at.UnixMilli(),
+	})
+	engine.flush(t)
+}
+
+func TestCreateRule(t *testing.T) {
+	ctx := context.Background()
+	engine := newTestEngine(t)
+	now := time.UnixMilli(1_000_000)
+	accessory := repository.Accessory
+
+	_, err := engine.CreateRule(ctx, RuleRequest{Name: "unknown", Kind: 7}, "admin", now)
+	assert.ErrorIs(t, err, ErrInvalidRule)
+	_, err = engine.CreateRule(ctx, RuleRequest{Name: "short", Kind: repository.AbsenceAlert, Window: time.Second}, "admin", now)
+	assert.ErrorIs(t, err, ErrInvalidRule)
+	_, err = engine.CreateRule(ctx, RuleRequest{Name: "online", Kind: repository.StatusAlert, Connectivity: repository.Online}, "admin", now)
+	assert.ErrorIs(t, err, ErrInvalidRule)
+	_, err = engine.CreateRule(ctx, RuleRequest{Name: "vector", Kind: repository.ThresholdAlert, ValueType: &engine.vector}, "admin", now)
+	assert.ErrorIs(t, err, ErrInvalidRule)
+	missing := uint(99)
+	_, err = engine.CreateRule(ctx, RuleRequest{Name: "missing", Kind: repository.ThresholdAlert, ValueType: &missing}, "admin", now)
+	assert.ErrorIs(t, err, measurementtypes.ErrUnknownType)
+	_, err = engine.CreateRule(ctx, RuleRequest{Name: "device", Kind: repository.ThresholdAlert, SerialId: "PMD-000001"}, "admin", now)
+	assert.ErrorIs(t, err, repository.NotFound)
+
+	rule, err := engine.CreateRule(ctx, RuleRequest{
+		Name: "hot accessories", Kind: repository.ThresholdAlert, DeviceType: &accessory, ValueType: &engine.temperature,
+		Threshold: 30,
+	}, "admin", now)
+	assert.NoError(t, err)
+	assert.Equal(t, "admin", rule.CreatedBy)
+	_, err = engine.CreateRule(ctx, RuleRequest{Name: "hot accessories", Kind: repository.ThresholdAlert}, "admin", now)
+	assert.ErrorIs(t, err, repository.AlreadyExists)
+
+	rules, err := engine.Rules(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, rules, 1)
+	assert.NoError(t, engine.DeleteRule(ctx, rule.ID, "admin"))
+	assert.Empty(t, engine.rules)
+}
+
+func TestThresholdAndRate(t *testing.T) {
+	ctx := context.Background()
+	engine := newTestEngine(t)
+	now := time.UnixMilli(1_000_000)
+
+	pmd, err := engine.repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000001", DeviceType: repository.PMD})
+	assert.NoError(t, err)
+	other, err := engine.repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000002", DeviceType: repository.PMD})
+	assert.NoError(t, err)
+
+	threshold, err := engine.CreateRule(ctx, RuleRequest{
+		Name: "hot", Kind: repository.ThresholdAlert, SerialId: pmd.SerialId, ValueType: &engine.temperature, Threshold: 30,
+	}, "admin", now)
+	assert.NoError(t, err)
+	rate, err := engine.CreateRule(ctx, RuleRequest{
+		Name: "cooling fast", Kind: repository.RateAlert, ValueType: &engine.temperature,
+		Comparison: repository.Below, Threshold: -5,
+	}, "admin", now)
+	assert.NoError(t, err)
+
+	// The first value has no rate, and the other device is out of the scope of the threshold
+	engine.publish(t, pmd, engine.temperature, "31", now)
+	engine.publish(t, other, engine.temperature, "40", now)
+	engine.publish(t, pmd, engine.temperature, "35", now.Add(time.Minute))
+	// Non numeric values, and the other measurement types, are skipped
+	engine.publish(t, pmd, engine.temperature, "hot", now.Add(time.Minute))
+	engine.publish(t, pmd, 0, "10", now.Add(time.Minute))
+
+	fired := <-engine.received
+	assert.Equal(t, AlertFiring, fired.Type)
+	assert.Equal(t, pmd.SerialId, fired.SerialId)
+	assert.Empty(t, engine.received)
+
+	open, err := engine.Alerts(ctx, repository.AlertQuery{Open: true})
+	assert.NoError(t, err)
+	assert.Len(t, open, 1)
+	assert.Equal(t, threshold.ID, open[0].RuleFk)
+	assert.Equal(t, "31 is above 30", open[0].Detail)
+	assert.Equal(t, 31.0, open[0].Value.Float64)
+
+	// Dropping 15 degrees in two minutes, while falling back under the threshold
+	engine.publish(t, pmd, engine.temperature, "20", now.Add(3*time.Minute))
+	assert.Equal(t, AlertResolved, (<-engine.received).Type)
+	assert.Equal(t, AlertFiring, (<-engine.received).Type)
+
+	alerts, err := engine.Alerts(ctx, repository.AlertQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, alerts, 2)
+	assert.Equal(t, rate.ID, alerts[0].RuleFk)
+	assert.Equal(t, "changing by -7.5 per minute, below -5", alerts[0].Detail)
+	assert.Equal(t, 20.0, alerts[0].Value.Float64)
+	assert.Equal(t, repository.AlertResolved, alerts[1].State)
+	assert.Equal(t, now.Add(3*time.Minute).UnixMilli(), alerts[1].ResolvedAt.Int64)
+
+	// A value measured before the last one doesn't change the rate
+	engine.Observe(pmd, repository.NewMeasurement{
+		Value: "50", ValueType: engine.temperature, ReceivedAt: now.Add(4 * time.Minute).UnixMilli(),
+		MeasuredAt: sql.NullInt64{Int64: now.Add(2 * time.Minute).UnixMilli(), Valid: true},
+	})
+	engine.flush(t)
+	assert.Equal(t, AlertFiring, (<-engine.received).Type)
+	assert.Empty(t, engine.received)
+}
+
+func TestAcknowledge(t *testing.T) {
+	ctx := context.Background()
+	engine := newTestEngine(t)
+	now := time.UnixMilli(1_000_000)
+
+	pmd, err := engine.repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000001", DeviceType: repository.PMD})
+	assert.NoError(t, err)
+	_, err = engine.CreateRule(ctx, RuleRequest{
+		Name: "cold", Kind: repository.ThresholdAlert, Comparison: repository.Below, Threshold: 0,
+	}, "admin", now)
+	assert.NoError(t, err)
+
+	engine.publish(t, pmd, engine.temperature, "-2", now)
+	fired := <-engine.received
+	id := fired.Details["alert_id"].(uint)
+
+	acknowledged, err := engine.Acknowledge(ctx, id, "operator", now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, repository.AlertAcknowledged, acknowledged.State)
+	assert.Equal(t, "operator", acknowledged.AcknowledgedBy.String)
+	assert.Equal(t, AlertAcknowledged, (<-engine.received).Type)
+	_, err = engine.Acknowledge(ctx, id, "operator", now.Add(time.Minute))
+	assert.ErrorIs(t, err, ErrNotFiring)
+	_, err = engine.Acknowledge(ctx, 99, "operator", now.Add(time.Minute))
+	assert.ErrorIs(t, err, repository.NotFound)
+
+	// Acknowledged, the alert stays open, and doesn't fire again
+	engine.publish(t, pmd, engine.temperature, "-3", now.Add(2*time.Minute))
+	assert.Empty(t, engine.received)
+	engine.publish(t, pmd, engine.temperature, "4", now.Add(3*time.Minute))
+	assert.Equal(t, AlertResolved, (<-engine.received).Type)
+
+	// The alerts open are loaded back along with the rules
+	engine.publish(t, pmd, engine.temperature, "-1", now.Add(4*time.Minute))
+	<-engine.received
+	reloaded, err := Load(ctx, engine.repos.Alerts, engine.repos.Devices, engine.repos.Measurements,
+		engine.deviceTypes, engine.measurementTypes, engine.bus, Config{})
+	assert.NoError(t, err)
+	assert.Len(t, reloaded.rules, 1)
+	assert.Len(t, reloaded.open, 1)
+}
+
+func TestAbsenceAndStatus(t *testing.T) {
+	ctx := context.Background()
+	engine := newTestEngine(t)
+	now := time.UnixMilli(10_000_000)
+
+	pmd, err := engine.repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000001", DeviceType: repository.PMD})
+	assert.NoError(t, err)
+	// Never seen, the device isn't expected to publish
+	_, err = engine.repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000002", DeviceType: repository.PMD})
+	assert.NoError(t, err)
+	assert.NoError(t, engine.repos.Devices.MarkSeen(ctx, map[uint]int64{pmd.ID: now.UnixMilli()}))
+
+	_, err = engine.CreateRule(ctx, RuleRequest{
+		Name: "quiet", Kind: repository.AbsenceAlert, ValueType: &engine.temperature, Window: 5 * time.Minute,
+	}, "admin", now)
+	assert.NoError(t, err)
+	_, err = engine.CreateRule(ctx, RuleRequest{
+		Name: "offline", Kind: repository.StatusAlert, Connectivity: repository.Offline,
+	}, "admin", now)
+	assert.NoError(t, err)
+
+	_, err = engine.repos.Measurements.Insert(ctx, repository.NewMeasurement{
+		PublishingDeviceFk: pmd.ID, Value: "20", ValueType: engine.temperature, ReceivedAt: now.UnixMilli(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, engine.RunOnce(ctx, now.Add(4*time.Minute)))
+	engine.flush(t)
+	assert.Empty(t, engine.received)
+
+	assert.NoError(t, engine.RunOnce(ctx, now.Add(6*time.Minute)))
+	engine.flush(t)
+	fired := <-engine.received
+	assert.Equal(t, AlertFiring, fired.Type)
+	assert.Equal(t, pmd.SerialId, fired.SerialId)
+	assert.Equal(t, "no measurement for 5m0s", fired.Details["detail"])
+	assert.Empty(t, engine.received)
+
+	// Suspended, the device is expected to be quiet
+	_, err = engine.repos.Devices.UpdateStatus(ctx, pmd.SerialId, repository.StatusChange{
+		Status: repository.Suspended, Actor: "admin", At: now.UnixMilli(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, engine.RunOnce(ctx, now.Add(7*time.Minute)))
+	engine.flush(t)
+	assert.Equal(t, AlertResolved, (<-engine.received).Type)
+
+	// Stale isn't enough to fire the status rule
+	engine.status(ctx, events.Event{Type: presence.DeviceStale, SerialId: pmd.SerialId, At: now})
+	engine.flush(t)
+	assert.Empty(t, engine.received)
+	engine.status(ctx, events.Event{Type: presence.DeviceOffline, SerialId: pmd.SerialId, At: now})
+	engine.flush(t)
+	fired = <-engine.received
+	assert.Equal(t, "device is offline", fired.Details["detail"])
+	engine.status(ctx, events.Event{Type: presence.DeviceOnline, SerialId: pmd.SerialId, At: now.Add(time.Minute)})
+	engine.flush(t)
+	assert.Equal(t, AlertResolved, (<-engine.received).Type)
+
+	// A missed event is caught up on from the stored connectivity, at the next check
+	assert.NoError(t, engine.RunOnce(ctx, now.Add(2*time.Minute)))
+	engine.flush(t)
+	assert.NoError(t, engine.repos.Devices.SetConnectivity(ctx, pmd.ID, repository.Offline))
+	assert.NoError(t, engine.RunOnce(ctx, now.Add(3*time.Minute)))
+	engine.flush(t)
+	fired = <-engine.received
+	assert.Equal(t, AlertFiring, fired.Type)
+	assert.Equal(t, "device is offline", fired.Details["detail"])
+
+	// The store catches up on an event at the next check, until then the event is kept
+	engine.status(ctx, events.Event{Type: presence.DeviceOnline, SerialId: pmd.SerialId, At: now.Add(4 * time.Minute)})
+	engine.flush(t)
+	assert.Equal(t, AlertResolved, (<-engine.received).Type)
+	assert.NoError(t, engine.RunOnce(ctx, now.Add(4*time.Minute)))
+	engine.flush(t)
+	assert.Empty(t, engine.received)
+	assert.NoError(t, engine.repos.Devices.SetConnectivity(ctx, pmd.ID, repository.Online))
+	assert.NoError(t, engine.RunOnce(ctx, now.Add(5*time.Minute)))
+	engine.flush(t)
+	assert.Empty(t, engine.received)
+}
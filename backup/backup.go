@@ -76,43 +76,51 @@ func compressFile(file *os.File) *CompressionError {
 	return nil
 }
 
+/*
+BackupLocations is what gets backed up, and where to. With a Snapshot, the copy is
+written by it, a db in WAL mode holds committed pages outside of its main file, copying
+the file alone would miss them, sqlite writes a consistent copy with VACUUM INTO.
+*/
 type BackupLocations struct {
 	SourceLocation string
 	BackupLocation string
+	// Writes a consistent copy of the source into the destination, which doesn't exist yet
+	Snapshot func(destination string) error
 }
 
-func backupFile(locations BackupLocations) (err error) {
-	fileName := filepath.Base(locations.SourceLocation)
-	destinationFilename := filepath.Clean(
-		fmt.Sprintf(
-			"%s/%s-bkup",
-			locations.BackupLocation,
-			filepath.Base(locations.SourceLocation),
-		),
-	)
-	destinationBkpFileName := filepath.Base(destinationFilename)
-
-	slog.Info("backup-file", "init-backup", fmt.Sprintf("starting backing up file [%s] into [%s]", fileName, destinationFilename))
-
-	err = os.MkdirAll(locations.BackupLocation, 0740)
-	if err != nil {
-		slog.Error("backup-file", "create-destination", "failed to create back-up destination")
-		return
+// snapshotFile writes the copy through the snapshot, opening it to be compressed
+func snapshotFile(snapshot func(destination string) error, destinationFilename string) (*os.File, error) {
+	// The snapshot refuses to write over a file, like the one left by a failed compression
+	if err := os.Remove(destinationFilename); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("backup-file", "write-backup-operation", "failed to remove the previous backup file")
+		return nil, err
 	}
+	if err := snapshot(destinationFilename); err != nil {
+		slog.Error("backup-file", "write-backup-operation", "failed to snapshot the source into the backup file", "cause", err.Error())
+		return nil, err
+	}
+	return os.Open(destinationFilename)
+}
 
-	original, err := os.Open(locations.SourceLocation)
+// copyFile copies the source byte by byte, the returned copy is left at its start
+func copyFile(sourceLocation, destinationFilename string) (_ *os.File, err error) {
+	original, err := os.Open(sourceLocation)
 	if err != nil {
 		slog.Error("backup-file", "read-backup-operation", "failed to read the file to be backed-up")
-		return
+		return nil, err
 	}
 	defer original.Close()
 
 	destinationBkpFile, err := os.Create(destinationFilename)
 	if err != nil {
 		slog.Error("backup-file", "write-backup-operation", "failed to create the destination file for the backup")
-		return
+		return nil, err
 	}
-	defer destinationBkpFile.Close()
+	defer func() {
+		if err != nil {
+			destinationBkpFile.Close()
+		}
+	}()
 
 	const BUFFER_SIZE = 5324288 // 5 Mebibyte
 	READ_BUFFER := make([]byte, BUFFER_SIZE)
@@ -125,20 +133,57 @@ func backupFile(locations BackupLocations) (err error) {
 		}
 		if readErr != nil {
 			slog.Error("backup-file", "read-backup-operation", "failed to read a part of the file into a buffer")
-			err = readErr
-			break
+			return nil, readErr
 		}
 		if readN == 0 {
 			break
 		}
 
-		_, err = destinationBkpFile.Write(READ_BUFFER)
+		_, err = destinationBkpFile.Write(READ_BUFFER[:readN])
 		if err != nil {
 			slog.Error("backup-file", "write-backup-operation", "failed to write the buffer contents into the file")
-			return
+			return nil, err
 		}
 	}
 
+	// The archive is read from the copy, which was left at its end by the writes
+	if _, err = destinationBkpFile.Seek(0, io.SeekStart); err != nil {
+		slog.Error("backup-file", "read-backup-operation", "failed to rewind the backup file")
+		return nil, err
+	}
+	return destinationBkpFile, nil
+}
+
+func backupFile(locations BackupLocations) (err error) {
+	fileName := filepath.Base(locations.SourceLocation)
+	destinationFilename := filepath.Clean(
+		fmt.Sprintf(
+			"%s/%s-bkup",
+			locations.BackupLocation,
+			filepath.Base(locations.SourceLocation),
+		),
+	)
+	destinationBkpFileName := filepath.Base(destinationFilename)
+
+	slog.Info("backup-file", "init-backup", fmt.Sprintf("starting backing up file [%s] into [%s]", fileName, destinationFilename))
+
+	err = os.MkdirAll(locations.BackupLocation, 0740)
+	if err != nil {
+		slog.Error("backup-file", "create-destination", "failed to create back-up destination")
+		return
+	}
+
+	var destinationBkpFile *os.File
+	if locations.Snapshot != nil {
+		destinationBkpFile, err = snapshotFile(locations.Snapshot, destinationFilename)
+	} else {
+		destinationBkpFile, err = copyFile(locations.SourceLocation, destinationFilename)
+	}
+	if err != nil {
+		return
+	}
+	defer destinationBkpFile.Close()
+
 	slog.Info("backup-file", "finished-backup", fmt.Sprintf("done backing up file [%s], success", fileName))
 
 	if compressionError := compressFile(destinationBkpFile); compressionError != nil {
@@ -169,6 +214,7 @@ const (
 	BackupEnded
 	BackupPaused
 	BackupSkipped
+	BackupResumed
 )
 
 type BackupTaskSignal struct {
@@ -187,21 +233,42 @@ const (
 	EndBackupTask TaskHandleSignal = 1 + iota
 	PauseBackupTask
 	SkipBackupTask
+	ResumeBackupTask
 )
 
+// Size of the buffer of task signals, once full new signals are dropped instead of blocking the task
+const taskSignalBuffer = 20
+
+// notify sends the signal to the task caller, without ever blocking the task on it
+func notify(signalTheHandler chan<- BackupTaskSignal, signal BackupTaskSignal) {
+	select {
+	case signalTheHandler <- signal:
+	default:
+		slog.Warn("database-backup", "dropped-signal", fmt.Sprintf("no one is reading the task signals, dropped status [%d]", signal.Status))
+	}
+}
+
 /*
 CreateFileBackupTask will create a worker that will backup and archive said backup,
 repeating that process within a given interval.
 This function also returns the ticker that will be used to start the archive action,
 and a channel that will inform the task caller of the current state of the worker on any change.
 A channel will also be provided to the function, to enable finer control of the backup activity,
-not of archiving activity.
+not of archiving activity. A paused task backs up again once it receives ResumeBackupTask.
+While the gate is blocked every backup is skipped, paused or not.
 */
-func CreateFileBackupTask(backups BackupLocations, taskHandle <-chan TaskHandleSignal, backupInterval time.Duration) /* Returns */ (
-	signalTheHandler chan<- BackupTaskSignal,
+func CreateFileBackupTask(
+	backups BackupLocations,
+	taskHandle <-chan TaskHandleSignal,
+	gate *Gate,
+	backupInterval time.Duration,
+) /* Returns */ (
+	signalTheHandler <-chan BackupTaskSignal,
 	ticker *time.Ticker,
 ) {
 	ticker = time.NewTicker(backupInterval)
+	signals := make(chan BackupTaskSignal, taskSignalBuffer)
+	signalTheHandler = signals
 	go func() {
 		skipBackup := false
 		pauseBackup := false
@@ -210,11 +277,11 @@ func CreateFileBackupTask(backups BackupLocations, taskHandle <-chan TaskHandleS
 			case taskSignal := <-taskHandle:
 				switch taskSignal {
 				case EndBackupTask:
-					signalTheHandler <- BackupTaskSignal{
+					notify(signals, BackupTaskSignal{
 						Done:   true,
 						Status: BackupEnded,
 						Error:  nil,
-					}
+					})
 					ticker.Stop()
 					slog.Info(
 						"database-backup",
@@ -223,11 +290,11 @@ func CreateFileBackupTask(backups BackupLocations, taskHandle <-chan TaskHandleS
 					)
 					return
 				case PauseBackupTask:
-					signalTheHandler <- BackupTaskSignal{
+					notify(signals, BackupTaskSignal{
 						Done:   false,
 						Status: BackupPaused,
 						Error:  nil,
-					}
+					})
 					pauseBackup = true
 					slog.Info(
 						"database-backup",
@@ -236,17 +303,29 @@ func CreateFileBackupTask(backups BackupLocations, taskHandle <-chan TaskHandleS
 					)
 					continue
 				case SkipBackupTask:
-					signalTheHandler <- BackupTaskSignal{
+					notify(signals, BackupTaskSignal{
 						Done:   false,
 						Status: BackupSkipped,
 						Error:  nil,
-					}
+					})
 					slog.Info(
 						"database-backup",
 						"behaviour-termination",
 						fmt.Sprintf("skipping all following backups, requested at %s", time.UTC.String()),
 					)
 					skipBackup = true
+				case ResumeBackupTask:
+					notify(signals, BackupTaskSignal{
+						Done:   false,
+						Status: BackupResumed,
+						Error:  nil,
+					})
+					pauseBackup = false
+					slog.Info(
+						"database-backup",
+						"behaviour-change",
+						fmt.Sprintf("resuming the following backups, requested at %s", time.Now().UTC().String()),
+					)
 				}
 
 			case <-ticker.C:
@@ -267,22 +346,30 @@ func CreateFileBackupTask(backups BackupLocations, taskHandle <-chan TaskHandleS
 					)
 					continue
 				}
+				if gate.Blocked() {
+					slog.Warn(
+						"database-backup",
+						"behaviour-change",
+						fmt.Sprintf("the db failed its integrity checks, skipped backup at %s", time.Now().UTC().String()),
+					)
+					continue
+				}
 
 				err := backupFile(backups)
 				if err != nil {
-					signalTheHandler <- BackupTaskSignal{
+					notify(signals, BackupTaskSignal{
 						Done:   false,
 						Status: BackupFailed,
 						Error:  err,
-					}
+					})
 					continue
 				}
 				// After backup is done and successful, warn any observer
-				signalTheHandler <- BackupTaskSignal{
+				notify(signals, BackupTaskSignal{
 					Done:   false,
 					Status: BackupSuccess,
 					Error:  nil,
-				}
+				})
 			}
 		}
 	}()
@@ -1,10 +1,13 @@
 package backup
 
 import (
+	"context"
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"testing"
 
@@ -65,3 +68,143 @@ func TestBackUpFile(t *testing.T) {
 	// cleanUp
 	_ = os.RemoveAll(basePath)
 }
+
+func TestFileBackupTaskPauseAndResume(t *testing.T) {
+	basePath := "./.testing-backup-task/"
+	sourcePath := filepath.Join(basePath, "source_sql")
+	handleErr(os.MkdirAll(basePath, 0744))
+	handleErr(os.WriteFile(sourcePath, []byte("sqlite"), 0644))
+	defer os.RemoveAll(basePath)
+
+	taskHandle := make(chan TaskHandleSignal, 1)
+	taskHandle <- PauseBackupTask
+	signals, ticker := CreateFileBackupTask(
+		BackupLocations{SourceLocation: sourcePath, BackupLocation: filepath.Join(basePath, "dest")},
+		taskHandle,
+		nil,
+		5*time.Millisecond,
+	)
+	defer ticker.Stop()
+
+	assert.Equal(t, BackupPaused, (<-signals).Status)
+	select {
+	case signal := <-signals:
+		assert.Failf(t, "paused task should not backup", "got status %d", signal.Status)
+	case <-time.After(30 * time.Millisecond):
+	}
+
+	taskHandle <- ResumeBackupTask
+	assert.Equal(t, BackupResumed, (<-signals).Status)
+	assert.Equal(t, BackupSuccess, (<-signals).Status)
+
+	taskHandle <- EndBackupTask
+	for signal := range signals {
+		if signal.Status == BackupEnded {
+			break
+		}
+	}
+}
+
+func TestFileBackupTaskGate(t *testing.T) {
+	basePath := t.TempDir()
+	sourcePath := filepath.Join(basePath, "source_sql")
+	handleErr(os.WriteFile(sourcePath, []byte("sqlite"), 0644))
+
+	gate := &Gate{}
+	assert.True(t, gate.Block(true))
+	assert.False(t, gate.Block(true))
+	taskHandle := make(chan TaskHandleSignal, 1)
+	signals, ticker := CreateFileBackupTask(
+		BackupLocations{SourceLocation: sourcePath, BackupLocation: filepath.Join(basePath, "dest")},
+		taskHandle,
+		gate,
+		5*time.Millisecond,
+	)
+	defer ticker.Stop()
+
+	// Resuming the task doesn't lift the gate
+	taskHandle <- ResumeBackupTask
+	assert.Equal(t, BackupResumed, (<-signals).Status)
+	select {
+	case signal := <-signals:
+		assert.Failf(t, "blocked task should not backup", "got status %d", signal.Status)
+	case <-time.After(30 * time.Millisecond):
+	}
+
+	assert.True(t, gate.Block(false))
+	assert.Equal(t, BackupSuccess, (<-signals).Status)
+
+	taskHandle <- EndBackupTask
+	for signal := range signals {
+		if signal.Status == BackupEnded {
+			break
+		}
+	}
+}
+
+func TestController(t *testing.T) {
+	taskHandle := make(chan TaskHandleSignal, 1)
+	signals := make(chan BackupTaskSignal, 4)
+	controller := NewController(taskHandle, signals, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		controller.Run(context.Background())
+	}()
+
+	assert.NoError(t, controller.Send(PauseBackupTask))
+	assert.ErrorIs(t, controller.Send(SkipBackupTask), ErrTaskBusy)
+	assert.Equal(t, PauseBackupTask, <-taskHandle)
+
+	signals <- BackupTaskSignal{Status: BackupPaused}
+	signals <- BackupTaskSignal{Status: BackupFailed, Error: errors.New("disk full")}
+	assert.Eventually(t, func() bool {
+		state := controller.State()
+		return state.Paused && state.LastFailure == "disk full"
+	}, time.Second, time.Millisecond)
+
+	signals <- BackupTaskSignal{Status: BackupResumed}
+	signals <- BackupTaskSignal{Done: true, Status: BackupEnded}
+	<-done
+	state := controller.State()
+	assert.False(t, state.Paused)
+	assert.True(t, state.Ended)
+	assert.False(t, state.IntegrityBlocked)
+}
+
+func TestControllerGate(t *testing.T) {
+	gate := &Gate{}
+	controller := NewController(make(chan TaskHandleSignal, 1), make(chan BackupTaskSignal), gate)
+	assert.False(t, controller.State().IntegrityBlocked)
+	gate.Block(true)
+	assert.True(t, controller.State().IntegrityBlocked)
+	assert.False(t, controller.State().Paused)
+}
+
+func TestBackUpFileSnapshot(t *testing.T) {
+	basePath := t.TempDir()
+	destPath := filepath.Join(basePath, "dest")
+	sourceFilePath := filepath.Join(basePath, "source_sql")
+
+	// The snapshot writes the copy, the source file itself is never read
+	snapshots := 0
+	err := backupFile(BackupLocations{
+		SourceLocation: sourceFilePath,
+		BackupLocation: destPath,
+		Snapshot: func(destination string) error {
+			snapshots++
+			return os.WriteFile(destination, []byte("snapshot"), 0600)
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, snapshots)
+	assert.FileExists(t, filepath.Join(destPath, "source_sql-bkup.zip"))
+	assert.NoFileExists(t, filepath.Join(destPath, "source_sql-bkup"))
+
+	err = backupFile(BackupLocations{
+		SourceLocation: sourceFilePath,
+		BackupLocation: destPath,
+		Snapshot:       func(string) error { return errors.New("db is busy") },
+	})
+	assert.EqualError(t, err, "db is busy")
+}
@@ -0,0 +1,123 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The task signal could not be queued, the task is not keeping up with the signals sent
+var ErrTaskBusy = errors.New("backup task is busy, retry later")
+
+/*
+Gate blocks the backups while the db fails its integrity checks. It is kept apart from
+the pause of an operator, so the checks passing again never resume a task paused on
+purpose, and resuming the task never lets a corrupt db overwrite a good archive.
+The zero value is open, and a nil Gate is never blocked.
+*/
+type Gate struct {
+	blocked atomic.Bool
+}
+
+// Block closes or opens the gate, reporting whether that changed it
+func (gate *Gate) Block(blocked bool) (changed bool) {
+	if gate == nil {
+		return false
+	}
+	return gate.blocked.Swap(blocked) != blocked
+}
+
+func (gate *Gate) Blocked() bool {
+	return gate != nil && gate.blocked.Load()
+}
+
+// TaskState is what the backup task last reported, as followed by the Controller
+type TaskState struct {
+	Paused bool `json:"paused"`
+	// The integrity checks failed, no backup is taken until they pass, whether paused or not
+	IntegrityBlocked bool `json:"integrity_blocked"`
+	// The next backup is skipped
+	Skipping bool `json:"skipping"`
+	// The task was ended, and never backs up again
+	Ended bool `json:"ended"`
+	// Unix milliseconds of the last successful backup, 0 if there was none since the start
+	LastBackupAt int64 `json:"last_backup_at"`
+	// Unix milliseconds and cause of the last failed backup
+	LastFailureAt int64  `json:"last_failure_at"`
+	LastFailure   string `json:"last_failure,omitempty"`
+}
+
+/*
+Controller sends the signals of whoever controls the backup task, like the api, and
+follows the signals the task emits back, keeping its state. The gate of the integrity
+checks is read as the state is, it is never changed through the task handle.
+*/
+type Controller struct {
+	taskHandle chan<- TaskHandleSignal
+	signals    <-chan BackupTaskSignal
+	gate       *Gate
+
+	mutex sync.RWMutex
+	state TaskState
+}
+
+func NewController(taskHandle chan<- TaskHandleSignal, signals <-chan BackupTaskSignal, gate *Gate) *Controller {
+	return &Controller{taskHandle: taskHandle, signals: signals, gate: gate}
+}
+
+// Run follows the signals of the task until the context is done, or the task ends
+func (controller *Controller) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case signal := <-controller.signals:
+			controller.follow(signal, time.Now())
+			if signal.Done {
+				return
+			}
+		}
+	}
+}
+
+func (controller *Controller) follow(signal BackupTaskSignal, at time.Time) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	switch signal.Status {
+	case BackupSuccess:
+		controller.state.LastBackupAt = at.UnixMilli()
+		controller.state.Skipping = false
+	case BackupFailed:
+		controller.state.LastFailureAt = at.UnixMilli()
+		controller.state.LastFailure = signal.Error.Error()
+	case BackupPaused:
+		controller.state.Paused = true
+	case BackupResumed:
+		controller.state.Paused = false
+	case BackupSkipped:
+		controller.state.Skipping = true
+	case BackupEnded:
+		controller.state.Ended = true
+	}
+}
+
+func (controller *Controller) State() TaskState {
+	controller.mutex.RLock()
+	defer controller.mutex.RUnlock()
+	state := controller.state
+	state.IntegrityBlocked = controller.gate.Blocked()
+	return state
+}
+
+// Send queues the signal to the task, failing with ErrTaskBusy instead of blocking when the queue is full
+func (controller *Controller) Send(signal TaskHandleSignal) error {
+	select {
+	case controller.taskHandle <- signal:
+		return nil
+	default:
+		return ErrTaskBusy
+	}
+}
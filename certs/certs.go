@@ -0,0 +1,49 @@
+/*
+Package certs serves the api over TLS, keeping the certificate and key in memory and
+reloading them once renewed on disk, so a renewal never needs a restart.
+
+With a client CA, the clients are asked for a certificate issued by it, verified when
+given, the devices can then authenticate with their certificate instead of signing
+their requests, see the deviceauth package. A certificate is not required at the
+handshake, so the users of the api can still reach it without one.
+
+It also generates a self-signed CA, and the server and device certificates it issues,
+meant for bench testing, a deployment should use certificates from its own PKI.
+*/
+package certs
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrMissingFiles = errors.New("a certificate and a key are required")
+	// The client certificates are required, but there is no CA to verify them with
+	ErrMissingClientCA = errors.New("requiring client certificates needs a client CA")
+)
+
+// Config holds the files the TLS certificate, its key, and the CA of the client certificates are read from
+type Config struct {
+	CertFile string
+	KeyFile  string
+	// PEM file of the CA the client certificates are issued by, none when empty
+	ClientCAFile string
+	// Time between two checks of the files for a renewal
+	ReloadInterval time.Duration
+}
+
+// WithDefaults fills every value left out, checking the files every minute
+func (config Config) WithDefaults() Config {
+	if config.ReloadInterval == 0 {
+		config.ReloadInterval = time.Minute
+	}
+	return config
+}
+
+func (config Config) Validate() error {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return ErrMissingFiles
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/deviceauth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	ca, err := NewCA("test CA", time.Hour, now)
+	assert.NoError(t, err)
+	server, err := ca.IssueServer([]string{"127.0.0.1"}, time.Hour, now)
+	assert.NoError(t, err)
+	device, err := ca.IssueDevice("PMD-000001", time.Hour, now)
+	assert.NoError(t, err)
+	_, err = ca.IssueDevice("", time.Hour, now)
+	assert.Error(t, err)
+
+	path := func(name string) string { return filepath.Join(dir, name) }
+	assert.NoError(t, ca.Write(path("ca.crt"), path("ca.key")))
+	assert.NoError(t, server.Write(path("server.crt"), path("server.key")))
+	loaded, err := Load(path("ca.crt"), path("ca.key"))
+	assert.NoError(t, err)
+	assert.True(t, loaded.Certificate.Equal(ca.Certificate))
+	info, _ := os.Stat(path("server.key"))
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	_, err = NewStore(Config{CertFile: path("server.crt")})
+	assert.True(t, errors.Is(err, ErrMissingFiles))
+	store, err := NewStore(Config{CertFile: path("server.crt"), KeyFile: path("server.key"), ClientCAFile: path("ca.crt")})
+	assert.NoError(t, err)
+
+	httpServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serialId, _ := deviceauth.CertificateSerial(r.TLS)
+		_, _ = w.Write([]byte(serialId))
+	}))
+	httpServer.TLS = store.TLSConfig()
+	httpServer.StartTLS()
+	defer httpServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate)
+	client := func(certificates ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates}}}
+	}
+	get := func(client *http.Client) (string, *tls.ConnectionState, error) {
+		response, err := client.Get(httpServer.URL)
+		if err != nil {
+			return "", nil, err
+		}
+		defer response.Body.Close()
+		body := make([]byte, 64)
+		n, _ := response.Body.Read(body)
+		return string(body[:n]), response.TLS, nil
+	}
+
+	// A client without a certificate still connects, a device is known by its certificate
+	body, _, err := get(client())
+	assert.NoError(t, err)
+	assert.Empty(t, body)
+	deviceCertificate := tls.Certificate{Certificate: [][]byte{device.Certificate.Raw}, PrivateKey: device.Key}
+	body, state, err := get(client(deviceCertificate))
+	assert.NoError(t, err)
+	assert.Equal(t, "PMD-000001", body)
+	assert.True(t, state.PeerCertificates[0].Equal(server.Certificate))
+
+	// A certificate of another CA is never taken for a device
+	other, _ := NewCA("other CA", time.Hour, now)
+	stranger, _ := other.IssueDevice("PMD-000002", time.Hour, now)
+	body, _, _ = get(client(tls.Certificate{Certificate: [][]byte{stranger.Certificate.Raw}, PrivateKey: stranger.Key}))
+	assert.Empty(t, body)
+
+	// Nothing changed, nothing reloaded
+	reloaded, err := store.Reload()
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+
+	// A renewed certificate is used by the next connections
+	renewed, _ := ca.IssueServer([]string{"127.0.0.1"}, 2*time.Hour, now)
+	assert.NoError(t, renewed.Write(path("server.crt"), path("server.key")))
+	later := now.Add(time.Second)
+	assert.NoError(t, os.Chtimes(path("server.crt"), later, later))
+	reloaded, err = store.Reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	_, state, err = get(client())
+	assert.NoError(t, err)
+	assert.True(t, state.PeerCertificates[0].Equal(renewed.Certificate))
+
+	// A broken renewal keeps the previous certificate
+	assert.NoError(t, os.WriteFile(path("server.key"), []byte("broken"), 0o600))
+	_, err = store.Reload()
+	assert.Error(t, err)
+	_, state, err = get(client())
+	assert.NoError(t, err)
+	assert.True(t, state.PeerCertificates[0].Equal(renewed.Certificate))
+}
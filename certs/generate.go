@@ -0,0 +1,146 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// Issued is a certificate along with its private key
+type Issued struct {
+	Certificate *x509.Certificate
+	Key         *ecdsa.PrivateKey
+}
+
+// template fills what every certificate generated has, valid from now for the validity
+func template(commonName string, validity time.Duration, now time.Time) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"maestro"}},
+		// Covers a clock slightly behind
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(validity),
+	}, nil
+}
+
+func sign(template *x509.Certificate, parent *Issued) (Issued, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Issued{}, err
+	}
+	// A CA signs itself
+	parentCertificate, parentKey := template, key
+	if parent != nil {
+		parentCertificate, parentKey = parent.Certificate, parent.Key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCertificate, &key.PublicKey, parentKey)
+	if err != nil {
+		return Issued{}, err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return Issued{}, err
+	}
+	return Issued{certificate, key}, nil
+}
+
+// NewCA generates a self-signed CA, which issues the server and device certificates
+func NewCA(commonName string, validity time.Duration, now time.Time) (Issued, error) {
+	ca, err := template(commonName, validity, now)
+	if err != nil {
+		return Issued{}, err
+	}
+	ca.IsCA = true
+	ca.BasicConstraintsValid = true
+	ca.MaxPathLenZero = true
+	ca.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	return sign(ca, nil)
+}
+
+// IssueServer issues a certificate for the server, valid for the hosts, names or ip addresses
+func (ca Issued) IssueServer(hosts []string, validity time.Duration, now time.Time) (Issued, error) {
+	if len(hosts) == 0 {
+		return Issued{}, errors.New("a server certificate needs at least one host")
+	}
+	server, err := template(hosts[0], validity, now)
+	if err != nil {
+		return Issued{}, err
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			server.IPAddresses = append(server.IPAddresses, ip)
+		} else {
+			server.DNSNames = append(server.DNSNames, host)
+		}
+	}
+	server.KeyUsage = x509.KeyUsageDigitalSignature
+	server.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	return sign(server, &ca)
+}
+
+// IssueDevice issues a client certificate for the device, its serial id as the common name
+func (ca Issued) IssueDevice(serialId string, validity time.Duration, now time.Time) (Issued, error) {
+	if serialId == "" {
+		return Issued{}, errors.New("a device certificate needs a serial id")
+	}
+	device, err := template(serialId, validity, now)
+	if err != nil {
+		return Issued{}, err
+	}
+	device.KeyUsage = x509.KeyUsageDigitalSignature
+	device.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return sign(device, &ca)
+}
+
+// Write writes the certificate and its key as PEM files, the key readable only by its owner
+func (issued Issued) Write(certPath, keyPath string) error {
+	key, err := x509.MarshalECPrivateKey(issued.Key)
+	if err != nil {
+		return err
+	}
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issued.Certificate.Raw})
+	return errors.Join(
+		os.WriteFile(certPath, certificate, 0o644),
+		os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0o600),
+	)
+}
+
+// Load reads a certificate and its key written by Write
+func Load(certPath, keyPath string) (Issued, error) {
+	certificatePem, err := os.ReadFile(certPath)
+	if err != nil {
+		return Issued{}, err
+	}
+	keyPem, err := os.ReadFile(keyPath)
+	if err != nil {
+		return Issued{}, err
+	}
+
+	certificateBlock, _ := pem.Decode(certificatePem)
+	keyBlock, _ := pem.Decode(keyPem)
+	if certificateBlock == nil || keyBlock == nil {
+		return Issued{}, errors.New("no PEM block found")
+	}
+	certificate, err := x509.ParseCertificate(certificateBlock.Bytes)
+	if err != nil {
+		return Issued{}, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return Issued{}, err
+	}
+	return Issued{certificate, key}, nil
+}
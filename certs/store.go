@@ -0,0 +1,161 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long before its expiry a certificate loaded is reported as about to expire
+const expiryWarning = 14 * 24 * time.Hour
+
+/*
+Store keeps the certificate, its key, and the client CA in memory, reloading them
+when any of their files changes. A reload that fails keeps the previous ones in place,
+so a renewal caught halfway through, with only the certificate written, is retried.
+*/
+type Store struct {
+	config Config
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	// Modification dates of the files as last loaded
+	modified map[string]time.Time
+}
+
+// NewStore loads the files of the config into a new store
+func NewStore(config Config) (*Store, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	store := &Store{config: config.WithDefaults()}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *Store) files() []string {
+	files := []string{store.config.CertFile, store.config.KeyFile}
+	if store.config.ClientCAFile != "" {
+		files = append(files, store.config.ClientCAFile)
+	}
+	return files
+}
+
+func (store *Store) load() error {
+	modified := map[string]time.Time{}
+	for _, file := range store.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modified[file] = info.ModTime()
+	}
+
+	certificate, err := tls.LoadX509KeyPair(store.config.CertFile, store.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load the certificate: %w", err)
+	}
+	var clientCAs *x509.CertPool
+	if store.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(store.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("failed to load the client CA, no certificate found")
+		}
+	}
+
+	if leaf := certificate.Leaf; leaf != nil && time.Until(leaf.NotAfter) < expiryWarning {
+		slog.Warn("tls-certificate", "expires-at", leaf.NotAfter, "subject", leaf.Subject.String())
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.certificate = &certificate
+	store.clientCAs = clientCAs
+	store.modified = modified
+	return nil
+}
+
+// changed reports if any of the files was modified, or can't be read, since last loaded
+func (store *Store) changed() bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	for _, file := range store.files() {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(store.modified[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload loads the files again when any of them changed, reporting if they were
+func (store *Store) Reload() (bool, error) {
+	if !store.changed() {
+		return false, nil
+	}
+	if err := store.load(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Run checks the files for a renewal every reload interval, until the context is done
+func (store *Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(store.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := store.Reload()
+			if err != nil {
+				slog.Error("tls-reload", "cause", err.Error())
+				slog.Warn("tls-reload", "action", "keeping the previous certificate")
+				continue
+			}
+			if reloaded {
+				slog.Info("tls-reload", "status", "reloaded the certificate", "location", store.config.CertFile)
+			}
+		}
+	}
+}
+
+/*
+TLSConfig returns the config the server is given, each handshake reads the certificate
+and the client CA held then, so a reload applies to the next connections.
+*/
+func (store *Store) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			store.mutex.RLock()
+			defer store.mutex.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*store.certificate},
+			}
+			if store.clientCAs != nil {
+				config.ClientCAs = store.clientCAs
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return config, nil
+		},
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/TomascpMarques/maestro/certs"
+)
+
+const certsUsage = `usage: maestro certs <command> [flags], for bench testing only
+  ca      -dir D [-name N] [-days N]     generate a self-signed CA, as D/ca.crt and D/ca.key
+  server  -dir D -hosts H,... [-days N]  issue a server certificate from the CA in D, as D/server.crt and D/server.key
+  device  -dir D -serial S [-days N]     issue a device certificate from the CA in D, as D/<serial>.crt and D/<serial>.key`
+
+/*
+RunCertsCommand runs one of the `maestro certs` sub commands, generating a local CA,
+and the certificates it issues, into a directory. It needs no config, nor a db.
+*/
+func RunCertsCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(certsUsage)
+	}
+
+	command, args := args[0], args[1:]
+	flags := flag.NewFlagSet("certs "+command, flag.ContinueOnError)
+	dir := flags.String("dir", ".", "directory of the CA, where the files are written")
+	days := flags.Int("days", 365, "days the certificate is valid for")
+	name := flags.String("name", "maestro local CA", "common name of the CA")
+	hosts := flags.String("hosts", "localhost,127.0.0.1", "comma separated names and ip addresses of the server")
+	serialId := flags.String("serial", "", "serial id of the device, the common name of its certificate")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *days < 1 {
+		return errors.New("days should be positive")
+	}
+	validity := time.Duration(*days) * 24 * time.Hour
+	now := time.Now()
+	caCert, caKey := filepath.Join(*dir, "ca.crt"), filepath.Join(*dir, "ca.key")
+
+	var issued certs.Issued
+	var certPath, keyPath string
+	switch command {
+	case "ca":
+		ca, err := certs.NewCA(*name, validity, now)
+		if err != nil {
+			return err
+		}
+		issued, certPath, keyPath = ca, caCert, caKey
+
+	case "server", "device":
+		ca, err := certs.Load(caCert, caKey)
+		if err != nil {
+			return fmt.Errorf("failed to load the CA, generate it with `maestro certs ca`: %w", err)
+		}
+		if command == "server" {
+			issued, err = ca.IssueServer(strings.Split(*hosts, ","), validity, now)
+			certPath, keyPath = filepath.Join(*dir, "server.crt"), filepath.Join(*dir, "server.key")
+		} else {
+			issued, err = ca.IssueDevice(*serialId, validity, now)
+			certPath, keyPath = filepath.Join(*dir, *serialId+".crt"), filepath.Join(*dir, *serialId+".key")
+		}
+		if err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown certs command [%s]\n%s", command, certsUsage)
+	}
+
+	if err := issued.Write(certPath, keyPath); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s and %s, valid until %s\n", certPath, keyPath, issued.Certificate.NotAfter.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,285 @@
+/*
+Package clocksync keeps track of how far the clock of each device is from the one of
+the server. A device syncs like an NTP client, noting when it sent its request and when
+the answer arrived, around the times the server received and answered it, either
+through the time endpoint of the api or through the SNTP responder. The offset and
+round trip estimated from the four timestamps are recorded for the device, so the times
+it supplies can be corrected, and flagged once it drifts too far.
+*/
+package clocksync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+var (
+	ErrInvalidExchange = errors.New("invalid clock sync exchange")
+	// Half the round trip bounds the error of the offset, a slow exchange isn't accurate enough
+	ErrRoundTripTooLong = errors.New("clock sync round trip is too long")
+	// A measurement timed ahead of its arrival, once corrected
+	ErrFutureTimestamp = errors.New("timestamp is in the future")
+	ErrTimestampTooOld = errors.New("timestamp is too old")
+)
+
+// Config holds when a clock sync is too slow to be recorded, and when a clock is too far off
+type Config struct {
+	// A device whose clock is further off than this is flagged as skewed
+	MaxSkew time.Duration
+	// Longest round trip of a clock sync recorded
+	MaxRoundTrip time.Duration
+	// UDP address the SNTP responder listens on, it isn't started when empty
+	SNTPAddress string
+	// How far ahead of its arrival a time supplied by a device is accepted, once corrected
+	MaxFuture time.Duration
+	// How long before its arrival a time supplied by a device is accepted, a device buffering while offline
+	MaxAge time.Duration
+}
+
+/*
+WithDefaults fills every value left out, clocks skewed once more than 2 seconds off,
+synced within a round trip of 1 second, and the times supplied by the devices accepted
+from 7 days before their arrival to 5 seconds after it.
+*/
+func (config Config) WithDefaults() Config {
+	if config.MaxSkew == 0 {
+		config.MaxSkew = 2 * time.Second
+	}
+	if config.MaxRoundTrip == 0 {
+		config.MaxRoundTrip = time.Second
+	}
+	if config.MaxFuture == 0 {
+		config.MaxFuture = 5 * time.Second
+	}
+	if config.MaxAge == 0 {
+		config.MaxAge = 7 * 24 * time.Hour
+	}
+	return config
+}
+
+// Validate checks the values once filled
+func (config Config) Validate() error {
+	config = config.WithDefaults()
+	if config.MaxSkew < 0 || config.MaxRoundTrip < 0 {
+		return fmt.Errorf("max_skew and max_round_trip should be positive")
+	}
+	if config.MaxFuture < 0 || config.MaxAge < 0 {
+		return fmt.Errorf("max_future and max_age should be positive")
+	}
+	return nil
+}
+
+/*
+Exchange holds the four timestamps of a clock sync, in unix nanoseconds, the device sends
+its request at Originate, the server receives it at Receive and answers at Transmit, and
+the answer arrives at Destination. Originate and Destination are read from the clock of
+the device, Receive and Transmit from the one of the server.
+*/
+type Exchange struct {
+	Originate   int64 `json:"originate"`
+	Receive     int64 `json:"receive"`
+	Transmit    int64 `json:"transmit"`
+	Destination int64 `json:"destination"`
+}
+
+// Offset is the time added to the clock of the device to get the one of the server, assuming a symmetric link
+func (exchange Exchange) Offset() time.Duration {
+	return time.Duration(((exchange.Receive - exchange.Originate) + (exchange.Transmit - exchange.Destination)) / 2)
+}
+
+// RoundTrip is the time the exchange spent on the link, without the time the server took to answer
+func (exchange Exchange) RoundTrip() time.Duration {
+	return time.Duration((exchange.Destination - exchange.Originate) - (exchange.Transmit - exchange.Receive))
+}
+
+// Clock is the clock of a device, skewed when its offset is over the max skew
+type Clock struct {
+	repository.DeviceClock
+	Skewed bool `json:"skewed"`
+}
+
+// Offset is the time added to the clock of the device to get the one of the server
+func (clock Clock) Offset() time.Duration {
+	return time.Duration(clock.OffsetMicros) * time.Microsecond
+}
+
+/*
+Service records the clock syncs of the devices, and corrects the times they supply.
+The clocks are read once from the repository and kept in memory, correcting a time is
+on the path of every publish, each Record replaces the clock kept for its device.
+Forget drops every clock kept, once the repository holds them differently.
+*/
+type Service struct {
+	repo   repository.ClockRepository
+	config Config
+
+	mutex sync.RWMutex
+	// By device, a device that never synced is kept too, as not synced
+	clocks map[uint]cachedClock
+	// Counts the calls to Forget, a clock read before one isn't kept
+	generation uint64
+}
+
+type cachedClock struct {
+	recorded repository.DeviceClock
+	synced   bool
+}
+
+func NewService(repo repository.ClockRepository, config Config) *Service {
+	return &Service{repo: repo, config: config.WithDefaults(), clocks: map[uint]cachedClock{}}
+}
+
+func (service *Service) MaxSkew() time.Duration {
+	return service.config.MaxSkew
+}
+
+/*
+Forget drops every clock kept, they are read again from the repository. Called once the
+db leaves the in-memory fallback: merging its spill re-points the clocks to the ids of
+the devices in the db file, and combines the syncs recorded in both.
+*/
+func (service *Service) Forget() {
+	service.mutex.Lock()
+	service.clocks = map[uint]cachedClock{}
+	service.generation++
+	service.mutex.Unlock()
+}
+
+func (service *Service) clock(recorded repository.DeviceClock) Clock {
+	offset := time.Duration(recorded.OffsetMicros) * time.Microsecond
+	return Clock{DeviceClock: recorded, Skewed: offset.Abs() > service.config.MaxSkew}
+}
+
+/*
+Record estimates the offset of the clock of the device from the exchange, replacing the
+one recorded. The server timestamps of the exchange should be from the last minute, the
+device reporting the exchange right after it.
+*/
+func (service *Service) Record(ctx context.Context, device repository.Device, exchange Exchange, now time.Time) (Clock, error) {
+	if exchange.Originate <= 0 || exchange.Destination < exchange.Originate || exchange.Transmit < exchange.Receive {
+		return Clock{}, fmt.Errorf("%w: the timestamps are out of order", ErrInvalidExchange)
+	}
+	if exchange.Transmit > now.UnixNano() || now.UnixNano()-exchange.Receive > int64(time.Minute) {
+		return Clock{}, fmt.Errorf("%w: the server timestamps should be from the last minute", ErrInvalidExchange)
+	}
+	roundTrip := exchange.RoundTrip()
+	if roundTrip < 0 {
+		return Clock{}, fmt.Errorf("%w: the device answered before it asked", ErrInvalidExchange)
+	}
+	if roundTrip > service.config.MaxRoundTrip {
+		return Clock{}, fmt.Errorf("%w: %s, at most %s", ErrRoundTripTooLong, roundTrip, service.config.MaxRoundTrip)
+	}
+
+	service.mutex.RLock()
+	generation := service.generation
+	service.mutex.RUnlock()
+
+	recorded, err := service.repo.Record(ctx, repository.DeviceClock{
+		DeviceFk:        device.ID,
+		OffsetMicros:    exchange.Offset().Microseconds(),
+		RoundTripMicros: roundTrip.Microseconds(),
+		SyncedAt:        now.UnixMilli(),
+	})
+	if err != nil {
+		return Clock{}, err
+	}
+	service.mutex.Lock()
+	if service.generation == generation {
+		service.clocks[device.ID] = cachedClock{recorded: recorded, synced: true}
+	}
+	service.mutex.Unlock()
+
+	clock := service.clock(recorded)
+	if clock.Skewed {
+		slog.Warn("clock-sync", "status", "device clock skewed", "serial_id", device.SerialId,
+			"offset", clock.Offset().String(), "max_skew", service.config.MaxSkew.String())
+	}
+	return clock, nil
+}
+
+// Get returns the clock of the device, NotFound while it never synced
+func (service *Service) Get(ctx context.Context, device repository.Device) (Clock, error) {
+	service.mutex.RLock()
+	cached, found := service.clocks[device.ID]
+	generation := service.generation
+	service.mutex.RUnlock()
+
+	if !found {
+		recorded, err := service.repo.Get(ctx, device.ID)
+		if err != nil && !errors.Is(err, repository.NotFound) {
+			return Clock{}, err
+		}
+		cached = cachedClock{recorded: recorded, synced: err == nil}
+
+		service.mutex.Lock()
+		// A Record that ran meanwhile is newer than what was read, a Forget makes it stale
+		if current, recordedMeanwhile := service.clocks[device.ID]; recordedMeanwhile {
+			cached = current
+		} else if service.generation == generation {
+			service.clocks[device.ID] = cached
+		}
+		service.mutex.Unlock()
+	}
+
+	if !cached.synced {
+		return Clock{}, repository.NewRepositoryError(repository.NotFound, "no matching rows", "failed to get the clock of the device")
+	}
+	return service.clock(cached.recorded), nil
+}
+
+// Skewed returns the clock of every device further off than the max skew
+func (service *Service) Skewed(ctx context.Context) ([]Clock, error) {
+	recorded, err := service.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	skewed := []Clock{}
+	for _, device := range recorded {
+		if clock := service.clock(device); clock.Skewed {
+			skewed = append(skewed, clock)
+		}
+	}
+	return skewed, nil
+}
+
+/*
+Correct moves a time read from the clock of the device to the one of the server, by the
+offset of its last sync, reporting if the clock is skewed. The time of a device that
+never synced is left as is.
+*/
+func (service *Service) Correct(ctx context.Context, device repository.Device, at time.Time) (time.Time, bool, error) {
+	clock, err := service.Get(ctx, device)
+	if errors.Is(err, repository.NotFound) {
+		return at, false, nil
+	}
+	if err != nil {
+		return at, false, err
+	}
+	return at.Add(clock.Offset()), clock.Skewed, nil
+}
+
+/*
+Stamp checks a time supplied by the device for something it received at, correcting it
+first. A time too far ahead of its arrival, or from before the max age, is refused, a
+clock that far off can't be trusted even corrected. The time is flagged when the clock
+of the device is skewed.
+*/
+func (service *Service) Stamp(ctx context.Context, device repository.Device, at, received time.Time) (time.Time, bool, error) {
+	corrected, skewed, err := service.Correct(ctx, device, at)
+	if err != nil {
+		return at, false, err
+	}
+	if ahead := corrected.Sub(received); ahead > service.config.MaxFuture {
+		return at, skewed, fmt.Errorf("%w: %s ahead of the server, at most %s", ErrFutureTimestamp, ahead, service.config.MaxFuture)
+	}
+	if age := received.Sub(corrected); age > service.config.MaxAge {
+		return at, skewed, fmt.Errorf("%w: %s before the server, at most %s", ErrTimestampTooOld, age, service.config.MaxAge)
+	}
+	return corrected, skewed, nil
+}
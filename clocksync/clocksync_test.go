@@ -0,0 +1,216 @@
+package clocksync
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExchange(t *testing.T) {
+	// The device is 3 seconds behind, 40ms each way, the server answers in 5ms
+	server := time.UnixMilli(1_000_000)
+	exchange := Exchange{
+		Originate:   server.Add(-3*time.Second - 40*time.Millisecond).UnixNano(),
+		Receive:     server.UnixNano(),
+		Transmit:    server.Add(5 * time.Millisecond).UnixNano(),
+		Destination: server.Add(-3*time.Second + 45*time.Millisecond).UnixNano(),
+	}
+	assert.Equal(t, 3*time.Second, exchange.Offset())
+	assert.Equal(t, 80*time.Millisecond, exchange.RoundTrip())
+}
+
+func TestRecord(t *testing.T) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	service := NewService(repos.Clocks, Config{})
+	device, err := repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000001"})
+	assert.NoError(t, err)
+	now := time.UnixMilli(1_000_000)
+
+	// Never synced, the time is left as is
+	at, skewed, err := service.Correct(ctx, device, now)
+	assert.NoError(t, err)
+	assert.Equal(t, now, at)
+	assert.False(t, skewed)
+
+	ahead := func(offset, roundTrip time.Duration) Exchange {
+		return Exchange{
+			Originate:   now.Add(offset - roundTrip/2).UnixNano(),
+			Receive:     now.UnixNano(),
+			Transmit:    now.UnixNano(),
+			Destination: now.Add(offset + roundTrip/2).UnixNano(),
+		}
+	}
+	_, err = service.Record(ctx, device, Exchange{Originate: 10, Receive: now.UnixNano(), Transmit: now.UnixNano(), Destination: 5}, now)
+	assert.True(t, errors.Is(err, ErrInvalidExchange))
+	_, err = service.Record(ctx, device, ahead(0, 10*time.Millisecond), now.Add(2*time.Minute))
+	assert.True(t, errors.Is(err, ErrInvalidExchange))
+	_, err = service.Record(ctx, device, ahead(0, 2*time.Second), now)
+	assert.True(t, errors.Is(err, ErrRoundTripTooLong))
+
+	clock, err := service.Record(ctx, device, ahead(500*time.Millisecond, 10*time.Millisecond), now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-500_000), clock.OffsetMicros)
+	assert.Equal(t, int64(10_000), clock.RoundTripMicros)
+	assert.False(t, clock.Skewed)
+	at, skewed, err = service.Correct(ctx, device, now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(-500*time.Millisecond), at)
+	assert.False(t, skewed)
+	clocks, err := service.Skewed(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, clocks)
+
+	// Behind by more than the max skew
+	clock, err = service.Record(ctx, device, ahead(-5*time.Second, 10*time.Millisecond), now)
+	assert.NoError(t, err)
+	assert.True(t, clock.Skewed)
+	assert.Equal(t, uint(2), clock.Samples)
+	_, skewed, _ = service.Correct(ctx, device, now)
+	assert.True(t, skewed)
+	clocks, _ = service.Skewed(ctx)
+	assert.Len(t, clocks, 1)
+}
+
+func TestStamp(t *testing.T) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	service := NewService(repos.Clocks, Config{MaxFuture: time.Second, MaxAge: time.Hour})
+	device, err := repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000001"})
+	assert.NoError(t, err)
+	received := time.UnixMilli(1_000_000_000)
+
+	// Never synced, the times are only bounded
+	at, skewed, err := service.Stamp(ctx, device, received.Add(-time.Minute), received)
+	assert.NoError(t, err)
+	assert.Equal(t, received.Add(-time.Minute), at)
+	assert.False(t, skewed)
+	_, _, err = service.Stamp(ctx, device, received.Add(2*time.Second), received)
+	assert.True(t, errors.Is(err, ErrFutureTimestamp))
+	_, _, err = service.Stamp(ctx, device, received.Add(-2*time.Hour), received)
+	assert.True(t, errors.Is(err, ErrTimestampTooOld))
+
+	// 10 seconds ahead, corrected back within the bounds, but skewed
+	ahead := received.Add(10 * time.Second).UnixNano()
+	exchange := Exchange{Originate: ahead, Receive: received.UnixNano(), Transmit: received.UnixNano(), Destination: ahead}
+	_, err = service.Record(ctx, device, exchange, received)
+	assert.NoError(t, err)
+	at, skewed, err = service.Stamp(ctx, device, received.Add(9*time.Second), received)
+	assert.NoError(t, err)
+	assert.Equal(t, received.Add(-time.Second), at)
+	assert.True(t, skewed)
+}
+
+// countingClockRepository counts the clocks read from the repository
+type countingClockRepository struct {
+	repository.ClockRepository
+	reads int
+}
+
+func (repo *countingClockRepository) Get(ctx context.Context, deviceFk uint) (repository.DeviceClock, error) {
+	repo.reads++
+	return repo.ClockRepository.Get(ctx, deviceFk)
+}
+
+func TestCorrectCachesTheClocks(t *testing.T) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	device, err := repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000001"})
+	assert.NoError(t, err)
+	synced, err := repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000002"})
+	assert.NoError(t, err)
+	_, err = repos.Clocks.Record(ctx, repository.DeviceClock{DeviceFk: synced.ID, OffsetMicros: 1_000_000, SyncedAt: 1})
+	assert.NoError(t, err)
+	repo := &countingClockRepository{ClockRepository: repos.Clocks}
+	service := NewService(repo, Config{})
+	now := time.UnixMilli(1_000_000)
+
+	// Read once each, whether the device synced or not
+	for range 3 {
+		at, _, err := service.Correct(ctx, device, now)
+		assert.NoError(t, err)
+		assert.Equal(t, now, at)
+		at, _, err = service.Correct(ctx, synced, now)
+		assert.NoError(t, err)
+		assert.Equal(t, now.Add(time.Second), at)
+	}
+	assert.Equal(t, 2, repo.reads)
+	_, err = service.Get(ctx, device)
+	assert.True(t, errors.Is(err, repository.NotFound))
+
+	// Recording replaces the clock kept
+	behind := now.Add(-2 * time.Second).UnixNano()
+	_, err = service.Record(ctx, device, Exchange{Originate: behind, Receive: now.UnixNano(), Transmit: now.UnixNano(), Destination: behind}, now)
+	assert.NoError(t, err)
+	at, _, err := service.Correct(ctx, device, now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(2*time.Second), at)
+	assert.Equal(t, 2, repo.reads)
+
+	// Once forgotten, the clocks are read again
+	service.Forget()
+	at, _, err = service.Correct(ctx, synced, now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(time.Second), at)
+	assert.Equal(t, 3, repo.reads)
+}
+
+func TestSNTPResponder(t *testing.T) {
+	responder, err := ListenSNTP("127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		responder.Serve(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := net.Dial("udp", responder.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// Ignored, a server mode packet
+	request := make([]byte, sntpPacketSize)
+	request[0] = 4<<3 | sntpModeServer
+	_, _ = conn.Write(request)
+
+	originate := time.Now()
+	request[0] = 4<<3 | sntpModeClient
+	ntpTimestamp(request[40:], originate)
+	_, err = conn.Write(request)
+	assert.NoError(t, err)
+	answer := make([]byte, 128)
+	n, err := conn.Read(answer)
+	destination := time.Now()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, sntpPacketSize, n)
+	assert.Equal(t, byte(4<<3|sntpModeServer), answer[0])
+	assert.Equal(t, byte(sntpStratum), answer[1])
+	assert.Equal(t, request[40:48], answer[24:32])
+
+	exchange := Exchange{
+		Originate:   fromNTPTimestamp(answer[24:]).UnixNano(),
+		Receive:     fromNTPTimestamp(answer[32:]).UnixNano(),
+		Transmit:    fromNTPTimestamp(answer[40:]).UnixNano(),
+		Destination: destination.UnixNano(),
+	}
+	// Same clock on both ends, the offset is within the round trip
+	assert.LessOrEqual(t, exchange.Offset().Abs(), exchange.RoundTrip()+time.Microsecond)
+	assert.WithinDuration(t, originate, fromNTPTimestamp(answer[24:]), time.Microsecond)
+}
@@ -0,0 +1,114 @@
+package clocksync
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+)
+
+const (
+	sntpPacketSize = 48
+	// Seconds from the NTP era, 1900, to the unix epoch
+	ntpEpochOffset = 2_208_988_800
+	// Like the local clock of ntpd, a client with a better server at hand prefers it
+	sntpStratum = 10
+	// About a microsecond, 2^-20 seconds, as a signed byte
+	sntpPrecision = 0xec
+
+	sntpModeClient = 3
+	sntpModeServer = 4
+)
+
+// ntpTimestamp writes the time as an NTP timestamp, seconds since 1900 and their 32 bit fraction
+func ntpTimestamp(packet []byte, at time.Time) {
+	seconds := uint64(at.Unix() + ntpEpochOffset)
+	fraction := uint64(at.Nanosecond()) << 32 / uint64(time.Second)
+	binary.BigEndian.PutUint64(packet, seconds<<32|fraction)
+}
+
+// fromNTPTimestamp reads an NTP timestamp, in the era of the unix epoch
+func fromNTPTimestamp(packet []byte) time.Time {
+	timestamp := binary.BigEndian.Uint64(packet)
+	seconds := int64(timestamp>>32) - ntpEpochOffset
+	nanoseconds := int64((timestamp & 0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(seconds, nanoseconds)
+}
+
+/*
+Responder answers the SNTP requests of the devices (RFC 4330), with the time of the
+server. The requests aren't authenticated, a device reports the exchange through the
+api for its offset to be recorded.
+*/
+type Responder struct {
+	conn net.PacketConn
+}
+
+// ListenSNTP opens the UDP socket of the responder, the standard port 123 is privileged
+func ListenSNTP(address string) (*Responder, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &Responder{conn}, nil
+}
+
+func (responder *Responder) Addr() net.Addr {
+	return responder.conn.LocalAddr()
+}
+
+// Serve answers the requests until the context is done, closing the socket
+func (responder *Responder) Serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		responder.conn.Close()
+	}()
+
+	request := make([]byte, 512)
+	for {
+		n, client, err := responder.conn.ReadFrom(request)
+		received := time.Now()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error("clock-sync", "status", "failed to read an sntp request", "cause", err.Error())
+			continue
+		}
+
+		answer, ok := sntpAnswer(request[:n], received)
+		if !ok {
+			continue
+		}
+		ntpTimestamp(answer[40:], time.Now())
+		if _, err = responder.conn.WriteTo(answer, client); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("clock-sync", "status", "failed to answer an sntp request", "client", client.String(), "cause", err.Error())
+		}
+	}
+}
+
+// sntpAnswer builds the answer to a client request received at the time, the caller writes its transmit timestamp
+func sntpAnswer(request []byte, received time.Time) ([]byte, bool) {
+	if len(request) < sntpPacketSize {
+		return nil, false
+	}
+	version := request[0] >> 3 & 0x7
+	if request[0]&0x7 != sntpModeClient || version < 1 || version > 4 {
+		return nil, false
+	}
+
+	answer := make([]byte, sntpPacketSize)
+	// No leap second warning, the version of the client, server mode
+	answer[0] = version<<3 | sntpModeServer
+	answer[1] = sntpStratum
+	answer[2] = request[2]
+	answer[3] = sntpPrecision
+	copy(answer[12:16], "LOCL")
+	ntpTimestamp(answer[16:], received)
+	// The transmit timestamp of the client is its originate timestamp
+	copy(answer[24:32], request[40:48])
+	ntpTimestamp(answer[32:], received)
+	return answer, true
+}
@@ -0,0 +1,139 @@
+/*
+Package commands queues the commands sent to the devices, a reboot, a new sampling
+rate, a self-test. An operator queues a command for a device, the device fetches it
+by long-polling, or over server-sent events, and acknowledges it with its result.
+
+A command fetched but not acknowledged within the ack timeout is delivered again,
+up to its max attempts, and a command not done with by its expiry is expired.
+Every status a command goes through is recorded, with who moved it there.
+*/
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+// Commands the devices understand
+const (
+	Reboot          = "reboot"
+	SetSamplingRate = "set-sampling-rate"
+	SelfTest        = "self-test"
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrInvalidPayload = errors.New("invalid command payload")
+	ErrTTL            = errors.New("ttl outside the allowed range")
+	ErrMaxAttempts    = errors.New("max attempts outside the allowed range")
+	// Only a delivered command can be acknowledged, once
+	ErrNotDelivered = errors.New("command is not waiting for an acknowledgement")
+	ErrDone         = errors.New("command is already done with")
+)
+
+// Shortest sampling interval a device can be set to
+const minSamplingInterval = 100
+
+// SamplingRate is the payload of a set-sampling-rate command
+type SamplingRate struct {
+	// Milliseconds between two measurements
+	IntervalMs int64 `json:"interval_ms"`
+}
+
+// payloads checks the payload of each command, a command without one takes no arguments
+var payloads = map[string]func(payload repository.RawJSON) error{
+	Reboot:   noPayload,
+	SelfTest: noPayload,
+	SetSamplingRate: func(payload repository.RawJSON) error {
+		var rate SamplingRate
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&rate); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidPayload, err.Error())
+		}
+		if rate.IntervalMs < minSamplingInterval {
+			return fmt.Errorf("%w: interval_ms should be at least %d", ErrInvalidPayload, minSamplingInterval)
+		}
+		return nil
+	},
+}
+
+func noPayload(payload repository.RawJSON) error {
+	if len(payload) > 0 {
+		return fmt.Errorf("%w: the command takes no payload", ErrInvalidPayload)
+	}
+	return nil
+}
+
+// Validate checks that the command is known, and its payload is the one it takes
+func Validate(name string, payload repository.RawJSON) error {
+	check, found := payloads[name]
+	if !found {
+		return fmt.Errorf("%w: %q", ErrUnknownCommand, name)
+	}
+	return check(payload)
+}
+
+// Config holds how long the commands wait, for the device and for its acknowledgement
+type Config struct {
+	// Expiry of the commands queued without a ttl
+	DefaultTTL time.Duration
+	// Longest ttl a command can be queued with
+	MaxTTL time.Duration
+	// Time a device has to acknowledge a command before it is delivered again
+	AckTimeout time.Duration
+	// Attempts of the commands queued without max attempts
+	DefaultMaxAttempts uint
+	MaxAttempts        uint
+	// Longest a device waits on a poll for a command
+	MaxWait time.Duration
+	// Time between two sweeps of the expired and unacknowledged commands
+	SweepInterval time.Duration
+}
+
+/*
+WithDefaults fills every value left out, commands expiring after an hour, and at most
+a week, delivered up to 3 times, and at most 10, a minute apart, with polls of at most
+30 seconds, and a sweep every 30 seconds.
+*/
+func (config Config) WithDefaults() Config {
+	if config.DefaultTTL == 0 {
+		config.DefaultTTL = time.Hour
+	}
+	if config.MaxTTL == 0 {
+		config.MaxTTL = 7 * 24 * time.Hour
+	}
+	if config.AckTimeout == 0 {
+		config.AckTimeout = time.Minute
+	}
+	if config.DefaultMaxAttempts == 0 {
+		config.DefaultMaxAttempts = 3
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = 10
+	}
+	if config.MaxWait == 0 {
+		config.MaxWait = 30 * time.Second
+	}
+	if config.SweepInterval == 0 {
+		config.SweepInterval = 30 * time.Second
+	}
+	return config
+}
+
+// Validate checks that the defaults are within the limits, once filled
+func (config Config) Validate() error {
+	config = config.WithDefaults()
+	if config.DefaultTTL > config.MaxTTL {
+		return fmt.Errorf("the default ttl should not be longer than max_ttl")
+	}
+	if config.DefaultMaxAttempts > config.MaxAttempts {
+		return fmt.Errorf("the default max attempts should not be more than max_attempts")
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package commands
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+// Request is a command to queue, when the ttl or the max attempts are left out, the defaults of the config are used
+type Request struct {
+	Name        string
+	Payload     repository.RawJSON
+	TTL         time.Duration
+	MaxAttempts uint
+}
+
+/*
+Queue queues the commands of the devices, and hands them over as they fetch them.
+A device waiting on a poll is woken up as soon as a command is queued for it.
+*/
+type Queue struct {
+	commands repository.CommandRepository
+	config   Config
+
+	mutex sync.Mutex
+	// The polls waiting for a command, by device, closed once one is queued
+	waiters map[uint][]chan struct{}
+}
+
+func NewQueue(commands repository.CommandRepository, config Config) *Queue {
+	return &Queue{commands: commands, config: config.WithDefaults(), waiters: map[uint][]chan struct{}{}}
+}
+
+// MaxWait is the longest a poll waits for a command
+func (queue *Queue) MaxWait() time.Duration {
+	return queue.config.MaxWait
+}
+
+// Enqueue queues the command for the device, waking up its polls
+func (queue *Queue) Enqueue(ctx context.Context, device repository.Device, request Request, actor string, now time.Time) (repository.Command, error) {
+	if err := Validate(request.Name, request.Payload); err != nil {
+		return repository.Command{}, err
+	}
+	ttl := request.TTL
+	if ttl == 0 {
+		ttl = queue.config.DefaultTTL
+	}
+	if ttl < 0 || ttl > queue.config.MaxTTL {
+		return repository.Command{}, fmt.Errorf("%w: at most %s", ErrTTL, queue.config.MaxTTL)
+	}
+	maxAttempts := request.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = queue.config.DefaultMaxAttempts
+	}
+	if maxAttempts > queue.config.MaxAttempts {
+		return repository.Command{}, fmt.Errorf("%w: at most %d", ErrMaxAttempts, queue.config.MaxAttempts)
+	}
+
+	command, err := queue.commands.Create(ctx, repository.NewCommand{
+		DeviceFk:    device.ID,
+		Name:        request.Name,
+		Payload:     request.Payload,
+		MaxAttempts: maxAttempts,
+		CreatedBy:   actor,
+		CreatedAt:   now.UnixMilli(),
+		ExpiresAt:   now.Add(ttl).UnixMilli(),
+	})
+	if err != nil {
+		return repository.Command{}, err
+	}
+	slog.Info("commands", "status", "command queued", "serial_id", device.SerialId, "command", command.ID,
+		"name", command.Name, "actor", actor)
+	queue.notify(device.ID)
+	return command, nil
+}
+
+/*
+Poll delivers the commands due for the device, waiting up to wait, capped by the max
+wait of the config, for one to be queued when none is. No commands is not an error,
+the device polls again.
+*/
+func (queue *Queue) Poll(ctx context.Context, device repository.Device, wait time.Duration) ([]repository.Command, error) {
+	wait = min(max(wait, 0), queue.config.MaxWait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		// Waiting from before the fetch, so a command queued in between isn't missed
+		queued, stopWaiting := queue.wait(device.ID)
+		commands, err := queue.deliver(ctx, device, time.Now())
+		if err != nil || len(commands) > 0 {
+			stopWaiting()
+			return commands, err
+		}
+
+		select {
+		case <-queued:
+			continue
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		stopWaiting()
+		return commands, nil
+	}
+}
+
+func (queue *Queue) deliver(ctx context.Context, device repository.Device, now time.Time) ([]repository.Command, error) {
+	commands, err := queue.commands.Deliver(ctx, device.ID, device.SerialId, now.UnixMilli(),
+		now.Add(-queue.config.AckTimeout).UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	for _, command := range commands {
+		slog.Info("commands", "status", "command delivered", "serial_id", device.SerialId, "command", command.ID,
+			"attempt", command.Attempts)
+	}
+	return commands, nil
+}
+
+// wait registers a poll of the device, the returned func unregisters it
+func (queue *Queue) wait(deviceID uint) (<-chan struct{}, func()) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queued := make(chan struct{})
+	queue.waiters[deviceID] = append(queue.waiters[deviceID], queued)
+	return queued, func() {
+		queue.mutex.Lock()
+		defer queue.mutex.Unlock()
+
+		waiters := queue.waiters[deviceID]
+		for i, waiter := range waiters {
+			if waiter == queued {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(queue.waiters, deviceID)
+		} else {
+			queue.waiters[deviceID] = waiters
+		}
+	}
+}
+
+// notify wakes up every poll of the device
+func (queue *Queue) notify(deviceID uint) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for _, waiter := range queue.waiters[deviceID] {
+		close(waiter)
+	}
+	delete(queue.waiters, deviceID)
+}
+
+/*
+Acknowledge records the result of a command delivered to the device. A failed command
+with attempts left is queued again, and failed for good after its last attempt.
+A command of another device is not found.
+*/
+func (queue *Queue) Acknowledge(
+	ctx context.Context, device repository.Device, id uint, succeeded bool, result repository.RawJSON, now time.Time,
+) (repository.Command, error) {
+	command, err := queue.commands.Get(ctx, id)
+	if err != nil {
+		return repository.Command{}, err
+	}
+	if command.DeviceFk != device.ID {
+		return repository.Command{}, repository.NotFound
+	}
+	if command.Status != repository.Delivered {
+		return repository.Command{}, ErrNotDelivered
+	}
+
+	change := repository.CommandChange{Status: repository.Succeeded, Actor: device.SerialId, Result: result, At: now.UnixMilli()}
+	if !succeeded {
+		change.Status = repository.Failed
+		change.Detail = sql.NullString{String: fmt.Sprintf("attempt %d failed", command.Attempts), Valid: true}
+		if command.Attempts < command.MaxAttempts && command.ExpiresAt > now.UnixMilli() {
+			change.Status = repository.Queued
+			change.Detail.String += ", retried"
+		}
+	}
+
+	command, err = queue.commands.Change(ctx, id, []repository.CommandStatus{repository.Delivered}, change)
+	if errors.Is(err, repository.NotFound) {
+		// Acknowledged, swept or cancelled since it was read
+		return repository.Command{}, ErrNotDelivered
+	}
+	if err != nil {
+		return repository.Command{}, err
+	}
+	slog.Info("commands", "status", "command acknowledged", "serial_id", device.SerialId, "command", command.ID,
+		"command_status", command.Status.String())
+	if command.Status == repository.Queued {
+		queue.notify(device.ID)
+	}
+	return command, nil
+}
+
+// Cancel cancels a command not done with yet, so it is never delivered again
+func (queue *Queue) Cancel(ctx context.Context, id uint, actor, reason string, now time.Time) (repository.Command, error) {
+	command, err := queue.commands.Get(ctx, id)
+	if err != nil {
+		return repository.Command{}, err
+	}
+	if command.Status.Final() {
+		return repository.Command{}, ErrDone
+	}
+
+	command, err = queue.commands.Change(ctx, id, []repository.CommandStatus{repository.Queued, repository.Delivered},
+		repository.CommandChange{
+			Status: repository.Cancelled,
+			Actor:  actor,
+			Detail: sql.NullString{String: reason, Valid: reason != ""},
+			At:     now.UnixMilli(),
+		})
+	if errors.Is(err, repository.NotFound) {
+		return repository.Command{}, ErrDone
+	}
+	return command, err
+}
+
+func (queue *Queue) Get(ctx context.Context, id uint) (repository.Command, error) {
+	return queue.commands.Get(ctx, id)
+}
+
+func (queue *Queue) List(ctx context.Context, query repository.CommandQuery) ([]repository.Command, error) {
+	return queue.commands.List(ctx, query)
+}
+
+func (queue *Queue) History(ctx context.Context, id uint) ([]repository.CommandHistoryEntry, error) {
+	return queue.commands.History(ctx, id)
+}
+
+// RunOnce expires the commands past their expiry, and fails the ones out of attempts, by now
+func (queue *Queue) RunOnce(ctx context.Context, now time.Time) error {
+	changed, err := queue.commands.Sweep(ctx, now.UnixMilli(), now.Add(-queue.config.AckTimeout).UnixMilli())
+	if err != nil {
+		return err
+	}
+	if changed > 0 {
+		slog.Info("commands", "status", "commands swept", "changed", changed)
+	}
+	return nil
+}
+
+// Run sweeps the commands each interval, until the context is done
+func (queue *Queue) Run(ctx context.Context) {
+	ticker := time.NewTicker(queue.config.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := queue.RunOnce(ctx, time.Now()); err != nil && !errors.Is(err, context.Canceled) {
+			slog.Error("commands", "sweep-failure", err.Error())
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Validate(Reboot, nil))
+	assert.NoError(t, Validate(SetSamplingRate, repository.RawJSON(`{"interval_ms":1000}`)))
+
+	assert.True(t, errors.Is(Validate("format-disk", nil), ErrUnknownCommand))
+	assert.True(t, errors.Is(Validate(SelfTest, repository.RawJSON(`{"full":true}`)), ErrInvalidPayload))
+	assert.True(t, errors.Is(Validate(SetSamplingRate, nil), ErrInvalidPayload))
+	assert.True(t, errors.Is(Validate(SetSamplingRate, repository.RawJSON(`{"interval_ms":10}`)), ErrInvalidPayload))
+	assert.True(t, errors.Is(Validate(SetSamplingRate, repository.RawJSON(`{"interval":1000}`)), ErrInvalidPayload))
+}
+
+func TestQueue(t *testing.T) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	device, err := repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000090"})
+	assert.NoError(t, err)
+	other, err := repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000091"})
+	assert.NoError(t, err)
+
+	queue := NewQueue(repos.Commands, Config{MaxWait: time.Second})
+
+	_, err = queue.Enqueue(ctx, device, Request{Name: Reboot, TTL: 30 * 24 * time.Hour}, "ana", time.Now())
+	assert.True(t, errors.Is(err, ErrTTL))
+	_, err = queue.Enqueue(ctx, device, Request{Name: Reboot, MaxAttempts: 50}, "ana", time.Now())
+	assert.True(t, errors.Is(err, ErrMaxAttempts))
+
+	// Nothing queued, the poll waits for the max wait at most
+	started := time.Now()
+	commands, err := queue.Poll(ctx, device, 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Empty(t, commands)
+	assert.GreaterOrEqual(t, time.Since(started), 50*time.Millisecond)
+
+	// A waiting poll is woken up by the command queued
+	polled := make(chan []repository.Command)
+	go func() {
+		commands, _ := queue.Poll(ctx, device, time.Minute)
+		polled <- commands
+	}()
+	time.Sleep(20 * time.Millisecond)
+	reboot, err := queue.Enqueue(ctx, device, Request{Name: Reboot, MaxAttempts: 2}, "ana", time.Now())
+	assert.NoError(t, err)
+	select {
+	case commands = <-polled:
+		if assert.Len(t, commands, 1) {
+			assert.Equal(t, reboot.ID, commands[0].ID)
+			assert.Equal(t, repository.Delivered, commands[0].Status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the poll was not woken up")
+	}
+
+	// Only the device the command was delivered to acknowledges it
+	_, err = queue.Acknowledge(ctx, other, reboot.ID, true, nil, time.Now())
+	assert.True(t, errors.Is(err, repository.NotFound))
+
+	// Failed with an attempt left, it is queued again, then failed for good
+	retried, err := queue.Acknowledge(ctx, device, reboot.ID, false, repository.RawJSON(`{"error":"busy"}`), time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, repository.Queued, retried.Status)
+	commands, _ = queue.Poll(ctx, device, 0)
+	assert.Len(t, commands, 1)
+	failed, err := queue.Acknowledge(ctx, device, reboot.ID, false, nil, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, repository.Failed, failed.Status)
+	assert.JSONEq(t, `{"error":"busy"}`, string(failed.Result))
+	_, err = queue.Acknowledge(ctx, device, reboot.ID, true, nil, time.Now())
+	assert.True(t, errors.Is(err, ErrNotDelivered))
+
+	history, err := queue.History(ctx, reboot.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 5) {
+		assert.Equal(t, "attempt 1 failed, retried", history[2].Detail.String)
+		assert.Equal(t, "PMD-000090", history[4].Actor)
+	}
+
+	// A command acknowledged in time succeeds
+	selfTest, _ := queue.Enqueue(ctx, device, Request{Name: SelfTest}, "ana", time.Now())
+	commands, _ = queue.Poll(ctx, device, 0)
+	assert.Len(t, commands, 1)
+	succeeded, err := queue.Acknowledge(ctx, device, selfTest.ID, true, repository.RawJSON(`{"passed":true}`), time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, repository.Succeeded, succeeded.Status)
+
+	// A cancelled command is never delivered
+	sampling, err := queue.Enqueue(ctx, device, Request{Name: SetSamplingRate, Payload: repository.RawJSON(`{"interval_ms":500}`)},
+		"ana", time.Now())
+	assert.NoError(t, err)
+	cancelled, err := queue.Cancel(ctx, sampling.ID, "ana", "wrong device", time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, repository.Cancelled, cancelled.Status)
+	_, err = queue.Cancel(ctx, sampling.ID, "ana", "", time.Now())
+	assert.True(t, errors.Is(err, ErrDone))
+	commands, _ = queue.Poll(ctx, device, 0)
+	assert.Empty(t, commands)
+
+	// Expired by the sweep once past its ttl
+	expiring, _ := queue.Enqueue(ctx, device, Request{Name: Reboot, TTL: time.Minute}, "ana", time.Now())
+	assert.NoError(t, queue.RunOnce(ctx, time.Now().Add(2*time.Minute)))
+	expired, _ := queue.Get(ctx, expiring.ID)
+	assert.Equal(t, repository.Expired, expired.Status)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	// Got to use V1, V2 will break trying to read time.Duration values
+	toml "github.com/pelletier/go-toml"
+)
+
+// Keys that control how config files are composed, never decoded into ConfigWrapper
+const (
+	ConfigIncludeKey = "include"
+	ConfigProfileKey = "profile"
+)
+
+// Env var used to select the profile, when none is given by flag
+const ConfigProfileEnv = "MAESTRO_PROFILE"
+
+// defaultConfigProfile returns the profile selected through the env var, the default of the flag
+func defaultConfigProfile() string {
+	return os.Getenv(ConfigProfileEnv)
+}
+
+/*
+loadConfigTree reads a config file and every file it includes, merging them into
+a single TOML tree. Included files are merged in the order they are listed,
+and the including file is merged last, so it always overrides its includes.
+After that, the selected profile (if any) is merged on top of the base values.
+*/
+func loadConfigTree(absOrigin, profile string) (*toml.Tree, error) {
+	merged, err := loadConfigWithIncludes(absOrigin, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	profiles, _ := merged[ConfigProfileKey].(map[string]any)
+	delete(merged, ConfigProfileKey)
+
+	if profile != "" {
+		selected, exists := profiles[profile].(map[string]any)
+		if !exists {
+			return nil, fmt.Errorf("config profile [%s] is not defined, known profiles: [%s]",
+				profile, strings.Join(sortedKeys(profiles), ", "))
+		}
+		mergeConfigMaps(merged, selected)
+	}
+
+	return toml.TreeFromMap(merged)
+}
+
+/*
+loadConfigWithIncludes loads a single config file and resolves its include list,
+relative paths are relative to the directory of the including file.
+The chain of files being loaded is tracked, to refuse include cycles.
+*/
+func loadConfigWithIncludes(path string, chain []string) (map[string]any, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, errors.New("that file either does not exist, or the path is wrong")
+	}
+	for _, loading := range chain {
+		if loading == absPath {
+			return nil, fmt.Errorf("config include cycle: [%s -> %s]", strings.Join(chain, " -> "), absPath)
+		}
+	}
+	chain = append(chain, absPath)
+
+	configContents, err := os.ReadFile(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("config file [%s] either does not exist, or the path is wrong", path)
+	}
+	tree, err := toml.LoadBytes(configContents)
+	if err != nil {
+		return nil, errors.New("failed to read config toml from: " + path)
+	}
+	contents := tree.ToMap()
+
+	includes, err := configIncludes(contents[ConfigIncludeKey])
+	if err != nil {
+		return nil, fmt.Errorf("config file [%s]: %w", path, err)
+	}
+	delete(contents, ConfigIncludeKey)
+
+	merged := map[string]any{}
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(absPath), include)
+		}
+		included, err := loadConfigWithIncludes(include, chain)
+		if err != nil {
+			return nil, err
+		}
+		mergeConfigMaps(merged, included)
+	}
+	mergeConfigMaps(merged, contents)
+
+	return merged, nil
+}
+
+func configIncludes(value any) ([]string, error) {
+	if value == nil {
+		return nil, nil
+	}
+	values, ok := value.([]any)
+	if !ok {
+		return nil, errors.New("include should be a list of file paths")
+	}
+
+	includes := make([]string, 0, len(values))
+	for _, include := range values {
+		path, ok := include.(string)
+		if !ok || path == "" {
+			return nil, errors.New("include should be a list of file paths")
+		}
+		includes = append(includes, path)
+	}
+	return includes, nil
+}
+
+/*
+mergeConfigMaps merges the override values into base, tables are merged key by key,
+while every other value (arrays included) is replaced as a whole.
+*/
+func mergeConfigMaps(base, override map[string]any) {
+	for _, key := range sortedKeys(override) {
+		overrideTable, overrideIsTable := override[key].(map[string]any)
+		baseTable, baseIsTable := base[key].(map[string]any)
+
+		if overrideIsTable && baseIsTable {
+			mergeConfigMaps(baseTable, overrideTable)
+			continue
+		}
+		if overrideIsTable {
+			// Copied, so later merges never write into another file's values
+			copied := map[string]any{}
+			mergeConfigMaps(copied, overrideTable)
+			base[key] = copied
+			continue
+		}
+		base[key] = override[key]
+	}
+}
+
+func sortedKeys(values map[string]any) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
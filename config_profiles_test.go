@@ -0,0 +1,146 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeConfigFiles writes the files, by name, into a temporary directory, returning it
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadConfigTree(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		files   map[string]string
+		profile string
+		// The values expected, by their dotted key
+		values map[string]any
+		fails  bool
+	}{
+		{
+			name: "nested includes",
+			files: map[string]string{
+				"main.toml":        "include = ['base/common.toml']\n[web_api]\nport = 8080\n",
+				"base/common.toml": "include = ['database.toml']\n[web_api]\nport = 2000\nread_timeout = 5\n",
+				"base/database.toml": "[database]\nuri = 'db.sqlite'\n[web_api]\nread_timeout = 2\n" +
+					"write_timeout = 3\n",
+			},
+			values: map[string]any{
+				"web_api.port": int64(8080), "web_api.read_timeout": int64(5), "web_api.write_timeout": int64(3),
+				"database.uri": "db.sqlite",
+			},
+		},
+		{
+			name: "includes in order, the including file last",
+			files: map[string]string{
+				"main.toml":   "include = ['first.toml', 'second.toml']\n[ingest]\nbatch_size = 10\n",
+				"first.toml":  "[ingest]\nbatch_size = 1\nqueue_size = 1\nflush_interval = '00h00m01s'\n",
+				"second.toml": "[ingest]\nbatch_size = 2\nqueue_size = 2\n",
+			},
+			values: map[string]any{
+				"ingest.batch_size": int64(10), "ingest.queue_size": int64(2), "ingest.flush_interval": "00h00m01s",
+			},
+		},
+		{
+			name: "profile over the includes",
+			files: map[string]string{
+				"main.toml": "include = ['base.toml']\n[web_api]\nport = 8080\n" +
+					"[profile.dev.web_api]\nport = 9000\n[profile.prod.web_api]\nport = 443\n",
+				"base.toml": "[web_api]\nport = 2000\nread_timeout = 5\n[profile.dev.web_api]\nread_timeout = 50\n",
+			},
+			profile: "dev",
+			values:  map[string]any{"web_api.port": int64(9000), "web_api.read_timeout": int64(50), "profile": nil},
+		},
+		{
+			name: "arrays replaced as a whole",
+			files: map[string]string{
+				"main.toml": "include = ['base.toml']\n[retention]\ntiers = ['1m']\n",
+				"base.toml": "[retention]\ntiers = ['1m', '1h']\n",
+			},
+			values: map[string]any{"retention.tiers": []string{"1m"}},
+		},
+		{
+			name:    "missing profile",
+			files:   map[string]string{"main.toml": "[profile.dev.web_api]\nport = 9000\n"},
+			profile: "prod",
+			fails:   true,
+		},
+		{
+			name: "include cycle",
+			files: map[string]string{
+				"main.toml":  "include = ['other.toml']\n",
+				"other.toml": "include = ['./main.toml']\n",
+			},
+			fails: true,
+		},
+		{
+			name:  "missing include",
+			files: map[string]string{"main.toml": "include = ['missing.toml']\n"},
+			fails: true,
+		},
+		{
+			name:  "include not a list",
+			files: map[string]string{"main.toml": "include = 'base.toml'\n"},
+			fails: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeConfigFiles(t, test.files)
+			tree, err := loadConfigTree(filepath.Join(dir, "main.toml"), test.profile)
+			if test.fails {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.False(t, tree.Has(ConfigIncludeKey))
+			for key, value := range test.values {
+				assert.Equal(t, value, tree.Get(key), key)
+			}
+		})
+	}
+}
+
+func TestDefaultConfigProfile(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"main.toml": "[web_api]\nport = 8080\n[profile.dev.web_api]\nport = 9000\n",
+	})
+
+	t.Setenv(ConfigProfileEnv, "dev")
+	tree, err := loadConfigTree(filepath.Join(dir, "main.toml"), defaultConfigProfile())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9000), tree.Get("web_api.port"))
+
+	t.Setenv(ConfigProfileEnv, "")
+	tree, err = loadConfigTree(filepath.Join(dir, "main.toml"), defaultConfigProfile())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8080), tree.Get("web_api.port"))
+}
+
+func TestMergeConfigMaps(t *testing.T) {
+	override := map[string]any{"web_api": map[string]any{"port": 9000}}
+	base := map[string]any{"web_api": "not a table", "database": map[string]any{"uri": "db.sqlite"}}
+	mergeConfigMaps(base, override)
+	assert.Equal(t, map[string]any{"port": 9000}, base["web_api"])
+	assert.Equal(t, "db.sqlite", base["database"].(map[string]any)["uri"])
+
+	// The table merged is copied, merging into the base never writes into the override
+	mergeConfigMaps(base, map[string]any{"web_api": map[string]any{"port": 443}})
+	assert.Equal(t, 9000, override["web_api"].(map[string]any)["port"])
+}
@@ -1,75 +1,213 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	"github.com/jmoiron/sqlx"
 
+	"github.com/TomascpMarques/maestro/health"
+	"github.com/TomascpMarques/maestro/migrations"
+	"github.com/TomascpMarques/maestro/repository"
 	"github.com/golang-migrate/migrate/v4"
-	migration_sqlite3 "github.com/golang-migrate/migrate/v4/database/sqlite3"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Wrapped by the error returned when the app falls back into an in-memory database
+var ErrDegradedDatabase = errors.New("running on the in-memory fallback database")
+
 /*
 ConnectToDatabase connects to a sqlite3 db file, if the file does not exist,
 create that file at the specified path, if that FS operation fails,
 the function error out, if the file creation succeeds but the opening of said
 sqlite3 file fails, the database will continue in "memory" mode,
 and will indicate that the DB instance will still be usable.
+The memory mode is reported with an error wrapping ErrDegradedDatabase,
+see DegradedDatabase for how the data stored in it is kept.
+Two pools are opened over the file, a single connection writer and a
+query only reader pool, both with the tuning pragmas applied on every connection.
 */
-func ConnectToDatabase(dbFilePath string) (db *sqlx.DB, err error, usable bool) {
+func ConnectToDatabase(dbFilePath string, tuning SqliteTuning) (pools repository.SqlitePools, err error, usable bool) {
 	usable = true
 	dbFilePath = filepath.Clean(dbFilePath)
+	tuning = tuning.WithDefaults()
 
 	_, err = os.Stat(dbFilePath)
 	if err != nil {
 		slog.Info("database-setup", "creation", "file does not exist, creating")
-		if _, err = os.Create(dbFilePath); err != nil {
+		dbFile, createErr := os.Create(dbFilePath)
+		if createErr != nil {
 			slog.Error("database-setup", "cause", "could not create database file, probably lack of permissions")
+			err = createErr
 			usable = false
 			return
 		}
+		dbFile.Close()
 	}
 
-	db, err = sqlx.Open("sqlite3", dbFilePath)
+	pools, err = openDatabaseFile(dbFilePath, tuning)
 
 	// To allow the app to continue to function if the file usage fails,
 	// we change to a memory storage tactic for the sqlite instance
 	if err != nil {
-		slog.Error("database-setup", "cause", "failed to use giver sqlite path")
-		slog.Info("database-setup", "action", "changing into app memory stored sqlite")
-		return sqlx.MustConnect("sqlite3", ":memory:"), err, true
+		slog.Error("database-setup", "cause", "failed to use giver sqlite path", "reason", err.Error())
+		slog.Warn("database-setup", "action", "changing into app memory stored sqlite")
+		return openMemoryDatabase(tuning), fmt.Errorf("%w: %w", ErrDegradedDatabase, err), true
 	}
 
+	slog.Info("database-setup", "journal-mode", tuning.JournalMode, "synchronous", tuning.Synchronous,
+		"busy-timeout", tuning.BusyTimeout.String(), "reader-conns", tuning.MaxOpenConns)
 	return
 }
 
-func RunMigrations(db *sqlx.DB, migsDir string) (err error) {
-	migsDir = fmt.Sprintf("file://%s", migsDir)
+/*
+openDatabaseFile opens the writer and reader pools over the db file, and makes sure
+the file can be written to, since opening a pool never touches the file.
+*/
+func openDatabaseFile(dbFilePath string, tuning SqliteTuning) (pools repository.SqlitePools, err error) {
+	pools.Writer, err = sqlx.Open("sqlite3", sqliteDSN(dbFilePath, tuning, true))
+	if err != nil {
+		return
+	}
+	pools.Reader, err = sqlx.Open("sqlite3", sqliteDSN(dbFilePath, tuning, false))
+	if err != nil {
+		pools.Writer.Close()
+		return
+	}
+
+	// A single writer, concurrent writes would only wait on each other for the db lock
+	pools.Writer.SetMaxOpenConns(1)
+	pools.Reader.SetMaxOpenConns(tuning.MaxOpenConns)
+	pools.Reader.SetMaxIdleConns(tuning.MaxIdleConns)
 
-	slog.Info("db-migrations-folder", "using folder", migsDir)
+	if err = probeWritable(pools.Writer); err != nil {
+		pools.Writer.Close()
+		pools.Reader.Close()
+	}
+	return
+}
+
+// probeWritable rewrites the user_version header field with its own value
+func probeWritable(db *sqlx.DB) error {
+	var userVersion int
+	if err := db.Get(&userVersion, `PRAGMA user_version`); err != nil {
+		return err
+	}
+	_, err := db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, userVersion))
+	return err
+}
+
+func openMemoryDatabase(tuning SqliteTuning) repository.SqlitePools {
+	memory := sqlx.MustConnect("sqlite3", sqliteDSN(":memory:", tuning, true))
+	// Every connection to ":memory:" is a new database, so only one is kept
+	memory.SetMaxOpenConns(1)
+	return repository.SqlitePools{Reader: memory, Writer: memory}
+}
+
+/*
+sqliteDSN builds the connection string for the sqlite driver, the pragmas in it are
+applied by the driver every time it opens a connection, unlike a PRAGMA statement
+that only affects the connection it ran on.
+The writer takes the write lock when its transactions start, so it never fails
+half way through upgrading a read lock, while readers are set as query only.
+*/
+func sqliteDSN(dbFilePath string, tuning SqliteTuning, writer bool) string {
+	params := url.Values{}
+	params.Set("_synchronous", tuning.Synchronous)
+	params.Set("_busy_timeout", strconv.FormatInt(tuning.BusyTimeout.Milliseconds(), 10))
+	params.Set("_cache_size", strconv.Itoa(tuning.CacheSize))
+	params.Set("_foreign_keys", strconv.FormatBool(*tuning.ForeignKeys))
+
+	if writer {
+		// The journal mode is stored in the db file, only the writer should change it
+		params.Set("_journal_mode", tuning.JournalMode)
+		// Only takes effect on new db files, `maestro migrate vacuum` converts the existing ones
+		params.Set("_auto_vacuum", "incremental")
+		params.Set("_txlock", "immediate")
+	} else {
+		params.Set("_query_only", "true")
+	}
+
+	return fmt.Sprintf("file:%s?%s", dbFilePath, params.Encode())
+}
 
-	driver, err := migration_sqlite3.WithInstance(
-		db.DB,
-		&migration_sqlite3.Config{},
-	)
+/*
+snapshotDatabase returns the snapshot the backups are taken with, a consistent copy of
+the db written by VACUUM INTO, the pages still in the WAL file included. It runs on the
+writer, the readers being query only, the writes wait for it. While degraded, the db in use is
+the in-memory fallback, a partial copy that would replace the last good backup, so no
+snapshot is taken.
+*/
+func snapshotDatabase(db *repository.SqliteDB, registry *health.Registry) func(destination string) error {
+	return func(destination string) error {
+		if check, exists := registry.Get(DatabaseHealthCheck); exists && check.Status == health.Degraded {
+			return ErrDegradedDatabase
+		}
+		return db.WithPools(func(pools repository.SqlitePools) error {
+			_, err := pools.Writer.Exec(`VACUUM INTO ?`, destination)
+			return err
+		})
+	}
+}
+
+// Returned when the database was migrated by a newer binary than the one running
+var ErrSchemaTooNew = errors.New("database schema is newer than the migrations known by this binary")
+
+/*
+CheckSchemaVersion refuses a database whose schema version is ahead of the newest
+embedded migration, or that was left dirty by a failed migration, since running
+against either of them could corrupt the stored data.
+*/
+func CheckSchemaVersion(migration *migrate.Migrate) error {
+	version, dirty, err := migration.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return nil
+	}
 	if err != nil {
-		slog.Error("db-migrations", "migration-failure", "failed to create db driver")
-		return
+		return err
+	}
+
+	latest, err := migrations.LatestVersion()
+	if err != nil {
+		return err
+	}
+	if version > latest {
+		return fmt.Errorf("%w: database at [%d], binary at [%d]", ErrSchemaTooNew, version, latest)
 	}
+	if dirty {
+		return fmt.Errorf("database schema is dirty at version [%d], fix it and use `migrate force`", version)
+	}
+
+	return nil
+}
 
-	migration, err := migrate.NewWithDatabaseInstance(migsDir, "sqlite3", driver)
+/*
+RunMigrations applies every embedded migration that the database is still missing,
+a database that is already up to date is not an error.
+*/
+func RunMigrations(db *sqlx.DB) (err error) {
+	migration, err := migrations.New(db.DB)
 	if err != nil {
 		slog.Error("db-migrations", "migration-failure-err", err.Error())
-		slog.Error("db-migrations", "migration-failure", "failed connect to database")
+		slog.Error("db-migrations", "migration-failure", "failed to create the migrator")
+		return
+	}
+
+	if err = CheckSchemaVersion(migration); err != nil {
+		slog.Error("db-migrations", "schema-version-failure", err.Error())
 		return
 	}
 
 	err = migration.Up()
+	if errors.Is(err, migrate.ErrNoChange) {
+		slog.Info("db-migrations", "migrations-success", "the DB was already up to date")
+		return nil
+	}
 	if err != nil {
 		slog.Error("db-migrations", "migrations-up-failure", err.Error())
 		return
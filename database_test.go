@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TomascpMarques/maestro/health"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotDatabase(t *testing.T) {
+	dir := t.TempDir()
+	pools, err := openDatabaseFile(filepath.Join(dir, "db.sqlite"), DefaultSqliteTuning())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pools.Writer.Close()
+	defer pools.Reader.Close()
+
+	// Kept out of the checkpoints, the rows are only in the WAL file
+	_, err = pools.Writer.Exec(`PRAGMA wal_autocheckpoint = 0`)
+	assert.NoError(t, err)
+	_, err = pools.Writer.Exec(`CREATE TABLE reading (value INTEGER)`)
+	assert.NoError(t, err)
+	_, err = pools.Writer.Exec(`INSERT INTO reading VALUES (1), (2), (3)`)
+	assert.NoError(t, err)
+
+	wal, err := os.Stat(filepath.Join(dir, "db.sqlite-wal"))
+	assert.NoError(t, err)
+	assert.NotZero(t, wal.Size())
+
+	registry := health.NewRegistry()
+	snapshot := snapshotDatabase(repository.NewSqliteDB(pools), registry)
+	destination := filepath.Join(dir, "db.sqlite-bkup")
+	assert.NoError(t, snapshot(destination))
+
+	copied, err := openDatabaseFile(destination, DefaultSqliteTuning())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Writer.Close()
+	defer copied.Reader.Close()
+	var count int
+	assert.NoError(t, copied.Reader.Get(&count, `SELECT count(*) FROM reading`))
+	assert.Equal(t, 3, count)
+
+	// The in-memory fallback is never backed up
+	registry.Set(health.Check{Name: DatabaseHealthCheck, Status: health.Degraded})
+	assert.ErrorIs(t, snapshot(filepath.Join(dir, "degraded-bkup")), ErrDegradedDatabase)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/TomascpMarques/maestro/health"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/jmoiron/sqlx"
+)
+
+// Name of the health check that reports the state of the database
+const DatabaseHealthCheck = "database"
+
+/*
+DegradedDatabase runs while the app is using the in-memory fallback database.
+It checkpoints the in-memory data into a spill file, so a crash or shutdown only
+loses what arrived since the last checkpoint, keeps the degraded state visible
+(health check and a warning on every checkpoint), and retries the db file until
+it can be used again. On recovery the in-memory data is merged into the db file,
+and the repositories are switched over to it.
+A spill file left by a previous degraded run is loaded into the in-memory db before
+the first checkpoint, it is never overwritten while it holds data not merged anywhere.
+*/
+type DegradedDatabase struct {
+	db         *repository.SqliteDB
+	dbFilePath string
+	tuning     SqliteTuning
+	config     DegradedMode
+	health     *health.Registry
+	since      time.Time
+	// Set while the spill file of a previous run holds data not loaded into the in-memory db
+	leftover bool
+}
+
+func NewDegradedDatabase(
+	db *repository.SqliteDB,
+	dbConfig Database,
+	registry *health.Registry,
+	cause error,
+) *DegradedDatabase {
+	degraded := &DegradedDatabase{
+		db:         db,
+		dbFilePath: dbConfig.Uri,
+		tuning:     dbConfig.Sqlite.WithDefaults(),
+		config:     dbConfig.Degraded.WithDefaults(dbConfig.Uri),
+		health:     registry,
+		since:      time.Now(),
+	}
+	if _, err := os.Stat(degraded.config.SpillLocation); err == nil {
+		degraded.leftover = true
+	}
+	degraded.reportHealth(cause)
+	return degraded
+}
+
+/*
+Run blocks until the db file is recovered or the context is done,
+a last checkpoint is made when the context is done, so a graceful shutdown
+keeps everything in the spill file, to be merged on the next start.
+*/
+func (degraded *DegradedDatabase) Run(ctx context.Context) {
+	if err := degraded.loadLeftover(ctx); err != nil {
+		slog.Error("database-degraded", "leftover-spill-failure", err.Error())
+	}
+	checkpointTicker := time.NewTicker(degraded.config.CheckpointInterval)
+	defer checkpointTicker.Stop()
+	recoveryTicker := time.NewTicker(degraded.config.RecoveryInterval)
+	defer recoveryTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := degraded.checkpoint(); err != nil {
+				slog.Error("database-degraded", "final-checkpoint-failure", err.Error())
+			}
+			return
+
+		case <-checkpointTicker.C:
+			slog.Warn(
+				"database-degraded",
+				"warning", "running on the in-memory database, data only survives through the spill file",
+				"since", degraded.since.Format(time.RFC3339),
+				"spill-file", degraded.config.SpillLocation,
+			)
+			if err := degraded.checkpoint(); err != nil {
+				slog.Error("database-degraded", "checkpoint-failure", err.Error())
+			}
+
+		case <-recoveryTicker.C:
+			err := degraded.recover(ctx)
+			if err == nil {
+				return
+			}
+			degraded.reportHealth(err)
+		}
+	}
+}
+
+/*
+loadLeftover merges the spill file left by a previous degraded run into the in-memory db,
+the checkpoints that follow write its data back along with the new one.
+*/
+func (degraded *DegradedDatabase) loadLeftover(ctx context.Context) error {
+	if !degraded.leftover {
+		return nil
+	}
+	slog.Warn("database-degraded", "spill-file", "found a spill file from a previous degraded run, loading it",
+		"location", degraded.config.SpillLocation)
+	err := degraded.db.WithPools(func(pools repository.SqlitePools) error {
+		return mergeSpill(ctx, pools.Writer, degraded.config.SpillLocation, degraded.tuning)
+	})
+	if err != nil {
+		return err
+	}
+	degraded.leftover = false
+	return nil
+}
+
+/*
+checkpoint writes the in-memory database into the spill file, refusing to while the
+spill file of a previous run can't be loaded, it would be the only copy of its data.
+*/
+func (degraded *DegradedDatabase) checkpoint() error {
+	if err := degraded.loadLeftover(context.Background()); err != nil {
+		return fmt.Errorf("%w, refusing to overwrite the spill file of a previous run", err)
+	}
+	return degraded.db.WithPools(func(pools repository.SqlitePools) error {
+		return spillDatabase(pools, degraded.config.SpillLocation)
+	})
+}
+
+/*
+recover tries to open the db file, once it succeeds the repositories are held,
+the in-memory data is spilled one last time and merged into the db file,
+and only then are the repositories moved over to it.
+*/
+func (degraded *DegradedDatabase) recover(ctx context.Context) error {
+	filePools, err := openDatabaseFile(degraded.dbFilePath, degraded.tuning)
+	if err != nil {
+		return err
+	}
+	if err = RunMigrations(filePools.Writer); err != nil {
+		filePools.Writer.Close()
+		filePools.Reader.Close()
+		return err
+	}
+
+	var memoryPools repository.SqlitePools
+	err = degraded.db.Swap(func(current repository.SqlitePools) (repository.SqlitePools, error) {
+		// Never loaded, the spill of the previous run goes into the db file before it is overwritten
+		if degraded.leftover {
+			if err := mergeSpill(ctx, filePools.Writer, degraded.config.SpillLocation, degraded.tuning); err != nil {
+				return current, err
+			}
+			degraded.leftover = false
+		}
+		if err := spillDatabase(current, degraded.config.SpillLocation); err != nil {
+			return current, err
+		}
+		if err := repository.MergeSpillFile(ctx, filePools.Writer, degraded.config.SpillLocation); err != nil {
+			return current, err
+		}
+		memoryPools = current
+		return filePools, nil
+	})
+	if err != nil {
+		slog.Error("database-degraded", "recovery-failure", err.Error())
+		filePools.Writer.Close()
+		filePools.Reader.Close()
+		return err
+	}
+
+	memoryPools.Writer.Close()
+	if err = os.Remove(degraded.config.SpillLocation); err != nil {
+		slog.Warn("database-degraded", "spill-removal-failure", err.Error())
+	}
+
+	slog.Info("database-degraded", "recovered", "merged the in-memory data into the db file",
+		"location", degraded.dbFilePath, "degraded-for", time.Since(degraded.since).String())
+	degraded.health.Set(health.Check{
+		Name:    DatabaseHealthCheck,
+		Status:  health.Ok,
+		Message: "recovered from the in-memory fallback",
+	})
+	return nil
+}
+
+func (degraded *DegradedDatabase) reportHealth(cause error) {
+	degraded.health.Set(health.Check{
+		Name:    DatabaseHealthCheck,
+		Status:  health.Degraded,
+		Message: "db file unusable, running on the in-memory fallback database",
+		Details: map[string]any{
+			"cause":      cause.Error(),
+			"since":      degraded.since,
+			"spill_file": degraded.config.SpillLocation,
+		},
+	})
+}
+
+/*
+spillDatabase copies the database into the spill file, through a temporary file
+renamed over it, so the previous spill is never lost to a half written one.
+*/
+func spillDatabase(pools repository.SqlitePools, spillPath string) error {
+	temporaryPath := spillPath + ".tmp"
+	if err := os.Remove(temporaryPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if _, err := pools.Writer.Exec(`VACUUM INTO ?`, temporaryPath); err != nil {
+		return fmt.Errorf("failed to checkpoint into the spill file: %w", err)
+	}
+	return os.Rename(temporaryPath, spillPath)
+}
+
+/*
+MergeLeftoverSpill merges the spill file left by a previous run that ended while
+degraded into the db file, removing it once merged. A spill file that fails to
+merge is kept in place, so no data is lost.
+*/
+func MergeLeftoverSpill(ctx context.Context, db *repository.SqliteDB, dbConfig Database) error {
+	spillPath := dbConfig.Degraded.WithDefaults(dbConfig.Uri).SpillLocation
+	if _, err := os.Stat(spillPath); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	slog.Warn("database-setup", "spill-file", "found a spill file from a degraded run, merging it", "location", spillPath)
+	err := db.WithPools(func(pools repository.SqlitePools) error {
+		return mergeSpill(ctx, pools.Writer, spillPath, dbConfig.Sqlite.WithDefaults())
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(spillPath)
+}
+
+// mergeSpill merges the spill file into the target db, migrating it first
+func mergeSpill(ctx context.Context, target *sqlx.DB, spillPath string, tuning SqliteTuning) error {
+	// The spill may have been written by an older schema, it is migrated before merging
+	spill, err := openDatabaseFile(spillPath, tuning)
+	if err != nil {
+		return err
+	}
+	err = RunMigrations(spill.Writer)
+	spill.Writer.Close()
+	spill.Reader.Close()
+	if err != nil {
+		return err
+	}
+	return repository.MergeSpillFile(ctx, target, spillPath)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/health"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+// createDevices creates the devices in the db, through its repositories
+func createDevices(t *testing.T, db *repository.SqliteDB, serialIds ...string) {
+	repos, err := repository.NewSqliteRepositories(db, filepath.Join(t.TempDir(), "archive.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, serialId := range serialIds {
+		_, err := repos.Devices.Create(context.Background(), repository.NewDevice{SerialId: serialId, DeviceType: repository.PMD})
+		assert.NoError(t, err)
+	}
+}
+
+// writeSpillFile writes a spill file like the one left by a degraded run, holding the devices
+func writeSpillFile(t *testing.T, spillPath string, serialIds ...string) {
+	pools, err := openDatabaseFile(spillPath, DefaultSqliteTuning())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pools.Writer.Close()
+	defer pools.Reader.Close()
+	if err = RunMigrations(pools.Writer); err != nil {
+		t.Fatal(err)
+	}
+	createDevices(t, repository.NewSqliteDB(pools), serialIds...)
+}
+
+// serialIdsIn reads the serial ids of the devices stored in the db file
+func serialIdsIn(t *testing.T, dbFilePath string) []string {
+	pools, err := openDatabaseFile(dbFilePath, DefaultSqliteTuning())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pools.Writer.Close()
+	defer pools.Reader.Close()
+	serialIds := []string{}
+	assert.NoError(t, pools.Reader.Select(&serialIds, `SELECT serial_id FROM device ORDER BY serial_id`))
+	return serialIds
+}
+
+// newMemoryDB opens the in-memory fallback, migrated, as the app does when the db file is unusable
+func newMemoryDB(t *testing.T) *repository.SqliteDB {
+	pools := openMemoryDatabase(DefaultSqliteTuning())
+	if err := RunMigrations(pools.Writer); err != nil {
+		t.Fatal(err)
+	}
+	return repository.NewSqliteDB(pools)
+}
+
+func TestDegradedRestartKeepsTheSpill(t *testing.T) {
+	dir := t.TempDir()
+	dbConfig := Database{Uri: filepath.Join(dir, "db.sqlite")}
+	spillPath := dbConfig.Uri + ".spill"
+	writeSpillFile(t, spillPath, "PMD-000001")
+
+	memory := newMemoryDB(t)
+	createDevices(t, memory, "PMD-000002")
+	registry := health.NewRegistry()
+	degraded := NewDegradedDatabase(memory, dbConfig, registry, errors.New("disk failure"))
+	check, _ := registry.Get(DatabaseHealthCheck)
+	assert.Equal(t, health.Degraded, check.Status)
+
+	// Stopped right away, the only checkpoint is the last one
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	degraded.Run(ctx)
+	assert.Equal(t, []string{"PMD-000001", "PMD-000002"}, serialIdsIn(t, spillPath))
+}
+
+func TestDegradedRefusesToOverwriteAnUnloadedSpill(t *testing.T) {
+	dir := t.TempDir()
+	dbConfig := Database{Uri: filepath.Join(dir, "db.sqlite")}
+	spillPath := dbConfig.Uri + ".spill"
+	if err := os.WriteFile(spillPath, []byte("not a sqlite file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	degraded := NewDegradedDatabase(newMemoryDB(t), dbConfig, health.NewRegistry(), errors.New("disk failure"))
+	assert.Error(t, degraded.checkpoint())
+	contents, err := os.ReadFile(spillPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "not a sqlite file", string(contents))
+}
+
+func TestDegradedRecovery(t *testing.T) {
+	dir := t.TempDir()
+	dbConfig := Database{
+		Uri:      filepath.Join(dir, "db.sqlite"),
+		Degraded: DegradedMode{CheckpointInterval: time.Hour, RecoveryInterval: time.Millisecond},
+	}
+	spillPath := dbConfig.Uri + ".spill"
+	writeSpillFile(t, spillPath, "PMD-000001")
+
+	memory := newMemoryDB(t)
+	createDevices(t, memory, "PMD-000002")
+	registry := health.NewRegistry()
+	degraded := NewDegradedDatabase(memory, dbConfig, registry, errors.New("disk failure"))
+	swaps := 0
+	memory.OnSwap(func() { swaps++ })
+
+	// The db file can be opened from the start, the first retry recovers
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		degraded.Run(context.Background())
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the degraded database never recovered")
+	}
+
+	check, _ := registry.Get(DatabaseHealthCheck)
+	assert.Equal(t, health.Ok, check.Status)
+	assert.NoFileExists(t, spillPath)
+	assert.Equal(t, []string{"PMD-000001", "PMD-000002"}, serialIdsIn(t, dbConfig.Uri))
+	assert.Equal(t, 1, swaps)
+
+	// The repositories were moved over to the db file
+	createDevices(t, memory, "PMD-000003")
+	assert.Equal(t, []string{"PMD-000001", "PMD-000002", "PMD-000003"}, serialIdsIn(t, dbConfig.Uri))
+}
+
+func TestMergeLeftoverSpill(t *testing.T) {
+	dir := t.TempDir()
+	dbConfig := Database{Uri: filepath.Join(dir, "db.sqlite")}
+	spillPath := dbConfig.Uri + ".spill"
+
+	pools, err := openDatabaseFile(dbConfig.Uri, DefaultSqliteTuning())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = RunMigrations(pools.Writer); err != nil {
+		t.Fatal(err)
+	}
+	db := repository.NewSqliteDB(pools)
+	createDevices(t, db, "PMD-000002")
+
+	// Without a spill file, there is nothing to merge
+	assert.NoError(t, MergeLeftoverSpill(context.Background(), db, dbConfig))
+
+	writeSpillFile(t, spillPath, "PMD-000001", "PMD-000002")
+	assert.NoError(t, MergeLeftoverSpill(context.Background(), db, dbConfig))
+	assert.NoFileExists(t, spillPath)
+	pools.Writer.Close()
+	pools.Reader.Close()
+	assert.Equal(t, []string{"PMD-000001", "PMD-000002"}, serialIdsIn(t, dbConfig.Uri))
+}
@@ -0,0 +1,186 @@
+package deviceauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+// SignedRequest is what a device sent, as read from the request and its headers
+type SignedRequest struct {
+	Method    string
+	Path      string
+	Timestamp int64
+	Nonce     string
+	Signature string
+	Body      []byte
+}
+
+/*
+Authenticator issues the secrets of the devices, and checks the signatures of their
+requests against their valid credentials, remembering the nonces used within the max
+skew, so no request is replayed. The nonces are kept in memory, a restart forgets
+them, only a request signed less than the max skew ago can be replayed then. The
+signing keys are sealed with the key secret before they are stored.
+*/
+type Authenticator struct {
+	credentials repository.CredentialRepository
+	config      Config
+	keys        keyring
+
+	mutex sync.Mutex
+	// Expiry of the nonces used, keyed by device and nonce
+	nonces     map[string]time.Time
+	lastPruned time.Time
+}
+
+func NewAuthenticator(credentials repository.CredentialRepository, config Config) (*Authenticator, error) {
+	keys, err := newKeyring(config.KeySecret)
+	if err != nil {
+		return nil, err
+	}
+	return &Authenticator{
+		credentials: credentials,
+		config:      config.WithDefaults(),
+		keys:        keys,
+		nonces:      map[string]time.Time{},
+	}, nil
+}
+
+// AllowsUnsigned reports if the requests without a signature are let through
+func (authenticator *Authenticator) AllowsUnsigned() bool {
+	return authenticator.config.AllowUnsigned
+}
+
+// RequiresClientCert reports if the requests without a verified client certificate are refused
+func (authenticator *Authenticator) RequiresClientCert() bool {
+	return authenticator.config.RequireClientCert
+}
+
+// MaxSkew returns how far the clock of a device may be from the server's, sent to the devices when provisioned
+func (authenticator *Authenticator) MaxSkew() time.Duration {
+	return authenticator.config.MaxSkew
+}
+
+// Verify checks the request was signed by the device, now, with one of its valid credentials
+func (authenticator *Authenticator) Verify(ctx context.Context, device repository.Device, request SignedRequest, now time.Time) error {
+	if request.Signature == "" || request.Nonce == "" || request.Timestamp == 0 {
+		return ErrMissingSignature
+	}
+	signedAt := time.UnixMilli(request.Timestamp)
+	if skew := now.Sub(signedAt).Abs(); skew > authenticator.config.MaxSkew {
+		return fmt.Errorf("%w: off by %s", ErrStaleTimestamp, skew.Round(time.Second))
+	}
+	signature, err := hex.DecodeString(request.Signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	credentials, err := authenticator.credentials.Valid(ctx, device.ID, now.UnixMilli())
+	if err != nil {
+		return err
+	}
+	if len(credentials) == 0 {
+		return ErrNoCredential
+	}
+
+	matched := false
+	for _, credential := range credentials {
+		keyHash, err := authenticator.keys.open(credential.KeyHash)
+		if err != nil {
+			return fmt.Errorf("%w: credential %d", err, credential.ID)
+		}
+		expected, _ := hex.DecodeString(Sign(keyHash,
+			request.Method, request.Path, request.Timestamp, request.Nonce, request.Body))
+		if hmac.Equal(signature, expected) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return ErrInvalidSignature
+	}
+
+	// Only a valid signature uses up the nonce, or anyone could burn the nonces of a device
+	return authenticator.useNonce(device.ID, request.Nonce, now)
+}
+
+func (authenticator *Authenticator) useNonce(deviceID uint, nonce string, now time.Time) error {
+	authenticator.mutex.Lock()
+	defer authenticator.mutex.Unlock()
+
+	// A nonce older than the skew can't be replayed, its timestamp is refused first
+	if now.Sub(authenticator.lastPruned) > authenticator.config.MaxSkew {
+		for key, expiry := range authenticator.nonces {
+			if now.After(expiry) {
+				delete(authenticator.nonces, key)
+			}
+		}
+		authenticator.lastPruned = now
+	}
+
+	key := fmt.Sprintf("%d/%s", deviceID, nonce)
+	if expiry, used := authenticator.nonces[key]; used && !now.After(expiry) {
+		return ErrReplayedNonce
+	}
+	// Covers a timestamp up to the skew in the future, and then the skew in the past
+	authenticator.nonces[key] = now.Add(2 * authenticator.config.MaxSkew)
+	return nil
+}
+
+/*
+Issue gives the device a new secret, returned only here, its previous secrets stay
+valid for the rotation grace, so the device can switch without losing requests.
+*/
+func (authenticator *Authenticator) Issue(ctx context.Context, deviceID uint, now time.Time) (string, repository.Credential, error) {
+	secret, keyHash, err := NewSecret()
+	if err != nil {
+		return "", repository.Credential{}, err
+	}
+	sealedKey, err := authenticator.keys.seal(keyHash)
+	if err != nil {
+		return "", repository.Credential{}, err
+	}
+	graceUntil := now.Add(authenticator.config.RotationGrace)
+	credential, err := authenticator.credentials.Rotate(ctx, deviceID, sealedKey, now.UnixMilli(), graceUntil.UnixMilli())
+	if err != nil {
+		return "", repository.Credential{}, err
+	}
+	return secret, credential, nil
+}
+
+// Revoke revokes every secret of the device, it can't sign anything until issued a new one
+func (authenticator *Authenticator) Revoke(ctx context.Context, deviceID uint, now time.Time) (int64, error) {
+	return authenticator.credentials.Revoke(ctx, deviceID, now.UnixMilli())
+}
+
+/*
+SealStored seals the signing keys stored before the key secret was set, returning how
+many were, the keys already sealed are left as they are.
+*/
+func (authenticator *Authenticator) SealStored(ctx context.Context) (int, error) {
+	credentials, err := authenticator.credentials.Keys(ctx)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, credential := range credentials {
+		if sealed(credential.KeyHash) {
+			continue
+		}
+		sealedKey, err := authenticator.keys.seal(credential.KeyHash)
+		if err != nil {
+			return count, err
+		}
+		if err = authenticator.credentials.ReplaceKey(ctx, credential.ID, sealedKey); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
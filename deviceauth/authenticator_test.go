@@ -0,0 +1,105 @@
+package deviceauth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	device, err := repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000001"})
+	assert.NoError(t, err)
+
+	authenticator, err := NewAuthenticator(repos.Credentials, Config{MaxSkew: time.Minute, RotationGrace: time.Hour, KeySecret: "key-secret"})
+	assert.NoError(t, err)
+	now := time.UnixMilli(1_000_000_000)
+	body := []byte(`{"m_value":21.5}`)
+	signed := func(secret, nonce string, at time.Time) SignedRequest {
+		timestamp := at.UnixMilli()
+		return SignedRequest{
+			Method: "POST", Path: "/api/v1/devices/pmd/data/", Timestamp: timestamp, Nonce: nonce, Body: body,
+			Signature: Sign(HashSecret(secret), "POST", "/api/v1/devices/pmd/data/", timestamp, nonce, body),
+		}
+	}
+
+	assert.True(t, errors.Is(authenticator.Verify(ctx, device, signed("secret", "n-0", now), now), ErrNoCredential))
+
+	secret, credential, err := authenticator.Issue(ctx, device.ID, now)
+	assert.NoError(t, err)
+	assert.NotContains(t, credential.KeyHash, HashSecret(secret), "the signing key is stored sealed")
+	assert.NoError(t, authenticator.Verify(ctx, device, signed(secret, "n-1", now), now))
+
+	// Replays, old or tampered requests, and other secrets are refused
+	assert.True(t, errors.Is(authenticator.Verify(ctx, device, signed(secret, "n-1", now), now), ErrReplayedNonce))
+	assert.True(t, errors.Is(authenticator.Verify(ctx, device, signed(secret, "n-2", now.Add(-2*time.Minute)), now), ErrStaleTimestamp))
+	tampered := signed(secret, "n-3", now)
+	tampered.Body = []byte(`{"m_value":99}`)
+	assert.True(t, errors.Is(authenticator.Verify(ctx, device, tampered, now), ErrInvalidSignature))
+	assert.True(t, errors.Is(authenticator.Verify(ctx, device, signed("other", "n-4", now), now), ErrInvalidSignature))
+	assert.True(t, errors.Is(authenticator.Verify(ctx, device, SignedRequest{}, now), ErrMissingSignature))
+	// A refused request doesn't use up its nonce
+	assert.NoError(t, authenticator.Verify(ctx, device, signed(secret, "n-3", now), now))
+
+	// The previous secret keeps working for the rotation grace
+	rotated, _, err := authenticator.Issue(ctx, device.ID, now)
+	assert.NoError(t, err)
+	assert.NoError(t, authenticator.Verify(ctx, device, signed(secret, "n-5", now), now))
+	later := now.Add(2 * time.Hour)
+	assert.True(t, errors.Is(authenticator.Verify(ctx, device, signed(secret, "n-6", later), later), ErrInvalidSignature))
+	assert.NoError(t, authenticator.Verify(ctx, device, signed(rotated, "n-7", later), later))
+	// The nonces outlive the skew only as long as their timestamp is accepted
+	assert.NoError(t, authenticator.Verify(ctx, device, signed(rotated, "n-1", later), later))
+
+	revoked, err := authenticator.Revoke(ctx, device.ID, later)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), revoked)
+	assert.True(t, errors.Is(authenticator.Verify(ctx, device, signed(rotated, "n-8", later), later), ErrNoCredential))
+}
+
+func TestSealedKeys(t *testing.T) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	device, err := repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000001"})
+	assert.NoError(t, err)
+	now := time.UnixMilli(1_000_000_000)
+	signed := func(secret, nonce string) SignedRequest {
+		return SignedRequest{
+			Method: "GET", Path: "/api/v1/devices/pmd/commands/", Timestamp: now.UnixMilli(), Nonce: nonce,
+			Signature: Sign(HashSecret(secret), "GET", "/api/v1/devices/pmd/commands/", now.UnixMilli(), nonce, nil),
+		}
+	}
+
+	_, err = NewAuthenticator(repos.Credentials, Config{})
+	assert.ErrorIs(t, err, ErrMissingKeySecret)
+
+	// A key stored before the key secret was set is only used once sealed
+	legacy, _, err := NewSecret()
+	assert.NoError(t, err)
+	_, err = repos.Credentials.Rotate(ctx, device.ID, HashSecret(legacy), now.UnixMilli(), now.UnixMilli())
+	assert.NoError(t, err)
+	authenticator, err := NewAuthenticator(repos.Credentials, Config{KeySecret: "key-secret"})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, authenticator.Verify(ctx, device, signed(legacy, "n-1"), now), ErrUnreadableKey)
+
+	sealedKeys, err := authenticator.SealStored(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sealedKeys)
+	sealedKeys, err = authenticator.SealStored(ctx)
+	assert.NoError(t, err)
+	assert.Zero(t, sealedKeys)
+	stored, err := repos.Credentials.Keys(ctx)
+	assert.NoError(t, err)
+	assert.NotContains(t, stored[0].KeyHash, HashSecret(legacy))
+	assert.NoError(t, authenticator.Verify(ctx, device, signed(legacy, "n-1"), now))
+
+	// Another key secret can't read the stored keys
+	other, err := NewAuthenticator(repos.Credentials, Config{KeySecret: "other-key-secret"})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, other.Verify(ctx, device, signed(legacy, "n-2"), now), ErrUnreadableKey)
+}
@@ -0,0 +1,127 @@
+/*
+Package deviceauth authenticates the requests of the devices. Every device is given a
+secret when registered, and signs its requests with an HMAC-SHA256 keyed by the SHA-256
+of that secret. The server checks the signatures with the same key, so it stores that key
+sealed with a key secret of its own, set in the config and never in the db: reading the
+db, or one of its backups, isn't enough to sign as a device. Changing the key secret
+leaves the stored keys unreadable, the devices have to be issued new secrets then.
+
+A signed request carries the headers:
+
+	X-Device-Id: the serial id of the device
+	X-Timestamp: unix milliseconds of when it was signed
+	X-Nonce:     random string, never reused within the max skew
+	X-Signature: hex HMAC-SHA256 of the string to sign, see StringToSign
+
+Served over TLS with a client CA, a device can instead present a client certificate
+issued by it, with its serial id as the common name, its requests need no signature then.
+*/
+package deviceauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DeviceHeader    = "X-Device-Id"
+	TimestampHeader = "X-Timestamp"
+	NonceHeader     = "X-Nonce"
+	SignatureHeader = "X-Signature"
+)
+
+var (
+	ErrMissingSignature = errors.New("request is not signed")
+	ErrInvalidSignature = errors.New("invalid signature")
+	// The timestamp is further from now than the max skew
+	ErrStaleTimestamp = errors.New("timestamp outside the allowed skew")
+	ErrReplayedNonce  = errors.New("nonce already used")
+	// The device has no valid credential, it was never issued one, or they were revoked
+	ErrNoCredential = errors.New("device has no valid credential")
+	// Client certificates are required, and the request was made without one
+	ErrMissingCertificate = errors.New("request has no client certificate")
+	// The serial id of the certificate is not a device, or not the one the request names
+	ErrCertificateMismatch = errors.New("client certificate doesn't match the device")
+)
+
+// Config holds how far a signed request may be from the server clock, and how long rotated secrets stay valid
+type Config struct {
+	MaxSkew time.Duration
+	// How long the previous secrets of a device stay valid after a rotation
+	RotationGrace time.Duration
+	// Lets the requests without a signature through, meant for migrating the devices
+	AllowUnsigned bool
+	// Refuses the requests of the devices made without a verified client certificate
+	RequireClientCert bool
+	// Seals the signing keys of the devices before they are stored, required
+	KeySecret string
+}
+
+// WithDefaults fills every value left out, a skew of 5 minutes and a grace of a day
+func (config Config) WithDefaults() Config {
+	if config.MaxSkew == 0 {
+		config.MaxSkew = 5 * time.Minute
+	}
+	if config.RotationGrace == 0 {
+		config.RotationGrace = 24 * time.Hour
+	}
+	return config
+}
+
+/*
+CertificateSerial returns the serial id of the device that presented a verified client
+certificate on the connection, the common name of its subject.
+*/
+func CertificateSerial(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	serialId := state.VerifiedChains[0][0].Subject.CommonName
+	return serialId, serialId != ""
+}
+
+// NewSecret generates a secret for a device, returning it with the hash it signs with
+func NewSecret() (secret string, keyHash string, err error) {
+	raw := make([]byte, 32)
+	if _, err = rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	secret = base64.RawURLEncoding.EncodeToString(raw)
+	return secret, HashSecret(secret), nil
+}
+
+// HashSecret returns the hex SHA-256 of the secret, which is also the key the device signs with
+func HashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+/*
+StringToSign joins what a signature covers, one per line: the method, the path with
+its query string, the timestamp, the nonce, and the hex SHA-256 of the body.
+*/
+func StringToSign(method, path string, timestamp int64, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{
+		strings.ToUpper(method),
+		path,
+		strconv.FormatInt(timestamp, 10),
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+}
+
+// Sign returns the hex signature of a request, keyed by the hash of the secret
+func Sign(keyHash, method, path string, timestamp int64, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(keyHash))
+	mac.Write([]byte(StringToSign(method, path, timestamp, nonce, body)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,78 @@
+package deviceauth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// sealedPrefix marks a signing key stored encrypted with the key secret
+const sealedPrefix = "sealed:"
+
+var (
+	// The key secret is required, the signing keys can't be stored without it
+	ErrMissingKeySecret = errors.New("the key secret is missing")
+	// The stored key can't be decrypted, it isn't sealed, or was sealed with another key secret
+	ErrUnreadableKey = errors.New("the stored signing key can't be read")
+)
+
+/*
+keyring seals the signing keys of the devices before they are stored, with AES-256-GCM
+keyed by the key secret, so reading the db, or one of its backups, isn't enough to sign
+as a device.
+*/
+type keyring struct {
+	aead cipher.AEAD
+}
+
+func newKeyring(keySecret string) (keyring, error) {
+	if keySecret == "" {
+		return keyring{}, ErrMissingKeySecret
+	}
+	key := sha256.Sum256([]byte("maestro device signing keys\n" + keySecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return keyring{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return keyring{}, err
+	}
+	return keyring{aead}, nil
+}
+
+// sealed reports if the stored key was sealed, the ones stored before the key secret weren't
+func sealed(stored string) bool {
+	return strings.HasPrefix(stored, sealedPrefix)
+}
+
+// seal encrypts the signing key, a random nonce ahead of the ciphertext
+func (keys keyring) seal(keyHash string) (string, error) {
+	nonce := make([]byte, keys.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealedKey := keys.aead.Seal(nonce, nonce, []byte(keyHash), nil)
+	return sealedPrefix + base64.RawStdEncoding.EncodeToString(sealedKey), nil
+}
+
+// open decrypts the stored signing key
+func (keys keyring) open(stored string) (string, error) {
+	if !sealed(stored) {
+		return "", ErrUnreadableKey
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(stored, sealedPrefix))
+	if err != nil || len(raw) < keys.aead.NonceSize() {
+		return "", ErrUnreadableKey
+	}
+	nonce, ciphertext := raw[:keys.aead.NonceSize()], raw[keys.aead.NonceSize():]
+	keyHash, err := keys.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", ErrUnreadableKey
+	}
+	return string(keyHash), nil
+}
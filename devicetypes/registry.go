@@ -0,0 +1,211 @@
+/*
+Package devicetypes holds the device type registry, what each type of device is
+allowed to be and to publish, read from the db once and kept in memory, so the
+validation of every request doesn't go through the db.
+*/
+package devicetypes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+var (
+	ErrUnknownType = errors.New("unknown device type")
+	// The type definition itself is invalid
+	ErrInvalidType = errors.New("invalid device type")
+	// The built-in types can be updated, but never deleted
+	ErrBuiltinType   = errors.New("built-in device type")
+	ErrSerialPattern = errors.New("serial id doesn't match the device type")
+)
+
+type entry struct {
+	definition repository.DeviceTypeDefinition
+	pattern    *regexp.Regexp
+}
+
+/*
+Registry keeps the device types in memory, every change goes through it, so it
+is stored and then reloaded. Only one registry should be used per db.
+*/
+type Registry struct {
+	repo repository.DeviceTypeRepository
+
+	mutex sync.RWMutex
+	types map[repository.DeviceType]entry
+}
+
+// Load reads every device type from the repository into a new registry
+func Load(ctx context.Context, repo repository.DeviceTypeRepository) (*Registry, error) {
+	registry := &Registry{repo: repo}
+	if err := registry.reload(ctx); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+func (registry *Registry) reload(ctx context.Context) error {
+	definitions, err := registry.repo.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	types := make(map[repository.DeviceType]entry, len(definitions))
+	for _, definition := range definitions {
+		pattern, err := regexp.Compile(definition.SerialPattern)
+		if err != nil {
+			return fmt.Errorf("device type %s has an invalid serial_pattern: %w", definition.Name, err)
+		}
+		types[definition.ID] = entry{definition, pattern}
+	}
+
+	registry.mutex.Lock()
+	registry.types = types
+	registry.mutex.Unlock()
+	return nil
+}
+
+// validate checks the parts of a definition the db can't
+func validate(deviceType repository.NewDeviceType) error {
+	if deviceType.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidType)
+	}
+	if deviceType.Role > repository.AccessoryRole {
+		return fmt.Errorf("%w: role outside valid values", ErrInvalidType)
+	}
+	if deviceType.DefaultStatus > repository.Suspended {
+		return fmt.Errorf("%w: default_status outside valid values", ErrInvalidType)
+	}
+	if deviceType.HeartbeatTimeout.Valid && deviceType.HeartbeatTimeout.Int64 <= 0 {
+		return fmt.Errorf("%w: heartbeat_timeout should be positive", ErrInvalidType)
+	}
+	if _, err := regexp.Compile(deviceType.SerialPattern); err != nil {
+		return fmt.Errorf("%w: serial_pattern is not a valid regular expression", ErrInvalidType)
+	}
+	return nil
+}
+
+func (registry *Registry) Get(id repository.DeviceType) (repository.DeviceTypeDefinition, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	found, exists := registry.types[id]
+	return found.definition, exists
+}
+
+func (registry *Registry) ByName(name string) (repository.DeviceTypeDefinition, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	for _, found := range registry.types {
+		if found.definition.Name == name {
+			return found.definition, true
+		}
+	}
+	return repository.DeviceTypeDefinition{}, false
+}
+
+func (registry *Registry) List() []repository.DeviceTypeDefinition {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	definitions := make([]repository.DeviceTypeDefinition, 0, len(registry.types))
+	for _, found := range registry.types {
+		definitions = append(definitions, found.definition)
+	}
+	slices.SortFunc(definitions, func(a, b repository.DeviceTypeDefinition) int { return int(a.ID) - int(b.ID) })
+	return definitions
+}
+
+func (registry *Registry) Create(ctx context.Context, deviceType repository.NewDeviceType) (repository.DeviceTypeDefinition, error) {
+	if err := validate(deviceType); err != nil {
+		return repository.DeviceTypeDefinition{}, err
+	}
+	created, err := registry.repo.Create(ctx, deviceType)
+	if err != nil {
+		return repository.DeviceTypeDefinition{}, err
+	}
+	return created, registry.reload(ctx)
+}
+
+// Update replaces the definition of the type with the same id, keeping its name and role
+func (registry *Registry) Update(ctx context.Context, deviceType repository.DeviceTypeDefinition) (repository.DeviceTypeDefinition, error) {
+	existing, found := registry.Get(deviceType.ID)
+	if !found {
+		return repository.DeviceTypeDefinition{}, ErrUnknownType
+	}
+	deviceType.Name, deviceType.Role = existing.Name, existing.Role
+	if err := validate(deviceType.NewDeviceType); err != nil {
+		return repository.DeviceTypeDefinition{}, err
+	}
+
+	updated, err := registry.repo.Update(ctx, deviceType)
+	if err != nil {
+		return repository.DeviceTypeDefinition{}, err
+	}
+	return updated, registry.reload(ctx)
+}
+
+func (registry *Registry) Delete(ctx context.Context, id repository.DeviceType) error {
+	if id == repository.PMD || id == repository.Accessory {
+		return ErrBuiltinType
+	}
+	if err := registry.repo.Delete(ctx, id); err != nil {
+		return err
+	}
+	return registry.reload(ctx)
+}
+
+// ValidateDevice checks that the device has a known type, and a serial id matching it
+func (registry *Registry) ValidateDevice(device repository.NewDevice) error {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	found, exists := registry.types[device.DeviceType]
+	if !exists {
+		return ErrUnknownType
+	}
+	if !found.pattern.MatchString(device.SerialId) {
+		return fmt.Errorf("%w: expected %s", ErrSerialPattern, found.definition.SerialPattern)
+	}
+	return nil
+}
+
+// AllowsValueType reports if the devices of the type may publish the measurement type
+func (registry *Registry) AllowsValueType(deviceType repository.DeviceType, valueType uint) bool {
+	definition, found := registry.Get(deviceType)
+	if !found {
+		return false
+	}
+	return len(definition.ValueTypes) == 0 || slices.Contains(definition.ValueTypes, valueType)
+}
+
+// Role returns the role of the type, an unknown type has the PMD role
+func (registry *Registry) Role(deviceType repository.DeviceType) repository.DeviceRole {
+	definition, _ := registry.Get(deviceType)
+	return definition.Role
+}
+
+// Name returns the name of the type, used when logging or reporting the devices
+func (registry *Registry) Name(deviceType repository.DeviceType) string {
+	if definition, found := registry.Get(deviceType); found {
+		return definition.Name
+	}
+	return "unknown"
+}
+
+// HeartbeatTimeout returns the heartbeat timeout of the type, if it sets one
+func (registry *Registry) HeartbeatTimeout(deviceType repository.DeviceType) (time.Duration, bool) {
+	definition, found := registry.Get(deviceType)
+	if !found || !definition.HeartbeatTimeout.Valid {
+		return 0, false
+	}
+	return time.Duration(definition.HeartbeatTimeout.Int64) * time.Millisecond, true
+}
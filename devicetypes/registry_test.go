@@ -0,0 +1,70 @@
+package devicetypes
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	registry, err := Load(ctx, repos.DeviceTypes)
+	assert.NoError(t, err)
+	assert.Len(t, registry.List(), 2)
+
+	// The built-in types keep the rules the devices had before the registry
+	assert.NoError(t, registry.ValidateDevice(repository.NewDevice{SerialId: "PMD-000001"}))
+	assert.True(t, errors.Is(registry.ValidateDevice(repository.NewDevice{SerialId: "PMD"}), ErrSerialPattern))
+	assert.True(t, errors.Is(registry.ValidateDevice(repository.NewDevice{SerialId: "PMD-000001", DeviceType: 9}), ErrUnknownType))
+
+	_, err = registry.Create(ctx, repository.NewDeviceType{Name: "broken", SerialPattern: "("})
+	assert.True(t, errors.Is(err, ErrInvalidType))
+
+	thermometer, err := registry.Create(ctx, repository.NewDeviceType{
+		Name:             "thermometer",
+		Role:             repository.AccessoryRole,
+		SerialPattern:    `^TMP-\d{4}$`,
+		ValueTypes:       repository.ValueTypes{3},
+		HeartbeatTimeout: sql.NullInt64{Int64: 60_000, Valid: true},
+	})
+	assert.NoError(t, err)
+	_, err = registry.Create(ctx, repository.NewDeviceType{Name: "thermometer", SerialPattern: ".*"})
+	assert.True(t, errors.Is(err, repository.AlreadyExists))
+
+	found, exists := registry.ByName("thermometer")
+	assert.True(t, exists)
+	assert.Equal(t, thermometer, found)
+	assert.Equal(t, repository.AccessoryRole, registry.Role(thermometer.ID))
+	assert.NoError(t, registry.ValidateDevice(repository.NewDevice{SerialId: "TMP-0001", DeviceType: thermometer.ID}))
+	assert.Error(t, registry.ValidateDevice(repository.NewDevice{SerialId: "PMD-000001", DeviceType: thermometer.ID}))
+	assert.True(t, registry.AllowsValueType(thermometer.ID, 3))
+	assert.False(t, registry.AllowsValueType(thermometer.ID, 1))
+	assert.True(t, registry.AllowsValueType(repository.PMD, 1))
+	timeout, set := registry.HeartbeatTimeout(thermometer.ID)
+	assert.True(t, set)
+	assert.Equal(t, time.Minute, timeout)
+
+	// The name and role are kept on updates
+	thermometer.Name, thermometer.Role = "renamed", repository.PMDRole
+	thermometer.ValueTypes = repository.ValueTypes{}
+	updated, err := registry.Update(ctx, thermometer)
+	assert.NoError(t, err)
+	assert.Equal(t, "thermometer", updated.Name)
+	assert.Equal(t, repository.AccessoryRole, updated.Role)
+	assert.True(t, registry.AllowsValueType(thermometer.ID, 1))
+
+	_, err = repos.Devices.Create(ctx, repository.NewDevice{SerialId: "TMP-0001", DeviceType: thermometer.ID})
+	assert.NoError(t, err)
+	assert.True(t, errors.Is(registry.Delete(ctx, thermometer.ID), repository.InUse))
+	assert.True(t, errors.Is(registry.Delete(ctx, repository.PMD), ErrBuiltinType))
+	assert.NoError(t, repos.Devices.Delete(ctx, "TMP-0001", false))
+	assert.NoError(t, registry.Delete(ctx, thermometer.ID))
+	_, exists = registry.Get(thermometer.ID)
+	assert.False(t, exists)
+}
@@ -2,32 +2,470 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"strconv"
 	"time"
 
+	"github.com/TomascpMarques/maestro/adminauth"
+	"github.com/TomascpMarques/maestro/alerts"
+	"github.com/TomascpMarques/maestro/certs"
+	"github.com/TomascpMarques/maestro/clocksync"
+	"github.com/TomascpMarques/maestro/commands"
+	"github.com/TomascpMarques/maestro/deviceauth"
+	"github.com/TomascpMarques/maestro/firmware"
+	"github.com/TomascpMarques/maestro/ingest"
+	"github.com/TomascpMarques/maestro/presence"
+	"github.com/TomascpMarques/maestro/provisioning"
+	"github.com/TomascpMarques/maestro/retention"
 	"github.com/go-playground/validator/v10"
-	// Got to use V1, V2 will break trying to read time.Duration values
-	toml "github.com/pelletier/go-toml"
 )
 
 // Wraps all the wanted configs in on place
 type ConfigWrapper struct {
-	DatabaseConfig  Database  `toml:"database" validate:"required"`
-	WebApiConfig    WebApi    `toml:"web_api" validate:"required"`
-	TelemetryConfig Telemetry `toml:"telemetry" validate:"required"`
+	DatabaseConfig  Database     `toml:"database" validate:"required"`
+	WebApiConfig    WebApi       `toml:"web_api" validate:"required"`
+	TelemetryConfig Telemetry    `toml:"telemetry" validate:"required"`
+	RetentionConfig Retention    `toml:"retention"`
+	IngestConfig    Ingest       `toml:"ingest"`
+	PresenceConfig  Presence     `toml:"presence"`
+	DeviceAuth      DeviceAuth   `toml:"device_auth"`
+	AdminAuth       AdminAuth    `toml:"admin_auth"`
+	Provisioning    Provisioning `toml:"provisioning"`
+	Commands        Commands     `toml:"commands"`
+	Firmware        Firmware     `toml:"firmware"`
+	Clock           Clock        `toml:"clock"`
+	Alerts          Alerts       `toml:"alerts"`
+
+	// The same config, but before any secret reference was resolved
+	unresolved *ConfigWrapper
 }
 
 type Database struct {
-	Uri            string        `toml:"uri" validate:"required"`
-	Backup         bool          `toml:"backup"`
-	BackupInterval time.Duration `toml:"backup_interval" validate:"required"`
-	BackUpLocation string        `toml:"location" validate:"required"`
+	Uri            string          `toml:"uri" validate:"required"`
+	Backup         bool            `toml:"backup"`
+	BackupInterval time.Duration   `toml:"backup_interval" validate:"required"`
+	BackUpLocation string          `toml:"location" validate:"required"`
+	Sqlite         SqliteTuning    `toml:"sqlite"`
+	Degraded       DegradedMode    `toml:"degraded"`
+	Integrity      IntegrityChecks `toml:"integrity"`
+	// Where archived devices have their measurements moved into, "<uri>.archive" by default
+	ArchiveLocation string `toml:"archive_location"`
+}
+
+func (database Database) ArchivePath() string {
+	if database.ArchiveLocation == "" {
+		return database.Uri + ".archive"
+	}
+	return database.ArchiveLocation
+}
+
+/*
+IntegrityChecks configures the periodic integrity checks of the db, every run uses
+quick_check, except every full_check_every runs, which use integrity_check.
+Free pages are vacuumed once they pass freelist_threshold (0 to 1) of the db.
+*/
+type IntegrityChecks struct {
+	Interval          time.Duration `toml:"interval" validate:"gte=0"`
+	FullCheckEvery    uint          `toml:"full_check_every"`
+	FreelistThreshold float64       `toml:"freelist_threshold" validate:"gte=0,lte=1"`
+	// Pages reclaimed by each incremental vacuum
+	VacuumPages uint `toml:"vacuum_pages"`
+}
+
+// WithDefaults fills every value left out, an hourly quick_check and a daily integrity_check
+func (checks IntegrityChecks) WithDefaults() IntegrityChecks {
+	if checks.Interval == 0 {
+		checks.Interval = time.Hour
+	}
+	if checks.FullCheckEvery == 0 {
+		checks.FullCheckEvery = 24
+	}
+	if checks.FreelistThreshold == 0 {
+		checks.FreelistThreshold = 0.2
+	}
+	if checks.VacuumPages == 0 {
+		checks.VacuumPages = 2000
+	}
+	return checks
+}
+
+/*
+DegradedMode configures the in-memory fallback used when the db file is unusable,
+the in-memory db is checkpointed into the spill file, and the db file is retried
+until it can be used again, at which point the spilled data is merged into it.
+*/
+type DegradedMode struct {
+	SpillLocation      string        `toml:"spill_location"`
+	CheckpointInterval time.Duration `toml:"checkpoint_interval" validate:"gte=0"`
+	RecoveryInterval   time.Duration `toml:"recovery_interval" validate:"gte=0"`
+}
+
+// WithDefaults fills every value left out, the spill file defaults to "<uri>.spill"
+func (degraded DegradedMode) WithDefaults(dbFilePath string) DegradedMode {
+	if degraded.SpillLocation == "" {
+		degraded.SpillLocation = dbFilePath + ".spill"
+	}
+	if degraded.CheckpointInterval == 0 {
+		degraded.CheckpointInterval = time.Minute
+	}
+	if degraded.RecoveryInterval == 0 {
+		degraded.RecoveryInterval = 30 * time.Second
+	}
+	return degraded
+}
+
+/*
+SqliteTuning holds the pragmas applied to every sqlite connection, and the size of
+the connection pools. Any value left out uses the default from DefaultSqliteTuning.
+*/
+type SqliteTuning struct {
+	JournalMode string        `toml:"journal_mode" validate:"omitempty,oneof=DELETE TRUNCATE PERSIST MEMORY WAL OFF"`
+	Synchronous string        `toml:"synchronous" validate:"omitempty,oneof=OFF NORMAL FULL EXTRA"`
+	BusyTimeout time.Duration `toml:"busy_timeout" validate:"gte=0"`
+	// Positive values are pages, negative values are KiB, as sqlite reads them
+	CacheSize    int   `toml:"cache_size"`
+	ForeignKeys  *bool `toml:"foreign_keys"`
+	MaxOpenConns int   `toml:"max_open_conns" validate:"gte=0,lte=64"`
+	MaxIdleConns int   `toml:"max_idle_conns" validate:"gte=0,lte=64"`
+}
+
+func DefaultSqliteTuning() SqliteTuning {
+	foreignKeys := true
+	return SqliteTuning{
+		JournalMode:  "WAL",
+		Synchronous:  "NORMAL",
+		BusyTimeout:  5 * time.Second,
+		CacheSize:    -2000,
+		ForeignKeys:  &foreignKeys,
+		MaxOpenConns: 4,
+		MaxIdleConns: 2,
+	}
+}
+
+// WithDefaults fills every value left out of the config with its default
+func (tuning SqliteTuning) WithDefaults() SqliteTuning {
+	defaults := DefaultSqliteTuning()
+	if tuning.JournalMode == "" {
+		tuning.JournalMode = defaults.JournalMode
+	}
+	if tuning.Synchronous == "" {
+		tuning.Synchronous = defaults.Synchronous
+	}
+	if tuning.BusyTimeout == 0 {
+		tuning.BusyTimeout = defaults.BusyTimeout
+	}
+	if tuning.CacheSize == 0 {
+		tuning.CacheSize = defaults.CacheSize
+	}
+	if tuning.ForeignKeys == nil {
+		tuning.ForeignKeys = defaults.ForeignKeys
+	}
+	if tuning.MaxOpenConns == 0 {
+		tuning.MaxOpenConns = defaults.MaxOpenConns
+	}
+	if tuning.MaxIdleConns == 0 {
+		tuning.MaxIdleConns = defaults.MaxIdleConns
+	}
+	return tuning
+}
+
+/*
+Retention configures how long the measurements are kept, per resolution,
+the policies under `[retention.types.<m_value_type>]` override the default one.
+Every value left out keeps the data forever, see retention.Config.
+*/
+type Retention struct {
+	Interval   time.Duration              `toml:"interval" validate:"gte=0"`
+	BatchSize  uint                       `toml:"batch_size" validate:"lte=10000"`
+	BatchPause time.Duration              `toml:"batch_pause" validate:"gte=0"`
+	Lag        time.Duration              `toml:"lag" validate:"gte=0"`
+	Default    RetentionPolicy            `toml:"default"`
+	Types      map[string]RetentionPolicy `toml:"types" validate:"dive"`
+}
+
+type RetentionPolicy struct {
+	Raw    time.Duration `toml:"raw" validate:"gte=0"`
+	Minute time.Duration `toml:"minute" validate:"gte=0"`
+	Hourly time.Duration `toml:"hourly" validate:"gte=0"`
+}
+
+func (policy RetentionPolicy) policy() retention.Policy {
+	return retention.Policy{Raw: policy.Raw, Minute: policy.Minute, Hourly: policy.Hourly}
+}
+
+// Policies converts the config into the one used by the retention job
+func (config Retention) Policies() (retention.Config, error) {
+	types := make(map[uint]retention.Policy, len(config.Types))
+	for key, policy := range config.Types {
+		valueType, err := strconv.ParseUint(key, 10, 0)
+		if err != nil {
+			return retention.Config{}, fmt.Errorf("RETENTION.TYPES key [%s] should be a m_value_type number", key)
+		}
+		types[uint(valueType)] = policy.policy()
+	}
+
+	return retention.Config{
+		Interval:   config.Interval,
+		BatchSize:  config.BatchSize,
+		BatchPause: config.BatchPause,
+		Lag:        config.Lag,
+		Default:    config.Default.policy(),
+		Types:      types,
+	}, nil
+}
+
+/*
+Ingest sizes the queue between the measurement publishes and the db writes,
+leaving spill_location out disables the disk spill, refusing publishes instead.
+*/
+type Ingest struct {
+	QueueSize     uint          `toml:"queue_size" validate:"lte=1000000"`
+	BatchSize     uint          `toml:"batch_size" validate:"lte=10000"`
+	FlushInterval time.Duration `toml:"flush_interval" validate:"gte=0"`
+	RetryAfter    time.Duration `toml:"retry_after" validate:"gte=0"`
+	SpillLocation string        `toml:"spill_location"`
+}
+
+// Pipeline converts the config into the one used by the ingest pipeline
+func (config Ingest) Pipeline() ingest.Config {
+	return ingest.Config{
+		QueueSize:     config.QueueSize,
+		BatchSize:     config.BatchSize,
+		FlushInterval: config.FlushInterval,
+		RetryAfter:    config.RetryAfter,
+		SpillLocation: config.SpillLocation,
+	}
+}
+
+/*
+Presence configures when a quiet device is flagged as stale, and then offline,
+the device types with a heartbeat_timeout of their own (see /v1/devices/types/)
+don't use the default timeouts, see presence.Config for the values used when left out.
+*/
+type Presence struct {
+	Interval time.Duration    `toml:"interval" validate:"gte=0"`
+	Default  PresenceTimeouts `toml:"default"`
+}
+
+type PresenceTimeouts struct {
+	StaleAfter   time.Duration `toml:"stale_after" validate:"gte=0"`
+	OfflineAfter time.Duration `toml:"offline_after" validate:"gte=0"`
+}
+
+func (timeouts PresenceTimeouts) timeouts() presence.Timeouts {
+	return presence.Timeouts{StaleAfter: timeouts.StaleAfter, OfflineAfter: timeouts.OfflineAfter}
+}
+
+// Monitor converts the config into the one used by the presence monitor
+func (config Presence) Monitor() (presence.Config, error) {
+	monitor := presence.Config{
+		Interval: config.Interval,
+		Default:  config.Default.timeouts(),
+	}
+	if err := monitor.Validate(); err != nil {
+		return presence.Config{}, fmt.Errorf("PRESENCE: %w", err)
+	}
+	return monitor, nil
+}
+
+/*
+DeviceAuth configures how the requests signed by the devices are checked, see the
+deviceauth package, allow_unsigned lets the devices without a secret keep publishing
+while they are given one, and should be turned off once they all are.
+require_client_cert only lets the devices with a client certificate through, which
+needs the api served over TLS with a client CA. The key secret seals the signing keys
+of the devices in the db, it should reference a secret, like "env:MAESTRO_DEVICE_KEY_SECRET".
+*/
+type DeviceAuth struct {
+	MaxSkew           time.Duration `toml:"max_skew" validate:"gte=0"`
+	RotationGrace     time.Duration `toml:"rotation_grace" validate:"gte=0"`
+	AllowUnsigned     bool          `toml:"allow_unsigned"`
+	RequireClientCert bool          `toml:"require_client_cert"`
+	KeySecret         string        `toml:"key_secret" secret:"true"`
+}
+
+// Authenticator converts the config into the one used by the device authenticator
+func (config DeviceAuth) Authenticator() (deviceauth.Config, error) {
+	if config.KeySecret == "" {
+		return deviceauth.Config{}, fmt.Errorf("DEVICE-AUTH: %w, set key_secret", deviceauth.ErrMissingKeySecret)
+	}
+	return deviceauth.Config{
+		MaxSkew:           config.MaxSkew,
+		RotationGrace:     config.RotationGrace,
+		AllowUnsigned:     config.AllowUnsigned,
+		RequireClientCert: config.RequireClientCert,
+		KeySecret:         config.KeySecret,
+	}, nil
+}
+
+/*
+AdminAuth configures the sessions of the users of the api, see the adminauth package.
+The bootstrap user is created as an admin only while there are no users, its password
+should reference a secret, like "env:MAESTRO_ADMIN_PASSWORD", never be written in the file.
+*/
+type AdminAuth struct {
+	SessionTTL        time.Duration `toml:"session_ttl" validate:"gte=0"`
+	BootstrapUser     string        `toml:"bootstrap_user" validate:"omitempty,max=64"`
+	BootstrapPassword string        `toml:"bootstrap_password" validate:"required_with=BootstrapUser" secret:"true"`
+}
+
+// Authenticator converts the config into the one used by the admin authenticator
+func (config AdminAuth) Authenticator() adminauth.Config {
+	return adminauth.Config{
+		SessionTTL:        config.SessionTTL,
+		BootstrapUser:     config.BootstrapUser,
+		BootstrapPassword: config.BootstrapPassword,
+	}
+}
+
+// Provisioning configures the claim codes the devices register themselves with, see the provisioning package
+type Provisioning struct {
+	CodeExpiry    time.Duration `toml:"code_expiry" validate:"gte=0"`
+	MaxCodeExpiry time.Duration `toml:"max_code_expiry" validate:"gte=0"`
+}
+
+// Provisioner converts the config into the one used by the provisioner
+func (config Provisioning) Provisioner() provisioning.Config {
+	return provisioning.Config{
+		DefaultExpiry: config.CodeExpiry,
+		MaxExpiry:     config.MaxCodeExpiry,
+	}
+}
+
+// Commands configures how long the commands of the devices wait, see commands.Config for the values used when left out
+type Commands struct {
+	TTL                time.Duration `toml:"ttl" validate:"gte=0"`
+	MaxTTL             time.Duration `toml:"max_ttl" validate:"gte=0"`
+	AckTimeout         time.Duration `toml:"ack_timeout" validate:"gte=0"`
+	MaxAttempts        uint          `toml:"max_attempts"`
+	MaxAttemptsAllowed uint          `toml:"max_attempts_allowed"`
+	MaxWait            time.Duration `toml:"max_wait" validate:"gte=0"`
+	SweepInterval      time.Duration `toml:"sweep_interval" validate:"gte=0"`
+}
+
+// Queue converts the config into the one used by the command queue
+func (config Commands) Queue() (commands.Config, error) {
+	queue := commands.Config{
+		DefaultTTL:         config.TTL,
+		MaxTTL:             config.MaxTTL,
+		AckTimeout:         config.AckTimeout,
+		DefaultMaxAttempts: config.MaxAttempts,
+		MaxAttempts:        config.MaxAttemptsAllowed,
+		MaxWait:            config.MaxWait,
+		SweepInterval:      config.SweepInterval,
+	}
+	if err := queue.Validate(); err != nil {
+		return commands.Config{}, fmt.Errorf("COMMANDS: %w", err)
+	}
+	return queue, nil
+}
+
+/*
+Firmware configures where the firmware images are stored, and when a rollout is paused,
+see firmware.Config for the values used when left out. With a public_key_file, every
+image is uploaded with its signature, checked against the key.
+*/
+type Firmware struct {
+	Location         string  `toml:"location"`
+	MaxSize          int64   `toml:"max_size" validate:"gte=0"`
+	FailureThreshold float64 `toml:"failure_threshold" validate:"gte=0,lte=1"`
+	MinReports       uint    `toml:"min_reports"`
+	PublicKeyFile    string  `toml:"public_key_file"`
+}
+
+// Service converts the config into the one used by the firmware service, reading the public key
+func (config Firmware) Service() (firmware.Config, error) {
+	service := firmware.Config{
+		Location:         config.Location,
+		MaxSize:          config.MaxSize,
+		FailureThreshold: config.FailureThreshold,
+		MinReports:       config.MinReports,
+	}
+	if config.PublicKeyFile != "" {
+		encoded, err := os.ReadFile(config.PublicKeyFile)
+		if err != nil {
+			return firmware.Config{}, fmt.Errorf("FIRMWARE: %w", err)
+		}
+		if service.PublicKey, err = firmware.ParsePublicKey(encoded); err != nil {
+			return firmware.Config{}, fmt.Errorf("FIRMWARE: %w", err)
+		}
+	}
+	if err := service.Validate(); err != nil {
+		return firmware.Config{}, fmt.Errorf("FIRMWARE: %w", err)
+	}
+	return service, nil
+}
+
+/*
+Clock configures the clock syncs of the devices, see clocksync.Config for the values used
+when left out. The SNTP responder is only started with an sntp_address.
+*/
+type Clock struct {
+	MaxSkew      time.Duration `toml:"max_skew" validate:"gte=0"`
+	MaxRoundTrip time.Duration `toml:"max_round_trip" validate:"gte=0"`
+	SNTPAddress  string        `toml:"sntp_address"`
+	MaxFuture    time.Duration `toml:"max_future" validate:"gte=0"`
+	MaxAge       time.Duration `toml:"max_age" validate:"gte=0"`
+}
+
+// Sync converts the config into the one used by the clock sync service
+func (config Clock) Sync() (clocksync.Config, error) {
+	sync := clocksync.Config{
+		MaxSkew:      config.MaxSkew,
+		MaxRoundTrip: config.MaxRoundTrip,
+		SNTPAddress:  config.SNTPAddress,
+		MaxFuture:    config.MaxFuture,
+		MaxAge:       config.MaxAge,
+	}
+	if err := sync.Validate(); err != nil {
+		return clocksync.Config{}, fmt.Errorf("CLOCK: %w", err)
+	}
+	return sync, nil
+}
+
+// Alerts configures the evaluation of the alert rules, see alerts.Config for the values used when left out
+type Alerts struct {
+	Interval time.Duration `toml:"interval" validate:"gte=0"`
+}
+
+// Engine converts the config into the one used by the alerts engine
+func (config Alerts) Engine() (alerts.Config, error) {
+	engine := alerts.Config{Interval: config.Interval}
+	if err := engine.Validate(); err != nil {
+		return alerts.Config{}, fmt.Errorf("ALERTS: %w", err)
+	}
+	return engine, nil
 }
 
 type WebApi struct {
 	Port         uint16 `toml:"port" validate:"required,gte=2000,lte=65535"`
 	ReadTimeout  uint8  `toml:"read_timeout" validate:"required,gte=2,lte=1000"`
 	WriteTimeout uint8  `toml:"write_timeout" validate:"required,gte=2,lte=1000"`
+	TLS          TLS    `toml:"tls"`
+}
+
+/*
+TLS configures the api to be served over TLS, see the certs package, the files are
+checked every reload_interval, a renewed certificate is used without a restart.
+With a client_ca_file, the devices may authenticate with a certificate it issued.
+*/
+type TLS struct {
+	Enabled        bool          `toml:"enabled"`
+	CertFile       string        `toml:"cert_file" validate:"required_if=Enabled true"`
+	KeyFile        string        `toml:"key_file" validate:"required_if=Enabled true"`
+	ClientCAFile   string        `toml:"client_ca_file"`
+	ReloadInterval time.Duration `toml:"reload_interval" validate:"gte=0"`
+}
+
+// Certs converts the config into the one used by the certificate store
+func (config TLS) Certs() certs.Config {
+	return certs.Config{
+		CertFile:       config.CertFile,
+		KeyFile:        config.KeyFile,
+		ClientCAFile:   config.ClientCAFile,
+		ReloadInterval: config.ReloadInterval,
+	}
 }
 
 type Telemetry struct {
@@ -37,22 +475,35 @@ type Telemetry struct {
 /*
 LoadConfig loads the config values from an env file, with the files
 written using the TOML format.
+A file can list other files to be merged under it with `include = [...]`,
+and define named profiles under `[profile.<name>]`, that override the
+base values when selected. The merged result is what gets validated.
+A string value tagged `secret:"true"` can reference a secret instead of holding it,
+see ResolveSecrets for the supported references.
 */
-func LoadConfig(absOrigin string) (ConfigWrapper, error) {
-	var config ConfigWrapper
+func LoadConfig(absOrigin, profile string) (ConfigWrapper, error) {
+	var config, unresolved ConfigWrapper
 
-	configFile, err := os.Open(absOrigin)
+	configTree, err := loadConfigTree(absOrigin, profile)
 	if err != nil {
-		return ConfigWrapper{},
-			errors.New("that file either does not exist, or the path is wrong")
+		return ConfigWrapper{}, err
 	}
 
-	err = toml.NewDecoder(configFile).Decode(&config)
+	// Decoded twice, so a copy with the secret references is kept around for logging
+	err = errors.Join(
+		configTree.Unmarshal(&config),
+		configTree.Unmarshal(&unresolved),
+	)
 	if err != nil {
 		return ConfigWrapper{},
 			errors.New("failed to read config toml from: " + absOrigin)
 	}
 
+	err = ResolveSecrets(&config)
+	if err != nil {
+		return ConfigWrapper{}, err
+	}
+
 	err = VALIDATE.Struct(&config)
 	if err != nil {
 		validationErrors := []error{}
@@ -65,14 +516,54 @@ func LoadConfig(absOrigin string) (ConfigWrapper, error) {
 			var e error = nil
 			WebApiEnvErrorMapper(err, &e)
 			DatabaseEnvErrorMapper(err, &e)
+			if e == nil {
+				e = err
+			}
 			validationErrors = append(validationErrors, e)
 		}
 		return config, errors.Join(validationErrors...)
 	}
+	if _, err = config.RetentionConfig.Policies(); err != nil {
+		return config, err
+	}
+	if _, err = config.PresenceConfig.Monitor(); err != nil {
+		return config, err
+	}
+	if _, err = config.Commands.Queue(); err != nil {
+		return config, err
+	}
+	if _, err = config.Firmware.Service(); err != nil {
+		return config, err
+	}
+	if _, err = config.Clock.Sync(); err != nil {
+		return config, err
+	}
+	if _, err = config.Alerts.Engine(); err != nil {
+		return config, err
+	}
+	if _, err = config.DeviceAuth.Authenticator(); err != nil {
+		return config, err
+	}
+	tls := config.WebApiConfig.TLS
+	if config.DeviceAuth.RequireClientCert && (!tls.Enabled || tls.ClientCAFile == "") {
+		return config, fmt.Errorf("DEVICE-AUTH: %w, under [web_api.tls]", certs.ErrMissingClientCA)
+	}
 
+	config.unresolved = &unresolved
 	return config, nil
 }
 
+/*
+Redacted returns the config as it was written, before any secret reference was
+resolved, making it safe to be logged or stored.
+*/
+func (config ConfigWrapper) Redacted() ConfigWrapper {
+	if config.unresolved == nil {
+		return config
+	}
+	return *config.unresolved
+}
+
 /*
 WebApiEnvErrorMapper Maps a validator error field into the expected
 error value, is used to customize the error messages given an invalid
@@ -97,6 +588,18 @@ func DatabaseEnvErrorMapper(err validator.FieldError, e *error) {
 		*e = errors.New("BACKUP-LOCATION should be a file path to store the DB backup")
 	case "Uri":
 		*e = errors.New("URI should be a file path to store the DB")
+	case "JournalMode":
+		*e = errors.New("SQLITE.JOURNAL-MODE should be one of DELETE, TRUNCATE, PERSIST, MEMORY, WAL or OFF")
+	case "Synchronous":
+		*e = errors.New("SQLITE.SYNCHRONOUS should be one of OFF, NORMAL, FULL or EXTRA")
+	case "MaxOpenConns", "MaxIdleConns":
+		*e = errors.New("SQLITE.MAX-OPEN/IDLE-CONNS should be between 0 and 64")
+	case "FreelistThreshold":
+		*e = errors.New("INTEGRITY.FREELIST-THRESHOLD should be between 0 and 1")
+	case "BatchSize":
+		*e = errors.New("RETENTION/INGEST.BATCH-SIZE should be at most 10000")
+	case "QueueSize":
+		*e = errors.New("INGEST.QUEUE-SIZE should be at most 1000000")
 	default:
 		return
 	}
@@ -0,0 +1,88 @@
+/*
+Package events fans out what happens to the devices (going offline, coming back...)
+to every part of the app interested in it, without the publishers knowing about them.
+*/
+package events
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Type names what happened, declared by the package publishing the event
+type Type string
+
+type Event struct {
+	Type     Type      `json:"type"`
+	SerialId string    `json:"serial_id"`
+	At       time.Time `json:"at"`
+	// Anything else worth knowing about the event, specific to its type
+	Details map[string]any `json:"details,omitempty"`
+}
+
+/*
+Bus delivers every published event to every subscriber. Publishing never blocks,
+a subscriber that falls behind its buffer misses the events that don't fit in it.
+*/
+type Bus struct {
+	mutex       sync.RWMutex
+	lastID      uint
+	subscribers map[uint]chan Event
+}
+
+func NewBus() *Bus {
+	return &Bus{subscribers: map[uint]chan Event{}}
+}
+
+/*
+Subscribe returns a channel receiving every event published from now on, buffering
+up to buffer of them. The returned func unsubscribes, closing the channel.
+*/
+func (bus *Bus) Subscribe(buffer uint) (<-chan Event, func()) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	bus.lastID++
+	id, subscription := bus.lastID, make(chan Event, buffer)
+	bus.subscribers[id] = subscription
+
+	var once sync.Once
+	return subscription, func() {
+		once.Do(func() {
+			bus.mutex.Lock()
+			defer bus.mutex.Unlock()
+			delete(bus.subscribers, id)
+			close(subscription)
+		})
+	}
+}
+
+func (bus *Bus) Publish(event Event) {
+	bus.mutex.RLock()
+	defer bus.mutex.RUnlock()
+
+	for _, subscription := range bus.subscribers {
+		select {
+		case subscription <- event:
+		default:
+			slog.Warn("events", "dropped", string(event.Type), "serial_id", event.SerialId, "cause", "subscriber buffer full")
+		}
+	}
+}
+
+// Log logs every event published, until the context is done
+func (bus *Bus) Log(ctx context.Context) {
+	subscription, unsubscribe := bus.Subscribe(100)
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-subscription:
+			slog.Info("events", "type", string(event.Type), "serial_id", event.SerialId, "at", event.At.Format(time.RFC3339))
+		}
+	}
+}
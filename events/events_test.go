@@ -0,0 +1,34 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	first, unsubscribeFirst := bus.Subscribe(1)
+	second, unsubscribeSecond := bus.Subscribe(1)
+	defer unsubscribeSecond()
+
+	event := Event{Type: "device-offline", SerialId: "PMD-000001", At: time.Now()}
+	bus.Publish(event)
+	assert.Equal(t, event, <-first)
+	assert.Equal(t, event, <-second)
+
+	// A full subscriber misses the event, without blocking the publisher
+	bus.Publish(event)
+	bus.Publish(Event{Type: "device-online"})
+	assert.Equal(t, event, <-second)
+	assert.Empty(t, second)
+
+	unsubscribeFirst()
+	unsubscribeFirst()
+	// What was buffered is still received, then the channel is closed
+	assert.Equal(t, event, <-first)
+	_, open := <-first
+	assert.False(t, open)
+	bus.Publish(event)
+}
@@ -0,0 +1,171 @@
+/*
+Package firmware stores the firmware images of the devices, and rolls them out.
+An image is uploaded for a device type at a version, and kept on disk named by its
+SHA-256, with an optional signature the devices check before installing it, an
+ed25519 signature of the SHA-256 digest, required when a public key is configured.
+
+A rollout offers an image to a share of the devices of its type, picked by hashing
+their serial id, or to the devices listed with it. A device checks for its update,
+downloads the image, with range requests to resume it, and reports the outcome of
+its install. A rollout is paused once the share of failed installs crosses its
+threshold, and only one rollout per device type is in progress at a time.
+*/
+package firmware
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrTooLarge         = errors.New("firmware image is too large")
+	ErrChecksumMismatch = errors.New("firmware image doesn't match its sha256")
+	ErrInvalidSignature = errors.New("invalid firmware signature")
+	// A rollout targets either a percentage of the devices of the type, or the devices listed
+	ErrInvalidTarget     = errors.New("invalid rollout target")
+	ErrInvalidThreshold  = errors.New("failure threshold should be above 0, and at most 1")
+	ErrRolloutInProgress = errors.New("a rollout for the device type is already in progress")
+	ErrRolloutStatus     = errors.New("rollout can't change from its status")
+	// Only a device offered the update downloads it, and reports its install, once
+	ErrNotOffered    = errors.New("update isn't offered to the device")
+	ErrInvalidReport = errors.New("a device reports downloading, installed or failed")
+)
+
+// Config holds where the images are stored, and when a rollout is paused
+type Config struct {
+	// Directory the images are stored in
+	Location string
+	// Largest image accepted, in bytes
+	MaxSize int64
+	// Share of failed installs that pauses the rollouts created without one
+	FailureThreshold float64
+	// Installs reported before the failure threshold is checked, for the rollouts created without it
+	MinReports uint
+	// When set, every image is uploaded with its signature, checked against it
+	PublicKey ed25519.PublicKey
+}
+
+/*
+WithDefaults fills every value left out, images of at most 64 MiB stored in ./firmware,
+and rollouts paused once more than 20% of at least 5 reported installs failed.
+*/
+func (config Config) WithDefaults() Config {
+	if config.Location == "" {
+		config.Location = "./firmware"
+	}
+	if config.MaxSize == 0 {
+		config.MaxSize = 64 << 20
+	}
+	if config.FailureThreshold == 0 {
+		config.FailureThreshold = 0.2
+	}
+	if config.MinReports == 0 {
+		config.MinReports = 5
+	}
+	return config
+}
+
+// Validate checks the values once filled
+func (config Config) Validate() error {
+	config = config.WithDefaults()
+	if config.MaxSize < 0 {
+		return fmt.Errorf("max_size should be positive")
+	}
+	if config.FailureThreshold < 0 || config.FailureThreshold > 1 {
+		return ErrInvalidThreshold
+	}
+	return nil
+}
+
+// ParsePublicKey reads a PEM encoded ed25519 public key, as written by openssl
+func ParsePublicKey(encoded []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(encoded)
+	if block == nil {
+		return nil, errors.New("no PEM block found in the public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, isEd25519 := key.(ed25519.PublicKey)
+	if !isEd25519 {
+		return nil, errors.New("the public key should be an ed25519 key")
+	}
+	return publicKey, nil
+}
+
+// Store keeps the images on disk, named by their SHA-256, so an image uploaded twice is stored once
+type Store struct {
+	location string
+	maxSize  int64
+}
+
+func NewStore(location string, maxSize int64) (*Store, error) {
+	if err := os.MkdirAll(location, 0o750); err != nil {
+		return nil, err
+	}
+	return &Store{location, maxSize}, nil
+}
+
+func (store *Store) path(sha string) string {
+	return filepath.Join(store.location, sha+".bin")
+}
+
+/*
+Save writes the image to a temporary file while hashing it, and moves it to its
+name once complete, returning its hex encoded SHA-256 and its size.
+*/
+func (store *Store) Save(image io.Reader) (sha string, size int64, err error) {
+	file, err := os.CreateTemp(store.location, "upload-*.tmp")
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	hash := sha256.New()
+	// Read one byte past the limit, to tell a complete image from a cut one
+	size, err = io.Copy(io.MultiWriter(file, hash), io.LimitReader(image, store.maxSize+1))
+	if err != nil {
+		return "", 0, err
+	}
+	if size > store.maxSize {
+		return "", 0, fmt.Errorf("%w: at most %d bytes", ErrTooLarge, store.maxSize)
+	}
+	if err = file.Sync(); err != nil {
+		return "", 0, err
+	}
+	if err = file.Close(); err != nil {
+		return "", 0, err
+	}
+
+	sha = hex.EncodeToString(hash.Sum(nil))
+	if err = os.Rename(file.Name(), store.path(sha)); err != nil {
+		return "", 0, err
+	}
+	return sha, size, nil
+}
+
+func (store *Store) Open(sha string) (*os.File, error) {
+	return os.Open(store.path(sha))
+}
+
+// Remove deletes the image, an image already gone isn't an error
+func (store *Store) Remove(sha string) error {
+	if err := os.Remove(store.path(sha)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
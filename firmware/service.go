@@ -0,0 +1,480 @@
+package firmware
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+// Upload describes an image uploaded, SHA256 is checked against the image when given
+type Upload struct {
+	DeviceType  repository.DeviceType
+	Version     string
+	Description string
+	// Hex encoded
+	SHA256 string
+	// Base64 encoded
+	Signature string
+}
+
+/*
+RolloutRequest rolls a firmware out to Percentage of the devices of its type, or to the
+devices of SerialIds, the failure threshold and min reports left out take the defaults.
+*/
+type RolloutRequest struct {
+	FirmwareID       uint
+	Percentage       uint
+	SerialIds        []string
+	FailureThreshold float64
+	MinReports       uint
+}
+
+// Update is what a device fetches when a rollout offers it an image
+type Update struct {
+	RolloutID  uint                    `json:"rollout_id"`
+	FirmwareID uint                    `json:"firmware_id"`
+	Version    string                  `json:"version"`
+	Size       int64                   `json:"size"`
+	SHA256     string                  `json:"sha256"`
+	Signature  string                  `json:"signature,omitempty"`
+	Status     repository.UpdateStatus `json:"status"`
+}
+
+// Service uploads the images, and rolls them out to the devices
+type Service struct {
+	repo        repository.FirmwareRepository
+	devices     repository.DeviceRepository
+	deviceTypes *devicetypes.Registry
+	store       *Store
+	config      Config
+
+	// Held while a rollout is created, so a device type never gets two in progress
+	rolloutMutex sync.Mutex
+}
+
+func NewService(
+	repo repository.FirmwareRepository, devices repository.DeviceRepository, deviceTypes *devicetypes.Registry, config Config,
+) (*Service, error) {
+	config = config.WithDefaults()
+	store, err := NewStore(config.Location, config.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Service{repo: repo, devices: devices, deviceTypes: deviceTypes, store: store, config: config}, nil
+}
+
+// MaxSize is the largest image accepted, in bytes
+func (service *Service) MaxSize() int64 {
+	return service.config.MaxSize
+}
+
+// checkSignature decodes the signature, checking it against the public key when one is configured
+func (service *Service) checkSignature(signature, sha string) error {
+	if signature == "" {
+		if service.config.PublicKey != nil {
+			return fmt.Errorf("%w: the image should be signed", ErrInvalidSignature)
+		}
+		return nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, err.Error())
+	}
+	if service.config.PublicKey == nil {
+		return nil
+	}
+	digest, err := hex.DecodeString(sha)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(service.config.PublicKey, digest, decoded) {
+		return fmt.Errorf("%w: it doesn't match the image", ErrInvalidSignature)
+	}
+	return nil
+}
+
+// removeUnused deletes the image from disk once no firmware is stored with it
+func (service *Service) removeUnused(ctx context.Context, sha string) {
+	firmware, err := service.repo.List(ctx)
+	if err != nil {
+		return
+	}
+	for _, stored := range firmware {
+		if stored.SHA256 == sha {
+			return
+		}
+	}
+	if err = service.store.Remove(sha); err != nil {
+		slog.Error("firmware", "status", "failed to remove the image", "sha256", sha, "cause", err.Error())
+	}
+}
+
+// Upload stores the image, and records it as the version of its device type
+func (service *Service) Upload(
+	ctx context.Context, upload Upload, image io.Reader, actor string, now time.Time,
+) (repository.Firmware, error) {
+	if _, found := service.deviceTypes.Get(upload.DeviceType); !found {
+		return repository.Firmware{}, devicetypes.ErrUnknownType
+	}
+	sha, size, err := service.store.Save(image)
+	if err != nil {
+		return repository.Firmware{}, err
+	}
+
+	err = service.checkSignature(upload.Signature, sha)
+	if upload.SHA256 != "" && !strings.EqualFold(upload.SHA256, sha) {
+		err = fmt.Errorf("%w: the image has %s", ErrChecksumMismatch, sha)
+	}
+	var firmware repository.Firmware
+	if err == nil {
+		firmware, err = service.repo.Create(ctx, repository.NewFirmware{
+			DeviceType:  upload.DeviceType,
+			Version:     upload.Version,
+			Size:        size,
+			SHA256:      sha,
+			Signature:   sql.NullString{String: upload.Signature, Valid: upload.Signature != ""},
+			Description: sql.NullString{String: upload.Description, Valid: upload.Description != ""},
+			UploadedBy:  actor,
+			UploadedAt:  now.UnixMilli(),
+		})
+	}
+	if err != nil {
+		service.removeUnused(ctx, sha)
+		return repository.Firmware{}, err
+	}
+
+	slog.Info("firmware", "status", "uploaded", "device_type", service.deviceTypes.Name(upload.DeviceType),
+		"version", upload.Version, "sha256", sha, "actor", actor)
+	return firmware, nil
+}
+
+func (service *Service) List(ctx context.Context) ([]repository.Firmware, error) {
+	return service.repo.List(ctx)
+}
+
+// Delete removes the firmware with its rollouts, and its image once no other firmware has it
+func (service *Service) Delete(ctx context.Context, id uint, actor string) error {
+	firmware, err := service.repo.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err = service.repo.Delete(ctx, id); err != nil {
+		return err
+	}
+	service.removeUnused(ctx, firmware.SHA256)
+	slog.Info("firmware", "status", "deleted", "version", firmware.Version, "actor", actor)
+	return nil
+}
+
+// CreateRollout starts offering the firmware to the devices targeted
+func (service *Service) CreateRollout(
+	ctx context.Context, request RolloutRequest, actor string, now time.Time,
+) (repository.Rollout, error) {
+	firmware, err := service.repo.Get(ctx, request.FirmwareID)
+	if err != nil {
+		return repository.Rollout{}, err
+	}
+	if (request.Percentage == 0) == (len(request.SerialIds) == 0) || request.Percentage > 100 {
+		return repository.Rollout{}, fmt.Errorf("%w: either a percentage from 1 to 100, or the serial ids", ErrInvalidTarget)
+	}
+	if request.FailureThreshold == 0 {
+		request.FailureThreshold = service.config.FailureThreshold
+	}
+	if request.FailureThreshold < 0 || request.FailureThreshold > 1 {
+		return repository.Rollout{}, ErrInvalidThreshold
+	}
+	if request.MinReports == 0 {
+		request.MinReports = service.config.MinReports
+	}
+
+	devices := make([]uint, 0, len(request.SerialIds))
+	for _, serialId := range request.SerialIds {
+		device, err := service.devices.GetBySerial(ctx, serialId)
+		if err != nil {
+			return repository.Rollout{}, err
+		}
+		if device.DeviceType != firmware.DeviceType {
+			return repository.Rollout{}, fmt.Errorf("%w: %s isn't a %s", ErrInvalidTarget, serialId,
+				service.deviceTypes.Name(firmware.DeviceType))
+		}
+		if device.DeviceStatus == repository.Decommissioned {
+			return repository.Rollout{}, fmt.Errorf("%w: %s is decommissioned", ErrInvalidTarget, serialId)
+		}
+		devices = append(devices, device.ID)
+	}
+
+	service.rolloutMutex.Lock()
+	defer service.rolloutMutex.Unlock()
+	rollouts, err := service.repo.ListRollouts(ctx)
+	if err != nil {
+		return repository.Rollout{}, err
+	}
+	for _, rollout := range rollouts {
+		if rollout.DeviceType == firmware.DeviceType && !rollout.Status.Final() {
+			return repository.Rollout{}, fmt.Errorf("%w: rollout %d", ErrRolloutInProgress, rollout.ID)
+		}
+	}
+
+	rollout, err := service.repo.CreateRollout(ctx, repository.NewRollout{
+		FirmwareFk:       firmware.ID,
+		Percentage:       request.Percentage,
+		FailureThreshold: request.FailureThreshold,
+		MinReports:       request.MinReports,
+		CreatedBy:        actor,
+		CreatedAt:        now.UnixMilli(),
+	}, devices)
+	if err != nil {
+		return repository.Rollout{}, err
+	}
+	slog.Info("firmware", "status", "rollout created", "rollout", rollout.ID, "version", firmware.Version,
+		"percentage", rollout.Percentage, "devices", rollout.Devices, "actor", actor)
+	return rollout, nil
+}
+
+func (service *Service) Rollouts(ctx context.Context) ([]repository.Rollout, error) {
+	return service.repo.ListRollouts(ctx)
+}
+
+func (service *Service) RolloutDevices(ctx context.Context, id uint) ([]repository.RolloutDevice, error) {
+	if _, err := service.repo.GetRollout(ctx, id); err != nil {
+		return nil, err
+	}
+	return service.repo.RolloutDevices(ctx, id)
+}
+
+// change moves the rollout to the status from one of the statuses, a rollout in another one is an ErrRolloutStatus
+func (service *Service) change(
+	ctx context.Context, id uint, from []repository.RolloutStatus, to repository.RolloutStatus, actor, reason string, now time.Time,
+) (repository.Rollout, error) {
+	rollout, err := service.repo.ChangeRollout(ctx, id, from, repository.RolloutChange{
+		Status: to,
+		Actor:  actor,
+		Reason: sql.NullString{String: reason, Valid: reason != ""},
+		At:     now.UnixMilli(),
+	})
+	if errors.Is(err, repository.NotFound) {
+		current, getErr := service.repo.GetRollout(ctx, id)
+		if getErr != nil {
+			return repository.Rollout{}, getErr
+		}
+		return repository.Rollout{}, fmt.Errorf("%w: it is %s", ErrRolloutStatus, current.Status)
+	}
+	if err != nil {
+		return repository.Rollout{}, err
+	}
+	slog.Info("firmware", "status", "rollout "+to.String(), "rollout", id, "actor", actor, "reason", reason)
+	return rollout, nil
+}
+
+// Pause stops offering the update, the devices already updating may still report
+func (service *Service) Pause(ctx context.Context, id uint, actor, reason string, now time.Time) (repository.Rollout, error) {
+	return service.change(ctx, id, []repository.RolloutStatus{repository.RolloutActive}, repository.RolloutPaused, actor, reason, now)
+}
+
+func (service *Service) Resume(ctx context.Context, id uint, actor, reason string, now time.Time) (repository.Rollout, error) {
+	return service.change(ctx, id, []repository.RolloutStatus{repository.RolloutPaused}, repository.RolloutActive, actor, reason, now)
+}
+
+// Complete ends the rollout, letting another one of the device type start
+func (service *Service) Complete(ctx context.Context, id uint, actor, reason string, now time.Time) (repository.Rollout, error) {
+	from := []repository.RolloutStatus{repository.RolloutActive, repository.RolloutPaused}
+	return service.change(ctx, id, from, repository.RolloutCompleted, actor, reason, now)
+}
+
+// Cancel ends the rollout, its image isn't served to the devices anymore
+func (service *Service) Cancel(ctx context.Context, id uint, actor, reason string, now time.Time) (repository.Rollout, error) {
+	from := []repository.RolloutStatus{repository.RolloutActive, repository.RolloutPaused}
+	return service.change(ctx, id, from, repository.RolloutCancelled, actor, reason, now)
+}
+
+// selected reports if the device falls within the percentage of the rollout, the same devices every time
+func selected(rolloutID uint, serialId string, percentage uint) bool {
+	hash := fnv.New32a()
+	fmt.Fprintf(hash, "%d/%s", rolloutID, serialId)
+	return uint(hash.Sum32()%100) < percentage
+}
+
+/*
+Check returns the update the device is offered, if any, by the active rollout of its type.
+A device running the version of the rollout already isn't offered it, a listed one is
+recorded as installed.
+*/
+func (service *Service) Check(
+	ctx context.Context, device repository.Device, running string, now time.Time,
+) (Update, bool, error) {
+	if device.DeviceStatus == repository.Decommissioned {
+		return Update{}, false, nil
+	}
+	rollouts, err := service.repo.ListRollouts(ctx)
+	if err != nil {
+		return Update{}, false, err
+	}
+	var rollout *repository.Rollout
+	for i := range rollouts {
+		if rollouts[i].DeviceType == device.DeviceType && rollouts[i].Status == repository.RolloutActive {
+			rollout = &rollouts[i]
+			break
+		}
+	}
+	if rollout == nil {
+		return Update{}, false, nil
+	}
+
+	at := now.UnixMilli()
+	record, err := service.repo.GetRolloutDevice(ctx, rollout.ID, device.ID)
+	switch {
+	case errors.Is(err, repository.NotFound):
+		if rollout.Percentage == 0 || !selected(rollout.ID, device.SerialId, rollout.Percentage) || running == rollout.Version {
+			return Update{}, false, nil
+		}
+		record, err = service.repo.AddRolloutDevice(ctx, rollout.ID, device.ID, repository.UpdateOffered, at)
+		if errors.Is(err, repository.AlreadyExists) {
+			// Checked twice at once, the other check offered it
+			record, err = service.repo.GetRolloutDevice(ctx, rollout.ID, device.ID)
+		}
+	case err == nil && record.Status == repository.UpdatePending:
+		from := []repository.UpdateStatus{repository.UpdatePending}
+		if running == rollout.Version {
+			detail := sql.NullString{String: "already running the version", Valid: true}
+			_, err = service.repo.ChangeRolloutDevice(ctx, rollout.ID, device.ID, from, repository.UpdateInstalled, detail, at)
+			if err == nil {
+				service.evaluate(ctx, rollout.ID, now)
+			}
+			return Update{}, false, err
+		}
+		record, err = service.repo.ChangeRolloutDevice(ctx, rollout.ID, device.ID, from, repository.UpdateOffered, sql.NullString{}, at)
+	}
+	if err != nil {
+		return Update{}, false, err
+	}
+	if record.Status.Final() {
+		return Update{}, false, nil
+	}
+
+	firmware, err := service.repo.Get(ctx, rollout.FirmwareFk)
+	if err != nil {
+		return Update{}, false, err
+	}
+	return Update{
+		RolloutID:  rollout.ID,
+		FirmwareID: firmware.ID,
+		Version:    firmware.Version,
+		Size:       firmware.Size,
+		SHA256:     firmware.SHA256,
+		Signature:  firmware.Signature.String,
+		Status:     record.Status,
+	}, true, nil
+}
+
+/*
+Open returns the image of the firmware, for a device offered it by a rollout not cancelled,
+the caller closes it.
+*/
+func (service *Service) Open(ctx context.Context, device repository.Device, id uint) (*os.File, repository.Firmware, error) {
+	firmware, err := service.repo.Get(ctx, id)
+	if err != nil {
+		return nil, repository.Firmware{}, err
+	}
+	rollouts, err := service.repo.ListRollouts(ctx)
+	if err != nil {
+		return nil, repository.Firmware{}, err
+	}
+
+	offered := false
+	for _, rollout := range rollouts {
+		if rollout.FirmwareFk != id || rollout.Status == repository.RolloutCancelled {
+			continue
+		}
+		record, err := service.repo.GetRolloutDevice(ctx, rollout.ID, device.ID)
+		if err == nil && record.Status != repository.UpdatePending {
+			offered = true
+			break
+		}
+		if err != nil && !errors.Is(err, repository.NotFound) {
+			return nil, repository.Firmware{}, err
+		}
+	}
+	if !offered {
+		return nil, repository.Firmware{}, ErrNotOffered
+	}
+
+	file, err := service.store.Open(firmware.SHA256)
+	if err != nil {
+		return nil, repository.Firmware{}, err
+	}
+	return file, firmware, nil
+}
+
+/*
+Report records where the device is in its update, downloading it, or the outcome of its
+install, which may pause the rollout, or complete it once every device listed reported.
+*/
+func (service *Service) Report(
+	ctx context.Context, device repository.Device, rolloutID uint, status repository.UpdateStatus, detail string, now time.Time,
+) (repository.RolloutDevice, error) {
+	if status < repository.UpdateDownloading || status > repository.UpdateFailed {
+		return repository.RolloutDevice{}, ErrInvalidReport
+	}
+	rollout, err := service.repo.GetRollout(ctx, rolloutID)
+	if err != nil {
+		return repository.RolloutDevice{}, err
+	}
+	if rollout.Status.Final() {
+		return repository.RolloutDevice{}, fmt.Errorf("%w: it is %s", ErrRolloutStatus, rollout.Status)
+	}
+
+	from := []repository.UpdateStatus{repository.UpdateOffered, repository.UpdateDownloading}
+	record, err := service.repo.ChangeRolloutDevice(ctx, rolloutID, device.ID, from, status,
+		sql.NullString{String: detail, Valid: detail != ""}, now.UnixMilli())
+	if errors.Is(err, repository.NotFound) {
+		return repository.RolloutDevice{}, ErrNotOffered
+	}
+	if err != nil {
+		return repository.RolloutDevice{}, err
+	}
+	if status.Final() {
+		slog.Info("firmware", "status", "install "+status.String(), "rollout", rolloutID, "serial_id", device.SerialId,
+			"detail", detail)
+		service.evaluate(ctx, rolloutID, now)
+	}
+	return record, nil
+}
+
+/*
+evaluate pauses the active rollout once more of the installs reported failed than its
+threshold allows, and completes a rollout to the devices listed once they all reported.
+*/
+func (service *Service) evaluate(ctx context.Context, id uint, now time.Time) {
+	rollout, err := service.repo.GetRollout(ctx, id)
+	if err != nil || rollout.Status != repository.RolloutActive {
+		return
+	}
+	active := []repository.RolloutStatus{repository.RolloutActive}
+
+	reported := rollout.Installed + rollout.Failed
+	if reported > 0 && reported >= rollout.MinReports && float64(rollout.Failed)/float64(reported) > rollout.FailureThreshold {
+		reason := fmt.Sprintf("%d of the %d installs reported failed, over the %g threshold", rollout.Failed, reported,
+			rollout.FailureThreshold)
+		_, err = service.change(ctx, id, active, repository.RolloutPaused, repository.SystemActor, reason, now)
+	} else if rollout.Percentage == 0 && reported == rollout.Devices {
+		_, err = service.change(ctx, id, active, repository.RolloutCompleted, repository.SystemActor,
+			"every device listed reported its install", now)
+	}
+	if err != nil && !errors.Is(err, ErrRolloutStatus) {
+		slog.Error("firmware", "status", "failed to evaluate the rollout", "rollout", id, "cause", err.Error())
+	}
+}
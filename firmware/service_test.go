@@ -0,0 +1,184 @@
+package firmware
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestService(t *testing.T, config Config) (*Service, repository.Repositories) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	registry, err := devicetypes.Load(ctx, repos.DeviceTypes)
+	assert.NoError(t, err)
+	config.Location = t.TempDir()
+	service, err := NewService(repos.Firmware, repos.Devices, registry, config)
+	assert.NoError(t, err)
+	return service, repos
+}
+
+func TestUpload(t *testing.T) {
+	ctx := context.Background()
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	service, _ := newTestService(t, Config{MaxSize: 16, PublicKey: publicKey})
+	now := time.UnixMilli(1_000_000)
+
+	image := "firmware-1.2.0"
+	digest := sha256.Sum256([]byte(image))
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, digest[:]))
+
+	_, err = service.Upload(ctx, Upload{Version: "1.2.0"}, strings.NewReader(image), "ana", now)
+	assert.True(t, errors.Is(err, ErrInvalidSignature))
+	_, err = service.Upload(ctx, Upload{Version: "1.2.0", Signature: base64.StdEncoding.EncodeToString([]byte("forged"))},
+		strings.NewReader(image), "ana", now)
+	assert.True(t, errors.Is(err, ErrInvalidSignature))
+	_, err = service.Upload(ctx, Upload{Version: "1.2.0", Signature: signature, SHA256: strings.Repeat("0", 64)},
+		strings.NewReader(image), "ana", now)
+	assert.True(t, errors.Is(err, ErrChecksumMismatch))
+	_, err = service.Upload(ctx, Upload{Version: "1.3.0", Signature: signature}, strings.NewReader(strings.Repeat("x", 17)), "ana", now)
+	assert.True(t, errors.Is(err, ErrTooLarge))
+	_, err = service.Upload(ctx, Upload{DeviceType: 42, Version: "1.2.0"}, strings.NewReader(image), "ana", now)
+	assert.True(t, errors.Is(err, devicetypes.ErrUnknownType))
+
+	firmware, err := service.Upload(ctx, Upload{Version: "1.2.0", Signature: signature, SHA256: hex.EncodeToString(digest[:])},
+		strings.NewReader(image), "ana", now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(image)), firmware.Size)
+	_, err = service.Upload(ctx, Upload{Version: "1.2.0", Signature: signature}, strings.NewReader(image), "ana", now)
+	assert.True(t, errors.Is(err, repository.AlreadyExists))
+
+	// The image stays on disk while a firmware has it
+	file, err := service.store.Open(firmware.SHA256)
+	if assert.NoError(t, err) {
+		stored, _ := io.ReadAll(file)
+		file.Close()
+		assert.Equal(t, image, string(stored))
+	}
+	assert.NoError(t, service.Delete(ctx, firmware.ID, "ana"))
+	_, err = service.store.Open(firmware.SHA256)
+	assert.Error(t, err)
+}
+
+func TestRollout(t *testing.T) {
+	ctx := context.Background()
+	service, repos := newTestService(t, Config{})
+	now := time.UnixMilli(1_000_000)
+
+	devices := []repository.Device{}
+	for i := range 20 {
+		device, err := repos.Devices.Create(ctx, repository.NewDevice{SerialId: fmt.Sprintf("PMD-%06d", i)})
+		assert.NoError(t, err)
+		devices = append(devices, device)
+	}
+	firmware, err := service.Upload(ctx, Upload{Version: "2.0.0"}, strings.NewReader("firmware-2.0.0"), "ana", now)
+	assert.NoError(t, err)
+
+	_, err = service.CreateRollout(ctx, RolloutRequest{FirmwareID: firmware.ID}, "ana", now)
+	assert.True(t, errors.Is(err, ErrInvalidTarget))
+	_, err = service.CreateRollout(ctx, RolloutRequest{FirmwareID: firmware.ID, Percentage: 10, FailureThreshold: 2}, "ana", now)
+	assert.True(t, errors.Is(err, ErrInvalidThreshold))
+
+	// Listed devices only, completed once they all reported
+	rollout, err := service.CreateRollout(ctx, RolloutRequest{
+		FirmwareID: firmware.ID, SerialIds: []string{"PMD-000001", "PMD-000002"}, MinReports: 3,
+	}, "ana", now)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(2), rollout.Devices)
+	_, err = service.CreateRollout(ctx, RolloutRequest{FirmwareID: firmware.ID, Percentage: 50}, "ana", now)
+	assert.True(t, errors.Is(err, ErrRolloutInProgress))
+
+	_, offered, err := service.Check(ctx, devices[0], "1.0.0", now)
+	assert.NoError(t, err)
+	assert.False(t, offered)
+	_, _, err = service.Open(ctx, devices[0], firmware.ID)
+	assert.True(t, errors.Is(err, ErrNotOffered))
+
+	update, offered, err := service.Check(ctx, devices[1], "1.0.0", now)
+	assert.NoError(t, err)
+	if assert.True(t, offered) {
+		assert.Equal(t, firmware.SHA256, update.SHA256)
+		assert.Equal(t, repository.UpdateOffered, update.Status)
+	}
+	file, _, err := service.Open(ctx, devices[1], firmware.ID)
+	if assert.NoError(t, err) {
+		file.Close()
+	}
+	_, err = service.Report(ctx, devices[1], rollout.ID, repository.UpdateOffered, "", now)
+	assert.True(t, errors.Is(err, ErrInvalidReport))
+	_, err = service.Report(ctx, devices[1], rollout.ID, repository.UpdateDownloading, "", now)
+	assert.NoError(t, err)
+	_, err = service.Report(ctx, devices[1], rollout.ID, repository.UpdateInstalled, "", now)
+	assert.NoError(t, err)
+	_, err = service.Report(ctx, devices[1], rollout.ID, repository.UpdateFailed, "", now)
+	assert.True(t, errors.Is(err, ErrNotOffered))
+	// Already running the version, the second device counts as installed
+	_, offered, err = service.Check(ctx, devices[2], "2.0.0", now)
+	assert.NoError(t, err)
+	assert.False(t, offered)
+
+	rollouts, err := service.Rollouts(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, repository.RolloutCompleted, rollouts[0].Status)
+	assert.Equal(t, repository.SystemActor, rollouts[0].ChangedBy.String)
+
+	// A share of the devices, paused once too many of them failed
+	rollout, err = service.CreateRollout(ctx, RolloutRequest{
+		FirmwareID: firmware.ID, Percentage: 50, FailureThreshold: 0.4, MinReports: 2,
+	}, "ana", now)
+	assert.NoError(t, err)
+	offeredTo := []repository.Device{}
+	for _, device := range devices {
+		if _, offered, _ := service.Check(ctx, device, "1.0.0", now); offered {
+			offeredTo = append(offeredTo, device)
+		}
+	}
+	assert.NotEmpty(t, offeredTo)
+	assert.Less(t, len(offeredTo), len(devices))
+	for _, device := range offeredTo {
+		_, again, _ := service.Check(ctx, device, "1.0.0", now)
+		assert.True(t, again)
+	}
+
+	_, err = service.Report(ctx, offeredTo[0], rollout.ID, repository.UpdateFailed, "boot loop", now)
+	assert.NoError(t, err)
+	// Below min reports, a single failure doesn't pause it
+	rollout, _ = repos.Firmware.GetRollout(ctx, rollout.ID)
+	assert.Equal(t, repository.RolloutActive, rollout.Status)
+	_, err = service.Report(ctx, offeredTo[1], rollout.ID, repository.UpdateInstalled, "", now)
+	assert.NoError(t, err)
+	rollout, _ = repos.Firmware.GetRollout(ctx, rollout.ID)
+	assert.Equal(t, repository.RolloutPaused, rollout.Status)
+	assert.Contains(t, rollout.Reason.String, "1 of the 2 installs reported failed")
+
+	// Paused, nothing is offered, the devices updating still report
+	_, offered, err = service.Check(ctx, offeredTo[2], "1.0.0", now)
+	assert.NoError(t, err)
+	assert.False(t, offered)
+	_, err = service.Report(ctx, offeredTo[2], rollout.ID, repository.UpdateInstalled, "", now)
+	assert.NoError(t, err)
+
+	_, err = service.Pause(ctx, rollout.ID, "ana", "", now)
+	assert.True(t, errors.Is(err, ErrRolloutStatus))
+	_, err = service.Resume(ctx, rollout.ID, "ana", "fixed the boot loop", now)
+	assert.NoError(t, err)
+	_, err = service.Cancel(ctx, rollout.ID, "ana", "", now)
+	assert.NoError(t, err)
+	// Out of the completed rollout, the first device can't download the image anymore
+	_, _, err = service.Open(ctx, offeredTo[0], firmware.ID)
+	assert.True(t, errors.Is(err, ErrNotOffered))
+	_, err = service.Report(ctx, offeredTo[3], rollout.ID, repository.UpdateInstalled, "", now)
+	assert.True(t, errors.Is(err, ErrRolloutStatus))
+}
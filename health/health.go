@@ -0,0 +1,87 @@
+/*
+Package health keeps the latest result of every check the app runs on itself,
+so they can be reported together (e.g. by the health endpoint).
+*/
+package health
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type Status string
+
+const (
+	Ok       Status = "ok"
+	Degraded Status = "degraded"
+	Failing  Status = "failing"
+)
+
+// severity orders the statuses, the worst check decides the status of the report
+func (status Status) severity() int {
+	switch status {
+	case Ok:
+		return 0
+	case Degraded:
+		return 1
+	}
+	return 2
+}
+
+type Check struct {
+	Name      string         `json:"name"`
+	Status    Status         `json:"status"`
+	Message   string         `json:"message,omitempty"`
+	Details   map[string]any `json:"details,omitempty"`
+	CheckedAt time.Time      `json:"checked_at"`
+}
+
+type Report struct {
+	Status Status  `json:"status"`
+	Checks []Check `json:"checks"`
+}
+
+type Registry struct {
+	mutex  sync.RWMutex
+	checks map[string]Check
+}
+
+func NewRegistry() *Registry {
+	return &Registry{checks: map[string]Check{}}
+}
+
+// Set stores the check, replacing the previous result with the same name
+func (registry *Registry) Set(check Check) {
+	if check.CheckedAt.IsZero() {
+		check.CheckedAt = time.Now()
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.checks[check.Name] = check
+}
+
+func (registry *Registry) Get(name string) (check Check, exists bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	check, exists = registry.checks[name]
+	return
+}
+
+// Report returns every check sorted by name, with the status of the worst one
+func (registry *Registry) Report() Report {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	report := Report{Status: Ok, Checks: make([]Check, 0, len(registry.checks))}
+	for _, check := range registry.checks {
+		report.Checks = append(report.Checks, check)
+		if check.Status.severity() > report.Status.severity() {
+			report.Status = check.Status
+		}
+	}
+	sort.Slice(report.Checks, func(i, j int) bool { return report.Checks[i].Name < report.Checks[j].Name })
+
+	return report
+}
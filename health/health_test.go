@@ -0,0 +1,26 @@
+package health
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportTakesTheWorstStatus(t *testing.T) {
+	registry := NewRegistry()
+	assert.Equal(t, Ok, registry.Report().Status)
+
+	registry.Set(Check{Name: "database", Status: Degraded})
+	registry.Set(Check{Name: "backup", Status: Ok})
+	report := registry.Report()
+	assert.Equal(t, Degraded, report.Status)
+	assert.Equal(t, "backup", report.Checks[0].Name)
+	assert.False(t, report.Checks[0].CheckedAt.IsZero())
+
+	registry.Set(Check{Name: "backup", Status: Failing})
+	assert.Equal(t, Failing, registry.Report().Status)
+
+	registry.Set(Check{Name: "backup", Status: Ok})
+	registry.Set(Check{Name: "database", Status: Ok})
+	assert.Equal(t, Ok, registry.Report().Status)
+}
@@ -0,0 +1,194 @@
+/*
+Package ingest sits between the web handlers and the database, queueing the
+published measurements in memory, and writing them in batches, so a burst of
+publishes costs a few transactions instead of one each.
+*/
+package ingest
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+// Returned by Submit when the queue (and the spill file, if any) can't take the measurement
+var ErrQueueFull = errors.New("the measurement queue is full")
+
+// Returned by Flush when the writer stopped before the flush was done
+var ErrStopped = errors.New("the measurement writer is not running")
+
+/*
+Config sizes the queue and paces the writer, a batch is committed once it holds
+BatchSize measurements, or FlushInterval after its first measurement.
+When SpillLocation is set, measurements that don't fit the queue are appended
+to that file, and written once the queue drains, instead of being refused.
+*/
+type Config struct {
+	QueueSize     uint
+	BatchSize     uint
+	FlushInterval time.Duration
+	// How long clients are told to wait, when the queue is full
+	RetryAfter    time.Duration
+	SpillLocation string
+}
+
+// WithDefaults fills every value left out, the disk spill stays disabled
+func (config Config) WithDefaults() Config {
+	if config.QueueSize == 0 {
+		config.QueueSize = 10_000
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = 500
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = 250 * time.Millisecond
+	}
+	if config.RetryAfter == 0 {
+		config.RetryAfter = time.Second
+	}
+	return config
+}
+
+/*
+Pipeline queues the measurements given to Submit, and writes them from a single
+writer goroutine (Run). A batch that fails to be written is retried, and while it
+is, nothing else is taken from the queue, so a failing db fills the queue and
+pushes back on the clients, instead of growing the memory used.
+*/
+type Pipeline struct {
+	repo    repository.MeasurementRepository
+	config  Config
+	queue   chan repository.NewMeasurement
+	flushes chan chan error
+	spill   *spillFile
+	done    chan struct{}
+
+	stopOnce sync.Once
+}
+
+func NewPipeline(repo repository.MeasurementRepository, config Config) *Pipeline {
+	config = config.WithDefaults()
+	pipeline := &Pipeline{
+		repo:    repo,
+		config:  config,
+		queue:   make(chan repository.NewMeasurement, config.QueueSize),
+		flushes: make(chan chan error),
+		done:    make(chan struct{}),
+	}
+	if config.SpillLocation != "" {
+		pipeline.spill = &spillFile{path: config.SpillLocation}
+	}
+	return pipeline
+}
+
+// RetryAfter is how long clients should wait before publishing again, after ErrQueueFull
+func (pipeline *Pipeline) RetryAfter() time.Duration {
+	return pipeline.config.RetryAfter
+}
+
+// Submit queues the measurement without waiting for it to be written
+func (pipeline *Pipeline) Submit(measurement repository.NewMeasurement) error {
+	select {
+	case <-pipeline.done:
+		return ErrStopped
+	default:
+	}
+
+	select {
+	case pipeline.queue <- measurement:
+		return nil
+	default:
+	}
+
+	if pipeline.spill == nil {
+		return ErrQueueFull
+	}
+	if err := pipeline.spill.append(measurement); err != nil {
+		slog.Error("ingest", "spill-failure", err.Error())
+		return ErrQueueFull
+	}
+	return nil
+}
+
+/*
+Flush waits until every measurement queued before the call is written,
+it is meant for tests and tooling, the writer flushes on its own.
+*/
+func (pipeline *Pipeline) Flush(ctx context.Context) error {
+	result := make(chan error, 1)
+	select {
+	case pipeline.flushes <- result:
+	case <-pipeline.done:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+Run is the writer, it blocks until the context is done. Once done, no more
+measurements are accepted, and what is still queued is written with the given
+shutdown deadline, anything that fails to be written is moved into the spill file.
+*/
+func (pipeline *Pipeline) Run(ctx context.Context, shutdownTimeout time.Duration) {
+	writer := newBatchWriter(pipeline)
+	writer.replaySpill(ctx)
+
+	flushTicker := time.NewTicker(pipeline.config.FlushInterval)
+	defer flushTicker.Stop()
+
+	for {
+		// A batch waiting to be retried blocks the queue, pushing back on the clients
+		queue := pipeline.queue
+		if writer.full() {
+			queue = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			pipeline.stop(writer, shutdownTimeout)
+			return
+
+		case measurement := <-queue:
+			writer.add(measurement)
+			if writer.full() {
+				writer.write(ctx)
+			}
+
+		case result := <-pipeline.flushes:
+			result <- writer.drain(ctx)
+
+		case <-flushTicker.C:
+			writer.write(ctx)
+			if writer.empty() && len(pipeline.queue) == 0 {
+				writer.replaySpill(ctx)
+			}
+		}
+	}
+}
+
+// stop refuses new measurements, and writes or spills everything still queued
+func (pipeline *Pipeline) stop(writer *batchWriter, shutdownTimeout time.Duration) {
+	pipeline.stopOnce.Do(func() { close(pipeline.done) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := writer.drain(ctx); err != nil {
+		slog.Error("ingest", "shutdown-flush-failure", err.Error())
+		writer.spillPending()
+		return
+	}
+	slog.Info("ingest", "shutdown", "flushed every queued measurement")
+}
@@ -0,0 +1,204 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingRepository fails every write while failing is set, and the writes of the rejected value
+type failingRepository struct {
+	*repository.MemoryMeasurementRepository
+	mutex    sync.Mutex
+	failing  bool
+	batches  int
+	rejected string
+}
+
+func (repo *failingRepository) setFailing(failing bool) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.failing = failing
+}
+
+func (repo *failingRepository) InsertBatch(ctx context.Context, measurements []repository.NewMeasurement) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if repo.failing {
+		return errors.New("db unavailable")
+	}
+	for _, measurement := range measurements {
+		if repo.rejected != "" && measurement.Value == repo.rejected {
+			return repository.NewRepositoryError(repository.ConstraintFailed, "measurement rejected", "failed to insert the measurement batch")
+		}
+	}
+	repo.batches++
+	return repo.MemoryMeasurementRepository.InsertBatch(ctx, measurements)
+}
+
+func (repo *failingRepository) Insert(ctx context.Context, measurement repository.NewMeasurement) (repository.Measurement, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if repo.failing {
+		return repository.Measurement{}, errors.New("db unavailable")
+	}
+	if repo.rejected != "" && measurement.Value == repo.rejected {
+		return repository.Measurement{}, repository.NewRepositoryError(repository.ConstraintFailed, "measurement rejected", "failed to insert the measurement")
+	}
+	return repo.MemoryMeasurementRepository.Insert(ctx, measurement)
+}
+
+func stored(t *testing.T, repo repository.MeasurementRepository) int {
+	measurements, err := repo.Query(context.Background(), repository.MeasurementQuery{DeviceID: 1, To: 1 << 62})
+	assert.NoError(t, err)
+	return len(measurements)
+}
+
+func measurement(receivedAt int64) repository.NewMeasurement {
+	return repository.NewMeasurement{PublishingDeviceFk: 1, Value: "10", ReceivedAt: receivedAt}
+}
+
+func startPipeline(t *testing.T, pipeline *Pipeline) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pipeline.Run(ctx, time.Second)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestPipelineBatchesWrites(t *testing.T) {
+	repo := &failingRepository{MemoryMeasurementRepository: repository.NewMemoryMeasurementRepository()}
+	pipeline := NewPipeline(repo, Config{BatchSize: 10, FlushInterval: time.Hour})
+	stop := startPipeline(t, pipeline)
+
+	for i := 0; i < 25; i++ {
+		assert.NoError(t, pipeline.Submit(measurement(int64(i))))
+	}
+	assert.NoError(t, pipeline.Flush(context.Background()))
+	assert.Equal(t, 25, stored(t, repo))
+	assert.Equal(t, 3, repo.batches)
+
+	stop()
+	assert.ErrorIs(t, pipeline.Submit(measurement(0)), ErrStopped)
+}
+
+func TestPipelineBackpressure(t *testing.T) {
+	repo := &failingRepository{MemoryMeasurementRepository: repository.NewMemoryMeasurementRepository()}
+	repo.setFailing(true)
+	pipeline := NewPipeline(repo, Config{QueueSize: 4, BatchSize: 2, FlushInterval: time.Millisecond})
+	stop := startPipeline(t, pipeline)
+
+	// The failing batch holds 2, the rest fills the queue
+	var err error
+	accepted := 0
+	for ; accepted < 10; accepted++ {
+		if err = pipeline.Submit(measurement(int64(accepted))); err != nil {
+			break
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	assert.ErrorIs(t, err, ErrQueueFull)
+	assert.LessOrEqual(t, accepted, 6)
+
+	repo.setFailing(false)
+	assert.NoError(t, pipeline.Flush(context.Background()))
+	assert.Equal(t, accepted, stored(t, repo))
+	assert.NoError(t, pipeline.Submit(measurement(100)))
+	stop()
+	assert.Equal(t, accepted+1, stored(t, repo), "queued measurements are flushed on shutdown")
+}
+
+func TestPipelineSpill(t *testing.T) {
+	spillPath := filepath.Join(t.TempDir(), "ingest.spill")
+	repo := &failingRepository{MemoryMeasurementRepository: repository.NewMemoryMeasurementRepository()}
+	repo.setFailing(true)
+	pipeline := NewPipeline(repo, Config{
+		QueueSize: 2, BatchSize: 2, FlushInterval: time.Millisecond, SpillLocation: spillPath,
+	})
+	stop := startPipeline(t, pipeline)
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, pipeline.Submit(measurement(int64(i))))
+	}
+	// Whatever is still pending on shutdown is spilled too
+	stop()
+	assert.FileExists(t, spillPath)
+	assert.Equal(t, 0, stored(t, repo))
+
+	// The next run replays the spill file before anything else
+	repo.setFailing(false)
+	pipeline = NewPipeline(repo, Config{BatchSize: 3, SpillLocation: spillPath})
+	stop = startPipeline(t, pipeline)
+	assert.NoError(t, pipeline.Flush(context.Background()))
+	stop()
+
+	assert.Equal(t, 10, stored(t, repo))
+	_, err := os.Stat(spillPath)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestPipelineSpillQuarantine(t *testing.T) {
+	spillPath := filepath.Join(t.TempDir(), "ingest.spill")
+	spill := &spillFile{path: spillPath}
+	// Past the 64KB default line of a scanner
+	long := repository.NewMeasurement{PublishingDeviceFk: 1, Value: strings.Repeat("1", 100_000), ReceivedAt: 1}
+	rejected := repository.NewMeasurement{PublishingDeviceFk: 1, Value: "rejected", ReceivedAt: 2}
+	assert.NoError(t, spill.append(long, rejected, measurement(3), measurement(4), measurement(5)))
+
+	// The rejected measurement fails its batch, the others of the batch are still written
+	repo := &failingRepository{MemoryMeasurementRepository: repository.NewMemoryMeasurementRepository(), rejected: "rejected"}
+	pipeline := NewPipeline(repo, Config{BatchSize: 2, SpillLocation: spillPath})
+	stop := startPipeline(t, pipeline)
+	assert.NoError(t, pipeline.Flush(context.Background()))
+	stop()
+
+	assert.Equal(t, 4, stored(t, repo))
+	assert.NoFileExists(t, spillPath)
+	assert.NoFileExists(t, spill.replayPath())
+	quarantined, err := os.ReadFile(spill.rejectedPath())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(quarantined), "\n"))
+	assert.Contains(t, string(quarantined), `"m_value":"rejected"`)
+}
+
+func TestPipelineQuarantinesRejected(t *testing.T) {
+	spillPath := filepath.Join(t.TempDir(), "ingest.spill")
+	repo := &failingRepository{MemoryMeasurementRepository: repository.NewMemoryMeasurementRepository(), rejected: "rejected"}
+	pipeline := NewPipeline(repo, Config{BatchSize: 4, FlushInterval: time.Hour, SpillLocation: spillPath})
+	stop := startPipeline(t, pipeline)
+	defer stop()
+
+	// A batch starting with rejected measurements (e.g. of a device just deleted) isn't taken for a failing db
+	rejected := repository.NewMeasurement{PublishingDeviceFk: 1, Value: "rejected", ReceivedAt: 1}
+	for range 3 {
+		assert.NoError(t, pipeline.Submit(rejected))
+	}
+	assert.NoError(t, pipeline.Submit(measurement(2)))
+	assert.NoError(t, pipeline.Flush(context.Background()))
+	assert.Equal(t, 1, stored(t, repo))
+
+	// Nothing is left to retry, the next measurements are written
+	for i := range 4 {
+		assert.NoError(t, pipeline.Submit(measurement(int64(3+i))))
+	}
+	assert.NoError(t, pipeline.Flush(context.Background()))
+	assert.Equal(t, 5, stored(t, repo))
+
+	quarantined, err := os.ReadFile((&spillFile{path: spillPath}).rejectedPath())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(quarantined), "\n"))
+	assert.NoFileExists(t, spillPath)
+}
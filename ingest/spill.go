@@ -0,0 +1,182 @@
+package ingest
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+// spilledMeasurement is a measurement as stored in the spill file, one json object per line
+type spilledMeasurement struct {
+	PublishingDeviceFk uint `json:"publishing_device_fk"`
+	// Left out for the measurements not published by an accessory
+	AccessoryFk int64  `json:"accessory_fk,omitempty"`
+	Value       string `json:"m_value"`
+	ValueType   uint   `json:"m_value_type"`
+	ReceivedAt  int64  `json:"received_at"`
+	// Left out for the measurements the device didn't time
+	MeasuredAt  int64 `json:"measured_at,omitempty"`
+	ClockSkewed bool  `json:"clock_skewed,omitempty"`
+}
+
+func (spilled spilledMeasurement) measurement() repository.NewMeasurement {
+	return repository.NewMeasurement{
+		PublishingDeviceFk: spilled.PublishingDeviceFk,
+		AccessoryFk:        sql.NullInt64{Int64: spilled.AccessoryFk, Valid: spilled.AccessoryFk != 0},
+		Value:              spilled.Value,
+		ValueType:          spilled.ValueType,
+		ReceivedAt:         spilled.ReceivedAt,
+		MeasuredAt:         sql.NullInt64{Int64: spilled.MeasuredAt, Valid: spilled.MeasuredAt != 0},
+		ClockSkewed:        spilled.ClockSkewed,
+	}
+}
+
+// The longest line read back from the spill file, the default of bufio is 64KB
+const maxSpilledLine = 16 << 20
+
+/*
+spillFile appends the measurements that didn't fit the queue to a file, replaying
+them later. The file is moved aside while being replayed, so new measurements can
+be spilled in the meantime, and a crash mid replay leaves it to be replayed again.
+The measurements the db rejects on their own are moved into a quarantine file, kept
+for an operator to look into, instead of failing every replay after.
+*/
+type spillFile struct {
+	mutex sync.Mutex
+	path  string
+}
+
+func (spill *spillFile) replayPath() string {
+	return spill.path + ".replay"
+}
+
+func (spill *spillFile) rejectedPath() string {
+	return spill.path + ".rejected"
+}
+
+func (spill *spillFile) append(measurements ...repository.NewMeasurement) error {
+	return spill.appendTo(spill.path, measurements...)
+}
+
+func (spill *spillFile) appendTo(path string, measurements ...repository.NewMeasurement) error {
+	spill.mutex.Lock()
+	defer spill.mutex.Unlock()
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	for _, measurement := range measurements {
+		err = encoder.Encode(spilledMeasurement{
+			PublishingDeviceFk: measurement.PublishingDeviceFk,
+			AccessoryFk:        measurement.AccessoryFk.Int64,
+			Value:              measurement.Value,
+			ValueType:          measurement.ValueType,
+			ReceivedAt:         measurement.ReceivedAt,
+			MeasuredAt:         measurement.MeasuredAt.Int64,
+			ClockSkewed:        measurement.ClockSkewed,
+		})
+		if err != nil {
+			break
+		}
+	}
+	return errors.Join(err, file.Close())
+}
+
+/*
+replay hands the spilled measurements to write in batches, the ones left when a
+batch fails are appended back into the spill file, to be replayed the next time.
+The ones write rejects on their own are quarantined.
+*/
+func (spill *spillFile) replay(
+	batchSize uint,
+	write func([]repository.NewMeasurement) ([]repository.NewMeasurement, error),
+) (replayed, rejected int, err error) {
+	spill.mutex.Lock()
+	// A replay file left by a crash is replayed before taking the current spill file
+	if _, statErr := os.Stat(spill.replayPath()); errors.Is(statErr, os.ErrNotExist) {
+		err = os.Rename(spill.path, spill.replayPath())
+	}
+	spill.mutex.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	file, err := os.Open(spill.replayPath())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	batch := make([]repository.NewMeasurement, 0, batchSize)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxSpilledLine)
+	flush := func() error {
+		failed, err := write(batch)
+		if err != nil {
+			return spill.keep(batch, scanner, err)
+		}
+		replayed += len(batch) - len(failed)
+		batch = batch[:0]
+		if len(failed) == 0 {
+			return nil
+		}
+		if err = spill.appendTo(spill.rejectedPath(), failed...); err != nil {
+			// Not quarantined, they are replayed again
+			return spill.keep(failed, scanner, err)
+		}
+		rejected += len(failed)
+		return nil
+	}
+	for scanner.Scan() {
+		var spilled spilledMeasurement
+		if err = json.Unmarshal(scanner.Bytes(), &spilled); err != nil {
+			// A line cut short by a crash is the only way to get here, it can't be recovered
+			continue
+		}
+		batch = append(batch, spilled.measurement())
+
+		if uint(len(batch)) < batchSize {
+			continue
+		}
+		if err = flush(); err != nil {
+			return replayed, rejected, err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return replayed, rejected, err
+	}
+	if len(batch) > 0 {
+		if err = flush(); err != nil {
+			return replayed, rejected, err
+		}
+	}
+
+	return replayed, rejected, os.Remove(spill.replayPath())
+}
+
+// keep appends the failed batch, and what the scanner didn't read yet, back into the spill file
+func (spill *spillFile) keep(batch []repository.NewMeasurement, scanner *bufio.Scanner, cause error) error {
+	for scanner.Scan() {
+		var spilled spilledMeasurement
+		if json.Unmarshal(scanner.Bytes(), &spilled) != nil {
+			continue
+		}
+		batch = append(batch, spilled.measurement())
+	}
+	if err := errors.Join(scanner.Err(), spill.append(batch...)); err != nil {
+		// The replay file is kept, it is replayed again before the spill file
+		return errors.Join(cause, err)
+	}
+	return errors.Join(cause, os.Remove(spill.replayPath()))
+}
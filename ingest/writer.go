@@ -0,0 +1,169 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+// batchWriter holds the batch being built by the writer goroutine, it is never shared
+type batchWriter struct {
+	pipeline *Pipeline
+	batch    []repository.NewMeasurement
+}
+
+func newBatchWriter(pipeline *Pipeline) *batchWriter {
+	return &batchWriter{
+		pipeline: pipeline,
+		batch:    make([]repository.NewMeasurement, 0, pipeline.config.BatchSize),
+	}
+}
+
+func (writer *batchWriter) add(measurement repository.NewMeasurement) {
+	writer.batch = append(writer.batch, measurement)
+}
+
+func (writer *batchWriter) full() bool {
+	return uint(len(writer.batch)) >= writer.pipeline.config.BatchSize
+}
+
+func (writer *batchWriter) empty() bool {
+	return len(writer.batch) == 0
+}
+
+/*
+insertBatch commits the batch, if the batch breaks a constraint, its measurements are
+inserted one by one, returning the ones that break it on their own (e.g. their device is
+gone). Any other failure is the db's, its error is returned for the batch to be retried.
+*/
+func (pipeline *Pipeline) insertBatch(
+	ctx context.Context,
+	batch []repository.NewMeasurement,
+) (rejected []repository.NewMeasurement, err error) {
+	err = pipeline.repo.InsertBatch(ctx, batch)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, repository.ConstraintFailed) {
+		return nil, err
+	}
+
+	for _, measurement := range batch {
+		_, insertErr := pipeline.repo.Insert(ctx, measurement)
+		if errors.Is(insertErr, repository.ConstraintFailed) {
+			rejected = append(rejected, measurement)
+		} else if insertErr != nil {
+			return nil, insertErr
+		}
+	}
+	if len(rejected) > 0 {
+		slog.Error("ingest", "rejected-measurements", len(rejected), "cause", err.Error())
+	}
+	return rejected, nil
+}
+
+/*
+write commits the batch, moving the measurements rejected on their own into the quarantine
+file, when the db is the problem the batch is kept to be retried.
+*/
+func (writer *batchWriter) write(ctx context.Context) error {
+	if writer.empty() {
+		return nil
+	}
+
+	rejected, err := writer.pipeline.insertBatch(ctx, writer.batch)
+	if err != nil {
+		slog.Error("ingest", "batch-failure", err.Error(), "pending", len(writer.batch))
+		return err
+	}
+	writer.quarantine(rejected)
+	writer.batch = writer.batch[:0]
+	return nil
+}
+
+// quarantine moves the rejected measurements next to the spill file, or reports them lost without one
+func (writer *batchWriter) quarantine(rejected []repository.NewMeasurement) {
+	if len(rejected) == 0 {
+		return
+	}
+	spill := writer.pipeline.spill
+	if spill == nil {
+		slog.Error("ingest", "dropped-measurements", len(rejected), "cause", "no spill file configured")
+		return
+	}
+	if err := spill.appendTo(spill.rejectedPath(), rejected...); err != nil {
+		slog.Error("ingest", "dropped-measurements", len(rejected), "cause", err.Error())
+		return
+	}
+	slog.Warn("ingest", "quarantined-measurements", len(rejected), "location", spill.rejectedPath())
+}
+
+// drain writes the batch and every measurement queued so far
+func (writer *batchWriter) drain(ctx context.Context) error {
+	for {
+		select {
+		case measurement := <-writer.pipeline.queue:
+			writer.add(measurement)
+			if !writer.full() {
+				continue
+			}
+		default:
+			return writer.write(ctx)
+		}
+
+		if err := writer.write(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// spillPending moves the batch and the queue into the spill file, or reports them lost
+func (writer *batchWriter) spillPending() {
+	for len(writer.pipeline.queue) > 0 {
+		writer.add(<-writer.pipeline.queue)
+	}
+	if writer.empty() {
+		return
+	}
+
+	spill := writer.pipeline.spill
+	if spill == nil {
+		slog.Error("ingest", "lost-measurements", len(writer.batch), "cause", "no spill file configured")
+		return
+	}
+	for i, measurement := range writer.batch {
+		if err := spill.append(measurement); err != nil {
+			slog.Error("ingest", "lost-measurements", len(writer.batch)-i, "cause", err.Error())
+			return
+		}
+	}
+	slog.Warn("ingest", "spilled-measurements", len(writer.batch), "location", spill.path)
+	writer.batch = writer.batch[:0]
+}
+
+/*
+replaySpill writes the spilled measurements, in batches, leaving the ones that failed in the
+spill, and moving the ones rejected on their own into the quarantine file.
+*/
+func (writer *batchWriter) replaySpill(ctx context.Context) {
+	spill := writer.pipeline.spill
+	if spill == nil {
+		return
+	}
+
+	insert := func(batch []repository.NewMeasurement) ([]repository.NewMeasurement, error) {
+		return writer.pipeline.insertBatch(ctx, batch)
+	}
+	replayed, rejected, err := spill.replay(writer.pipeline.config.BatchSize, insert)
+	if err != nil {
+		slog.Error("ingest", "spill-replay-failure", err.Error())
+	}
+	if replayed > 0 {
+		slog.Info("ingest", "replayed-measurements", replayed, "location", spill.path)
+	}
+	if rejected > 0 {
+		slog.Warn("ingest", "quarantined-measurements", rejected, "location", spill.rejectedPath())
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/TomascpMarques/maestro/backup"
+	"github.com/TomascpMarques/maestro/health"
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+// Name of the health check that reports the last integrity check of the database
+const IntegrityHealthCheck = "database-integrity"
+
+// Most problems kept in a report, a corrupt file can report one per page
+const maxReportedProblems = 10
+
+// IntegrityReport is the result of one run of the integrity checks
+type IntegrityReport struct {
+	Check                string   `json:"check"`
+	Problems             []string `json:"problems,omitempty"`
+	ForeignKeyViolations int      `json:"foreign_key_violations"`
+	PageSize             int64    `json:"page_size"`
+	PageCount            int64    `json:"page_count"`
+	FreelistCount        int64    `json:"freelist_count"`
+	FileSize             int64    `json:"file_size"`
+	FileGrowth           int64    `json:"file_growth"`
+	VacuumedPages        int64    `json:"vacuumed_pages"`
+}
+
+// Failed is true when the file is corrupt, or holds rows breaking a foreign key
+func (report IntegrityReport) Failed() bool {
+	return len(report.Problems) > 0 || report.ForeignKeyViolations > 0
+}
+
+/*
+IntegrityJob checks the database periodically, instead of only finding out about
+corruption once a query fails. Most runs use quick_check, every FullCheckEvery runs
+use the slower integrity_check, and foreign_key_check runs every time.
+It also tracks the page, freelist and file sizes, reclaiming the free pages with an
+incremental vacuum once they pass the threshold. While the last run failed, the gate
+of the backup task is blocked, so a corrupt db never overwrites a good archive.
+*/
+type IntegrityJob struct {
+	db         *repository.SqliteDB
+	dbFilePath string
+	config     IntegrityChecks
+	health     *health.Registry
+	backups    *backup.Gate
+
+	runs         uint
+	lastFileSize int64
+}
+
+func NewIntegrityJob(
+	db *repository.SqliteDB,
+	dbConfig Database,
+	registry *health.Registry,
+	backups *backup.Gate,
+) *IntegrityJob {
+	return &IntegrityJob{
+		db:         db,
+		dbFilePath: dbConfig.Uri,
+		config:     dbConfig.Integrity.WithDefaults(),
+		health:     registry,
+		backups:    backups,
+	}
+}
+
+// Run checks the database every interval, until the context is done
+func (job *IntegrityJob) Run(ctx context.Context) {
+	ticker := time.NewTicker(job.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := job.RunOnce(ctx)
+		job.report(report, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce runs every check, and the incremental vacuum when it is due
+func (job *IntegrityJob) RunOnce(ctx context.Context) (report IntegrityReport, err error) {
+	report.Check = "quick_check"
+	if job.runs%job.config.FullCheckEvery == 0 {
+		report.Check = "integrity_check"
+	}
+	job.runs++
+
+	err = job.db.WithPools(func(pools repository.SqlitePools) error {
+		results := []string{}
+		if err := pools.Reader.SelectContext(ctx, &results, fmt.Sprintf(`PRAGMA %s`, report.Check)); err != nil {
+			return err
+		}
+		for _, result := range results {
+			if result != "ok" && len(report.Problems) < maxReportedProblems {
+				report.Problems = append(report.Problems, result)
+			}
+		}
+
+		violations, err := countForeignKeyViolations(ctx, pools.Reader)
+		if err != nil {
+			return err
+		}
+		report.ForeignKeyViolations = violations
+
+		err = errors.Join(
+			pools.Reader.GetContext(ctx, &report.PageSize, `PRAGMA page_size`),
+			pools.Reader.GetContext(ctx, &report.PageCount, `PRAGMA page_count`),
+			pools.Reader.GetContext(ctx, &report.FreelistCount, `PRAGMA freelist_count`),
+		)
+		if err != nil || report.Failed() {
+			return err
+		}
+
+		report.VacuumedPages, err = job.vacuum(ctx, pools.Writer, report)
+		return err
+	})
+
+	report.FileSize = databaseFileSize(job.dbFilePath)
+	if job.lastFileSize > 0 {
+		report.FileGrowth = report.FileSize - job.lastFileSize
+	}
+	job.lastFileSize = report.FileSize
+	return
+}
+
+/*
+vacuum reclaims the free pages once they pass the threshold, a db created before
+auto_vacuum was set to incremental is left alone, its conversion rebuilds the whole
+file, done once with `maestro migrate vacuum`.
+*/
+func (job *IntegrityJob) vacuum(ctx context.Context, writer *sqlx.DB, report IntegrityReport) (int64, error) {
+	if report.PageCount == 0 || float64(report.FreelistCount)/float64(report.PageCount) < job.config.FreelistThreshold {
+		return 0, nil
+	}
+
+	incremental, err := incrementalVacuum(ctx, writer)
+	if err != nil {
+		return 0, err
+	}
+	if !incremental {
+		slog.Warn(
+			"database-integrity",
+			"vacuum", "the db isn't in incremental auto vacuum, convert it with `maestro migrate vacuum`",
+			"freelist-count", report.FreelistCount,
+		)
+		return 0, nil
+	}
+
+	// A page is freed per row stepped through, executing it would only free the first one
+	rows, err := writer.QueryContext(ctx, fmt.Sprintf(`PRAGMA incremental_vacuum(%d)`, job.config.VacuumPages))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	return min(report.FreelistCount, int64(job.config.VacuumPages)), nil
+}
+
+// report logs the run, updates the health check, and blocks or unblocks the backups
+func (job *IntegrityJob) report(report IntegrityReport, err error) {
+	check := health.Check{
+		Name:    IntegrityHealthCheck,
+		Status:  health.Ok,
+		Details: map[string]any{"report": report},
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return
+	case err != nil:
+		check.Status = health.Failing
+		check.Message = "the integrity checks could not run: " + err.Error()
+		slog.Error("database-integrity", "check-failure", err.Error())
+	case len(report.Problems) > 0:
+		check.Status = health.Failing
+		check.Message = fmt.Sprintf("%s found the db file corrupt", report.Check)
+		slog.Error("database-integrity", "check", report.Check, "problems", report.Problems)
+	case report.ForeignKeyViolations > 0:
+		check.Status = health.Degraded
+		check.Message = fmt.Sprintf("%d rows break a foreign key", report.ForeignKeyViolations)
+		slog.Error("database-integrity", "check", "foreign_key_check", "violations", report.ForeignKeyViolations)
+	default:
+		slog.Info(
+			"database-integrity",
+			"check", report.Check,
+			"result", "ok",
+			"page-count", report.PageCount,
+			"freelist-count", report.FreelistCount,
+			"file-size", report.FileSize,
+			"file-growth", report.FileGrowth,
+			"vacuumed-pages", report.VacuumedPages,
+		)
+	}
+	job.health.Set(check)
+
+	failed := check.Status != health.Ok
+	if job.backups.Block(failed) {
+		slog.Warn("database-integrity", "backups-blocked", failed)
+	}
+}
+
+// incrementalVacuum is true when the auto_vacuum mode of the db is INCREMENTAL (2)
+func incrementalVacuum(ctx context.Context, db *sqlx.DB) (bool, error) {
+	var autoVacuum int
+	if err := db.GetContext(ctx, &autoVacuum, `PRAGMA auto_vacuum`); err != nil {
+		return false, err
+	}
+	return autoVacuum == 2, nil
+}
+
+func countForeignKeyViolations(ctx context.Context, db *sqlx.DB) (violations int, err error) {
+	rows, err := db.QueryContext(ctx, `PRAGMA foreign_key_check`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		violations++
+	}
+	return violations, rows.Err()
+}
+
+// databaseFileSize is the size of the db file and its write ahead log, 0 when in memory
+func databaseFileSize(dbFilePath string) (size int64) {
+	for _, path := range []string{dbFilePath, dbFilePath + "-wal"} {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+	return
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/TomascpMarques/maestro/backup"
+	"github.com/TomascpMarques/maestro/health"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+// openTestDatabaseFile opens the db file, as the app does, closing it with the test
+func openTestDatabaseFile(t *testing.T, dbFilePath string) repository.SqlitePools {
+	pools, err := openDatabaseFile(dbFilePath, DefaultSqliteTuning())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pools.Writer.Close()
+		pools.Reader.Close()
+	})
+	return pools
+}
+
+// freePages fills a table and empties it, leaving most pages of the db on the freelist
+func freePages(t *testing.T, writer *sqlx.DB) {
+	_, err := writer.Exec(`CREATE TABLE IF NOT EXISTS filler (value BLOB)`)
+	assert.NoError(t, err)
+	_, err = writer.Exec(`
+		WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 200)
+		INSERT INTO filler SELECT randomblob(4096) FROM n`)
+	assert.NoError(t, err)
+	_, err = writer.Exec(`DELETE FROM filler`)
+	assert.NoError(t, err)
+}
+
+func TestIntegrityJob(t *testing.T) {
+	dbConfig := Database{Uri: filepath.Join(t.TempDir(), "db.sqlite")}
+	pools := openTestDatabaseFile(t, dbConfig.Uri)
+	if err := RunMigrations(pools.Writer); err != nil {
+		t.Fatal(err)
+	}
+	registry := health.NewRegistry()
+	gate := &backup.Gate{}
+	job := NewIntegrityJob(repository.NewSqliteDB(pools), dbConfig, registry, gate)
+	ctx := context.Background()
+
+	report, err := job.RunOnce(ctx)
+	job.report(report, err)
+	assert.NoError(t, err)
+	assert.Equal(t, "integrity_check", report.Check)
+	assert.False(t, report.Failed())
+	assert.NotZero(t, report.PageCount)
+	assert.NotZero(t, report.FileSize)
+	check, _ := registry.Get(IntegrityHealthCheck)
+	assert.Equal(t, health.Ok, check.Status)
+	assert.False(t, gate.Blocked())
+
+	// A measurement of a device that doesn't exist, only possible with the foreign keys off
+	_, err = pools.Writer.Exec(`PRAGMA foreign_keys = OFF`)
+	assert.NoError(t, err)
+	_, err = pools.Writer.Exec(`
+		INSERT INTO device_measurement (publishing_device_fk, m_value, m_value_type, received_at)
+		VALUES (99, '10', 1, 1)`)
+	assert.NoError(t, err)
+	_, err = pools.Writer.Exec(`PRAGMA foreign_keys = ON`)
+	assert.NoError(t, err)
+
+	report, err = job.RunOnce(ctx)
+	job.report(report, err)
+	assert.NoError(t, err)
+	assert.Equal(t, "quick_check", report.Check)
+	assert.Equal(t, 1, report.ForeignKeyViolations)
+	check, _ = registry.Get(IntegrityHealthCheck)
+	assert.Equal(t, health.Degraded, check.Status)
+	assert.True(t, gate.Blocked())
+
+	// Only passing again unblocks the backups
+	_, err = pools.Writer.Exec(`DELETE FROM device_measurement WHERE publishing_device_fk = 99`)
+	assert.NoError(t, err)
+	report, err = job.RunOnce(ctx)
+	job.report(report, err)
+	assert.NoError(t, err)
+	assert.False(t, gate.Blocked())
+
+	job.report(IntegrityReport{}, errors.New("disk failure"))
+	check, _ = registry.Get(IntegrityHealthCheck)
+	assert.Equal(t, health.Failing, check.Status)
+	assert.True(t, gate.Blocked())
+	job.report(IntegrityReport{}, context.Canceled)
+	assert.True(t, gate.Blocked(), "a cancelled run reports nothing")
+}
+
+func TestIntegrityJobVacuum(t *testing.T) {
+	dbConfig := Database{
+		Uri:       filepath.Join(t.TempDir(), "db.sqlite"),
+		Integrity: IntegrityChecks{FreelistThreshold: 0.1, VacuumPages: 50},
+	}
+	// Created before auto_vacuum was set to incremental, which only applies to new files
+	legacy, err := sqlx.Open("sqlite3", dbConfig.Uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Exec(`CREATE TABLE reading (value INTEGER)`)
+	assert.NoError(t, err)
+	legacy.Close()
+
+	pools := openTestDatabaseFile(t, dbConfig.Uri)
+	job := NewIntegrityJob(repository.NewSqliteDB(pools), dbConfig, health.NewRegistry(), &backup.Gate{})
+	ctx := context.Background()
+	freePages(t, pools.Writer)
+
+	// The periodic job never rebuilds the db to convert it
+	report, err := job.RunOnce(ctx)
+	assert.NoError(t, err)
+	assert.Greater(t, report.FreelistCount, int64(50))
+	assert.Zero(t, report.VacuumedPages)
+	incremental, err := incrementalVacuum(ctx, pools.Writer)
+	assert.NoError(t, err)
+	assert.False(t, incremental)
+
+	assert.NoError(t, convertToIncrementalVacuum(pools.Writer))
+	incremental, err = incrementalVacuum(ctx, pools.Writer)
+	assert.NoError(t, err)
+	assert.True(t, incremental)
+	// Converting again changes nothing
+	assert.NoError(t, convertToIncrementalVacuum(pools.Writer))
+
+	freePages(t, pools.Writer)
+	report, err = job.RunOnce(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(50), report.VacuumedPages)
+	var freelist int64
+	assert.NoError(t, pools.Reader.Get(&freelist, `PRAGMA freelist_count`))
+	assert.Equal(t, report.FreelistCount-50, freelist)
+}
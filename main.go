@@ -1,24 +1,46 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	adminauth "github.com/TomascpMarques/maestro/adminauth"
+	alerts "github.com/TomascpMarques/maestro/alerts"
 	backup "github.com/TomascpMarques/maestro/backup"
+	certs "github.com/TomascpMarques/maestro/certs"
+	clocksync "github.com/TomascpMarques/maestro/clocksync"
+	commands "github.com/TomascpMarques/maestro/commands"
+	deviceauth "github.com/TomascpMarques/maestro/deviceauth"
+	devicetypes "github.com/TomascpMarques/maestro/devicetypes"
+	events "github.com/TomascpMarques/maestro/events"
+	firmware "github.com/TomascpMarques/maestro/firmware"
+	health "github.com/TomascpMarques/maestro/health"
+	ingest "github.com/TomascpMarques/maestro/ingest"
+	measurementtypes "github.com/TomascpMarques/maestro/measurementtypes"
+	presence "github.com/TomascpMarques/maestro/presence"
+	provisioning "github.com/TomascpMarques/maestro/provisioning"
+	repository "github.com/TomascpMarques/maestro/repository"
+	retention "github.com/TomascpMarques/maestro/retention"
+	shadow "github.com/TomascpMarques/maestro/shadow"
 	web_service "github.com/TomascpMarques/maestro/web_api"
 	gin "github.com/gin-gonic/gin"
 	validator "github.com/go-playground/validator/v10"
 	_ "github.com/mattn/go-sqlite3" // sqlite3 driver
 )
 
-/*
-	TODO Add a way to publish the current date-and-time to the raspberry pi, so we can keep track of it with some certainty
-*/
+// How long the in-flight requests have to finish, once a shutdown starts
+const shutdownTimeout = 10 * time.Second
 
 // Struct validation across the entire app
 var VALIDATE *validator.Validate = validator.New(
@@ -27,17 +49,49 @@ var VALIDATE *validator.Validate = validator.New(
 )
 
 func main() {
+	// The config profile can be chosen by flag, or by env var
+	profile := flag.String("profile", defaultConfigProfile(), "config profile to apply over the base config")
+	flag.Parse()
+
+	// Generates local certificates, without any config
+	if flag.Arg(0) == "certs" {
+		if err := RunCertsCommand(flag.Args()[1:]); err != nil {
+			log.Fatalf("Certs Error:\n%s\n", err.Error())
+		}
+		return
+	}
+
 	// Env file config loading
 	configPath, defined := os.LookupEnv("ENV_PATH")
 	if !defined {
 		log.Fatalf("No Environment file specified")
 	}
-	config, err := LoadConfig(configPath)
+	config, err := LoadConfig(configPath, *profile)
 	if err != nil {
 		log.Fatalf("Config Error:\n%s\n", err.Error())
 	}
+
+	// Sub commands run against the configured db and exit, without starting the app
+	if args := flag.Args(); len(args) > 0 {
+		if args[0] != "migrate" {
+			log.Fatalf("Unknown command: %s\n%s\n%s\n", args[0], migrateUsage, certsUsage)
+		}
+		pools, err, usable := ConnectToDatabase(config.DatabaseConfig.Uri, config.DatabaseConfig.Sqlite)
+		if err != nil || !usable {
+			log.Fatalf("Database Error:\ncould not open the db file at %s\n", config.DatabaseConfig.Uri)
+		}
+		if err = RunMigrateCommand(pools.Writer, args[1:]); err != nil {
+			log.Fatalf("Migrate Error:\n%s\n", err.Error())
+		}
+		return
+	}
+	// Checks the config again (and its secrets) on SIGHUP, the values reloaded apply on the next restart
+	configHolder := NewConfigHolder(config)
+	stopConfigReload := configHolder.WatchReload(configPath, *profile)
+	defer stopConfigReload()
+
 	// Will be used to later store the config values used to start this app instance
-	configJson, err := json.Marshal(config)
+	configJson, err := json.Marshal(config.Redacted())
 	if err != nil {
 		panic("Should not fail to parse config to json!")
 	}
@@ -54,10 +108,17 @@ func main() {
 	slog.Info("setup", "status", "initialized telemetry successful")
 
 	slog.Info("setup-telemetry", "location", telemetryFilePath)
-	slog.Info("setup-environment", "config", configJson)
+	slog.Info("setup-environment", "config", configJson, "profile", *profile)
+
+	// Stopped on SIGINT/SIGTERM, every worker and the server shut down gracefully
+	appCtx, stopApp := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopApp()
+	var workers sync.WaitGroup
+
+	healthRegistry := health.NewRegistry()
 
 	// Database usage and connection
-	db, err, usable := ConnectToDatabase(config.DatabaseConfig.Uri)
+	pools, err, usable := ConnectToDatabase(config.DatabaseConfig.Uri, config.DatabaseConfig.Sqlite)
 	if err != nil {
 		slog.Warn("database-creation", "cause", "db file error", "reason", err)
 	}
@@ -66,33 +127,268 @@ func main() {
 		slog.Info("setup", "operation", "terminating")
 		os.Exit(1)
 	}
+	connectErr := err
+	sqliteDB := repository.NewSqliteDB(pools)
 
 	// Database file backup worker handeling
-	taskHandle := make(<-chan backup.TaskHandleSignal, 20)
+	taskHandle := make(chan backup.TaskHandleSignal, 20)
+	// Blocked by the integrity job while the db fails its checks, apart from the pause of an operator
+	backupGate := &backup.Gate{}
 	signalHandler, ticker := backup.CreateFileBackupTask(
 		backup.BackupLocations{
 			SourceLocation: config.DatabaseConfig.Uri,
 			BackupLocation: config.DatabaseConfig.BackUpLocation,
+			Snapshot:       snapshotDatabase(sqliteDB, healthRegistry),
 		},
 		taskHandle,
+		backupGate,
 		config.DatabaseConfig.BackupInterval,
 	)
-	// TODO Handle task signaler
-	_ = signalHandler
 	defer ticker.Stop()
+	// Follows the state of the backup task, and lets the api pause and resume it
+	backupController := backup.NewController(taskHandle, signalHandler, backupGate)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		backupController.Run(appCtx)
+	}()
 
-	// execute a query on the server
-	err = RunMigrations(db, "./migrations/")
+	// Migrations are embedded in the binary, refusing to start on a newer schema
+	err = RunMigrations(pools.Writer)
 	if err != nil {
 		slog.Error("setup-db-migrations", "cause", err.Error())
 		slog.Error("setup-db-migrations", "cause", "Could not migrate db changes")
 		os.Exit(1)
 	}
 
+	if errors.Is(connectErr, ErrDegradedDatabase) {
+		// Keeps the in-memory data spilled to disk, until the db file can be used again
+		degraded := NewDegradedDatabase(sqliteDB, config.DatabaseConfig, healthRegistry, connectErr)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			degraded.Run(appCtx)
+		}()
+	} else {
+		if err = MergeLeftoverSpill(appCtx, sqliteDB, config.DatabaseConfig); err != nil {
+			slog.Error("setup-db-spill", "cause", err.Error())
+			slog.Warn("setup-db-spill", "action", "spill file kept in place, it will be retried on the next start")
+		}
+		healthRegistry.Set(health.Check{Name: DatabaseHealthCheck, Status: health.Ok})
+	}
+
+	// Checks the db periodically, blocking the backups while it fails
+	integrityJob := NewIntegrityJob(sqliteDB, config.DatabaseConfig, healthRegistry, backupGate)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		integrityJob.Run(appCtx)
+	}()
+
 	// Web App config and launch
+	repos, err := repository.NewSqliteRepositories(sqliteDB, config.DatabaseConfig.ArchivePath())
+	if err != nil {
+		slog.Error("setup-repositories", "cause", err.Error())
+		os.Exit(1)
+	}
+
+	// Every device and measurement is validated against the type of its device
+	deviceTypes, err := devicetypes.Load(appCtx, repos.DeviceTypes)
+	if err != nil {
+		slog.Error("setup-device-types", "cause", err.Error())
+		os.Exit(1)
+	}
+	// Every published value is parsed, and every stored one decoded, by its measurement type
+	measurementTypes, err := measurementtypes.Load(appCtx, repos.MeasurementTypes)
+	if err != nil {
+		slog.Error("setup-measurement-types", "cause", err.Error())
+		os.Exit(1)
+	}
+
+	// Rolls up the measurements and deletes the expired ones in the background
+	retentionConfig, err := config.RetentionConfig.Policies()
+	if err != nil {
+		slog.Error("setup-retention", "cause", err.Error())
+		os.Exit(1)
+	}
+	retentionJob := retention.NewJob(repos.Retention, retentionConfig)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		retentionJob.Run(appCtx)
+	}()
+
+	// Stopped only after the server, so the in-flight publishes are still queued and flushed
+	ingestCtx, stopIngest := context.WithCancel(context.Background())
+	defer stopIngest()
+	pipeline := ingest.NewPipeline(repos.Measurements, config.IngestConfig.Pipeline())
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		pipeline.Run(ingestCtx, shutdownTimeout)
+	}()
+
+	// Everything that happens to the devices, logged as it happens
+	eventBus := events.NewBus()
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		eventBus.Log(appCtx)
+	}()
+
+	// Flags the quiet devices as offline, stopped with the ingest so the last heartbeats are stored
+	presenceConfig, err := config.PresenceConfig.Monitor()
+	if err != nil {
+		slog.Error("setup-presence", "cause", err.Error())
+		os.Exit(1)
+	}
+	presenceMonitor := presence.NewMonitor(repos.Devices, deviceTypes, presenceConfig, eventBus)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		presenceMonitor.Run(ingestCtx)
+	}()
+
+	// Checks the signatures of the requests sent by the devices
+	deviceAuthConfig, err := config.DeviceAuth.Authenticator()
+	if err != nil {
+		slog.Error("setup-device-auth", "cause", err.Error())
+		os.Exit(1)
+	}
+	deviceAuth, err := deviceauth.NewAuthenticator(repos.Credentials, deviceAuthConfig)
+	if err != nil {
+		slog.Error("setup-device-auth", "cause", err.Error())
+		os.Exit(1)
+	}
+	// The keys stored before the key secret was set are sealed with it
+	sealedKeys, err := deviceAuth.SealStored(appCtx)
+	if err != nil {
+		slog.Error("setup-device-auth", "cause", err.Error())
+		os.Exit(1)
+	}
+	if sealedKeys > 0 {
+		slog.Info("setup-device-auth", "sealed-keys", sealedKeys)
+	}
+	if config.DeviceAuth.AllowUnsigned {
+		slog.Warn("setup-device-auth", "unsigned-requests", "allowed, any client can publish as any device")
+	}
+
+	// Logs the users in, the first start creates the bootstrap admin
+	adminAuth := adminauth.NewAuthenticator(repos.Users, repos.Sessions, config.AdminAuth.Authenticator())
+	bootstrapped, err := adminAuth.Bootstrap(appCtx, time.Now())
+	if err != nil {
+		slog.Error("setup-admin-auth", "cause", err.Error())
+		os.Exit(1)
+	}
+	if bootstrapped {
+		slog.Info("setup-admin-auth", "bootstrap-user", config.AdminAuth.BootstrapUser)
+	} else if count, _ := repos.Users.Count(appCtx); count == 0 {
+		slog.Warn("setup-admin-auth", "users", "none, set a bootstrap user so the api can be used")
+	}
+
+	// Registers the devices presenting a claim code
+	provisioner := provisioning.NewProvisioner(
+		repos.ClaimCodes, repos.Devices, deviceTypes, deviceAuth, config.Provisioning.Provisioner(),
+	)
+
+	// Queues the commands of the devices, expiring the ones not done with in time
+	commandsConfig, err := config.Commands.Queue()
+	if err != nil {
+		slog.Error("setup-commands", "cause", err.Error())
+		os.Exit(1)
+	}
+	commandQueue := commands.NewQueue(repos.Commands, commandsConfig)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		commandQueue.Run(appCtx)
+	}()
+
+	// Keeps the desired and reported config of the devices
+	shadows := shadow.NewService(repos.Shadows, repos.Devices, deviceTypes)
+
+	// Stores the firmware images, and rolls them out to the devices
+	firmwareConfig, err := config.Firmware.Service()
+	if err != nil {
+		slog.Error("setup-firmware", "cause", err.Error())
+		os.Exit(1)
+	}
+	firmwareService, err := firmware.NewService(repos.Firmware, repos.Devices, deviceTypes, firmwareConfig)
+	if err != nil {
+		slog.Error("setup-firmware", "cause", err.Error())
+		os.Exit(1)
+	}
+	if firmwareConfig.PublicKey == nil {
+		slog.Warn("setup-firmware", "signatures", "not required, set a public key so every image is signed")
+	}
+
+	// Records the clock offsets of the devices, answering their SNTP requests when configured
+	clockConfig, err := config.Clock.Sync()
+	if err != nil {
+		slog.Error("setup-clock-sync", "cause", err.Error())
+		os.Exit(1)
+	}
+	clocks := clocksync.NewService(repos.Clocks, clockConfig)
+	// Leaving the in-memory fallback re-points the clocks to the devices of the db file
+	sqliteDB.OnSwap(clocks.Forget)
+	if clockConfig.SNTPAddress != "" {
+		responder, err := clocksync.ListenSNTP(clockConfig.SNTPAddress)
+		if err != nil {
+			slog.Error("setup-clock-sync", "cause", err.Error())
+			os.Exit(1)
+		}
+		slog.Info("setup-clock-sync", "sntp", responder.Addr().String())
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			responder.Serve(appCtx)
+		}()
+	}
+
+	// Evaluates the alert rules on the measurements, and on the connectivity of the devices
+	alertsConfig, err := config.Alerts.Engine()
+	if err != nil {
+		slog.Error("setup-alerts", "cause", err.Error())
+		os.Exit(1)
+	}
+	alertEngine, err := alerts.Load(
+		appCtx, repos.Alerts, repos.Devices, repos.Measurements, deviceTypes, measurementTypes, eventBus, alertsConfig,
+	)
+	if err != nil {
+		slog.Error("setup-alerts", "cause", err.Error())
+		os.Exit(1)
+	}
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		alertEngine.Run(appCtx)
+	}()
+
 	app := gin.Default()
 	api := app.Group("/api")
-	web_service.Api(api, db)
+	err = web_service.Api(api, web_service.Dependencies{
+		Repositories:     repos,
+		Health:           healthRegistry,
+		Ingest:           pipeline,
+		Retention:        retentionConfig,
+		Presence:         presenceMonitor,
+		DeviceTypes:      deviceTypes,
+		MeasurementTypes: measurementTypes,
+		DeviceAuth:       deviceAuth,
+		AdminAuth:        adminAuth,
+		Backups:          backupController,
+		Config:           configHolder.Control(configPath, *profile),
+		Provisioner:      provisioner,
+		Commands:         commandQueue,
+		Shadows:          shadows,
+		Firmware:         firmwareService,
+		Clocks:           clocks,
+		Alerts:           alertEngine,
+	})
+	if err != nil {
+		slog.Error("setup-web-api", "cause", err.Error())
+		os.Exit(1)
+	}
 
 	server := &http.Server{
 		Handler:      app,
@@ -102,5 +398,41 @@ func main() {
 		WriteTimeout: time.Duration(config.WebApiConfig.WriteTimeout) * time.Second,
 	}
 
-	server.ListenAndServe()
+	// Served over TLS when configured, the certificate is reloaded once renewed
+	serve := server.ListenAndServe
+	if config.WebApiConfig.TLS.Enabled {
+		certStore, err := certs.NewStore(config.WebApiConfig.TLS.Certs())
+		if err != nil {
+			slog.Error("setup-tls", "cause", err.Error())
+			os.Exit(1)
+		}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			certStore.Run(appCtx)
+		}()
+		server.TLSConfig = certStore.TLSConfig()
+		serve = func() error { return server.ListenAndServeTLS("", "") }
+		slog.Info("setup-tls", "certificate", config.WebApiConfig.TLS.CertFile,
+			"client-ca", config.WebApiConfig.TLS.ClientCAFile)
+	}
+
+	go func() {
+		if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("web-server", "cause", err.Error())
+			stopApp()
+		}
+	}()
+
+	<-appCtx.Done()
+	slog.Info("shutdown", "status", "shutting down gracefully")
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("shutdown", "web-server", err.Error())
+	}
+	stopIngest()
+	workers.Wait()
+	slog.Info("shutdown", "status", "done")
 }
@@ -0,0 +1,161 @@
+/*
+Package measurementtypes holds the measurement type registry, how the values of each
+type are written, their unit and valid range, read from the db once and kept in memory,
+so every published value is parsed without going through the db.
+*/
+package measurementtypes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+var (
+	ErrUnknownType = errors.New("unknown measurement type")
+	// The type definition itself is invalid
+	ErrInvalidType = errors.New("invalid measurement type")
+	// The built-in type can be updated, but never deleted
+	ErrBuiltinType = errors.New("built-in measurement type")
+	// The value isn't written with the encoding of its type, or is outside its range
+	ErrInvalidValue = errors.New("invalid measurement value")
+)
+
+/*
+Registry keeps the measurement types in memory, every change goes through it, so it
+is stored and then reloaded. Only one registry should be used per db.
+*/
+type Registry struct {
+	repo repository.MeasurementTypeRepository
+
+	mutex sync.RWMutex
+	types map[uint]repository.MeasurementTypeDefinition
+}
+
+// Load reads every measurement type from the repository into a new registry
+func Load(ctx context.Context, repo repository.MeasurementTypeRepository) (*Registry, error) {
+	registry := &Registry{repo: repo}
+	if err := registry.reload(ctx); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+func (registry *Registry) reload(ctx context.Context) error {
+	definitions, err := registry.repo.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	types := make(map[uint]repository.MeasurementTypeDefinition, len(definitions))
+	for _, definition := range definitions {
+		types[definition.ID] = definition
+	}
+
+	registry.mutex.Lock()
+	registry.types = types
+	registry.mutex.Unlock()
+	return nil
+}
+
+// validate checks the parts of a definition the db can't
+func validate(measurementType repository.NewMeasurementType) error {
+	if measurementType.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidType)
+	}
+	if measurementType.Encoding > repository.VectorEncoding {
+		return fmt.Errorf("%w: encoding outside valid values", ErrInvalidType)
+	}
+	bounded := measurementType.Min.Valid || measurementType.Max.Valid
+	if measurementType.Encoding == repository.BoolEncoding && bounded {
+		return fmt.Errorf("%w: a bool type has no range", ErrInvalidType)
+	}
+	for _, bound := range []float64{measurementType.Min.Float64, measurementType.Max.Float64} {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return fmt.Errorf("%w: min and max should be finite", ErrInvalidType)
+		}
+	}
+	if measurementType.Min.Valid && measurementType.Max.Valid && measurementType.Min.Float64 > measurementType.Max.Float64 {
+		return fmt.Errorf("%w: min should not be greater than max", ErrInvalidType)
+	}
+	return nil
+}
+
+func (registry *Registry) Get(id uint) (repository.MeasurementTypeDefinition, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	found, exists := registry.types[id]
+	return found, exists
+}
+
+func (registry *Registry) List() []repository.MeasurementTypeDefinition {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	definitions := make([]repository.MeasurementTypeDefinition, 0, len(registry.types))
+	for _, definition := range registry.types {
+		definitions = append(definitions, definition)
+	}
+	slices.SortFunc(definitions, func(a, b repository.MeasurementTypeDefinition) int { return int(a.ID) - int(b.ID) })
+	return definitions
+}
+
+func (registry *Registry) Create(ctx context.Context, measurementType repository.NewMeasurementType) (repository.MeasurementTypeDefinition, error) {
+	if err := validate(measurementType); err != nil {
+		return repository.MeasurementTypeDefinition{}, err
+	}
+	created, err := registry.repo.Create(ctx, measurementType)
+	if err != nil {
+		return repository.MeasurementTypeDefinition{}, err
+	}
+	return created, registry.reload(ctx)
+}
+
+/*
+Update replaces the definition of the type with the same id, keeping its name and encoding,
+the values already stored are never checked against the new range.
+*/
+func (registry *Registry) Update(ctx context.Context, measurementType repository.MeasurementTypeDefinition) (repository.MeasurementTypeDefinition, error) {
+	existing, found := registry.Get(measurementType.ID)
+	if !found {
+		return repository.MeasurementTypeDefinition{}, ErrUnknownType
+	}
+	measurementType.Name, measurementType.Encoding = existing.Name, existing.Encoding
+	if err := validate(measurementType.NewMeasurementType); err != nil {
+		return repository.MeasurementTypeDefinition{}, err
+	}
+
+	updated, err := registry.repo.Update(ctx, measurementType)
+	if err != nil {
+		return repository.MeasurementTypeDefinition{}, err
+	}
+	return updated, registry.reload(ctx)
+}
+
+func (registry *Registry) Delete(ctx context.Context, id uint) error {
+	if id == repository.GenericValueType {
+		return ErrBuiltinType
+	}
+	if err := registry.repo.Delete(ctx, id); err != nil {
+		return err
+	}
+	return registry.reload(ctx)
+}
+
+// Unit returns the unit of the type, empty for a type without one or an unknown type
+func (registry *Registry) Unit(id uint) string {
+	definition, _ := registry.Get(id)
+	return definition.Unit
+}
+
+// Aggregated reports if the values of the type are rolled up, every type but the vectors is
+func (registry *Registry) Aggregated(id uint) bool {
+	definition, found := registry.Get(id)
+	return !found || definition.Encoding != repository.VectorEncoding
+}
@@ -0,0 +1,106 @@
+package measurementtypes
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	registry, err := Load(ctx, repos.MeasurementTypes)
+	assert.NoError(t, err)
+	assert.Len(t, registry.List(), 1)
+
+	_, err = registry.Create(ctx, repository.NewMeasurementType{Name: "broken", Encoding: repository.BoolEncoding,
+		Max: sql.NullFloat64{Float64: 1, Valid: true}})
+	assert.True(t, errors.Is(err, ErrInvalidType))
+	_, err = registry.Create(ctx, repository.NewMeasurementType{Name: "broken",
+		Min: sql.NullFloat64{Float64: 2, Valid: true}, Max: sql.NullFloat64{Float64: 1, Valid: true}})
+	assert.True(t, errors.Is(err, ErrInvalidType))
+
+	temperature, err := registry.Create(ctx, repository.NewMeasurementType{
+		Name: "temperature", Unit: "°C", Min: sql.NullFloat64{Float64: -273.15, Valid: true},
+	})
+	assert.NoError(t, err)
+	_, err = registry.Create(ctx, repository.NewMeasurementType{Name: "temperature"})
+	assert.True(t, errors.Is(err, repository.AlreadyExists))
+	assert.Equal(t, "°C", registry.Unit(temperature.ID))
+
+	// The name and encoding are kept on updates
+	temperature.Name, temperature.Encoding = "renamed", repository.VectorEncoding
+	temperature.Max = sql.NullFloat64{Float64: 100, Valid: true}
+	updated, err := registry.Update(ctx, temperature)
+	assert.NoError(t, err)
+	assert.Equal(t, "temperature", updated.Name)
+	assert.Equal(t, repository.FloatEncoding, updated.Encoding)
+	assert.True(t, registry.Aggregated(temperature.ID))
+
+	_, err = repos.Measurements.Insert(ctx, repository.NewMeasurement{Value: "21.5", ValueType: temperature.ID})
+	assert.NoError(t, err)
+	assert.True(t, errors.Is(registry.Delete(ctx, temperature.ID), repository.InUse))
+	assert.True(t, errors.Is(registry.Delete(ctx, repository.GenericValueType), ErrBuiltinType))
+	assert.True(t, errors.Is(registry.Delete(ctx, 99), repository.NotFound))
+}
+
+func TestParseAndDecode(t *testing.T) {
+	ctx := context.Background()
+	registry, err := Load(ctx, repository.NewMemoryRepositories().MeasurementTypes)
+	assert.NoError(t, err)
+
+	types := map[repository.ValueEncoding]uint{}
+	for _, encoding := range []repository.ValueEncoding{
+		repository.FloatEncoding, repository.IntEncoding, repository.BoolEncoding, repository.VectorEncoding,
+	} {
+		definition := repository.NewMeasurementType{Name: encoding.String(), Encoding: encoding}
+		if encoding != repository.BoolEncoding {
+			definition.Min = sql.NullFloat64{Float64: -10, Valid: true}
+			definition.Max = sql.NullFloat64{Float64: 10, Valid: true}
+		}
+		created, err := registry.Create(ctx, definition)
+		assert.NoError(t, err)
+		types[encoding] = created.ID
+	}
+
+	tests := []struct {
+		encoding repository.ValueEncoding
+		raw      string
+		stored   string
+		decoded  any
+	}{
+		{repository.FloatEncoding, `2.50`, "2.5", 2.5},
+		{repository.FloatEncoding, `"2.5"`, "2.5", 2.5},
+		{repository.IntEncoding, `-3`, "-3", int64(-3)},
+		{repository.BoolEncoding, `true`, "1", true},
+		{repository.BoolEncoding, `"false"`, "0", false},
+		{repository.VectorEncoding, `[1, 2.5, -3]`, "[1,2.5,-3]", []float64{1, 2.5, -3}},
+	}
+	for _, test := range tests {
+		stored, err := registry.Parse(types[test.encoding], json.RawMessage(test.raw))
+		assert.NoError(t, err, test.raw)
+		assert.Equal(t, test.stored, stored)
+		assert.Equal(t, test.decoded, registry.Decode(types[test.encoding], stored))
+	}
+
+	for encoding, raw := range map[repository.ValueEncoding]string{
+		repository.FloatEncoding:  `11`,
+		repository.IntEncoding:    `1.5`,
+		repository.BoolEncoding:   `1`,
+		repository.VectorEncoding: `[1, 20]`,
+	} {
+		_, err := registry.Parse(types[encoding], json.RawMessage(raw))
+		assert.True(t, errors.Is(err, ErrInvalidValue), raw)
+	}
+	_, err = registry.Parse(99, json.RawMessage(`1`))
+	assert.True(t, errors.Is(err, ErrUnknownType))
+
+	// Values stored before the registry are returned as they are
+	assert.Equal(t, "warm", registry.Decode(types[repository.FloatEncoding], "warm"))
+	assert.Equal(t, "21.5", registry.Decode(99, "21.5"))
+}
@@ -0,0 +1,118 @@
+package measurementtypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+/*
+Parse reads a published value of the type, returning it as it is stored in m_value.
+The value is either the JSON value itself, or a string holding it, as published
+before the registry, so 21.5 and "21.5" are the same float.
+*/
+func (registry *Registry) Parse(id uint, raw json.RawMessage) (string, error) {
+	definition, found := registry.Get(id)
+	if !found {
+		return "", ErrUnknownType
+	}
+
+	if string(bytes.TrimSpace(raw)) == "null" {
+		return "", fmt.Errorf("%w: value is required", ErrInvalidValue)
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		raw = json.RawMessage(text)
+	}
+
+	switch definition.Encoding {
+	case repository.FloatEncoding:
+		var value float64
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return "", fmt.Errorf("%w: expected a number", ErrInvalidValue)
+		}
+		if err := inRange(definition, value); err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case repository.IntEncoding:
+		var value int64
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return "", fmt.Errorf("%w: expected an integer", ErrInvalidValue)
+		}
+		if err := inRange(definition, float64(value)); err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(value, 10), nil
+	case repository.BoolEncoding:
+		var value bool
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return "", fmt.Errorf("%w: expected true or false", ErrInvalidValue)
+		}
+		if value {
+			return "1", nil
+		}
+		return "0", nil
+	case repository.VectorEncoding:
+		var value []float64
+		if err := json.Unmarshal(raw, &value); err != nil || len(value) == 0 {
+			return "", fmt.Errorf("%w: expected a non empty array of numbers", ErrInvalidValue)
+		}
+		for _, element := range value {
+			if err := inRange(definition, element); err != nil {
+				return "", err
+			}
+		}
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	}
+	return "", fmt.Errorf("%w: %s has an unknown encoding", ErrInvalidType, definition.Name)
+}
+
+func inRange(definition repository.MeasurementTypeDefinition, value float64) error {
+	if definition.Min.Valid && value < definition.Min.Float64 {
+		return fmt.Errorf("%w: %v is below the minimum of %s, %v", ErrInvalidValue, value, definition.Name, definition.Min.Float64)
+	}
+	if definition.Max.Valid && value > definition.Max.Float64 {
+		return fmt.Errorf("%w: %v is above the maximum of %s, %v", ErrInvalidValue, value, definition.Name, definition.Max.Float64)
+	}
+	return nil
+}
+
+/*
+Decode returns a stored value as the JSON value of its type, a value that can't be
+read with the encoding of its type, like those stored before the registry, is
+returned as the stored string.
+*/
+func (registry *Registry) Decode(id uint, stored string) any {
+	definition, found := registry.Get(id)
+	if !found {
+		return stored
+	}
+
+	switch definition.Encoding {
+	case repository.FloatEncoding:
+		// JSON has no NaN or infinities, sqlite may hold them from before the registry
+		if value, err := strconv.ParseFloat(stored, 64); err == nil && !math.IsNaN(value) && !math.IsInf(value, 0) {
+			return value
+		}
+	case repository.IntEncoding:
+		if value, err := strconv.ParseInt(stored, 10, 64); err == nil {
+			return value
+		}
+	case repository.BoolEncoding:
+		if value, err := strconv.ParseBool(stored); err == nil {
+			return value
+		}
+	case repository.VectorEncoding:
+		var value []float64
+		if err := json.Unmarshal([]byte(stored), &value); err == nil {
+			return value
+		}
+	}
+	return stored
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/TomascpMarques/maestro/migrations"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/jmoiron/sqlx"
+)
+
+const migrateUsage = `usage: maestro migrate <command>
+  up              apply every pending migration
+  down [N]        revert the last N migrations (defaults to 1)
+  goto V          migrate up or down to the version V
+  version         print the current schema version
+  force V         set the schema version to V without running migrations, clearing the dirty flag
+  vacuum          convert a db created before incremental auto vacuum, rebuilding it with a full VACUUM`
+
+/*
+RunMigrateCommand runs one of the `maestro migrate` sub commands against the db,
+commands that change nothing (ErrNoChange) are reported as a success.
+*/
+func RunMigrateCommand(db *sqlx.DB, args []string) (err error) {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	migration, err := migrations.New(db.DB)
+	if err != nil {
+		return err
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "up":
+		if err = CheckSchemaVersion(migration); err != nil {
+			return
+		}
+		err = migration.Up()
+
+	case "down":
+		steps := 1
+		if len(args) > 0 {
+			if steps, err = strconv.Atoi(args[0]); err != nil || steps < 1 {
+				return errors.New("down expects a positive number of steps")
+			}
+		}
+		if steps, err = cappedDownSteps(migration, steps); err != nil || steps == 0 {
+			break
+		}
+		err = migration.Steps(-steps)
+		var short migrate.ErrShortLimit
+		if errors.As(err, &short) {
+			err = fmt.Errorf("down reverted every migration applied, %d steps short of the %d asked", short.Short, steps)
+		}
+
+	case "goto":
+		version, parseErr := migrateVersionArg(args)
+		if parseErr != nil {
+			return parseErr
+		}
+		err = migration.Migrate(uint(version))
+
+	case "force":
+		version, parseErr := migrateVersionArg(args)
+		if parseErr != nil {
+			return parseErr
+		}
+		err = migration.Force(version)
+
+	case "vacuum":
+		err = convertToIncrementalVacuum(db)
+
+	case "version":
+		// Handled below, every command reports the version it left the db in
+
+	default:
+		return fmt.Errorf("unknown migrate command [%s]\n%s", command, migrateUsage)
+	}
+
+	if errors.Is(err, migrate.ErrNoChange) {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	version, dirty, err := migration.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		fmt.Println("version: none, no migration was applied")
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	latest, _ := migrations.LatestVersion()
+	fmt.Printf("version: %d (dirty: %t, latest embedded: %d)\n", version, dirty, latest)
+	return nil
+}
+
+/*
+cappedDownSteps caps the steps down to the migrations applied, saying so when it does,
+down can't revert more than were applied.
+*/
+func cappedDownSteps(migration *migrate.Migrate, steps int) (int, error) {
+	version, _, err := migration.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		fmt.Println("down: no migration is applied, nothing to revert")
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	applied, err := migrations.AppliedCount(version)
+	if err != nil {
+		return 0, err
+	}
+	if steps > applied {
+		fmt.Printf("down: only %d migrations are applied, reverting them all instead of %d\n", applied, steps)
+		return applied, nil
+	}
+	return steps, nil
+}
+
+/*
+convertToIncrementalVacuum sets auto_vacuum to INCREMENTAL, which only applies to an
+existing db once it is rebuilt, so a full VACUUM follows, rewriting the whole file.
+It is run once, with the app stopped, rather than by the IntegrityJob of a running app.
+*/
+func convertToIncrementalVacuum(db *sqlx.DB) error {
+	ctx := context.Background()
+	incremental, err := incrementalVacuum(ctx, db)
+	if err != nil || incremental {
+		return err
+	}
+	if _, err = db.ExecContext(ctx, `PRAGMA auto_vacuum = INCREMENTAL`); err != nil {
+		return err
+	}
+	if _, err = db.ExecContext(ctx, `VACUUM`); err != nil {
+		return err
+	}
+	fmt.Println("auto_vacuum: converted to incremental")
+	return nil
+}
+
+func migrateVersionArg(args []string) (int, error) {
+	if len(args) == 0 {
+		return 0, errors.New("a migration version is required")
+	}
+	version, err := strconv.Atoi(args[0])
+	if err != nil || version < 0 {
+		return 0, errors.New("the migration version should be a positive number")
+	}
+	return version, nil
+}
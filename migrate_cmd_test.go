@@ -0,0 +1,38 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/TomascpMarques/maestro/migrations"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateDown(t *testing.T) {
+	pools := openTestDatabaseFile(t, filepath.Join(t.TempDir(), "db.sqlite"))
+	assert.NoError(t, RunMigrateCommand(pools.Writer, []string{"up"}))
+	migration, err := migrations.New(pools.Writer.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, err := migrations.LatestVersion()
+	assert.NoError(t, err)
+	applied, err := migrations.AppliedCount(latest)
+	assert.NoError(t, err)
+
+	assert.NoError(t, RunMigrateCommand(pools.Writer, []string{"down", "1"}))
+	version, _, err := migration.Version()
+	assert.NoError(t, err)
+	assert.Less(t, version, latest)
+	count, err := migrations.AppliedCount(version)
+	assert.NoError(t, err)
+	assert.Equal(t, applied-1, count)
+
+	// More steps than applied revert them all, instead of failing part way
+	assert.NoError(t, RunMigrateCommand(pools.Writer, []string{"down", "1000"}))
+	_, _, err = migration.Version()
+	assert.ErrorIs(t, err, migrate.ErrNilVersion)
+	assert.NoError(t, RunMigrateCommand(pools.Writer, []string{"down"}))
+	assert.Error(t, RunMigrateCommand(pools.Writer, []string{"down", "0"}))
+}
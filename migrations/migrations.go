@@ -0,0 +1,80 @@
+/*
+Package migrations embeds the SQL migrations into the binary, so the app
+can migrate its database no matter the directory it was started from.
+*/
+package migrations
+
+import (
+	"database/sql"
+	"embed"
+	"io/fs"
+
+	"github.com/golang-migrate/migrate/v4"
+	migration_sqlite3 "github.com/golang-migrate/migrate/v4/database/sqlite3"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+//go:embed *.sqlite
+var FS embed.FS
+
+/*
+New creates a migrator over the embedded migrations for the given sqlite db.
+The migrations are not wrapped in a transaction by the driver, each
+migration file handles its own BEGIN/COMMIT, since some statements
+(VACUUM, PRAGMA foreign_keys) can't run inside one.
+*/
+func New(db *sql.DB) (*migrate.Migrate, error) {
+	sourceDriver, err := iofs.New(FS, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	databaseDriver, err := migration_sqlite3.WithInstance(
+		db,
+		&migration_sqlite3.Config{NoTxWrap: true},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return migrate.NewWithInstance("iofs", sourceDriver, "sqlite3", databaseDriver)
+}
+
+// LatestVersion returns the version of the newest migration embedded in the binary
+func LatestVersion() (latest uint, err error) {
+	entries, err := fs.ReadDir(FS, ".")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		migration, err := source.Parse(entry.Name())
+		if err != nil {
+			continue
+		}
+		if migration.Version > latest {
+			latest = migration.Version
+		}
+	}
+	return
+}
+
+// AppliedCount returns how many of the embedded migrations are applied up to the version
+func AppliedCount(version uint) (count int, err error) {
+	entries, err := fs.ReadDir(FS, ".")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		migration, err := source.Parse(entry.Name())
+		if err != nil || migration.Direction != source.Up {
+			continue
+		}
+		if migration.Version <= version {
+			count++
+		}
+	}
+	return
+}
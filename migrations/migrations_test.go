@@ -0,0 +1,34 @@
+package migrations
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEveryMigrationHasBothDirections(t *testing.T) {
+	entries, err := fs.ReadDir(FS, ".")
+	assert.NoError(t, err)
+
+	directions := map[uint][]source.Direction{}
+	for _, entry := range entries {
+		migration, err := source.Parse(entry.Name())
+		if err != nil {
+			continue
+		}
+		directions[migration.Version] = append(directions[migration.Version], migration.Direction)
+	}
+
+	assert.NotEmpty(t, directions)
+	for version, found := range directions {
+		assert.ElementsMatch(t, []source.Direction{source.Up, source.Down}, found, "version %d", version)
+	}
+}
+
+func TestLatestVersion(t *testing.T) {
+	latest, err := LatestVersion()
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, latest, uint(1723732863))
+}
@@ -0,0 +1,195 @@
+package presence
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/TomascpMarques/maestro/events"
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+/*
+Monitor keeps the connectivity of every device up to date. The devices seen are kept
+in memory and stored once per check, so a heartbeat or a measurement never waits on
+a db write. Only devices with the Ok status are judged, a device switched off,
+suspended or decommissioned is expected to go quiet.
+*/
+type Monitor struct {
+	devices     repository.DeviceRepository
+	deviceTypes DeviceTypes
+	config      Config
+	bus         *events.Bus
+
+	mutex sync.Mutex
+	// Last seen dates, in unix milliseconds, not stored yet
+	pending map[uint]int64
+	// Connectivity of the devices as last published, ahead of the stored one
+	published map[uint]repository.Connectivity
+}
+
+func NewMonitor(devices repository.DeviceRepository, deviceTypes DeviceTypes, config Config, bus *events.Bus) *Monitor {
+	return &Monitor{
+		devices:     devices,
+		deviceTypes: deviceTypes,
+		config:      config.WithDefaults(),
+		bus:         bus,
+		pending:     map[uint]int64{},
+		published:   map[uint]repository.Connectivity{},
+	}
+}
+
+// Timeouts returns the timeouts the devices of the type are judged by
+func (monitor *Monitor) Timeouts(deviceType repository.DeviceType) Timeouts {
+	return monitor.config.timeoutsFor(monitor.deviceTypes, deviceType)
+}
+
+/*
+Seen records that the device reported at the given time. A device that was not
+online is reported as back online right away, without waiting for the next check.
+*/
+func (monitor *Monitor) Seen(device repository.Device, at time.Time) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+
+	if at.UnixMilli() > monitor.pending[device.ID] {
+		monitor.pending[device.ID] = at.UnixMilli()
+	}
+	if device.DeviceStatus != repository.Ok {
+		return
+	}
+	monitor.publish(device, repository.Online, at)
+}
+
+/*
+Presence returns when the device was last seen and its connectivity,
+including what was seen since the last check.
+*/
+func (monitor *Monitor) Presence(device repository.Device) (lastSeen int64, seen bool, connectivity repository.Connectivity) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+
+	lastSeen, seen = device.LastSeenAt.Int64, device.LastSeenAt.Valid
+	if pending, found := monitor.pending[device.ID]; found && pending > lastSeen {
+		lastSeen, seen = pending, true
+	}
+	return lastSeen, seen, monitor.connectivity(device)
+}
+
+// connectivity returns the last published connectivity of the device, the lock must be held
+func (monitor *Monitor) connectivity(device repository.Device) repository.Connectivity {
+	if connectivity, found := monitor.published[device.ID]; found {
+		return connectivity
+	}
+	return device.Connectivity
+}
+
+// publish emits an event if the device connectivity changed, the lock must be held
+func (monitor *Monitor) publish(device repository.Device, connectivity repository.Connectivity, at time.Time) {
+	previous := monitor.connectivity(device)
+	if previous == connectivity {
+		return
+	}
+	monitor.published[device.ID] = connectivity
+	monitor.bus.Publish(events.Event{
+		Type:     eventType(connectivity),
+		SerialId: device.SerialId,
+		At:       at,
+		Details: map[string]any{
+			"previous":    previous.String(),
+			"device_type": monitor.deviceTypes.Name(device.DeviceType),
+		},
+	})
+}
+
+// Run checks every device each interval, until the context is done, checking them once more before returning
+func (monitor *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(monitor.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Stores the devices seen, and those reported back online, since the last check
+			if err := monitor.RunOnce(context.Background(), time.Now()); err != nil {
+				slog.Error("presence", "final-check-failure", err.Error())
+			}
+			return
+		case <-ticker.C:
+		}
+
+		if err := monitor.RunOnce(ctx, time.Now()); err != nil && !errors.Is(err, context.Canceled) {
+			slog.Error("presence", "check-failure", err.Error())
+		}
+	}
+}
+
+// flush stores the pending last seen dates, keeping them pending if it fails
+func (monitor *Monitor) flush(ctx context.Context) error {
+	monitor.mutex.Lock()
+	pending := monitor.pending
+	monitor.pending = map[uint]int64{}
+	monitor.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	err := monitor.devices.MarkSeen(ctx, pending)
+	if err != nil {
+		monitor.mutex.Lock()
+		for id, lastSeen := range monitor.pending {
+			pending[id] = max(pending[id], lastSeen)
+		}
+		monitor.pending = pending
+		monitor.mutex.Unlock()
+	}
+	return err
+}
+
+// RunOnce stores what was seen, and judges every device by now, storing and publishing the changes
+func (monitor *Monitor) RunOnce(ctx context.Context, now time.Time) error {
+	if err := monitor.flush(ctx); err != nil {
+		return err
+	}
+	devices, err := monitor.devices.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[uint]bool, len(devices))
+	for _, device := range devices {
+		listed[device.ID] = true
+		if device.DeviceStatus != repository.Ok {
+			continue
+		}
+
+		monitor.mutex.Lock()
+		lastSeen, seen := device.LastSeenAt.Int64, device.LastSeenAt.Valid
+		// Seen while the devices were being listed
+		if pending, found := monitor.pending[device.ID]; found && pending > lastSeen {
+			lastSeen, seen = pending, true
+		}
+		if !seen {
+			monitor.mutex.Unlock()
+			continue
+		}
+		connectivity := monitor.config.timeoutsFor(monitor.deviceTypes, device.DeviceType).Connectivity(time.UnixMilli(lastSeen), now)
+		monitor.publish(device, connectivity, now)
+		monitor.mutex.Unlock()
+
+		if connectivity != device.Connectivity {
+			if err = monitor.devices.SetConnectivity(ctx, device.ID, connectivity); err != nil && !errors.Is(err, repository.NotFound) {
+				return err
+			}
+		}
+	}
+
+	// Forgets the devices deleted since
+	monitor.mutex.Lock()
+	maps.DeleteFunc(monitor.published, func(id uint, _ repository.Connectivity) bool { return !listed[id] })
+	monitor.mutex.Unlock()
+	return nil
+}
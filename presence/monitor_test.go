@@ -0,0 +1,86 @@
+package presence
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/events"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonitor(t *testing.T) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	bus := events.NewBus()
+	received, unsubscribe := bus.Subscribe(10)
+	defer unsubscribe()
+
+	registry, err := devicetypes.Load(ctx, repos.DeviceTypes)
+	assert.NoError(t, err)
+	accessoryType, _ := registry.Get(repository.Accessory)
+	accessoryType.HeartbeatTimeout = sql.NullInt64{Int64: (2 * time.Minute).Milliseconds(), Valid: true}
+	_, err = registry.Update(ctx, accessoryType)
+	assert.NoError(t, err)
+
+	monitor := NewMonitor(repos.Devices, registry, Config{
+		Default: Timeouts{StaleAfter: time.Minute, OfflineAfter: 5 * time.Minute},
+	}, bus)
+
+	pmd, err := repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000001", DeviceType: repository.PMD})
+	assert.NoError(t, err)
+	accessory, err := repos.Devices.Create(ctx, repository.NewDevice{SerialId: "ACC-000001", DeviceType: repository.Accessory})
+	assert.NoError(t, err)
+	_, err = repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000002", DeviceStatus: repository.Suspended})
+	assert.NoError(t, err)
+
+	start := time.UnixMilli(1_000_000)
+	monitor.Seen(pmd, start)
+	monitor.Seen(accessory, start)
+	assert.Equal(t, DeviceOnline, (<-received).Type)
+	assert.Equal(t, DeviceOnline, (<-received).Type)
+
+	// Seen dates are only stored by the checks
+	stored, _ := repos.Devices.GetByID(ctx, pmd.ID)
+	assert.False(t, stored.LastSeenAt.Valid)
+	assert.NoError(t, monitor.RunOnce(ctx, start.Add(30*time.Second)))
+	stored, _ = repos.Devices.GetByID(ctx, pmd.ID)
+	assert.Equal(t, start.UnixMilli(), stored.LastSeenAt.Int64)
+	assert.Equal(t, repository.Online, stored.Connectivity)
+	assert.Empty(t, received)
+
+	assert.NoError(t, monitor.RunOnce(ctx, start.Add(3*time.Minute)))
+	events := map[string]events.Event{}
+	for range 2 {
+		event := <-received
+		events[event.SerialId] = event
+	}
+	assert.Equal(t, DeviceStale, events["PMD-000001"].Type)
+	// The accessory goes offline sooner
+	assert.Equal(t, DeviceOffline, events["ACC-000001"].Type)
+	assert.Equal(t, "online", events["ACC-000001"].Details["previous"])
+
+	// Coming back is reported as soon as the device is seen, and stored with the next check
+	stored, _ = repos.Devices.GetByID(ctx, accessory.ID)
+	monitor.Seen(stored, start.Add(4*time.Minute))
+	assert.Equal(t, DeviceOnline, (<-received).Type)
+	lastSeen, seen, connectivity := monitor.Presence(stored)
+	assert.True(t, seen)
+	assert.Equal(t, start.Add(4*time.Minute).UnixMilli(), lastSeen)
+	assert.Equal(t, repository.Online, connectivity)
+
+	assert.NoError(t, monitor.RunOnce(ctx, start.Add(4*time.Minute)))
+	stored, _ = repos.Devices.GetByID(ctx, accessory.ID)
+	assert.Equal(t, repository.Online, stored.Connectivity)
+	// Nothing changed for the pmd, and the suspended device is never judged
+	assert.Empty(t, received)
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	assert.Error(t, Config{Default: Timeouts{StaleAfter: time.Hour}}.Validate())
+	assert.Error(t, Config{Default: Timeouts{StaleAfter: time.Hour, OfflineAfter: time.Minute}}.Validate())
+}
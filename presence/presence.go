@@ -0,0 +1,96 @@
+/*
+Package presence tracks when each device was last heard from, through its heartbeats
+and measurements, flagging it as stale and then offline once it goes quiet for longer
+than the timeouts of its device type.
+*/
+package presence
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/TomascpMarques/maestro/events"
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+// Events published when the connectivity of a device changes
+const (
+	DeviceOnline  events.Type = "device-online"
+	DeviceStale   events.Type = "device-stale"
+	DeviceOffline events.Type = "device-offline"
+)
+
+func eventType(connectivity repository.Connectivity) events.Type {
+	switch connectivity {
+	case repository.Stale:
+		return DeviceStale
+	case repository.Offline:
+		return DeviceOffline
+	}
+	return DeviceOnline
+}
+
+// Timeouts is how long a device can go without being seen before it is stale, and then offline
+type Timeouts struct {
+	StaleAfter   time.Duration
+	OfflineAfter time.Duration
+}
+
+// Connectivity judges a device last seen at lastSeen, by now
+func (timeouts Timeouts) Connectivity(lastSeen, now time.Time) repository.Connectivity {
+	quiet := now.Sub(lastSeen)
+	switch {
+	case quiet >= timeouts.OfflineAfter:
+		return repository.Offline
+	case quiet >= timeouts.StaleAfter:
+		return repository.Stale
+	}
+	return repository.Online
+}
+
+// Config holds the timeouts of the devices whose type doesn't set a heartbeat timeout
+type Config struct {
+	// Time between two checks of every device
+	Interval time.Duration
+	Default  Timeouts
+}
+
+// WithDefaults fills every value left out, a check every 30 seconds, with devices stale after 2 minutes and offline after 10
+func (config Config) WithDefaults() Config {
+	if config.Interval == 0 {
+		config.Interval = 30 * time.Second
+	}
+	if config.Default.StaleAfter == 0 {
+		config.Default.StaleAfter = 2 * time.Minute
+	}
+	if config.Default.OfflineAfter == 0 {
+		config.Default.OfflineAfter = 10 * time.Minute
+	}
+	return config
+}
+
+// Validate checks that no device goes offline before going stale, once the defaults are filled
+func (config Config) Validate() error {
+	config = config.WithDefaults()
+	if config.Default.OfflineAfter < config.Default.StaleAfter {
+		return fmt.Errorf("the default offline_after should not be shorter than stale_after")
+	}
+	return nil
+}
+
+// DeviceTypes is the part of the device type registry the monitor depends on
+type DeviceTypes interface {
+	Name(deviceType repository.DeviceType) string
+	HeartbeatTimeout(deviceType repository.DeviceType) (time.Duration, bool)
+}
+
+/*
+timeoutsFor returns the timeouts of the device type, a type with a heartbeat timeout
+has its devices offline once it passes, and stale halfway through it.
+*/
+func (config Config) timeoutsFor(deviceTypes DeviceTypes, deviceType repository.DeviceType) Timeouts {
+	if timeout, set := deviceTypes.HeartbeatTimeout(deviceType); set {
+		return Timeouts{StaleAfter: timeout / 2, OfflineAfter: timeout}
+	}
+	return config.Default
+}
@@ -0,0 +1,138 @@
+package provisioning
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/TomascpMarques/maestro/deviceauth"
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+// CodeRequest is a claim code to generate, when the expiry is left out, the default of the config is used
+type CodeRequest struct {
+	DeviceType       repository.DeviceType
+	RequiresApproval bool
+	Description      sql.NullString
+	ExpiresIn        time.Duration
+}
+
+/*
+Provisioner generates the claim codes, and registers the devices that present them.
+A code is claimed before the device is created, so two devices presenting the same
+code can't both be registered, and released if the device could not be.
+*/
+type Provisioner struct {
+	codes       repository.ClaimCodeRepository
+	devices     repository.DeviceRepository
+	deviceTypes *devicetypes.Registry
+	auth        *deviceauth.Authenticator
+	config      Config
+}
+
+func NewProvisioner(
+	codes repository.ClaimCodeRepository,
+	devices repository.DeviceRepository,
+	deviceTypes *devicetypes.Registry,
+	auth *deviceauth.Authenticator,
+	config Config,
+) *Provisioner {
+	return &Provisioner{codes, devices, deviceTypes, auth, config.WithDefaults()}
+}
+
+// Generate creates a claim code for the type, returning the code, the only time it is ever shown
+func (provisioner *Provisioner) Generate(ctx context.Context, request CodeRequest, actor string, now time.Time) (string, repository.ClaimCode, error) {
+	if _, found := provisioner.deviceTypes.Get(request.DeviceType); !found {
+		return "", repository.ClaimCode{}, devicetypes.ErrUnknownType
+	}
+	expiresIn := request.ExpiresIn
+	if expiresIn == 0 {
+		expiresIn = provisioner.config.DefaultExpiry
+	}
+	if expiresIn < 0 || expiresIn > provisioner.config.MaxExpiry {
+		return "", repository.ClaimCode{}, fmt.Errorf("%w: at most %s", ErrExpiry, provisioner.config.MaxExpiry)
+	}
+
+	code, codeHash, err := NewCode()
+	if err != nil {
+		return "", repository.ClaimCode{}, err
+	}
+	created, err := provisioner.codes.Create(ctx, repository.NewClaimCode{
+		CodeHash:         codeHash,
+		DeviceType:       request.DeviceType,
+		RequiresApproval: request.RequiresApproval,
+		Description:      request.Description,
+		CreatedBy:        actor,
+		CreatedAt:        now.UnixMilli(),
+		ExpiresAt:        now.Add(expiresIn).UnixMilli(),
+	})
+	if err != nil {
+		return "", repository.ClaimCode{}, err
+	}
+	return code, created, nil
+}
+
+// Revoke revokes a code not yet used, so no device can claim it
+func (provisioner *Provisioner) Revoke(ctx context.Context, id uint, now time.Time) (repository.ClaimCode, error) {
+	return provisioner.codes.Revoke(ctx, id, now.UnixMilli())
+}
+
+func (provisioner *Provisioner) List(ctx context.Context) ([]repository.ClaimCode, error) {
+	return provisioner.codes.List(ctx)
+}
+
+/*
+Provision registers the device with the type of the code, and issues its secret. The
+device starts Pending when the code requires an approval, with the default status of
+its type otherwise. A code that doesn't match is ErrInvalidCode, a serial id the type
+doesn't allow is an error of the devicetypes package, and leaves the code usable.
+*/
+func (provisioner *Provisioner) Provision(
+	ctx context.Context, code, serialId string, description sql.NullString, now time.Time,
+) (repository.Device, string, repository.ClaimCode, error) {
+	claimed, err := provisioner.codes.Claim(ctx, HashCode(code), serialId, now.UnixMilli())
+	if errors.Is(err, repository.NotFound) {
+		return repository.Device{}, "", repository.ClaimCode{}, ErrInvalidCode
+	}
+	if err != nil {
+		return repository.Device{}, "", repository.ClaimCode{}, err
+	}
+
+	device, err := provisioner.register(ctx, claimed, serialId, description)
+	if err != nil {
+		// The device was not created, the code can be used again, by the same device once fixed
+		if releaseErr := provisioner.codes.Release(ctx, claimed.ID); releaseErr != nil {
+			slog.Error("provisioning", "release-failure", claimed.ID, "cause", releaseErr.Error())
+		}
+		return repository.Device{}, "", repository.ClaimCode{}, err
+	}
+
+	// A device left without a secret by a failure here is given one by rotating its credentials
+	secret, _, err := provisioner.auth.Issue(ctx, device.ID, now)
+	if err != nil {
+		return repository.Device{}, "", repository.ClaimCode{}, err
+	}
+	slog.Info("provisioning", "status", "device provisioned", "serial_id", device.SerialId, "claim_code", claimed.ID,
+		"device_status", device.DeviceStatus.String())
+	return device, secret, claimed, nil
+}
+
+func (provisioner *Provisioner) register(
+	ctx context.Context, code repository.ClaimCode, serialId string, description sql.NullString,
+) (repository.Device, error) {
+	newDevice := repository.NewDevice{SerialId: serialId, Description: description, DeviceType: code.DeviceType}
+	if err := provisioner.deviceTypes.ValidateDevice(newDevice); err != nil {
+		return repository.Device{}, err
+	}
+	if code.RequiresApproval {
+		newDevice.DeviceStatus = repository.Pending
+	} else {
+		deviceType, _ := provisioner.deviceTypes.Get(code.DeviceType)
+		newDevice.DeviceStatus = deviceType.DefaultStatus
+	}
+	return provisioner.devices.Create(ctx, newDevice)
+}
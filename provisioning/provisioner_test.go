@@ -0,0 +1,95 @@
+package provisioning
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/deviceauth"
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodes(t *testing.T) {
+	code, codeHash, err := NewCode()
+	assert.NoError(t, err)
+	assert.Len(t, code, 19)
+	assert.Len(t, strings.Split(code, "-"), 4)
+	assert.Equal(t, codeHash, HashCode(code))
+
+	// Typed by hand, the code still matches
+	assert.Equal(t, HashCode("0123-ABCD-1JKM-NPQR"), HashCode("o123 abcd ljkm nPqR"))
+	assert.NotEqual(t, HashCode("0123-ABCD-1JKM-NPQR"), HashCode("0123-ABCD-1JKM-NPQS"))
+}
+
+func TestProvisioner(t *testing.T) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	registry, err := devicetypes.Load(ctx, repos.DeviceTypes)
+	assert.NoError(t, err)
+	deviceType, err := registry.Create(ctx, repository.NewDeviceType{
+		Name: "field-pmd", SerialPattern: "^FLD-[0-9]{6}$", DefaultStatus: repository.Suspended,
+	})
+	assert.NoError(t, err)
+
+	auth, err := deviceauth.NewAuthenticator(repos.Credentials, deviceauth.Config{KeySecret: "test-key-secret"})
+	assert.NoError(t, err)
+	provisioner := NewProvisioner(repos.ClaimCodes, repos.Devices, registry, auth, Config{DefaultExpiry: time.Hour})
+	now := time.UnixMilli(1_000_000_000)
+
+	_, _, err = provisioner.Generate(ctx, CodeRequest{DeviceType: 99}, "ana", now)
+	assert.True(t, errors.Is(err, devicetypes.ErrUnknownType))
+	_, _, err = provisioner.Generate(ctx, CodeRequest{DeviceType: deviceType.ID, ExpiresIn: 365 * 24 * time.Hour}, "ana", now)
+	assert.True(t, errors.Is(err, ErrExpiry))
+
+	code, claimCode, err := provisioner.Generate(ctx, CodeRequest{DeviceType: deviceType.ID}, "ana", now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(time.Hour).UnixMilli(), claimCode.ExpiresAt)
+	assert.Equal(t, "ana", claimCode.CreatedBy)
+
+	// A serial id the type doesn't allow leaves the code usable
+	_, _, _, err = provisioner.Provision(ctx, code, "PMD-000001", sql.NullString{}, now)
+	assert.True(t, errors.Is(err, devicetypes.ErrSerialPattern))
+
+	device, secret, claimed, err := provisioner.Provision(ctx, strings.ToLower(code), "FLD-000001", sql.NullString{}, now)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, secret)
+	assert.Equal(t, repository.Suspended, device.DeviceStatus)
+	assert.Equal(t, sql.NullString{String: "FLD-000001", Valid: true}, claimed.ClaimedBy)
+	valid, _ := repos.Credentials.Valid(ctx, device.ID, now.UnixMilli())
+	if assert.Len(t, valid, 1) {
+		assert.NotContains(t, valid[0].KeyHash, deviceauth.HashSecret(secret), "the signing key is stored sealed")
+	}
+
+	// A code is used once
+	_, _, _, err = provisioner.Provision(ctx, code, "FLD-000002", sql.NullString{}, now)
+	assert.True(t, errors.Is(err, ErrInvalidCode))
+
+	// A device registered from a code requiring an approval is pending
+	code, _, err = provisioner.Generate(ctx, CodeRequest{DeviceType: deviceType.ID, RequiresApproval: true}, "ana", now)
+	assert.NoError(t, err)
+	device, _, _, err = provisioner.Provision(ctx, code, "FLD-000002", sql.NullString{}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, repository.Pending, device.DeviceStatus)
+
+	// An expired or revoked code is refused
+	code, _, _ = provisioner.Generate(ctx, CodeRequest{DeviceType: deviceType.ID}, "ana", now)
+	_, _, _, err = provisioner.Provision(ctx, code, "FLD-000003", sql.NullString{}, now.Add(time.Hour))
+	assert.True(t, errors.Is(err, ErrInvalidCode))
+	code, claimCode, _ = provisioner.Generate(ctx, CodeRequest{DeviceType: deviceType.ID}, "ana", now)
+	_, err = provisioner.Revoke(ctx, claimCode.ID, now)
+	assert.NoError(t, err)
+	_, _, _, err = provisioner.Provision(ctx, code, "FLD-000003", sql.NullString{}, now)
+	assert.True(t, errors.Is(err, ErrInvalidCode))
+
+	// A serial id already registered is refused, and the code released
+	code, _, _ = provisioner.Generate(ctx, CodeRequest{DeviceType: deviceType.ID}, "ana", now)
+	_, _, _, err = provisioner.Provision(ctx, code, "FLD-000001", sql.NullString{}, now)
+	assert.True(t, errors.Is(err, repository.AlreadyExists))
+	_, _, _, err = provisioner.Provision(ctx, code, "FLD-000003", sql.NullString{}, now)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,81 @@
+/*
+Package provisioning registers factory-fresh devices by themselves. An admin generates
+one-time claim codes, each tied to a device type and an expiry, and a device presents
+its code with its serial id, receiving the secret it signs its requests with. Like the
+secrets of the devices, only the SHA-256 of a code is stored.
+
+Codes are 16 characters of Crockford's base32, grouped by 4 as XXXX-XXXX-XXXX-XXXX,
+read case-insensitively, with the dashes and spaces ignored, and O, I and L read as
+0, 1 and 1, so a code typed by hand or read from a label still matches.
+*/
+package provisioning
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Alphabet of Crockford's base32, without I, L, O and U
+const alphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+const (
+	codeLength = 16
+	groupSize  = 4
+)
+
+var (
+	// The code is unknown, already used, revoked or expired, which one is never told
+	ErrInvalidCode = errors.New("invalid or expired claim code")
+	ErrExpiry      = errors.New("expiry outside the allowed range")
+)
+
+// Config holds how long the claim codes stay valid
+type Config struct {
+	// Expiry of the codes generated without one
+	DefaultExpiry time.Duration
+	// Longest expiry a code can be generated with
+	MaxExpiry time.Duration
+}
+
+// WithDefaults fills every value left out, codes valid for a day, and at most 30 days
+func (config Config) WithDefaults() Config {
+	if config.DefaultExpiry == 0 {
+		config.DefaultExpiry = 24 * time.Hour
+	}
+	if config.MaxExpiry == 0 {
+		config.MaxExpiry = 30 * 24 * time.Hour
+	}
+	return config
+}
+
+// NewCode generates a claim code, returning it with the hash that is stored
+func NewCode() (code string, codeHash string, err error) {
+	raw := make([]byte, codeLength)
+	if _, err = rand.Read(raw); err != nil {
+		return "", "", err
+	}
+
+	var builder strings.Builder
+	for i, b := range raw {
+		if i > 0 && i%groupSize == 0 {
+			builder.WriteByte('-')
+		}
+		// 256 is a multiple of 32, so every character is as likely
+		builder.WriteByte(alphabet[int(b)%len(alphabet)])
+	}
+	code = builder.String()
+	return code, HashCode(code), nil
+}
+
+// normalize reads the code the way it was generated, see the package doc
+var normalize = strings.NewReplacer("-", "", " ", "", "O", "0", "I", "1", "L", "1")
+
+// HashCode returns the hex SHA-256 of the code, once normalized
+func HashCode(code string) string {
+	hash := sha256.Sum256([]byte(normalize.Replace(strings.ToUpper(code))))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+/*
+ConfigHolder keeps the most recent valid config of the app instance, the one the api
+reports. The running components keep the config they were started with, a reload only
+checks the file and its secrets, the values it changes are applied on the next restart.
+That goes for the secrets too: the admin bootstrap password is only used at startup, and
+a new device key secret leaves the stored signing keys unreadable once restarted, see
+the deviceauth package.
+*/
+type ConfigHolder struct {
+	current atomic.Pointer[ConfigWrapper]
+}
+
+func NewConfigHolder(config ConfigWrapper) *ConfigHolder {
+	holder := &ConfigHolder{}
+	holder.current.Store(&config)
+	return holder
+}
+
+func (holder *ConfigHolder) Get() ConfigWrapper {
+	return *holder.current.Load()
+}
+
+/*
+Reload loads the config file again, and its secrets, a config that fails to load is
+logged and returned, keeping the last valid config in place.
+Every secret that changed is logged by its path, as it is only validated, not applied.
+*/
+func (holder *ConfigHolder) Reload(configPath, profile string) error {
+	config, err := LoadConfig(configPath, profile)
+	if err != nil {
+		slog.Error("config-reload", "cause", err.Error())
+		slog.Warn("config-reload", "action", "keeping the previous config")
+		return err
+	}
+	previous := holder.current.Swap(&config)
+	slog.Info("config-reload", "status", "reloaded config and secrets", "location", configPath, "profile", profile)
+	for _, path := range ChangedSecrets(*previous, config) {
+		slog.Warn("config-reload", "secret", path, "action", "changed secret not applied, the running components keep the previous one until a restart")
+	}
+	slog.Warn("config-reload", "action", "restart to apply the reloaded values, the running components keep their config")
+	return nil
+}
+
+/*
+WatchReload reloads the config file every time the process receives a SIGHUP,
+which also re-resolves every secret reference in it, see ConfigHolder for what a
+reload changes. A config that fails to load is logged and ignored, keeping the last
+valid config in place.
+The returned function stops the watcher.
+*/
+func (holder *ConfigHolder) WatchReload(configPath, profile string) (stop func()) {
+	reload := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(reload, syscall.SIGHUP)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-reload:
+				_ = holder.Reload(configPath, profile)
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(reload)
+		close(done)
+	}
+}
+
+// ConfigControl lets the api read and reload the config held, see web_api.ConfigControl
+type ConfigControl struct {
+	holder     *ConfigHolder
+	configPath string
+	profile    string
+}
+
+func (holder *ConfigHolder) Control(configPath, profile string) ConfigControl {
+	return ConfigControl{holder, configPath, profile}
+}
+
+func (control ConfigControl) Redacted() any {
+	return control.holder.Get().Redacted()
+}
+
+func (control ConfigControl) Reload() error {
+	return control.holder.Reload(control.configPath, control.profile)
+}
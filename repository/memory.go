@@ -0,0 +1,400 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+MemoryDeviceRepository keeps the devices in a map, it holds the same constraints
+as the SQLite schema (unique serial ids), so the handlers can be tested against it.
+*/
+type MemoryDeviceRepository struct {
+	mutex   sync.RWMutex
+	lastID  uint
+	devices map[uint]Device
+	// Checked and cascaded into when deleting a device
+	measurements *MemoryMeasurementRepository
+
+	lastHistoryID uint
+	history       []StatusHistoryEntry
+
+	// Kept by MemoryAttachmentRepository, read here to cascade the status changes
+	lastAttachmentID uint
+	attachments      []Attachment
+
+	// Kept by MemoryCredentialRepository, deleted with their device
+	lastCredentialID uint
+	credentials      []Credential
+
+	// Kept by MemoryClaimCodeRepository, deleted with their device type
+	lastClaimCodeID uint
+	claimCodes      []ClaimCode
+
+	// Kept by MemoryCommandRepository, deleted with their device
+	lastCommandID        uint
+	commands             []Command
+	lastCommandHistoryID uint
+	commandHistory       []CommandHistoryEntry
+
+	// Kept by MemoryShadowRepository, deleted with their device, and their device type
+	shadows         map[uint]Shadow
+	shadowTemplates map[DeviceType]ShadowTemplate
+
+	// Kept by MemoryFirmwareRepository, the devices of the rollouts are deleted with their device
+	lastFirmwareID uint
+	firmware       []Firmware
+	lastRolloutID  uint
+	rollouts       []Rollout
+	rolloutDevices []RolloutDevice
+
+	// Kept by MemoryClockRepository, deleted with their device
+	clocks map[uint]DeviceClock
+
+	// Kept by MemoryAlertRepository, the rules scoped to a device are deleted with it
+	lastAlertRuleID uint
+	alertRules      []AlertRule
+	lastAlertID     uint
+	alerts          []Alert
+}
+
+func NewMemoryDeviceRepository(measurements *MemoryMeasurementRepository) *MemoryDeviceRepository {
+	return &MemoryDeviceRepository{
+		devices:         map[uint]Device{},
+		measurements:    measurements,
+		shadows:         map[uint]Shadow{},
+		shadowTemplates: map[DeviceType]ShadowTemplate{},
+		clocks:          map[uint]DeviceClock{},
+	}
+}
+
+func (repo *MemoryDeviceRepository) Create(_ context.Context, device NewDevice) (Device, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	for _, existing := range repo.devices {
+		if existing.SerialId == device.SerialId {
+			return Device{}, NewRepositoryError(AlreadyExists, "unique constraint failed", "failed to create the device")
+		}
+	}
+
+	repo.lastID++
+	created := Device{ID: repo.lastID, NewDevice: device}
+	repo.devices[created.ID] = created
+	repo.record(created, nil, StatusChange{
+		Status: device.DeviceStatus,
+		Actor:  RegistrationActor,
+		At:     time.Now().UnixMilli(),
+	})
+	return created, nil
+}
+
+func (repo *MemoryDeviceRepository) GetByID(_ context.Context, id uint) (Device, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	device, exists := repo.devices[id]
+	if !exists {
+		return Device{}, NewRepositoryError(NotFound, "no matching rows", "failed to get the device by id")
+	}
+	return device, nil
+}
+
+func (repo *MemoryDeviceRepository) GetBySerial(_ context.Context, serialId string) (Device, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	for _, device := range repo.devices {
+		if device.SerialId == serialId {
+			return device, nil
+		}
+	}
+	return Device{}, NewRepositoryError(NotFound, "no matching rows", "failed to get the device by serial id")
+}
+
+func (repo *MemoryDeviceRepository) List(_ context.Context) ([]Device, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	devices := make([]Device, 0, len(repo.devices))
+	for _, device := range repo.devices {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices, nil
+}
+
+func (repo *MemoryDeviceRepository) UpdateStatus(_ context.Context, serialId string, change StatusChange) (Device, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	device, changed := repo.changeStatus(serialId, change)
+	if !changed {
+		return Device{}, NewRepositoryError(NotFound, "no matching rows", "failed to update the device status")
+	}
+	return device, nil
+}
+
+func (repo *MemoryDeviceRepository) Decommission(_ context.Context, serialId string, change StatusChange) (Device, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	change.Status = Decommissioned
+	device, found := repo.changeStatus(serialId, change)
+	if !found {
+		return Device{}, NewRepositoryError(NotFound, "no matching rows", "failed to decommission the device")
+	}
+	return device, nil
+}
+
+/*
+changeStatus applies and records the change, and when cascading, does the same for
+the accessories attached to the device. The lock must be held.
+*/
+func (repo *MemoryDeviceRepository) changeStatus(serialId string, change StatusChange) (Device, bool) {
+	for id, device := range repo.devices {
+		if device.SerialId != serialId {
+			continue
+		}
+		device = repo.applyStatus(device, change)
+		if change.CascadeAccessories {
+			for _, attachment := range repo.attachments {
+				accessory := repo.devices[attachment.AccessoryFk]
+				// A decommissioned accessory is never brought back by its parent, nor a pending one approved
+				if attachment.ParentFk != id || attachment.DetachedAt.Valid ||
+					accessory.DeviceStatus == Decommissioned || accessory.DeviceStatus == Pending {
+					continue
+				}
+				repo.applyStatus(accessory, change)
+			}
+		}
+		return device, true
+	}
+	return Device{}, false
+}
+
+func (repo *MemoryDeviceRepository) applyStatus(device Device, change StatusChange) Device {
+	if device.DeviceStatus == change.Status {
+		return device
+	}
+	oldStatus := device.DeviceStatus
+	device.DeviceStatus = change.Status
+	if change.Status == Decommissioned && !device.DecommissionedAt.Valid {
+		device.DecommissionedAt = sql.NullInt64{Int64: change.At, Valid: true}
+	}
+	repo.devices[device.ID] = device
+	repo.record(device, &oldStatus, change)
+	return device
+}
+
+// record appends the change to the history, the lock must be held
+func (repo *MemoryDeviceRepository) record(device Device, oldStatus *DeviceStatus, change StatusChange) {
+	repo.lastHistoryID++
+	repo.history = append(repo.history, StatusHistoryEntry{
+		ID:        repo.lastHistoryID,
+		DeviceFk:  device.ID,
+		OldStatus: oldStatus,
+		NewStatus: change.Status,
+		Actor:     change.Actor,
+		Reason:    change.Reason,
+		ChangedAt: change.At,
+	})
+}
+
+func (repo *MemoryDeviceRepository) Delete(_ context.Context, serialId string, cascade bool) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.measurements.mutex.Lock()
+	defer repo.measurements.mutex.Unlock()
+
+	for id, device := range repo.devices {
+		if device.SerialId != serialId {
+			continue
+		}
+
+		belongs := func(fk uint) bool { return fk == id }
+		inUse := slices.ContainsFunc(repo.measurements.measurements, func(m Measurement) bool { return belongs(m.PublishingDeviceFk) })
+		for _, rollups := range repo.measurements.rollups {
+			inUse = inUse || slices.ContainsFunc(rollups, func(r Rollup) bool { return belongs(r.PublishingDeviceFk) })
+		}
+		if inUse && !cascade {
+			return NewRepositoryError(InUse, "device has measurements", "failed to delete the device")
+		}
+
+		repo.measurements.measurements = slices.DeleteFunc(repo.measurements.measurements, func(m Measurement) bool {
+			return belongs(m.PublishingDeviceFk)
+		})
+		for resolution, rollups := range repo.measurements.rollups {
+			repo.measurements.rollups[resolution] = slices.DeleteFunc(rollups, func(r Rollup) bool {
+				return belongs(r.PublishingDeviceFk)
+			})
+		}
+		repo.history = slices.DeleteFunc(repo.history, func(entry StatusHistoryEntry) bool {
+			return belongs(entry.DeviceFk)
+		})
+		repo.attachments = slices.DeleteFunc(repo.attachments, func(attachment Attachment) bool {
+			return belongs(attachment.AccessoryFk) || belongs(attachment.ParentFk)
+		})
+		repo.credentials = slices.DeleteFunc(repo.credentials, func(credential Credential) bool {
+			return belongs(credential.DeviceFk)
+		})
+		for _, command := range repo.commands {
+			if belongs(command.DeviceFk) {
+				repo.commandHistory = slices.DeleteFunc(repo.commandHistory, func(entry CommandHistoryEntry) bool {
+					return entry.CommandFk == command.ID
+				})
+			}
+		}
+		repo.commands = slices.DeleteFunc(repo.commands, func(command Command) bool {
+			return belongs(command.DeviceFk)
+		})
+		delete(repo.shadows, id)
+		delete(repo.clocks, id)
+		rules := []uint{}
+		for _, rule := range repo.alertRules {
+			if rule.DeviceFk.Valid && belongs(uint(rule.DeviceFk.Int64)) {
+				rules = append(rules, rule.ID)
+			}
+		}
+		repo.alerts = slices.DeleteFunc(repo.alerts, func(alert Alert) bool {
+			return belongs(alert.DeviceFk) || slices.Contains(rules, alert.RuleFk)
+		})
+		repo.alertRules = slices.DeleteFunc(repo.alertRules, func(rule AlertRule) bool {
+			return slices.Contains(rules, rule.ID)
+		})
+		repo.rolloutDevices = slices.DeleteFunc(repo.rolloutDevices, func(device RolloutDevice) bool {
+			return belongs(device.DeviceFk)
+		})
+		delete(repo.devices, id)
+		return nil
+	}
+	return NewRepositoryError(NotFound, "no matching rows", "failed to delete the device")
+}
+
+func (repo *MemoryDeviceRepository) MarkSeen(_ context.Context, seen map[uint]int64) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	for id, lastSeenAt := range seen {
+		device, exists := repo.devices[id]
+		if !exists || device.LastSeenAt.Int64 >= lastSeenAt {
+			continue
+		}
+		device.LastSeenAt = sql.NullInt64{Int64: lastSeenAt, Valid: true}
+		repo.devices[id] = device
+	}
+	return nil
+}
+
+func (repo *MemoryDeviceRepository) SetConnectivity(_ context.Context, deviceID uint, connectivity Connectivity) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	device, exists := repo.devices[deviceID]
+	if !exists {
+		return NewRepositoryError(NotFound, "no matching rows", "failed to set the device connectivity")
+	}
+	device.Connectivity = connectivity
+	repo.devices[deviceID] = device
+	return nil
+}
+
+// ---------------------------------------------------
+
+type MemoryMeasurementRepository struct {
+	mutex        sync.RWMutex
+	lastID       uint
+	measurements []Measurement
+	// Kept by MemoryRetentionRepository, keyed by their resolution
+	rollups map[Resolution][]Rollup
+}
+
+func NewMemoryMeasurementRepository() *MemoryMeasurementRepository {
+	return &MemoryMeasurementRepository{rollups: map[Resolution][]Rollup{}}
+}
+
+func (repo *MemoryMeasurementRepository) Insert(_ context.Context, measurement NewMeasurement) (Measurement, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	repo.lastID++
+	inserted := Measurement{ID: repo.lastID, NewMeasurement: measurement}
+	repo.measurements = append(repo.measurements, inserted)
+	return inserted, nil
+}
+
+func (repo *MemoryMeasurementRepository) InsertBatch(_ context.Context, measurements []NewMeasurement) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	for _, measurement := range measurements {
+		repo.lastID++
+		repo.measurements = append(repo.measurements, Measurement{ID: repo.lastID, NewMeasurement: measurement})
+	}
+	return nil
+}
+
+func (repo *MemoryMeasurementRepository) Query(_ context.Context, query MeasurementQuery) ([]Measurement, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	measurements := []Measurement{}
+	for _, measurement := range repo.measurements {
+		device := measurement.PublishingDeviceFk
+		if query.ByAccessory {
+			device = uint(measurement.AccessoryFk.Int64)
+		}
+		at := query.Axis.at(measurement.NewMeasurement)
+		if device != query.DeviceID || at < query.From || at > query.To {
+			continue
+		}
+		if query.ValueType != nil && measurement.ValueType != *query.ValueType {
+			continue
+		}
+		measurements = append(measurements, measurement)
+	}
+
+	sort.SliceStable(measurements, func(i, j int) bool {
+		return query.Axis.at(measurements[i].NewMeasurement) < query.Axis.at(measurements[j].NewMeasurement)
+	})
+	if query.Limit > 0 && uint(len(measurements)) > query.Limit {
+		measurements = measurements[:query.Limit]
+	}
+	return measurements, nil
+}
+
+func (repo *MemoryMeasurementRepository) QueryRollups(_ context.Context, query MeasurementQuery, resolution Resolution) ([]Rollup, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	rollups := []Rollup{}
+	if query.ByAccessory {
+		return rollups, nil
+	}
+	for _, rollup := range repo.rollups[resolution] {
+		if rollup.PublishingDeviceFk != query.DeviceID ||
+			rollup.BucketStart < query.From || rollup.BucketStart > query.To {
+			continue
+		}
+		if query.ValueType != nil && rollup.ValueType != *query.ValueType {
+			continue
+		}
+		rollup.Avg = rollup.Sum / float64(rollup.Count)
+		rollups = append(rollups, rollup)
+	}
+
+	sort.SliceStable(rollups, func(i, j int) bool {
+		if rollups[i].BucketStart != rollups[j].BucketStart {
+			return rollups[i].BucketStart < rollups[j].BucketStart
+		}
+		return rollups[i].ValueType < rollups[j].ValueType
+	})
+	if query.Limit > 0 && uint(len(rollups)) > query.Limit {
+		rollups = rollups[:query.Limit]
+	}
+	return rollups, nil
+}
@@ -0,0 +1,162 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+)
+
+// MemoryAlertRepository keeps the alerts in the MemoryDeviceRepository, so deleting a device reaches its rules and alerts
+type MemoryAlertRepository struct {
+	devices *MemoryDeviceRepository
+}
+
+func NewMemoryAlertRepository(devices *MemoryDeviceRepository) *MemoryAlertRepository {
+	return &MemoryAlertRepository{devices}
+}
+
+// withSerial fills the serial id of the device in the scope of the rule, the caller holds the lock
+func (repo *MemoryAlertRepository) withSerial(rule AlertRule) AlertRule {
+	rule.SerialId = sql.NullString{}
+	if device, found := repo.devices.devices[uint(rule.DeviceFk.Int64)]; found && rule.DeviceFk.Valid {
+		rule.SerialId = sql.NullString{String: device.SerialId, Valid: true}
+	}
+	return rule
+}
+
+// withNames fills what sqlite reads with the alert, the caller holds the lock
+func (repo *MemoryAlertRepository) withNames(alert Alert) Alert {
+	for _, rule := range repo.devices.alertRules {
+		if rule.ID == alert.RuleFk {
+			alert.RuleName = rule.Name
+		}
+	}
+	alert.SerialId = repo.devices.devices[alert.DeviceFk].SerialId
+	return alert
+}
+
+func (repo *MemoryAlertRepository) CreateRule(_ context.Context, rule NewAlertRule) (AlertRule, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	if slices.ContainsFunc(repo.devices.alertRules, func(existing AlertRule) bool { return existing.Name == rule.Name }) {
+		return AlertRule{}, NewRepositoryError(AlreadyExists, "unique constraint failed", "failed to create the alert rule")
+	}
+	if _, found := repo.devices.devices[uint(rule.DeviceFk.Int64)]; rule.DeviceFk.Valid && !found {
+		return AlertRule{}, NewRepositoryError(ConstraintFailed, "foreign key constraint failed", "failed to create the alert rule")
+	}
+	repo.devices.lastAlertRuleID++
+	created := AlertRule{ID: repo.devices.lastAlertRuleID, NewAlertRule: rule}
+	repo.devices.alertRules = append(repo.devices.alertRules, created)
+	return repo.withSerial(created), nil
+}
+
+func (repo *MemoryAlertRepository) ListRules(_ context.Context) ([]AlertRule, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	rules := make([]AlertRule, 0, len(repo.devices.alertRules))
+	for _, rule := range repo.devices.alertRules {
+		rules = append(rules, repo.withSerial(rule))
+	}
+	return rules, nil
+}
+
+func (repo *MemoryAlertRepository) DeleteRule(_ context.Context, id uint) error {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	index := slices.IndexFunc(repo.devices.alertRules, func(rule AlertRule) bool { return rule.ID == id })
+	if index < 0 {
+		return NewRepositoryError(NotFound, "no matching rows", "failed to delete the alert rule")
+	}
+	// Same as the delete of sqlite, the alerts go with their rule
+	repo.devices.alerts = slices.DeleteFunc(repo.devices.alerts, func(alert Alert) bool { return alert.RuleFk == id })
+	repo.devices.alertRules = slices.Delete(repo.devices.alertRules, index, index+1)
+	return nil
+}
+
+func (repo *MemoryAlertRepository) Fire(_ context.Context, alert NewAlert) (Alert, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	if slices.ContainsFunc(repo.devices.alerts, func(existing Alert) bool {
+		return existing.RuleFk == alert.RuleFk && existing.DeviceFk == alert.DeviceFk && existing.State != AlertResolved
+	}) {
+		return Alert{}, NewRepositoryError(AlreadyExists, "unique constraint failed", "failed to fire the alert")
+	}
+	_, deviceFound := repo.devices.devices[alert.DeviceFk]
+	if !deviceFound || !slices.ContainsFunc(repo.devices.alertRules, func(rule AlertRule) bool { return rule.ID == alert.RuleFk }) {
+		return Alert{}, NewRepositoryError(ConstraintFailed, "foreign key constraint failed", "failed to fire the alert")
+	}
+	repo.devices.lastAlertID++
+	fired := Alert{ID: repo.devices.lastAlertID, NewAlert: alert, State: AlertFiring}
+	repo.devices.alerts = append(repo.devices.alerts, fired)
+	return repo.withNames(fired), nil
+}
+
+func (repo *MemoryAlertRepository) Get(_ context.Context, id uint) (Alert, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	for _, alert := range repo.devices.alerts {
+		if alert.ID == id {
+			return repo.withNames(alert), nil
+		}
+	}
+	return Alert{}, NewRepositoryError(NotFound, "no matching rows", "failed to get the alert")
+}
+
+func (repo *MemoryAlertRepository) List(_ context.Context, query AlertQuery) ([]Alert, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	alerts := []Alert{}
+	for i := len(repo.devices.alerts) - 1; i >= 0; i-- {
+		alert := repo.devices.alerts[i]
+		if query.State != nil && alert.State != *query.State {
+			continue
+		}
+		if (query.Open && alert.State == AlertResolved) || (query.DeviceID != 0 && alert.DeviceFk != query.DeviceID) {
+			continue
+		}
+		alerts = append(alerts, repo.withNames(alert))
+		if query.Limit > 0 && uint(len(alerts)) == query.Limit {
+			break
+		}
+	}
+	return alerts, nil
+}
+
+func (repo *MemoryAlertRepository) Acknowledge(_ context.Context, id uint, actor string, at int64) (Alert, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	for i, alert := range repo.devices.alerts {
+		if alert.ID != id || alert.State != AlertFiring {
+			continue
+		}
+		alert.State = AlertAcknowledged
+		alert.AcknowledgedBy = sql.NullString{String: actor, Valid: true}
+		alert.AcknowledgedAt = sql.NullInt64{Int64: at, Valid: true}
+		repo.devices.alerts[i] = alert
+		return repo.withNames(alert), nil
+	}
+	return Alert{}, NewRepositoryError(NotFound, "no matching rows", "failed to acknowledge the alert")
+}
+
+func (repo *MemoryAlertRepository) Resolve(_ context.Context, ruleID, deviceID uint, at int64) (Alert, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	for i, alert := range repo.devices.alerts {
+		if alert.RuleFk != ruleID || alert.DeviceFk != deviceID || alert.State == AlertResolved {
+			continue
+		}
+		alert.State = AlertResolved
+		alert.ResolvedAt = sql.NullInt64{Int64: at, Valid: true}
+		repo.devices.alerts[i] = alert
+		return repo.withNames(alert), nil
+	}
+	return Alert{}, NewRepositoryError(NotFound, "no matching rows", "failed to resolve the alert")
+}
@@ -0,0 +1,48 @@
+package repository
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+/*
+MemoryArchiveRepository moves the measurements of a device into a slice,
+standing in for the archive db file.
+*/
+type MemoryArchiveRepository struct {
+	mutex    sync.Mutex
+	devices  *MemoryDeviceRepository
+	archived map[string][]NewMeasurement
+}
+
+func NewMemoryArchiveRepository(devices *MemoryDeviceRepository) *MemoryArchiveRepository {
+	return &MemoryArchiveRepository{devices: devices, archived: map[string][]NewMeasurement{}}
+}
+
+func (repo *MemoryArchiveRepository) Archive(ctx context.Context, serialId string, change StatusChange) (int64, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	device, err := repo.devices.GetBySerial(ctx, serialId)
+	if err != nil {
+		return 0, err
+	}
+
+	measurements := repo.devices.measurements
+	measurements.mutex.Lock()
+	var archived int64
+	measurements.measurements = slices.DeleteFunc(measurements.measurements, func(measurement Measurement) bool {
+		fromAccessory := measurement.AccessoryFk.Valid && uint(measurement.AccessoryFk.Int64) == device.ID
+		if measurement.PublishingDeviceFk != device.ID && !fromAccessory {
+			return false
+		}
+		repo.archived[serialId] = append(repo.archived[serialId], measurement.NewMeasurement)
+		archived++
+		return true
+	})
+	measurements.mutex.Unlock()
+
+	_, err = repo.devices.Decommission(ctx, serialId, change)
+	return archived, err
+}
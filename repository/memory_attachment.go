@@ -0,0 +1,110 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+)
+
+// MemoryAttachmentRepository keeps the attachments in the MemoryDeviceRepository, so deletes and status changes reach them
+type MemoryAttachmentRepository struct {
+	devices *MemoryDeviceRepository
+}
+
+func NewMemoryAttachmentRepository(devices *MemoryDeviceRepository) *MemoryAttachmentRepository {
+	return &MemoryAttachmentRepository{devices}
+}
+
+// withSerials fills the serial ids of the attachment, the lock must be held
+func (repo *MemoryAttachmentRepository) withSerials(attachment Attachment) Attachment {
+	attachment.AccessorySerial = repo.devices.devices[attachment.AccessoryFk].SerialId
+	attachment.ParentSerial = repo.devices.devices[attachment.ParentFk].SerialId
+	return attachment
+}
+
+func (repo *MemoryAttachmentRepository) Attach(_ context.Context, parentID, accessoryID uint, change AttachmentChange) (Attachment, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	for _, attachment := range repo.devices.attachments {
+		if attachment.AccessoryFk == accessoryID && !attachment.DetachedAt.Valid {
+			return Attachment{}, NewRepositoryError(AlreadyExists, "unique constraint failed", "failed to attach the accessory")
+		}
+	}
+
+	repo.devices.lastAttachmentID++
+	attachment := Attachment{
+		ID:          repo.devices.lastAttachmentID,
+		AccessoryFk: accessoryID,
+		ParentFk:    parentID,
+		AttachedAt:  change.At,
+		AttachedBy:  change.Actor,
+	}
+	repo.devices.attachments = append(repo.devices.attachments, attachment)
+	return repo.withSerials(attachment), nil
+}
+
+func (repo *MemoryAttachmentRepository) Detach(_ context.Context, accessoryID uint, change AttachmentChange) (Attachment, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	for i, attachment := range repo.devices.attachments {
+		if attachment.AccessoryFk != accessoryID || attachment.DetachedAt.Valid {
+			continue
+		}
+		attachment.DetachedAt = sql.NullInt64{Int64: change.At, Valid: true}
+		attachment.DetachedBy = sql.NullString{String: change.Actor, Valid: true}
+		repo.devices.attachments[i] = attachment
+		return repo.withSerials(attachment), nil
+	}
+	return Attachment{}, NewRepositoryError(NotFound, "no matching rows", "failed to detach the accessory")
+}
+
+func (repo *MemoryAttachmentRepository) Parent(_ context.Context, accessoryID uint) (Device, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	for _, attachment := range repo.devices.attachments {
+		if attachment.AccessoryFk == accessoryID && !attachment.DetachedAt.Valid {
+			return repo.devices.devices[attachment.ParentFk], nil
+		}
+	}
+	return Device{}, NewRepositoryError(NotFound, "no matching rows", "failed to get the parent of the accessory")
+}
+
+func (repo *MemoryAttachmentRepository) Accessories(_ context.Context, parentID uint) ([]Device, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	accessories := []Device{}
+	for _, attachment := range repo.devices.attachments {
+		if attachment.ParentFk == parentID && !attachment.DetachedAt.Valid {
+			accessories = append(accessories, repo.devices.devices[attachment.AccessoryFk])
+		}
+	}
+	sort.Slice(accessories, func(i, j int) bool { return accessories[i].ID < accessories[j].ID })
+	return accessories, nil
+}
+
+func (repo *MemoryAttachmentRepository) History(_ context.Context, deviceID uint, from, to int64) ([]Attachment, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	attachments := []Attachment{}
+	for _, attachment := range repo.devices.attachments {
+		if attachment.AccessoryFk != deviceID && attachment.ParentFk != deviceID {
+			continue
+		}
+		if attachment.AttachedAt > to || (attachment.DetachedAt.Valid && attachment.DetachedAt.Int64 < from) {
+			continue
+		}
+		attachments = append(attachments, repo.withSerials(attachment))
+	}
+	sort.SliceStable(attachments, func(i, j int) bool {
+		if attachments[i].AttachedAt != attachments[j].AttachedAt {
+			return attachments[i].AttachedAt < attachments[j].AttachedAt
+		}
+		return attachments[i].ID < attachments[j].ID
+	})
+	return attachments, nil
+}
@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+)
+
+// MemoryClaimCodeRepository keeps the claim codes in the MemoryDeviceRepository, so deleting a device type reaches them
+type MemoryClaimCodeRepository struct {
+	devices *MemoryDeviceRepository
+}
+
+func NewMemoryClaimCodeRepository(devices *MemoryDeviceRepository) *MemoryClaimCodeRepository {
+	return &MemoryClaimCodeRepository{devices}
+}
+
+func (repo *MemoryClaimCodeRepository) Create(_ context.Context, code NewClaimCode) (ClaimCode, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	for _, existing := range repo.devices.claimCodes {
+		if existing.CodeHash == code.CodeHash {
+			return ClaimCode{}, NewRepositoryError(AlreadyExists, "unique constraint failed", "failed to create the claim code")
+		}
+	}
+
+	repo.devices.lastClaimCodeID++
+	created := ClaimCode{ID: repo.devices.lastClaimCodeID, NewClaimCode: code}
+	repo.devices.claimCodes = append(repo.devices.claimCodes, created)
+	return created, nil
+}
+
+func (repo *MemoryClaimCodeRepository) List(_ context.Context) ([]ClaimCode, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	return append([]ClaimCode{}, repo.devices.claimCodes...), nil
+}
+
+func (repo *MemoryClaimCodeRepository) Revoke(_ context.Context, id uint, at int64) (ClaimCode, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	for i, code := range repo.devices.claimCodes {
+		if code.ID == id && !code.ClaimedAt.Valid && !code.RevokedAt.Valid && code.ExpiresAt > at {
+			repo.devices.claimCodes[i].RevokedAt = sql.NullInt64{Int64: at, Valid: true}
+			return repo.devices.claimCodes[i], nil
+		}
+	}
+	return ClaimCode{}, NewRepositoryError(NotFound, "no matching rows", "failed to revoke the claim code")
+}
+
+func (repo *MemoryClaimCodeRepository) Claim(_ context.Context, codeHash, serialId string, at int64) (ClaimCode, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	for i, code := range repo.devices.claimCodes {
+		if code.CodeHash == codeHash && code.UsableAt(at) {
+			repo.devices.claimCodes[i].ClaimedAt = sql.NullInt64{Int64: at, Valid: true}
+			repo.devices.claimCodes[i].ClaimedBy = sql.NullString{String: serialId, Valid: true}
+			return repo.devices.claimCodes[i], nil
+		}
+	}
+	return ClaimCode{}, NewRepositoryError(NotFound, "no matching rows", "failed to claim the code")
+}
+
+func (repo *MemoryClaimCodeRepository) Release(_ context.Context, id uint) error {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	for i, code := range repo.devices.claimCodes {
+		if code.ID == id {
+			repo.devices.claimCodes[i].ClaimedAt = sql.NullInt64{}
+			repo.devices.claimCodes[i].ClaimedBy = sql.NullString{}
+		}
+	}
+	return nil
+}
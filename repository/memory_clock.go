@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"context"
+	"sort"
+)
+
+// MemoryClockRepository keeps the clocks in the MemoryDeviceRepository, so deleting a device reaches its clock
+type MemoryClockRepository struct {
+	devices *MemoryDeviceRepository
+}
+
+func NewMemoryClockRepository(devices *MemoryDeviceRepository) *MemoryClockRepository {
+	return &MemoryClockRepository{devices}
+}
+
+func (repo *MemoryClockRepository) Record(_ context.Context, clock DeviceClock) (DeviceClock, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	device, found := repo.devices.devices[clock.DeviceFk]
+	if !found {
+		return DeviceClock{}, NewRepositoryError(ConstraintFailed, "foreign key constraint failed", "failed to record the clock of the device")
+	}
+	clock.SerialId = device.SerialId
+	clock.Samples = repo.devices.clocks[clock.DeviceFk].Samples + 1
+	repo.devices.clocks[clock.DeviceFk] = clock
+	return clock, nil
+}
+
+func (repo *MemoryClockRepository) Get(_ context.Context, deviceID uint) (DeviceClock, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	if clock, found := repo.devices.clocks[deviceID]; found {
+		return clock, nil
+	}
+	return DeviceClock{}, NewRepositoryError(NotFound, "no matching rows", "failed to get the clock of the device")
+}
+
+func (repo *MemoryClockRepository) List(_ context.Context) ([]DeviceClock, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	clocks := make([]DeviceClock, 0, len(repo.devices.clocks))
+	for _, clock := range repo.devices.clocks {
+		clocks = append(clocks, clock)
+	}
+	sort.Slice(clocks, func(i, j int) bool { return clocks[i].SerialId < clocks[j].SerialId })
+	return clocks, nil
+}
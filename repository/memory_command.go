@@ -0,0 +1,170 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// MemoryCommandRepository keeps the commands in the MemoryDeviceRepository, so deleting a device reaches them
+type MemoryCommandRepository struct {
+	devices *MemoryDeviceRepository
+}
+
+func NewMemoryCommandRepository(devices *MemoryDeviceRepository) *MemoryCommandRepository {
+	return &MemoryCommandRepository{devices}
+}
+
+// record adds the change to the history of the command, the caller holds the lock
+func (repo *MemoryCommandRepository) record(id uint, old *CommandStatus, change CommandChange) {
+	repo.devices.lastCommandHistoryID++
+	repo.devices.commandHistory = append(repo.devices.commandHistory, CommandHistoryEntry{
+		ID:        repo.devices.lastCommandHistoryID,
+		CommandFk: id,
+		OldStatus: old,
+		NewStatus: change.Status,
+		Actor:     change.Actor,
+		Detail:    change.Detail,
+		ChangedAt: change.At,
+	})
+}
+
+func (repo *MemoryCommandRepository) Create(_ context.Context, command NewCommand) (Command, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	if _, found := repo.devices.devices[command.DeviceFk]; !found {
+		return Command{}, NewRepositoryError(ConstraintFailed, "foreign key constraint failed", "failed to create the command")
+	}
+
+	repo.devices.lastCommandID++
+	created := Command{ID: repo.devices.lastCommandID, NewCommand: command, Status: Queued}
+	repo.devices.commands = append(repo.devices.commands, created)
+	repo.record(created.ID, nil, CommandChange{Status: Queued, Actor: command.CreatedBy, At: command.CreatedAt})
+	return created, nil
+}
+
+func (repo *MemoryCommandRepository) Get(_ context.Context, id uint) (Command, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	for _, command := range repo.devices.commands {
+		if command.ID == id {
+			return command, nil
+		}
+	}
+	return Command{}, NewRepositoryError(NotFound, "no matching rows", "failed to get the command")
+}
+
+func (repo *MemoryCommandRepository) List(_ context.Context, query CommandQuery) ([]Command, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	commands := []Command{}
+	for _, command := range repo.devices.commands {
+		if command.DeviceFk == query.DeviceID && (len(query.Statuses) == 0 || slices.Contains(query.Statuses, command.Status)) {
+			commands = append(commands, command)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].ID > commands[j].ID })
+	if query.Limit > 0 && uint(len(commands)) > query.Limit {
+		commands = commands[:query.Limit]
+	}
+	return commands, nil
+}
+
+func (repo *MemoryCommandRepository) Deliver(_ context.Context, deviceID uint, actor string, at, redeliverBefore int64) ([]Command, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	delivered := []Command{}
+	for i, command := range repo.devices.commands {
+		redelivery := command.Status == Delivered && command.DeliveredAt.Int64 <= redeliverBefore &&
+			command.Attempts < command.MaxAttempts
+		if command.DeviceFk != deviceID || command.ExpiresAt <= at || (command.Status != Queued && !redelivery) {
+			continue
+		}
+
+		old := command.Status
+		command.Status = Delivered
+		command.Attempts++
+		command.DeliveredAt = sql.NullInt64{Int64: at, Valid: true}
+		repo.devices.commands[i] = command
+		repo.record(command.ID, &old, CommandChange{
+			Status: Delivered,
+			Actor:  actor,
+			Detail: sql.NullString{String: fmt.Sprintf("attempt %d", command.Attempts), Valid: true},
+			At:     at,
+		})
+		delivered = append(delivered, command)
+	}
+	return delivered, nil
+}
+
+func (repo *MemoryCommandRepository) Change(_ context.Context, id uint, from []CommandStatus, change CommandChange) (Command, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	for i, command := range repo.devices.commands {
+		if command.ID != id || !slices.Contains(from, command.Status) {
+			continue
+		}
+
+		old := command.Status
+		command.Status = change.Status
+		if change.Result != nil {
+			command.Result = change.Result
+		}
+		command.CompletedAt = sql.NullInt64{}
+		if change.Status.Final() {
+			command.CompletedAt = sql.NullInt64{Int64: change.At, Valid: true}
+		}
+		repo.devices.commands[i] = command
+		repo.record(id, &old, change)
+		return command, nil
+	}
+	return Command{}, NewRepositoryError(NotFound, "no matching rows", "failed to change the command status")
+}
+
+func (repo *MemoryCommandRepository) Sweep(_ context.Context, at, redeliverBefore int64) (int64, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	changed := int64(0)
+	for i, command := range repo.devices.commands {
+		change := CommandChange{Actor: SystemActor, At: at}
+		switch {
+		case !command.Status.Final() && command.ExpiresAt <= at:
+			change.Status = Expired
+			change.Detail = sql.NullString{String: "not done with before its expiry", Valid: true}
+		case command.Status == Delivered && command.Attempts >= command.MaxAttempts && command.DeliveredAt.Int64 <= redeliverBefore:
+			change.Status = Failed
+			change.Detail = sql.NullString{String: fmt.Sprintf("not acknowledged after %d attempts", command.Attempts), Valid: true}
+		default:
+			continue
+		}
+
+		old := command.Status
+		command.Status = change.Status
+		command.CompletedAt = sql.NullInt64{Int64: at, Valid: true}
+		repo.devices.commands[i] = command
+		repo.record(command.ID, &old, change)
+		changed++
+	}
+	return changed, nil
+}
+
+func (repo *MemoryCommandRepository) History(_ context.Context, id uint) ([]CommandHistoryEntry, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	entries := []CommandHistoryEntry{}
+	for _, entry := range repo.devices.commandHistory {
+		if entry.CommandFk == id {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
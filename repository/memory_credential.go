@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+)
+
+// MemoryCredentialRepository keeps the credentials in the MemoryDeviceRepository, so deletes reach them
+type MemoryCredentialRepository struct {
+	devices *MemoryDeviceRepository
+}
+
+func NewMemoryCredentialRepository(devices *MemoryDeviceRepository) *MemoryCredentialRepository {
+	return &MemoryCredentialRepository{devices}
+}
+
+func (repo *MemoryCredentialRepository) Rotate(_ context.Context, deviceID uint, keyHash string, at, graceUntil int64) (Credential, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	if _, found := repo.devices.devices[deviceID]; !found {
+		return Credential{}, NewRepositoryError(ConstraintFailed, "foreign key constraint failed", "failed to rotate the credentials")
+	}
+
+	for i, credential := range repo.devices.credentials {
+		if credential.DeviceFk == deviceID && credential.ValidAt(graceUntil) {
+			repo.devices.credentials[i].ExpiresAt = sql.NullInt64{Int64: graceUntil, Valid: true}
+		}
+	}
+
+	repo.devices.lastCredentialID++
+	credential := Credential{ID: repo.devices.lastCredentialID, DeviceFk: deviceID, KeyHash: keyHash, CreatedAt: at}
+	repo.devices.credentials = append(repo.devices.credentials, credential)
+	return credential, nil
+}
+
+func (repo *MemoryCredentialRepository) Valid(_ context.Context, deviceID uint, at int64) ([]Credential, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	credentials := []Credential{}
+	for _, credential := range slices.Backward(repo.devices.credentials) {
+		if credential.DeviceFk == deviceID && credential.ValidAt(at) {
+			credentials = append(credentials, credential)
+		}
+	}
+	return credentials, nil
+}
+
+func (repo *MemoryCredentialRepository) List(_ context.Context, deviceID uint) ([]Credential, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	credentials := []Credential{}
+	for _, credential := range repo.devices.credentials {
+		if credential.DeviceFk == deviceID {
+			credentials = append(credentials, credential)
+		}
+	}
+	return credentials, nil
+}
+
+func (repo *MemoryCredentialRepository) Revoke(_ context.Context, deviceID uint, at int64) (int64, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	var revoked int64
+	for i, credential := range repo.devices.credentials {
+		// Same as sqlite, the credentials not yet created are revoked too
+		expired := credential.ExpiresAt.Valid && credential.ExpiresAt.Int64 <= at
+		if credential.DeviceFk == deviceID && !credential.RevokedAt.Valid && !expired {
+			repo.devices.credentials[i].RevokedAt = sql.NullInt64{Int64: at, Valid: true}
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+func (repo *MemoryCredentialRepository) Keys(_ context.Context) ([]Credential, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	return slices.Clone(repo.devices.credentials), nil
+}
+
+func (repo *MemoryCredentialRepository) ReplaceKey(_ context.Context, id uint, keyHash string) error {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	for i, credential := range repo.devices.credentials {
+		if credential.ID == id {
+			repo.devices.credentials[i].KeyHash = keyHash
+			return nil
+		}
+	}
+	return NewRepositoryError(NotFound, "no matching rows", "failed to replace the credential key")
+}
@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// BuiltinDeviceTypes are the types every registry starts with, as seeded by the migrations
+func BuiltinDeviceTypes() []DeviceTypeDefinition {
+	return []DeviceTypeDefinition{
+		{ID: PMD, NewDeviceType: NewDeviceType{
+			Name: "pmd", Role: PMDRole, SerialPattern: "^.{6,}$", ValueTypes: ValueTypes{},
+			Description: sql.NullString{String: "Built-in PMD type", Valid: true},
+		}},
+		{ID: Accessory, NewDeviceType: NewDeviceType{
+			Name: "accessory", Role: AccessoryRole, SerialPattern: "^.{6,}$", ValueTypes: ValueTypes{},
+			Description: sql.NullString{String: "Built-in accessory type", Valid: true},
+		}},
+	}
+}
+
+// MemoryDeviceTypeRepository keeps the device types in a map, checking the devices of the MemoryDeviceRepository before deleting
+type MemoryDeviceTypeRepository struct {
+	mutex       sync.RWMutex
+	lastID      DeviceType
+	deviceTypes map[DeviceType]DeviceTypeDefinition
+	devices     *MemoryDeviceRepository
+}
+
+func NewMemoryDeviceTypeRepository(devices *MemoryDeviceRepository) *MemoryDeviceTypeRepository {
+	repo := &MemoryDeviceTypeRepository{deviceTypes: map[DeviceType]DeviceTypeDefinition{}, devices: devices}
+	for _, deviceType := range BuiltinDeviceTypes() {
+		repo.deviceTypes[deviceType.ID] = deviceType
+		repo.lastID = max(repo.lastID, deviceType.ID)
+	}
+	return repo
+}
+
+func (repo *MemoryDeviceTypeRepository) List(_ context.Context) ([]DeviceTypeDefinition, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	deviceTypes := make([]DeviceTypeDefinition, 0, len(repo.deviceTypes))
+	for _, deviceType := range repo.deviceTypes {
+		deviceTypes = append(deviceTypes, deviceType)
+	}
+	sort.Slice(deviceTypes, func(i, j int) bool { return deviceTypes[i].ID < deviceTypes[j].ID })
+	return deviceTypes, nil
+}
+
+func (repo *MemoryDeviceTypeRepository) Create(_ context.Context, deviceType NewDeviceType) (DeviceTypeDefinition, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	for _, existing := range repo.deviceTypes {
+		if existing.Name == deviceType.Name {
+			return DeviceTypeDefinition{}, NewRepositoryError(AlreadyExists, "unique constraint failed", "failed to create the device type")
+		}
+	}
+
+	repo.lastID++
+	created := DeviceTypeDefinition{ID: repo.lastID, NewDeviceType: deviceType}
+	repo.deviceTypes[created.ID] = created
+	return created, nil
+}
+
+func (repo *MemoryDeviceTypeRepository) Update(_ context.Context, deviceType DeviceTypeDefinition) (DeviceTypeDefinition, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	existing, found := repo.deviceTypes[deviceType.ID]
+	if !found {
+		return DeviceTypeDefinition{}, NewRepositoryError(NotFound, "no matching rows", "failed to update the device type")
+	}
+	deviceType.Name, deviceType.Role = existing.Name, existing.Role
+	repo.deviceTypes[deviceType.ID] = deviceType
+	return deviceType, nil
+}
+
+func (repo *MemoryDeviceTypeRepository) Delete(_ context.Context, id DeviceType) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	if _, found := repo.deviceTypes[id]; !found {
+		return NewRepositoryError(NotFound, "no matching rows", "failed to delete the device type")
+	}
+
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+	for _, device := range repo.devices.devices {
+		if device.DeviceType == id {
+			return NewRepositoryError(InUse, "devices have the type", "failed to delete the device type")
+		}
+	}
+	for _, firmware := range repo.devices.firmware {
+		if firmware.DeviceType == id {
+			return NewRepositoryError(InUse, "firmware targets the type", "failed to delete the device type")
+		}
+	}
+	for _, rule := range repo.devices.alertRules {
+		if rule.DeviceType.Valid && DeviceType(rule.DeviceType.Int64) == id {
+			return NewRepositoryError(InUse, "alert rules target the type", "failed to delete the device type")
+		}
+	}
+	delete(repo.deviceTypes, id)
+	// Same as the cascade of sqlite, the claim codes go with their type
+	repo.devices.claimCodes = slices.DeleteFunc(repo.devices.claimCodes, func(code ClaimCode) bool {
+		return code.DeviceType == id
+	})
+	delete(repo.devices.shadowTemplates, id)
+	return nil
+}
@@ -0,0 +1,245 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"sort"
+)
+
+// MemoryFirmwareRepository keeps the firmware in the MemoryDeviceRepository, so deleting a device reaches its rollouts
+type MemoryFirmwareRepository struct {
+	devices *MemoryDeviceRepository
+}
+
+func NewMemoryFirmwareRepository(devices *MemoryDeviceRepository) *MemoryFirmwareRepository {
+	return &MemoryFirmwareRepository{devices}
+}
+
+func (repo *MemoryFirmwareRepository) Create(_ context.Context, firmware NewFirmware) (Firmware, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	for _, existing := range repo.devices.firmware {
+		if existing.DeviceType == firmware.DeviceType && existing.Version == firmware.Version {
+			return Firmware{}, NewRepositoryError(AlreadyExists, "unique constraint failed", "failed to create the firmware")
+		}
+	}
+	repo.devices.lastFirmwareID++
+	created := Firmware{ID: repo.devices.lastFirmwareID, NewFirmware: firmware}
+	repo.devices.firmware = append(repo.devices.firmware, created)
+	return created, nil
+}
+
+func (repo *MemoryFirmwareRepository) Get(_ context.Context, id uint) (Firmware, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	for _, firmware := range repo.devices.firmware {
+		if firmware.ID == id {
+			return firmware, nil
+		}
+	}
+	return Firmware{}, NewRepositoryError(NotFound, "no matching rows", "failed to get the firmware")
+}
+
+func (repo *MemoryFirmwareRepository) List(_ context.Context) ([]Firmware, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	firmware := append([]Firmware{}, repo.devices.firmware...)
+	sort.SliceStable(firmware, func(i, j int) bool {
+		if firmware[i].DeviceType != firmware[j].DeviceType {
+			return firmware[i].DeviceType < firmware[j].DeviceType
+		}
+		return firmware[i].UploadedAt > firmware[j].UploadedAt
+	})
+	return firmware, nil
+}
+
+func (repo *MemoryFirmwareRepository) Delete(_ context.Context, id uint) error {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	index := slices.IndexFunc(repo.devices.firmware, func(firmware Firmware) bool { return firmware.ID == id })
+	if index < 0 {
+		return NewRepositoryError(NotFound, "no matching rows", "failed to delete the firmware")
+	}
+	rollouts := []uint{}
+	for _, rollout := range repo.devices.rollouts {
+		if rollout.FirmwareFk != id {
+			continue
+		}
+		if !rollout.Status.Final() {
+			return NewRepositoryError(InUse, "a rollout of the firmware is in progress", "failed to delete the firmware")
+		}
+		rollouts = append(rollouts, rollout.ID)
+	}
+
+	// Same as the delete of sqlite, the rollouts go with their firmware
+	repo.devices.rolloutDevices = slices.DeleteFunc(repo.devices.rolloutDevices, func(device RolloutDevice) bool {
+		return slices.Contains(rollouts, device.RolloutFk)
+	})
+	repo.devices.rollouts = slices.DeleteFunc(repo.devices.rollouts, func(rollout Rollout) bool {
+		return rollout.FirmwareFk == id
+	})
+	repo.devices.firmware = slices.Delete(repo.devices.firmware, index, index+1)
+	return nil
+}
+
+// counted fills what sqlite reads with the rollout, the caller holds the lock
+func (repo *MemoryFirmwareRepository) counted(rollout Rollout) Rollout {
+	for _, firmware := range repo.devices.firmware {
+		if firmware.ID == rollout.FirmwareFk {
+			rollout.DeviceType = firmware.DeviceType
+			rollout.Version = firmware.Version
+		}
+	}
+	rollout.Devices, rollout.Installed, rollout.Failed = 0, 0, 0
+	for _, device := range repo.devices.rolloutDevices {
+		if device.RolloutFk != rollout.ID {
+			continue
+		}
+		rollout.Devices++
+		switch device.Status {
+		case UpdateInstalled:
+			rollout.Installed++
+		case UpdateFailed:
+			rollout.Failed++
+		}
+	}
+	return rollout
+}
+
+// withSerial fills the serial id of the device, the caller holds the lock
+func (repo *MemoryFirmwareRepository) withSerial(device RolloutDevice) RolloutDevice {
+	device.SerialId = repo.devices.devices[device.DeviceFk].SerialId
+	return device
+}
+
+func (repo *MemoryFirmwareRepository) CreateRollout(_ context.Context, rollout NewRollout, devices []uint) (Rollout, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	if !slices.ContainsFunc(repo.devices.firmware, func(firmware Firmware) bool { return firmware.ID == rollout.FirmwareFk }) {
+		return Rollout{}, NewRepositoryError(ConstraintFailed, "foreign key constraint failed", "failed to create the rollout")
+	}
+	repo.devices.lastRolloutID++
+	created := Rollout{ID: repo.devices.lastRolloutID, NewRollout: rollout, Status: RolloutActive}
+	repo.devices.rollouts = append(repo.devices.rollouts, created)
+	for _, device := range devices {
+		if !slices.ContainsFunc(repo.devices.rolloutDevices, func(existing RolloutDevice) bool {
+			return existing.RolloutFk == created.ID && existing.DeviceFk == device
+		}) {
+			repo.devices.rolloutDevices = append(repo.devices.rolloutDevices, RolloutDevice{
+				RolloutFk: created.ID, DeviceFk: device, Status: UpdatePending, UpdatedAt: rollout.CreatedAt,
+			})
+		}
+	}
+	return repo.counted(created), nil
+}
+
+func (repo *MemoryFirmwareRepository) GetRollout(_ context.Context, id uint) (Rollout, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	for _, rollout := range repo.devices.rollouts {
+		if rollout.ID == id {
+			return repo.counted(rollout), nil
+		}
+	}
+	return Rollout{}, NewRepositoryError(NotFound, "no matching rows", "failed to get the rollout")
+}
+
+func (repo *MemoryFirmwareRepository) ListRollouts(_ context.Context) ([]Rollout, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	rollouts := make([]Rollout, 0, len(repo.devices.rollouts))
+	for i := len(repo.devices.rollouts) - 1; i >= 0; i-- {
+		rollouts = append(rollouts, repo.counted(repo.devices.rollouts[i]))
+	}
+	return rollouts, nil
+}
+
+func (repo *MemoryFirmwareRepository) ChangeRollout(_ context.Context, id uint, from []RolloutStatus, change RolloutChange) (Rollout, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	for i, rollout := range repo.devices.rollouts {
+		if rollout.ID != id || !slices.Contains(from, rollout.Status) {
+			continue
+		}
+		rollout.Status = change.Status
+		rollout.ChangedBy = sql.NullString{String: change.Actor, Valid: true}
+		rollout.ChangedAt = sql.NullInt64{Int64: change.At, Valid: true}
+		rollout.Reason = change.Reason
+		repo.devices.rollouts[i] = rollout
+		return repo.counted(rollout), nil
+	}
+	return Rollout{}, NewRepositoryError(NotFound, "no matching rows", "failed to change the rollout")
+}
+
+func (repo *MemoryFirmwareRepository) RolloutDevices(_ context.Context, id uint) ([]RolloutDevice, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	devices := []RolloutDevice{}
+	for _, device := range repo.devices.rolloutDevices {
+		if device.RolloutFk == id {
+			devices = append(devices, repo.withSerial(device))
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].SerialId < devices[j].SerialId })
+	return devices, nil
+}
+
+func (repo *MemoryFirmwareRepository) GetRolloutDevice(_ context.Context, rolloutID, deviceID uint) (RolloutDevice, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	for _, device := range repo.devices.rolloutDevices {
+		if device.RolloutFk == rolloutID && device.DeviceFk == deviceID {
+			return repo.withSerial(device), nil
+		}
+	}
+	return RolloutDevice{}, NewRepositoryError(NotFound, "no matching rows", "failed to get the device of the rollout")
+}
+
+func (repo *MemoryFirmwareRepository) AddRolloutDevice(
+	_ context.Context, rolloutID, deviceID uint, status UpdateStatus, at int64,
+) (RolloutDevice, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	if _, found := repo.devices.devices[deviceID]; !found {
+		return RolloutDevice{}, NewRepositoryError(ConstraintFailed, "foreign key constraint failed", "failed to add the device to the rollout")
+	}
+	for _, device := range repo.devices.rolloutDevices {
+		if device.RolloutFk == rolloutID && device.DeviceFk == deviceID {
+			return RolloutDevice{}, NewRepositoryError(AlreadyExists, "the device is in the rollout", "failed to add the device to the rollout")
+		}
+	}
+	added := RolloutDevice{RolloutFk: rolloutID, DeviceFk: deviceID, Status: status, UpdatedAt: at}
+	repo.devices.rolloutDevices = append(repo.devices.rolloutDevices, added)
+	return repo.withSerial(added), nil
+}
+
+func (repo *MemoryFirmwareRepository) ChangeRolloutDevice(
+	_ context.Context, rolloutID, deviceID uint, from []UpdateStatus, status UpdateStatus, detail sql.NullString, at int64,
+) (RolloutDevice, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	for i, device := range repo.devices.rolloutDevices {
+		if device.RolloutFk != rolloutID || device.DeviceFk != deviceID || !slices.Contains(from, device.Status) {
+			continue
+		}
+		device.Status = status
+		device.Detail = detail
+		device.UpdatedAt = at
+		repo.devices.rolloutDevices[i] = device
+		return repo.withSerial(device), nil
+	}
+	return RolloutDevice{}, NewRepositoryError(NotFound, "no matching rows", "failed to change the device of the rollout")
+}
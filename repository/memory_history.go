@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"context"
+	"sort"
+)
+
+// MemoryStatusHistoryRepository reads the status history kept by a MemoryDeviceRepository
+type MemoryStatusHistoryRepository struct {
+	devices *MemoryDeviceRepository
+}
+
+func NewMemoryStatusHistoryRepository(devices *MemoryDeviceRepository) *MemoryStatusHistoryRepository {
+	return &MemoryStatusHistoryRepository{devices}
+}
+
+// sorted returns the history of the device, ordered as the sqlite queries order it
+func (repo *MemoryStatusHistoryRepository) sorted(deviceID uint) []StatusHistoryEntry {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	entries := []StatusHistoryEntry{}
+	for _, entry := range repo.devices.history {
+		if entry.DeviceFk == deviceID {
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].ChangedAt != entries[j].ChangedAt {
+			return entries[i].ChangedAt < entries[j].ChangedAt
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries
+}
+
+func (repo *MemoryStatusHistoryRepository) List(_ context.Context, query StatusHistoryQuery) ([]StatusHistoryEntry, error) {
+	entries := []StatusHistoryEntry{}
+	for _, entry := range repo.sorted(query.DeviceID) {
+		if entry.ChangedAt >= query.From && entry.ChangedAt <= query.To {
+			entries = append(entries, entry)
+		}
+	}
+	if query.Limit > 0 && uint(len(entries)) > query.Limit {
+		entries = entries[:query.Limit]
+	}
+	return entries, nil
+}
+
+func (repo *MemoryStatusHistoryRepository) Before(_ context.Context, deviceID uint, at int64) (StatusHistoryEntry, error) {
+	entries := repo.sorted(deviceID)
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].ChangedAt < at {
+			return entries[i], nil
+		}
+	}
+	return StatusHistoryEntry{}, NewRepositoryError(NotFound, "no matching rows", "failed to get the status before the date")
+}
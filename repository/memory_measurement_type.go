@@ -0,0 +1,120 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+)
+
+// BuiltinMeasurementTypes are the types every registry starts with, as seeded by the migrations
+func BuiltinMeasurementTypes() []MeasurementTypeDefinition {
+	return []MeasurementTypeDefinition{
+		{ID: GenericValueType, NewMeasurementType: NewMeasurementType{
+			Name: "generic", Encoding: FloatEncoding,
+			Description: sql.NullString{String: "Built-in type, for the measurements published without one", Valid: true},
+		}},
+	}
+}
+
+/*
+MemoryMeasurementTypeRepository keeps the measurement types in a map, checking the
+MemoryMeasurementRepository, and the alert rules of the MemoryDeviceRepository, before deleting.
+*/
+type MemoryMeasurementTypeRepository struct {
+	mutex            sync.RWMutex
+	lastID           uint
+	measurementTypes map[uint]MeasurementTypeDefinition
+	measurements     *MemoryMeasurementRepository
+	devices          *MemoryDeviceRepository
+}
+
+func NewMemoryMeasurementTypeRepository(
+	measurements *MemoryMeasurementRepository, devices *MemoryDeviceRepository,
+) *MemoryMeasurementTypeRepository {
+	repo := &MemoryMeasurementTypeRepository{
+		measurementTypes: map[uint]MeasurementTypeDefinition{},
+		measurements:     measurements,
+		devices:          devices,
+	}
+	for _, measurementType := range BuiltinMeasurementTypes() {
+		repo.measurementTypes[measurementType.ID] = measurementType
+		repo.lastID = max(repo.lastID, measurementType.ID)
+	}
+	return repo
+}
+
+func (repo *MemoryMeasurementTypeRepository) List(_ context.Context) ([]MeasurementTypeDefinition, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	measurementTypes := make([]MeasurementTypeDefinition, 0, len(repo.measurementTypes))
+	for _, measurementType := range repo.measurementTypes {
+		measurementTypes = append(measurementTypes, measurementType)
+	}
+	sort.Slice(measurementTypes, func(i, j int) bool { return measurementTypes[i].ID < measurementTypes[j].ID })
+	return measurementTypes, nil
+}
+
+func (repo *MemoryMeasurementTypeRepository) Create(_ context.Context, measurementType NewMeasurementType) (MeasurementTypeDefinition, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	for _, existing := range repo.measurementTypes {
+		if existing.Name == measurementType.Name {
+			return MeasurementTypeDefinition{}, NewRepositoryError(AlreadyExists, "unique constraint failed", "failed to create the measurement type")
+		}
+	}
+
+	repo.lastID++
+	created := MeasurementTypeDefinition{ID: repo.lastID, NewMeasurementType: measurementType}
+	repo.measurementTypes[created.ID] = created
+	return created, nil
+}
+
+func (repo *MemoryMeasurementTypeRepository) Update(_ context.Context, measurementType MeasurementTypeDefinition) (MeasurementTypeDefinition, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	existing, found := repo.measurementTypes[measurementType.ID]
+	if !found {
+		return MeasurementTypeDefinition{}, NewRepositoryError(NotFound, "no matching rows", "failed to update the measurement type")
+	}
+	measurementType.Name, measurementType.Encoding = existing.Name, existing.Encoding
+	repo.measurementTypes[measurementType.ID] = measurementType
+	return measurementType, nil
+}
+
+func (repo *MemoryMeasurementTypeRepository) Delete(_ context.Context, id uint) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	if _, found := repo.measurementTypes[id]; !found {
+		return NewRepositoryError(NotFound, "no matching rows", "failed to delete the measurement type")
+	}
+
+	// Locked before the measurements, like when deleting a device
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+	repo.measurements.mutex.RLock()
+	defer repo.measurements.mutex.RUnlock()
+	for _, measurement := range repo.measurements.measurements {
+		if measurement.ValueType == id {
+			return NewRepositoryError(InUse, "measurements have the type", "failed to delete the measurement type")
+		}
+	}
+	for _, rollups := range repo.measurements.rollups {
+		for _, rollup := range rollups {
+			if rollup.ValueType == id {
+				return NewRepositoryError(InUse, "measurements have the type", "failed to delete the measurement type")
+			}
+		}
+	}
+	for _, rule := range repo.devices.alertRules {
+		if rule.ValueType.Valid && uint(rule.ValueType.Int64) == id {
+			return NewRepositoryError(InUse, "alert rules target the type", "failed to delete the measurement type")
+		}
+	}
+	delete(repo.measurementTypes, id)
+	return nil
+}
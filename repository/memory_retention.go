@@ -0,0 +1,180 @@
+package repository
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+MemoryRetentionRepository aggregates the measurements held by a MemoryMeasurementRepository,
+storing the rollups in it, so they can be queried the same way the SQLite ones are.
+*/
+type MemoryRetentionRepository struct {
+	mutex        sync.Mutex
+	measurements *MemoryMeasurementRepository
+	watermarks   map[Resolution]int64
+}
+
+func NewMemoryRetentionRepository(measurements *MemoryMeasurementRepository) *MemoryRetentionRepository {
+	return &MemoryRetentionRepository{
+		measurements: measurements,
+		watermarks:   map[Resolution]int64{},
+	}
+}
+
+// rollupKey identifies the bucket a rollup aggregates
+type rollupKey struct {
+	device      uint
+	valueType   uint
+	bucketStart int64
+}
+
+func (repo *MemoryRetentionRepository) ValueTypes(_ context.Context) ([]uint, error) {
+	repo.measurements.mutex.RLock()
+	defer repo.measurements.mutex.RUnlock()
+
+	valueTypes := []uint{}
+	for _, measurement := range repo.measurements.measurements {
+		valueTypes = append(valueTypes, measurement.ValueType)
+	}
+	for _, rollups := range repo.measurements.rollups {
+		for _, rollup := range rollups {
+			valueTypes = append(valueTypes, rollup.ValueType)
+		}
+	}
+	slices.Sort(valueTypes)
+	return slices.Compact(valueTypes), nil
+}
+
+func (repo *MemoryRetentionRepository) RolledUntil(_ context.Context, resolution Resolution) (int64, bool, error) {
+	source, err := sourceResolution(resolution)
+	if err != nil {
+		return 0, false, err
+	}
+
+	repo.mutex.Lock()
+	until, found := repo.watermarks[resolution]
+	repo.mutex.Unlock()
+	if found {
+		return until, true, nil
+	}
+
+	repo.measurements.mutex.RLock()
+	defer repo.measurements.mutex.RUnlock()
+
+	found = false
+	var oldest int64
+	if source == RawResolution {
+		for _, measurement := range repo.measurements.measurements {
+			if !found || measurement.ReceivedAt < oldest {
+				oldest, found = measurement.ReceivedAt, true
+			}
+		}
+	} else {
+		for _, rollup := range repo.measurements.rollups[source] {
+			if !found || rollup.BucketStart < oldest {
+				oldest, found = rollup.BucketStart, true
+			}
+		}
+	}
+	return resolution.Floor(oldest), found, nil
+}
+
+func (repo *MemoryRetentionRepository) Rollup(_ context.Context, resolution Resolution, from, until int64) error {
+	source, err := sourceResolution(resolution)
+	if err != nil {
+		return err
+	}
+
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.measurements.mutex.Lock()
+	defer repo.measurements.mutex.Unlock()
+
+	// Source rows are turned into single sample rollups, so both resolutions merge the same way
+	sources := []Rollup{}
+	if source == RawResolution {
+		for _, measurement := range repo.measurements.measurements {
+			// Vectors aren't aggregated
+			if strings.HasPrefix(measurement.Value, "[") {
+				continue
+			}
+			// Same as sqlite's CAST AS REAL, a value that isn't a number counts as 0
+			value, _ := strconv.ParseFloat(measurement.Value, 64)
+			sources = append(sources, Rollup{
+				PublishingDeviceFk: measurement.PublishingDeviceFk,
+				ValueType:          measurement.ValueType,
+				BucketStart:        measurement.ReceivedAt,
+				Count:              1,
+				Min:                value,
+				Max:                value,
+				Sum:                value,
+			})
+		}
+	} else {
+		sources = repo.measurements.rollups[source]
+	}
+
+	rollups := repo.measurements.rollups[resolution]
+	indexes := map[rollupKey]int{}
+	for i, rollup := range rollups {
+		indexes[rollupKey{rollup.PublishingDeviceFk, rollup.ValueType, rollup.BucketStart}] = i
+	}
+
+	for _, row := range sources {
+		if row.BucketStart < from || row.BucketStart >= until {
+			continue
+		}
+		key := rollupKey{row.PublishingDeviceFk, row.ValueType, resolution.Floor(row.BucketStart)}
+		i, exists := indexes[key]
+		if !exists {
+			row.Resolution, row.BucketStart = resolution, key.bucketStart
+			indexes[key] = len(rollups)
+			rollups = append(rollups, row)
+			continue
+		}
+		rollups[i].Count += row.Count
+		rollups[i].Min = min(rollups[i].Min, row.Min)
+		rollups[i].Max = max(rollups[i].Max, row.Max)
+		rollups[i].Sum += row.Sum
+	}
+
+	repo.measurements.rollups[resolution] = rollups
+	repo.watermarks[resolution] = until
+	return nil
+}
+
+func (repo *MemoryRetentionRepository) DeleteBefore(
+	_ context.Context,
+	resolution Resolution,
+	valueType uint,
+	before int64,
+	limit uint,
+) (int64, error) {
+	repo.measurements.mutex.Lock()
+	defer repo.measurements.mutex.Unlock()
+
+	var deleted int64
+	if resolution == RawResolution {
+		repo.measurements.measurements = slices.DeleteFunc(repo.measurements.measurements, func(measurement Measurement) bool {
+			expired := uint(deleted) < limit && measurement.ValueType == valueType && measurement.ReceivedAt < before
+			if expired {
+				deleted++
+			}
+			return expired
+		})
+		return deleted, nil
+	}
+
+	repo.measurements.rollups[resolution] = slices.DeleteFunc(repo.measurements.rollups[resolution], func(rollup Rollup) bool {
+		expired := uint(deleted) < limit && rollup.ValueType == valueType && rollup.BucketStart < before
+		if expired {
+			deleted++
+		}
+		return expired
+	})
+	return deleted, nil
+}
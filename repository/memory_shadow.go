@@ -0,0 +1,112 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"maps"
+	"slices"
+)
+
+// MemoryShadowRepository keeps the shadows in the MemoryDeviceRepository, so deleting a device, or a type, reaches them
+type MemoryShadowRepository struct {
+	devices *MemoryDeviceRepository
+}
+
+func NewMemoryShadowRepository(devices *MemoryDeviceRepository) *MemoryShadowRepository {
+	return &MemoryShadowRepository{devices}
+}
+
+func (repo *MemoryShadowRepository) Get(_ context.Context, deviceID uint) (Shadow, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	if shadow, found := repo.devices.shadows[deviceID]; found {
+		return shadow, nil
+	}
+	return Shadow{DeviceFk: deviceID}, nil
+}
+
+func (repo *MemoryShadowRepository) List(_ context.Context) ([]Shadow, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	shadows := []Shadow{}
+	for _, id := range slices.Sorted(maps.Keys(repo.devices.shadows)) {
+		shadows = append(shadows, repo.devices.shadows[id])
+	}
+	return shadows, nil
+}
+
+func (repo *MemoryShadowRepository) SetDesired(
+	_ context.Context, deviceID, version uint, document RawJSON, actor string, at int64,
+) (Shadow, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	shadow, found := repo.devices.shadows[deviceID]
+	if !found {
+		shadow = Shadow{DeviceFk: deviceID}
+	}
+	if shadow.DesiredVersion != version {
+		return Shadow{}, NewRepositoryError(NotFound, "no matching rows", "failed to set the desired config")
+	}
+	shadow.Desired = document
+	shadow.DesiredVersion++
+	shadow.DesiredBy = sql.NullString{String: actor, Valid: true}
+	shadow.DesiredAt = sql.NullInt64{Int64: at, Valid: true}
+	repo.devices.shadows[deviceID] = shadow
+	return shadow, nil
+}
+
+func (repo *MemoryShadowRepository) SetReported(_ context.Context, deviceID, version uint, document RawJSON, at int64) (Shadow, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	shadow, found := repo.devices.shadows[deviceID]
+	if !found {
+		shadow = Shadow{DeviceFk: deviceID}
+	}
+	if shadow.ReportedVersion != version {
+		return Shadow{}, NewRepositoryError(NotFound, "no matching rows", "failed to set the reported config")
+	}
+	shadow.Reported = document
+	shadow.ReportedVersion++
+	shadow.ReportedAt = sql.NullInt64{Int64: at, Valid: true}
+	repo.devices.shadows[deviceID] = shadow
+	return shadow, nil
+}
+
+func (repo *MemoryShadowRepository) GetTemplate(_ context.Context, deviceType DeviceType) (ShadowTemplate, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	if template, found := repo.devices.shadowTemplates[deviceType]; found {
+		return template, nil
+	}
+	return ShadowTemplate{DeviceType: deviceType}, nil
+}
+
+func (repo *MemoryShadowRepository) ListTemplates(_ context.Context) ([]ShadowTemplate, error) {
+	repo.devices.mutex.RLock()
+	defer repo.devices.mutex.RUnlock()
+
+	templates := []ShadowTemplate{}
+	for _, deviceType := range slices.Sorted(maps.Keys(repo.devices.shadowTemplates)) {
+		templates = append(templates, repo.devices.shadowTemplates[deviceType])
+	}
+	return templates, nil
+}
+
+func (repo *MemoryShadowRepository) SetTemplate(
+	_ context.Context, deviceType DeviceType, version uint, document RawJSON, actor string, at int64,
+) (ShadowTemplate, error) {
+	repo.devices.mutex.Lock()
+	defer repo.devices.mutex.Unlock()
+
+	if repo.devices.shadowTemplates[deviceType].Version != version {
+		return ShadowTemplate{}, NewRepositoryError(NotFound, "no matching rows", "failed to set the shadow template")
+	}
+	template := ShadowTemplate{DeviceType: deviceType, Document: document, Version: version + 1, UpdatedBy: actor, UpdatedAt: at}
+	repo.devices.shadowTemplates[deviceType] = template
+	return template, nil
+}
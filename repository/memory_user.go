@@ -0,0 +1,219 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+)
+
+// MemoryUserRepository keeps the users in a map, along with their sessions
+type MemoryUserRepository struct {
+	mutex         sync.RWMutex
+	lastID        uint
+	users         map[uint]User
+	lastSessionID uint
+	sessions      []Session
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{users: map[uint]User{}}
+}
+
+func (repo *MemoryUserRepository) Create(_ context.Context, user NewUser) (User, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	for _, existing := range repo.users {
+		if existing.Username == user.Username {
+			return User{}, NewRepositoryError(AlreadyExists, "unique constraint failed", "failed to create the user")
+		}
+	}
+
+	repo.lastID++
+	created := User{ID: repo.lastID, NewUser: user}
+	repo.users[created.ID] = created
+	return created, nil
+}
+
+func (repo *MemoryUserRepository) GetByID(_ context.Context, id uint) (User, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	user, found := repo.users[id]
+	if !found {
+		return User{}, NewRepositoryError(NotFound, "no matching rows", "failed to get the user")
+	}
+	return user, nil
+}
+
+func (repo *MemoryUserRepository) GetByUsername(_ context.Context, username string) (User, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	for _, user := range repo.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return User{}, NewRepositoryError(NotFound, "no matching rows", "failed to get the user")
+}
+
+func (repo *MemoryUserRepository) List(_ context.Context) ([]User, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	users := make([]User, 0, len(repo.users))
+	for _, user := range repo.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (repo *MemoryUserRepository) Count(_ context.Context) (uint, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	return uint(len(repo.users)), nil
+}
+
+func (repo *MemoryUserRepository) Update(_ context.Context, id uint, role UserRole, disabledAt sql.NullInt64) (User, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	user, found := repo.users[id]
+	if !found {
+		return User{}, NewRepositoryError(NotFound, "no matching rows", "failed to update the user")
+	}
+	user.Role = role
+	user.DisabledAt = disabledAt
+	repo.users[id] = user
+	return user, nil
+}
+
+func (repo *MemoryUserRepository) SetPassword(_ context.Context, id uint, passwordHash string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	user, found := repo.users[id]
+	if !found {
+		return NewRepositoryError(NotFound, "no matching rows", "failed to set the password of the user")
+	}
+	user.PasswordHash = passwordHash
+	repo.users[id] = user
+	return nil
+}
+
+// ---------------------------------------------------
+
+// MemorySessionRepository keeps the sessions in the MemoryUserRepository
+type MemorySessionRepository struct {
+	users *MemoryUserRepository
+}
+
+func NewMemorySessionRepository(users *MemoryUserRepository) *MemorySessionRepository {
+	return &MemorySessionRepository{users}
+}
+
+func (repo *MemorySessionRepository) Create(_ context.Context, userID uint, tokenHash string, at, expiresAt int64) (Session, error) {
+	repo.users.mutex.Lock()
+	defer repo.users.mutex.Unlock()
+
+	if _, found := repo.users.users[userID]; !found {
+		return Session{}, NewRepositoryError(ConstraintFailed, "foreign key constraint failed", "failed to create the session")
+	}
+	for _, session := range repo.users.sessions {
+		if session.TokenHash == tokenHash {
+			return Session{}, NewRepositoryError(AlreadyExists, "unique constraint failed", "failed to create the session")
+		}
+	}
+
+	repo.users.lastSessionID++
+	session := Session{ID: repo.users.lastSessionID, UserFk: userID, TokenHash: tokenHash, CreatedAt: at, ExpiresAt: expiresAt}
+	repo.users.sessions = append(repo.users.sessions, session)
+	return session, nil
+}
+
+func (repo *MemorySessionRepository) Valid(_ context.Context, tokenHash string, at int64) (Session, error) {
+	repo.users.mutex.RLock()
+	defer repo.users.mutex.RUnlock()
+
+	for _, session := range repo.users.sessions {
+		if session.TokenHash == tokenHash && session.ValidAt(at) {
+			return session, nil
+		}
+	}
+	return Session{}, NewRepositoryError(NotFound, "no matching rows", "failed to get the session")
+}
+
+func (repo *MemorySessionRepository) Revoke(_ context.Context, tokenHash string, at int64) error {
+	repo.users.mutex.Lock()
+	defer repo.users.mutex.Unlock()
+
+	for i, session := range repo.users.sessions {
+		if session.TokenHash == tokenHash && !session.RevokedAt.Valid && session.ExpiresAt > at {
+			repo.users.sessions[i].RevokedAt = sql.NullInt64{Int64: at, Valid: true}
+			return nil
+		}
+	}
+	return NewRepositoryError(NotFound, "no matching rows", "failed to revoke the session")
+}
+
+func (repo *MemorySessionRepository) RevokeAll(_ context.Context, userID uint, at int64) (int64, error) {
+	repo.users.mutex.Lock()
+	defer repo.users.mutex.Unlock()
+
+	var revoked int64
+	for i, session := range repo.users.sessions {
+		if session.UserFk == userID && !session.RevokedAt.Valid && session.ExpiresAt > at {
+			repo.users.sessions[i].RevokedAt = sql.NullInt64{Int64: at, Valid: true}
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+// ---------------------------------------------------
+
+// MemoryAuditRepository keeps the audit log in a slice, in the order it was recorded
+type MemoryAuditRepository struct {
+	mutex   sync.RWMutex
+	entries []AuditEntry
+}
+
+func NewMemoryAuditRepository() *MemoryAuditRepository {
+	return &MemoryAuditRepository{}
+}
+
+func (repo *MemoryAuditRepository) Record(_ context.Context, entry AuditEntry) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	entry.ID = uint(len(repo.entries)) + 1
+	repo.entries = append(repo.entries, entry)
+	return nil
+}
+
+func (repo *MemoryAuditRepository) List(_ context.Context, query AuditQuery) ([]AuditEntry, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	entries := []AuditEntry{}
+	for _, entry := range repo.entries {
+		if (query.Actor == "" || entry.Actor == query.Actor) && entry.At >= query.From && entry.At <= query.To {
+			entries = append(entries, entry)
+		}
+	}
+	// Same order as sqlite, the most recent first
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].At != entries[j].At {
+			return entries[i].At > entries[j].At
+		}
+		return entries[i].ID > entries[j].ID
+	})
+	if query.Limit > 0 && uint(len(entries)) > query.Limit {
+		entries = entries[:query.Limit]
+	}
+	return entries, nil
+}
@@ -0,0 +1,252 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+Statements that copy the rows of an attached "spill" database into the main one,
+run in order. Primary keys of both files are unrelated, so devices are matched by
+their serial id, and every row pointing to a device is re-pointed through it,
+the same goes for the device types and their name. Measurement types are matched
+by their pk, the m_value_type the measurements were published with.
+A table added to the schema that holds ingested data must be added here,
+or its rows are dropped when leaving the in-memory fallback.
+Rollups are left out, the main db aggregates the merged measurements itself, but
+the ones behind its watermarks are added to its rollups as they are merged.
+*/
+var mergeSpillStatements = []string{
+	`INSERT INTO main.device_type (name, role, serial_pattern, value_types, heartbeat_timeout, default_status, description)
+		SELECT name, role, serial_pattern, value_types, heartbeat_timeout, default_status, description
+		FROM spill.device_type
+		WHERE name NOT IN (SELECT name FROM main.device_type)`,
+	// A type created in both files keeps the definition of the main db
+	`INSERT OR IGNORE INTO main.measurement_type (pk, name, encoding, unit, min_value, max_value, description)
+		SELECT pk, name, encoding, unit, min_value, max_value, description FROM spill.measurement_type`,
+	// Device types are matched by their name, like the devices by their serial id
+	`INSERT INTO main.device (device_type, serial_id, device_status, description, decommissioned_at,
+			last_seen_at, connectivity)
+		SELECT COALESCE(
+				(SELECT target_type.pk FROM spill.device_type source_type
+					JOIN main.device_type target_type ON target_type.name = source_type.name
+					WHERE source_type.pk = source.device_type),
+				source.device_type),
+			serial_id, device_status, description, decommissioned_at, last_seen_at, connectivity
+		FROM spill.device source
+		WHERE serial_id NOT IN (SELECT serial_id FROM main.device)`,
+	// Devices seen while degraded keep the latest of both dates
+	`UPDATE main.device SET last_seen_at = (
+			SELECT MAX(COALESCE(main.device.last_seen_at, 0), source.last_seen_at)
+			FROM spill.device source WHERE source.serial_id = main.device.serial_id)
+		WHERE serial_id IN (SELECT serial_id FROM spill.device WHERE last_seen_at IS NOT NULL)`,
+	`INSERT INTO main.device_measurement (publishing_device_fk, accessory_fk, m_value, m_value_type, received_at,
+			measured_at, clock_skewed)
+		SELECT target.pk, accessory_target.pk, m.m_value, m.m_value_type, m.received_at, m.measured_at, m.clock_skewed
+		FROM spill.device_measurement m
+		JOIN spill.device source ON source.pk = m.publishing_device_fk
+		JOIN main.device target ON target.serial_id = source.serial_id
+		LEFT JOIN spill.device accessory_source ON accessory_source.pk = m.accessory_fk
+		LEFT JOIN main.device accessory_target ON accessory_target.serial_id = accessory_source.serial_id`,
+	mergeRollupStatement(MinuteResolution),
+	mergeRollupStatement(HourResolution),
+	`INSERT INTO main.device_status_history (device_fk, old_status, new_status, actor, reason, changed_at)
+		SELECT target.pk, h.old_status, h.new_status, h.actor, h.reason, h.changed_at
+		FROM spill.device_status_history h
+		JOIN spill.device source ON source.pk = h.device_fk
+		JOIN main.device target ON target.serial_id = source.serial_id`,
+	// An accessory attached in both files keeps the attachment of the main db
+	`INSERT OR IGNORE INTO main.device_attachment (accessory_fk, parent_fk, attached_at, attached_by, detached_at, detached_by)
+		SELECT accessory_target.pk, parent_target.pk, a.attached_at, a.attached_by, a.detached_at, a.detached_by
+		FROM spill.device_attachment a
+		JOIN spill.device accessory_source ON accessory_source.pk = a.accessory_fk
+		JOIN main.device accessory_target ON accessory_target.serial_id = accessory_source.serial_id
+		JOIN spill.device parent_source ON parent_source.pk = a.parent_fk
+		JOIN main.device parent_target ON parent_target.serial_id = parent_source.serial_id`,
+	`INSERT INTO main.device_credential (device_fk, key_hash, created_at, expires_at, revoked_at)
+		SELECT target.pk, c.key_hash, c.created_at, c.expires_at, c.revoked_at
+		FROM spill.device_credential c
+		JOIN spill.device source ON source.pk = c.device_fk
+		JOIN main.device target ON target.serial_id = source.serial_id`,
+	// Users are matched by their username, their sessions are left out, they log in again
+	`INSERT INTO main.admin_user (username, password_hash, role, created_at, disabled_at)
+		SELECT username, password_hash, role, created_at, disabled_at
+		FROM spill.admin_user
+		WHERE username NOT IN (SELECT username FROM main.admin_user)`,
+	`INSERT INTO main.audit_log (actor, actor_role, action, target, status_code, at)
+		SELECT actor, actor_role, action, target, status_code, at FROM spill.audit_log`,
+	// A code created in both files keeps the state of the main db
+	`INSERT OR IGNORE INTO main.claim_code (code_hash, device_type, requires_approval, description, created_by,
+			created_at, expires_at, claimed_at, claimed_by, revoked_at)
+		SELECT c.code_hash, target_type.pk, c.requires_approval, c.description, c.created_by,
+			c.created_at, c.expires_at, c.claimed_at, c.claimed_by, c.revoked_at
+		FROM spill.claim_code c
+		JOIN spill.device_type source_type ON source_type.pk = c.device_type
+		JOIN main.device_type target_type ON target_type.name = source_type.name`,
+	`INSERT INTO main.device_command (device_fk, name, payload, status, attempts, max_attempts, created_by,
+			created_at, expires_at, delivered_at, completed_at, result)
+		SELECT target.pk, c.name, c.payload, c.status, c.attempts, c.max_attempts, c.created_by,
+			c.created_at, c.expires_at, c.delivered_at, c.completed_at, c.result
+		FROM spill.device_command c
+		JOIN spill.device source ON source.pk = c.device_fk
+		JOIN main.device target ON target.serial_id = source.serial_id`,
+	// Commands have no key of their own, they are matched by their device, name, creator and date
+	`INSERT INTO main.device_command_history (command_fk, old_status, new_status, actor, detail, changed_at)
+		SELECT target_command.pk, h.old_status, h.new_status, h.actor, h.detail, h.changed_at
+		FROM spill.device_command_history h
+		JOIN spill.device_command source_command ON source_command.pk = h.command_fk
+		JOIN spill.device source ON source.pk = source_command.device_fk
+		JOIN main.device target ON target.serial_id = source.serial_id
+		JOIN main.device_command target_command ON target_command.device_fk = target.pk
+			AND target_command.name = source_command.name AND target_command.created_by = source_command.created_by
+			AND target_command.created_at = source_command.created_at`,
+	// The section of a shadow changed while degraded replaces the one of the main db, at its next version
+	`INSERT INTO main.device_shadow (device_fk, desired, desired_version, desired_by, desired_at,
+			reported, reported_version, reported_at)
+		SELECT target.pk, s.desired, s.desired_version, s.desired_by, s.desired_at,
+			s.reported, s.reported_version, s.reported_at
+		FROM spill.device_shadow s
+		JOIN spill.device source ON source.pk = s.device_fk
+		JOIN main.device target ON target.serial_id = source.serial_id
+		WHERE true
+		ON CONFLICT (device_fk) DO UPDATE SET
+			desired = CASE WHEN COALESCE(excluded.desired_at, 0) > COALESCE(desired_at, 0) THEN excluded.desired ELSE desired END,
+			desired_version = desired_version + (COALESCE(excluded.desired_at, 0) > COALESCE(desired_at, 0)),
+			desired_by = CASE WHEN COALESCE(excluded.desired_at, 0) > COALESCE(desired_at, 0) THEN excluded.desired_by ELSE desired_by END,
+			desired_at = NULLIF(MAX(COALESCE(desired_at, 0), COALESCE(excluded.desired_at, 0)), 0),
+			reported = CASE WHEN COALESCE(excluded.reported_at, 0) > COALESCE(reported_at, 0) THEN excluded.reported ELSE reported END,
+			reported_version = reported_version + (COALESCE(excluded.reported_at, 0) > COALESCE(reported_at, 0)),
+			reported_at = NULLIF(MAX(COALESCE(reported_at, 0), COALESCE(excluded.reported_at, 0)), 0)`,
+	`INSERT INTO main.shadow_template (device_type, document, version, updated_by, updated_at)
+		SELECT target_type.pk, t.document, t.version, t.updated_by, t.updated_at
+		FROM spill.shadow_template t
+		JOIN spill.device_type source_type ON source_type.pk = t.device_type
+		JOIN main.device_type target_type ON target_type.name = source_type.name
+		WHERE true
+		ON CONFLICT (device_type) DO UPDATE SET document = excluded.document, version = version + 1,
+			updated_by = excluded.updated_by, updated_at = excluded.updated_at
+		WHERE excluded.updated_at > updated_at`,
+	// Firmware is matched by its type and version, a version uploaded to both files keeps the one of the main db
+	`INSERT INTO main.firmware (device_type, version, size, sha256, signature, description, uploaded_by, uploaded_at)
+		SELECT target_type.pk, f.version, f.size, f.sha256, f.signature, f.description, f.uploaded_by, f.uploaded_at
+		FROM spill.firmware f
+		JOIN spill.device_type source_type ON source_type.pk = f.device_type
+		JOIN main.device_type target_type ON target_type.name = source_type.name
+		WHERE true
+		ON CONFLICT (device_type, version) DO NOTHING`,
+	// Rollouts have no key of their own, they are matched by their firmware, creator and date
+	`INSERT INTO main.firmware_rollout (firmware_fk, percentage, failure_threshold, min_reports, status,
+			created_by, created_at, changed_by, changed_at, reason)
+		SELECT target_firmware.pk, r.percentage, r.failure_threshold, r.min_reports, r.status,
+			r.created_by, r.created_at, r.changed_by, r.changed_at, r.reason
+		FROM spill.firmware_rollout r
+		JOIN spill.firmware source_firmware ON source_firmware.pk = r.firmware_fk
+		JOIN spill.device_type source_type ON source_type.pk = source_firmware.device_type
+		JOIN main.device_type target_type ON target_type.name = source_type.name
+		JOIN main.firmware target_firmware ON target_firmware.device_type = target_type.pk
+			AND target_firmware.version = source_firmware.version`,
+	`INSERT OR IGNORE INTO main.firmware_rollout_device (rollout_fk, device_fk, status, detail, updated_at)
+		SELECT target_rollout.pk, target.pk, d.status, d.detail, d.updated_at
+		FROM spill.firmware_rollout_device d
+		JOIN spill.firmware_rollout source_rollout ON source_rollout.pk = d.rollout_fk
+		JOIN spill.firmware source_firmware ON source_firmware.pk = source_rollout.firmware_fk
+		JOIN spill.device_type source_type ON source_type.pk = source_firmware.device_type
+		JOIN main.device_type target_type ON target_type.name = source_type.name
+		JOIN main.firmware target_firmware ON target_firmware.device_type = target_type.pk
+			AND target_firmware.version = source_firmware.version
+		JOIN main.firmware_rollout target_rollout ON target_rollout.firmware_fk = target_firmware.pk
+			AND target_rollout.created_by = source_rollout.created_by AND target_rollout.created_at = source_rollout.created_at
+		JOIN spill.device source ON source.pk = d.device_fk
+		JOIN main.device target ON target.serial_id = source.serial_id`,
+	// The most recent sync of a clock gives its offset, the syncs of both files are counted
+	`INSERT INTO main.device_clock (device_fk, offset_us, round_trip_us, samples, synced_at)
+		SELECT target.pk, c.offset_us, c.round_trip_us, c.samples, c.synced_at
+		FROM spill.device_clock c
+		JOIN spill.device source ON source.pk = c.device_fk
+		JOIN main.device target ON target.serial_id = source.serial_id
+		WHERE true
+		ON CONFLICT (device_fk) DO UPDATE SET
+			offset_us = CASE WHEN excluded.synced_at > synced_at THEN excluded.offset_us ELSE offset_us END,
+			round_trip_us = CASE WHEN excluded.synced_at > synced_at THEN excluded.round_trip_us ELSE round_trip_us END,
+			samples = samples + excluded.samples,
+			synced_at = MAX(synced_at, excluded.synced_at)`,
+	// Alert rules are matched by their name, a rule created in both files keeps the definition of the main db
+	`INSERT INTO main.alert_rule (name, kind, device_fk, device_type, m_value_type, comparison, threshold, window_ms,
+			connectivity, created_by, created_at)
+		SELECT r.name, r.kind, target.pk, target_type.pk, r.m_value_type, r.comparison, r.threshold, r.window_ms,
+			r.connectivity, r.created_by, r.created_at
+		FROM spill.alert_rule r
+		LEFT JOIN spill.device source ON source.pk = r.device_fk
+		LEFT JOIN main.device target ON target.serial_id = source.serial_id
+		LEFT JOIN spill.device_type source_type ON source_type.pk = r.device_type
+		LEFT JOIN main.device_type target_type ON target_type.name = source_type.name
+		WHERE true
+		ON CONFLICT (name) DO NOTHING`,
+	// An alert open in both files for the same rule and device keeps the one of the main db
+	`INSERT OR IGNORE INTO main.alert (rule_fk, device_fk, alert_state, detail, m_value, fired_at,
+			acknowledged_by, acknowledged_at, resolved_at)
+		SELECT target_rule.pk, target.pk, a.alert_state, a.detail, a.m_value, a.fired_at,
+			a.acknowledged_by, a.acknowledged_at, a.resolved_at
+		FROM spill.alert a
+		JOIN spill.alert_rule source_rule ON source_rule.pk = a.rule_fk
+		JOIN main.alert_rule target_rule ON target_rule.name = source_rule.name
+		JOIN spill.device source ON source.pk = a.device_fk
+		JOIN main.device target ON target.serial_id = source.serial_id`,
+}
+
+/*
+MergeSpillFile copies every row of a spilled sqlite file into the target db,
+inside a single transaction, so a failed merge leaves the target untouched and
+can be retried. The spill file must have the same schema version as the target.
+*/
+/*
+Aggregates the spilled measurements the main db already rolled up past into its rollups
+of the resolution. The retention job never goes back behind its watermark, so without it
+a long degraded run leaves the measurements it merges out of the rollups.
+*/
+func mergeRollupStatement(resolution Resolution) string {
+	return fmt.Sprintf(`
+		INSERT INTO main.device_measurement_rollup (publishing_device_fk, m_value_type, resolution,
+			bucket_start, sample_count, min_value, max_value, sum_value)
+		SELECT target.pk, m.m_value_type, %[1]d, (m.received_at / %[1]d) * %[1]d AS bucket, COUNT(*),
+			MIN(CAST(m.m_value AS REAL)), MAX(CAST(m.m_value AS REAL)), SUM(CAST(m.m_value AS REAL))
+		FROM spill.device_measurement m
+		JOIN spill.device source ON source.pk = m.publishing_device_fk
+		JOIN main.device target ON target.serial_id = source.serial_id
+		JOIN main.rollup_watermark watermark ON watermark.resolution = %[1]d
+		WHERE m.received_at < watermark.rolled_until AND m.m_value NOT LIKE '[%%'
+		GROUP BY target.pk, m.m_value_type, bucket`, resolution) + rollupUpsert
+}
+
+func MergeSpillFile(ctx context.Context, target *sqlx.DB, spillPath string) (err error) {
+	// ATTACH is per connection, so everything runs on the same one
+	conn, err := target.Connx(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, `ATTACH DATABASE ? AS spill`, spillPath); err != nil {
+		return
+	}
+	defer conn.ExecContext(context.Background(), `DETACH DATABASE spill`)
+
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return
+	}
+	for _, statement := range mergeSpillStatements {
+		result, execErr := tx.ExecContext(ctx, statement)
+		if execErr != nil {
+			tx.Rollback()
+			return execErr
+		}
+		merged, _ := result.RowsAffected()
+		slog.Info("database-merge", "merged-rows", merged)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,140 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeSpillFile(t *testing.T) {
+	ctx := context.Background()
+	spillPath := filepath.Join(t.TempDir(), "spill.db")
+
+	// The spill holds a device also known by the target, and one only it knows
+	spill := newTestSqliteRepositories(t)
+	shared, err := spill.Devices.Create(ctx, NewDevice{SerialId: "PMD-shared"})
+	handleErr(err)
+	onlySpilled, err := spill.Devices.Create(ctx, NewDevice{SerialId: "PMD-spilled"})
+	handleErr(err)
+	for _, device := range []Device{shared, onlySpilled} {
+		_, err = spill.Measurements.Insert(ctx, NewMeasurement{PublishingDeviceFk: device.ID, Value: "10", ReceivedAt: 1})
+		handleErr(err)
+	}
+	// Configured while degraded, the desired config of the shared device replaces the one of the target
+	_, err = spill.Shadows.SetDesired(ctx, shared.ID, 0, RawJSON(`{"interval_ms":1000}`), "ana", 20)
+	handleErr(err)
+	_, err = spill.Shadows.SetReported(ctx, onlySpilled.ID, 0, RawJSON(`{"interval_ms":500}`), 20)
+	handleErr(err)
+	// Rolled out while degraded, the firmware keeps where each device is in its update
+	firmware, err := spill.Firmware.Create(ctx, NewFirmware{Version: "1.1.0", Size: 4, SHA256: "ab", UploadedBy: "ana", UploadedAt: 20})
+	handleErr(err)
+	rollout, err := spill.Firmware.CreateRollout(ctx, NewRollout{
+		FirmwareFk: firmware.ID, FailureThreshold: 0.5, MinReports: 1, CreatedBy: "ana", CreatedAt: 20,
+	}, []uint{shared.ID, onlySpilled.ID})
+	handleErr(err)
+	_, err = spill.Firmware.ChangeRolloutDevice(ctx, rollout.ID, shared.ID, []UpdateStatus{UpdatePending}, UpdateInstalled, sql.NullString{}, 30)
+	handleErr(err)
+	// Synced while degraded, the offset of the shared clock replaces the older one of the target
+	_, err = spill.Clocks.Record(ctx, DeviceClock{DeviceFk: shared.ID, OffsetMicros: -1500, RoundTripMicros: 800, SyncedAt: 40})
+	handleErr(err)
+	// Fired while degraded, the alert of the shared device is kept with its rule
+	rule, err := spill.Alerts.CreateRule(ctx, NewAlertRule{
+		Name: "too-hot", Kind: ThresholdAlert, DeviceFk: sql.NullInt64{Int64: int64(shared.ID), Valid: true},
+		Threshold: 30, CreatedBy: "ana", CreatedAt: 20,
+	})
+	handleErr(err)
+	_, err = spill.Alerts.Fire(ctx, NewAlert{RuleFk: rule.ID, DeviceFk: shared.ID, Detail: "31 above 30", FiredAt: 50})
+	handleErr(err)
+	handleErr(spill.Devices.(*SqliteDeviceRepository).db.WithPools(func(pools SqlitePools) error {
+		_, err := pools.Writer.Exec(`VACUUM INTO ?`, spillPath)
+		return err
+	}))
+
+	target := newTestSqliteRepositories(t)
+	_, err = target.Devices.Create(ctx, NewDevice{SerialId: "PMD-other"})
+	handleErr(err)
+	targetShared, err := target.Devices.Create(ctx, NewDevice{SerialId: "PMD-shared"})
+	handleErr(err)
+
+	_, err = target.Shadows.SetDesired(ctx, targetShared.ID, 0, RawJSON(`{"interval_ms":5000}`), "rui", 10)
+	handleErr(err)
+	_, err = target.Shadows.SetReported(ctx, targetShared.ID, 0, RawJSON(`{"interval_ms":5000}`), 30)
+	handleErr(err)
+
+	_, err = target.Clocks.Record(ctx, DeviceClock{DeviceFk: targetShared.ID, OffsetMicros: 200, RoundTripMicros: 900, SyncedAt: 10})
+	handleErr(err)
+
+	// Rolled up past the spilled measurements, the minutes get them as they are merged
+	handleErr(target.Retention.Rollup(ctx, MinuteResolution, 0, 120_000))
+
+	targetDB := target.Devices.(*SqliteDeviceRepository).db
+	assert.NoError(t, targetDB.WithPools(func(pools SqlitePools) error {
+		return MergeSpillFile(ctx, pools.Writer, spillPath)
+	}))
+
+	devices, err := target.Devices.List(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, devices, 3)
+
+	measurements, err := target.Measurements.Query(ctx, MeasurementQuery{DeviceID: targetShared.ID, From: 0, To: 10})
+	assert.NoError(t, err)
+	assert.Len(t, measurements, 1)
+
+	merged, err := target.Devices.GetBySerial(ctx, "PMD-spilled")
+	assert.NoError(t, err)
+	measurements, err = target.Measurements.Query(ctx, MeasurementQuery{DeviceID: merged.ID, From: 0, To: 10})
+	assert.NoError(t, err)
+	assert.Len(t, measurements, 1)
+
+	rollups, err := target.Measurements.QueryRollups(ctx, MeasurementQuery{DeviceID: targetShared.ID, From: 0, To: 120_000}, MinuteResolution)
+	assert.NoError(t, err)
+	if assert.Len(t, rollups, 1) {
+		assert.Equal(t, uint(1), rollups[0].Count)
+		assert.Equal(t, float64(10), rollups[0].Sum)
+	}
+	// Never rolled up, the hours aggregate the merged minutes themselves
+	rollups, err = target.Measurements.QueryRollups(ctx, MeasurementQuery{DeviceID: merged.ID, From: 0, To: 120_000}, HourResolution)
+	assert.NoError(t, err)
+	assert.Empty(t, rollups)
+
+	shadow, err := target.Shadows.Get(ctx, targetShared.ID)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"interval_ms":1000}`, string(shadow.Desired))
+	assert.Equal(t, uint(2), shadow.DesiredVersion)
+	assert.Equal(t, "ana", shadow.DesiredBy.String)
+	assert.JSONEq(t, `{"interval_ms":5000}`, string(shadow.Reported))
+	assert.Equal(t, uint(1), shadow.ReportedVersion)
+	shadow, err = target.Shadows.Get(ctx, merged.ID)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"interval_ms":500}`, string(shadow.Reported))
+	assert.False(t, shadow.DesiredAt.Valid)
+
+	rollouts, err := target.Firmware.ListRollouts(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, rollouts, 1) {
+		assert.Equal(t, "1.1.0", rollouts[0].Version)
+		assert.Equal(t, uint(2), rollouts[0].Devices)
+		assert.Equal(t, uint(1), rollouts[0].Installed)
+	}
+
+	clock, err := target.Clocks.Get(ctx, targetShared.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1500), clock.OffsetMicros)
+	assert.Equal(t, uint(2), clock.Samples)
+	assert.Equal(t, int64(40), clock.SyncedAt)
+
+	rules, err := target.Alerts.ListRules(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 1) {
+		assert.Equal(t, "PMD-shared", rules[0].SerialId.String)
+	}
+	alerts, err := target.Alerts.List(ctx, AlertQuery{Open: true})
+	assert.NoError(t, err)
+	if assert.Len(t, alerts, 1) {
+		assert.Equal(t, "too-hot", alerts[0].RuleName)
+		assert.Equal(t, targetShared.ID, alerts[0].DeviceFk)
+	}
+}
@@ -0,0 +1,934 @@
+package repository
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+)
+
+// DeviceType is the pk of the type of a device, in the device type registry
+type DeviceType uint
+
+// The built-in device types, always in the registry
+const (
+	PMD DeviceType = iota
+	Accessory
+)
+
+// DeviceRole is how the devices of a type behave, whatever the type
+type DeviceRole uint
+
+const (
+	// Publishes its own measurements, and those of the accessories attached to it
+	PMDRole DeviceRole = iota
+	// Only publishes while attached to a device with the PMD role
+	AccessoryRole
+)
+
+func (role DeviceRole) String() string {
+	switch role {
+	case PMDRole:
+		return "pmd"
+	case AccessoryRole:
+		return "accessory"
+	}
+	return "unknown"
+}
+
+// ValueTypes is a set of measurement types, stored as a JSON array
+type ValueTypes []uint
+
+func (valueTypes ValueTypes) Value() (driver.Value, error) {
+	if valueTypes == nil {
+		return "[]", nil
+	}
+	encoded, err := json.Marshal([]uint(valueTypes))
+	return string(encoded), err
+}
+
+func (valueTypes *ValueTypes) Scan(source any) error {
+	switch value := source.(type) {
+	case string:
+		return json.Unmarshal([]byte(value), valueTypes)
+	case []byte:
+		return json.Unmarshal(value, valueTypes)
+	}
+	return errors.New("value_types should be a JSON array")
+}
+
+/*
+NewDeviceType defines a device type, the serial ids of its devices must match SerialPattern,
+an empty ValueTypes allows any measurement type, and a null HeartbeatTimeout (milliseconds)
+uses the timeouts of the presence config.
+*/
+type NewDeviceType struct {
+	Name             string         `json:"name" db:"name"`
+	Role             DeviceRole     `json:"role" db:"role"`
+	SerialPattern    string         `json:"serial_pattern" db:"serial_pattern"`
+	ValueTypes       ValueTypes     `json:"value_types" db:"value_types"`
+	HeartbeatTimeout sql.NullInt64  `json:"heartbeat_timeout" db:"heartbeat_timeout"`
+	DefaultStatus    DeviceStatus   `json:"default_status" db:"default_status"`
+	Description      sql.NullString `json:"description" db:"description"`
+}
+
+type DeviceTypeDefinition struct {
+	ID DeviceType `json:"id" db:"pk"`
+	NewDeviceType
+}
+
+// The built-in measurement type, of the measurements published without a type
+const GenericValueType uint = 0
+
+// ValueEncoding is how the values of a measurement type are published and stored
+type ValueEncoding uint
+
+const (
+	FloatEncoding ValueEncoding = iota
+	IntEncoding
+	// Stored as 1 or 0, so they can be aggregated
+	BoolEncoding
+	// A JSON array of floats, never aggregated
+	VectorEncoding
+)
+
+func (encoding ValueEncoding) String() string {
+	switch encoding {
+	case FloatEncoding:
+		return "float"
+	case IntEncoding:
+		return "int"
+	case BoolEncoding:
+		return "bool"
+	case VectorEncoding:
+		return "vector"
+	}
+	return "unknown"
+}
+
+/*
+NewMeasurementType defines a measurement type, the values published with it must be
+written with its Encoding, and fall within Min and Max (inclusive), null is unbounded.
+*/
+type NewMeasurementType struct {
+	Name        string          `json:"name" db:"name"`
+	Encoding    ValueEncoding   `json:"encoding" db:"encoding"`
+	Unit        string          `json:"unit" db:"unit"`
+	Min         sql.NullFloat64 `json:"min" db:"min_value"`
+	Max         sql.NullFloat64 `json:"max" db:"max_value"`
+	Description sql.NullString  `json:"description" db:"description"`
+}
+
+// MeasurementTypeDefinition is a measurement type, its ID is the m_value_type of its measurements
+type MeasurementTypeDefinition struct {
+	ID uint `json:"id" db:"pk"`
+	NewMeasurementType
+}
+
+type DeviceStatus uint
+
+const (
+	Ok DeviceStatus = iota
+	Off
+	Suspended
+	// Set through Decommission only, a decommissioned device keeps its history but can't publish
+	Decommissioned
+	// Provisioned with a claim code that requires approval, it can't publish until approved
+	Pending
+)
+
+func (status DeviceStatus) String() string {
+	switch status {
+	case Ok:
+		return "ok"
+	case Off:
+		return "off"
+	case Suspended:
+		return "suspended"
+	case Decommissioned:
+		return "decommissioned"
+	case Pending:
+		return "pending"
+	}
+	return "unknown"
+}
+
+// Connectivity is whether a device is still reporting, as judged by the presence monitor
+type Connectivity uint
+
+const (
+	// The device was never seen
+	Unknown Connectivity = iota
+	Online
+	// Late on its heartbeat, but not yet offline
+	Stale
+	Offline
+)
+
+func (connectivity Connectivity) String() string {
+	switch connectivity {
+	case Unknown:
+		return "unknown"
+	case Online:
+		return "online"
+	case Stale:
+		return "stale"
+	case Offline:
+		return "offline"
+	}
+	return "unknown"
+}
+
+type NewDevice struct {
+	SerialId     string         `binding:"required" form:"serial_id" json:"serial_id" db:"serial_id"`
+	Description  sql.NullString `form:"description" json:"description" db:"description"`
+	DeviceType   DeviceType     `form:"device_type" json:"device_type" db:"device_type"`
+	DeviceStatus DeviceStatus   `form:"device_status" json:"device_status" db:"device_status"`
+}
+
+type Device struct {
+	ID uint `json:"-" db:"pk"`
+	NewDevice
+	// Unix milliseconds of when the device was decommissioned
+	DecommissionedAt sql.NullInt64 `json:"decommissioned_at" db:"decommissioned_at"`
+	// Unix milliseconds of the last heartbeat or measurement received from the device
+	LastSeenAt   sql.NullInt64 `json:"last_seen_at" db:"last_seen_at"`
+	Connectivity Connectivity  `json:"connectivity" db:"connectivity"`
+}
+
+// StatusChange is a change of a device status, recorded in the status history
+type StatusChange struct {
+	Status DeviceStatus
+	// Who made the change
+	Actor  string
+	Reason sql.NullString
+	// Unix milliseconds of when the change was made
+	At int64
+	// Applies the same change to the accessories attached to the device, when it is a PMD
+	CascadeAccessories bool
+}
+
+// Actor recorded for the status a device is registered with
+const RegistrationActor = "registration"
+
+type StatusHistoryEntry struct {
+	ID       uint `json:"-" db:"pk"`
+	DeviceFk uint `json:"-" db:"device_fk"`
+	// nil for the status the device was registered with
+	OldStatus *DeviceStatus  `json:"old_status" db:"old_status"`
+	NewStatus DeviceStatus   `json:"new_status" db:"new_status"`
+	Actor     string         `json:"actor" db:"actor"`
+	Reason    sql.NullString `json:"reason" db:"reason"`
+	ChangedAt int64          `json:"changed_at" db:"changed_at"`
+}
+
+/*
+StatusHistoryQuery filters the status changes of a single device, From and To
+are inclusive unix milliseconds, and a Limit of 0 returns every matching change.
+*/
+type StatusHistoryQuery struct {
+	DeviceID uint
+	From     int64
+	To       int64
+	Limit    uint
+}
+
+type NewMeasurement struct {
+	// The PMD the measurement is attributed to, also for those published by its accessories
+	PublishingDeviceFk uint `json:"-" db:"publishing_device_fk"`
+	// The accessory the measurement came from, if any
+	AccessoryFk sql.NullInt64 `json:"-" db:"accessory_fk"`
+	Value       string        `json:"m_value" db:"m_value"`
+	ValueType   uint          `json:"m_value_type" db:"m_value_type"`
+	// Unix time in milliseconds, set by the server when the measurement arrives
+	ReceivedAt int64 `json:"received_at" db:"received_at"`
+	// Unix time in milliseconds, when the device took the measurement, moved to the clock of the server
+	MeasuredAt sql.NullInt64 `json:"measured_at" db:"measured_at"`
+	// The clock of the device was further off than the max skew, its measured_at is less certain
+	ClockSkewed bool `json:"clock_skewed" db:"clock_skewed"`
+}
+
+type Measurement struct {
+	ID uint `json:"-" db:"pk"`
+	NewMeasurement
+}
+
+// TimeAxis is the time the measurements are filtered and ordered by
+type TimeAxis uint
+
+const (
+	ReceivedAxis TimeAxis = iota
+	// The time the device took the measurement at, or the time it was received when the device didn't send it
+	MeasuredAxis
+)
+
+func (axis TimeAxis) String() string {
+	if axis == MeasuredAxis {
+		return "measured"
+	}
+	return "received"
+}
+
+// at returns the time of the measurement on the axis
+func (axis TimeAxis) at(measurement NewMeasurement) int64 {
+	if axis == MeasuredAxis && measurement.MeasuredAt.Valid {
+		return measurement.MeasuredAt.Int64
+	}
+	return measurement.ReceivedAt
+}
+
+/*
+MeasurementQuery filters the measurements published by a single device, or
+for a PMD, by its accessories too,
+From and To are inclusive unix milliseconds on the Axis, a nil ValueType matches
+any type, and a Limit of 0 returns every matching measurement.
+*/
+type MeasurementQuery struct {
+	DeviceID uint
+	// DeviceID is an accessory, matched against the accessory the measurements came from
+	ByAccessory bool
+	ValueType   *uint
+	From        int64
+	To          int64
+	Limit       uint
+	// Rollups are always bucketed by the time received
+	Axis TimeAxis
+}
+
+// Resolution is the width of the buckets of aggregated measurements, in milliseconds
+type Resolution int64
+
+const (
+	RawResolution    Resolution = 0
+	MinuteResolution Resolution = 60_000
+	HourResolution   Resolution = 3_600_000
+)
+
+func (resolution Resolution) String() string {
+	switch resolution {
+	case RawResolution:
+		return "raw"
+	case MinuteResolution:
+		return "1m"
+	case HourResolution:
+		return "1h"
+	}
+	return "unknown"
+}
+
+// Floor returns the start of the bucket the unix milliseconds timestamp falls in
+func (resolution Resolution) Floor(timestamp int64) int64 {
+	if resolution <= 0 {
+		return timestamp
+	}
+	return timestamp - timestamp%int64(resolution)
+}
+
+// Rollup aggregates every numeric measurement of a device and type within a bucket
+type Rollup struct {
+	PublishingDeviceFk uint       `json:"-" db:"publishing_device_fk"`
+	ValueType          uint       `json:"m_value_type" db:"m_value_type"`
+	Resolution         Resolution `json:"-" db:"resolution"`
+	BucketStart        int64      `json:"bucket_start" db:"bucket_start"`
+	Count              uint       `json:"count" db:"sample_count"`
+	Min                float64    `json:"min" db:"min_value"`
+	Max                float64    `json:"max" db:"max_value"`
+	Sum                float64    `json:"sum" db:"sum_value"`
+	Avg                float64    `json:"avg" db:"-"`
+}
+
+/*
+Credential is a secret a device signs its requests with, issued when the device is
+registered and on every rotation. The SHA-256 of the secret is the key the requests are
+signed with, it is stored sealed with the key secret, see the deviceauth package.
+*/
+type Credential struct {
+	ID       uint `json:"id" db:"pk"`
+	DeviceFk uint `json:"-" db:"device_fk"`
+	// Sealed signing key, never shown
+	KeyHash string `json:"-" db:"key_hash"`
+	// Unix milliseconds, a credential is valid from its creation until it expires or is revoked
+	CreatedAt int64         `json:"created_at" db:"created_at"`
+	ExpiresAt sql.NullInt64 `json:"expires_at" db:"expires_at"`
+	RevokedAt sql.NullInt64 `json:"revoked_at" db:"revoked_at"`
+}
+
+// ValidAt reports if the credential can be used at the date, in unix milliseconds
+func (credential Credential) ValidAt(at int64) bool {
+	if credential.RevokedAt.Valid || credential.CreatedAt > at {
+		return false
+	}
+	return !credential.ExpiresAt.Valid || credential.ExpiresAt.Int64 > at
+}
+
+type NewClaimCode struct {
+	CodeHash   string     `json:"-" db:"code_hash"`
+	DeviceType DeviceType `json:"device_type" db:"device_type"`
+	// The device is registered Pending, until an operator approves it
+	RequiresApproval bool           `json:"requires_approval" db:"requires_approval"`
+	Description      sql.NullString `json:"description" db:"description"`
+	CreatedBy        string         `json:"created_by" db:"created_by"`
+	// Unix milliseconds
+	CreatedAt int64 `json:"created_at" db:"created_at"`
+	ExpiresAt int64 `json:"expires_at" db:"expires_at"`
+}
+
+/*
+ClaimCode is a one-time code a device provisions itself with, registering it with the
+type of the code. Only the SHA-256 of the code is stored.
+*/
+type ClaimCode struct {
+	ID uint `json:"id" db:"pk"`
+	NewClaimCode
+	ClaimedAt sql.NullInt64 `json:"claimed_at" db:"claimed_at"`
+	// The serial id of the device that used the code
+	ClaimedBy sql.NullString `json:"claimed_by" db:"claimed_by"`
+	RevokedAt sql.NullInt64  `json:"revoked_at" db:"revoked_at"`
+}
+
+// UsableAt reports if the code can still be claimed at the date, in unix milliseconds
+func (code ClaimCode) UsableAt(at int64) bool {
+	return !code.ClaimedAt.Valid && !code.RevokedAt.Valid && code.CreatedAt <= at && code.ExpiresAt > at
+}
+
+// RawJSON is a JSON document stored as text, null when empty
+type RawJSON []byte
+
+func (document RawJSON) Value() (driver.Value, error) {
+	if len(document) == 0 {
+		return nil, nil
+	}
+	return string(document), nil
+}
+
+func (document *RawJSON) Scan(source any) error {
+	switch value := source.(type) {
+	case nil:
+		*document = nil
+	case string:
+		*document = RawJSON(value)
+	case []byte:
+		*document = append(RawJSON{}, value...)
+	default:
+		return errors.New("a JSON document should be stored as text")
+	}
+	return nil
+}
+
+func (document RawJSON) MarshalJSON() ([]byte, error) {
+	if len(document) == 0 {
+		return []byte("null"), nil
+	}
+	return document, nil
+}
+
+func (document *RawJSON) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*document = nil
+		return nil
+	}
+	*document = append(RawJSON{}, data...)
+	return nil
+}
+
+// CommandStatus is where a device command is in its delivery
+type CommandStatus uint
+
+const (
+	// Waiting to be fetched by the device
+	Queued CommandStatus = iota
+	// Fetched by the device, waiting for its acknowledgement
+	Delivered
+	Succeeded
+	Failed
+	// Not delivered, or not acknowledged, before its expiry
+	Expired
+	Cancelled
+)
+
+func (status CommandStatus) String() string {
+	switch status {
+	case Queued:
+		return "queued"
+	case Delivered:
+		return "delivered"
+	case Succeeded:
+		return "succeeded"
+	case Failed:
+		return "failed"
+	case Expired:
+		return "expired"
+	case Cancelled:
+		return "cancelled"
+	}
+	return "unknown"
+}
+
+// Final reports if the command is done with, it never changes status again
+func (status CommandStatus) Final() bool {
+	return status > Delivered
+}
+
+/*
+NewCommand is a command queued for a device, with the arguments it takes as its payload.
+It is delivered up to MaxAttempts times, and only until it expires.
+*/
+type NewCommand struct {
+	DeviceFk    uint    `json:"-" db:"device_fk"`
+	Name        string  `json:"name" db:"name"`
+	Payload     RawJSON `json:"payload" db:"payload"`
+	MaxAttempts uint    `json:"max_attempts" db:"max_attempts"`
+	CreatedBy   string  `json:"created_by" db:"created_by"`
+	// Unix milliseconds
+	CreatedAt int64 `json:"created_at" db:"created_at"`
+	ExpiresAt int64 `json:"expires_at" db:"expires_at"`
+}
+
+type Command struct {
+	ID uint `json:"id" db:"pk"`
+	NewCommand
+	Status      CommandStatus `json:"status" db:"status"`
+	Attempts    uint          `json:"attempts" db:"attempts"`
+	DeliveredAt sql.NullInt64 `json:"delivered_at" db:"delivered_at"`
+	CompletedAt sql.NullInt64 `json:"completed_at" db:"completed_at"`
+	// Reported by the device when acknowledging the command
+	Result RawJSON `json:"result" db:"result"`
+}
+
+// CommandChange moves a command to a status, Result is only kept when the device acknowledges it
+type CommandChange struct {
+	Status CommandStatus
+	Actor  string
+	Detail sql.NullString
+	Result RawJSON
+	// Unix milliseconds
+	At int64
+}
+
+/*
+CommandQuery filters the commands of a device, the most recent first, Statuses
+left empty matches every status, and a Limit of 0 returns every matching command.
+*/
+type CommandQuery struct {
+	DeviceID uint
+	Statuses []CommandStatus
+	Limit    uint
+}
+
+// Actor recorded for the changes made by the app itself, like expiring a command
+const SystemActor = "system"
+
+type CommandHistoryEntry struct {
+	ID        uint `json:"-" db:"pk"`
+	CommandFk uint `json:"-" db:"command_fk"`
+	// nil for the status the command was queued with
+	OldStatus *CommandStatus `json:"old_status" db:"old_status"`
+	NewStatus CommandStatus  `json:"new_status" db:"new_status"`
+	Actor     string         `json:"actor" db:"actor"`
+	Detail    sql.NullString `json:"detail" db:"detail"`
+	ChangedAt int64          `json:"changed_at" db:"changed_at"`
+}
+
+// UserRole is what a user may do through the api, every role may do what the ones below it do
+type UserRole uint
+
+const (
+	// Reads the devices, their measurements and the state of the app
+	ViewerRole UserRole = iota
+	// Registers devices and changes their status and attachments
+	OperatorRole
+	// Manages the users, types, credentials, backups and config
+	AdminRole
+)
+
+func (role UserRole) String() string {
+	switch role {
+	case ViewerRole:
+		return "viewer"
+	case OperatorRole:
+		return "operator"
+	case AdminRole:
+		return "admin"
+	}
+	return "unknown"
+}
+
+// Allows reports if the role may do what the required role does
+func (role UserRole) Allows(required UserRole) bool {
+	return role >= required
+}
+
+type NewUser struct {
+	Username     string   `json:"username" db:"username"`
+	PasswordHash string   `json:"-" db:"password_hash"`
+	Role         UserRole `json:"role" db:"role"`
+	// Unix milliseconds
+	CreatedAt int64 `json:"created_at" db:"created_at"`
+}
+
+// User is a human operator of the api
+type User struct {
+	ID uint `json:"id" db:"pk"`
+	NewUser
+	DisabledAt sql.NullInt64 `json:"disabled_at" db:"disabled_at"`
+}
+
+// Session is a bearer token issued to a user on login, only the SHA-256 of the token is stored
+type Session struct {
+	ID        uint   `json:"-" db:"pk"`
+	UserFk    uint   `json:"-" db:"user_fk"`
+	TokenHash string `json:"-" db:"token_hash"`
+	// Unix milliseconds, a session is valid from its creation until it expires or is revoked
+	CreatedAt int64         `json:"created_at" db:"created_at"`
+	ExpiresAt int64         `json:"expires_at" db:"expires_at"`
+	RevokedAt sql.NullInt64 `json:"revoked_at" db:"revoked_at"`
+}
+
+// ValidAt reports if the session can be used at the date, in unix milliseconds
+func (session Session) ValidAt(at int64) bool {
+	return !session.RevokedAt.Valid && session.CreatedAt <= at && session.ExpiresAt > at
+}
+
+// AuditEntry records who did what through the api, and how it went
+type AuditEntry struct {
+	ID    uint   `json:"id" db:"pk"`
+	Actor string `json:"actor" db:"actor"`
+	// Null for the login attempts of unknown users
+	ActorRole sql.NullInt64 `json:"actor_role" db:"actor_role"`
+	// The method and route of the request, like "PUT /api/v1/devices/pmd/status/"
+	Action     string         `json:"action" db:"action"`
+	Target     sql.NullString `json:"target" db:"target"`
+	StatusCode int            `json:"status_code" db:"status_code"`
+	// Unix milliseconds
+	At int64 `json:"at" db:"at"`
+}
+
+// AuditQuery filters the audit log by actor, when set, and a [From, To] range in unix milliseconds
+type AuditQuery struct {
+	Actor string
+	From  int64
+	To    int64
+	// Most recent entries returned, 0 for all of them
+	Limit uint
+}
+
+// Attachment links an accessory to the PMD it is plugged into, for as long as it stays attached
+type Attachment struct {
+	ID              uint   `json:"-" db:"pk"`
+	AccessoryFk     uint   `json:"-" db:"accessory_fk"`
+	ParentFk        uint   `json:"-" db:"parent_fk"`
+	AccessorySerial string `json:"accessory_serial_id" db:"accessory_serial_id"`
+	ParentSerial    string `json:"parent_serial_id" db:"parent_serial_id"`
+	AttachedAt      int64  `json:"attached_at" db:"attached_at"`
+	AttachedBy      string `json:"attached_by" db:"attached_by"`
+	// Null while the accessory is still attached
+	DetachedAt sql.NullInt64  `json:"detached_at" db:"detached_at"`
+	DetachedBy sql.NullString `json:"detached_by" db:"detached_by"`
+}
+
+// AttachmentChange is who attached or detached an accessory, and when, in unix milliseconds
+type AttachmentChange struct {
+	Actor string
+	At    int64
+}
+
+/*
+Shadow holds the config of a device, as desired by the operators and as reported by
+the device, each a JSON object with a version bumped on every change. A device without
+a shadow has an empty one, at version 0.
+*/
+type Shadow struct {
+	DeviceFk        uint           `json:"-" db:"device_fk"`
+	Desired         RawJSON        `json:"desired" db:"desired"`
+	DesiredVersion  uint           `json:"desired_version" db:"desired_version"`
+	DesiredBy       sql.NullString `json:"desired_by" db:"desired_by"`
+	DesiredAt       sql.NullInt64  `json:"desired_at" db:"desired_at"`
+	Reported        RawJSON        `json:"reported" db:"reported"`
+	ReportedVersion uint           `json:"reported_version" db:"reported_version"`
+	ReportedAt      sql.NullInt64  `json:"reported_at" db:"reported_at"`
+}
+
+// ShadowTemplate is the desired config every device of the type starts from, at version 0 when there is none
+type ShadowTemplate struct {
+	DeviceType DeviceType `json:"device_type" db:"device_type"`
+	Document   RawJSON    `json:"document" db:"document"`
+	Version    uint       `json:"version" db:"version"`
+	UpdatedBy  string     `json:"updated_by" db:"updated_by"`
+	UpdatedAt  int64      `json:"updated_at" db:"updated_at"`
+}
+
+// NewFirmware is a firmware image for the devices of a type, its file is stored on disk named by its SHA-256
+type NewFirmware struct {
+	DeviceType DeviceType `json:"device_type" db:"device_type"`
+	Version    string     `json:"version" db:"version"`
+	// Bytes
+	Size int64 `json:"size" db:"size"`
+	// Hex encoded
+	SHA256 string `json:"sha256" db:"sha256"`
+	// Base64 encoded, checked by the devices before installing the image
+	Signature   sql.NullString `json:"signature" db:"signature"`
+	Description sql.NullString `json:"description" db:"description"`
+	UploadedBy  string         `json:"uploaded_by" db:"uploaded_by"`
+	// Unix milliseconds
+	UploadedAt int64 `json:"uploaded_at" db:"uploaded_at"`
+}
+
+type Firmware struct {
+	ID uint `json:"id" db:"pk"`
+	NewFirmware
+}
+
+// RolloutStatus is whether a rollout still offers its firmware to the devices
+type RolloutStatus uint
+
+const (
+	RolloutActive RolloutStatus = iota
+	// Offers nothing until resumed, the devices already updating may still report
+	RolloutPaused
+	RolloutCompleted
+	RolloutCancelled
+)
+
+func (status RolloutStatus) String() string {
+	switch status {
+	case RolloutActive:
+		return "active"
+	case RolloutPaused:
+		return "paused"
+	case RolloutCompleted:
+		return "completed"
+	case RolloutCancelled:
+		return "cancelled"
+	}
+	return "unknown"
+}
+
+// Final reports if the rollout is done with, it never changes status again
+func (status RolloutStatus) Final() bool {
+	return status > RolloutPaused
+}
+
+/*
+NewRollout offers a firmware to a share of the devices of its type, or to the devices
+listed with it when Percentage is 0. It is paused once the share of failed installs
+crosses FailureThreshold, with at least MinReports installs reported.
+*/
+type NewRollout struct {
+	FirmwareFk       uint    `json:"firmware_id" db:"firmware_fk"`
+	Percentage       uint    `json:"percentage" db:"percentage"`
+	FailureThreshold float64 `json:"failure_threshold" db:"failure_threshold"`
+	MinReports       uint    `json:"min_reports" db:"min_reports"`
+	CreatedBy        string  `json:"created_by" db:"created_by"`
+	// Unix milliseconds
+	CreatedAt int64 `json:"created_at" db:"created_at"`
+}
+
+type Rollout struct {
+	ID uint `json:"id" db:"pk"`
+	NewRollout
+	// Of the firmware rolled out
+	DeviceType DeviceType     `json:"device_type" db:"device_type"`
+	Version    string         `json:"version" db:"version"`
+	Status     RolloutStatus  `json:"status" db:"status"`
+	ChangedBy  sql.NullString `json:"changed_by" db:"changed_by"`
+	ChangedAt  sql.NullInt64  `json:"changed_at" db:"changed_at"`
+	Reason     sql.NullString `json:"reason" db:"reason"`
+	// Counted over the devices of the rollout
+	Devices   uint `json:"devices" db:"devices"`
+	Installed uint `json:"installed" db:"installed"`
+	Failed    uint `json:"failed" db:"failed"`
+}
+
+// RolloutChange moves a rollout to a status, with who moved it there and why
+type RolloutChange struct {
+	Status RolloutStatus
+	Actor  string
+	Reason sql.NullString
+	// Unix milliseconds
+	At int64
+}
+
+// UpdateStatus is where a device is in the update of a rollout
+type UpdateStatus uint
+
+const (
+	// Listed in the rollout, not yet offered the update
+	UpdatePending UpdateStatus = iota
+	UpdateOffered
+	UpdateDownloading
+	UpdateInstalled
+	UpdateFailed
+)
+
+func (status UpdateStatus) String() string {
+	switch status {
+	case UpdatePending:
+		return "pending"
+	case UpdateOffered:
+		return "offered"
+	case UpdateDownloading:
+		return "downloading"
+	case UpdateInstalled:
+		return "installed"
+	case UpdateFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// Final reports if the device reported the outcome of its install
+func (status UpdateStatus) Final() bool {
+	return status > UpdateDownloading
+}
+
+type RolloutDevice struct {
+	RolloutFk uint           `json:"rollout_id" db:"rollout_fk"`
+	DeviceFk  uint           `json:"-" db:"device_fk"`
+	SerialId  string         `json:"serial_id" db:"serial_id"`
+	Status    UpdateStatus   `json:"status" db:"status"`
+	Detail    sql.NullString `json:"detail" db:"detail"`
+	// Unix milliseconds
+	UpdatedAt int64 `json:"updated_at" db:"updated_at"`
+}
+
+/*
+DeviceClock is how far the clock of a device is from the one of the server, estimated
+from the last clock sync of the device, the shorter its round trip the more accurate.
+*/
+type DeviceClock struct {
+	DeviceFk uint   `json:"-" db:"device_fk"`
+	SerialId string `json:"serial_id" db:"serial_id"`
+	// Microseconds added to the time of the device to get the one of the server, negative when the device is ahead
+	OffsetMicros    int64 `json:"offset_us" db:"offset_us"`
+	RoundTripMicros int64 `json:"round_trip_us" db:"round_trip_us"`
+	// Clock syncs recorded for the device
+	Samples uint `json:"samples" db:"samples"`
+	// Unix milliseconds
+	SyncedAt int64 `json:"synced_at" db:"synced_at"`
+}
+
+// AlertKind is what an alert rule watches for
+type AlertKind uint
+
+const (
+	// A value above, or below, the threshold
+	ThresholdAlert AlertKind = iota
+	// A value changing faster than the threshold per minute, rising when above, falling when below
+	RateAlert
+	// No measurement received for the window
+	AbsenceAlert
+	// The device going stale or offline
+	StatusAlert
+)
+
+func (kind AlertKind) String() string {
+	switch kind {
+	case ThresholdAlert:
+		return "threshold"
+	case RateAlert:
+		return "rate"
+	case AbsenceAlert:
+		return "absence"
+	case StatusAlert:
+		return "status"
+	}
+	return "unknown"
+}
+
+// AlertComparison is the side of the threshold a rule fires on
+type AlertComparison uint
+
+const (
+	Above AlertComparison = iota
+	Below
+)
+
+func (comparison AlertComparison) String() string {
+	if comparison == Below {
+		return "below"
+	}
+	return "above"
+}
+
+/*
+NewAlertRule is a rule the measurements, or the connectivity, of the devices in its
+scope are evaluated against. The scope is the device, device type and measurement type
+set, every device when none is.
+*/
+type NewAlertRule struct {
+	Name       string          `json:"name" db:"name"`
+	Kind       AlertKind       `json:"kind" db:"kind"`
+	DeviceFk   sql.NullInt64   `json:"-" db:"device_fk"`
+	DeviceType sql.NullInt64   `json:"device_type" db:"device_type"`
+	ValueType  sql.NullInt64   `json:"m_value_type" db:"m_value_type"`
+	Comparison AlertComparison `json:"comparison" db:"comparison"`
+	// The value, or its change per minute, crossing it fires the rule
+	Threshold float64 `json:"threshold" db:"threshold"`
+	// Milliseconds without a measurement, for the absence rules
+	WindowMillis int64 `json:"window_ms" db:"window_ms"`
+	// Connectivity firing the status rules, offline going stale first when stale
+	Connectivity Connectivity `json:"connectivity" db:"connectivity"`
+	CreatedBy    string       `json:"created_by" db:"created_by"`
+	// Unix milliseconds
+	CreatedAt int64 `json:"created_at" db:"created_at"`
+}
+
+type AlertRule struct {
+	ID uint `json:"id" db:"pk"`
+	NewAlertRule
+	// Of the device in the scope
+	SerialId sql.NullString `json:"serial_id" db:"serial_id"`
+}
+
+// AlertState is where an alert is in its lifecycle, open until resolved
+type AlertState uint
+
+const (
+	AlertFiring AlertState = iota
+	// Seen by an operator, still open until the rule stops firing
+	AlertAcknowledged
+	AlertResolved
+)
+
+func (state AlertState) String() string {
+	switch state {
+	case AlertFiring:
+		return "firing"
+	case AlertAcknowledged:
+		return "acknowledged"
+	case AlertResolved:
+		return "resolved"
+	}
+	return "unknown"
+}
+
+// NewAlert is an alert fired by a rule for a device, a rule has a single alert open per device
+type NewAlert struct {
+	RuleFk   uint `json:"rule_id" db:"rule_fk"`
+	DeviceFk uint `json:"-" db:"device_fk"`
+	// What fired the alert, and the value that did when there is one
+	Detail  string          `json:"detail" db:"detail"`
+	Value   sql.NullFloat64 `json:"m_value" db:"m_value"`
+	FiredAt int64           `json:"fired_at" db:"fired_at"`
+}
+
+type Alert struct {
+	ID uint `json:"id" db:"pk"`
+	NewAlert
+	RuleName       string         `json:"rule_name" db:"rule_name"`
+	SerialId       string         `json:"serial_id" db:"serial_id"`
+	State          AlertState     `json:"state" db:"alert_state"`
+	AcknowledgedBy sql.NullString `json:"acknowledged_by" db:"acknowledged_by"`
+	// Unix milliseconds
+	AcknowledgedAt sql.NullInt64 `json:"acknowledged_at" db:"acknowledged_at"`
+	ResolvedAt     sql.NullInt64 `json:"resolved_at" db:"resolved_at"`
+}
+
+// AlertQuery filters the alerts by state and device, when set, Open matching the firing and acknowledged ones
+type AlertQuery struct {
+	State    *AlertState
+	Open     bool
+	DeviceID uint
+	// Most recent alerts returned, 0 for all of them
+	Limit uint
+}
@@ -0,0 +1,492 @@
+/*
+Package repository holds every query made against the app's storage,
+the web handlers only ever see the interfaces declared here, so they
+can be backed by the SQLite implementation or by the in-memory one.
+*/
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/TomascpMarques/maestro/errs"
+)
+
+type RepositoryErrorVariant uint
+
+const (
+	NotFound RepositoryErrorVariant = iota
+	AlreadyExists
+	QueryFailed
+	InUse
+	// The row breaks a constraint of its own, a check or a foreign key, the db itself is fine
+	ConstraintFailed
+)
+
+func (m RepositoryErrorVariant) Error() string {
+	switch m {
+	case NotFound:
+		return "not found"
+	case AlreadyExists:
+		return "already exists"
+	case QueryFailed:
+		return "query failed"
+	case InUse:
+		return "in use"
+	case ConstraintFailed:
+		return "constraint failed"
+	}
+	return "Unknown Error"
+}
+
+type RepositoryError struct {
+	errs.CustomError
+}
+
+func NewRepositoryError(variant RepositoryErrorVariant, cause, message string) *RepositoryError {
+	return &RepositoryError{
+		errs.NewCustomError(variant, cause, message),
+	}
+}
+
+type DeviceRepository interface {
+	Create(ctx context.Context, device NewDevice) (Device, error)
+	GetByID(ctx context.Context, id uint) (Device, error)
+	GetBySerial(ctx context.Context, serialId string) (Device, error)
+	List(ctx context.Context) ([]Device, error)
+	/*
+		UpdateStatus changes the status of the device, recording the change in its status history
+		in the same transaction, a change to the status the device already has is not recorded.
+	*/
+	UpdateStatus(ctx context.Context, serialId string, change StatusChange) (Device, error)
+	// Decommission is UpdateStatus into Decommissioned, keeping the date it was first decommissioned
+	Decommission(ctx context.Context, serialId string, change StatusChange) (Device, error)
+	/*
+		Delete removes the device, a device with measurements or rollups is only
+		removed with cascade, deleting them with it, otherwise it fails with InUse.
+	*/
+	Delete(ctx context.Context, serialId string, cascade bool) error
+	/*
+		MarkSeen stores when each device, by id, was last seen, in a single transaction.
+		A last seen date is only ever moved forward, and missing devices are skipped.
+	*/
+	MarkSeen(ctx context.Context, seen map[uint]int64) error
+	SetConnectivity(ctx context.Context, deviceID uint, connectivity Connectivity) error
+}
+
+/*
+ArchiveRepository moves the measurements of a device out of the main db, into an
+archive, decommissioning the device. The measurements of an accessory, published by
+its parents, are moved with it. The rollups of the device are kept in place.
+*/
+type ArchiveRepository interface {
+	// Archive returns how many measurements were moved, the decommission is recorded as the change
+	Archive(ctx context.Context, serialId string, change StatusChange) (int64, error)
+}
+
+// DeviceTypeRepository stores the device type registry
+type DeviceTypeRepository interface {
+	List(ctx context.Context) ([]DeviceTypeDefinition, error)
+	// Create fails with AlreadyExists if the name is taken
+	Create(ctx context.Context, deviceType NewDeviceType) (DeviceTypeDefinition, error)
+	// Update replaces everything but the name and the role of the type
+	Update(ctx context.Context, deviceType DeviceTypeDefinition) (DeviceTypeDefinition, error)
+	// Delete fails with InUse while a device has the type
+	Delete(ctx context.Context, id DeviceType) error
+}
+
+// MeasurementTypeRepository stores the measurement type registry
+type MeasurementTypeRepository interface {
+	List(ctx context.Context) ([]MeasurementTypeDefinition, error)
+	// Create fails with AlreadyExists if the name is taken
+	Create(ctx context.Context, measurementType NewMeasurementType) (MeasurementTypeDefinition, error)
+	// Update replaces everything but the name and the encoding of the type
+	Update(ctx context.Context, measurementType MeasurementTypeDefinition) (MeasurementTypeDefinition, error)
+	// Delete fails with InUse while measurements or rollups have the type
+	Delete(ctx context.Context, id uint) error
+}
+
+// CredentialRepository stores the credentials of the devices, the secrets themselves are never given to it
+type CredentialRepository interface {
+	/*
+		Rotate issues a new credential from the hash of its secret, the credentials of the
+		device still valid after graceUntil expire then, the others are left as they are.
+	*/
+	Rotate(ctx context.Context, deviceID uint, keyHash string, at, graceUntil int64) (Credential, error)
+	// Valid returns the credentials of the device that can be used at the date, the newest first
+	Valid(ctx context.Context, deviceID uint, at int64) ([]Credential, error)
+	// List returns every credential of the device, the oldest first
+	List(ctx context.Context, deviceID uint) ([]Credential, error)
+	// Revoke revokes every credential of the device not yet expired at the date, returning how many
+	Revoke(ctx context.Context, deviceID uint, at int64) (int64, error)
+	// Keys returns every credential, of every device, the oldest first
+	Keys(ctx context.Context) ([]Credential, error)
+	// ReplaceKey replaces the stored key of the credential, NotFound if there is none
+	ReplaceKey(ctx context.Context, id uint, keyHash string) error
+}
+
+// ClaimCodeRepository stores the claim codes, the codes themselves are never given to it
+type ClaimCodeRepository interface {
+	Create(ctx context.Context, code NewClaimCode) (ClaimCode, error)
+	// List returns every claim code, used and revoked ones included, the oldest first
+	List(ctx context.Context) ([]ClaimCode, error)
+	// Revoke revokes the code, NotFound if it can't be claimed anymore
+	Revoke(ctx context.Context, id uint, at int64) (ClaimCode, error)
+	// Claim uses the code for the serial id, NotFound if it can't be claimed at the date
+	Claim(ctx context.Context, codeHash, serialId string, at int64) (ClaimCode, error)
+	// Release makes a claimed code usable again, when the device failed to be registered with it
+	Release(ctx context.Context, id uint) error
+}
+
+// CommandRepository stores the commands queued for the devices, and every status they went through
+type CommandRepository interface {
+	// Create queues the command, recording its creator as the actor
+	Create(ctx context.Context, command NewCommand) (Command, error)
+	Get(ctx context.Context, id uint) (Command, error)
+	List(ctx context.Context, query CommandQuery) ([]Command, error)
+	/*
+		Deliver marks the commands due for the device as delivered, and returns them, the oldest
+		first. Due are the queued commands, and the delivered ones not acknowledged since
+		redeliverBefore with attempts left, as long as they haven't expired at the date.
+	*/
+	Deliver(ctx context.Context, deviceID uint, actor string, at, redeliverBefore int64) ([]Command, error)
+	// Change moves the command to the status of the change, only from one of the statuses, NotFound otherwise
+	Change(ctx context.Context, id uint, from []CommandStatus, change CommandChange) (Command, error)
+	/*
+		Sweep expires the commands not done with by their expiry, and fails the ones delivered
+		every attempt and not acknowledged since redeliverBefore, returning how many it changed.
+	*/
+	Sweep(ctx context.Context, at, redeliverBefore int64) (int64, error)
+	// History returns every status the command went through, the oldest first
+	History(ctx context.Context, id uint) ([]CommandHistoryEntry, error)
+}
+
+/*
+ShadowRepository stores the shadows of the devices, and the templates of their types.
+Every change is made from the version it was read at, and is NotFound once it moved on,
+a document of nil clears it.
+*/
+type ShadowRepository interface {
+	// Get returns the shadow of the device, an empty one when it has none
+	Get(ctx context.Context, deviceID uint) (Shadow, error)
+	// List returns every shadow stored, by device
+	List(ctx context.Context) ([]Shadow, error)
+	SetDesired(ctx context.Context, deviceID, version uint, document RawJSON, actor string, at int64) (Shadow, error)
+	SetReported(ctx context.Context, deviceID, version uint, document RawJSON, at int64) (Shadow, error)
+	// GetTemplate returns the template of the device type, an empty one when it has none
+	GetTemplate(ctx context.Context, deviceType DeviceType) (ShadowTemplate, error)
+	ListTemplates(ctx context.Context) ([]ShadowTemplate, error)
+	SetTemplate(ctx context.Context, deviceType DeviceType, version uint, document RawJSON, actor string, at int64) (ShadowTemplate, error)
+}
+
+type ClockRepository interface {
+	// Record replaces the clock offset of the device, counting the sync
+	Record(ctx context.Context, clock DeviceClock) (DeviceClock, error)
+	// Get returns the clock offset of the device, NotFound while it never synced
+	Get(ctx context.Context, deviceID uint) (DeviceClock, error)
+	// List returns the clock offset of every device synced, by serial id
+	List(ctx context.Context) ([]DeviceClock, error)
+}
+
+type FirmwareRepository interface {
+	// Create records the firmware, AlreadyExists when its type has the version already
+	Create(ctx context.Context, firmware NewFirmware) (Firmware, error)
+	Get(ctx context.Context, id uint) (Firmware, error)
+	List(ctx context.Context) ([]Firmware, error)
+	// Delete removes the firmware with its rollouts, InUse while one of them is active or paused
+	Delete(ctx context.Context, id uint) error
+	// CreateRollout creates the rollout, with the devices listed pending
+	CreateRollout(ctx context.Context, rollout NewRollout, devices []uint) (Rollout, error)
+	GetRollout(ctx context.Context, id uint) (Rollout, error)
+	// ListRollouts returns every rollout, the most recent first
+	ListRollouts(ctx context.Context) ([]Rollout, error)
+	// ChangeRollout moves the rollout to the status of the change, only from one of the statuses, NotFound otherwise
+	ChangeRollout(ctx context.Context, id uint, from []RolloutStatus, change RolloutChange) (Rollout, error)
+	// RolloutDevices returns every device of the rollout, by serial id
+	RolloutDevices(ctx context.Context, id uint) ([]RolloutDevice, error)
+	GetRolloutDevice(ctx context.Context, rolloutID, deviceID uint) (RolloutDevice, error)
+	// AddRolloutDevice adds the device to the rollout at the status, AlreadyExists when it is in it
+	AddRolloutDevice(ctx context.Context, rolloutID, deviceID uint, status UpdateStatus, at int64) (RolloutDevice, error)
+	// ChangeRolloutDevice moves the device to the status, only from one of the statuses, NotFound otherwise
+	ChangeRolloutDevice(
+		ctx context.Context, rolloutID, deviceID uint, from []UpdateStatus, status UpdateStatus, detail sql.NullString, at int64,
+	) (RolloutDevice, error)
+}
+
+/*
+AlertRepository stores the alert rules, and the alerts they fired. The rules scoped to a
+device are deleted with it, and a device type or measurement type is in use while a rule
+is scoped to it.
+*/
+type AlertRepository interface {
+	// CreateRule fails with AlreadyExists if the name is taken
+	CreateRule(ctx context.Context, rule NewAlertRule) (AlertRule, error)
+	// ListRules returns every rule, the oldest first
+	ListRules(ctx context.Context) ([]AlertRule, error)
+	// DeleteRule removes the rule with its alerts
+	DeleteRule(ctx context.Context, id uint) error
+	// Fire opens the alert, AlreadyExists while the rule has one open for the device
+	Fire(ctx context.Context, alert NewAlert) (Alert, error)
+	Get(ctx context.Context, id uint) (Alert, error)
+	// List returns the alerts matching the query, the most recent first
+	List(ctx context.Context, query AlertQuery) ([]Alert, error)
+	// Acknowledge moves the alert from firing to acknowledged, NotFound if it isn't firing
+	Acknowledge(ctx context.Context, id uint, actor string, at int64) (Alert, error)
+	// Resolve resolves the alert the rule has open for the device, NotFound if there is none
+	Resolve(ctx context.Context, ruleID, deviceID uint, at int64) (Alert, error)
+}
+
+type UserRepository interface {
+	// Create fails with AlreadyExists if the username is taken
+	Create(ctx context.Context, user NewUser) (User, error)
+	GetByID(ctx context.Context, id uint) (User, error)
+	GetByUsername(ctx context.Context, username string) (User, error)
+	// List returns every user, disabled ones included, the oldest first
+	List(ctx context.Context) ([]User, error)
+	Count(ctx context.Context) (uint, error)
+	// Update changes the role of the user, and disables it from the date when set
+	Update(ctx context.Context, id uint, role UserRole, disabledAt sql.NullInt64) (User, error)
+	SetPassword(ctx context.Context, id uint, passwordHash string) error
+}
+
+// SessionRepository stores the sessions of the users, the tokens themselves are never given to it
+type SessionRepository interface {
+	Create(ctx context.Context, userID uint, tokenHash string, at, expiresAt int64) (Session, error)
+	// Valid returns the session of the token if it can be used at the date, NotFound otherwise
+	Valid(ctx context.Context, tokenHash string, at int64) (Session, error)
+	// Revoke revokes the session of the token, NotFound if it was already unusable
+	Revoke(ctx context.Context, tokenHash string, at int64) error
+	// RevokeAll revokes every session of the user not yet expired, returning how many
+	RevokeAll(ctx context.Context, userID uint, at int64) (int64, error)
+}
+
+// AuditRepository stores the audit log, entries are never changed once recorded
+type AuditRepository interface {
+	Record(ctx context.Context, entry AuditEntry) error
+	// List returns the entries matching the query, the most recent first
+	List(ctx context.Context, query AuditQuery) ([]AuditEntry, error)
+}
+
+/*
+AttachmentRepository links accessories to the PMD they are plugged into, keeping every
+attachment once closed. Which device is a PMD or an accessory is checked by the caller.
+*/
+type AttachmentRepository interface {
+	// Attach fails with AlreadyExists if the accessory is attached, to this PMD or any other
+	Attach(ctx context.Context, parentID, accessoryID uint, change AttachmentChange) (Attachment, error)
+	// Detach closes the attachment of the accessory, NotFound if it isn't attached
+	Detach(ctx context.Context, accessoryID uint, change AttachmentChange) (Attachment, error)
+	// Parent returns the PMD the accessory is attached to, NotFound if it isn't attached
+	Parent(ctx context.Context, accessoryID uint) (Device, error)
+	Accessories(ctx context.Context, parentID uint) ([]Device, error)
+	// History lists the attachments of the device, as accessory or parent, open within the range
+	History(ctx context.Context, deviceID uint, from, to int64) ([]Attachment, error)
+}
+
+// StatusHistoryRepository reads the status changes recorded by DeviceRepository
+type StatusHistoryRepository interface {
+	List(ctx context.Context, query StatusHistoryQuery) ([]StatusHistoryEntry, error)
+	// Before returns the last change made before the unix milliseconds, NotFound if there is none
+	Before(ctx context.Context, deviceID uint, at int64) (StatusHistoryEntry, error)
+}
+
+type MeasurementRepository interface {
+	Insert(ctx context.Context, measurement NewMeasurement) (Measurement, error)
+	// InsertBatch inserts every measurement in a single transaction, all or none of them
+	InsertBatch(ctx context.Context, measurements []NewMeasurement) error
+	Query(ctx context.Context, query MeasurementQuery) ([]Measurement, error)
+	/*
+		QueryRollups filters like Query, with From and To matching the start of the buckets.
+		Rollups are kept per PMD only, a query ByAccessory never matches any.
+	*/
+	QueryRollups(ctx context.Context, query MeasurementQuery, resolution Resolution) ([]Rollup, error)
+}
+
+/*
+RetentionRepository aggregates measurements into coarser resolutions and deletes the
+expired ones. Minute rollups are computed from the raw measurements, and hour rollups
+from the minute rollups, so each resolution can be deleted once the next one covers it.
+*/
+type RetentionRepository interface {
+	// ValueTypes lists every measurement type that has raw measurements or rollups stored
+	ValueTypes(ctx context.Context) ([]uint, error)
+	/*
+		RolledUntil returns where the next rollup of the resolution starts, the end of the last
+		aggregated bucket, or when nothing was aggregated yet, the bucket of the oldest source row.
+		found is false if there is nothing to aggregate at all.
+	*/
+	RolledUntil(ctx context.Context, resolution Resolution) (until int64, found bool, err error)
+	// Rollup aggregates the source rows in [from, until), and stores until as the new watermark
+	Rollup(ctx context.Context, resolution Resolution, from, until int64) error
+	// DeleteBefore deletes up to limit rows of the type and resolution, older than before
+	DeleteBefore(ctx context.Context, resolution Resolution, valueType uint, before int64, limit uint) (int64, error)
+}
+
+// Repositories groups every repository the app depends on
+type Repositories struct {
+	Devices      DeviceRepository
+	Measurements MeasurementRepository
+	Retention    RetentionRepository
+	Archive      ArchiveRepository
+	History      StatusHistoryRepository
+	Attachments  AttachmentRepository
+	DeviceTypes  DeviceTypeRepository
+	// The types of the measurements, and how their values are written
+	MeasurementTypes MeasurementTypeRepository
+	Credentials      CredentialRepository
+	ClaimCodes       ClaimCodeRepository
+	// The commands queued for the devices
+	Commands CommandRepository
+	// The desired and reported configs of the devices
+	Shadows ShadowRepository
+	// The firmware images, and their rollouts to the devices
+	Firmware FirmwareRepository
+	// The offsets of the clocks of the devices
+	Clocks ClockRepository
+	// The alert rules, and the alerts they fired
+	Alerts AlertRepository
+	// The human operators of the api, their sessions, and what they did
+	Users    UserRepository
+	Sessions SessionRepository
+	Audit    AuditRepository
+}
+
+/*
+NewSqliteRepositories prepares every SQLite backed repository over the same
+database, failing if any of the statements can't be prepared.
+Archived measurements are moved into the sqlite file at archivePath.
+*/
+func NewSqliteRepositories(db *SqliteDB, archivePath string) (Repositories, error) {
+	devices, err := NewSqliteDeviceRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	measurements, err := NewSqliteMeasurementRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	retention, err := NewSqliteRetentionRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	history, err := NewSqliteStatusHistoryRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	attachments, err := NewSqliteAttachmentRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	deviceTypes, err := NewSqliteDeviceTypeRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	measurementTypes, err := NewSqliteMeasurementTypeRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	credentials, err := NewSqliteCredentialRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	claimCodes, err := NewSqliteClaimCodeRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	commands, err := NewSqliteCommandRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	shadows, err := NewSqliteShadowRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	firmware, err := NewSqliteFirmwareRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	clocks, err := NewSqliteClockRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	alerts, err := NewSqliteAlertRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	users, err := NewSqliteUserRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	sessions, err := NewSqliteSessionRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	audit, err := NewSqliteAuditRepository(db)
+	if err != nil {
+		return Repositories{}, err
+	}
+
+	return Repositories{
+		Devices:          devices,
+		Measurements:     measurements,
+		Retention:        retention,
+		Archive:          NewSqliteArchiveRepository(db, archivePath),
+		History:          history,
+		Attachments:      attachments,
+		DeviceTypes:      deviceTypes,
+		MeasurementTypes: measurementTypes,
+		Credentials:      credentials,
+		ClaimCodes:       claimCodes,
+		Commands:         commands,
+		Shadows:          shadows,
+		Firmware:         firmware,
+		Clocks:           clocks,
+		Alerts:           alerts,
+		Users:            users,
+		Sessions:         sessions,
+		Audit:            audit,
+	}, nil
+}
+
+// NewMemoryRepositories creates empty in-memory repositories, meant for tests
+func NewMemoryRepositories() Repositories {
+	measurements := NewMemoryMeasurementRepository()
+	devices := NewMemoryDeviceRepository(measurements)
+	users := NewMemoryUserRepository()
+	return Repositories{
+		Devices:          devices,
+		Measurements:     measurements,
+		Retention:        NewMemoryRetentionRepository(measurements),
+		Archive:          NewMemoryArchiveRepository(devices),
+		History:          NewMemoryStatusHistoryRepository(devices),
+		Attachments:      NewMemoryAttachmentRepository(devices),
+		DeviceTypes:      NewMemoryDeviceTypeRepository(devices),
+		MeasurementTypes: NewMemoryMeasurementTypeRepository(measurements, devices),
+		Credentials:      NewMemoryCredentialRepository(devices),
+		ClaimCodes:       NewMemoryClaimCodeRepository(devices),
+		Commands:         NewMemoryCommandRepository(devices),
+		Shadows:          NewMemoryShadowRepository(devices),
+		Firmware:         NewMemoryFirmwareRepository(devices),
+		Clocks:           NewMemoryClockRepository(devices),
+		Alerts:           NewMemoryAlertRepository(devices),
+		Users:            users,
+		Sessions:         NewMemorySessionRepository(users),
+		Audit:            NewMemoryAuditRepository(),
+	}
+}
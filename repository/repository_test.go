@@ -0,0 +1,1146 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/migrations"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSqliteRepositories(t *testing.T) Repositories {
+	db := sqlx.MustConnect("sqlite3", ":memory:")
+	// Every connection to ":memory:" is a new database, so only one is kept
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	migration, err := migrations.New(db.DB)
+	handleErr(err)
+	handleErr(migration.Up())
+
+	archivePath := filepath.Join(t.TempDir(), "archive.sqlite")
+	repos, err := NewSqliteRepositories(NewSqliteDB(SqlitePools{Reader: db, Writer: db}), archivePath)
+	handleErr(err)
+	return repos
+}
+
+func handleErr(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func testedRepositories(t *testing.T) map[string]Repositories {
+	return map[string]Repositories{
+		"sqlite": newTestSqliteRepositories(t),
+		"memory": NewMemoryRepositories(),
+	}
+}
+
+func TestDeviceRepository(t *testing.T) {
+	ctx := context.Background()
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			created, err := repos.Devices.Create(ctx, NewDevice{
+				SerialId:    "PMD-000001",
+				Description: sql.NullString{String: "bench", Valid: true},
+				DeviceType:  PMD,
+			})
+			assert.NoError(t, err)
+			assert.NotZero(t, created.ID)
+
+			_, err = repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000001"})
+			assert.True(t, errors.Is(err, AlreadyExists))
+
+			found, err := repos.Devices.GetBySerial(ctx, "PMD-000001")
+			assert.NoError(t, err)
+			assert.Equal(t, created, found)
+
+			_, err = repos.Devices.GetByID(ctx, created.ID+1)
+			assert.True(t, errors.Is(err, NotFound))
+
+			updated, err := repos.Devices.UpdateStatus(ctx, "PMD-000001", StatusChange{Status: Suspended, Actor: "test", At: 1000})
+			assert.NoError(t, err)
+			assert.Equal(t, Suspended, updated.DeviceStatus)
+
+			_, err = repos.Devices.UpdateStatus(ctx, "PMD-missing", StatusChange{Status: Off, Actor: "test", At: 1000})
+			assert.True(t, errors.Is(err, NotFound))
+
+			devices, err := repos.Devices.List(ctx)
+			assert.NoError(t, err)
+			assert.Len(t, devices, 1)
+		})
+	}
+}
+
+func TestMeasurementRepository(t *testing.T) {
+	ctx := context.Background()
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			device, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000002"})
+			handleErr(err)
+
+			for i, valueType := range []uint{0, 1, 0} {
+				_, err := repos.Measurements.Insert(ctx, NewMeasurement{
+					PublishingDeviceFk: device.ID,
+					Value:              "12.5",
+					ValueType:          valueType,
+					ReceivedAt:         int64(1000 * (i + 1)),
+				})
+				assert.NoError(t, err)
+			}
+
+			all, err := repos.Measurements.Query(ctx, MeasurementQuery{DeviceID: device.ID, From: 0, To: 5000})
+			assert.NoError(t, err)
+			assert.Len(t, all, 3)
+
+			valueType := uint(0)
+			typed, err := repos.Measurements.Query(ctx, MeasurementQuery{
+				DeviceID: device.ID, ValueType: &valueType, From: 0, To: 5000, Limit: 1,
+			})
+			assert.NoError(t, err)
+			assert.Len(t, typed, 1)
+			assert.Equal(t, int64(1000), typed[0].ReceivedAt)
+
+			windowed, err := repos.Measurements.Query(ctx, MeasurementQuery{DeviceID: device.ID, From: 1500, To: 3000})
+			assert.NoError(t, err)
+			assert.Len(t, windowed, 2)
+
+			batch := []NewMeasurement{
+				{PublishingDeviceFk: device.ID, Value: "13.5", ValueType: 2, ReceivedAt: 6000},
+				{PublishingDeviceFk: device.ID, Value: "14.5", ValueType: 2, ReceivedAt: 7000},
+			}
+			assert.NoError(t, repos.Measurements.InsertBatch(ctx, batch))
+			batched, err := repos.Measurements.Query(ctx, MeasurementQuery{DeviceID: device.ID, From: 6000, To: 7000})
+			assert.NoError(t, err)
+			assert.Len(t, batched, 2)
+
+			// Measured before the ones received earlier, the others fall back to the time received
+			_, err = repos.Measurements.Insert(ctx, NewMeasurement{
+				PublishingDeviceFk: device.ID, Value: "15.5", ReceivedAt: 9000,
+				MeasuredAt: sql.NullInt64{Int64: 1500, Valid: true}, ClockSkewed: true,
+			})
+			assert.NoError(t, err)
+			received, err := repos.Measurements.Query(ctx, MeasurementQuery{DeviceID: device.ID, From: 0, To: 1800})
+			assert.NoError(t, err)
+			assert.Len(t, received, 1)
+			measured, err := repos.Measurements.Query(ctx, MeasurementQuery{DeviceID: device.ID, From: 0, To: 1800, Axis: MeasuredAxis})
+			assert.NoError(t, err)
+			if assert.Len(t, measured, 2) {
+				assert.Equal(t, int64(1000), measured[0].ReceivedAt)
+				assert.Equal(t, int64(1500), measured[1].MeasuredAt.Int64)
+				assert.True(t, measured[1].ClockSkewed)
+			}
+		})
+	}
+}
+
+func TestRetentionRepository(t *testing.T) {
+	ctx := context.Background()
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			device, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000003"})
+			handleErr(err)
+
+			_, found, err := repos.Retention.RolledUntil(ctx, MinuteResolution)
+			assert.NoError(t, err)
+			assert.False(t, found)
+
+			// Two measurements in the first minute, one in the second
+			for _, measurement := range []struct {
+				value      string
+				receivedAt int64
+			}{{"10", 61_000}, {"20", 62_000}, {"04", 125_000}} {
+				_, err := repos.Measurements.Insert(ctx, NewMeasurement{
+					PublishingDeviceFk: device.ID,
+					Value:              measurement.value,
+					ValueType:          1,
+					ReceivedAt:         measurement.receivedAt,
+				})
+				handleErr(err)
+			}
+
+			until, found, err := repos.Retention.RolledUntil(ctx, MinuteResolution)
+			assert.NoError(t, err)
+			assert.True(t, found)
+			assert.Equal(t, int64(60_000), until)
+
+			assert.NoError(t, repos.Retention.Rollup(ctx, MinuteResolution, until, 120_000))
+			until, _, err = repos.Retention.RolledUntil(ctx, MinuteResolution)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(120_000), until)
+
+			query := MeasurementQuery{DeviceID: device.ID, From: 0, To: 1_000_000}
+			rollups, err := repos.Measurements.QueryRollups(ctx, query, MinuteResolution)
+			assert.NoError(t, err)
+			assert.Len(t, rollups, 1)
+			assert.Equal(t, uint(2), rollups[0].Count)
+			assert.Equal(t, 10.0, rollups[0].Min)
+			assert.Equal(t, 20.0, rollups[0].Max)
+			assert.Equal(t, 15.0, rollups[0].Avg)
+
+			// Rolled up in two steps, the hour bucket still holds every sample
+			assert.NoError(t, repos.Retention.Rollup(ctx, MinuteResolution, 120_000, 180_000))
+			assert.NoError(t, repos.Retention.Rollup(ctx, HourResolution, 0, 3_600_000))
+			rollups, err = repos.Measurements.QueryRollups(ctx, query, HourResolution)
+			assert.NoError(t, err)
+			assert.Len(t, rollups, 1)
+			assert.Equal(t, uint(3), rollups[0].Count)
+			assert.Equal(t, 34.0, rollups[0].Sum)
+
+			valueTypes, err := repos.Retention.ValueTypes(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, []uint{1}, valueTypes)
+
+			deleted, err := repos.Retention.DeleteBefore(ctx, RawResolution, 1, 120_000, 1)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), deleted)
+			deleted, err = repos.Retention.DeleteBefore(ctx, RawResolution, 1, 120_000, 10)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), deleted)
+
+			remaining, err := repos.Measurements.Query(ctx, query)
+			assert.NoError(t, err)
+			assert.Len(t, remaining, 1)
+
+			deleted, err = repos.Retention.DeleteBefore(ctx, MinuteResolution, 1, 3_600_000, 10)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(2), deleted)
+		})
+	}
+}
+
+func TestDeviceLifecycle(t *testing.T) {
+	ctx := context.Background()
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, serialId := range []string{"PMD-000010", "PMD-000011", "PMD-000012"} {
+				device, err := repos.Devices.Create(ctx, NewDevice{SerialId: serialId})
+				handleErr(err)
+				_, err = repos.Measurements.Insert(ctx, NewMeasurement{
+					PublishingDeviceFk: device.ID, Value: "10", ValueType: 1, ReceivedAt: 1000,
+				})
+				handleErr(err)
+			}
+
+			decommissioned, err := repos.Devices.Decommission(ctx, "PMD-000010", StatusChange{Actor: "test", At: 5000})
+			assert.NoError(t, err)
+			assert.Equal(t, Decommissioned, decommissioned.DeviceStatus)
+			assert.Equal(t, int64(5000), decommissioned.DecommissionedAt.Int64)
+			// Decommissioning again keeps the first date
+			decommissioned, err = repos.Devices.Decommission(ctx, "PMD-000010", StatusChange{Actor: "test", At: 9000})
+			assert.NoError(t, err)
+			assert.Equal(t, int64(5000), decommissioned.DecommissionedAt.Int64)
+
+			err = repos.Devices.Delete(ctx, "PMD-000011", false)
+			assert.True(t, errors.Is(err, InUse))
+			assert.NoError(t, repos.Devices.Delete(ctx, "PMD-000011", true))
+			_, err = repos.Devices.GetBySerial(ctx, "PMD-000011")
+			assert.True(t, errors.Is(err, NotFound))
+			err = repos.Devices.Delete(ctx, "PMD-000011", true)
+			assert.True(t, errors.Is(err, NotFound))
+
+			archived, err := repos.Archive.Archive(ctx, "PMD-000012", StatusChange{Actor: "test", At: 7000})
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), archived)
+			device, err := repos.Devices.GetBySerial(ctx, "PMD-000012")
+			assert.NoError(t, err)
+			assert.Equal(t, Decommissioned, device.DeviceStatus)
+			remaining, err := repos.Measurements.Query(ctx, MeasurementQuery{DeviceID: device.ID, To: 10_000})
+			assert.NoError(t, err)
+			assert.Empty(t, remaining)
+
+			// With its measurements archived, the device can be deleted without cascading
+			assert.NoError(t, repos.Devices.Delete(ctx, "PMD-000012", false))
+
+			// An accessory takes the measurements its parent published for it, the parent keeps its own
+			parent, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000013"})
+			handleErr(err)
+			accessory, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000014"})
+			handleErr(err)
+			for _, accessoryFk := range []sql.NullInt64{{}, {Int64: int64(accessory.ID), Valid: true}} {
+				_, err = repos.Measurements.Insert(ctx, NewMeasurement{
+					PublishingDeviceFk: parent.ID, AccessoryFk: accessoryFk, Value: "10", ValueType: 1, ReceivedAt: 1000,
+				})
+				handleErr(err)
+			}
+			archived, err = repos.Archive.Archive(ctx, "PMD-000014", StatusChange{Actor: "test", At: 7000})
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), archived)
+			remaining, err = repos.Measurements.Query(ctx, MeasurementQuery{DeviceID: parent.ID, To: 10_000})
+			assert.NoError(t, err)
+			if assert.Len(t, remaining, 1) {
+				assert.False(t, remaining[0].AccessoryFk.Valid)
+			}
+
+			_, err = repos.Archive.Archive(ctx, "PMD-missing", StatusChange{Actor: "test", At: 7000})
+			assert.True(t, errors.Is(err, NotFound))
+		})
+	}
+}
+
+func TestSqliteArchiveFile(t *testing.T) {
+	ctx := context.Background()
+	repos := newTestSqliteRepositories(t)
+	parent, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000001"})
+	handleErr(err)
+	accessory, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000002"})
+	handleErr(err)
+	_, err = repos.Measurements.Insert(ctx, NewMeasurement{
+		PublishingDeviceFk: parent.ID, AccessoryFk: sql.NullInt64{Int64: int64(accessory.ID), Valid: true},
+		Value: "10", ValueType: 1, ReceivedAt: 1000, MeasuredAt: sql.NullInt64{Int64: 900, Valid: true}, ClockSkewed: true,
+	})
+	handleErr(err)
+
+	// Created with the first version of the archive, before the accessories and the device times were kept
+	archivePath := filepath.Join(t.TempDir(), "archive.sqlite")
+	archiveFile := sqlx.MustConnect("sqlite3", archivePath)
+	defer archiveFile.Close()
+	archiveFile.MustExec(`CREATE TABLE archived_measurement (
+		serial_id TEXT NOT NULL, m_value TEXT NOT NULL, m_value_type INTEGER NOT NULL, received_at INTEGER NOT NULL
+	)`)
+	archiveFile.MustExec(`INSERT INTO archived_measurement VALUES ('PMD-000003', '5', 1, 500)`)
+
+	archive := NewSqliteArchiveRepository(repos.Devices.(*SqliteDeviceRepository).db, archivePath)
+	archived, err := archive.Archive(ctx, "PMD-000002", StatusChange{Actor: "test", At: 7000})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), archived)
+
+	type archivedMeasurement struct {
+		SerialId          string         `db:"serial_id"`
+		AccessorySerialId sql.NullString `db:"accessory_serial_id"`
+		MeasuredAt        sql.NullInt64  `db:"measured_at"`
+		ClockSkewed       bool           `db:"clock_skewed"`
+	}
+	rows := []archivedMeasurement{}
+	assert.NoError(t, archiveFile.Select(&rows, `
+		SELECT serial_id, accessory_serial_id, measured_at, clock_skewed FROM archived_measurement ORDER BY received_at`))
+	assert.Equal(t, []archivedMeasurement{
+		{SerialId: "PMD-000003"},
+		{
+			SerialId: "PMD-000002", AccessorySerialId: sql.NullString{String: "PMD-000002", Valid: true},
+			MeasuredAt: sql.NullInt64{Int64: 900, Valid: true}, ClockSkewed: true,
+		},
+	}, rows)
+}
+
+func TestStatusHistory(t *testing.T) {
+	ctx := context.Background()
+	reason := sql.NullString{String: "maintenance", Valid: true}
+	// The registration is recorded at the current time, the changes are made after it
+	base := time.Now().UnixMilli() + 1000
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			device, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000020"})
+			handleErr(err)
+
+			_, err = repos.Devices.UpdateStatus(ctx, "PMD-000020", StatusChange{Status: Suspended, Actor: "operator", Reason: reason, At: base + 1000})
+			assert.NoError(t, err)
+			// Changing into the status it already has is not recorded
+			_, err = repos.Devices.UpdateStatus(ctx, "PMD-000020", StatusChange{Status: Suspended, Actor: "operator", At: base + 2000})
+			assert.NoError(t, err)
+			_, err = repos.Devices.UpdateStatus(ctx, "PMD-000020", StatusChange{Status: Ok, Actor: "operator", At: base + 3000})
+			assert.NoError(t, err)
+			_, err = repos.Devices.Decommission(ctx, "PMD-000020", StatusChange{Actor: "admin", At: base + 4000})
+			assert.NoError(t, err)
+
+			entries, err := repos.History.List(ctx, StatusHistoryQuery{DeviceID: device.ID, From: base + 1000, To: base + 4000})
+			assert.NoError(t, err)
+			if assert.Len(t, entries, 3) {
+				assert.Equal(t, Ok, *entries[0].OldStatus)
+				assert.Equal(t, Suspended, entries[0].NewStatus)
+				assert.Equal(t, "operator", entries[0].Actor)
+				assert.Equal(t, reason, entries[0].Reason)
+				assert.Equal(t, base+1000, entries[0].ChangedAt)
+				assert.Equal(t, Ok, entries[1].NewStatus)
+				assert.Equal(t, Decommissioned, entries[2].NewStatus)
+				assert.Equal(t, "admin", entries[2].Actor)
+			}
+
+			// The status the device was registered with is recorded too
+			registration, err := repos.History.Before(ctx, device.ID, base)
+			assert.NoError(t, err)
+			assert.Nil(t, registration.OldStatus)
+			assert.Equal(t, RegistrationActor, registration.Actor)
+
+			before, err := repos.History.Before(ctx, device.ID, base+3500)
+			assert.NoError(t, err)
+			assert.Equal(t, Ok, before.NewStatus)
+
+			limited, err := repos.History.List(ctx, StatusHistoryQuery{DeviceID: device.ID, From: base + 1000, To: base + 4000, Limit: 1})
+			assert.NoError(t, err)
+			assert.Len(t, limited, 1)
+
+			_, err = repos.History.Before(ctx, device.ID+1, base+3500)
+			assert.True(t, errors.Is(err, NotFound))
+		})
+	}
+}
+
+func TestDevicePresence(t *testing.T) {
+	ctx := context.Background()
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			device, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000030"})
+			handleErr(err)
+
+			assert.NoError(t, repos.Devices.MarkSeen(ctx, map[uint]int64{device.ID: 5000, device.ID + 100: 5000}))
+			// An older date never moves it back
+			assert.NoError(t, repos.Devices.MarkSeen(ctx, map[uint]int64{device.ID: 3000}))
+			assert.NoError(t, repos.Devices.SetConnectivity(ctx, device.ID, Stale))
+
+			found, err := repos.Devices.GetByID(ctx, device.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, sql.NullInt64{Int64: 5000, Valid: true}, found.LastSeenAt)
+			assert.Equal(t, Stale, found.Connectivity)
+
+			err = repos.Devices.SetConnectivity(ctx, device.ID+100, Offline)
+			assert.True(t, errors.Is(err, NotFound))
+		})
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	ctx := context.Background()
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			pmd, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000040", DeviceType: PMD})
+			handleErr(err)
+			other, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000041", DeviceType: PMD})
+			handleErr(err)
+			sensor, err := repos.Devices.Create(ctx, NewDevice{SerialId: "ACC-000040", DeviceType: Accessory})
+			handleErr(err)
+			retired, err := repos.Devices.Create(ctx, NewDevice{SerialId: "ACC-000041", DeviceType: Accessory})
+			handleErr(err)
+
+			attachment, err := repos.Attachments.Attach(ctx, pmd.ID, sensor.ID, AttachmentChange{Actor: "tech", At: 1000})
+			assert.NoError(t, err)
+			assert.Equal(t, "ACC-000040", attachment.AccessorySerial)
+			assert.Equal(t, "PMD-000040", attachment.ParentSerial)
+			_, err = repos.Attachments.Attach(ctx, other.ID, sensor.ID, AttachmentChange{Actor: "tech", At: 1500})
+			assert.True(t, errors.Is(err, AlreadyExists))
+			_, err = repos.Attachments.Attach(ctx, pmd.ID, retired.ID, AttachmentChange{Actor: "tech", At: 1000})
+			assert.NoError(t, err)
+			_, err = repos.Devices.Decommission(ctx, "ACC-000041", StatusChange{Actor: "tech", At: 1200})
+			assert.NoError(t, err)
+
+			parent, err := repos.Attachments.Parent(ctx, sensor.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, pmd.ID, parent.ID)
+			accessories, err := repos.Attachments.Accessories(ctx, pmd.ID)
+			assert.NoError(t, err)
+			assert.Len(t, accessories, 2)
+
+			// Cascading reaches the attached accessories, but never brings back a decommissioned one
+			_, err = repos.Devices.UpdateStatus(ctx, "PMD-000040", StatusChange{Status: Suspended, Actor: "tech", At: 2000, CascadeAccessories: true})
+			assert.NoError(t, err)
+			found, _ := repos.Devices.GetByID(ctx, sensor.ID)
+			assert.Equal(t, Suspended, found.DeviceStatus)
+			found, _ = repos.Devices.GetByID(ctx, retired.ID)
+			assert.Equal(t, Decommissioned, found.DeviceStatus)
+			changes, err := repos.History.List(ctx, StatusHistoryQuery{DeviceID: sensor.ID, From: 2000, To: 2000})
+			assert.NoError(t, err)
+			assert.Len(t, changes, 1)
+
+			// Without cascading, only the PMD changes
+			_, err = repos.Devices.UpdateStatus(ctx, "PMD-000040", StatusChange{Status: Ok, Actor: "tech", At: 2500})
+			assert.NoError(t, err)
+			found, _ = repos.Devices.GetByID(ctx, sensor.ID)
+			assert.Equal(t, Suspended, found.DeviceStatus)
+
+			detached, err := repos.Attachments.Detach(ctx, sensor.ID, AttachmentChange{Actor: "tech", At: 3000})
+			assert.NoError(t, err)
+			assert.Equal(t, sql.NullString{String: "tech", Valid: true}, detached.DetachedBy)
+			_, err = repos.Attachments.Detach(ctx, sensor.ID, AttachmentChange{Actor: "tech", At: 3000})
+			assert.True(t, errors.Is(err, NotFound))
+			_, err = repos.Attachments.Parent(ctx, sensor.ID)
+			assert.True(t, errors.Is(err, NotFound))
+
+			_, err = repos.Attachments.Attach(ctx, other.ID, sensor.ID, AttachmentChange{Actor: "tech", At: 4000})
+			assert.NoError(t, err)
+			history, err := repos.Attachments.History(ctx, sensor.ID, 0, 5000)
+			assert.NoError(t, err)
+			if assert.Len(t, history, 2) {
+				assert.Equal(t, "PMD-000040", history[0].ParentSerial)
+				assert.Equal(t, "PMD-000041", history[1].ParentSerial)
+			}
+			history, err = repos.Attachments.History(ctx, sensor.ID, 3500, 5000)
+			assert.NoError(t, err)
+			assert.Len(t, history, 1)
+
+			// Measurements of an accessory are attributed to its parent, and found through the accessory too
+			_, err = repos.Measurements.Insert(ctx, NewMeasurement{
+				PublishingDeviceFk: other.ID,
+				AccessoryFk:        sql.NullInt64{Int64: int64(sensor.ID), Valid: true},
+				Value:              "21",
+				ValueType:          1,
+				ReceivedAt:         4500,
+			})
+			assert.NoError(t, err)
+			ofParent, err := repos.Measurements.Query(ctx, MeasurementQuery{DeviceID: other.ID, To: 5000})
+			assert.NoError(t, err)
+			assert.Len(t, ofParent, 1)
+			ofAccessory, err := repos.Measurements.Query(ctx, MeasurementQuery{DeviceID: sensor.ID, ByAccessory: true, To: 5000})
+			assert.NoError(t, err)
+			assert.Equal(t, ofParent, ofAccessory)
+
+			// Deleting the parent removes its attachments
+			assert.NoError(t, repos.Devices.Delete(ctx, "PMD-000041", true))
+			_, err = repos.Attachments.Parent(ctx, sensor.ID)
+			assert.True(t, errors.Is(err, NotFound))
+		})
+	}
+}
+
+func TestDeviceTypes(t *testing.T) {
+	ctx := context.Background()
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			deviceTypes, err := repos.DeviceTypes.List(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, BuiltinDeviceTypes(), deviceTypes)
+
+			created, err := repos.DeviceTypes.Create(ctx, NewDeviceType{
+				Name:             "air-sensor",
+				Role:             AccessoryRole,
+				SerialPattern:    "^AIR-[0-9]{6}$",
+				ValueTypes:       ValueTypes{1, 2},
+				HeartbeatTimeout: sql.NullInt64{Int64: 60_000, Valid: true},
+				DefaultStatus:    Suspended,
+			})
+			assert.NoError(t, err)
+			_, err = repos.DeviceTypes.Create(ctx, NewDeviceType{Name: "air-sensor", SerialPattern: ".*"})
+			assert.True(t, errors.Is(err, AlreadyExists))
+
+			created.ValueTypes = ValueTypes{3}
+			created.Description = sql.NullString{String: "Air quality", Valid: true}
+			updated, err := repos.DeviceTypes.Update(ctx, created)
+			assert.NoError(t, err)
+			deviceTypes, _ = repos.DeviceTypes.List(ctx)
+			if assert.Len(t, deviceTypes, 3) {
+				assert.Equal(t, updated, deviceTypes[2])
+				assert.Equal(t, ValueTypes{3}, deviceTypes[2].ValueTypes)
+			}
+
+			// A type used by a device can't be deleted
+			_, err = repos.Devices.Create(ctx, NewDevice{SerialId: "AIR-000001", DeviceType: created.ID})
+			handleErr(err)
+			assert.True(t, errors.Is(repos.DeviceTypes.Delete(ctx, created.ID), InUse))
+			assert.NoError(t, repos.Devices.Delete(ctx, "AIR-000001", false))
+			assert.NoError(t, repos.DeviceTypes.Delete(ctx, created.ID))
+			assert.True(t, errors.Is(repos.DeviceTypes.Delete(ctx, created.ID), NotFound))
+		})
+	}
+}
+
+func TestMeasurementTypes(t *testing.T) {
+	ctx := context.Background()
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			measurementTypes, err := repos.MeasurementTypes.List(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, BuiltinMeasurementTypes(), measurementTypes)
+
+			created, err := repos.MeasurementTypes.Create(ctx, NewMeasurementType{
+				Name:     "acceleration",
+				Encoding: VectorEncoding,
+				Unit:     "m/s²",
+				Max:      sql.NullFloat64{Float64: 20, Valid: true},
+			})
+			assert.NoError(t, err)
+			_, err = repos.MeasurementTypes.Create(ctx, NewMeasurementType{Name: "acceleration"})
+			assert.True(t, errors.Is(err, AlreadyExists))
+
+			created.Unit = "g"
+			created.Min = sql.NullFloat64{Float64: -2, Valid: true}
+			updated, err := repos.MeasurementTypes.Update(ctx, created)
+			assert.NoError(t, err)
+			measurementTypes, _ = repos.MeasurementTypes.List(ctx)
+			if assert.Len(t, measurementTypes, 2) {
+				assert.Equal(t, updated, measurementTypes[1])
+			}
+
+			// Vectors are stored, but never rolled up
+			device, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000050"})
+			handleErr(err)
+			_, err = repos.Measurements.Insert(ctx, NewMeasurement{
+				PublishingDeviceFk: device.ID, Value: "[1,2]", ValueType: created.ID, ReceivedAt: 1000,
+			})
+			handleErr(err)
+			assert.NoError(t, repos.Retention.Rollup(ctx, MinuteResolution, 0, MinuteResolution.Floor(120_000)))
+			rollups, err := repos.Measurements.QueryRollups(ctx, MeasurementQuery{DeviceID: device.ID, To: 120_000}, MinuteResolution)
+			assert.NoError(t, err)
+			assert.Empty(t, rollups)
+			// Bools are stored as a single character
+			_, err = repos.Measurements.Insert(ctx, NewMeasurement{
+				PublishingDeviceFk: device.ID, Value: "1", ValueType: GenericValueType, ReceivedAt: 200_000,
+			})
+			assert.NoError(t, err)
+
+			assert.True(t, errors.Is(repos.MeasurementTypes.Delete(ctx, created.ID), InUse))
+			assert.NoError(t, repos.Devices.Delete(ctx, "PMD-000050", true))
+			assert.NoError(t, repos.MeasurementTypes.Delete(ctx, created.ID))
+			assert.True(t, errors.Is(repos.MeasurementTypes.Delete(ctx, created.ID), NotFound))
+		})
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	ctx := context.Background()
+	first, second := strings.Repeat("a", 64), strings.Repeat("b", 64)
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			device, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000060"})
+			handleErr(err)
+
+			_, err = repos.Credentials.Rotate(ctx, device.ID+100, first, 1000, 1000)
+			assert.Error(t, err)
+			created, err := repos.Credentials.Rotate(ctx, device.ID, first, 1000, 1000)
+			assert.NoError(t, err)
+			assert.Equal(t, first, created.KeyHash)
+
+			// The rotated credential stays valid until the grace ends
+			rotated, err := repos.Credentials.Rotate(ctx, device.ID, second, 2000, 5000)
+			assert.NoError(t, err)
+			valid, err := repos.Credentials.Valid(ctx, device.ID, 4999)
+			assert.NoError(t, err)
+			if assert.Len(t, valid, 2) {
+				assert.Equal(t, rotated.ID, valid[0].ID)
+			}
+			valid, err = repos.Credentials.Valid(ctx, device.ID, 5000)
+			assert.NoError(t, err)
+			assert.Len(t, valid, 1)
+
+			credentials, err := repos.Credentials.List(ctx, device.ID)
+			assert.NoError(t, err)
+			if assert.Len(t, credentials, 2) {
+				assert.Equal(t, sql.NullInt64{Int64: 5000, Valid: true}, credentials[0].ExpiresAt)
+			}
+
+			assert.NoError(t, repos.Credentials.ReplaceKey(ctx, created.ID, "sealed:key"))
+			assert.True(t, errors.Is(repos.Credentials.ReplaceKey(ctx, rotated.ID+100, "sealed:key"), NotFound))
+			keys, err := repos.Credentials.Keys(ctx)
+			assert.NoError(t, err)
+			if assert.Len(t, keys, 2) {
+				assert.Equal(t, "sealed:key", keys[0].KeyHash)
+				assert.Equal(t, second, keys[1].KeyHash)
+			}
+
+			revoked, err := repos.Credentials.Revoke(ctx, device.ID, 6000)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), revoked)
+			valid, _ = repos.Credentials.Valid(ctx, device.ID, 6000)
+			assert.Empty(t, valid)
+
+			assert.NoError(t, repos.Devices.Delete(ctx, "PMD-000060", true))
+			credentials, err = repos.Credentials.List(ctx, device.ID)
+			assert.NoError(t, err)
+			assert.Empty(t, credentials)
+		})
+	}
+}
+
+func TestUsers(t *testing.T) {
+	ctx := context.Background()
+	first, second := strings.Repeat("a", 64), strings.Repeat("b", 64)
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := repos.Users.Create(ctx, NewUser{Username: "ana", PasswordHash: "hash", Role: OperatorRole, CreatedAt: 1000})
+			assert.NoError(t, err)
+			_, err = repos.Users.Create(ctx, NewUser{Username: "ana", PasswordHash: "hash", CreatedAt: 1000})
+			assert.True(t, errors.Is(err, AlreadyExists))
+			count, err := repos.Users.Count(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, uint(1), count)
+
+			found, err := repos.Users.GetByUsername(ctx, "ana")
+			assert.NoError(t, err)
+			assert.Equal(t, user, found)
+			_, err = repos.Users.GetByUsername(ctx, "missing")
+			assert.True(t, errors.Is(err, NotFound))
+
+			updated, err := repos.Users.Update(ctx, user.ID, AdminRole, sql.NullInt64{Int64: 2000, Valid: true})
+			assert.NoError(t, err)
+			assert.Equal(t, AdminRole, updated.Role)
+			assert.NoError(t, repos.Users.SetPassword(ctx, user.ID, "new-hash"))
+			assert.True(t, errors.Is(repos.Users.SetPassword(ctx, user.ID+100, "new-hash"), NotFound))
+			users, err := repos.Users.List(ctx)
+			assert.NoError(t, err)
+			if assert.Len(t, users, 1) {
+				assert.Equal(t, "new-hash", users[0].PasswordHash)
+				assert.Equal(t, sql.NullInt64{Int64: 2000, Valid: true}, users[0].DisabledAt)
+			}
+
+			// Sessions are valid until they expire or are revoked
+			_, err = repos.Sessions.Create(ctx, user.ID, first, 1000, 5000)
+			assert.NoError(t, err)
+			_, err = repos.Sessions.Create(ctx, user.ID, second, 1000, 5000)
+			assert.NoError(t, err)
+			session, err := repos.Sessions.Valid(ctx, first, 4999)
+			assert.NoError(t, err)
+			assert.Equal(t, user.ID, session.UserFk)
+			_, err = repos.Sessions.Valid(ctx, first, 5000)
+			assert.True(t, errors.Is(err, NotFound))
+
+			assert.NoError(t, repos.Sessions.Revoke(ctx, first, 2000))
+			assert.True(t, errors.Is(repos.Sessions.Revoke(ctx, first, 2000), NotFound))
+			_, err = repos.Sessions.Valid(ctx, first, 3000)
+			assert.True(t, errors.Is(err, NotFound))
+			revoked, err := repos.Sessions.RevokeAll(ctx, user.ID, 3000)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), revoked)
+
+			for i, actor := range []string{"ana", "rui", "ana"} {
+				assert.NoError(t, repos.Audit.Record(ctx, AuditEntry{
+					Actor: actor, Action: "PUT /api/v1/devices/pmd/status/", StatusCode: 200, At: int64(1000 * (i + 1)),
+				}))
+			}
+			entries, err := repos.Audit.List(ctx, AuditQuery{Actor: "ana", From: 0, To: 5000})
+			assert.NoError(t, err)
+			if assert.Len(t, entries, 2) {
+				assert.Equal(t, int64(3000), entries[0].At)
+			}
+			entries, err = repos.Audit.List(ctx, AuditQuery{From: 1500, To: 5000, Limit: 1})
+			assert.NoError(t, err)
+			if assert.Len(t, entries, 1) {
+				assert.Equal(t, "ana", entries[0].Actor)
+				assert.Equal(t, int64(3000), entries[0].At)
+			}
+		})
+	}
+}
+
+func TestClaimCodes(t *testing.T) {
+	ctx := context.Background()
+	first, second := strings.Repeat("a", 64), strings.Repeat("b", 64)
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			deviceType, err := repos.DeviceTypes.Create(ctx, NewDeviceType{Name: "field-pmd", SerialPattern: ".*"})
+			handleErr(err)
+
+			code, err := repos.ClaimCodes.Create(ctx, NewClaimCode{
+				CodeHash: first, DeviceType: deviceType.ID, RequiresApproval: true,
+				CreatedBy: "ana", CreatedAt: 1000, ExpiresAt: 5000,
+			})
+			assert.NoError(t, err)
+			assert.True(t, code.UsableAt(1000))
+			_, err = repos.ClaimCodes.Create(ctx, NewClaimCode{CodeHash: first, DeviceType: deviceType.ID, CreatedAt: 1000, ExpiresAt: 5000})
+			assert.True(t, errors.Is(err, AlreadyExists))
+
+			// An expired code can't be claimed, and a claimed one can't be claimed again
+			_, err = repos.ClaimCodes.Claim(ctx, first, "PMD-000070", 5000)
+			assert.True(t, errors.Is(err, NotFound))
+			claimed, err := repos.ClaimCodes.Claim(ctx, first, "PMD-000070", 2000)
+			assert.NoError(t, err)
+			assert.Equal(t, sql.NullString{String: "PMD-000070", Valid: true}, claimed.ClaimedBy)
+			assert.True(t, claimed.RequiresApproval)
+			_, err = repos.ClaimCodes.Claim(ctx, first, "PMD-000071", 2000)
+			assert.True(t, errors.Is(err, NotFound))
+			_, err = repos.ClaimCodes.Revoke(ctx, code.ID, 2000)
+			assert.True(t, errors.Is(err, NotFound))
+
+			// A released code can be claimed again
+			assert.NoError(t, repos.ClaimCodes.Release(ctx, code.ID))
+			_, err = repos.ClaimCodes.Claim(ctx, first, "PMD-000071", 3000)
+			assert.NoError(t, err)
+
+			other, err := repos.ClaimCodes.Create(ctx, NewClaimCode{CodeHash: second, DeviceType: deviceType.ID, CreatedAt: 1000, ExpiresAt: 5000})
+			handleErr(err)
+			revoked, err := repos.ClaimCodes.Revoke(ctx, other.ID, 2000)
+			assert.NoError(t, err)
+			assert.Equal(t, sql.NullInt64{Int64: 2000, Valid: true}, revoked.RevokedAt)
+			_, err = repos.ClaimCodes.Claim(ctx, second, "PMD-000072", 2000)
+			assert.True(t, errors.Is(err, NotFound))
+
+			codes, err := repos.ClaimCodes.List(ctx)
+			assert.NoError(t, err)
+			if assert.Len(t, codes, 2) {
+				assert.Equal(t, code.ID, codes[0].ID)
+				assert.Equal(t, sql.NullString{String: "PMD-000071", Valid: true}, codes[0].ClaimedBy)
+			}
+
+			// Deleting the type deletes its codes
+			assert.NoError(t, repos.DeviceTypes.Delete(ctx, deviceType.ID))
+			codes, _ = repos.ClaimCodes.List(ctx)
+			assert.Empty(t, codes)
+		})
+	}
+}
+
+func TestCommands(t *testing.T) {
+	ctx := context.Background()
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			device, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000080"})
+			handleErr(err)
+
+			reboot, err := repos.Commands.Create(ctx, NewCommand{
+				DeviceFk: device.ID, Name: "reboot", MaxAttempts: 2, CreatedBy: "ana", CreatedAt: 1000, ExpiresAt: 10_000,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, Queued, reboot.Status)
+			sampling, err := repos.Commands.Create(ctx, NewCommand{
+				DeviceFk: device.ID, Name: "set-sampling-rate", Payload: RawJSON(`{"interval_ms":5000}`),
+				MaxAttempts: 1, CreatedBy: "ana", CreatedAt: 1000, ExpiresAt: 3000,
+			})
+			assert.NoError(t, err)
+
+			delivered, err := repos.Commands.Deliver(ctx, device.ID, "PMD-000080", 2000, 1000)
+			assert.NoError(t, err)
+			if assert.Len(t, delivered, 2) {
+				assert.Equal(t, reboot.ID, delivered[0].ID)
+				assert.Equal(t, uint(1), delivered[0].Attempts)
+				assert.JSONEq(t, `{"interval_ms":5000}`, string(delivered[1].Payload))
+			}
+			// Not acknowledged, but not for long enough
+			delivered, _ = repos.Commands.Deliver(ctx, device.ID, "PMD-000080", 2500, 1999)
+			assert.Empty(t, delivered)
+			// Only the command with attempts left is delivered again
+			delivered, _ = repos.Commands.Deliver(ctx, device.ID, "PMD-000080", 2500, 2000)
+			if assert.Len(t, delivered, 1) {
+				assert.Equal(t, uint(2), delivered[0].Attempts)
+			}
+
+			// The sampling rate was never acknowledged, and the reboot expires
+			changed, err := repos.Commands.Sweep(ctx, 2600, 2000)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), changed)
+			failed, _ := repos.Commands.Get(ctx, sampling.ID)
+			assert.Equal(t, Failed, failed.Status)
+
+			// A done command doesn't change anymore
+			_, err = repos.Commands.Change(ctx, sampling.ID, []CommandStatus{Queued, Delivered}, CommandChange{Status: Cancelled, At: 2700})
+			assert.True(t, errors.Is(err, NotFound))
+			acknowledged, err := repos.Commands.Change(ctx, reboot.ID, []CommandStatus{Delivered}, CommandChange{
+				Status: Succeeded, Actor: "PMD-000080", Result: RawJSON(`{"uptime":0}`), At: 2700,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, sql.NullInt64{Int64: 2700, Valid: true}, acknowledged.CompletedAt)
+			assert.JSONEq(t, `{"uptime":0}`, string(acknowledged.Result))
+
+			commands, err := repos.Commands.List(ctx, CommandQuery{DeviceID: device.ID, Statuses: []CommandStatus{Succeeded}})
+			assert.NoError(t, err)
+			if assert.Len(t, commands, 1) {
+				assert.Equal(t, reboot.ID, commands[0].ID)
+			}
+			commands, _ = repos.Commands.List(ctx, CommandQuery{DeviceID: device.ID, Limit: 1})
+			if assert.Len(t, commands, 1) {
+				assert.Equal(t, sampling.ID, commands[0].ID)
+			}
+
+			history, err := repos.Commands.History(ctx, reboot.ID)
+			assert.NoError(t, err)
+			if assert.Len(t, history, 4) {
+				assert.Nil(t, history[0].OldStatus)
+				assert.Equal(t, "ana", history[0].Actor)
+				assert.Equal(t, "attempt 2", history[2].Detail.String)
+				assert.Equal(t, Succeeded, history[3].NewStatus)
+			}
+
+			// Queued commands expire
+			expiring, _ := repos.Commands.Create(ctx, NewCommand{
+				DeviceFk: device.ID, Name: "self-test", MaxAttempts: 1, CreatedBy: "ana", CreatedAt: 1000, ExpiresAt: 3000,
+			})
+			changed, _ = repos.Commands.Sweep(ctx, 3000, 0)
+			assert.Equal(t, int64(1), changed)
+			expired, _ := repos.Commands.Get(ctx, expiring.ID)
+			assert.Equal(t, Expired, expired.Status)
+
+			assert.NoError(t, repos.Devices.Delete(ctx, "PMD-000080", true))
+			_, err = repos.Commands.Get(ctx, reboot.ID)
+			assert.True(t, errors.Is(err, NotFound))
+			history, _ = repos.Commands.History(ctx, reboot.ID)
+			assert.Empty(t, history)
+		})
+	}
+}
+
+func TestShadows(t *testing.T) {
+	ctx := context.Background()
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			device, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000081"})
+			handleErr(err)
+
+			shadow, err := repos.Shadows.Get(ctx, device.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, Shadow{DeviceFk: device.ID}, shadow)
+
+			shadow, err = repos.Shadows.SetDesired(ctx, device.ID, 0, RawJSON(`{"interval_ms":1000}`), "ana", 100)
+			assert.NoError(t, err)
+			assert.Equal(t, uint(1), shadow.DesiredVersion)
+			assert.Equal(t, "ana", shadow.DesiredBy.String)
+			// Changed since version 0 was read
+			_, err = repos.Shadows.SetDesired(ctx, device.ID, 0, RawJSON(`{"interval_ms":2000}`), "rui", 200)
+			assert.True(t, errors.Is(err, NotFound))
+
+			shadow, err = repos.Shadows.SetReported(ctx, device.ID, 0, RawJSON(`{"interval_ms":1000,"firmware":"1.2"}`), 300)
+			assert.NoError(t, err)
+			assert.Equal(t, uint(1), shadow.ReportedVersion)
+			assert.Equal(t, uint(1), shadow.DesiredVersion)
+			_, err = repos.Shadows.SetReported(ctx, device.ID, 5, nil, 400)
+			assert.True(t, errors.Is(err, NotFound))
+			shadow, err = repos.Shadows.SetDesired(ctx, device.ID, 1, nil, "rui", 500)
+			assert.NoError(t, err)
+			assert.Nil(t, shadow.Desired)
+
+			shadows, err := repos.Shadows.List(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, []Shadow{shadow}, shadows)
+
+			template, err := repos.Shadows.GetTemplate(ctx, PMD)
+			assert.NoError(t, err)
+			assert.Equal(t, uint(0), template.Version)
+			template, err = repos.Shadows.SetTemplate(ctx, PMD, 0, RawJSON(`{"display":"on"}`), "ana", 600)
+			assert.NoError(t, err)
+			assert.Equal(t, uint(1), template.Version)
+			_, err = repos.Shadows.SetTemplate(ctx, PMD, 0, RawJSON(`{}`), "ana", 700)
+			assert.True(t, errors.Is(err, NotFound))
+			templates, err := repos.Shadows.ListTemplates(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, []ShadowTemplate{template}, templates)
+
+			// The shadow goes with its device, the template with its type
+			assert.NoError(t, repos.Devices.Delete(ctx, "PMD-000081", true))
+			shadows, _ = repos.Shadows.List(ctx)
+			assert.Empty(t, shadows)
+			deviceType, err := repos.DeviceTypes.Create(ctx, NewDeviceType{Name: "shadowed", SerialPattern: "^SHD-[0-9]+$"})
+			handleErr(err)
+			_, err = repos.Shadows.SetTemplate(ctx, deviceType.ID, 0, RawJSON(`{"display":"off"}`), "ana", 800)
+			assert.NoError(t, err)
+			assert.NoError(t, repos.DeviceTypes.Delete(ctx, deviceType.ID))
+			templates, _ = repos.Shadows.ListTemplates(ctx)
+			assert.Len(t, templates, 1)
+		})
+	}
+}
+
+func TestFirmware(t *testing.T) {
+	ctx := context.Background()
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			first, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000091"})
+			handleErr(err)
+			second, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000092"})
+			handleErr(err)
+
+			firmware, err := repos.Firmware.Create(ctx, NewFirmware{
+				DeviceType: PMD, Version: "1.2.0", Size: 1024, SHA256: "aa", UploadedBy: "ana", UploadedAt: 100,
+			})
+			assert.NoError(t, err)
+			_, err = repos.Firmware.Create(ctx, NewFirmware{DeviceType: PMD, Version: "1.2.0", SHA256: "bb", UploadedBy: "rui"})
+			assert.True(t, errors.Is(err, AlreadyExists))
+			got, err := repos.Firmware.Get(ctx, firmware.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, firmware, got)
+
+			rollout, err := repos.Firmware.CreateRollout(ctx, NewRollout{
+				FirmwareFk: firmware.ID, FailureThreshold: 0.2, MinReports: 1, CreatedBy: "ana", CreatedAt: 200,
+			}, []uint{first.ID})
+			assert.NoError(t, err)
+			assert.Equal(t, RolloutActive, rollout.Status)
+			assert.Equal(t, "1.2.0", rollout.Version)
+			assert.Equal(t, uint(1), rollout.Devices)
+
+			// A device out of the listed ones is added once offered the update
+			_, err = repos.Firmware.AddRolloutDevice(ctx, rollout.ID, first.ID, UpdateOffered, 300)
+			assert.True(t, errors.Is(err, AlreadyExists))
+			added, err := repos.Firmware.AddRolloutDevice(ctx, rollout.ID, second.ID, UpdateOffered, 300)
+			assert.NoError(t, err)
+			assert.Equal(t, "PMD-000092", added.SerialId)
+
+			failed := sql.NullString{String: "checksum mismatch", Valid: true}
+			changed, err := repos.Firmware.ChangeRolloutDevice(ctx, rollout.ID, second.ID,
+				[]UpdateStatus{UpdateOffered, UpdateDownloading}, UpdateFailed, failed, 400)
+			assert.NoError(t, err)
+			assert.Equal(t, UpdateFailed, changed.Status)
+			_, err = repos.Firmware.ChangeRolloutDevice(ctx, rollout.ID, second.ID,
+				[]UpdateStatus{UpdateOffered, UpdateDownloading}, UpdateInstalled, sql.NullString{}, 500)
+			assert.True(t, errors.Is(err, NotFound))
+			_, err = repos.Firmware.ChangeRolloutDevice(ctx, rollout.ID, first.ID,
+				[]UpdateStatus{UpdatePending}, UpdateInstalled, sql.NullString{}, 500)
+			assert.NoError(t, err)
+
+			devices, err := repos.Firmware.RolloutDevices(ctx, rollout.ID)
+			assert.NoError(t, err)
+			if assert.Len(t, devices, 2) {
+				assert.Equal(t, "PMD-000091", devices[0].SerialId)
+				assert.Equal(t, "checksum mismatch", devices[1].Detail.String)
+			}
+			rollout, err = repos.Firmware.GetRollout(ctx, rollout.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, []uint{2, 1, 1}, []uint{rollout.Devices, rollout.Installed, rollout.Failed})
+
+			// In progress, the rollout keeps its firmware, and the firmware its type
+			assert.True(t, errors.Is(repos.Firmware.Delete(ctx, firmware.ID), InUse))
+			assert.True(t, errors.Is(repos.DeviceTypes.Delete(ctx, PMD), InUse))
+			pause := RolloutChange{Status: RolloutPaused, Actor: "ana", Reason: sql.NullString{String: "checking", Valid: true}, At: 600}
+			rollout, err = repos.Firmware.ChangeRollout(ctx, rollout.ID, []RolloutStatus{RolloutActive}, pause)
+			assert.NoError(t, err)
+			assert.Equal(t, "checking", rollout.Reason.String)
+			_, err = repos.Firmware.ChangeRollout(ctx, rollout.ID, []RolloutStatus{RolloutActive}, pause)
+			assert.True(t, errors.Is(err, NotFound))
+			_, err = repos.Firmware.ChangeRollout(ctx, rollout.ID, []RolloutStatus{RolloutActive, RolloutPaused},
+				RolloutChange{Status: RolloutCancelled, Actor: "ana", At: 700})
+			assert.NoError(t, err)
+
+			// The devices of a rollout go with their device, the rollouts with their firmware
+			assert.NoError(t, repos.Devices.Delete(ctx, "PMD-000092", true))
+			devices, _ = repos.Firmware.RolloutDevices(ctx, rollout.ID)
+			assert.Len(t, devices, 1)
+			assert.NoError(t, repos.Firmware.Delete(ctx, firmware.ID))
+			rollouts, err := repos.Firmware.ListRollouts(ctx)
+			assert.NoError(t, err)
+			assert.Empty(t, rollouts)
+			_, err = repos.Firmware.Get(ctx, firmware.ID)
+			assert.True(t, errors.Is(err, NotFound))
+		})
+	}
+}
+
+func TestClocks(t *testing.T) {
+	ctx := context.Background()
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			device, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000091"})
+			handleErr(err)
+
+			_, err = repos.Clocks.Get(ctx, device.ID)
+			assert.True(t, errors.Is(err, NotFound))
+
+			clock, err := repos.Clocks.Record(ctx, DeviceClock{DeviceFk: device.ID, OffsetMicros: 2500, RoundTripMicros: 900, SyncedAt: 100})
+			assert.NoError(t, err)
+			assert.Equal(t, "PMD-000091", clock.SerialId)
+			assert.Equal(t, uint(1), clock.Samples)
+			clock, err = repos.Clocks.Record(ctx, DeviceClock{DeviceFk: device.ID, OffsetMicros: -300, RoundTripMicros: 400, SyncedAt: 200})
+			assert.NoError(t, err)
+			assert.Equal(t, DeviceClock{
+				DeviceFk: device.ID, SerialId: "PMD-000091", OffsetMicros: -300, RoundTripMicros: 400, Samples: 2, SyncedAt: 200,
+			}, clock)
+
+			clocks, err := repos.Clocks.List(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, []DeviceClock{clock}, clocks)
+
+			// The clock goes with its device
+			assert.NoError(t, repos.Devices.Delete(ctx, "PMD-000091", true))
+			clocks, _ = repos.Clocks.List(ctx)
+			assert.Empty(t, clocks)
+		})
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	ctx := context.Background()
+
+	for name, repos := range testedRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			device, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000092"})
+			handleErr(err)
+			other, err := repos.Devices.Create(ctx, NewDevice{SerialId: "PMD-000093"})
+			handleErr(err)
+
+			everyDevice, err := repos.Alerts.CreateRule(ctx, NewAlertRule{
+				Name: "too-hot", Kind: ThresholdAlert, ValueType: sql.NullInt64{Int64: int64(GenericValueType), Valid: true},
+				Threshold: 30, CreatedBy: "ana", CreatedAt: 10,
+			})
+			assert.NoError(t, err)
+			assert.False(t, everyDevice.SerialId.Valid)
+			_, err = repos.Alerts.CreateRule(ctx, NewAlertRule{Name: "too-hot", CreatedBy: "ana"})
+			assert.True(t, errors.Is(err, AlreadyExists))
+			scoped, err := repos.Alerts.CreateRule(ctx, NewAlertRule{
+				Name: "quiet", Kind: AbsenceAlert, DeviceFk: sql.NullInt64{Int64: int64(device.ID), Valid: true},
+				WindowMillis: 60_000, CreatedBy: "ana", CreatedAt: 20,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "PMD-000092", scoped.SerialId.String)
+			rules, err := repos.Alerts.ListRules(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, []AlertRule{everyDevice, scoped}, rules)
+
+			// A single alert open per rule and device
+			fired, err := repos.Alerts.Fire(ctx, NewAlert{RuleFk: everyDevice.ID, DeviceFk: device.ID, Detail: "31 above 30", FiredAt: 100})
+			assert.NoError(t, err)
+			assert.Equal(t, AlertFiring, fired.State)
+			assert.Equal(t, "too-hot", fired.RuleName)
+			assert.Equal(t, "PMD-000092", fired.SerialId)
+			_, err = repos.Alerts.Fire(ctx, NewAlert{RuleFk: everyDevice.ID, DeviceFk: device.ID, Detail: "32 above 30", FiredAt: 110})
+			assert.True(t, errors.Is(err, AlreadyExists))
+			_, err = repos.Alerts.Fire(ctx, NewAlert{RuleFk: everyDevice.ID, DeviceFk: other.ID, Detail: "35 above 30", FiredAt: 120})
+			assert.NoError(t, err)
+			_, err = repos.Alerts.Fire(ctx, NewAlert{RuleFk: scoped.ID, DeviceFk: device.ID, Detail: "quiet for 1m", FiredAt: 130})
+			assert.NoError(t, err)
+
+			acknowledged, err := repos.Alerts.Acknowledge(ctx, fired.ID, "rui", 140)
+			assert.NoError(t, err)
+			assert.Equal(t, AlertAcknowledged, acknowledged.State)
+			assert.Equal(t, "rui", acknowledged.AcknowledgedBy.String)
+			_, err = repos.Alerts.Acknowledge(ctx, fired.ID, "rui", 150)
+			assert.True(t, errors.Is(err, NotFound))
+
+			resolved, err := repos.Alerts.Resolve(ctx, everyDevice.ID, device.ID, 160)
+			assert.NoError(t, err)
+			assert.Equal(t, AlertResolved, resolved.State)
+			assert.Equal(t, int64(160), resolved.ResolvedAt.Int64)
+			_, err = repos.Alerts.Resolve(ctx, everyDevice.ID, device.ID, 170)
+			assert.True(t, errors.Is(err, NotFound))
+			// Resolved, the rule fires again for the device
+			_, err = repos.Alerts.Fire(ctx, NewAlert{RuleFk: everyDevice.ID, DeviceFk: device.ID, Detail: "33 above 30", FiredAt: 180})
+			assert.NoError(t, err)
+
+			alerts, err := repos.Alerts.List(ctx, AlertQuery{})
+			assert.NoError(t, err)
+			assert.Len(t, alerts, 4)
+			open, err := repos.Alerts.List(ctx, AlertQuery{Open: true, DeviceID: device.ID})
+			assert.NoError(t, err)
+			assert.Len(t, open, 2)
+			state := AlertResolved
+			closed, err := repos.Alerts.List(ctx, AlertQuery{State: &state})
+			assert.NoError(t, err)
+			assert.Equal(t, []Alert{resolved}, closed)
+			latest, err := repos.Alerts.List(ctx, AlertQuery{Limit: 1})
+			assert.NoError(t, err)
+			if assert.Len(t, latest, 1) {
+				assert.Equal(t, int64(180), latest[0].FiredAt)
+			}
+
+			// In use by a rule, the measurement type can't be deleted
+			err = repos.MeasurementTypes.Delete(ctx, GenericValueType)
+			assert.True(t, errors.Is(err, InUse))
+
+			// The rule scoped to the device goes with it, along with the alerts of the device
+			assert.NoError(t, repos.Devices.Delete(ctx, "PMD-000092", true))
+			rules, _ = repos.Alerts.ListRules(ctx)
+			assert.Equal(t, []AlertRule{everyDevice}, rules)
+			alerts, _ = repos.Alerts.List(ctx, AlertQuery{})
+			assert.Len(t, alerts, 1)
+
+			assert.NoError(t, repos.Alerts.DeleteRule(ctx, everyDevice.ID))
+			alerts, _ = repos.Alerts.List(ctx, AlertQuery{})
+			assert.Empty(t, alerts)
+			assert.True(t, errors.Is(repos.Alerts.DeleteRule(ctx, everyDevice.ID), NotFound))
+		})
+	}
+}
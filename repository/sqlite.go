@@ -0,0 +1,452 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+/*
+sqliteError maps the errors returned by the sqlite driver into a RepositoryError,
+so the callers never need to know about the driver being used.
+*/
+func sqliteError(err error, message string) *RepositoryError {
+	if errors.Is(err, sql.ErrNoRows) {
+		return NewRepositoryError(NotFound, "no matching rows", message)
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return NewRepositoryError(AlreadyExists, "unique constraint failed", message)
+	}
+	if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint {
+		return NewRepositoryError(ConstraintFailed, err.Error(), message)
+	}
+
+	slog.Error("repository-sqlite", "query-failure", message, "cause", err.Error())
+	return NewRepositoryError(QueryFailed, err.Error(), message)
+}
+
+// ---------------------------------------------------
+
+const (
+	deviceColumns = `pk, device_type, serial_id, device_status, description, decommissioned_at,
+		last_seen_at, connectivity`
+
+	insertDeviceQuery = `
+		INSERT INTO device (device_type, serial_id, device_status, description)
+		VALUES (:device_type, :serial_id, :device_status, :description)
+		RETURNING pk`
+	deviceByIDQuery     = `SELECT ` + deviceColumns + ` FROM device WHERE pk = :pk`
+	deviceBySerialQuery = `SELECT ` + deviceColumns + ` FROM device WHERE serial_id = :serial_id`
+	listDevicesQuery    = `SELECT ` + deviceColumns + ` FROM device ORDER BY pk`
+
+	currentStatusQuery      = `SELECT pk, device_status FROM device WHERE serial_id = :serial_id`
+	updateDeviceStatusQuery = `UPDATE device SET device_status = :device_status WHERE pk = :pk`
+	decommissionDeviceQuery = `
+		UPDATE device SET device_status = :device_status,
+			decommissioned_at = COALESCE(decommissioned_at, :changed_at)
+		WHERE pk = :pk`
+	insertStatusHistoryQuery = `
+		INSERT INTO device_status_history (device_fk, old_status, new_status, actor, reason, changed_at)
+		VALUES (:device_fk, :old_status, :new_status, :actor, :reason, :changed_at)`
+	deviceKeyQuery   = `SELECT pk FROM device WHERE serial_id = :serial_id`
+	deviceInUseQuery = `
+		SELECT EXISTS (SELECT 1 FROM device_measurement WHERE publishing_device_fk = :pk)
+			OR EXISTS (SELECT 1 FROM device_measurement_rollup WHERE publishing_device_fk = :pk)`
+	// The schema cascades too, these keep a db opened without foreign keys consistent
+	deleteDeviceMeasurementsQuery   = `DELETE FROM device_measurement WHERE publishing_device_fk = :pk`
+	deleteDeviceRollupsQuery        = `DELETE FROM device_measurement_rollup WHERE publishing_device_fk = :pk`
+	deleteDeviceHistoryQuery        = `DELETE FROM device_status_history WHERE device_fk = :pk`
+	deleteDeviceAttachmentsQuery    = `DELETE FROM device_attachment WHERE accessory_fk = :pk OR parent_fk = :pk`
+	deleteDeviceCredentialsQuery    = `DELETE FROM device_credential WHERE device_fk = :pk`
+	deleteDeviceCommandHistoryQuery = `
+		DELETE FROM device_command_history WHERE command_fk IN (SELECT pk FROM device_command WHERE device_fk = :pk)`
+	deleteDeviceCommandsQuery = `DELETE FROM device_command WHERE device_fk = :pk`
+	deleteDeviceShadowQuery   = `DELETE FROM device_shadow WHERE device_fk = :pk`
+	deleteDeviceRolloutsQuery = `DELETE FROM firmware_rollout_device WHERE device_fk = :pk`
+	deleteDeviceClockQuery    = `DELETE FROM device_clock WHERE device_fk = :pk`
+	// The rules scoped to the device go with it, along with their alerts for any device
+	deleteDeviceAlertsQuery = `
+		DELETE FROM alert WHERE device_fk = :pk OR rule_fk IN (SELECT pk FROM alert_rule WHERE device_fk = :pk)`
+	deleteDeviceAlertRulesQuery = `DELETE FROM alert_rule WHERE device_fk = :pk`
+	deleteDeviceQuery           = `DELETE FROM device WHERE pk = :pk`
+	attachedStatusesQuery       = `
+		SELECT pk, device_status FROM device
+		WHERE pk IN (SELECT accessory_fk FROM device_attachment WHERE parent_fk = :pk AND detached_at IS NULL)
+		ORDER BY pk`
+
+	markSeenQuery = `
+		UPDATE device SET last_seen_at = MAX(COALESCE(last_seen_at, 0), :last_seen_at)
+		WHERE pk = :pk`
+	setConnectivityQuery = `UPDATE device SET connectivity = :connectivity WHERE pk = :pk`
+)
+
+type SqliteDeviceRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteDeviceRepository(db *SqliteDB) (*SqliteDeviceRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, insertDeviceQuery, currentStatusQuery, updateDeviceStatusQuery,
+			decommissionDeviceQuery, insertStatusHistoryQuery, deviceKeyQuery, deviceInUseQuery, deleteDeviceMeasurementsQuery, deleteDeviceRollupsQuery, deleteDeviceHistoryQuery,
+			deleteDeviceAttachmentsQuery, deleteDeviceCredentialsQuery, deleteDeviceCommandHistoryQuery, deleteDeviceCommandsQuery,
+			deleteDeviceShadowQuery, deleteDeviceRolloutsQuery, deleteDeviceClockQuery, deleteDeviceAlertsQuery,
+			deleteDeviceAlertRulesQuery, deleteDeviceQuery, attachedStatusesQuery, markSeenQuery, setConnectivityQuery),
+		db.Prepare(ReadPool, deviceByIDQuery, deviceBySerialQuery, listDevicesQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SqliteDeviceRepository{db}, nil
+}
+
+func (repo *SqliteDeviceRepository) Create(ctx context.Context, device NewDevice) (Device, error) {
+	var id uint
+	err := repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		if err := tx.get(ctx, insertDeviceQuery, &id, device); err != nil {
+			return err
+		}
+		// The status the device starts with opens its history
+		_, err := tx.exec(ctx, insertStatusHistoryQuery, map[string]any{
+			"device_fk":  id,
+			"old_status": nil,
+			"new_status": device.DeviceStatus,
+			"actor":      RegistrationActor,
+			"reason":     nil,
+			"changed_at": time.Now().UnixMilli(),
+		})
+		return err
+	})
+	if err != nil {
+		return Device{}, sqliteError(err, "failed to create the device")
+	}
+	return Device{ID: id, NewDevice: device}, nil
+}
+
+func (repo *SqliteDeviceRepository) GetByID(ctx context.Context, id uint) (device Device, err error) {
+	if err = repo.db.get(ctx, ReadPool, deviceByIDQuery, &device, map[string]any{"pk": id}); err != nil {
+		return Device{}, sqliteError(err, "failed to get the device by id")
+	}
+	return
+}
+
+func (repo *SqliteDeviceRepository) GetBySerial(ctx context.Context, serialId string) (device Device, err error) {
+	err = repo.db.get(ctx, ReadPool, deviceBySerialQuery, &device, map[string]any{"serial_id": serialId})
+	if err != nil {
+		return Device{}, sqliteError(err, "failed to get the device by serial id")
+	}
+	return
+}
+
+func (repo *SqliteDeviceRepository) List(ctx context.Context) (devices []Device, err error) {
+	devices = []Device{}
+	if err = repo.db.selectAll(ctx, ReadPool, listDevicesQuery, &devices, map[string]any{}); err != nil {
+		return nil, sqliteError(err, "failed to list the devices")
+	}
+	return
+}
+
+func (repo *SqliteDeviceRepository) UpdateStatus(ctx context.Context, serialId string, change StatusChange) (Device, error) {
+	err := repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		return changeStatus(ctx, tx, serialId, change, updateDeviceStatusQuery)
+	})
+	if err != nil {
+		return Device{}, sqliteError(err, "failed to update the device status")
+	}
+	return repo.GetBySerial(ctx, serialId)
+}
+
+func (repo *SqliteDeviceRepository) Decommission(ctx context.Context, serialId string, change StatusChange) (Device, error) {
+	change.Status = Decommissioned
+	err := repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		return changeStatus(ctx, tx, serialId, change, decommissionDeviceQuery)
+	})
+	if err != nil {
+		return Device{}, sqliteError(err, "failed to decommission the device")
+	}
+	return repo.GetBySerial(ctx, serialId)
+}
+
+type deviceStatus struct {
+	ID     uint         `db:"pk"`
+	Status DeviceStatus `db:"device_status"`
+}
+
+/*
+changeStatus runs the update query and records the change, unless the device already has
+the status, and when cascading, does the same for the accessories attached to the device.
+*/
+func changeStatus(ctx context.Context, tx *SqliteTx, serialId string, change StatusChange, updateQuery string) error {
+	var current deviceStatus
+	if err := tx.get(ctx, currentStatusQuery, &current, map[string]any{"serial_id": serialId}); err != nil {
+		return err
+	}
+	if err := applyStatus(ctx, tx, current, change, updateQuery); err != nil {
+		return err
+	}
+	if !change.CascadeAccessories {
+		return nil
+	}
+
+	accessories := []deviceStatus{}
+	if err := tx.selectAll(ctx, attachedStatusesQuery, &accessories, map[string]any{"pk": current.ID}); err != nil {
+		return err
+	}
+	for _, accessory := range accessories {
+		// A decommissioned accessory is never brought back by its parent, nor a pending one approved
+		if accessory.Status == Decommissioned || accessory.Status == Pending {
+			continue
+		}
+		if err := applyStatus(ctx, tx, accessory, change, updateQuery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyStatus(ctx context.Context, tx *SqliteTx, current deviceStatus, change StatusChange, updateQuery string) error {
+	if current.Status == change.Status {
+		return nil
+	}
+
+	arguments := map[string]any{
+		"pk":            current.ID,
+		"device_status": change.Status,
+		"device_fk":     current.ID,
+		"old_status":    current.Status,
+		"new_status":    change.Status,
+		"actor":         change.Actor,
+		"reason":        change.Reason,
+		"changed_at":    change.At,
+	}
+	if _, err := tx.exec(ctx, updateQuery, arguments); err != nil {
+		return err
+	}
+	_, err := tx.exec(ctx, insertStatusHistoryQuery, arguments)
+	return err
+}
+
+func (repo *SqliteDeviceRepository) Delete(ctx context.Context, serialId string, cascade bool) error {
+	err := repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		var pk uint
+		if err := tx.get(ctx, deviceKeyQuery, &pk, map[string]any{"serial_id": serialId}); err != nil {
+			return err
+		}
+		key := map[string]any{"pk": pk}
+
+		if !cascade {
+			var inUse bool
+			if err := tx.get(ctx, deviceInUseQuery, &inUse, key); err != nil {
+				return err
+			}
+			if inUse {
+				return NewRepositoryError(InUse, "device has measurements", "failed to delete the device")
+			}
+		}
+
+		for _, query := range []string{
+			deleteDeviceMeasurementsQuery, deleteDeviceRollupsQuery, deleteDeviceHistoryQuery,
+			deleteDeviceAttachmentsQuery, deleteDeviceCredentialsQuery, deleteDeviceCommandHistoryQuery,
+			deleteDeviceCommandsQuery, deleteDeviceShadowQuery, deleteDeviceRolloutsQuery, deleteDeviceClockQuery,
+			deleteDeviceAlertsQuery, deleteDeviceAlertRulesQuery, deleteDeviceQuery,
+		} {
+			if _, err := tx.exec(ctx, query, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	var repositoryErr *RepositoryError
+	if errors.As(err, &repositoryErr) {
+		return repositoryErr
+	}
+	if err != nil {
+		return sqliteError(err, "failed to delete the device")
+	}
+	return nil
+}
+
+func (repo *SqliteDeviceRepository) MarkSeen(ctx context.Context, seen map[uint]int64) error {
+	err := repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		for id, lastSeenAt := range seen {
+			if _, err := tx.exec(ctx, markSeenQuery, map[string]any{"pk": id, "last_seen_at": lastSeenAt}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return sqliteError(err, "failed to mark the devices as seen")
+	}
+	return nil
+}
+
+func (repo *SqliteDeviceRepository) SetConnectivity(ctx context.Context, deviceID uint, connectivity Connectivity) error {
+	result, err := repo.db.exec(ctx, setConnectivityQuery, map[string]any{"pk": deviceID, "connectivity": connectivity})
+	if err != nil {
+		return sqliteError(err, "failed to set the device connectivity")
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return NewRepositoryError(NotFound, "no matching rows", "failed to set the device connectivity")
+	}
+	return nil
+}
+
+// ---------------------------------------------------
+
+const (
+	insertMeasurementQuery = `
+		INSERT INTO device_measurement (publishing_device_fk, accessory_fk, m_value, m_value_type, received_at,
+			measured_at, clock_skewed)
+		VALUES (:publishing_device_fk, :accessory_fk, :m_value, :m_value_type, :received_at,
+			:measured_at, :clock_skewed)
+		RETURNING pk`
+	measurementColumns = `pk, publishing_device_fk, accessory_fk, m_value, m_value_type, received_at,
+		measured_at, clock_skewed`
+	// Same expression as the indexes of the measured axis, so they are used
+	measuredAxis           = `COALESCE(measured_at, received_at)`
+	queryMeasurementsQuery = `
+		SELECT ` + measurementColumns + ` FROM device_measurement
+		WHERE publishing_device_fk = :device
+			AND received_at BETWEEN :from AND :to
+			AND (:any_type OR m_value_type = :value_type)
+		ORDER BY received_at
+		LIMIT :limit`
+	queryAccessoryMeasurementsQuery = `
+		SELECT ` + measurementColumns + ` FROM device_measurement
+		WHERE accessory_fk = :device
+			AND received_at BETWEEN :from AND :to
+			AND (:any_type OR m_value_type = :value_type)
+		ORDER BY received_at
+		LIMIT :limit`
+	queryMeasuredQuery = `
+		SELECT ` + measurementColumns + ` FROM device_measurement
+		WHERE publishing_device_fk = :device
+			AND ` + measuredAxis + ` BETWEEN :from AND :to
+			AND (:any_type OR m_value_type = :value_type)
+		ORDER BY ` + measuredAxis + `
+		LIMIT :limit`
+	queryAccessoryMeasuredQuery = `
+		SELECT ` + measurementColumns + ` FROM device_measurement
+		WHERE accessory_fk = :device
+			AND ` + measuredAxis + ` BETWEEN :from AND :to
+			AND (:any_type OR m_value_type = :value_type)
+		ORDER BY ` + measuredAxis + `
+		LIMIT :limit`
+	queryRollupsQuery = `
+		SELECT publishing_device_fk, m_value_type, resolution, bucket_start,
+			sample_count, min_value, max_value, sum_value
+		FROM device_measurement_rollup
+		WHERE publishing_device_fk = :device
+			AND resolution = :resolution
+			AND bucket_start BETWEEN :from AND :to
+			AND (:any_type OR m_value_type = :value_type)
+		ORDER BY bucket_start, m_value_type
+		LIMIT :limit`
+)
+
+type SqliteMeasurementRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteMeasurementRepository(db *SqliteDB) (*SqliteMeasurementRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, insertMeasurementQuery),
+		db.Prepare(ReadPool, queryMeasurementsQuery, queryAccessoryMeasurementsQuery, queryMeasuredQuery,
+			queryAccessoryMeasuredQuery, queryRollupsQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SqliteMeasurementRepository{db}, nil
+}
+
+func (repo *SqliteMeasurementRepository) Insert(ctx context.Context, measurement NewMeasurement) (Measurement, error) {
+	var id uint
+	if err := repo.db.get(ctx, WritePool, insertMeasurementQuery, &id, measurement); err != nil {
+		return Measurement{}, sqliteError(err, "failed to insert the measurement")
+	}
+	return Measurement{ID: id, NewMeasurement: measurement}, nil
+}
+
+func (repo *SqliteMeasurementRepository) InsertBatch(ctx context.Context, measurements []NewMeasurement) error {
+	err := repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		var id uint
+		for _, measurement := range measurements {
+			if err := tx.get(ctx, insertMeasurementQuery, &id, measurement); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return sqliteError(err, "failed to insert the measurement batch")
+	}
+	return nil
+}
+
+// arguments maps the query into the named arguments shared by the measurement queries
+func (query MeasurementQuery) arguments() map[string]any {
+	var valueType uint
+	if query.ValueType != nil {
+		valueType = *query.ValueType
+	}
+	// A negative limit means no limit to sqlite
+	limit := int64(-1)
+	if query.Limit > 0 {
+		limit = int64(query.Limit)
+	}
+
+	return map[string]any{
+		"device":     query.DeviceID,
+		"from":       query.From,
+		"to":         query.To,
+		"any_type":   query.ValueType == nil,
+		"value_type": valueType,
+		"limit":      limit,
+	}
+}
+
+func (repo *SqliteMeasurementRepository) Query(ctx context.Context, query MeasurementQuery) (measurements []Measurement, err error) {
+	statement := queryMeasurementsQuery
+	switch {
+	case query.ByAccessory && query.Axis == MeasuredAxis:
+		statement = queryAccessoryMeasuredQuery
+	case query.ByAccessory:
+		statement = queryAccessoryMeasurementsQuery
+	case query.Axis == MeasuredAxis:
+		statement = queryMeasuredQuery
+	}
+
+	measurements = []Measurement{}
+	err = repo.db.selectAll(ctx, ReadPool, statement, &measurements, query.arguments())
+	if err != nil {
+		return nil, sqliteError(err, "failed to query the measurements")
+	}
+	return
+}
+
+func (repo *SqliteMeasurementRepository) QueryRollups(ctx context.Context, query MeasurementQuery, resolution Resolution) (rollups []Rollup, err error) {
+	if query.ByAccessory {
+		return []Rollup{}, nil
+	}
+	arguments := query.arguments()
+	arguments["resolution"] = resolution
+
+	rollups = []Rollup{}
+	if err = repo.db.selectAll(ctx, ReadPool, queryRollupsQuery, &rollups, arguments); err != nil {
+		return nil, sqliteError(err, "failed to query the rollups")
+	}
+	for i := range rollups {
+		rollups[i].Avg = rollups[i].Sum / float64(rollups[i].Count)
+	}
+	return
+}
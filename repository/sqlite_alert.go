@@ -0,0 +1,179 @@
+package repository
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	// The serial id of the device in the scope is read with the rule
+	alertRuleSelect = `
+		SELECT r.pk, r.name, r.kind, r.device_fk, r.device_type, r.m_value_type, r.comparison, r.threshold,
+			r.window_ms, r.connectivity, r.created_by, r.created_at, device.serial_id
+		FROM alert_rule r
+		LEFT JOIN device ON device.pk = r.device_fk`
+	alertSelect = `
+		SELECT a.pk, a.rule_fk, a.device_fk, a.detail, a.m_value, a.fired_at, r.name AS rule_name, device.serial_id,
+			a.alert_state, a.acknowledged_by, a.acknowledged_at, a.resolved_at
+		FROM alert a
+		JOIN alert_rule r ON r.pk = a.rule_fk
+		JOIN device ON device.pk = a.device_fk`
+
+	insertAlertRuleQuery = `
+		INSERT INTO alert_rule (name, kind, device_fk, device_type, m_value_type, comparison, threshold, window_ms,
+			connectivity, created_by, created_at)
+		VALUES (:name, :kind, :device_fk, :device_type, :m_value_type, :comparison, :threshold, :window_ms,
+			:connectivity, :created_by, :created_at)
+		RETURNING pk`
+	alertRuleByIDQuery    = alertRuleSelect + ` WHERE r.pk = :pk`
+	listAlertRulesQuery   = alertRuleSelect + ` ORDER BY r.pk`
+	deleteRuleAlertsQuery = `DELETE FROM alert WHERE rule_fk = :pk`
+	deleteAlertRuleQuery  = `DELETE FROM alert_rule WHERE pk = :pk RETURNING pk`
+
+	insertAlertQuery = `
+		INSERT INTO alert (rule_fk, device_fk, detail, m_value, fired_at)
+		VALUES (:rule_fk, :device_fk, :detail, :m_value, :fired_at)
+		RETURNING pk`
+	alertByIDQuery  = alertSelect + ` WHERE a.pk = :pk`
+	listAlertsQuery = alertSelect + `
+		WHERE (:any_state OR a.alert_state = :state) AND (NOT :open OR a.alert_state < 2)
+			AND (:device = 0 OR a.device_fk = :device)
+		ORDER BY a.pk DESC
+		LIMIT :limit`
+	acknowledgeAlertQuery = `
+		UPDATE alert SET alert_state = 1, acknowledged_by = :actor, acknowledged_at = :at
+		WHERE pk = :pk AND alert_state = 0
+		RETURNING pk`
+	resolveAlertQuery = `
+		UPDATE alert SET alert_state = 2, resolved_at = :at
+		WHERE rule_fk = :rule AND device_fk = :device AND alert_state < 2
+		RETURNING pk`
+)
+
+type SqliteAlertRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteAlertRepository(db *SqliteDB) (*SqliteAlertRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, insertAlertRuleQuery, alertRuleByIDQuery, deleteRuleAlertsQuery, deleteAlertRuleQuery,
+			insertAlertQuery, alertByIDQuery, acknowledgeAlertQuery, resolveAlertQuery),
+		db.Prepare(ReadPool, listAlertRulesQuery, alertByIDQuery, listAlertsQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteAlertRepository{db}, nil
+}
+
+func (repo *SqliteAlertRepository) CreateRule(ctx context.Context, rule NewAlertRule) (created AlertRule, err error) {
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		var id uint
+		if err := tx.get(ctx, insertAlertRuleQuery, &id, rule); err != nil {
+			return err
+		}
+		return tx.get(ctx, alertRuleByIDQuery, &created, map[string]any{"pk": id})
+	})
+	if err != nil {
+		return AlertRule{}, sqliteError(err, "failed to create the alert rule")
+	}
+	return
+}
+
+func (repo *SqliteAlertRepository) ListRules(ctx context.Context) (rules []AlertRule, err error) {
+	rules = []AlertRule{}
+	if err = repo.db.selectAll(ctx, ReadPool, listAlertRulesQuery, &rules, map[string]any{}); err != nil {
+		return nil, sqliteError(err, "failed to list the alert rules")
+	}
+	return
+}
+
+func (repo *SqliteAlertRepository) DeleteRule(ctx context.Context, id uint) error {
+	err := repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		key := map[string]any{"pk": id}
+		// Deleted explicitly, foreign keys may not be enforced
+		if _, err := tx.exec(ctx, deleteRuleAlertsQuery, key); err != nil {
+			return err
+		}
+		var deleted uint
+		return tx.get(ctx, deleteAlertRuleQuery, &deleted, key)
+	})
+	if err != nil {
+		return sqliteError(err, "failed to delete the alert rule")
+	}
+	return nil
+}
+
+func (repo *SqliteAlertRepository) Fire(ctx context.Context, alert NewAlert) (fired Alert, err error) {
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		var id uint
+		if err := tx.get(ctx, insertAlertQuery, &id, alert); err != nil {
+			return err
+		}
+		return tx.get(ctx, alertByIDQuery, &fired, map[string]any{"pk": id})
+	})
+	if err != nil {
+		return Alert{}, sqliteError(err, "failed to fire the alert")
+	}
+	return
+}
+
+func (repo *SqliteAlertRepository) Get(ctx context.Context, id uint) (alert Alert, err error) {
+	if err = repo.db.get(ctx, ReadPool, alertByIDQuery, &alert, map[string]any{"pk": id}); err != nil {
+		return Alert{}, sqliteError(err, "failed to get the alert")
+	}
+	return
+}
+
+func (repo *SqliteAlertRepository) List(ctx context.Context, query AlertQuery) (alerts []Alert, err error) {
+	var state AlertState
+	if query.State != nil {
+		state = *query.State
+	}
+	// A negative limit means no limit to sqlite
+	limit := int64(-1)
+	if query.Limit > 0 {
+		limit = int64(query.Limit)
+	}
+
+	alerts = []Alert{}
+	err = repo.db.selectAll(ctx, ReadPool, listAlertsQuery, &alerts, map[string]any{
+		"any_state": query.State == nil,
+		"state":     state,
+		"open":      query.Open,
+		"device":    query.DeviceID,
+		"limit":     limit,
+	})
+	if err != nil {
+		return nil, sqliteError(err, "failed to list the alerts")
+	}
+	return
+}
+
+func (repo *SqliteAlertRepository) Acknowledge(ctx context.Context, id uint, actor string, at int64) (acknowledged Alert, err error) {
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		var changedID uint
+		if err := tx.get(ctx, acknowledgeAlertQuery, &changedID, map[string]any{"pk": id, "actor": actor, "at": at}); err != nil {
+			return err
+		}
+		return tx.get(ctx, alertByIDQuery, &acknowledged, map[string]any{"pk": changedID})
+	})
+	if err != nil {
+		return Alert{}, sqliteError(err, "failed to acknowledge the alert")
+	}
+	return
+}
+
+func (repo *SqliteAlertRepository) Resolve(ctx context.Context, ruleID, deviceID uint, at int64) (resolved Alert, err error) {
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		var changedID uint
+		if err := tx.get(ctx, resolveAlertQuery, &changedID, map[string]any{"rule": ruleID, "device": deviceID, "at": at}); err != nil {
+			return err
+		}
+		return tx.get(ctx, alertByIDQuery, &resolved, map[string]any{"pk": changedID})
+	})
+	if err != nil {
+		return Alert{}, sqliteError(err, "failed to resolve the alert")
+	}
+	return
+}
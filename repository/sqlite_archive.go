@@ -0,0 +1,165 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Schema of the archive db file, created the first time a device is archived
+var archiveSchema = []string{
+	`CREATE TABLE IF NOT EXISTS archive.archived_device (
+		serial_id TEXT PRIMARY KEY,
+		device_type INTEGER NOT NULL,
+		description TEXT,
+		archived_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS archive.archived_measurement (
+		serial_id TEXT NOT NULL REFERENCES archived_device (serial_id),
+		m_value TEXT NOT NULL,
+		m_value_type INTEGER NOT NULL,
+		received_at INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS archive.archived_measurement_serial_idx
+		ON archived_measurement (serial_id, received_at)`,
+}
+
+/*
+Columns of archived_measurement added after its first version, an archive file created
+before them gets them added the next time a device is archived into it.
+*/
+var archiveMeasurementColumns = []struct{ name, definition string }{
+	// The accessory the measurement came from, through its parent, null for the parent's own
+	{"accessory_serial_id", "TEXT"},
+	// When the device measured it, corrected to the server clock, null when it wasn't timed
+	{"measured_at", "INTEGER"},
+	{"clock_skewed", "INTEGER NOT NULL DEFAULT FALSE"},
+}
+
+/*
+Statements that move a device's measurements into the attached archive, run in order,
+inside a single transaction, archiving the same device again appends to its archive.
+The measurements of a device are the ones it published, and as an accessory, the ones
+its parents published for it, all archived under its serial id.
+*/
+var archiveDeviceStatements = []string{
+	`INSERT INTO archive.archived_device (serial_id, device_type, description, archived_at)
+		SELECT serial_id, device_type, description, :archived_at FROM main.device WHERE pk = :pk
+		ON CONFLICT (serial_id) DO UPDATE SET archived_at = excluded.archived_at`,
+	`INSERT INTO archive.archived_measurement (serial_id, accessory_serial_id, m_value, m_value_type, received_at,
+			measured_at, clock_skewed)
+		SELECT :serial_id, accessory.serial_id, m.m_value, m.m_value_type, m.received_at,
+			m.measured_at, m.clock_skewed
+		FROM main.device_measurement m
+		LEFT JOIN main.device accessory ON accessory.pk = m.accessory_fk
+		WHERE m.publishing_device_fk = :pk OR m.accessory_fk = :pk
+		ORDER BY m.received_at`,
+	`DELETE FROM main.device_measurement WHERE publishing_device_fk = :pk OR accessory_fk = :pk`,
+	`INSERT INTO main.device_status_history (device_fk, old_status, new_status, actor, reason, changed_at)
+		SELECT pk, device_status, :device_status, :actor, :reason, :archived_at FROM main.device
+		WHERE pk = :pk AND device_status != :device_status`,
+	`UPDATE main.device SET device_status = :device_status,
+		decommissioned_at = COALESCE(decommissioned_at, :archived_at)
+		WHERE pk = :pk`,
+}
+
+type SqliteArchiveRepository struct {
+	db          *SqliteDB
+	archivePath string
+}
+
+func NewSqliteArchiveRepository(db *SqliteDB, archivePath string) *SqliteArchiveRepository {
+	return &SqliteArchiveRepository{db, archivePath}
+}
+
+func (repo *SqliteArchiveRepository) Archive(ctx context.Context, serialId string, change StatusChange) (archived int64, err error) {
+	if repo.archivePath == "" {
+		return 0, NewRepositoryError(QueryFailed, "no archive location", "failed to archive the device")
+	}
+
+	err = repo.db.withConn(ctx, func(conn *sqlx.Conn) error {
+		// ATTACH is per connection, and can't run inside a transaction
+		if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS archive`, repo.archivePath); err != nil {
+			return err
+		}
+		defer conn.ExecContext(context.Background(), `DETACH DATABASE archive`)
+
+		for _, statement := range archiveSchema {
+			if _, err := conn.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+		if err := addArchiveColumns(ctx, conn); err != nil {
+			return err
+		}
+
+		tx, err := conn.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		archived, err = archiveDevice(ctx, tx, serialId, change)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+
+	var repositoryErr *RepositoryError
+	if errors.As(err, &repositoryErr) {
+		return 0, repositoryErr
+	}
+	if err != nil {
+		return 0, sqliteError(err, "failed to archive the device")
+	}
+	return
+}
+
+// addArchiveColumns adds the columns the archive file was created without
+func addArchiveColumns(ctx context.Context, conn *sqlx.Conn) error {
+	columns := []string{}
+	err := conn.SelectContext(ctx, &columns, `SELECT name FROM pragma_table_info('archived_measurement', 'archive')`)
+	if err != nil {
+		return err
+	}
+	for _, column := range archiveMeasurementColumns {
+		if slices.Contains(columns, column.name) {
+			continue
+		}
+		statement := fmt.Sprintf(`ALTER TABLE archive.archived_measurement ADD COLUMN %s %s`, column.name, column.definition)
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func archiveDevice(ctx context.Context, tx *sqlx.Tx, serialId string, change StatusChange) (archived int64, err error) {
+	var pk uint
+	if err = tx.GetContext(ctx, &pk, `SELECT pk FROM main.device WHERE serial_id = ?`, serialId); err != nil {
+		return
+	}
+
+	arguments := map[string]any{
+		"pk":            pk,
+		"serial_id":     serialId,
+		"archived_at":   change.At,
+		"device_status": Decommissioned,
+		"actor":         change.Actor,
+		"reason":        change.Reason,
+	}
+	for i, statement := range archiveDeviceStatements {
+		result, err := tx.NamedExecContext(ctx, statement, arguments)
+		if err != nil {
+			return 0, fmt.Errorf("archive statement [%d]: %w", i, err)
+		}
+		// The measurements copied into the archive
+		if i == 1 {
+			archived, _ = result.RowsAffected()
+		}
+	}
+	return
+}
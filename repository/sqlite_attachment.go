@@ -0,0 +1,119 @@
+package repository
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	attachmentColumns = `
+		a.pk, a.accessory_fk, a.parent_fk, accessory.serial_id AS accessory_serial_id,
+		parent.serial_id AS parent_serial_id, a.attached_at, a.attached_by, a.detached_at, a.detached_by
+		FROM device_attachment a
+		JOIN device accessory ON accessory.pk = a.accessory_fk
+		JOIN device parent ON parent.pk = a.parent_fk`
+
+	insertAttachmentQuery = `
+		INSERT INTO device_attachment (accessory_fk, parent_fk, attached_at, attached_by)
+		VALUES (:accessory, :parent, :at, :actor)
+		RETURNING pk`
+	detachQuery = `
+		UPDATE device_attachment SET detached_at = :at, detached_by = :actor
+		WHERE accessory_fk = :accessory AND detached_at IS NULL
+		RETURNING pk`
+	attachmentByIDQuery = `SELECT ` + attachmentColumns + ` WHERE a.pk = :pk`
+	parentQuery         = `
+		SELECT ` + deviceColumns + ` FROM device
+		WHERE pk = (SELECT parent_fk FROM device_attachment WHERE accessory_fk = :accessory AND detached_at IS NULL)`
+	accessoriesQuery = `
+		SELECT ` + deviceColumns + ` FROM device
+		WHERE pk IN (SELECT accessory_fk FROM device_attachment WHERE parent_fk = :parent AND detached_at IS NULL)
+		ORDER BY pk`
+	attachmentHistoryQuery = `
+		SELECT ` + attachmentColumns + `
+		WHERE (a.accessory_fk = :device OR a.parent_fk = :device)
+			AND a.attached_at <= :to AND (a.detached_at IS NULL OR a.detached_at >= :from)
+		ORDER BY a.attached_at, a.pk`
+)
+
+type SqliteAttachmentRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteAttachmentRepository(db *SqliteDB) (*SqliteAttachmentRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, insertAttachmentQuery, detachQuery, attachmentByIDQuery),
+		db.Prepare(ReadPool, parentQuery, accessoriesQuery, attachmentHistoryQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteAttachmentRepository{db}, nil
+}
+
+func (repo *SqliteAttachmentRepository) Attach(ctx context.Context, parentID, accessoryID uint, change AttachmentChange) (attachment Attachment, err error) {
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		var id uint
+		err := tx.get(ctx, insertAttachmentQuery, &id, map[string]any{
+			"accessory": accessoryID,
+			"parent":    parentID,
+			"at":        change.At,
+			"actor":     change.Actor,
+		})
+		if err != nil {
+			return err
+		}
+		return tx.get(ctx, attachmentByIDQuery, &attachment, map[string]any{"pk": id})
+	})
+	if err != nil {
+		return Attachment{}, sqliteError(err, "failed to attach the accessory")
+	}
+	return
+}
+
+func (repo *SqliteAttachmentRepository) Detach(ctx context.Context, accessoryID uint, change AttachmentChange) (attachment Attachment, err error) {
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		var id uint
+		err := tx.get(ctx, detachQuery, &id, map[string]any{
+			"accessory": accessoryID,
+			"at":        change.At,
+			"actor":     change.Actor,
+		})
+		if err != nil {
+			return err
+		}
+		return tx.get(ctx, attachmentByIDQuery, &attachment, map[string]any{"pk": id})
+	})
+	if err != nil {
+		return Attachment{}, sqliteError(err, "failed to detach the accessory")
+	}
+	return
+}
+
+func (repo *SqliteAttachmentRepository) Parent(ctx context.Context, accessoryID uint) (parent Device, err error) {
+	if err = repo.db.get(ctx, ReadPool, parentQuery, &parent, map[string]any{"accessory": accessoryID}); err != nil {
+		return Device{}, sqliteError(err, "failed to get the parent of the accessory")
+	}
+	return
+}
+
+func (repo *SqliteAttachmentRepository) Accessories(ctx context.Context, parentID uint) (accessories []Device, err error) {
+	accessories = []Device{}
+	if err = repo.db.selectAll(ctx, ReadPool, accessoriesQuery, &accessories, map[string]any{"parent": parentID}); err != nil {
+		return nil, sqliteError(err, "failed to list the accessories")
+	}
+	return
+}
+
+func (repo *SqliteAttachmentRepository) History(ctx context.Context, deviceID uint, from, to int64) (attachments []Attachment, err error) {
+	attachments = []Attachment{}
+	err = repo.db.selectAll(ctx, ReadPool, attachmentHistoryQuery, &attachments, map[string]any{
+		"device": deviceID,
+		"from":   from,
+		"to":     to,
+	})
+	if err != nil {
+		return nil, sqliteError(err, "failed to list the attachment history")
+	}
+	return
+}
@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	claimCodeColumns = `pk, code_hash, device_type, requires_approval, description, created_by, created_at,
+		expires_at, claimed_at, claimed_by, revoked_at`
+
+	insertClaimCodeQuery = `
+		INSERT INTO claim_code (code_hash, device_type, requires_approval, description, created_by, created_at, expires_at)
+		VALUES (:code_hash, :device_type, :requires_approval, :description, :created_by, :created_at, :expires_at)
+		RETURNING ` + claimCodeColumns
+	listClaimCodesQuery  = `SELECT ` + claimCodeColumns + ` FROM claim_code ORDER BY pk`
+	revokeClaimCodeQuery = `
+		UPDATE claim_code SET revoked_at = :at
+		WHERE pk = :pk AND claimed_at IS NULL AND revoked_at IS NULL AND expires_at > :at
+		RETURNING ` + claimCodeColumns
+	claimCodeQuery = `
+		UPDATE claim_code SET claimed_at = :at, claimed_by = :serial_id
+		WHERE code_hash = :code_hash AND claimed_at IS NULL AND revoked_at IS NULL
+			AND created_at <= :at AND expires_at > :at
+		RETURNING ` + claimCodeColumns
+	releaseClaimCodeQuery = `UPDATE claim_code SET claimed_at = NULL, claimed_by = NULL WHERE pk = :pk`
+)
+
+type SqliteClaimCodeRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteClaimCodeRepository(db *SqliteDB) (*SqliteClaimCodeRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, insertClaimCodeQuery, revokeClaimCodeQuery, claimCodeQuery, releaseClaimCodeQuery),
+		db.Prepare(ReadPool, listClaimCodesQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteClaimCodeRepository{db}, nil
+}
+
+func (repo *SqliteClaimCodeRepository) Create(ctx context.Context, code NewClaimCode) (created ClaimCode, err error) {
+	if err = repo.db.get(ctx, WritePool, insertClaimCodeQuery, &created, code); err != nil {
+		return ClaimCode{}, sqliteError(err, "failed to create the claim code")
+	}
+	return
+}
+
+func (repo *SqliteClaimCodeRepository) List(ctx context.Context) (codes []ClaimCode, err error) {
+	codes = []ClaimCode{}
+	if err = repo.db.selectAll(ctx, ReadPool, listClaimCodesQuery, &codes, map[string]any{}); err != nil {
+		return nil, sqliteError(err, "failed to list the claim codes")
+	}
+	return
+}
+
+func (repo *SqliteClaimCodeRepository) Revoke(ctx context.Context, id uint, at int64) (code ClaimCode, err error) {
+	if err = repo.db.get(ctx, WritePool, revokeClaimCodeQuery, &code, map[string]any{"pk": id, "at": at}); err != nil {
+		return ClaimCode{}, sqliteError(err, "failed to revoke the claim code")
+	}
+	return
+}
+
+func (repo *SqliteClaimCodeRepository) Claim(ctx context.Context, codeHash, serialId string, at int64) (code ClaimCode, err error) {
+	key := map[string]any{"code_hash": codeHash, "serial_id": serialId, "at": at}
+	if err = repo.db.get(ctx, WritePool, claimCodeQuery, &code, key); err != nil {
+		return ClaimCode{}, sqliteError(err, "failed to claim the code")
+	}
+	return
+}
+
+func (repo *SqliteClaimCodeRepository) Release(ctx context.Context, id uint) error {
+	if _, err := repo.db.exec(ctx, releaseClaimCodeQuery, map[string]any{"pk": id}); err != nil {
+		return sqliteError(err, "failed to release the claim code")
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	clockSelect = `
+		SELECT c.device_fk, device.serial_id, c.offset_us, c.round_trip_us, c.samples, c.synced_at
+		FROM device_clock c
+		JOIN device ON device.pk = c.device_fk`
+
+	recordClockQuery = `
+		INSERT INTO device_clock (device_fk, offset_us, round_trip_us, synced_at)
+		VALUES (:device_fk, :offset_us, :round_trip_us, :synced_at)
+		ON CONFLICT (device_fk) DO UPDATE SET offset_us = excluded.offset_us, round_trip_us = excluded.round_trip_us,
+			samples = samples + 1, synced_at = excluded.synced_at`
+	clockQuery      = clockSelect + ` WHERE c.device_fk = :device_fk`
+	listClocksQuery = clockSelect + ` ORDER BY device.serial_id`
+)
+
+type SqliteClockRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteClockRepository(db *SqliteDB) (*SqliteClockRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, recordClockQuery, clockQuery),
+		db.Prepare(ReadPool, clockQuery, listClocksQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteClockRepository{db}, nil
+}
+
+func (repo *SqliteClockRepository) Record(ctx context.Context, clock DeviceClock) (recorded DeviceClock, err error) {
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		if _, err := tx.exec(ctx, recordClockQuery, clock); err != nil {
+			return err
+		}
+		return tx.get(ctx, clockQuery, &recorded, clock)
+	})
+	if err != nil {
+		return DeviceClock{}, sqliteError(err, "failed to record the clock of the device")
+	}
+	return
+}
+
+func (repo *SqliteClockRepository) Get(ctx context.Context, deviceID uint) (clock DeviceClock, err error) {
+	if err = repo.db.get(ctx, ReadPool, clockQuery, &clock, map[string]any{"device_fk": deviceID}); err != nil {
+		return DeviceClock{}, sqliteError(err, "failed to get the clock of the device")
+	}
+	return
+}
+
+func (repo *SqliteClockRepository) List(ctx context.Context) (clocks []DeviceClock, err error) {
+	clocks = []DeviceClock{}
+	if err = repo.db.selectAll(ctx, ReadPool, listClocksQuery, &clocks, map[string]any{}); err != nil {
+		return nil, sqliteError(err, "failed to list the clocks of the devices")
+	}
+	return
+}
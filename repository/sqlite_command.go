@@ -0,0 +1,231 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+const (
+	commandColumns = `pk, device_fk, name, payload, max_attempts, created_by, created_at, expires_at,
+		status, attempts, delivered_at, completed_at, result`
+	commandHistoryColumns = `pk, command_fk, old_status, new_status, actor, detail, changed_at`
+
+	insertCommandQuery = `
+		INSERT INTO device_command (device_fk, name, payload, max_attempts, created_by, created_at, expires_at)
+		VALUES (:device_fk, :name, :payload, :max_attempts, :created_by, :created_at, :expires_at)
+		RETURNING ` + commandColumns
+	commandByIDQuery = `SELECT ` + commandColumns + ` FROM device_command WHERE pk = :pk`
+	// The statuses are a bit set, so a single statement filters on any of them
+	listCommandsQuery = `
+		SELECT ` + commandColumns + ` FROM device_command
+		WHERE device_fk = :device AND (:statuses = 0 OR (:statuses >> status) & 1 = 1)
+		ORDER BY pk DESC
+		LIMIT :limit`
+	dueCommandsQuery = `
+		SELECT ` + commandColumns + ` FROM device_command
+		WHERE device_fk = :device AND expires_at > :at
+			AND (status = 0 OR (status = 1 AND delivered_at <= :redeliver_before AND attempts < max_attempts))
+		ORDER BY pk`
+	deliverCommandQuery = `
+		UPDATE device_command SET status = 1, attempts = attempts + 1, delivered_at = :at
+		WHERE pk = :pk
+		RETURNING ` + commandColumns
+	changeCommandQuery = `
+		UPDATE device_command SET status = :status, result = COALESCE(:result, result),
+			completed_at = CASE WHEN :status > 1 THEN :at END
+		WHERE pk = :pk
+		RETURNING ` + commandColumns
+	insertCommandHistoryQuery = `
+		INSERT INTO device_command_history (command_fk, old_status, new_status, actor, detail, changed_at)
+		VALUES (:command_fk, :old_status, :new_status, :actor, :detail, :changed_at)`
+	commandHistoryQuery = `
+		SELECT ` + commandHistoryColumns + ` FROM device_command_history
+		WHERE command_fk = :pk
+		ORDER BY changed_at, pk`
+
+	// Recorded before the commands change, while their old status can still be read
+	expireCommandsHistoryQuery = `
+		INSERT INTO device_command_history (command_fk, old_status, new_status, actor, detail, changed_at)
+		SELECT pk, status, 4, 'system', 'not done with before its expiry', :at FROM device_command
+		WHERE status IN (0, 1) AND expires_at <= :at`
+	expireCommandsQuery = `
+		UPDATE device_command SET status = 4, completed_at = :at
+		WHERE status IN (0, 1) AND expires_at <= :at`
+	failCommandsHistoryQuery = `
+		INSERT INTO device_command_history (command_fk, old_status, new_status, actor, detail, changed_at)
+		SELECT pk, 1, 3, 'system', 'not acknowledged after ' || attempts || ' attempts', :at FROM device_command
+		WHERE status = 1 AND attempts >= max_attempts AND delivered_at <= :redeliver_before`
+	failCommandsQuery = `
+		UPDATE device_command SET status = 3, completed_at = :at
+		WHERE status = 1 AND attempts >= max_attempts AND delivered_at <= :redeliver_before`
+)
+
+type SqliteCommandRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteCommandRepository(db *SqliteDB) (*SqliteCommandRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, insertCommandQuery, commandByIDQuery, dueCommandsQuery, deliverCommandQuery,
+			changeCommandQuery, insertCommandHistoryQuery, expireCommandsHistoryQuery, expireCommandsQuery,
+			failCommandsHistoryQuery, failCommandsQuery),
+		db.Prepare(ReadPool, commandByIDQuery, listCommandsQuery, commandHistoryQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteCommandRepository{db}, nil
+}
+
+func commandHistoryArguments(id uint, old *CommandStatus, change CommandChange) map[string]any {
+	arguments := map[string]any{
+		"command_fk": id,
+		"old_status": nil,
+		"new_status": change.Status,
+		"actor":      change.Actor,
+		"detail":     change.Detail,
+		"changed_at": change.At,
+	}
+	if old != nil {
+		arguments["old_status"] = *old
+	}
+	return arguments
+}
+
+func (repo *SqliteCommandRepository) Create(ctx context.Context, command NewCommand) (created Command, err error) {
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		if err := tx.get(ctx, insertCommandQuery, &created, command); err != nil {
+			return err
+		}
+		change := CommandChange{Status: Queued, Actor: command.CreatedBy, At: command.CreatedAt}
+		_, err := tx.exec(ctx, insertCommandHistoryQuery, commandHistoryArguments(created.ID, nil, change))
+		return err
+	})
+	if err != nil {
+		return Command{}, sqliteError(err, "failed to create the command")
+	}
+	return
+}
+
+func (repo *SqliteCommandRepository) Get(ctx context.Context, id uint) (command Command, err error) {
+	if err = repo.db.get(ctx, ReadPool, commandByIDQuery, &command, map[string]any{"pk": id}); err != nil {
+		return Command{}, sqliteError(err, "failed to get the command")
+	}
+	return
+}
+
+func (repo *SqliteCommandRepository) List(ctx context.Context, query CommandQuery) (commands []Command, err error) {
+	// A negative limit means no limit to sqlite
+	limit := int64(-1)
+	if query.Limit > 0 {
+		limit = int64(query.Limit)
+	}
+	statuses := 0
+	for _, status := range query.Statuses {
+		statuses |= 1 << status
+	}
+
+	commands = []Command{}
+	err = repo.db.selectAll(ctx, ReadPool, listCommandsQuery, &commands, map[string]any{
+		"device": query.DeviceID, "statuses": statuses, "limit": limit,
+	})
+	if err != nil {
+		return nil, sqliteError(err, "failed to list the commands")
+	}
+	return
+}
+
+func (repo *SqliteCommandRepository) Deliver(ctx context.Context, deviceID uint, actor string, at, redeliverBefore int64) (delivered []Command, err error) {
+	delivered = []Command{}
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		due := []Command{}
+		key := map[string]any{"device": deviceID, "at": at, "redeliver_before": redeliverBefore}
+		if err := tx.selectAll(ctx, dueCommandsQuery, &due, key); err != nil {
+			return err
+		}
+
+		for _, command := range due {
+			var updated Command
+			if err := tx.get(ctx, deliverCommandQuery, &updated, map[string]any{"pk": command.ID, "at": at}); err != nil {
+				return err
+			}
+			change := CommandChange{
+				Status: Delivered,
+				Actor:  actor,
+				Detail: sql.NullString{String: fmt.Sprintf("attempt %d", updated.Attempts), Valid: true},
+				At:     at,
+			}
+			_, err := tx.exec(ctx, insertCommandHistoryQuery, commandHistoryArguments(command.ID, &command.Status, change))
+			if err != nil {
+				return err
+			}
+			delivered = append(delivered, updated)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, sqliteError(err, "failed to deliver the commands")
+	}
+	return
+}
+
+func (repo *SqliteCommandRepository) Change(ctx context.Context, id uint, from []CommandStatus, change CommandChange) (changed Command, err error) {
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		var current Command
+		if err := tx.get(ctx, commandByIDQuery, &current, map[string]any{"pk": id}); err != nil {
+			return err
+		}
+		if !slices.Contains(from, current.Status) {
+			return sql.ErrNoRows
+		}
+
+		err := tx.get(ctx, changeCommandQuery, &changed, map[string]any{
+			"pk": id, "status": change.Status, "result": change.Result, "at": change.At,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tx.exec(ctx, insertCommandHistoryQuery, commandHistoryArguments(id, &current.Status, change))
+		return err
+	})
+	if err != nil {
+		return Command{}, sqliteError(err, "failed to change the command status")
+	}
+	return
+}
+
+func (repo *SqliteCommandRepository) Sweep(ctx context.Context, at, redeliverBefore int64) (changed int64, err error) {
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		key := map[string]any{"at": at, "redeliver_before": redeliverBefore}
+		for _, queries := range [][2]string{
+			{expireCommandsHistoryQuery, expireCommandsQuery},
+			{failCommandsHistoryQuery, failCommandsQuery},
+		} {
+			if _, err := tx.exec(ctx, queries[0], key); err != nil {
+				return err
+			}
+			result, err := tx.exec(ctx, queries[1], key)
+			if err != nil {
+				return err
+			}
+			affected, _ := result.RowsAffected()
+			changed += affected
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, sqliteError(err, "failed to sweep the commands")
+	}
+	return
+}
+
+func (repo *SqliteCommandRepository) History(ctx context.Context, id uint) (entries []CommandHistoryEntry, err error) {
+	entries = []CommandHistoryEntry{}
+	if err = repo.db.selectAll(ctx, ReadPool, commandHistoryQuery, &entries, map[string]any{"pk": id}); err != nil {
+		return nil, sqliteError(err, "failed to get the command history")
+	}
+	return
+}
@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	credentialColumns = `pk, device_fk, key_hash, created_at, expires_at, revoked_at`
+
+	expireCredentialsQuery = `
+		UPDATE device_credential SET expires_at = :grace_until
+		WHERE device_fk = :device AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > :grace_until)`
+	insertCredentialQuery = `
+		INSERT INTO device_credential (device_fk, key_hash, created_at)
+		VALUES (:device, :key_hash, :at)
+		RETURNING ` + credentialColumns
+	validCredentialsQuery = `
+		SELECT ` + credentialColumns + ` FROM device_credential
+		WHERE device_fk = :device AND revoked_at IS NULL AND created_at <= :at
+			AND (expires_at IS NULL OR expires_at > :at)
+		ORDER BY pk DESC`
+	listCredentialsQuery  = `SELECT ` + credentialColumns + ` FROM device_credential WHERE device_fk = :device ORDER BY pk`
+	revokeCredentialQuery = `
+		UPDATE device_credential SET revoked_at = :at
+		WHERE device_fk = :device AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > :at)`
+	credentialKeysQuery = `SELECT ` + credentialColumns + ` FROM device_credential ORDER BY pk`
+	replaceKeyQuery     = `UPDATE device_credential SET key_hash = :key_hash WHERE pk = :id`
+)
+
+type SqliteCredentialRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteCredentialRepository(db *SqliteDB) (*SqliteCredentialRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, expireCredentialsQuery, insertCredentialQuery, revokeCredentialQuery, replaceKeyQuery),
+		db.Prepare(ReadPool, validCredentialsQuery, listCredentialsQuery, credentialKeysQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteCredentialRepository{db}, nil
+}
+
+func (repo *SqliteCredentialRepository) Rotate(ctx context.Context, deviceID uint, keyHash string, at, graceUntil int64) (credential Credential, err error) {
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		key := map[string]any{"device": deviceID, "key_hash": keyHash, "at": at, "grace_until": graceUntil}
+		if _, err := tx.exec(ctx, expireCredentialsQuery, key); err != nil {
+			return err
+		}
+		return tx.get(ctx, insertCredentialQuery, &credential, key)
+	})
+	if err != nil {
+		return Credential{}, sqliteError(err, "failed to rotate the credentials")
+	}
+	return
+}
+
+func (repo *SqliteCredentialRepository) Valid(ctx context.Context, deviceID uint, at int64) (credentials []Credential, err error) {
+	credentials = []Credential{}
+	err = repo.db.selectAll(ctx, ReadPool, validCredentialsQuery, &credentials, map[string]any{"device": deviceID, "at": at})
+	if err != nil {
+		return nil, sqliteError(err, "failed to get the valid credentials")
+	}
+	return
+}
+
+func (repo *SqliteCredentialRepository) List(ctx context.Context, deviceID uint) (credentials []Credential, err error) {
+	credentials = []Credential{}
+	err = repo.db.selectAll(ctx, ReadPool, listCredentialsQuery, &credentials, map[string]any{"device": deviceID})
+	if err != nil {
+		return nil, sqliteError(err, "failed to list the credentials")
+	}
+	return
+}
+
+func (repo *SqliteCredentialRepository) Revoke(ctx context.Context, deviceID uint, at int64) (int64, error) {
+	result, err := repo.db.exec(ctx, revokeCredentialQuery, map[string]any{"device": deviceID, "at": at})
+	if err != nil {
+		return 0, sqliteError(err, "failed to revoke the credentials")
+	}
+	return result.RowsAffected()
+}
+
+func (repo *SqliteCredentialRepository) Keys(ctx context.Context) (credentials []Credential, err error) {
+	credentials = []Credential{}
+	err = repo.db.selectAll(ctx, ReadPool, credentialKeysQuery, &credentials, map[string]any{})
+	if err != nil {
+		return nil, sqliteError(err, "failed to list the credentials")
+	}
+	return
+}
+
+func (repo *SqliteCredentialRepository) ReplaceKey(ctx context.Context, id uint, keyHash string) error {
+	result, err := repo.db.exec(ctx, replaceKeyQuery, map[string]any{"id": id, "key_hash": keyHash})
+	if err != nil {
+		return sqliteError(err, "failed to replace the credential key")
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return NewRepositoryError(NotFound, "no matching rows", "failed to replace the credential key")
+	}
+	return nil
+}
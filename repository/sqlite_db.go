@@ -0,0 +1,260 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+SqlitePools holds the connection pools used by the SQLite repositories, writes are
+prepared on the Writer and reads on the Reader. Both can be the same pool,
+as is the case for in-memory databases.
+*/
+type SqlitePools struct {
+	Reader *sqlx.DB
+	Writer *sqlx.DB
+}
+
+type Pool uint
+
+const (
+	ReadPool Pool = iota
+	WritePool
+)
+
+type statementKey struct {
+	pool  Pool
+	query string
+}
+
+/*
+SqliteDB is shared by every SQLite repository, it prepares each named query once
+per pool and caches the statement. Every query holds a shared lock over the pools,
+so Swap can replace them (e.g. leaving the in-memory fallback) without any query
+running against a closed pool.
+*/
+type SqliteDB struct {
+	mutex sync.RWMutex
+	pools SqlitePools
+	// Run after every Swap, by whoever keeps data read from the replaced pools
+	swapped []func()
+
+	statementsMutex sync.Mutex
+	statements      map[statementKey]*sqlx.NamedStmt
+}
+
+func NewSqliteDB(pools SqlitePools) *SqliteDB {
+	return &SqliteDB{
+		pools:      pools,
+		statements: map[statementKey]*sqlx.NamedStmt{},
+	}
+}
+
+/*
+WithPools runs fn with the current pools, for the operations that don't fit
+a named query (pragmas, VACUUM INTO, ...). The pools must not be kept after fn returns.
+*/
+func (db *SqliteDB) WithPools(fn func(pools SqlitePools) error) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return fn(db.pools)
+}
+
+/*
+Swap replaces the pools with the ones returned by replace, waiting for every running
+query to finish and holding new ones until it is done. If replace fails, the current
+pools are kept. The replaced pools are not closed, that is left to the caller.
+The functions given to OnSwap run once the new pools are in use.
+*/
+func (db *SqliteDB) Swap(replace func(current SqlitePools) (SqlitePools, error)) error {
+	swapped, err := db.swap(replace)
+	if err != nil {
+		return err
+	}
+	for _, fn := range swapped {
+		fn()
+	}
+	return nil
+}
+
+/*
+OnSwap runs fn after every Swap, for the data kept in memory that the new pools may
+hold differently, e.g. the rows re-pointed when the spill is merged.
+*/
+func (db *SqliteDB) OnSwap(fn func()) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.swapped = append(db.swapped, fn)
+}
+
+// swap replaces the pools, returning the functions to run once it is done
+func (db *SqliteDB) swap(replace func(current SqlitePools) (SqlitePools, error)) ([]func(), error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	replacement, err := replace(db.pools)
+	if err != nil {
+		return nil, err
+	}
+
+	db.statementsMutex.Lock()
+	for key, statement := range db.statements {
+		statement.Close()
+		delete(db.statements, key)
+	}
+	db.statementsMutex.Unlock()
+
+	db.pools = replacement
+	return db.swapped, nil
+}
+
+/*
+Prepare prepares the queries on the given pool, so a broken query is caught
+when the repository is created, instead of on its first use.
+*/
+func (db *SqliteDB) Prepare(pool Pool, queries ...string) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	for _, query := range queries {
+		if _, err := db.statement(pool, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statement must be called while holding the pools lock
+func (db *SqliteDB) statement(pool Pool, query string) (*sqlx.NamedStmt, error) {
+	db.statementsMutex.Lock()
+	defer db.statementsMutex.Unlock()
+
+	key := statementKey{pool, query}
+	if statement, exists := db.statements[key]; exists {
+		return statement, nil
+	}
+
+	target := db.pools.Reader
+	if pool == WritePool {
+		target = db.pools.Writer
+	}
+
+	statement, err := target.PrepareNamed(query)
+	if err != nil {
+		slog.Error("repository-sqlite", "prepare-failure", query, "cause", err.Error())
+		return nil, err
+	}
+	db.statements[key] = statement
+	return statement, nil
+}
+
+func (db *SqliteDB) get(ctx context.Context, pool Pool, query string, dest, arg any) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	statement, err := db.statement(pool, query)
+	if err != nil {
+		return err
+	}
+	return statement.GetContext(ctx, dest, arg)
+}
+
+func (db *SqliteDB) selectAll(ctx context.Context, pool Pool, query string, dest, arg any) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	statement, err := db.statement(pool, query)
+	if err != nil {
+		return err
+	}
+	return statement.SelectContext(ctx, dest, arg)
+}
+
+func (db *SqliteDB) exec(ctx context.Context, query string, arg any) (sql.Result, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	statement, err := db.statement(WritePool, query)
+	if err != nil {
+		return nil, err
+	}
+	return statement.ExecContext(ctx, arg)
+}
+
+/*
+inTx runs fn inside a writer transaction, committing if fn succeeds and rolling
+back otherwise. The queries in fn must go through the given SqliteTx.
+*/
+func (db *SqliteDB) inTx(ctx context.Context, fn func(tx *SqliteTx) error) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	tx, err := db.pools.Writer.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = fn(&SqliteTx{db: db, tx: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+withConn runs fn on a single connection of the writer pool, for the statements that
+only affect the connection they run on (e.g. ATTACH), the cached statements are not used.
+*/
+func (db *SqliteDB) withConn(ctx context.Context, fn func(conn *sqlx.Conn) error) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	conn, err := db.pools.Writer.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return fn(conn)
+}
+
+// SqliteTx runs the cached writer statements inside a transaction
+type SqliteTx struct {
+	db *SqliteDB
+	tx *sqlx.Tx
+}
+
+func (tx *SqliteTx) statement(ctx context.Context, query string) (*sqlx.NamedStmt, error) {
+	statement, err := tx.db.statement(WritePool, query)
+	if err != nil {
+		return nil, err
+	}
+	return tx.tx.NamedStmtContext(ctx, statement), nil
+}
+
+func (tx *SqliteTx) get(ctx context.Context, query string, dest, arg any) error {
+	statement, err := tx.statement(ctx, query)
+	if err != nil {
+		return err
+	}
+	return statement.GetContext(ctx, dest, arg)
+}
+
+func (tx *SqliteTx) selectAll(ctx context.Context, query string, dest, arg any) error {
+	statement, err := tx.statement(ctx, query)
+	if err != nil {
+		return err
+	}
+	return statement.SelectContext(ctx, dest, arg)
+}
+
+func (tx *SqliteTx) exec(ctx context.Context, query string, arg any) (sql.Result, error) {
+	statement, err := tx.statement(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return statement.ExecContext(ctx, arg)
+}
@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	deviceTypeColumns = `pk, name, role, serial_pattern, value_types, heartbeat_timeout, default_status, description`
+
+	listDeviceTypesQuery  = `SELECT ` + deviceTypeColumns + ` FROM device_type ORDER BY pk`
+	deviceTypeByIDQuery   = `SELECT ` + deviceTypeColumns + ` FROM device_type WHERE pk = :pk`
+	insertDeviceTypeQuery = `
+		INSERT INTO device_type (name, role, serial_pattern, value_types, heartbeat_timeout, default_status, description)
+		VALUES (:name, :role, :serial_pattern, :value_types, :heartbeat_timeout, :default_status, :description)
+		RETURNING pk`
+	updateDeviceTypeQuery = `
+		UPDATE device_type SET serial_pattern = :serial_pattern, value_types = :value_types,
+			heartbeat_timeout = :heartbeat_timeout, default_status = :default_status, description = :description
+		WHERE pk = :pk
+		RETURNING pk`
+	deviceTypeInUseQuery  = `SELECT EXISTS (SELECT 1 FROM device WHERE device_type = :pk)`
+	typeHasFirmwareQuery  = `SELECT EXISTS (SELECT 1 FROM firmware WHERE device_type = :pk)`
+	typeHasAlertsQuery    = `SELECT EXISTS (SELECT 1 FROM alert_rule WHERE device_type = :pk)`
+	deleteDeviceTypeQuery = `DELETE FROM device_type WHERE pk = :pk RETURNING pk`
+	// Deleted explicitly, foreign keys may not be enforced
+	deleteTypeClaimCodesQuery = `DELETE FROM claim_code WHERE device_type = :pk`
+	deleteTypeTemplateQuery   = `DELETE FROM shadow_template WHERE device_type = :pk`
+)
+
+type SqliteDeviceTypeRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteDeviceTypeRepository(db *SqliteDB) (*SqliteDeviceTypeRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, insertDeviceTypeQuery, updateDeviceTypeQuery, deviceTypeByIDQuery,
+			deviceTypeInUseQuery, typeHasFirmwareQuery, typeHasAlertsQuery, deleteDeviceTypeQuery, deleteTypeClaimCodesQuery,
+			deleteTypeTemplateQuery),
+		db.Prepare(ReadPool, listDeviceTypesQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteDeviceTypeRepository{db}, nil
+}
+
+func (repo *SqliteDeviceTypeRepository) List(ctx context.Context) (deviceTypes []DeviceTypeDefinition, err error) {
+	deviceTypes = []DeviceTypeDefinition{}
+	if err = repo.db.selectAll(ctx, ReadPool, listDeviceTypesQuery, &deviceTypes, map[string]any{}); err != nil {
+		return nil, sqliteError(err, "failed to list the device types")
+	}
+	return
+}
+
+func (repo *SqliteDeviceTypeRepository) Create(ctx context.Context, deviceType NewDeviceType) (DeviceTypeDefinition, error) {
+	var id DeviceType
+	if err := repo.db.get(ctx, WritePool, insertDeviceTypeQuery, &id, deviceType); err != nil {
+		return DeviceTypeDefinition{}, sqliteError(err, "failed to create the device type")
+	}
+	return DeviceTypeDefinition{ID: id, NewDeviceType: deviceType}, nil
+}
+
+func (repo *SqliteDeviceTypeRepository) Update(ctx context.Context, deviceType DeviceTypeDefinition) (updated DeviceTypeDefinition, err error) {
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		var id DeviceType
+		if err := tx.get(ctx, updateDeviceTypeQuery, &id, deviceType); err != nil {
+			return err
+		}
+		return tx.get(ctx, deviceTypeByIDQuery, &updated, map[string]any{"pk": id})
+	})
+	if err != nil {
+		return DeviceTypeDefinition{}, sqliteError(err, "failed to update the device type")
+	}
+	return
+}
+
+func (repo *SqliteDeviceTypeRepository) Delete(ctx context.Context, id DeviceType) error {
+	err := repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		key := map[string]any{"pk": id}
+		var inUse bool
+		if err := tx.get(ctx, deviceTypeInUseQuery, &inUse, key); err != nil {
+			return err
+		}
+		if inUse {
+			return NewRepositoryError(InUse, "devices have the type", "failed to delete the device type")
+		}
+		if err := tx.get(ctx, typeHasFirmwareQuery, &inUse, key); err != nil {
+			return err
+		}
+		if inUse {
+			return NewRepositoryError(InUse, "firmware targets the type", "failed to delete the device type")
+		}
+		if err := tx.get(ctx, typeHasAlertsQuery, &inUse, key); err != nil {
+			return err
+		}
+		if inUse {
+			return NewRepositoryError(InUse, "alert rules target the type", "failed to delete the device type")
+		}
+		for _, query := range []string{deleteTypeClaimCodesQuery, deleteTypeTemplateQuery} {
+			if _, err := tx.exec(ctx, query, key); err != nil {
+				return err
+			}
+		}
+		var deleted DeviceType
+		return tx.get(ctx, deleteDeviceTypeQuery, &deleted, key)
+	})
+	var repositoryErr *RepositoryError
+	if errors.As(err, &repositoryErr) {
+		return repositoryErr
+	}
+	if err != nil {
+		return sqliteError(err, "failed to delete the device type")
+	}
+	return nil
+}
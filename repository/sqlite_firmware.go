@@ -0,0 +1,252 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+const (
+	firmwareColumns = `pk, device_type, version, size, sha256, signature, description, uploaded_by, uploaded_at`
+	// The firmware it rolls out, and the devices counted by status, are read with the rollout
+	rolloutSelect = `
+		SELECT r.pk, r.firmware_fk, r.percentage, r.failure_threshold, r.min_reports, r.created_by, r.created_at,
+			f.device_type, f.version, r.status, r.changed_by, r.changed_at, r.reason,
+			(SELECT COUNT(*) FROM firmware_rollout_device d WHERE d.rollout_fk = r.pk) AS devices,
+			(SELECT COUNT(*) FROM firmware_rollout_device d WHERE d.rollout_fk = r.pk AND d.status = 3) AS installed,
+			(SELECT COUNT(*) FROM firmware_rollout_device d WHERE d.rollout_fk = r.pk AND d.status = 4) AS failed
+		FROM firmware_rollout r
+		JOIN firmware f ON f.pk = r.firmware_fk`
+	rolloutDeviceSelect = `
+		SELECT d.rollout_fk, d.device_fk, device.serial_id, d.status, d.detail, d.updated_at
+		FROM firmware_rollout_device d
+		JOIN device ON device.pk = d.device_fk`
+
+	insertFirmwareQuery = `
+		INSERT INTO firmware (device_type, version, size, sha256, signature, description, uploaded_by, uploaded_at)
+		VALUES (:device_type, :version, :size, :sha256, :signature, :description, :uploaded_by, :uploaded_at)
+		RETURNING ` + firmwareColumns
+	firmwareByIDQuery         = `SELECT ` + firmwareColumns + ` FROM firmware WHERE pk = :pk`
+	listFirmwareQuery         = `SELECT ` + firmwareColumns + ` FROM firmware ORDER BY device_type, uploaded_at DESC`
+	firmwareInUseQuery        = `SELECT EXISTS (SELECT 1 FROM firmware_rollout WHERE firmware_fk = :pk AND status IN (0, 1))`
+	deleteFirmwareQuery       = `DELETE FROM firmware WHERE pk = :pk RETURNING pk`
+	deleteRolloutsQuery       = `DELETE FROM firmware_rollout WHERE firmware_fk = :pk`
+	deleteRolloutDevicesQuery = `
+		DELETE FROM firmware_rollout_device
+		WHERE rollout_fk IN (SELECT pk FROM firmware_rollout WHERE firmware_fk = :pk)`
+
+	insertRolloutQuery = `
+		INSERT INTO firmware_rollout (firmware_fk, percentage, failure_threshold, min_reports, created_by, created_at)
+		VALUES (:firmware_fk, :percentage, :failure_threshold, :min_reports, :created_by, :created_at)
+		RETURNING pk`
+	rolloutByIDQuery   = rolloutSelect + ` WHERE r.pk = :pk`
+	listRolloutsQuery  = rolloutSelect + ` ORDER BY r.pk DESC`
+	changeRolloutQuery = `
+		UPDATE firmware_rollout SET status = :status, changed_by = :actor, changed_at = :at, reason = :reason
+		WHERE pk = :pk AND (:from >> status) & 1 = 1
+		RETURNING pk`
+
+	rolloutDevicesQuery      = rolloutDeviceSelect + ` WHERE d.rollout_fk = :rollout ORDER BY device.serial_id`
+	rolloutDeviceQuery       = rolloutDeviceSelect + ` WHERE d.rollout_fk = :rollout AND d.device_fk = :device`
+	insertRolloutDeviceQuery = `
+		INSERT INTO firmware_rollout_device (rollout_fk, device_fk, status, updated_at)
+		VALUES (:rollout, :device, :status, :at)
+		ON CONFLICT DO NOTHING`
+	// The statuses are a bit set, like the ones of the commands
+	changeRolloutDeviceQuery = `
+		UPDATE firmware_rollout_device SET status = :status, detail = :detail, updated_at = :at
+		WHERE rollout_fk = :rollout AND device_fk = :device AND (:from >> status) & 1 = 1
+		RETURNING rollout_fk`
+)
+
+type SqliteFirmwareRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteFirmwareRepository(db *SqliteDB) (*SqliteFirmwareRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, insertFirmwareQuery, firmwareInUseQuery, deleteFirmwareQuery, deleteRolloutsQuery,
+			deleteRolloutDevicesQuery, insertRolloutQuery, rolloutByIDQuery, changeRolloutQuery, rolloutDeviceQuery,
+			insertRolloutDeviceQuery, changeRolloutDeviceQuery),
+		db.Prepare(ReadPool, firmwareByIDQuery, listFirmwareQuery, rolloutByIDQuery, listRolloutsQuery,
+			rolloutDevicesQuery, rolloutDeviceQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteFirmwareRepository{db}, nil
+}
+
+func (repo *SqliteFirmwareRepository) Create(ctx context.Context, firmware NewFirmware) (created Firmware, err error) {
+	if err = repo.db.get(ctx, WritePool, insertFirmwareQuery, &created, firmware); err != nil {
+		return Firmware{}, sqliteError(err, "failed to create the firmware")
+	}
+	return
+}
+
+func (repo *SqliteFirmwareRepository) Get(ctx context.Context, id uint) (firmware Firmware, err error) {
+	if err = repo.db.get(ctx, ReadPool, firmwareByIDQuery, &firmware, map[string]any{"pk": id}); err != nil {
+		return Firmware{}, sqliteError(err, "failed to get the firmware")
+	}
+	return
+}
+
+func (repo *SqliteFirmwareRepository) List(ctx context.Context) (firmware []Firmware, err error) {
+	firmware = []Firmware{}
+	if err = repo.db.selectAll(ctx, ReadPool, listFirmwareQuery, &firmware, map[string]any{}); err != nil {
+		return nil, sqliteError(err, "failed to list the firmware")
+	}
+	return
+}
+
+func (repo *SqliteFirmwareRepository) Delete(ctx context.Context, id uint) error {
+	err := repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		key := map[string]any{"pk": id}
+		var inUse bool
+		if err := tx.get(ctx, firmwareInUseQuery, &inUse, key); err != nil {
+			return err
+		}
+		if inUse {
+			return NewRepositoryError(InUse, "a rollout of the firmware is in progress", "failed to delete the firmware")
+		}
+		// Deleted explicitly, foreign keys may not be enforced
+		for _, query := range []string{deleteRolloutDevicesQuery, deleteRolloutsQuery} {
+			if _, err := tx.exec(ctx, query, key); err != nil {
+				return err
+			}
+		}
+		var deleted uint
+		return tx.get(ctx, deleteFirmwareQuery, &deleted, key)
+	})
+	var repositoryErr *RepositoryError
+	if errors.As(err, &repositoryErr) {
+		return repositoryErr
+	}
+	if err != nil {
+		return sqliteError(err, "failed to delete the firmware")
+	}
+	return nil
+}
+
+func (repo *SqliteFirmwareRepository) CreateRollout(ctx context.Context, rollout NewRollout, devices []uint) (created Rollout, err error) {
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		var id uint
+		if err := tx.get(ctx, insertRolloutQuery, &id, rollout); err != nil {
+			return err
+		}
+		for _, device := range devices {
+			key := map[string]any{"rollout": id, "device": device, "status": UpdatePending, "at": rollout.CreatedAt}
+			if _, err := tx.exec(ctx, insertRolloutDeviceQuery, key); err != nil {
+				return err
+			}
+		}
+		return tx.get(ctx, rolloutByIDQuery, &created, map[string]any{"pk": id})
+	})
+	if err != nil {
+		return Rollout{}, sqliteError(err, "failed to create the rollout")
+	}
+	return
+}
+
+func (repo *SqliteFirmwareRepository) GetRollout(ctx context.Context, id uint) (rollout Rollout, err error) {
+	if err = repo.db.get(ctx, ReadPool, rolloutByIDQuery, &rollout, map[string]any{"pk": id}); err != nil {
+		return Rollout{}, sqliteError(err, "failed to get the rollout")
+	}
+	return
+}
+
+func (repo *SqliteFirmwareRepository) ListRollouts(ctx context.Context) (rollouts []Rollout, err error) {
+	rollouts = []Rollout{}
+	if err = repo.db.selectAll(ctx, ReadPool, listRolloutsQuery, &rollouts, map[string]any{}); err != nil {
+		return nil, sqliteError(err, "failed to list the rollouts")
+	}
+	return
+}
+
+func (repo *SqliteFirmwareRepository) ChangeRollout(
+	ctx context.Context, id uint, from []RolloutStatus, change RolloutChange,
+) (changed Rollout, err error) {
+	statuses := 0
+	for _, status := range from {
+		statuses |= 1 << status
+	}
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		var changedID uint
+		err := tx.get(ctx, changeRolloutQuery, &changedID, map[string]any{
+			"pk": id, "from": statuses, "status": change.Status, "actor": change.Actor, "reason": change.Reason, "at": change.At,
+		})
+		if err != nil {
+			return err
+		}
+		return tx.get(ctx, rolloutByIDQuery, &changed, map[string]any{"pk": changedID})
+	})
+	if err != nil {
+		return Rollout{}, sqliteError(err, "failed to change the rollout")
+	}
+	return
+}
+
+func (repo *SqliteFirmwareRepository) RolloutDevices(ctx context.Context, id uint) (devices []RolloutDevice, err error) {
+	devices = []RolloutDevice{}
+	if err = repo.db.selectAll(ctx, ReadPool, rolloutDevicesQuery, &devices, map[string]any{"rollout": id}); err != nil {
+		return nil, sqliteError(err, "failed to list the devices of the rollout")
+	}
+	return
+}
+
+func (repo *SqliteFirmwareRepository) GetRolloutDevice(ctx context.Context, rolloutID, deviceID uint) (device RolloutDevice, err error) {
+	key := map[string]any{"rollout": rolloutID, "device": deviceID}
+	if err = repo.db.get(ctx, ReadPool, rolloutDeviceQuery, &device, key); err != nil {
+		return RolloutDevice{}, sqliteError(err, "failed to get the device of the rollout")
+	}
+	return
+}
+
+func (repo *SqliteFirmwareRepository) AddRolloutDevice(
+	ctx context.Context, rolloutID, deviceID uint, status UpdateStatus, at int64,
+) (added RolloutDevice, err error) {
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		key := map[string]any{"rollout": rolloutID, "device": deviceID, "status": status, "at": at}
+		result, err := tx.exec(ctx, insertRolloutDeviceQuery, key)
+		if err != nil {
+			return err
+		}
+		if inserted, err := result.RowsAffected(); err != nil {
+			return err
+		} else if inserted == 0 {
+			return NewRepositoryError(AlreadyExists, "the device is in the rollout", "failed to add the device to the rollout")
+		}
+		return tx.get(ctx, rolloutDeviceQuery, &added, key)
+	})
+	var repositoryErr *RepositoryError
+	if errors.As(err, &repositoryErr) {
+		return RolloutDevice{}, repositoryErr
+	}
+	if err != nil {
+		return RolloutDevice{}, sqliteError(err, "failed to add the device to the rollout")
+	}
+	return
+}
+
+func (repo *SqliteFirmwareRepository) ChangeRolloutDevice(
+	ctx context.Context, rolloutID, deviceID uint, from []UpdateStatus, status UpdateStatus, detail sql.NullString, at int64,
+) (changed RolloutDevice, err error) {
+	statuses := 0
+	for _, status := range from {
+		statuses |= 1 << status
+	}
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		key := map[string]any{
+			"rollout": rolloutID, "device": deviceID, "from": statuses, "status": status, "detail": detail, "at": at,
+		}
+		var changedID uint
+		if err := tx.get(ctx, changeRolloutDeviceQuery, &changedID, key); err != nil {
+			return err
+		}
+		return tx.get(ctx, rolloutDeviceQuery, &changed, key)
+	})
+	if err != nil {
+		return RolloutDevice{}, sqliteError(err, "failed to change the device of the rollout")
+	}
+	return
+}
@@ -0,0 +1,57 @@
+package repository
+
+import "context"
+
+const (
+	statusHistoryColumns = `pk, device_fk, old_status, new_status, actor, reason, changed_at`
+
+	listStatusHistoryQuery = `
+		SELECT ` + statusHistoryColumns + ` FROM device_status_history
+		WHERE device_fk = :device AND changed_at BETWEEN :from AND :to
+		ORDER BY changed_at, pk
+		LIMIT :limit`
+	statusBeforeQuery = `
+		SELECT ` + statusHistoryColumns + ` FROM device_status_history
+		WHERE device_fk = :device AND changed_at < :at
+		ORDER BY changed_at DESC, pk DESC
+		LIMIT 1`
+)
+
+type SqliteStatusHistoryRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteStatusHistoryRepository(db *SqliteDB) (*SqliteStatusHistoryRepository, error) {
+	if err := db.Prepare(ReadPool, listStatusHistoryQuery, statusBeforeQuery); err != nil {
+		return nil, err
+	}
+	return &SqliteStatusHistoryRepository{db}, nil
+}
+
+func (repo *SqliteStatusHistoryRepository) List(ctx context.Context, query StatusHistoryQuery) (entries []StatusHistoryEntry, err error) {
+	// A negative limit means no limit to sqlite
+	limit := int64(-1)
+	if query.Limit > 0 {
+		limit = int64(query.Limit)
+	}
+
+	entries = []StatusHistoryEntry{}
+	err = repo.db.selectAll(ctx, ReadPool, listStatusHistoryQuery, &entries, map[string]any{
+		"device": query.DeviceID,
+		"from":   query.From,
+		"to":     query.To,
+		"limit":  limit,
+	})
+	if err != nil {
+		return nil, sqliteError(err, "failed to list the status history")
+	}
+	return
+}
+
+func (repo *SqliteStatusHistoryRepository) Before(ctx context.Context, deviceID uint, at int64) (entry StatusHistoryEntry, err error) {
+	err = repo.db.get(ctx, ReadPool, statusBeforeQuery, &entry, map[string]any{"device": deviceID, "at": at})
+	if err != nil {
+		return StatusHistoryEntry{}, sqliteError(err, "failed to get the status before the date")
+	}
+	return
+}
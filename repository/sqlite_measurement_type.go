@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	measurementTypeColumns = `pk, name, encoding, unit, min_value, max_value, description`
+
+	listMeasurementTypesQuery  = `SELECT ` + measurementTypeColumns + ` FROM measurement_type ORDER BY pk`
+	measurementTypeByIDQuery   = `SELECT ` + measurementTypeColumns + ` FROM measurement_type WHERE pk = :pk`
+	insertMeasurementTypeQuery = `
+		INSERT INTO measurement_type (name, encoding, unit, min_value, max_value, description)
+		VALUES (:name, :encoding, :unit, :min_value, :max_value, :description)
+		RETURNING pk`
+	updateMeasurementTypeQuery = `
+		UPDATE measurement_type SET unit = :unit, min_value = :min_value, max_value = :max_value,
+			description = :description
+		WHERE pk = :pk
+		RETURNING pk`
+	measurementTypeInUseQuery = `
+		SELECT EXISTS (SELECT 1 FROM device_measurement WHERE m_value_type = :pk)
+			OR EXISTS (SELECT 1 FROM device_measurement_rollup WHERE m_value_type = :pk)`
+	measurementTypeHasAlertsQuery = `SELECT EXISTS (SELECT 1 FROM alert_rule WHERE m_value_type = :pk)`
+	deleteMeasurementTypeQuery    = `DELETE FROM measurement_type WHERE pk = :pk RETURNING pk`
+)
+
+type SqliteMeasurementTypeRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteMeasurementTypeRepository(db *SqliteDB) (*SqliteMeasurementTypeRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, insertMeasurementTypeQuery, updateMeasurementTypeQuery, measurementTypeByIDQuery,
+			measurementTypeInUseQuery, measurementTypeHasAlertsQuery, deleteMeasurementTypeQuery),
+		db.Prepare(ReadPool, listMeasurementTypesQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteMeasurementTypeRepository{db}, nil
+}
+
+func (repo *SqliteMeasurementTypeRepository) List(ctx context.Context) (measurementTypes []MeasurementTypeDefinition, err error) {
+	measurementTypes = []MeasurementTypeDefinition{}
+	if err = repo.db.selectAll(ctx, ReadPool, listMeasurementTypesQuery, &measurementTypes, map[string]any{}); err != nil {
+		return nil, sqliteError(err, "failed to list the measurement types")
+	}
+	return
+}
+
+func (repo *SqliteMeasurementTypeRepository) Create(ctx context.Context, measurementType NewMeasurementType) (MeasurementTypeDefinition, error) {
+	var id uint
+	if err := repo.db.get(ctx, WritePool, insertMeasurementTypeQuery, &id, measurementType); err != nil {
+		return MeasurementTypeDefinition{}, sqliteError(err, "failed to create the measurement type")
+	}
+	return MeasurementTypeDefinition{ID: id, NewMeasurementType: measurementType}, nil
+}
+
+func (repo *SqliteMeasurementTypeRepository) Update(ctx context.Context, measurementType MeasurementTypeDefinition) (updated MeasurementTypeDefinition, err error) {
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		var id uint
+		if err := tx.get(ctx, updateMeasurementTypeQuery, &id, measurementType); err != nil {
+			return err
+		}
+		return tx.get(ctx, measurementTypeByIDQuery, &updated, map[string]any{"pk": id})
+	})
+	if err != nil {
+		return MeasurementTypeDefinition{}, sqliteError(err, "failed to update the measurement type")
+	}
+	return
+}
+
+func (repo *SqliteMeasurementTypeRepository) Delete(ctx context.Context, id uint) error {
+	err := repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		key := map[string]any{"pk": id}
+		var inUse bool
+		if err := tx.get(ctx, measurementTypeInUseQuery, &inUse, key); err != nil {
+			return err
+		}
+		if inUse {
+			return NewRepositoryError(InUse, "measurements have the type", "failed to delete the measurement type")
+		}
+		if err := tx.get(ctx, measurementTypeHasAlertsQuery, &inUse, key); err != nil {
+			return err
+		}
+		if inUse {
+			return NewRepositoryError(InUse, "alert rules target the type", "failed to delete the measurement type")
+		}
+		var deleted uint
+		return tx.get(ctx, deleteMeasurementTypeQuery, &deleted, key)
+	})
+	var repositoryErr *RepositoryError
+	if errors.As(err, &repositoryErr) {
+		return repositoryErr
+	}
+	if err != nil {
+		return sqliteError(err, "failed to delete the measurement type")
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+const (
+	valueTypesQuery = `
+		SELECT m_value_type FROM device_measurement
+		UNION
+		SELECT m_value_type FROM device_measurement_rollup
+		ORDER BY m_value_type`
+	watermarkQuery = `SELECT rolled_until FROM rollup_watermark WHERE resolution = :resolution`
+	// The oldest row that the resolution is aggregated from
+	oldestRawQuery    = `SELECT MIN(received_at) FROM device_measurement`
+	oldestRollupQuery = `SELECT MIN(bucket_start) FROM device_measurement_rollup WHERE resolution = :resolution`
+
+	rollupUpsert = `
+		ON CONFLICT (publishing_device_fk, m_value_type, resolution, bucket_start) DO UPDATE SET
+			sample_count = sample_count + excluded.sample_count,
+			min_value = MIN(min_value, excluded.min_value),
+			max_value = MAX(max_value, excluded.max_value),
+			sum_value = sum_value + excluded.sum_value`
+	rollupRawQuery = `
+		INSERT INTO device_measurement_rollup (publishing_device_fk, m_value_type, resolution,
+			bucket_start, sample_count, min_value, max_value, sum_value)
+		SELECT publishing_device_fk, m_value_type, :resolution,
+			(received_at / :resolution) * :resolution AS bucket, COUNT(*),
+			MIN(CAST(m_value AS REAL)), MAX(CAST(m_value AS REAL)), SUM(CAST(m_value AS REAL))
+		FROM device_measurement
+		-- Vectors aren't aggregated
+		WHERE received_at >= :from AND received_at < :until AND m_value NOT LIKE '[%'
+		GROUP BY publishing_device_fk, m_value_type, bucket` + rollupUpsert
+	rollupRollupsQuery = `
+		INSERT INTO device_measurement_rollup (publishing_device_fk, m_value_type, resolution,
+			bucket_start, sample_count, min_value, max_value, sum_value)
+		SELECT publishing_device_fk, m_value_type, :resolution,
+			(bucket_start / :resolution) * :resolution AS bucket, SUM(sample_count),
+			MIN(min_value), MAX(max_value), SUM(sum_value)
+		FROM device_measurement_rollup
+		WHERE resolution = :source AND bucket_start >= :from AND bucket_start < :until
+		GROUP BY publishing_device_fk, m_value_type, bucket` + rollupUpsert
+	storeWatermarkQuery = `
+		INSERT INTO rollup_watermark (resolution, rolled_until) VALUES (:resolution, :until)
+		ON CONFLICT (resolution) DO UPDATE SET rolled_until = excluded.rolled_until`
+
+	deleteRawBeforeQuery = `
+		DELETE FROM device_measurement WHERE pk IN (
+			SELECT pk FROM device_measurement
+			WHERE m_value_type = :value_type AND received_at < :before
+			LIMIT :limit
+		)`
+	deleteRollupsBeforeQuery = `
+		DELETE FROM device_measurement_rollup WHERE rowid IN (
+			SELECT rowid FROM device_measurement_rollup
+			WHERE resolution = :resolution AND m_value_type = :value_type AND bucket_start < :before
+			LIMIT :limit
+		)`
+)
+
+type SqliteRetentionRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteRetentionRepository(db *SqliteDB) (*SqliteRetentionRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, rollupRawQuery, rollupRollupsQuery, storeWatermarkQuery,
+			deleteRawBeforeQuery, deleteRollupsBeforeQuery),
+		db.Prepare(ReadPool, valueTypesQuery, watermarkQuery, oldestRawQuery, oldestRollupQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SqliteRetentionRepository{db}, nil
+}
+
+// sourceResolution is the resolution each rollup is aggregated from
+func sourceResolution(resolution Resolution) (Resolution, error) {
+	switch resolution {
+	case MinuteResolution:
+		return RawResolution, nil
+	case HourResolution:
+		return MinuteResolution, nil
+	}
+	return 0, fmt.Errorf("no rollups are kept with the resolution [%s]", resolution)
+}
+
+func (repo *SqliteRetentionRepository) ValueTypes(ctx context.Context) (valueTypes []uint, err error) {
+	valueTypes = []uint{}
+	if err = repo.db.selectAll(ctx, ReadPool, valueTypesQuery, &valueTypes, map[string]any{}); err != nil {
+		return nil, sqliteError(err, "failed to list the measurement types")
+	}
+	return
+}
+
+func (repo *SqliteRetentionRepository) RolledUntil(ctx context.Context, resolution Resolution) (int64, bool, error) {
+	source, err := sourceResolution(resolution)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var until int64
+	err = repo.db.get(ctx, ReadPool, watermarkQuery, &until, map[string]any{"resolution": resolution})
+	if err == nil {
+		return until, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, false, sqliteError(err, "failed to get the rollup watermark")
+	}
+
+	var oldest sql.NullInt64
+	oldestQuery := oldestRawQuery
+	if source != RawResolution {
+		oldestQuery = oldestRollupQuery
+	}
+	err = repo.db.get(ctx, ReadPool, oldestQuery, &oldest, map[string]any{"resolution": source})
+	if err != nil {
+		return 0, false, sqliteError(err, "failed to get the oldest rollup source")
+	}
+	if !oldest.Valid {
+		return 0, false, nil
+	}
+	return resolution.Floor(oldest.Int64), true, nil
+}
+
+func (repo *SqliteRetentionRepository) Rollup(ctx context.Context, resolution Resolution, from, until int64) error {
+	source, err := sourceResolution(resolution)
+	if err != nil {
+		return err
+	}
+
+	rollupQuery := rollupRawQuery
+	if source != RawResolution {
+		rollupQuery = rollupRollupsQuery
+	}
+
+	// The watermark moves in the same transaction, so a bucket is never aggregated twice
+	err = repo.db.inTx(ctx, func(tx *SqliteTx) error {
+		arguments := map[string]any{"resolution": resolution, "source": source, "from": from, "until": until}
+		if _, err := tx.exec(ctx, rollupQuery, arguments); err != nil {
+			return err
+		}
+		_, err := tx.exec(ctx, storeWatermarkQuery, arguments)
+		return err
+	})
+	if err != nil {
+		return sqliteError(err, "failed to rollup the measurements")
+	}
+	return nil
+}
+
+func (repo *SqliteRetentionRepository) DeleteBefore(
+	ctx context.Context,
+	resolution Resolution,
+	valueType uint,
+	before int64,
+	limit uint,
+) (int64, error) {
+	deleteQuery := deleteRollupsBeforeQuery
+	if resolution == RawResolution {
+		deleteQuery = deleteRawBeforeQuery
+	}
+
+	result, err := repo.db.exec(ctx, deleteQuery, map[string]any{
+		"resolution": resolution,
+		"value_type": valueType,
+		"before":     before,
+		"limit":      limit,
+	})
+	if err != nil {
+		return 0, sqliteError(err, "failed to delete the expired measurements")
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+const (
+	shadowColumns = `device_fk, desired, desired_version, desired_by, desired_at,
+		reported, reported_version, reported_at`
+	shadowTemplateColumns = `device_type, document, version, updated_by, updated_at`
+
+	shadowQuery      = `SELECT ` + shadowColumns + ` FROM device_shadow WHERE device_fk = :device_fk`
+	listShadowsQuery = `SELECT ` + shadowColumns + ` FROM device_shadow ORDER BY device_fk`
+	// Created from version 0 only, an existing row is always selected, so the conflict checks its version
+	setDesiredQuery = `
+		INSERT INTO device_shadow (device_fk, desired, desired_version, desired_by, desired_at)
+		SELECT :device_fk, :document, 1, :actor, :at
+		WHERE :version = 0 OR EXISTS (SELECT 1 FROM device_shadow WHERE device_fk = :device_fk)
+		ON CONFLICT (device_fk) DO UPDATE SET desired = excluded.desired, desired_version = desired_version + 1,
+			desired_by = excluded.desired_by, desired_at = excluded.desired_at
+		WHERE desired_version = :version
+		RETURNING ` + shadowColumns
+	setReportedQuery = `
+		INSERT INTO device_shadow (device_fk, reported, reported_version, reported_at)
+		SELECT :device_fk, :document, 1, :at
+		WHERE :version = 0 OR EXISTS (SELECT 1 FROM device_shadow WHERE device_fk = :device_fk)
+		ON CONFLICT (device_fk) DO UPDATE SET reported = excluded.reported, reported_version = reported_version + 1,
+			reported_at = excluded.reported_at
+		WHERE reported_version = :version
+		RETURNING ` + shadowColumns
+
+	shadowTemplateQuery      = `SELECT ` + shadowTemplateColumns + ` FROM shadow_template WHERE device_type = :device_type`
+	listShadowTemplatesQuery = `SELECT ` + shadowTemplateColumns + ` FROM shadow_template ORDER BY device_type`
+	setShadowTemplateQuery   = `
+		INSERT INTO shadow_template (device_type, document, version, updated_by, updated_at)
+		SELECT :device_type, :document, 1, :actor, :at
+		WHERE :version = 0 OR EXISTS (SELECT 1 FROM shadow_template WHERE device_type = :device_type)
+		ON CONFLICT (device_type) DO UPDATE SET document = excluded.document, version = version + 1,
+			updated_by = excluded.updated_by, updated_at = excluded.updated_at
+		WHERE version = :version
+		RETURNING ` + shadowTemplateColumns
+)
+
+type SqliteShadowRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteShadowRepository(db *SqliteDB) (*SqliteShadowRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, setDesiredQuery, setReportedQuery, setShadowTemplateQuery),
+		db.Prepare(ReadPool, shadowQuery, listShadowsQuery, shadowTemplateQuery, listShadowTemplatesQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteShadowRepository{db}, nil
+}
+
+func (repo *SqliteShadowRepository) Get(ctx context.Context, deviceID uint) (shadow Shadow, err error) {
+	err = repo.db.get(ctx, ReadPool, shadowQuery, &shadow, map[string]any{"device_fk": deviceID})
+	if errors.Is(err, sql.ErrNoRows) {
+		return Shadow{DeviceFk: deviceID}, nil
+	}
+	if err != nil {
+		return Shadow{}, sqliteError(err, "failed to get the shadow")
+	}
+	return
+}
+
+func (repo *SqliteShadowRepository) List(ctx context.Context) (shadows []Shadow, err error) {
+	shadows = []Shadow{}
+	if err = repo.db.selectAll(ctx, ReadPool, listShadowsQuery, &shadows, map[string]any{}); err != nil {
+		return nil, sqliteError(err, "failed to list the shadows")
+	}
+	return
+}
+
+func (repo *SqliteShadowRepository) SetDesired(
+	ctx context.Context, deviceID, version uint, document RawJSON, actor string, at int64,
+) (shadow Shadow, err error) {
+	key := map[string]any{"device_fk": deviceID, "version": version, "document": document, "actor": actor, "at": at}
+	if err = repo.db.get(ctx, WritePool, setDesiredQuery, &shadow, key); err != nil {
+		return Shadow{}, sqliteError(err, "failed to set the desired config")
+	}
+	return
+}
+
+func (repo *SqliteShadowRepository) SetReported(
+	ctx context.Context, deviceID, version uint, document RawJSON, at int64,
+) (shadow Shadow, err error) {
+	key := map[string]any{"device_fk": deviceID, "version": version, "document": document, "at": at}
+	if err = repo.db.get(ctx, WritePool, setReportedQuery, &shadow, key); err != nil {
+		return Shadow{}, sqliteError(err, "failed to set the reported config")
+	}
+	return
+}
+
+func (repo *SqliteShadowRepository) GetTemplate(ctx context.Context, deviceType DeviceType) (template ShadowTemplate, err error) {
+	err = repo.db.get(ctx, ReadPool, shadowTemplateQuery, &template, map[string]any{"device_type": deviceType})
+	if errors.Is(err, sql.ErrNoRows) {
+		return ShadowTemplate{DeviceType: deviceType}, nil
+	}
+	if err != nil {
+		return ShadowTemplate{}, sqliteError(err, "failed to get the shadow template")
+	}
+	return
+}
+
+func (repo *SqliteShadowRepository) ListTemplates(ctx context.Context) (templates []ShadowTemplate, err error) {
+	templates = []ShadowTemplate{}
+	if err = repo.db.selectAll(ctx, ReadPool, listShadowTemplatesQuery, &templates, map[string]any{}); err != nil {
+		return nil, sqliteError(err, "failed to list the shadow templates")
+	}
+	return
+}
+
+func (repo *SqliteShadowRepository) SetTemplate(
+	ctx context.Context, deviceType DeviceType, version uint, document RawJSON, actor string, at int64,
+) (template ShadowTemplate, err error) {
+	key := map[string]any{"device_type": deviceType, "version": version, "document": document, "actor": actor, "at": at}
+	if err = repo.db.get(ctx, WritePool, setShadowTemplateQuery, &template, key); err != nil {
+		return ShadowTemplate{}, sqliteError(err, "failed to set the shadow template")
+	}
+	return
+}
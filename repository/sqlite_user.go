@@ -0,0 +1,222 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+const (
+	userColumns = `pk, username, password_hash, role, created_at, disabled_at`
+
+	insertUserQuery = `
+		INSERT INTO admin_user (username, password_hash, role, created_at)
+		VALUES (:username, :password_hash, :role, :created_at)
+		RETURNING ` + userColumns
+	userByIDQuery       = `SELECT ` + userColumns + ` FROM admin_user WHERE pk = :pk`
+	userByUsernameQuery = `SELECT ` + userColumns + ` FROM admin_user WHERE username = :username`
+	listUsersQuery      = `SELECT ` + userColumns + ` FROM admin_user ORDER BY pk`
+	countUsersQuery     = `SELECT COUNT(*) FROM admin_user`
+	updateUserQuery     = `
+		UPDATE admin_user SET role = :role, disabled_at = :disabled_at
+		WHERE pk = :pk
+		RETURNING ` + userColumns
+	setUserPasswordQuery = `UPDATE admin_user SET password_hash = :password_hash WHERE pk = :pk`
+)
+
+type SqliteUserRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteUserRepository(db *SqliteDB) (*SqliteUserRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, insertUserQuery, updateUserQuery, setUserPasswordQuery),
+		db.Prepare(ReadPool, userByIDQuery, userByUsernameQuery, listUsersQuery, countUsersQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteUserRepository{db}, nil
+}
+
+func (repo *SqliteUserRepository) Create(ctx context.Context, user NewUser) (created User, err error) {
+	if err = repo.db.get(ctx, WritePool, insertUserQuery, &created, user); err != nil {
+		return User{}, sqliteError(err, "failed to create the user")
+	}
+	return
+}
+
+func (repo *SqliteUserRepository) GetByID(ctx context.Context, id uint) (user User, err error) {
+	if err = repo.db.get(ctx, ReadPool, userByIDQuery, &user, map[string]any{"pk": id}); err != nil {
+		return User{}, sqliteError(err, "failed to get the user")
+	}
+	return
+}
+
+func (repo *SqliteUserRepository) GetByUsername(ctx context.Context, username string) (user User, err error) {
+	if err = repo.db.get(ctx, ReadPool, userByUsernameQuery, &user, map[string]any{"username": username}); err != nil {
+		return User{}, sqliteError(err, "failed to get the user")
+	}
+	return
+}
+
+func (repo *SqliteUserRepository) List(ctx context.Context) (users []User, err error) {
+	users = []User{}
+	if err = repo.db.selectAll(ctx, ReadPool, listUsersQuery, &users, map[string]any{}); err != nil {
+		return nil, sqliteError(err, "failed to list the users")
+	}
+	return
+}
+
+func (repo *SqliteUserRepository) Count(ctx context.Context) (count uint, err error) {
+	if err = repo.db.get(ctx, ReadPool, countUsersQuery, &count, map[string]any{}); err != nil {
+		return 0, sqliteError(err, "failed to count the users")
+	}
+	return
+}
+
+func (repo *SqliteUserRepository) Update(ctx context.Context, id uint, role UserRole, disabledAt sql.NullInt64) (user User, err error) {
+	err = repo.db.get(ctx, WritePool, updateUserQuery, &user, map[string]any{"pk": id, "role": role, "disabled_at": disabledAt})
+	if err != nil {
+		return User{}, sqliteError(err, "failed to update the user")
+	}
+	return
+}
+
+func (repo *SqliteUserRepository) SetPassword(ctx context.Context, id uint, passwordHash string) error {
+	result, err := repo.db.exec(ctx, setUserPasswordQuery, map[string]any{"pk": id, "password_hash": passwordHash})
+	if err != nil {
+		return sqliteError(err, "failed to set the password of the user")
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return NewRepositoryError(NotFound, "no matching rows", "failed to set the password of the user")
+	}
+	return nil
+}
+
+// ---------------------------------------------------
+
+const (
+	sessionColumns = `pk, user_fk, token_hash, created_at, expires_at, revoked_at`
+
+	insertSessionQuery = `
+		INSERT INTO admin_session (user_fk, token_hash, created_at, expires_at)
+		VALUES (:user, :token_hash, :at, :expires_at)
+		RETURNING ` + sessionColumns
+	validSessionQuery = `
+		SELECT ` + sessionColumns + ` FROM admin_session
+		WHERE token_hash = :token_hash AND revoked_at IS NULL AND created_at <= :at AND expires_at > :at`
+	revokeSessionQuery = `
+		UPDATE admin_session SET revoked_at = :at
+		WHERE token_hash = :token_hash AND revoked_at IS NULL AND expires_at > :at`
+	revokeUserSessionsQuery = `
+		UPDATE admin_session SET revoked_at = :at
+		WHERE user_fk = :user AND revoked_at IS NULL AND expires_at > :at`
+)
+
+type SqliteSessionRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteSessionRepository(db *SqliteDB) (*SqliteSessionRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, insertSessionQuery, revokeSessionQuery, revokeUserSessionsQuery),
+		db.Prepare(ReadPool, validSessionQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteSessionRepository{db}, nil
+}
+
+func (repo *SqliteSessionRepository) Create(ctx context.Context, userID uint, tokenHash string, at, expiresAt int64) (session Session, err error) {
+	key := map[string]any{"user": userID, "token_hash": tokenHash, "at": at, "expires_at": expiresAt}
+	if err = repo.db.get(ctx, WritePool, insertSessionQuery, &session, key); err != nil {
+		return Session{}, sqliteError(err, "failed to create the session")
+	}
+	return
+}
+
+func (repo *SqliteSessionRepository) Valid(ctx context.Context, tokenHash string, at int64) (session Session, err error) {
+	err = repo.db.get(ctx, ReadPool, validSessionQuery, &session, map[string]any{"token_hash": tokenHash, "at": at})
+	if err != nil {
+		return Session{}, sqliteError(err, "failed to get the session")
+	}
+	return
+}
+
+func (repo *SqliteSessionRepository) Revoke(ctx context.Context, tokenHash string, at int64) error {
+	result, err := repo.db.exec(ctx, revokeSessionQuery, map[string]any{"token_hash": tokenHash, "at": at})
+	if err != nil {
+		return sqliteError(err, "failed to revoke the session")
+	}
+	if revoked, _ := result.RowsAffected(); revoked == 0 {
+		return NewRepositoryError(NotFound, "no matching rows", "failed to revoke the session")
+	}
+	return nil
+}
+
+func (repo *SqliteSessionRepository) RevokeAll(ctx context.Context, userID uint, at int64) (int64, error) {
+	result, err := repo.db.exec(ctx, revokeUserSessionsQuery, map[string]any{"user": userID, "at": at})
+	if err != nil {
+		return 0, sqliteError(err, "failed to revoke the sessions of the user")
+	}
+	return result.RowsAffected()
+}
+
+// ---------------------------------------------------
+
+const (
+	auditColumns = `pk, actor, actor_role, action, target, status_code, at`
+
+	insertAuditEntryQuery = `
+		INSERT INTO audit_log (actor, actor_role, action, target, status_code, at)
+		VALUES (:actor, :actor_role, :action, :target, :status_code, :at)`
+	listAuditEntriesQuery = `
+		SELECT ` + auditColumns + ` FROM audit_log
+		WHERE (:actor = '' OR actor = :actor) AND at BETWEEN :from AND :to
+		ORDER BY at DESC, pk DESC
+		LIMIT :limit`
+)
+
+type SqliteAuditRepository struct {
+	db *SqliteDB
+}
+
+func NewSqliteAuditRepository(db *SqliteDB) (*SqliteAuditRepository, error) {
+	err := errors.Join(
+		db.Prepare(WritePool, insertAuditEntryQuery),
+		db.Prepare(ReadPool, listAuditEntriesQuery),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteAuditRepository{db}, nil
+}
+
+func (repo *SqliteAuditRepository) Record(ctx context.Context, entry AuditEntry) error {
+	if _, err := repo.db.exec(ctx, insertAuditEntryQuery, entry); err != nil {
+		return sqliteError(err, "failed to record the audit entry")
+	}
+	return nil
+}
+
+func (repo *SqliteAuditRepository) List(ctx context.Context, query AuditQuery) (entries []AuditEntry, err error) {
+	// A negative limit means no limit to sqlite
+	limit := int64(-1)
+	if query.Limit > 0 {
+		limit = int64(query.Limit)
+	}
+
+	entries = []AuditEntry{}
+	err = repo.db.selectAll(ctx, ReadPool, listAuditEntriesQuery, &entries, map[string]any{
+		"actor": query.Actor,
+		"from":  query.From,
+		"to":    query.To,
+		"limit": limit,
+	})
+	if err != nil {
+		return nil, sqliteError(err, "failed to list the audit log")
+	}
+	return
+}
@@ -0,0 +1,144 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+// Width of the source rows aggregated by each rollup transaction
+const rollupWindow = time.Hour
+
+/*
+Job rolls up the measurements and deletes the expired ones, in small steps
+with pauses between them, so the api is never locked out of the db for long.
+A resolution is only deleted once the next one has aggregated it.
+*/
+type Job struct {
+	repo   repository.RetentionRepository
+	config Config
+}
+
+func NewJob(repo repository.RetentionRepository, config Config) *Job {
+	return &Job{repo: repo, config: config.WithDefaults()}
+}
+
+// Run runs the job every interval, until the context is done
+func (job *Job) Run(ctx context.Context) {
+	ticker := time.NewTicker(job.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := job.RunOnce(ctx, time.Now()); err != nil && !errors.Is(err, context.Canceled) {
+			slog.Error("retention", "run-failure", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+RunOnce rolls up every complete bucket up to the lag behind now, and deletes what expired
+by now, the raw measurements and minute rollups only once aggregated.
+*/
+func (job *Job) RunOnce(ctx context.Context, now time.Time) error {
+	settled := now.Add(-job.config.Lag).UnixMilli()
+
+	minuteUntil, err := job.rollup(ctx, repository.MinuteResolution, repository.MinuteResolution.Floor(settled))
+	if err != nil {
+		return err
+	}
+	hourUntil, err := job.rollup(ctx, repository.HourResolution, repository.HourResolution.Floor(minuteUntil))
+	if err != nil {
+		return err
+	}
+
+	valueTypes, err := job.repo.ValueTypes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, valueType := range valueTypes {
+		policy := job.config.PolicyFor(valueType)
+		if policy.Raw > 0 {
+			before := min(now.Add(-policy.Raw).UnixMilli(), minuteUntil)
+			if err = job.deleteBefore(ctx, repository.RawResolution, valueType, before); err != nil {
+				return err
+			}
+		}
+		if policy.Minute > 0 {
+			before := min(now.Add(-policy.Minute).UnixMilli(), hourUntil)
+			if err = job.deleteBefore(ctx, repository.MinuteResolution, valueType, before); err != nil {
+				return err
+			}
+		}
+		if policy.Hourly > 0 {
+			before := now.Add(-policy.Hourly).UnixMilli()
+			if err = job.deleteBefore(ctx, repository.HourResolution, valueType, before); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+rollup aggregates the resolution from its watermark up to until, one window at a time,
+returning the watermark it reached (0 when there was nothing to aggregate).
+*/
+func (job *Job) rollup(ctx context.Context, resolution repository.Resolution, until int64) (int64, error) {
+	from, found, err := job.repo.RolledUntil(ctx, resolution)
+	if err != nil || !found {
+		return 0, err
+	}
+
+	for from < until {
+		end := min(from+rollupWindow.Milliseconds(), until)
+		if err = job.repo.Rollup(ctx, resolution, from, end); err != nil {
+			return from, err
+		}
+		from = end
+		if err = job.pause(ctx); err != nil {
+			return from, err
+		}
+	}
+	return from, nil
+}
+
+// deleteBefore deletes the expired rows in batches, until a batch comes back short
+func (job *Job) deleteBefore(ctx context.Context, resolution repository.Resolution, valueType uint, before int64) error {
+	var total int64
+	for {
+		deleted, err := job.repo.DeleteBefore(ctx, resolution, valueType, before, job.config.BatchSize)
+		if err != nil {
+			return err
+		}
+		total += deleted
+		if deleted < int64(job.config.BatchSize) {
+			break
+		}
+		if err = job.pause(ctx); err != nil {
+			return err
+		}
+	}
+
+	if total > 0 {
+		slog.Info("retention", "deleted-rows", total, "resolution", resolution.String(), "m_value_type", valueType)
+	}
+	return nil
+}
+
+func (job *Job) pause(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(job.config.BatchPause):
+		return nil
+	}
+}
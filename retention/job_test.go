@@ -0,0 +1,92 @@
+package retention
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobRunOnce(t *testing.T) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	device, err := repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000001"})
+	assert.NoError(t, err)
+
+	// One measurement every 10 minutes, over 3 hours
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 18; i++ {
+		_, err := repos.Measurements.Insert(ctx, repository.NewMeasurement{
+			PublishingDeviceFk: device.ID,
+			Value:              "10",
+			ValueType:          1,
+			ReceivedAt:         start.Add(time.Duration(i) * 10 * time.Minute).UnixMilli(),
+		})
+		assert.NoError(t, err)
+	}
+
+	job := NewJob(repos.Retention, Config{
+		BatchSize:  4,
+		BatchPause: time.Millisecond,
+		Lag:        10 * time.Minute,
+		Default:    Policy{Raw: time.Hour, Minute: 2 * time.Hour},
+	})
+	// The three hours are rolled up once past the lag
+	now := start.Add(3*time.Hour + 10*time.Minute)
+	assert.NoError(t, job.RunOnce(ctx, now))
+
+	query := repository.MeasurementQuery{DeviceID: device.ID, From: 0, To: now.UnixMilli()}
+	raw, err := repos.Measurements.Query(ctx, query)
+	assert.NoError(t, err)
+	assert.Len(t, raw, 5, "only the last hour of raw data is kept")
+
+	minutes, err := repos.Measurements.QueryRollups(ctx, query, repository.MinuteResolution)
+	assert.NoError(t, err)
+	assert.Len(t, minutes, 11, "only the last two hours of minute rollups are kept")
+
+	hours, err := repos.Measurements.QueryRollups(ctx, query, repository.HourResolution)
+	assert.NoError(t, err)
+	if assert.Len(t, hours, 3) {
+		assert.Equal(t, uint(6), hours[0].Count)
+		assert.Equal(t, 10.0, hours[0].Avg)
+	}
+
+	// A second run finds nothing new to aggregate
+	assert.NoError(t, job.RunOnce(ctx, now))
+	hours, err = repos.Measurements.QueryRollups(ctx, query, repository.HourResolution)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(6), hours[0].Count)
+}
+
+func TestJobRollsUpLateMeasurements(t *testing.T) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	device, err := repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000001"})
+	assert.NoError(t, err)
+	insert := func(receivedAt time.Time) {
+		_, err := repos.Measurements.Insert(ctx, repository.NewMeasurement{
+			PublishingDeviceFk: device.ID, Value: "10", ValueType: 1, ReceivedAt: receivedAt.UnixMilli(),
+		})
+		assert.NoError(t, err)
+	}
+
+	job := NewJob(repos.Retention, Config{BatchPause: time.Millisecond, Lag: 10 * time.Minute})
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	insert(start)
+	now := start.Add(20 * time.Minute)
+	assert.NoError(t, job.RunOnce(ctx, now))
+
+	// Received 5 minutes ago, but only written now, like a measurement flushed or replayed late
+	insert(now.Add(-5 * time.Minute))
+	assert.NoError(t, job.RunOnce(ctx, now.Add(10*time.Minute)))
+
+	minutes, err := repos.Measurements.QueryRollups(ctx, repository.MeasurementQuery{
+		DeviceID: device.ID, To: now.Add(time.Hour).UnixMilli(),
+	}, repository.MinuteResolution)
+	assert.NoError(t, err)
+	if assert.Len(t, minutes, 2) {
+		assert.Equal(t, now.Add(-5*time.Minute).UnixMilli(), minutes[1].BucketStart)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Package retention keeps the stored measurements bounded, aggregating them into
+minute and hour rollups and deleting every resolution once it is past its
+retention, as configured per measurement type.
+*/
+package retention
+
+import (
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+// Widest range queried from each resolution when the resolution is chosen automatically
+const (
+	MaxRawSpan    = 2 * 24 * time.Hour
+	MaxMinuteSpan = 31 * 24 * time.Hour
+)
+
+// Policy is how long each resolution of a measurement type is kept, 0 keeps it forever
+type Policy struct {
+	Raw    time.Duration
+	Minute time.Duration
+	Hourly time.Duration
+}
+
+// keeps reports if the retention still holds data from the given instant
+func keeps(retention time.Duration, from, now time.Time) bool {
+	return retention == 0 || !from.Before(now.Add(-retention))
+}
+
+/*
+Config holds the retention policies, and how the job paces itself,
+Types overrides the Default policy for specific measurement types.
+*/
+type Config struct {
+	// Time between two runs of the job
+	Interval time.Duration
+	// Rows deleted per statement, keeping each write lock short
+	BatchSize uint
+	// Pause between two batches, letting the api requests through
+	BatchPause time.Duration
+	/*
+		How far behind now the minute rollups stop, the measurements are stored by when they
+		were received, but written later, once flushed, or replayed from the ingest spill file.
+		A measurement written behind the rollups is never aggregated, and lost once its raw
+		retention passes, the lag should cover the flush interval and the spill replays.
+	*/
+	Lag     time.Duration
+	Default Policy
+	Types   map[uint]Policy
+}
+
+// WithDefaults fills every pacing value left out, the policies are kept as they are
+func (config Config) WithDefaults() Config {
+	if config.Interval == 0 {
+		config.Interval = 5 * time.Minute
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = 500
+	}
+	if config.BatchPause == 0 {
+		config.BatchPause = 50 * time.Millisecond
+	}
+	if config.Lag == 0 {
+		config.Lag = 15 * time.Minute
+	}
+	return config
+}
+
+// PolicyFor returns the policy of the measurement type, or the default one
+func (config Config) PolicyFor(valueType uint) Policy {
+	if policy, exists := config.Types[valueType]; exists {
+		return policy
+	}
+	return config.Default
+}
+
+/*
+ResolutionFor chooses the resolution a range of measurements is read from.
+Raw data is used while it is still kept and the range is short, minute rollups
+while they are kept and the range is up to a month, and hour rollups otherwise.
+A nil valueType queries every type, so the default policy is used.
+Rollups lag behind the raw data by up to one run of the job.
+*/
+func (config Config) ResolutionFor(valueType *uint, from, to, now time.Time) repository.Resolution {
+	policy := config.Default
+	if valueType != nil {
+		policy = config.PolicyFor(*valueType)
+	}
+
+	span := to.Sub(from)
+	if keeps(policy.Raw, from, now) && span <= MaxRawSpan {
+		return repository.RawResolution
+	}
+	if keeps(policy.Minute, from, now) && span <= MaxMinuteSpan {
+		return repository.MinuteResolution
+	}
+	return repository.HourResolution
+}
@@ -0,0 +1,42 @@
+package retention
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolutionFor(t *testing.T) {
+	day := 24 * time.Hour
+	now := time.UnixMilli(1_000 * int64(day/time.Millisecond))
+	config := Config{
+		Default: Policy{Raw: 30 * day, Minute: 365 * day},
+		Types:   map[uint]Policy{2: {Raw: day, Minute: 7 * day}},
+	}
+	typed := uint(2)
+
+	cases := []struct {
+		name      string
+		valueType *uint
+		from, to  time.Time
+		expected  repository.Resolution
+	}{
+		{"recent short range", nil, now.Add(-day), now, repository.RawResolution},
+		{"recent long range", nil, now.Add(-10 * day), now, repository.MinuteResolution},
+		{"raw data expired", nil, now.Add(-40 * day), now.Add(-39 * day), repository.MinuteResolution},
+		{"longer than a month", nil, now.Add(-90 * day), now, repository.HourResolution},
+		{"minute data expired", nil, now.Add(-400 * day), now.Add(-399 * day), repository.HourResolution},
+		{"typed policy", &typed, now.Add(-2 * day), now.Add(-day), repository.MinuteResolution},
+		{"typed minute expired", &typed, now.Add(-8 * day), now.Add(-7 * day), repository.HourResolution},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, config.ResolutionFor(c.valueType, c.from, c.to, now))
+		})
+	}
+
+	forever := Config{}
+	assert.Equal(t, repository.RawResolution, forever.ResolutionFor(nil, time.UnixMilli(0), time.UnixMilli(0).Add(day), now))
+}
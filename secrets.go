@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Prefixes that mark a config string value as a reference to a secret
+const (
+	SecretFilePrefix = "file:"
+	SecretEnvPrefix  = "env:"
+)
+
+/*
+ResolveSecrets walks the fields tagged `secret:"true"` reachable from the given struct
+pointer, and replaces the string values that reference a secret with the secret itself.
+A value can reference a file with "file:/run/secrets/x", or an environment
+variable with "env:NAME", any other value is left untouched.
+Only the tagged fields are resolved, a sqlite uri like "file:db.sqlite" is not a secret.
+The resolution happens every time the config is loaded, reloads included.
+*/
+func ResolveSecrets(config any) error {
+	value := reflect.ValueOf(config)
+	if value.Kind() != reflect.Pointer || value.Elem().Kind() != reflect.Struct {
+		return errors.New("secrets can only be resolved on a pointer to a struct")
+	}
+
+	return resolveSecretsValue(value.Elem(), "", false)
+}
+
+// resolveSecretsValue resolves the strings under the value, when it, or a field holding it, is tagged as a secret
+func resolveSecretsValue(value reflect.Value, path string, secret bool) error {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+		return resolveSecretsValue(value.Elem(), path, secret)
+
+	case reflect.Struct:
+		valueType := value.Type()
+		for i := 0; i < value.NumField(); i++ {
+			field := valueType.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			fieldSecret := secret || field.Tag.Get("secret") == "true"
+			if err := resolveSecretsValue(value.Field(i), joinSecretPath(path, field), fieldSecret); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if err := resolveSecretsValue(value.Index(i), fmt.Sprintf("%s[%d]", path, i), secret); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		// Map values are not addressable, so they get copied, resolved and stored back
+		iter := value.MapRange()
+		for iter.Next() {
+			entry := reflect.New(iter.Value().Type()).Elem()
+			entry.Set(iter.Value())
+			if err := resolveSecretsValue(entry, fmt.Sprintf("%s.%v", path, iter.Key()), secret); err != nil {
+				return err
+			}
+			value.SetMapIndex(iter.Key(), entry)
+		}
+
+	case reflect.String:
+		if !secret || !value.CanSet() {
+			return nil
+		}
+		resolved, isReference, err := resolveSecretReference(value.String())
+		if err != nil {
+			return fmt.Errorf("could not resolve the secret for [%s]: %w", path, err)
+		}
+		if isReference {
+			value.SetString(resolved)
+		}
+	}
+
+	return nil
+}
+
+/*
+ChangedSecrets returns the paths of the fields tagged `secret:"true"` whose values differ
+between the two given structs, of the same type. Only the paths are returned, never the
+secrets, so they can be logged.
+*/
+func ChangedSecrets(previous, next any) []string {
+	previousSecrets, nextSecrets := map[string]string{}, map[string]string{}
+	collectSecrets(reflect.ValueOf(previous), "", false, previousSecrets)
+	collectSecrets(reflect.ValueOf(next), "", false, nextSecrets)
+
+	changed := []string{}
+	for path, secret := range nextSecrets {
+		if previousSecret, found := previousSecrets[path]; !found || previousSecret != secret {
+			changed = append(changed, path)
+		}
+	}
+	for path := range previousSecrets {
+		if _, found := nextSecrets[path]; !found {
+			changed = append(changed, path)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
+
+// collectSecrets gathers the strings under the value tagged as a secret, by their path
+func collectSecrets(value reflect.Value, path string, secret bool, secrets map[string]string) {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !value.IsNil() {
+			collectSecrets(value.Elem(), path, secret, secrets)
+		}
+
+	case reflect.Struct:
+		valueType := value.Type()
+		for i := 0; i < value.NumField(); i++ {
+			field := valueType.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			fieldSecret := secret || field.Tag.Get("secret") == "true"
+			collectSecrets(value.Field(i), joinSecretPath(path, field), fieldSecret, secrets)
+		}
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			collectSecrets(value.Index(i), fmt.Sprintf("%s[%d]", path, i), secret, secrets)
+		}
+
+	case reflect.Map:
+		iter := value.MapRange()
+		for iter.Next() {
+			collectSecrets(iter.Value(), fmt.Sprintf("%s.%v", path, iter.Key()), secret, secrets)
+		}
+
+	case reflect.String:
+		if secret {
+			secrets[path] = value.String()
+		}
+	}
+}
+
+/*
+resolveSecretReference returns the secret pointed to by the reference, and if
+the given value was a reference at all. The secret value is never included in
+the returned errors.
+*/
+func resolveSecretReference(reference string) (secret string, isReference bool, err error) {
+	switch {
+	case strings.HasPrefix(reference, SecretFilePrefix):
+		secret, err = readSecretFile(strings.TrimPrefix(reference, SecretFilePrefix))
+		return secret, true, err
+
+	case strings.HasPrefix(reference, SecretEnvPrefix):
+		name := strings.TrimPrefix(reference, SecretEnvPrefix)
+		secret, defined := os.LookupEnv(name)
+		if !defined {
+			return "", true, fmt.Errorf("environment variable [%s] is not defined", name)
+		}
+		return secret, true, nil
+	}
+
+	return reference, false, nil
+}
+
+/*
+readSecretFile reads a secret from a file, refusing any file that can be read
+by every user of the system. A single trailing new line is removed, since
+most tools used to create these files will add one.
+*/
+func readSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("secret file [%s] can't be accessed", path)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("secret file [%s] is a directory", path)
+	}
+	if info.Mode().Perm()&0o004 != 0 {
+		return "", fmt.Errorf("secret file [%s] is world-readable, refusing to use it", path)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("secret file [%s] can't be read", path)
+	}
+
+	secret := strings.TrimSuffix(string(contents), "\n")
+	return strings.TrimSuffix(secret, "\r"), nil
+}
+
+// joinSecretPath builds the toml path of a field, used to point out which value failed
+func joinSecretPath(parent string, field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("toml"), ",")[0]
+	if name == "" {
+		name = field.Name
+	}
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
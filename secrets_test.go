@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type secretsTestConfig struct {
+	Uri      string            `toml:"uri"`
+	Password string            `toml:"password" secret:"true"`
+	Nested   *secretsTestGroup `toml:"nested" secret:"true"`
+	Tokens   map[string]string `toml:"tokens" secret:"true"`
+}
+
+type secretsTestGroup struct {
+	Keys []string `toml:"keys"`
+}
+
+func writeSecretFile(t *testing.T, name, contents string, perm os.FileMode) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), perm); err != nil {
+		t.Fatal(err)
+	}
+	// Set explicitly, the umask would hide a world-readable mode
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestResolveSecrets(t *testing.T) {
+	t.Setenv("MAESTRO_TEST_PASSWORD", "from-env")
+	keyFile := writeSecretFile(t, "key", "from-file\r\n", 0o600)
+
+	config := secretsTestConfig{
+		Uri:      "file:db.sqlite?_txlock=immediate",
+		Password: "env:MAESTRO_TEST_PASSWORD",
+		Nested:   &secretsTestGroup{Keys: []string{"file:" + keyFile, "plain"}},
+		Tokens:   map[string]string{"device": "env:MAESTRO_TEST_PASSWORD"},
+	}
+	assert.NoError(t, ResolveSecrets(&config))
+	// The uri isn't tagged as a secret, it stays a sqlite uri
+	assert.Equal(t, "file:db.sqlite?_txlock=immediate", config.Uri)
+	assert.Equal(t, "from-env", config.Password)
+	assert.Equal(t, []string{"from-file", "plain"}, config.Nested.Keys)
+	assert.Equal(t, "from-env", config.Tokens["device"])
+
+	assert.Error(t, ResolveSecrets(config))
+}
+
+func TestResolveSecretReference(t *testing.T) {
+	t.Setenv("MAESTRO_TEST_PASSWORD", "from-env")
+	private := writeSecretFile(t, "private", "secret\n", 0o600)
+	public := writeSecretFile(t, "public", "secret\n", 0o644)
+
+	for _, test := range []struct {
+		name        string
+		reference   string
+		secret      string
+		isReference bool
+		fails       bool
+	}{
+		{name: "plain value", reference: "admin", secret: "admin"},
+		{name: "env", reference: "env:MAESTRO_TEST_PASSWORD", secret: "from-env", isReference: true},
+		{name: "env not defined", reference: "env:MAESTRO_TEST_MISSING", isReference: true, fails: true},
+		{name: "file", reference: "file:" + private, secret: "secret", isReference: true},
+		{name: "world-readable file", reference: "file:" + public, isReference: true, fails: true},
+		{name: "missing file", reference: "file:" + private + ".missing", isReference: true, fails: true},
+		{name: "directory", reference: "file:" + t.TempDir(), isReference: true, fails: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			secret, isReference, err := resolveSecretReference(test.reference)
+			assert.Equal(t, test.isReference, isReference)
+			if test.fails {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.secret, secret)
+		})
+	}
+}
+
+func TestChangedSecrets(t *testing.T) {
+	previous := secretsTestConfig{
+		Uri:      "file:db.sqlite",
+		Password: "old",
+		Nested:   &secretsTestGroup{Keys: []string{"a", "b"}},
+		Tokens:   map[string]string{"device": "same", "gateway": "gone"},
+	}
+	next := secretsTestConfig{
+		Uri:      "file:other.sqlite",
+		Password: "new",
+		Nested:   &secretsTestGroup{Keys: []string{"a", "c"}},
+		Tokens:   map[string]string{"device": "same", "relay": "added"},
+	}
+
+	// The uri isn't a secret, its change isn't reported
+	assert.Equal(t,
+		[]string{"nested.keys[1]", "password", "tokens.gateway", "tokens.relay"},
+		ChangedSecrets(previous, next),
+	)
+	assert.Empty(t, ChangedSecrets(previous, previous))
+}
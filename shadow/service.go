@@ -0,0 +1,248 @@
+package shadow
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+/*
+State is the shadow of a device as the operators see it, with its effective desired
+config, the template of its type with its own desired config laid over, and the delta.
+*/
+type State struct {
+	SerialId string `json:"serial_id"`
+	repository.Shadow
+	TemplateVersion uint               `json:"template_version"`
+	Effective       repository.RawJSON `json:"effective"`
+	Delta           repository.RawJSON `json:"delta"`
+	InSync          bool               `json:"in_sync"`
+}
+
+// DeviceDelta is what a device fetches, the settings to apply, and the versions they come from
+type DeviceDelta struct {
+	Delta           repository.RawJSON `json:"delta"`
+	DesiredVersion  uint               `json:"desired_version"`
+	TemplateVersion uint               `json:"template_version"`
+	ReportedVersion uint               `json:"reported_version"`
+}
+
+// DeviceDelta returns the part of the state a device fetches
+func (state State) DeviceDelta() DeviceDelta {
+	return DeviceDelta{
+		Delta:           state.Delta,
+		DesiredVersion:  state.DesiredVersion,
+		TemplateVersion: state.TemplateVersion,
+		ReportedVersion: state.ReportedVersion,
+	}
+}
+
+// Service reads and changes the shadows of the devices, and the templates of their types
+type Service struct {
+	shadows     repository.ShadowRepository
+	devices     repository.DeviceRepository
+	deviceTypes *devicetypes.Registry
+}
+
+func NewService(shadows repository.ShadowRepository, devices repository.DeviceRepository, deviceTypes *devicetypes.Registry) *Service {
+	return &Service{shadows, devices, deviceTypes}
+}
+
+func (service *Service) Get(ctx context.Context, device repository.Device) (State, error) {
+	shadow, err := service.shadows.Get(ctx, device.ID)
+	if err != nil {
+		return State{}, err
+	}
+	template, err := service.shadows.GetTemplate(ctx, device.DeviceType)
+	if err != nil {
+		return State{}, err
+	}
+	return state(device, shadow, template)
+}
+
+func state(device repository.Device, shadow repository.Shadow, template repository.ShadowTemplate) (State, error) {
+	templateObject, err := Decode(template.Document)
+	if err != nil {
+		return State{}, err
+	}
+	desired, err := Decode(shadow.Desired)
+	if err != nil {
+		return State{}, err
+	}
+	reported, err := Decode(shadow.Reported)
+	if err != nil {
+		return State{}, err
+	}
+
+	effective := Effective(templateObject, desired)
+	delta := Delta(effective, reported)
+	effectiveDocument, err := encode(effective)
+	if err != nil {
+		return State{}, err
+	}
+	deltaDocument, err := encode(delta)
+	if err != nil {
+		return State{}, err
+	}
+	return State{
+		SerialId:        device.SerialId,
+		Shadow:          shadow,
+		TemplateVersion: template.Version,
+		Effective:       effectiveDocument,
+		Delta:           deltaDocument,
+		InSync:          len(delta) == 0,
+	}, nil
+}
+
+/*
+patch merges the patch into the document at the version, or the current one when
+the version is nil, returning the new document and the version it was merged at.
+*/
+func patch(document repository.RawJSON, current uint, version *uint, changes repository.RawJSON) (repository.RawJSON, uint, error) {
+	if version != nil && *version != current {
+		return nil, 0, ErrVersionConflict
+	}
+	object, err := Decode(document)
+	if err != nil {
+		return nil, 0, err
+	}
+	patchObject, err := Decode(changes)
+	if err != nil {
+		return nil, 0, err
+	}
+	merged, err := Encode(Merge(object, patchObject))
+	return merged, current, err
+}
+
+// conflict reads a version moved on since it was read as a conflict
+func conflict(err error) error {
+	if errors.Is(err, repository.NotFound) {
+		return ErrVersionConflict
+	}
+	return err
+}
+
+// UpdateDesired merges the patch into the desired config of the device, from the version when given
+func (service *Service) UpdateDesired(
+	ctx context.Context, device repository.Device, desired repository.RawJSON, version *uint, actor string, now time.Time,
+) (State, error) {
+	shadow, err := service.shadows.Get(ctx, device.ID)
+	if err != nil {
+		return State{}, err
+	}
+	document, from, err := patch(shadow.Desired, shadow.DesiredVersion, version, desired)
+	if err != nil {
+		return State{}, err
+	}
+	if _, err = service.shadows.SetDesired(ctx, device.ID, from, document, actor, now.UnixMilli()); err != nil {
+		return State{}, conflict(err)
+	}
+	slog.Info("shadow", "status", "desired config updated", "serial_id", device.SerialId, "version", from+1, "actor", actor)
+	return service.Get(ctx, device)
+}
+
+// Report merges the patch into the config reported by the device, from the version when given
+func (service *Service) Report(
+	ctx context.Context, device repository.Device, reported repository.RawJSON, version *uint, now time.Time,
+) (State, error) {
+	shadow, err := service.shadows.Get(ctx, device.ID)
+	if err != nil {
+		return State{}, err
+	}
+	document, from, err := patch(shadow.Reported, shadow.ReportedVersion, version, reported)
+	if err != nil {
+		return State{}, err
+	}
+	if _, err = service.shadows.SetReported(ctx, device.ID, from, document, now.UnixMilli()); err != nil {
+		return State{}, conflict(err)
+	}
+	return service.Get(ctx, device)
+}
+
+/*
+Drifted returns the devices whose reported config doesn't match their effective desired
+one, by device. The decommissioned devices are left out, they apply nothing anymore.
+*/
+func (service *Service) Drifted(ctx context.Context) ([]State, error) {
+	devices, err := service.devices.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	shadows, err := service.shadows.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := service.shadows.ListTemplates(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byDevice := make(map[uint]repository.Shadow, len(shadows))
+	for _, shadow := range shadows {
+		byDevice[shadow.DeviceFk] = shadow
+	}
+	byType := make(map[repository.DeviceType]repository.ShadowTemplate, len(templates))
+	for _, template := range templates {
+		byType[template.DeviceType] = template
+	}
+
+	drifted := []State{}
+	for _, device := range devices {
+		if device.DeviceStatus == repository.Decommissioned {
+			continue
+		}
+		shadow, found := byDevice[device.ID]
+		if !found {
+			shadow = repository.Shadow{DeviceFk: device.ID}
+		}
+		template, found := byType[device.DeviceType]
+		if !found {
+			template = repository.ShadowTemplate{DeviceType: device.DeviceType}
+		}
+		deviceState, err := state(device, shadow, template)
+		if err != nil {
+			return nil, err
+		}
+		if !deviceState.InSync {
+			drifted = append(drifted, deviceState)
+		}
+	}
+	return drifted, nil
+}
+
+func (service *Service) Templates(ctx context.Context) ([]repository.ShadowTemplate, error) {
+	return service.shadows.ListTemplates(ctx)
+}
+
+/*
+SetTemplate replaces the template of the device type, from the version when given,
+an empty document removes every setting of the template.
+*/
+func (service *Service) SetTemplate(
+	ctx context.Context, deviceType repository.DeviceType, document repository.RawJSON, version *uint, actor string, now time.Time,
+) (repository.ShadowTemplate, error) {
+	if _, found := service.deviceTypes.Get(deviceType); !found {
+		return repository.ShadowTemplate{}, devicetypes.ErrUnknownType
+	}
+	template, err := service.shadows.GetTemplate(ctx, deviceType)
+	if err != nil {
+		return repository.ShadowTemplate{}, err
+	}
+	// Replaced as a whole, a patch onto nothing
+	replaced, from, err := patch(nil, template.Version, version, document)
+	if err != nil {
+		return repository.ShadowTemplate{}, err
+	}
+
+	template, err = service.shadows.SetTemplate(ctx, deviceType, from, replaced, actor, now.UnixMilli())
+	if err != nil {
+		return repository.ShadowTemplate{}, conflict(err)
+	}
+	slog.Info("shadow", "status", "template updated", "device_type", service.deviceTypes.Name(deviceType),
+		"version", template.Version, "actor", actor)
+	return template, nil
+}
@@ -0,0 +1,130 @@
+/*
+Package shadow keeps the config of every device as two JSON objects, the desired one,
+set by the operators, and the one the device reports. The desired config of a device
+is laid over the template of its type, so a setting shared by every device of a type
+is set once, and the device fetches the delta, the desired settings it doesn't report
+yet, applying them and reporting back.
+
+Both sides are changed with JSON merge patches (RFC 7386), a key set to null is removed,
+so a setting of the device removed from its desired config falls back to its template.
+Every change bumps the version of its side, and can be made from the version it was
+read at, failing once another change got in between.
+*/
+package shadow
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/TomascpMarques/maestro/repository"
+)
+
+// Largest document a side of a shadow, or a template, can hold once merged
+const MaxDocumentSize = 16 << 10
+
+var (
+	ErrNotObject       = errors.New("a config should be a JSON object")
+	ErrTooLarge        = fmt.Errorf("a config should be at most %d bytes", MaxDocumentSize)
+	ErrVersionConflict = errors.New("config changed since the version given")
+)
+
+// Decode reads a document as a JSON object, an empty document is an empty object
+func Decode(document repository.RawJSON) (map[string]any, error) {
+	if len(document) == 0 {
+		return map[string]any{}, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	// Kept as written, so large integers aren't rounded through a float
+	decoder.UseNumber()
+	var object map[string]any
+	if err := decoder.Decode(&object); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotObject, err.Error())
+	}
+	if object == nil {
+		return map[string]any{}, nil
+	}
+	return object, nil
+}
+
+// Encode writes an object as a document to store, an empty object as no document at all
+func Encode(object map[string]any) (repository.RawJSON, error) {
+	document, err := encode(object)
+	if err != nil {
+		return nil, err
+	}
+	if len(document) > MaxDocumentSize {
+		return nil, ErrTooLarge
+	}
+	return document, nil
+}
+
+// encode writes an object as a document of any size, the effective config can be larger than the stored ones
+func encode(object map[string]any) (repository.RawJSON, error) {
+	if len(object) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(object)
+}
+
+// Merge applies the merge patch to the object, in place, returning it
+func Merge(object, patch map[string]any) map[string]any {
+	for key, value := range patch {
+		if value == nil {
+			delete(object, key)
+			continue
+		}
+		patchObject, isObject := value.(map[string]any)
+		if !isObject {
+			object[key] = value
+			continue
+		}
+		target, isTargetObject := object[key].(map[string]any)
+		if !isTargetObject {
+			target = map[string]any{}
+		}
+		object[key] = Merge(target, patchObject)
+	}
+	return object
+}
+
+// Effective lays the desired config of a device over the template of its type
+func Effective(template, desired map[string]any) map[string]any {
+	return Merge(Merge(map[string]any{}, template), desired)
+}
+
+/*
+Delta returns the desired settings the reported config doesn't match, nested objects
+are compared key by key. A setting only reported is left alone.
+*/
+func Delta(desired, reported map[string]any) map[string]any {
+	delta := map[string]any{}
+	for key, value := range desired {
+		reportedValue, found := reported[key]
+		desiredObject, isObject := value.(map[string]any)
+		reportedObject, isReportedObject := reportedValue.(map[string]any)
+		switch {
+		case isObject && isReportedObject:
+			if nested := Delta(desiredObject, reportedObject); len(nested) > 0 {
+				delta[key] = nested
+			}
+		case !found || !equal(value, reportedValue):
+			delta[key] = value
+		}
+	}
+	return delta
+}
+
+// equal compares two decoded values, the numbers by their value, 1000 and 1e3 alike
+func equal(a, b any) bool {
+	aNumber, aIsNumber := a.(json.Number)
+	bNumber, bIsNumber := b.(json.Number)
+	if aIsNumber && bIsNumber && aNumber != bNumber {
+		aFloat, aErr := aNumber.Float64()
+		bFloat, bErr := bNumber.Float64()
+		return aErr == nil && bErr == nil && aFloat == bFloat
+	}
+	return reflect.DeepEqual(a, b)
+}
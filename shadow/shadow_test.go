@@ -0,0 +1,108 @@
+package shadow
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func decoded(t *testing.T, document string) map[string]any {
+	object, err := Decode(repository.RawJSON(document))
+	assert.NoError(t, err)
+	return object
+}
+
+func TestMergeAndDelta(t *testing.T) {
+	merged := Merge(
+		decoded(t, `{"interval_ms":1000,"display":{"brightness":50,"mode":"auto"},"debug":true}`),
+		decoded(t, `{"interval_ms":500,"display":{"mode":null,"contrast":3},"debug":null,"label":"north"}`),
+	)
+	document, err := Encode(merged)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"interval_ms":500,"display":{"brightness":50,"contrast":3},"label":"north"}`, string(document))
+
+	// The desired config of a device overrides the settings of its template
+	effective := Effective(decoded(t, `{"interval_ms":1000,"debug":false}`), decoded(t, `{"debug":true,"label":"north"}`))
+	document, _ = Encode(effective)
+	assert.JSONEq(t, `{"interval_ms":1000,"debug":true,"label":"north"}`, string(document))
+
+	delta := Delta(
+		decoded(t, `{"interval_ms":1000,"display":{"brightness":50,"mode":"auto"},"label":"north"}`),
+		decoded(t, `{"interval_ms":1e3,"display":{"brightness":50,"mode":"manual"},"firmware":"1.2"}`),
+	)
+	document, _ = Encode(delta)
+	assert.JSONEq(t, `{"display":{"mode":"auto"},"label":"north"}`, string(document))
+	assert.Empty(t, Delta(decoded(t, `{"a":[1,2]}`), decoded(t, `{"a":[1,2],"b":1}`)))
+
+	_, err = Decode(repository.RawJSON(`[1,2]`))
+	assert.True(t, errors.Is(err, ErrNotObject))
+	_, err = Encode(map[string]any{"blob": strings.Repeat("x", MaxDocumentSize)})
+	assert.True(t, errors.Is(err, ErrTooLarge))
+}
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	registry, err := devicetypes.Load(ctx, repos.DeviceTypes)
+	assert.NoError(t, err)
+	service := NewService(repos.Shadows, repos.Devices, registry)
+	now := time.UnixMilli(1_000_000)
+
+	device, err := repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000001"})
+	assert.NoError(t, err)
+	inSync, err := repos.Devices.Create(ctx, repository.NewDevice{SerialId: "PMD-000002"})
+	assert.NoError(t, err)
+
+	_, err = service.SetTemplate(ctx, 99, repository.RawJSON(`{}`), nil, "ana", now)
+	assert.True(t, errors.Is(err, devicetypes.ErrUnknownType))
+	template, err := service.SetTemplate(ctx, repository.PMD, repository.RawJSON(`{"interval_ms":1000,"display":"on"}`), nil, "ana", now)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(1), template.Version)
+	stale := uint(0)
+	_, err = service.SetTemplate(ctx, repository.PMD, repository.RawJSON(`{}`), &stale, "ana", now)
+	assert.True(t, errors.Is(err, ErrVersionConflict))
+
+	state, err := service.UpdateDesired(ctx, device, repository.RawJSON(`{"interval_ms":500,"display":"off"}`), nil, "ana", now)
+	assert.NoError(t, err)
+	// Removed from the device, the setting of the template applies again
+	state, err = service.UpdateDesired(ctx, device, repository.RawJSON(`{"display":null}`), nil, "ana", now)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(2), state.DesiredVersion)
+	assert.JSONEq(t, `{"interval_ms":500}`, string(state.Desired))
+	assert.JSONEq(t, `{"interval_ms":500,"display":"on"}`, string(state.Effective))
+	assert.JSONEq(t, `{"interval_ms":500,"display":"on"}`, string(state.Delta))
+	assert.False(t, state.InSync)
+	_, err = service.UpdateDesired(ctx, device, repository.RawJSON(`{"interval_ms":100}`), &stale, "rui", now)
+	assert.True(t, errors.Is(err, ErrVersionConflict))
+
+	// Both devices drift, until they report what they were told
+	drifted, err := service.Drifted(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, drifted, 2)
+
+	state, err = service.Report(ctx, device, repository.RawJSON(`{"interval_ms":500,"display":"on","firmware":"1.2"}`), nil, now)
+	assert.NoError(t, err)
+	assert.True(t, state.InSync)
+	assert.Equal(t, DeviceDelta{DesiredVersion: 2, TemplateVersion: 1, ReportedVersion: 1}, state.DeviceDelta())
+	_, err = service.Report(ctx, inSync, repository.RawJSON(`{"interval_ms":1000,"display":"on"}`), nil, now)
+	assert.NoError(t, err)
+	drifted, err = service.Drifted(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, drifted)
+
+	// A change to the template drifts the devices that don't override it
+	_, err = service.SetTemplate(ctx, repository.PMD, repository.RawJSON(`{"interval_ms":2000,"display":"on"}`), nil, "ana", now)
+	assert.NoError(t, err)
+	drifted, err = service.Drifted(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, drifted, 1) {
+		assert.Equal(t, "PMD-000002", drifted[0].SerialId)
+		assert.JSONEq(t, `{"interval_ms":2000}`, string(drifted[0].Delta))
+	}
+}
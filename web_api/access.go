@@ -0,0 +1,174 @@
+package web_api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/TomascpMarques/maestro/adminauth"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// Key of the authenticated user in the gin context
+const authenticatedUserKey = "authenticated-user"
+
+// Actor recorded for the changes made without a user, never expected behind AccessControl
+const defaultStatusActor = "api"
+
+// Fields of a request body recorded in the audit log, they name what was acted on, never a secret
+var auditedBodyFields = []string{"serial_id", "accessory_serial_id", "id", "firmware_id", "name", "username"}
+
+// Largest body read to name the target of a request, the bodies of the operators are small JSON documents
+const maxAuditedBodySize = 1 << 20
+
+/*
+AccessControl guards the routes used by the human operators, finding the user of the
+bearer token and checking its role, and records every change they make in the audit log.
+*/
+type AccessControl struct {
+	auth  *adminauth.Authenticator
+	audit repository.AuditRepository
+}
+
+func NewAccessControl(auth *adminauth.Authenticator, audit repository.AuditRepository) AccessControl {
+	return AccessControl{auth, audit}
+}
+
+/*
+Require lets through the requests of the users with at least the role, refusing the others
+with 401 when the token is missing or invalid, or with 403 when the role isn't enough.
+Every request but the reads is recorded in the audit log, once answered, along with the
+requests refused for their role. The 401s are not recorded, they have no user to record,
+and anyone can make them.
+*/
+func (access AccessControl) Require(role repository.UserRole) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := adminauth.BearerToken(c.GetHeader("Authorization"))
+		user, err := access.auth.Authenticate(c.Request.Context(), token, time.Now())
+		if err != nil {
+			abortWithAdminAuthError(c, err)
+			return
+		}
+		if !user.Role.Allows(role) {
+			// Refused either way, a body past the limit only leaves its fields out of the entry
+			target, _ := auditTarget(c)
+			access.record(c, user.Username, sql.NullInt64{Int64: int64(user.Role), Valid: true}, http.StatusForbidden, target)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "the " + role.String() + " role is required"})
+			return
+		}
+		c.Set(authenticatedUserKey, user)
+
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+		target, err := auditTarget(c)
+		if err != nil {
+			status, message := http.StatusBadRequest, "could not read the body"
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status, message = http.StatusRequestEntityTooLarge, "the body is too large"
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": message})
+			access.record(c, user.Username, sql.NullInt64{Int64: int64(user.Role), Valid: true}, status, target)
+			return
+		}
+		c.Next()
+		access.record(c, user.Username, sql.NullInt64{Int64: int64(user.Role), Valid: true}, c.Writer.Status(), target)
+	}
+}
+
+// record adds the request to the audit log, a failure is logged without failing the request
+func (access AccessControl) record(c *gin.Context, actor string, role sql.NullInt64, status int, target string) {
+	entry := repository.AuditEntry{
+		Actor:      actor,
+		ActorRole:  role,
+		Action:     c.Request.Method + " " + c.FullPath(),
+		Target:     sql.NullString{String: target, Valid: target != ""},
+		StatusCode: status,
+		At:         time.Now().UnixMilli(),
+	}
+	if err := access.audit.Record(c.Request.Context(), entry); err != nil {
+		slog.Error("audit-log", "cause", err.Error(), "actor", actor, "action", entry.Action)
+	}
+}
+
+/*
+auditTarget names what the request acts on, the query of the request along with the
+fields of its body that identify something, the body is put back for the handler. The
+body is read up to maxAuditedBodySize, past it only the query is returned, with the error.
+A multipart body, a firmware image, is left for the handler to stream.
+*/
+func auditTarget(c *gin.Context) (string, error) {
+	target := c.Request.URL.Query()
+	if c.Request.Body != nil && c.ContentType() != binding.MIMEMultipartPOSTForm {
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxAuditedBodySize))
+		if err != nil {
+			return target.Encode(), err
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		var fields map[string]any
+		if json.Unmarshal(body, &fields) == nil {
+			for _, name := range auditedBodyFields {
+				if value, found := fields[name]; found {
+					target.Set(name, jsonString(value))
+				}
+			}
+		}
+	}
+	return target.Encode(), nil
+}
+
+// jsonString writes a decoded JSON value back as text, strings without their quotes
+func jsonString(value any) string {
+	if text, ok := value.(string); ok {
+		return text
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+func abortWithAdminAuthError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, adminauth.ErrMissingToken), errors.Is(err, adminauth.ErrInvalidToken),
+		errors.Is(err, adminauth.ErrInvalidLogin):
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, adminauth.ErrWeakPassword):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("%s, it needs at least %d characters", err, adminauth.MinPasswordLength),
+		})
+	case errors.Is(err, adminauth.ErrPasswordTooLong):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("%s, it can have at most %d bytes", err, adminauth.MaxPasswordLength),
+		})
+	default:
+		abortWithRepositoryError(c, err)
+	}
+}
+
+// authenticatedUser returns the user that made the request, if it was authenticated
+func authenticatedUser(c *gin.Context) (repository.User, bool) {
+	value, found := c.Get(authenticatedUserKey)
+	if !found {
+		return repository.User{}, false
+	}
+	user, ok := value.(repository.User)
+	return user, ok
+}
+
+// actorOf returns the username of the user that made the request, recorded as the actor of its changes
+func actorOf(c *gin.Context) string {
+	if user, found := authenticatedUser(c); found {
+		return user.Username
+	}
+	return defaultStatusActor
+}
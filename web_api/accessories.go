@@ -0,0 +1,182 @@
+package web_api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+)
+
+// AttachmentRequest links the accessory to the PMD, or unlinks it, recording the user that did it
+type AttachmentRequest struct {
+	SerialId          string `json:"serial_id"`
+	AccessorySerialId string `binding:"required" json:"accessory_serial_id"`
+}
+
+func (request AttachmentRequest) change(actor string) repository.AttachmentChange {
+	return repository.AttachmentChange{Actor: actor, At: time.Now().UnixMilli()}
+}
+
+/*
+deviceOfRole gets the device by serial id, answering the request itself, and returning
+false, when the device doesn't exist, its type doesn't have the expected role, or is decommissioned.
+*/
+func (resolver *PmdResolver) deviceOfRole(c *gin.Context, serialId string, role repository.DeviceRole) (repository.Device, bool) {
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), serialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return repository.Device{}, false
+	}
+	if resolver.deviceTypes.Role(device.DeviceType) != role {
+		c.JSON(http.StatusBadRequest, gin.H{"error": serialId + " is not a " + role.String()})
+		return repository.Device{}, false
+	}
+	if device.DeviceStatus == repository.Decommissioned {
+		c.JSON(http.StatusConflict, gin.H{"error": serialId + " is decommissioned"})
+		return repository.Device{}, false
+	}
+	return device, true
+}
+
+func (resolver *PmdResolver) AttachAccessory(c *gin.Context) {
+	var request AttachmentRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.SerialId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "serial_id is required"})
+		return
+	}
+
+	parent, found := resolver.deviceOfRole(c, request.SerialId, repository.PMDRole)
+	if !found {
+		return
+	}
+	accessory, found := resolver.deviceOfRole(c, request.AccessorySerialId, repository.AccessoryRole)
+	if !found {
+		return
+	}
+
+	attachment, err := resolver.attachments.Attach(c.Request.Context(), parent.ID, accessory.ID, request.change(actorOf(c)))
+	if errors.Is(err, repository.AlreadyExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "accessory is already attached, detach it first"})
+		return
+	}
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, attachment)
+}
+
+func (resolver *PmdResolver) DetachAccessory(c *gin.Context) {
+	var request AttachmentRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	accessory, err := resolver.devices.GetBySerial(c.Request.Context(), request.AccessorySerialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	attachment, err := resolver.attachments.Detach(c.Request.Context(), accessory.ID, request.change(actorOf(c)))
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, attachment)
+}
+
+type AttachedAccessories struct {
+	SerialId    string              `json:"serial_id"`
+	Accessories []repository.Device `json:"accessories"`
+}
+
+func (resolver *PmdResolver) ListAccessories(c *gin.Context) {
+	serialId := c.Query("serial_id")
+	if serialId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "serial_id is required"})
+		return
+	}
+
+	parent, err := resolver.devices.GetBySerial(c.Request.Context(), serialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	if resolver.deviceTypes.Role(parent.DeviceType) != repository.PMDRole {
+		c.JSON(http.StatusBadRequest, gin.H{"error": serialId + " is not a pmd"})
+		return
+	}
+
+	accessories, err := resolver.attachments.Accessories(c.Request.Context(), parent.ID)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, AttachedAccessories{parent.SerialId, accessories})
+}
+
+/*
+AttachmentHistoryFilter is read from the query string, the serial id is either a PMD
+or an accessory, From and To are unix milliseconds, by default the last 30 days.
+*/
+type AttachmentHistoryFilter struct {
+	SerialId string `binding:"required" form:"serial_id"`
+	From     int64  `form:"from"`
+	To       int64  `form:"to"`
+}
+
+type AttachmentHistory struct {
+	SerialId    string                  `json:"serial_id"`
+	Attachments []repository.Attachment `json:"attachments"`
+}
+
+func (resolver *PmdResolver) GetAttachmentHistory(c *gin.Context) {
+	var filter AttachmentHistoryFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.To == 0 {
+		filter.To = time.Now().UnixMilli()
+	}
+	if filter.From == 0 {
+		filter.From = filter.To - defaultHistoryWindow.Milliseconds()
+	}
+
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), filter.SerialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	attachments, err := resolver.attachments.History(c.Request.Context(), device.ID, filter.From, filter.To)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, AttachmentHistory{device.SerialId, attachments})
+}
+
+/*
+publisher returns the PMD the measurements of the device are attributed to, the device
+itself unless it is an accessory, which only publishes while attached to a PMD.
+*/
+func (resolver *PmdResolver) publisher(ctx context.Context, device repository.Device) (repository.Device, error) {
+	if resolver.deviceTypes.Role(device.DeviceType) != repository.AccessoryRole {
+		return device, nil
+	}
+	return resolver.attachments.Parent(ctx, device.ID)
+}
@@ -0,0 +1,181 @@
+package web_api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/TomascpMarques/maestro/alerts"
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/measurementtypes"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+)
+
+type AlertResolver struct {
+	alerts  *alerts.Engine
+	devices repository.DeviceRepository
+}
+
+func NewAlertResolver(alerts *alerts.Engine, devices repository.DeviceRepository) AlertResolver {
+	return AlertResolver{alerts, devices}
+}
+
+func (resolver *AlertResolver) routes(v1 *gin.RouterGroup, guards routeGuards) {
+	// /v1/alerts
+	alertRoutes := v1.Group("/alerts")
+	// Retrieve the alerts, the most recent first, filtered by state or device
+	alertRoutes.GET("/", guards.viewer, resolver.ListAlerts)
+	// Mark a firing alert as seen, it resolves once its rule stops firing
+	alertRoutes.POST("/acknowledge/", guards.operator, resolver.AcknowledgeAlert)
+
+	// /v1/alerts/rules
+	rules := alertRoutes.Group("/rules")
+	// Retrieve every alert rule
+	rules.GET("/", guards.viewer, resolver.ListAlertRules)
+	// Create a threshold, rate of change, absence of data or status rule
+	rules.POST("/", guards.admin, resolver.CreateAlertRule)
+	// Delete a rule with its alerts
+	rules.DELETE("/", guards.admin, resolver.DeleteAlertRule)
+}
+
+func abortWithAlertError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, alerts.ErrInvalidRule), errors.Is(err, devicetypes.ErrUnknownType),
+		errors.Is(err, measurementtypes.ErrUnknownType):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, alerts.ErrNotFiring):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		abortWithRepositoryError(c, err)
+	}
+}
+
+func (resolver *AlertResolver) ListAlertRules(c *gin.Context) {
+	rules, err := resolver.alerts.Rules(c.Request.Context())
+	if err != nil {
+		abortWithAlertError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+/*
+NewAlertRuleRequest is a rule to create, see repository.AlertKind, AlertComparison and
+Connectivity for the values of its enums. The scope left out is every device, the
+window, in milliseconds, is only used by the absence of data rules.
+*/
+type NewAlertRuleRequest struct {
+	Name         string                     `binding:"required,max=128" json:"name"`
+	Kind         repository.AlertKind       `json:"kind"`
+	SerialId     string                     `json:"serial_id"`
+	DeviceType   *repository.DeviceType     `json:"device_type"`
+	ValueType    *uint                      `json:"m_value_type"`
+	Comparison   repository.AlertComparison `json:"comparison"`
+	Threshold    float64                    `json:"threshold"`
+	WindowMillis int64                      `binding:"gte=0" json:"window_ms"`
+	Connectivity repository.Connectivity    `json:"connectivity"`
+}
+
+func (resolver *AlertResolver) CreateAlertRule(c *gin.Context) {
+	var request NewAlertRuleRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule, err := resolver.alerts.CreateRule(c.Request.Context(), alerts.RuleRequest{
+		Name:         request.Name,
+		Kind:         request.Kind,
+		SerialId:     request.SerialId,
+		DeviceType:   request.DeviceType,
+		ValueType:    request.ValueType,
+		Comparison:   request.Comparison,
+		Threshold:    request.Threshold,
+		Window:       time.Duration(request.WindowMillis) * time.Millisecond,
+		Connectivity: request.Connectivity,
+	}, actorOf(c), time.Now())
+	if err != nil {
+		abortWithAlertError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, rule)
+}
+
+type AlertSelector struct {
+	ID *uint `binding:"required" form:"id"`
+}
+
+func (resolver *AlertResolver) DeleteAlertRule(c *gin.Context) {
+	var selector AlertSelector
+	if err := c.ShouldBindQuery(&selector); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := resolver.alerts.DeleteRule(c.Request.Context(), *selector.ID, actorOf(c)); err != nil {
+		abortWithAlertError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+/*
+AlertFilter is read from the query string, see repository.AlertState for the values of
+the state. Open lists the alerts firing or acknowledged, the ones not resolved yet.
+*/
+type AlertFilter struct {
+	SerialId string                 `form:"serial_id"`
+	State    *repository.AlertState `binding:"omitempty,lte=2" form:"state"`
+	Open     bool                   `form:"open"`
+	Limit    uint                   `binding:"lte=10000" form:"limit"`
+}
+
+// ListAlerts answers with the alerts matching the filter, the most recent first
+func (resolver *AlertResolver) ListAlerts(c *gin.Context) {
+	var filter AlertFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.Limit == 0 {
+		filter.Limit = defaultMeasurementLimit
+	}
+
+	query := repository.AlertQuery{State: filter.State, Open: filter.Open, Limit: filter.Limit}
+	if filter.SerialId != "" {
+		device, err := resolver.devices.GetBySerial(c.Request.Context(), filter.SerialId)
+		if err != nil {
+			abortWithRepositoryError(c, err)
+			return
+		}
+		query.DeviceID = device.ID
+	}
+
+	listed, err := resolver.alerts.Alerts(c.Request.Context(), query)
+	if err != nil {
+		abortWithAlertError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, listed)
+}
+
+type AlertAcknowledgement struct {
+	ID uint `binding:"required" json:"id"`
+}
+
+// AcknowledgeAlert marks a firing alert as seen by the user of the request
+func (resolver *AlertResolver) AcknowledgeAlert(c *gin.Context) {
+	var acknowledgement AlertAcknowledgement
+	if err := c.ShouldBindJSON(&acknowledgement); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	alert, err := resolver.alerts.Acknowledge(c.Request.Context(), acknowledgement.ID, actorOf(c), time.Now())
+	if err != nil {
+		abortWithAlertError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, alert)
+}
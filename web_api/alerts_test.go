@@ -0,0 +1,76 @@
+package web_api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/TomascpMarques/maestro/alerts"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertEndpoints(t *testing.T) {
+	var engine *alerts.Engine
+	app, _ := newTestApiWith(t, func(deps *Dependencies) { engine = deps.Alerts })
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+
+	response := doJSON(app, http.MethodPost, "/api/v1/alerts/rules/", gin.H{
+		"name": "hot", "kind": repository.ThresholdAlert, "m_value_type": 1, "comparison": repository.Above, "threshold": 30,
+	})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var rule repository.AlertRule
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &rule))
+	assert.Equal(t, testAdmin, rule.CreatedBy)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/alerts/rules/", gin.H{
+		"name": "quiet", "kind": repository.AbsenceAlert, "window_ms": 1000,
+	})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/alerts/rules/", gin.H{
+		"name": "typed", "kind": repository.StatusAlert, "connectivity": repository.Offline, "device_type": 9,
+	})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/alerts/rules/", gin.H{"name": "hot", "kind": repository.ThresholdAlert})
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	// Evaluated as the measurement is published, before it is written, the alert is written apart
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/", gin.H{"serial_id": "PMD-000001", "m_value": "31.5", "m_value_type": 1})
+	assert.NoError(t, engine.Flush(context.Background()))
+	response = doJSON(app, http.MethodGet, "/api/v1/alerts/?serial_id=PMD-000001&open=true", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var alerts []repository.Alert
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &alerts))
+	if !assert.Len(t, alerts, 1) {
+		return
+	}
+	assert.Equal(t, "hot", alerts[0].RuleName)
+	assert.Equal(t, repository.AlertFiring, alerts[0].State)
+
+	acknowledge := gin.H{"id": alerts[0].ID}
+	response = doJSON(app, http.MethodPost, "/api/v1/alerts/acknowledge/", acknowledge)
+	assert.Equal(t, http.StatusOK, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/alerts/acknowledge/", acknowledge)
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/alerts/acknowledge/", gin.H{"id": 99})
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/", gin.H{"serial_id": "PMD-000001", "m_value": "22", "m_value_type": 1})
+	assert.NoError(t, engine.Flush(context.Background()))
+	response = doJSON(app, http.MethodGet, fmt.Sprintf("/api/v1/alerts/?state=%d", repository.AlertResolved), nil)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &alerts))
+	if assert.Len(t, alerts, 1) {
+		assert.Equal(t, testAdmin, alerts[0].AcknowledgedBy.String)
+	}
+	response = doJSONAs(app, "", http.MethodGet, "/api/v1/alerts/", nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	response = doJSON(app, http.MethodDelete, fmt.Sprintf("/api/v1/alerts/rules/?id=%d", rule.ID), nil)
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	response = doJSON(app, http.MethodGet, "/api/v1/alerts/", nil)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &alerts))
+	assert.Empty(t, alerts)
+}
@@ -0,0 +1,135 @@
+package web_api
+
+import (
+	"errors"
+
+	"github.com/TomascpMarques/maestro/adminauth"
+	"github.com/TomascpMarques/maestro/alerts"
+	"github.com/TomascpMarques/maestro/backup"
+	"github.com/TomascpMarques/maestro/clocksync"
+	"github.com/TomascpMarques/maestro/commands"
+	"github.com/TomascpMarques/maestro/deviceauth"
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/firmware"
+	"github.com/TomascpMarques/maestro/health"
+	"github.com/TomascpMarques/maestro/ingest"
+	"github.com/TomascpMarques/maestro/measurementtypes"
+	"github.com/TomascpMarques/maestro/presence"
+	"github.com/TomascpMarques/maestro/provisioning"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/TomascpMarques/maestro/retention"
+	"github.com/TomascpMarques/maestro/shadow"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// Dependencies holds everything the handlers depend on
+type Dependencies struct {
+	Repositories repository.Repositories
+	Health       *health.Registry
+	// Queues the published measurements, writing them in batches
+	Ingest *ingest.Pipeline
+	// Decides which resolution a measurement query is read from
+	Retention retention.Config
+	// Tracks when the devices were last seen
+	Presence *presence.Monitor
+	// Validates the devices and their measurements against their type
+	DeviceTypes *devicetypes.Registry
+	// Parses the published values, and decodes the stored ones, by their measurement type
+	MeasurementTypes *measurementtypes.Registry
+	// Issues the secrets of the devices, and checks the signatures of their requests
+	DeviceAuth *deviceauth.Authenticator
+	// Logs the users in, and finds the user of a bearer token
+	AdminAuth *adminauth.Authenticator
+	// Pauses, resumes and skips the backups, following their state
+	Backups *backup.Controller
+	Config  ConfigControl
+	// Generates the claim codes, and registers the devices presenting them
+	Provisioner *provisioning.Provisioner
+	// Queues the commands of the devices, until they fetch and acknowledge them
+	Commands *commands.Queue
+	// Keeps the desired and reported config of the devices, and the templates of their types
+	Shadows *shadow.Service
+	// Stores the firmware images, and rolls them out to the devices
+	Firmware *firmware.Service
+	// Records the offsets of the clocks of the devices
+	Clocks *clocksync.Service
+	// Evaluates the alert rules, and keeps the alerts they fire
+	Alerts *alerts.Engine
+}
+
+// routeGuards are the middlewares a route is registered behind, by who may call it
+type routeGuards struct {
+	viewer   gin.HandlerFunc
+	operator gin.HandlerFunc
+	admin    gin.HandlerFunc
+	// Only the devices themselves, signing their requests
+	signed gin.HandlerFunc
+}
+
+/*
+Api registers every route under /v1, each resolver registers its own routes, found
+next to its handlers.
+*/
+func Api(api *gin.RouterGroup, deps Dependencies) (err error) {
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterStructValidation(DeviceRegistrationStructLevelValidation, DeviceRegistration{})
+	} else {
+		err = errors.New("could not register struct validators")
+	}
+
+	v1 := api.Group("/v1")
+
+	// /v1/health
+	v1.GET("/health", HealthHandler(deps.Health))
+
+	// Every route but the health check, the time, and the ones of the devices requires a user with the role
+	access := NewAccessControl(deps.AdminAuth, deps.Repositories.Audit)
+	guards := routeGuards{
+		viewer:   access.Require(repository.ViewerRole),
+		operator: access.Require(repository.OperatorRole),
+		admin:    access.Require(repository.AdminRole),
+		signed:   DeviceAuthentication(deps.Repositories.Devices, deps.DeviceAuth),
+	}
+
+	userResolver := NewUserResolver(deps.AdminAuth, deps.Repositories.Users, deps.Repositories.Audit, access)
+	userResolver.routes(v1, guards)
+
+	backupResolver := NewBackupResolver(deps.Backups)
+	backupResolver.routes(v1, guards)
+
+	configResolver := NewConfigResolver(deps.Config)
+	configResolver.routes(v1, guards)
+
+	deviceTypeResolver := NewDeviceTypeResolver(deps.DeviceTypes)
+	deviceTypeResolver.routes(v1, guards)
+
+	provisioningResolver := NewProvisioningResolver(
+		deps.Provisioner, deps.Repositories.Devices, deps.DeviceTypes, deps.Presence, deps.DeviceAuth, access,
+	)
+	provisioningResolver.routes(v1, guards)
+
+	pmdResolver := NewPmdResolver(deps)
+	pmdResolver.routes(v1, guards)
+
+	commandResolver := NewCommandResolver(deps.Commands, deps.Repositories.Devices)
+	commandResolver.routes(v1, guards)
+
+	shadowResolver := NewShadowResolver(deps.Shadows, deps.Repositories.Devices)
+	shadowResolver.routes(v1, guards)
+
+	clockResolver := NewClockResolver(deps.Clocks, deps.Repositories.Devices)
+	clockResolver.routes(v1, guards)
+
+	firmwareResolver := NewFirmwareResolver(deps.Firmware, deps.Repositories.Devices)
+	firmwareResolver.routes(v1, guards)
+
+	alertResolver := NewAlertResolver(deps.Alerts, deps.Repositories.Devices)
+	alertResolver.routes(v1, guards)
+
+	measurementTypeResolver := NewMeasurementTypeResolver(deps.MeasurementTypes)
+	measurementTypeResolver.routes(v1, guards)
+
+	return
+}
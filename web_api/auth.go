@@ -0,0 +1,162 @@
+package web_api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TomascpMarques/maestro/deviceauth"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+)
+
+// Key of the authenticated device in the gin context
+const authenticatedDeviceKey = "authenticated-device"
+
+// Largest body of a signed request, it is read whole for the signature, before the device is authenticated
+const maxSignedBodySize = 1 << 20
+
+/*
+DeviceAuthentication checks the signature of the requests sent by the devices, see
+the deviceauth package, attaching the authenticated device to the context.
+A request made with a verified client certificate is authenticated by it instead.
+Unsigned requests are refused, unless the authenticator allows them.
+*/
+func DeviceAuthentication(devices repository.DeviceRepository, authenticator *deviceauth.Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if certificateSerial, presented := deviceauth.CertificateSerial(c.Request.TLS); presented {
+			authenticateCertificate(c, devices, certificateSerial)
+			return
+		}
+		if authenticator.RequiresClientCert() {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": deviceauth.ErrMissingCertificate.Error()})
+			return
+		}
+
+		serialId := c.GetHeader(deviceauth.DeviceHeader)
+		if serialId == "" {
+			if authenticator.AllowsUnsigned() {
+				c.Next()
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": deviceauth.ErrMissingSignature.Error()})
+			return
+		}
+
+		device, err := devices.GetBySerial(c.Request.Context(), serialId)
+		if errors.Is(err, repository.NotFound) {
+			// Same answer as a wrong secret, so the serial ids can't be probed
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": deviceauth.ErrInvalidSignature.Error()})
+			return
+		}
+		if err != nil {
+			abortWithRepositoryError(c, err)
+			return
+		}
+
+		// The body is read for the signature, and put back for the handler
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxSignedBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "the body is too large"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "could not read the body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		timestamp, _ := strconv.ParseInt(c.GetHeader(deviceauth.TimestampHeader), 10, 64)
+		err = authenticator.Verify(c.Request.Context(), device, deviceauth.SignedRequest{
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.RequestURI(),
+			Timestamp: timestamp,
+			Nonce:     c.GetHeader(deviceauth.NonceHeader),
+			Signature: c.GetHeader(deviceauth.SignatureHeader),
+			Body:      body,
+		}, time.Now())
+		if err != nil {
+			abortWithAuthenticationError(c, err)
+			return
+		}
+
+		c.Set(authenticatedDeviceKey, device)
+		c.Next()
+	}
+}
+
+/*
+authenticateCertificate attaches the device of the certificate to the context, the
+device header, when sent, must name the same device.
+*/
+func authenticateCertificate(c *gin.Context, devices repository.DeviceRepository, serialId string) {
+	if header := c.GetHeader(deviceauth.DeviceHeader); header != "" && header != serialId {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": deviceauth.ErrCertificateMismatch.Error()})
+		return
+	}
+	device, err := devices.GetBySerial(c.Request.Context(), serialId)
+	if errors.Is(err, repository.NotFound) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": deviceauth.ErrCertificateMismatch.Error()})
+		return
+	}
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.Set(authenticatedDeviceKey, device)
+	c.Next()
+}
+
+func abortWithAuthenticationError(c *gin.Context, err error) {
+	for _, authErr := range []error{
+		deviceauth.ErrMissingSignature, deviceauth.ErrInvalidSignature, deviceauth.ErrStaleTimestamp,
+		deviceauth.ErrReplayedNonce, deviceauth.ErrNoCredential,
+	} {
+		if errors.Is(err, authErr) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	abortWithRepositoryError(c, err)
+}
+
+// authenticatedDevice returns the device that signed the request, if it was signed
+func authenticatedDevice(c *gin.Context) (repository.Device, bool) {
+	value, found := c.Get(authenticatedDeviceKey)
+	if !found {
+		return repository.Device{}, false
+	}
+	device, ok := value.(repository.Device)
+	return device, ok
+}
+
+/*
+requestDevice returns the device a device request is about, answering the request itself,
+and returning false, when it can't be found. A signed request is about the device that
+signed it, the serial id is optional then, and must be its own when given.
+*/
+func requestDevice(c *gin.Context, devices repository.DeviceRepository, serialId string) (repository.Device, bool) {
+	if device, signed := authenticatedDevice(c); signed {
+		if serialId != "" && serialId != device.SerialId {
+			c.JSON(http.StatusForbidden, gin.H{"error": "serial_id is not the one of the signing device"})
+			return repository.Device{}, false
+		}
+		return device, true
+	}
+
+	if serialId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "serial_id is required"})
+		return repository.Device{}, false
+	}
+	device, err := devices.GetBySerial(c.Request.Context(), serialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return repository.Device{}, false
+	}
+	return device, true
+}
@@ -0,0 +1,75 @@
+package web_api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/TomascpMarques/maestro/backup"
+	"github.com/gin-gonic/gin"
+)
+
+type BackupResolver struct {
+	controller *backup.Controller
+}
+
+func NewBackupResolver(controller *backup.Controller) BackupResolver {
+	return BackupResolver{controller}
+}
+
+func (resolver *BackupResolver) routes(v1 *gin.RouterGroup, guards routeGuards) {
+	// /v1/backup
+	backups := v1.Group("/backup")
+	// Retrieve the state of the backup task
+	backups.GET("/", guards.viewer, resolver.GetBackupState)
+	// Pause the backups until resumed
+	backups.POST("/pause/", guards.admin, resolver.PauseBackups)
+	backups.POST("/resume/", guards.admin, resolver.ResumeBackups)
+	// Skip the next backup only
+	backups.POST("/skip/", guards.admin, resolver.SkipBackup)
+}
+
+// GetBackupState answers with what the backup task last reported
+func (resolver *BackupResolver) GetBackupState(c *gin.Context) {
+	c.JSON(http.StatusOK, resolver.controller.State())
+}
+
+/*
+signal sends the signal to the backup task, the task applies it on its own time,
+so the request is answered with 202, and the new state is read from GetBackupState.
+*/
+func (resolver *BackupResolver) signal(signal backup.TaskHandleSignal) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if resolver.controller.State().Ended {
+			c.JSON(http.StatusConflict, gin.H{"error": "the backup task has ended"})
+			return
+		}
+		if err := resolver.controller.Send(signal); err != nil {
+			if errors.Is(err, backup.ErrTaskBusy) {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return
+		}
+		c.Status(http.StatusAccepted)
+	}
+}
+
+// PauseBackups stops the backups until they are resumed
+func (resolver *BackupResolver) PauseBackups(c *gin.Context) {
+	resolver.signal(backup.PauseBackupTask)(c)
+}
+
+// ResumeBackups lifts the pause of an operator, refused while the db fails its integrity checks
+func (resolver *BackupResolver) ResumeBackups(c *gin.Context) {
+	if resolver.controller.State().IntegrityBlocked {
+		c.JSON(http.StatusConflict, gin.H{"error": "the db failed its integrity checks, backups stay blocked until they pass"})
+		return
+	}
+	resolver.signal(backup.ResumeBackupTask)(c)
+}
+
+// SkipBackup skips the next backup only
+func (resolver *BackupResolver) SkipBackup(c *gin.Context) {
+	resolver.signal(backup.SkipBackupTask)(c)
+}
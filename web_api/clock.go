@@ -0,0 +1,138 @@
+package web_api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/TomascpMarques/maestro/clocksync"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+)
+
+type ClockResolver struct {
+	clocks  *clocksync.Service
+	devices repository.DeviceRepository
+}
+
+func NewClockResolver(clocks *clocksync.Service, devices repository.DeviceRepository) ClockResolver {
+	return ClockResolver{clocks, devices}
+}
+
+func (resolver *ClockResolver) routes(v1 *gin.RouterGroup, guards routeGuards) {
+	// /v1/time, open to every client, as the health check
+	v1.GET("/time/", resolver.GetServerTime)
+
+	// /v1/devices/pmd/clock
+	clock := v1.Group("/devices/pmd/clock")
+	// Retrieve the clock offset of a device
+	clock.GET("/", guards.viewer, resolver.GetDeviceClock)
+	// Retrieve every device whose clock is further off than the max skew
+	clock.GET("/skewed/", guards.viewer, resolver.GetSkewedClocks)
+	// The device reports its exchange with the time endpoint, or the SNTP responder
+	clock.POST("/", guards.signed, resolver.RecordClockSync)
+}
+
+func abortWithClockError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, clocksync.ErrInvalidExchange), errors.Is(err, clocksync.ErrRoundTripTooLong),
+		errors.Is(err, clocksync.ErrFutureTimestamp), errors.Is(err, clocksync.ErrTimestampTooOld):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		abortWithRepositoryError(c, err)
+	}
+}
+
+/*
+ServerTime is the time of the server, in unix nanoseconds, when it received the request
+and when it answered it, with the originate timestamp of the request echoed back.
+*/
+type ServerTime struct {
+	Originate int64  `json:"originate,omitempty"`
+	Receive   int64  `json:"receive"`
+	Transmit  int64  `json:"transmit"`
+	Time      string `json:"time"`
+}
+
+type ServerTimeRequest struct {
+	// When the device sent the request, in unix nanoseconds by its own clock
+	Originate int64 `form:"originate"`
+}
+
+// GetServerTime answers with the time of the server, for the devices to estimate the offset of their clock
+func (resolver *ClockResolver) GetServerTime(c *gin.Context) {
+	received := time.Now()
+	var request ServerTimeRequest
+	if err := c.ShouldBindQuery(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	transmitted := time.Now()
+	c.JSON(http.StatusOK, ServerTime{
+		Originate: request.Originate,
+		Receive:   received.UnixNano(),
+		Transmit:  transmitted.UnixNano(),
+		Time:      transmitted.UTC().Format(time.RFC3339Nano),
+	})
+}
+
+/*
+ClockSync is an exchange with the time endpoint, or the SNTP responder, reported by the
+device right after it, with Destination the time the answer arrived by its clock.
+*/
+type ClockSync struct {
+	SerialId string `json:"serial_id"`
+	clocksync.Exchange
+}
+
+// RecordClockSync records the offset of the clock of the device, estimated from its exchange
+func (resolver *ClockResolver) RecordClockSync(c *gin.Context) {
+	var sync ClockSync
+	if err := c.ShouldBindJSON(&sync); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	device, found := requestDevice(c, resolver.devices, sync.SerialId)
+	if !found {
+		return
+	}
+
+	clock, err := resolver.clocks.Record(c.Request.Context(), device, sync.Exchange, time.Now())
+	if err != nil {
+		abortWithClockError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, clock)
+}
+
+func (resolver *ClockResolver) GetDeviceClock(c *gin.Context) {
+	serialId := c.Query("serial_id")
+	if serialId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "serial_id is required"})
+		return
+	}
+
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), serialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	clock, err := resolver.clocks.Get(c.Request.Context(), device)
+	if err != nil {
+		abortWithClockError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, clock)
+}
+
+// GetSkewedClocks answers with every device whose clock is further off than the max skew
+func (resolver *ClockResolver) GetSkewedClocks(c *gin.Context) {
+	skewed, err := resolver.clocks.Skewed(c.Request.Context())
+	if err != nil {
+		abortWithClockError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, skewed)
+}
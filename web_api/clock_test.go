@@ -0,0 +1,92 @@
+package web_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/clocksync"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockEndpoints(t *testing.T) {
+	app, _ := newTestApi(t)
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+
+	// The device is 4 seconds behind the server
+	behind := 4 * time.Second
+	originate := time.Now().Add(-behind)
+	response := doJSONAs(app, "", http.MethodGet, fmt.Sprintf("/api/v1/time/?originate=%d", originate.UnixNano()), nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var server ServerTime
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &server))
+	assert.Equal(t, originate.UnixNano(), server.Originate)
+	assert.LessOrEqual(t, server.Receive, server.Transmit)
+	destination := time.Now().Add(-behind)
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/clock/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/clock/", gin.H{
+		"serial_id": "PMD-000001", "originate": server.Originate, "receive": server.Receive,
+		"transmit": server.Transmit, "destination": server.Originate - 1,
+	})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/clock/", gin.H{
+		"serial_id": "PMD-000001", "originate": server.Originate, "receive": server.Receive,
+		"transmit": server.Transmit, "destination": destination.UnixNano(),
+	})
+	assert.Equal(t, http.StatusOK, response.Code)
+	var clock clocksync.Clock
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &clock))
+	assert.InDelta(t, behind.Microseconds(), clock.OffsetMicros, float64(100*time.Millisecond/time.Microsecond))
+	assert.True(t, clock.Skewed)
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/clock/skewed/", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var skewed []clocksync.Clock
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &skewed))
+	if assert.Len(t, skewed, 1) {
+		assert.Equal(t, "PMD-000001", skewed[0].SerialId)
+	}
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/clock/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	response = doJSONAs(app, "", http.MethodGet, "/api/v1/devices/pmd/clock/skewed/", nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// Timed by the clock of the device, the measurement is moved forward by its offset
+	now := time.Now()
+	for _, measuredAt := range []time.Time{now.Add(time.Minute), now.Add(-30 * 24 * time.Hour)} {
+		response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/",
+			gin.H{"serial_id": "PMD-000001", "m_value": 21.5, "measured_at": measuredAt.Add(-behind).UnixMilli()})
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+	}
+	measuredAt := now.Add(-time.Hour)
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/",
+		gin.H{"serial_id": "PMD-000001", "m_value": 21.5, "measured_at": measuredAt.Add(-behind).UnixMilli()})
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	var published TypedMeasurement
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &published))
+	if assert.NotNil(t, published.MeasuredAt) {
+		assert.InDelta(t, measuredAt.UnixMilli(), *published.MeasuredAt, 100)
+	}
+	assert.True(t, published.ClockSkewed)
+	flushMeasurements(t, app)
+
+	window := fmt.Sprintf("/api/v1/devices/pmd/data/?serial_id=PMD-000001&from=%d&to=%d",
+		measuredAt.Add(-time.Minute).UnixMilli(), measuredAt.Add(time.Minute).UnixMilli())
+	var page MeasurementsPage
+	response = doJSON(app, http.MethodGet, window, nil)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &page))
+	assert.Empty(t, page.Measurements)
+	response = doJSON(app, http.MethodGet, window+"&axis=measured", nil)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &page))
+	assert.Equal(t, "raw", page.Resolution)
+	assert.Len(t, page.Measurements, 1)
+	response = doJSON(app, http.MethodGet, window+"&axis=measured&resolution=1m", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doJSON(app, http.MethodGet, window+"&axis=sent", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
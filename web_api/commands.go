@@ -0,0 +1,303 @@
+package web_api
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/TomascpMarques/maestro/commands"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+)
+
+// Time given to write the answer of a poll, past its wait
+const pollWriteMargin = 10 * time.Second
+
+type CommandResolver struct {
+	queue   *commands.Queue
+	devices repository.DeviceRepository
+}
+
+func NewCommandResolver(queue *commands.Queue, devices repository.DeviceRepository) CommandResolver {
+	return CommandResolver{queue, devices}
+}
+
+func (resolver *CommandResolver) routes(v1 *gin.RouterGroup, guards routeGuards) {
+	// /v1/devices/pmd/commands
+	commandRoutes := v1.Group("/devices/pmd/commands")
+	// Queue a command for a device
+	commandRoutes.POST("/", guards.operator, resolver.EnqueueCommand)
+	// Retrieve the commands of a device, filtered by status
+	commandRoutes.GET("/", guards.viewer, resolver.ListCommands)
+	// Retrieve every status a command went through
+	commandRoutes.GET("/history/", guards.viewer, resolver.GetCommandHistory)
+	// Cancel a command not done with
+	commandRoutes.POST("/cancel/", guards.operator, resolver.CancelCommand)
+	// The device fetches its commands, waiting for one to be queued, or streamed as server-sent events
+	commandRoutes.GET("/poll/", guards.signed, resolver.PollCommands)
+	commandRoutes.GET("/stream/", guards.signed, resolver.StreamCommands)
+	// The device acknowledges a command with its result
+	commandRoutes.POST("/ack/", guards.signed, resolver.AcknowledgeCommand)
+}
+
+func abortWithCommandError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, commands.ErrUnknownCommand), errors.Is(err, commands.ErrInvalidPayload),
+		errors.Is(err, commands.ErrTTL), errors.Is(err, commands.ErrMaxAttempts):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, commands.ErrNotDelivered), errors.Is(err, commands.ErrDone):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		abortWithRepositoryError(c, err)
+	}
+}
+
+/*
+CommandRequest is a command to queue for a device, the payload depends on the command,
+see the commands package. TTL is in milliseconds, when it or MaxAttempts are left out,
+the defaults of the commands config are used.
+*/
+type CommandRequest struct {
+	SerialId    string             `binding:"required" json:"serial_id"`
+	Name        string             `binding:"required,max=64" json:"name"`
+	Payload     repository.RawJSON `json:"payload"`
+	TTL         int64              `binding:"gte=0" json:"ttl"`
+	MaxAttempts uint               `json:"max_attempts"`
+}
+
+func (resolver *CommandResolver) EnqueueCommand(c *gin.Context) {
+	var request CommandRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), request.SerialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	if device.DeviceStatus == repository.Decommissioned {
+		c.JSON(http.StatusConflict, gin.H{"error": "device is decommissioned"})
+		return
+	}
+
+	command, err := resolver.queue.Enqueue(c.Request.Context(), device, commands.Request{
+		Name:        request.Name,
+		Payload:     request.Payload,
+		TTL:         time.Duration(request.TTL) * time.Millisecond,
+		MaxAttempts: request.MaxAttempts,
+	}, actorOf(c), time.Now())
+	if err != nil {
+		abortWithCommandError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, command)
+}
+
+/*
+CommandFilter is read from the query string, Status can be repeated, any of them
+matches, see repository.CommandStatus for their values.
+*/
+type CommandFilter struct {
+	SerialId string                     `binding:"required" form:"serial_id"`
+	Status   []repository.CommandStatus `binding:"dive,lte=5" form:"status"`
+	Limit    uint                       `binding:"lte=10000" form:"limit"`
+}
+
+// ListCommands answers with the commands of a device matching the filter, the most recent first
+func (resolver *CommandResolver) ListCommands(c *gin.Context) {
+	var filter CommandFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.Limit == 0 {
+		filter.Limit = defaultMeasurementLimit
+	}
+
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), filter.SerialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	listed, err := resolver.queue.List(c.Request.Context(), repository.CommandQuery{
+		DeviceID: device.ID,
+		Statuses: filter.Status,
+		Limit:    filter.Limit,
+	})
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, listed)
+}
+
+type CommandSelector struct {
+	ID *uint `binding:"required" form:"id"`
+}
+
+// GetCommandHistory answers with every status the command went through, the oldest first
+func (resolver *CommandResolver) GetCommandHistory(c *gin.Context) {
+	var selector CommandSelector
+	if err := c.ShouldBindQuery(&selector); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := resolver.queue.Get(c.Request.Context(), *selector.ID); err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	history, err := resolver.queue.History(c.Request.Context(), *selector.ID)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, history)
+}
+
+type CommandCancellation struct {
+	ID     uint   `binding:"required" json:"id"`
+	Reason string `binding:"omitempty,max=256" json:"reason"`
+}
+
+// CancelCommand cancels a command not done with, a delivered command is not taken back from the device
+func (resolver *CommandResolver) CancelCommand(c *gin.Context) {
+	var cancellation CommandCancellation
+	if err := c.ShouldBindJSON(&cancellation); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cancelled, err := resolver.queue.Cancel(c.Request.Context(), cancellation.ID, actorOf(c), cancellation.Reason, time.Now())
+	if err != nil {
+		abortWithCommandError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, cancelled)
+}
+
+// commandDevice returns the device fetching or acknowledging its commands, which can't be decommissioned
+func (resolver *CommandResolver) commandDevice(c *gin.Context, serialId string) (repository.Device, bool) {
+	device, found := requestDevice(c, resolver.devices, serialId)
+	if !found {
+		return repository.Device{}, false
+	}
+	if device.DeviceStatus == repository.Decommissioned {
+		c.JSON(http.StatusConflict, gin.H{"error": "device is decommissioned"})
+		return repository.Device{}, false
+	}
+	return device, true
+}
+
+// CommandPoll is read from the query string, Wait is in milliseconds, capped by the max wait of the config
+type CommandPoll struct {
+	SerialId string `form:"serial_id"`
+	Wait     int64  `binding:"gte=0" form:"wait"`
+}
+
+/*
+PollCommands delivers the commands due for the device, waiting for one to be queued
+when there is none, answering with an empty list if none was by the wait.
+*/
+func (resolver *CommandResolver) PollCommands(c *gin.Context) {
+	var poll CommandPoll
+	if err := c.ShouldBindQuery(&poll); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	device, found := resolver.commandDevice(c, poll.SerialId)
+	if !found {
+		return
+	}
+
+	wait := min(time.Duration(poll.Wait)*time.Millisecond, resolver.queue.MaxWait())
+	// The server's write timeout is shorter than a long poll, not every writer can extend it
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(wait + pollWriteMargin))
+	delivered, err := resolver.queue.Poll(c.Request.Context(), device, wait)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	if delivered == nil {
+		delivered = []repository.Command{}
+	}
+
+	c.JSON(http.StatusOK, delivered)
+}
+
+/*
+StreamCommands delivers the commands of the device as server-sent events, a "command"
+event each, as they are queued, until the device disconnects. A comment is sent every
+max wait without commands, so the proxies in between keep the connection open.
+*/
+func (resolver *CommandResolver) StreamCommands(c *gin.Context) {
+	device, found := resolver.commandDevice(c, c.Query("serial_id"))
+	if !found {
+		return
+	}
+
+	ctx := c.Request.Context()
+	// Never times out, the stream lasts as long as the device stays connected
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	for ctx.Err() == nil {
+		delivered, err := resolver.queue.Poll(ctx, device, resolver.queue.MaxWait())
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("commands", "stream-failure", device.SerialId, "cause", err.Error())
+			}
+			return
+		}
+		if len(delivered) == 0 && ctx.Err() == nil {
+			_, _ = io.WriteString(c.Writer, ": keep-alive\n\n")
+		}
+		for _, command := range delivered {
+			c.SSEvent("command", command)
+		}
+		c.Writer.Flush()
+	}
+}
+
+// CommandAcknowledgement is the result of a command, sent by the device it was delivered to
+type CommandAcknowledgement struct {
+	SerialId  string             `json:"serial_id"`
+	ID        uint               `binding:"required" json:"id"`
+	Succeeded bool               `json:"succeeded"`
+	Result    repository.RawJSON `json:"result"`
+}
+
+// AcknowledgeCommand records the result of a delivered command, a failed one is retried while it has attempts left
+func (resolver *CommandResolver) AcknowledgeCommand(c *gin.Context) {
+	var acknowledgement CommandAcknowledgement
+	if err := c.ShouldBindJSON(&acknowledgement); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	device, found := resolver.commandDevice(c, acknowledgement.SerialId)
+	if !found {
+		return
+	}
+
+	acknowledged, err := resolver.queue.Acknowledge(c.Request.Context(), device, acknowledgement.ID,
+		acknowledgement.Succeeded, acknowledgement.Result, time.Now())
+	if err != nil {
+		abortWithCommandError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, acknowledged)
+}
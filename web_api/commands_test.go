@@ -0,0 +1,104 @@
+package web_api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandEndpoints(t *testing.T) {
+	app, _ := newTestApi(t)
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+
+	response := doJSON(app, http.MethodPost, "/api/v1/devices/pmd/commands/", gin.H{"serial_id": "PMD-000001", "name": "format-disk"})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/commands/",
+		gin.H{"serial_id": "PMD-000001", "name": "set-sampling-rate", "payload": gin.H{"interval_ms": 5}})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/commands/", gin.H{"serial_id": "PMD-000009", "name": "reboot"})
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	response = doJSONAs(app, "", http.MethodPost, "/api/v1/devices/pmd/commands/", gin.H{"serial_id": "PMD-000001", "name": "reboot"})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/commands/",
+		gin.H{"serial_id": "PMD-000001", "name": "set-sampling-rate", "payload": gin.H{"interval_ms": 5000}, "max_attempts": 1})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var queued repository.Command
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &queued))
+	assert.Equal(t, repository.Queued, queued.Status)
+	assert.Equal(t, testAdmin, queued.CreatedBy)
+
+	// The device fetches the command, then finds nothing more by the wait
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/commands/poll/?serial_id=PMD-000001&wait=100", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var delivered []repository.Command
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &delivered))
+	if assert.Len(t, delivered, 1) {
+		assert.JSONEq(t, `{"interval_ms":5000}`, string(delivered[0].Payload))
+	}
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/commands/poll/?serial_id=PMD-000001&wait=50", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "[]", response.Body.String())
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/commands/ack/",
+		gin.H{"serial_id": "PMD-000001", "id": queued.ID, "succeeded": true, "result": gin.H{"applied": true}})
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"status":2`)
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/commands/ack/",
+		gin.H{"serial_id": "PMD-000001", "id": queued.ID, "succeeded": true})
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/commands/cancel/", gin.H{"id": queued.ID})
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	response = doJSON(app, http.MethodGet, fmt.Sprintf("/api/v1/devices/pmd/commands/history/?id=%d", queued.ID), nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var history []repository.CommandHistoryEntry
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &history))
+	if assert.Len(t, history, 3) {
+		assert.Equal(t, testAdmin, history[0].Actor)
+		assert.Equal(t, "PMD-000001", history[2].Actor)
+	}
+
+	// A cancelled command is never delivered, the queued ones are streamed as events
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/commands/", gin.H{"serial_id": "PMD-000001", "name": "reboot"})
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &queued))
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/commands/cancel/", gin.H{"id": queued.ID, "reason": "not needed"})
+	assert.Equal(t, http.StatusOK, response.Code)
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/commands/", gin.H{"serial_id": "PMD-000001", "name": "self-test"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/devices/pmd/commands/stream/?serial_id=PMD-000001", nil).WithContext(ctx)
+	stream := httptest.NewRecorder()
+	app.ServeHTTP(stream, request)
+	assert.Equal(t, http.StatusOK, stream.Code)
+	assert.Equal(t, "text/event-stream", stream.Header().Get("Content-Type"))
+	assert.Equal(t, 1, strings.Count(stream.Body.String(), "event:command"))
+	assert.Contains(t, stream.Body.String(), `"name":"self-test"`)
+	assert.Contains(t, stream.Body.String(), ": keep-alive")
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/commands/?serial_id=PMD-000001&status=1&status=5", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var listed []repository.Command
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &listed))
+	if assert.Len(t, listed, 2) {
+		assert.Equal(t, "self-test", listed[0].Name)
+		assert.Equal(t, repository.Cancelled, listed[1].Status)
+	}
+
+	// A decommissioned device is sent no more commands
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/decommission/", gin.H{"serial_id": "PMD-000001"})
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/commands/", gin.H{"serial_id": "PMD-000001", "name": "reboot"})
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/commands/poll/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusConflict, response.Code)
+}
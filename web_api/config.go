@@ -0,0 +1,45 @@
+package web_api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConfigControl exposes the config of the app instance
+type ConfigControl interface {
+	// Redacted returns the config in use, as written, never with its secrets resolved
+	Redacted() any
+	// Reload loads the config file again, keeping the last valid one when it fails, its values apply on the next restart
+	Reload() error
+}
+
+type ConfigResolver struct {
+	config ConfigControl
+}
+
+func NewConfigResolver(config ConfigControl) ConfigResolver {
+	return ConfigResolver{config}
+}
+
+func (resolver *ConfigResolver) routes(v1 *gin.RouterGroup, guards routeGuards) {
+	// /v1/config
+	config := v1.Group("/config", guards.admin)
+	// Retrieve the config in use, with the secret references as written
+	config.GET("/", resolver.GetConfig)
+	// Reload the config file, like a SIGHUP
+	config.POST("/reload/", resolver.ReloadConfig)
+}
+
+func (resolver *ConfigResolver) GetConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, resolver.config.Redacted())
+}
+
+// ReloadConfig reloads the config like a SIGHUP does, answering with the new config
+func (resolver *ConfigResolver) ReloadConfig(c *gin.Context) {
+	if err := resolver.config.Reload(); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resolver.config.Redacted())
+}
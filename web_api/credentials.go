@@ -0,0 +1,99 @@
+package web_api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+)
+
+/*
+IssuedCredential holds a secret just issued to a device, the only time it is ever
+shown, the device signs its requests with its SHA-256, see the deviceauth package.
+*/
+type IssuedCredential struct {
+	SerialId string `json:"serial_id"`
+	Secret   string `json:"secret"`
+	repository.Credential
+}
+
+type DeviceCredentials struct {
+	SerialId    string                  `json:"serial_id"`
+	Credentials []repository.Credential `json:"credentials"`
+}
+
+func (resolver *PmdResolver) ListCredentials(c *gin.Context) {
+	serialId := c.Query("serial_id")
+	if serialId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "serial_id is required"})
+		return
+	}
+
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), serialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	credentials, err := resolver.credentials.List(c.Request.Context(), device.ID)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, DeviceCredentials{device.SerialId, credentials})
+}
+
+/*
+RotateCredentials issues a new secret to the device, its previous secrets stay valid
+for the rotation grace, so it can switch to the new one without losing requests.
+*/
+func (resolver *PmdResolver) RotateCredentials(c *gin.Context) {
+	var selector DeviceSelector
+	if err := c.ShouldBindJSON(&selector); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), selector.SerialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	if device.DeviceStatus == repository.Decommissioned {
+		c.JSON(http.StatusConflict, gin.H{"error": "device is decommissioned"})
+		return
+	}
+
+	secret, credential, err := resolver.auth.Issue(c.Request.Context(), device.ID, time.Now())
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, IssuedCredential{device.SerialId, secret, credential})
+}
+
+// RevokeCredentials revokes every secret of the device at once, it can't sign anything until rotated
+func (resolver *PmdResolver) RevokeCredentials(c *gin.Context) {
+	var selector DeviceSelector
+	if err := c.ShouldBindJSON(&selector); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), selector.SerialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	revoked, err := resolver.auth.Revoke(c.Request.Context(), device.ID, time.Now())
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"serial_id": device.SerialId, "revoked_credentials": revoked})
+}
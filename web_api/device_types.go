@@ -0,0 +1,141 @@
+package web_api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+)
+
+type DeviceTypeResolver struct {
+	registry *devicetypes.Registry
+}
+
+func NewDeviceTypeResolver(registry *devicetypes.Registry) DeviceTypeResolver {
+	return DeviceTypeResolver{registry}
+}
+
+func (resolver *DeviceTypeResolver) routes(v1 *gin.RouterGroup, guards routeGuards) {
+	// /v1/devices/types
+	types := v1.Group("/devices/types")
+	// Retrieve every device type
+	types.GET("/", guards.viewer, resolver.ListDeviceTypes)
+	// Define a new device type
+	types.POST("/", guards.admin, resolver.CreateDeviceType)
+	// Update a device type, its name and role can't change
+	types.PUT("/", guards.admin, resolver.UpdateDeviceType)
+	// Delete a device type no device uses, the built-in types are never deleted
+	types.DELETE("/", guards.admin, resolver.DeleteDeviceType)
+}
+
+/*
+DeviceTypeRequest defines a device type, the id is only read by updates, which keep
+the name and role of the type. HeartbeatTimeout is in milliseconds, when left out the
+devices of the type use the timeouts of the presence config, and when ValueTypes is
+left out, they may publish any measurement type.
+*/
+type DeviceTypeRequest struct {
+	ID               repository.DeviceType   `json:"id"`
+	Name             string                  `binding:"omitempty,max=64" json:"name"`
+	Role             repository.DeviceRole   `binding:"lte=1" json:"role"`
+	SerialPattern    string                  `binding:"required" json:"serial_pattern"`
+	ValueTypes       []uint                  `json:"value_types"`
+	HeartbeatTimeout *int64                  `binding:"omitempty,gt=0" json:"heartbeat_timeout"`
+	DefaultStatus    repository.DeviceStatus `binding:"lte=2" json:"default_status"`
+	Description      string                  `binding:"omitempty,max=256" json:"description"`
+}
+
+func (request DeviceTypeRequest) definition() repository.DeviceTypeDefinition {
+	definition := repository.DeviceTypeDefinition{
+		ID: request.ID,
+		NewDeviceType: repository.NewDeviceType{
+			Name:          request.Name,
+			Role:          request.Role,
+			SerialPattern: request.SerialPattern,
+			ValueTypes:    request.ValueTypes,
+			DefaultStatus: request.DefaultStatus,
+			Description:   sql.NullString{String: request.Description, Valid: request.Description != ""},
+		},
+	}
+	if request.HeartbeatTimeout != nil {
+		definition.HeartbeatTimeout = sql.NullInt64{Int64: *request.HeartbeatTimeout, Valid: true}
+	}
+	return definition
+}
+
+/*
+abortWithDeviceTypeError answers a registry change that failed, the errors of the
+registry itself are client errors, anything else is left to abortWithRepositoryError.
+*/
+func abortWithDeviceTypeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, devicetypes.ErrInvalidType):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, devicetypes.ErrUnknownType):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, devicetypes.ErrBuiltinType):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "built-in device types can't be deleted"})
+	case errors.Is(err, repository.InUse):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "device type is used by devices"})
+	default:
+		abortWithRepositoryError(c, err)
+	}
+}
+
+func (resolver *DeviceTypeResolver) ListDeviceTypes(c *gin.Context) {
+	c.JSON(http.StatusOK, resolver.registry.List())
+}
+
+func (resolver *DeviceTypeResolver) CreateDeviceType(c *gin.Context) {
+	var request DeviceTypeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	created, err := resolver.registry.Create(c.Request.Context(), request.definition().NewDeviceType)
+	if err != nil {
+		abortWithDeviceTypeError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, created)
+}
+
+func (resolver *DeviceTypeResolver) UpdateDeviceType(c *gin.Context) {
+	var request DeviceTypeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updated, err := resolver.registry.Update(c.Request.Context(), request.definition())
+	if err != nil {
+		abortWithDeviceTypeError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
+type DeviceTypeSelector struct {
+	ID *repository.DeviceType `binding:"required" form:"id"`
+}
+
+func (resolver *DeviceTypeResolver) DeleteDeviceType(c *gin.Context) {
+	var selector DeviceTypeSelector
+	if err := c.ShouldBindQuery(&selector); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := resolver.registry.Delete(c.Request.Context(), *selector.ID); err != nil {
+		abortWithDeviceTypeError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -4,95 +4,335 @@ import (
 	"database/sql"
 	"errors"
 	"net/http"
+	"time"
 
+	"github.com/TomascpMarques/maestro/alerts"
+	"github.com/TomascpMarques/maestro/clocksync"
+	"github.com/TomascpMarques/maestro/deviceauth"
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/ingest"
+	"github.com/TomascpMarques/maestro/measurementtypes"
+	"github.com/TomascpMarques/maestro/presence"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/TomascpMarques/maestro/retention"
 	"github.com/gin-gonic/gin"
-	"github.com/gin-gonic/gin/binding"
 	"github.com/go-playground/validator/v10"
-	"github.com/jmoiron/sqlx"
 )
 
-func Api(api *gin.RouterGroup, db *sqlx.DB) (err error) {
-	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
-		v.RegisterStructValidation(NewDeviceStructLevelValidation, NewDevice{})
-	} else {
-		err = errors.New("could not register struct validators")
-	}
-
-	v1 := api.Group("/v1")
+type PmdResolver struct {
+	devices      repository.DeviceRepository
+	measurements repository.MeasurementRepository
+	archive      repository.ArchiveRepository
+	history      repository.StatusHistoryRepository
+	attachments  repository.AttachmentRepository
+	ingest       *ingest.Pipeline
+	retention    retention.Config
+	presence     *presence.Monitor
+	deviceTypes  *devicetypes.Registry
+	// The types of the measurements published and queried
+	measurementTypes *measurementtypes.Registry
+	credentials      repository.CredentialRepository
+	auth             *deviceauth.Authenticator
+	// Corrects the times the devices supply by the offset of their clock
+	clocks *clocksync.Service
+	// Evaluates the alert rules on every measurement published
+	alerts *alerts.Engine
+}
 
-	devices := v1.Group("/devices")
-	pmdResolver := NewPmdResolver(db)
+// NewPmdResolver takes what it needs from the dependencies of the api
+func NewPmdResolver(deps Dependencies) PmdResolver {
+	return PmdResolver{
+		devices:          deps.Repositories.Devices,
+		measurements:     deps.Repositories.Measurements,
+		archive:          deps.Repositories.Archive,
+		history:          deps.Repositories.History,
+		attachments:      deps.Repositories.Attachments,
+		ingest:           deps.Ingest,
+		retention:        deps.Retention,
+		presence:         deps.Presence,
+		deviceTypes:      deps.DeviceTypes,
+		measurementTypes: deps.MeasurementTypes,
+		credentials:      deps.Repositories.Credentials,
+		auth:             deps.DeviceAuth,
+		clocks:           deps.Clocks,
+		alerts:           deps.Alerts,
+	}
+}
 
+func (resolver *PmdResolver) routes(v1 *gin.RouterGroup, guards routeGuards) {
 	// /v1/devices/pmd
-	pmd := devices.Group("/pmd")
+	pmd := v1.Group("/devices/pmd")
+	// Delete a device, with ?cascade=true to delete its measurements with it
+	pmd.DELETE("/", guards.admin, resolver.DeleteDevice)
 
 	// /v1/devices/pmd/data
-	_ = pmd.Group("/data")
+	data := pmd.Group("/data")
+	// Publish a measurement from a device
+	data.POST("/", guards.signed, resolver.PublishMeasurement)
+	// Retrieve the measurements of a device
+	data.GET("/", guards.viewer, resolver.QueryMeasurements)
+
+	// /v1/devices/pmd/heartbeat
+	heartbeat := pmd.Group("/heartbeat")
+	// Report that a device is still alive
+	heartbeat.POST("/", guards.signed, resolver.Heartbeat)
+	// Retrieve when a device was last seen, and its connectivity
+	heartbeat.GET("/", guards.viewer, resolver.GetPresence)
 
+	// /v1/devices/pmd/accessories
+	accessories := pmd.Group("/accessories")
+	// Retrieve the accessories attached to a PMD
+	accessories.GET("/", guards.viewer, resolver.ListAccessories)
+	// Attach an accessory to a PMD, an accessory is attached to a single PMD at a time
+	accessories.POST("/attach/", guards.operator, resolver.AttachAccessory)
+	// Detach an accessory from the PMD it is attached to
+	accessories.POST("/detach/", guards.operator, resolver.DetachAccessory)
+	// Retrieve every attachment of a PMD or of an accessory within a range
+	accessories.GET("/history/", guards.viewer, resolver.GetAttachmentHistory)
+
+	// /v1/devices/pmd/credentials
+	credentials := pmd.Group("/credentials", guards.admin)
+	// Retrieve the credentials of a device, never their secrets
+	credentials.GET("/", resolver.ListCredentials)
+	// Issue a new secret to a device, its previous ones expire after a grace period
+	credentials.POST("/rotate/", resolver.RotateCredentials)
+	// Revoke every secret of a device right away
+	credentials.POST("/revoke/", resolver.RevokeCredentials)
+
+	// Register a device, answering with the secret it signs its requests with
 	register := pmd.Group("/register")
-	register.POST("/", pmdResolver.RegisterNewDeviceStatus)
+	register.POST("/", guards.operator, resolver.RegisterNewDeviceStatus)
 
 	// /v1/devices/pmd/status
 	status := pmd.Group("/status")
 	// Update device state for a device
-	status.PUT("/", func(c *gin.Context) {})
+	status.PUT("/", guards.operator, resolver.UpdateDeviceStatus)
 	// Retrieve device state of a device
-	status.GET("/", func(c *gin.Context) {})
+	status.GET("/", guards.viewer, resolver.GetDeviceStatus)
+	// Retrieve every status change of a device within a range
+	status.GET("/history/", guards.viewer, resolver.GetStatusHistory)
+	// Retrieve how long a device spent in each status within a range
+	status.GET("/uptime/", guards.viewer, resolver.GetDeviceUptime)
 
-	return
+	// /v1/devices/pmd/decommission
+	decommission := pmd.Group("/decommission")
+	// Stop a device from publishing, keeping its history
+	decommission.POST("/", guards.operator, resolver.DecommissionDevice)
+
+	// /v1/devices/pmd/archive
+	archive := pmd.Group("/archive")
+	// Move the measurements of a device into the archive db, decommissioning it
+	archive.POST("/", guards.admin, resolver.ArchiveDevice)
 }
 
-type DeviceType uint
+/*
+DeviceRegistration is a device to register, its serial id must match the pattern of its
+type, and when the status is left out, the default status of the type is used.
+*/
+type DeviceRegistration struct {
+	SerialId     string                   `binding:"required" json:"serial_id"`
+	Description  sql.NullString           `json:"description"`
+	DeviceType   repository.DeviceType    `json:"device_type"`
+	DeviceStatus *repository.DeviceStatus `json:"device_status"`
+}
 
-const (
-	PMD DeviceType = iota
-	Accessory
-)
+func (resolver *PmdResolver) RegisterNewDeviceStatus(c *gin.Context) {
+	var registration DeviceRegistration
+	if err := c.ShouldBindJSON(&registration); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-type DeviceStatus uint
+	newDevice := repository.NewDevice{
+		SerialId:    registration.SerialId,
+		Description: registration.Description,
+		DeviceType:  registration.DeviceType,
+	}
+	if err := resolver.deviceTypes.ValidateDevice(newDevice); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if registration.DeviceStatus != nil {
+		newDevice.DeviceStatus = *registration.DeviceStatus
+	} else {
+		deviceType, _ := resolver.deviceTypes.Get(newDevice.DeviceType)
+		newDevice.DeviceStatus = deviceType.DefaultStatus
+	}
 
-const (
-	Ok DeviceStatus = iota
-	Off
-	Suspended
-)
+	device, err := resolver.devices.Create(c.Request.Context(), newDevice)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	// A device left without a secret by a failure here is given one by rotating its credentials
+	secret, _, err := resolver.auth.Issue(c.Request.Context(), device.ID, time.Now())
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
 
-type NewDevice struct {
-	SerialId     string         `binding:"required" form:"serial_id" json:"serial_id" db:"serial_id"`
-	Description  sql.NullString `binding:"required" form:"description" json:"description" db:"description"`
-	DeviceType   DeviceType     `binding:"required" form:"device_type" json:"device_type" db:"device_type"`
-	DeviceStatus DeviceStatus   `binding:"required" form:"device_status" json:"device_status" db:"device_status"`
+	c.JSON(http.StatusCreated, RegisteredDevice{device, secret})
 }
 
-type PmdResolver struct {
-	db *sqlx.DB
+// RegisteredDevice is a device just registered, with its secret, the only time it is ever shown
+type RegisteredDevice struct {
+	repository.Device
+	Secret string `json:"secret"`
 }
 
-func NewPmdResolver(db *sqlx.DB) PmdResolver {
-	return PmdResolver{db}
+/*
+StatusChangeNote is why a status change was made, recorded in the status history
+of the device, along with the user that made it.
+*/
+type StatusChangeNote struct {
+	Reason string `binding:"omitempty,max=256" json:"reason,omitempty"`
 }
 
-func (resolver *PmdResolver) RegisterNewDeviceStatus(c *gin.Context) {
-	c.Status(http.StatusOK)
+// change returns the status change the note describes, made now by the actor
+func (note StatusChangeNote) change(actor string, status repository.DeviceStatus) repository.StatusChange {
+	return repository.StatusChange{
+		Status: status,
+		Actor:  actor,
+		Reason: sql.NullString{String: note.Reason, Valid: note.Reason != ""},
+		At:     time.Now().UnixMilli(),
+	}
 }
 
-type Device struct {
-	ID uint `json:"-" db:"pk"`
-	NewDevice
+type DeviceStatusUpdate struct {
+	SerialId     string                  `binding:"required" json:"serial_id"`
+	DeviceStatus repository.DeviceStatus `json:"device_status"`
+	// Applies the same status to the accessories attached to the PMD
+	CascadeAccessories bool `json:"cascade_accessories,omitempty"`
+	StatusChangeNote
 }
 
-func NewDeviceStructLevelValidation(sl validator.StructLevel) {
-	newDevice := sl.Current().Interface().(NewDevice)
+func (resolver *PmdResolver) UpdateDeviceStatus(c *gin.Context) {
+	var update DeviceStatusUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if update.DeviceStatus > repository.Suspended {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device_status outside valid values"})
+		return
+	}
 
-	if len(newDevice.SerialId) < 6 {
-		sl.ReportError(newDevice.SerialId, "SerialId", "serial_id", "invalid", "id is to short")
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), update.SerialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	if device.DeviceStatus == repository.Decommissioned {
+		c.JSON(http.StatusConflict, gin.H{"error": "device is decommissioned"})
+		return
+	}
+	if device.DeviceStatus == repository.Pending {
+		c.JSON(http.StatusConflict, gin.H{"error": "device is pending approval, approve it first"})
+		return
 	}
 
-	if newDevice.DeviceType < PMD || newDevice.DeviceType > Accessory {
-		sl.ReportError(newDevice.DeviceType, "DeviceType", "device_type", "invalid", "outside valid values")
+	change := update.change(actorOf(c), update.DeviceStatus)
+	change.CascadeAccessories = update.CascadeAccessories
+	device, err = resolver.devices.UpdateStatus(c.Request.Context(), update.SerialId, change)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
 	}
 
-	if newDevice.DeviceStatus < Ok || newDevice.DeviceStatus > Suspended {
-		sl.ReportError(newDevice.DeviceType, "DeviceType", "device_type", "invalid", "outside valid values")
+	c.JSON(http.StatusOK, DeviceStatusUpdate{SerialId: device.SerialId, DeviceStatus: device.DeviceStatus})
+}
+
+func (resolver *PmdResolver) GetDeviceStatus(c *gin.Context) {
+	serialId := c.Query("serial_id")
+	if serialId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "serial_id is required"})
+		return
+	}
+
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), serialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, DeviceStatusUpdate{SerialId: device.SerialId, DeviceStatus: device.DeviceStatus})
+}
+
+// DeviceSelector picks the device a lifecycle action applies to
+type DeviceSelector struct {
+	SerialId string `binding:"required" json:"serial_id"`
+	StatusChangeNote
+}
+
+func (resolver *PmdResolver) DecommissionDevice(c *gin.Context) {
+	var selector DeviceSelector
+	if err := c.ShouldBindJSON(&selector); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, err := resolver.devices.Decommission(c.Request.Context(), selector.SerialId, selector.change(actorOf(c), repository.Decommissioned))
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, device)
+}
+
+/*
+DeviceDeletion is read from the query string, without Cascade a device that
+still has measurements is not deleted, archive it or delete it with cascade.
+*/
+type DeviceDeletion struct {
+	SerialId string `binding:"required" form:"serial_id"`
+	Cascade  bool   `form:"cascade"`
+}
+
+func (resolver *PmdResolver) DeleteDevice(c *gin.Context) {
+	var deletion DeviceDeletion
+	if err := c.ShouldBindQuery(&deletion); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := resolver.devices.Delete(c.Request.Context(), deletion.SerialId, deletion.Cascade)
+	if errors.Is(err, repository.InUse) {
+		c.JSON(http.StatusConflict, gin.H{"error": "device has measurements or rollups, archive it or delete it with cascade=true"})
+		return
+	}
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (resolver *PmdResolver) ArchiveDevice(c *gin.Context) {
+	var selector DeviceSelector
+	if err := c.ShouldBindJSON(&selector); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	archived, err := resolver.archive.Archive(c.Request.Context(), selector.SerialId, selector.change(actorOf(c), repository.Decommissioned))
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"serial_id": selector.SerialId, "archived_measurements": archived})
+}
+
+/*
+DeviceRegistrationStructLevelValidation checks what doesn't depend on the device type,
+the serial id and the type itself are checked against the device type registry.
+*/
+func DeviceRegistrationStructLevelValidation(sl validator.StructLevel) {
+	registration := sl.Current().Interface().(DeviceRegistration)
+
+	if registration.DeviceStatus != nil && *registration.DeviceStatus > repository.Suspended {
+		sl.ReportError(registration.DeviceStatus, "DeviceStatus", "device_status", "invalid", "outside valid values")
 	}
 }
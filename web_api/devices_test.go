@@ -0,0 +1,778 @@
+package web_api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TomascpMarques/maestro/adminauth"
+	"github.com/TomascpMarques/maestro/alerts"
+	"github.com/TomascpMarques/maestro/backup"
+	"github.com/TomascpMarques/maestro/certs"
+	"github.com/TomascpMarques/maestro/clocksync"
+	"github.com/TomascpMarques/maestro/commands"
+	"github.com/TomascpMarques/maestro/deviceauth"
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/events"
+	"github.com/TomascpMarques/maestro/firmware"
+	"github.com/TomascpMarques/maestro/health"
+	"github.com/TomascpMarques/maestro/ingest"
+	"github.com/TomascpMarques/maestro/measurementtypes"
+	"github.com/TomascpMarques/maestro/presence"
+	"github.com/TomascpMarques/maestro/provisioning"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/TomascpMarques/maestro/shadow"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestApi(t *testing.T) (*gin.Engine, repository.Repositories) {
+	return newTestApiWith(t, nil)
+}
+
+// newTestApiWith lets the test change the dependencies before the routes are set up
+func newTestApiWith(t *testing.T, configure func(deps *Dependencies)) (*gin.Engine, repository.Repositories) {
+	gin.SetMode(gin.TestMode)
+	repos := repository.NewMemoryRepositories()
+
+	pipeline := ingest.NewPipeline(repos.Measurements, ingest.Config{FlushInterval: time.Millisecond})
+	ctx, stop := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		pipeline.Run(ctx, time.Second)
+	}()
+	t.Cleanup(func() {
+		stop()
+		<-stopped
+	})
+
+	deps := newTestDependencies(t, repos, pipeline)
+	if configure != nil {
+		configure(&deps)
+	}
+	app := gin.New()
+	app.Use(asTestAdmin(t, deps.AdminAuth))
+	if err := Api(app.Group("/api"), deps); err != nil {
+		t.Fatal(err)
+	}
+	return app, repos
+}
+
+// newTestDeviceAuth creates the device authenticator with a key secret of its own
+func newTestDeviceAuth(t *testing.T, credentials repository.CredentialRepository, config deviceauth.Config) *deviceauth.Authenticator {
+	config.KeySecret = "test-key-secret"
+	authenticator, err := deviceauth.NewAuthenticator(credentials, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authenticator
+}
+
+/*
+newTestDependencies loads the registries from the repositories, with a temperature
+measurement type (1) on top of the built-in types. Unsigned device requests are allowed.
+*/
+func newTestDependencies(t *testing.T, repos repository.Repositories, pipeline *ingest.Pipeline) Dependencies {
+	ctx := context.Background()
+	deviceTypes, err := devicetypes.Load(ctx, repos.DeviceTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	measurementTypes, err := measurementtypes.Load(ctx, repos.MeasurementTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = measurementTypes.Create(ctx, repository.NewMeasurementType{Name: "temperature", Unit: "°C"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceAuth := newTestDeviceAuth(t, repos.Credentials, deviceauth.Config{AllowUnsigned: true})
+	firmwareService, err := firmware.NewService(repos.Firmware, repos.Devices, deviceTypes, firmware.Config{Location: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus := events.NewBus()
+	alertEngine, err := alerts.Load(
+		ctx, repos.Alerts, repos.Devices, repos.Measurements, deviceTypes, measurementTypes, bus, alerts.Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	running, stop := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		alertEngine.Run(running)
+	}()
+	t.Cleanup(func() {
+		stop()
+		<-stopped
+	})
+
+	return Dependencies{
+		Repositories:     repos,
+		Health:           health.NewRegistry(),
+		Ingest:           pipeline,
+		Presence:         presence.NewMonitor(repos.Devices, deviceTypes, presence.Config{}, bus),
+		DeviceTypes:      deviceTypes,
+		MeasurementTypes: measurementTypes,
+		DeviceAuth:       deviceAuth,
+		AdminAuth:        adminauth.NewAuthenticator(repos.Users, repos.Sessions, adminauth.Config{PasswordCost: bcrypt.MinCost}),
+		Backups:          backup.NewController(make(chan backup.TaskHandleSignal, 1), make(chan backup.BackupTaskSignal), nil),
+		Config:           testConfig{},
+		Provisioner: provisioning.NewProvisioner(
+			repos.ClaimCodes, repos.Devices, deviceTypes, deviceAuth, provisioning.Config{},
+		),
+		Commands: commands.NewQueue(repos.Commands, commands.Config{MaxWait: 200 * time.Millisecond}),
+		Shadows:  shadow.NewService(repos.Shadows, repos.Devices, deviceTypes),
+		Firmware: firmwareService,
+		Clocks:   clocksync.NewService(repos.Clocks, clocksync.Config{}),
+		Alerts:   alertEngine,
+	}
+}
+
+// Username and password of the admin every test request is made by, unless it has its own token
+const (
+	testAdmin         = "test-admin"
+	testAdminPassword = "test-admin-password"
+)
+
+/*
+asTestAdmin authenticates the requests without an Authorization header as the test admin,
+a request with the header set, even empty, is left as it is.
+*/
+func asTestAdmin(t *testing.T, auth *adminauth.Authenticator) gin.HandlerFunc {
+	ctx := context.Background()
+	if _, err := auth.CreateUser(ctx, testAdmin, testAdminPassword, repository.AdminRole, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	token, _, _, err := auth.Login(ctx, testAdmin, testAdminPassword, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(c *gin.Context) {
+		if _, set := c.Request.Header["Authorization"]; !set {
+			c.Request.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+}
+
+// testConfig stands for the config of the app, failing to reload when its file is "broken"
+type testConfig struct{}
+
+func (testConfig) Redacted() any {
+	return gin.H{"admin_auth": gin.H{"bootstrap_password": "env:MAESTRO_ADMIN_PASSWORD"}}
+}
+
+func (testConfig) Reload() error {
+	return errors.New("config file is broken")
+}
+
+// flushMeasurements waits for the published measurements to be written
+func flushMeasurements(t *testing.T, app *gin.Engine) {
+	assert.Eventually(t, func() bool {
+		response := doJSON(app, http.MethodGet, "/api/v1/devices/pmd/data/?serial_id=PMD-000001", nil)
+		var page MeasurementsPage
+		return json.Unmarshal(response.Body.Bytes(), &page) == nil && len(page.Measurements) > 0
+	}, time.Second, time.Millisecond)
+}
+
+func doJSON(app *gin.Engine, method, path string, body any) *httptest.ResponseRecorder {
+	var payload bytes.Buffer
+	if body != nil {
+		_ = json.NewEncoder(&payload).Encode(body)
+	}
+
+	request := httptest.NewRequest(method, path, &payload)
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	app.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestRegisterDevice(t *testing.T) {
+	app, _ := newTestApi(t)
+
+	response := doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD"})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+func TestDeviceStatus(t *testing.T) {
+	app, _ := newTestApi(t)
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+
+	response := doJSON(app, http.MethodPut, "/api/v1/devices/pmd/status/",
+		gin.H{"serial_id": "PMD-000001", "device_status": repository.Suspended})
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/status/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"serial_id":"PMD-000001","device_status":2}`, response.Body.String())
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/status/?serial_id=PMD-missing", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+func TestPublishAndQueryMeasurements(t *testing.T) {
+	app, _ := newTestApi(t)
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+
+	response := doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/",
+		gin.H{"serial_id": "PMD-000001", "m_value": "21.5", "m_value_type": 1})
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	flushMeasurements(t, app)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/",
+		gin.H{"serial_id": "PMD-missing", "m_value": "21.5"})
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/data/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var page MeasurementsPage
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &page))
+	assert.Equal(t, "raw", page.Resolution)
+	assert.Len(t, page.Measurements, 1)
+	assert.Equal(t, 21.5, page.Measurements[0].Value)
+	assert.Equal(t, "°C", page.Measurements[0].Unit)
+}
+
+func TestQueryMeasurementsResolution(t *testing.T) {
+	app, repos := newTestApi(t)
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/",
+		gin.H{"serial_id": "PMD-000001", "m_value": "21.5", "m_value_type": 1})
+	flushMeasurements(t, app)
+
+	// Rolls up everything published, up to the next minute
+	until := repository.MinuteResolution.Floor(time.Now().Add(time.Minute).UnixMilli())
+	assert.NoError(t, repos.Retention.Rollup(context.Background(), repository.MinuteResolution, 0, until))
+
+	// A week is longer than what is read from the raw data
+	from := time.Now().Add(-7 * 24 * time.Hour).UnixMilli()
+	response := doJSON(app, http.MethodGet,
+		fmt.Sprintf("/api/v1/devices/pmd/data/?serial_id=PMD-000001&from=%d", from), nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var page MeasurementsPage
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &page))
+	assert.Equal(t, "1m", page.Resolution)
+	assert.Empty(t, page.Measurements)
+	if assert.Len(t, page.Rollups, 1) {
+		assert.Equal(t, 21.5, page.Rollups[0].Avg)
+	}
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/data/?serial_id=PMD-000001&resolution=1h", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &page))
+	assert.Equal(t, "1h", page.Resolution)
+	assert.Empty(t, page.Rollups)
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/data/?serial_id=PMD-000001&resolution=1s", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+func TestPublishBackpressure(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	repos := repository.NewMemoryRepositories()
+	// Never run, so nothing is taken out of the queue
+	pipeline := ingest.NewPipeline(repos.Measurements, ingest.Config{QueueSize: 1, RetryAfter: 1500 * time.Millisecond})
+
+	deps := newTestDependencies(t, repos, pipeline)
+	app := gin.New()
+	app.Use(asTestAdmin(t, deps.AdminAuth))
+	assert.NoError(t, Api(app.Group("/api"), deps))
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+
+	published := gin.H{"serial_id": "PMD-000001", "m_value": "21.5"}
+	response := doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/", published)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/", published)
+	assert.Equal(t, http.StatusTooManyRequests, response.Code)
+	assert.Equal(t, "2", response.Header().Get("Retry-After"))
+
+	// A refused publish of an accessory doesn't mark its PMD as seen
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000002"})
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "ACC-000001", "device_type": repository.Accessory})
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/accessories/attach/", gin.H{
+		"serial_id": "PMD-000002", "accessory_serial_id": "ACC-000001",
+	})
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/", gin.H{"serial_id": "ACC-000001", "m_value": "21"})
+	assert.Equal(t, http.StatusTooManyRequests, response.Code)
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/heartbeat/?serial_id=PMD-000002", nil)
+	var parent DevicePresence
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &parent))
+	assert.Nil(t, parent.LastSeenAt)
+}
+
+func TestDeviceLifecycleEndpoints(t *testing.T) {
+	app, _ := newTestApi(t)
+	for _, serialId := range []string{"PMD-000001", "PMD-000002"} {
+		doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": serialId})
+	}
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/", gin.H{"serial_id": "PMD-000001", "m_value": "21.5"})
+	flushMeasurements(t, app)
+
+	response := doJSON(app, http.MethodDelete, "/api/v1/devices/pmd/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/archive/", gin.H{"serial_id": "PMD-000001"})
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"serial_id":"PMD-000001","archived_measurements":1}`, response.Body.String())
+
+	// Archived devices are decommissioned, they can't publish or change status anymore
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/", gin.H{"serial_id": "PMD-000001", "m_value": "21.5"})
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSON(app, http.MethodPut, "/api/v1/devices/pmd/status/",
+		gin.H{"serial_id": "PMD-000001", "device_status": repository.Ok})
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	response = doJSON(app, http.MethodDelete, "/api/v1/devices/pmd/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusNoContent, response.Code)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/decommission/", gin.H{"serial_id": "PMD-000002"})
+	assert.Equal(t, http.StatusOK, response.Code)
+	var device repository.Device
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &device))
+	assert.Equal(t, repository.Decommissioned, device.DeviceStatus)
+	assert.True(t, device.DecommissionedAt.Valid)
+
+	response = doJSON(app, http.MethodDelete, "/api/v1/devices/pmd/?serial_id=PMD-000002&cascade=true", nil)
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	response = doJSON(app, http.MethodDelete, "/api/v1/devices/pmd/?serial_id=PMD-000002", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+func TestStatusHistoryEndpoints(t *testing.T) {
+	app, _ := newTestApi(t)
+	start := time.Now().UnixMilli() - 1000
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+
+	response := doJSON(app, http.MethodPut, "/api/v1/devices/pmd/status/", gin.H{
+		"serial_id": "PMD-000001", "device_status": repository.Suspended, "reason": "maintenance",
+	})
+	assert.Equal(t, http.StatusOK, response.Code)
+	// Not a change, so not recorded
+	doJSON(app, http.MethodPut, "/api/v1/devices/pmd/status/", gin.H{"serial_id": "PMD-000001", "device_status": repository.Suspended})
+	doJSON(app, http.MethodPut, "/api/v1/devices/pmd/status/", gin.H{"serial_id": "PMD-000001", "device_status": repository.Ok})
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/status/history/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var timeline StatusHistory
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &timeline))
+	if assert.Len(t, timeline.History, 3) {
+		assert.Nil(t, timeline.History[0].OldStatus)
+		assert.Equal(t, repository.RegistrationActor, timeline.History[0].Actor)
+		// The user that made the change is its actor
+		assert.Equal(t, testAdmin, timeline.History[1].Actor)
+		assert.Equal(t, "maintenance", timeline.History[1].Reason.String)
+		assert.Equal(t, testAdmin, timeline.History[2].Actor)
+	}
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/status/history/?serial_id=PMD-missing", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	// Some time is spent in the last status, the range ends now
+	time.Sleep(5 * time.Millisecond)
+	response = doJSON(app, http.MethodGet, fmt.Sprintf("/api/v1/devices/pmd/status/uptime/?serial_id=PMD-000001&from=%d", start), nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var uptime DeviceUptime
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &uptime))
+	assert.NotNil(t, uptime.Availability)
+	assert.Contains(t, uptime.Durations, "ok")
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/status/uptime/?serial_id=PMD-000001&from=1&to=2", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	uptime = DeviceUptime{}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &uptime))
+	// The device didn't exist yet, so nothing is known
+	assert.Nil(t, uptime.Availability)
+	assert.Empty(t, uptime.Durations)
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/status/uptime/?serial_id=PMD-000001&from=5&to=2", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+func TestStatusDurations(t *testing.T) {
+	ok, suspended := repository.Ok, repository.Suspended
+	changes := []repository.StatusHistoryEntry{
+		{OldStatus: &ok, NewStatus: repository.Suspended, ChangedAt: 2000},
+		{OldStatus: &suspended, NewStatus: repository.Ok, ChangedAt: 3000},
+	}
+
+	durations, availability := statusDurations(&ok, changes, 1000, 5000)
+	assert.Equal(t, map[string]int64{"ok": 3000, "suspended": 1000}, durations)
+	assert.InDelta(t, 0.75, *availability, 0.0001)
+
+	// Unknown until the first change
+	durations, availability = statusDurations(nil, changes, 1000, 5000)
+	assert.Equal(t, map[string]int64{"ok": 2000, "suspended": 1000}, durations)
+	assert.InDelta(t, 2.0/3.0, *availability, 0.0001)
+
+	durations, availability = statusDurations(nil, nil, 1000, 5000)
+	assert.Empty(t, durations)
+	assert.Nil(t, availability)
+}
+
+func TestHeartbeat(t *testing.T) {
+	app, _ := newTestApi(t)
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+
+	response := doJSON(app, http.MethodGet, "/api/v1/devices/pmd/heartbeat/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var current DevicePresence
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &current))
+	assert.Nil(t, current.LastSeenAt)
+	assert.Equal(t, "unknown", current.Connectivity)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/heartbeat/", gin.H{"serial_id": "PMD-000001"})
+	assert.Equal(t, http.StatusNoContent, response.Code)
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/heartbeat/?serial_id=PMD-000001", nil)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &current))
+	assert.NotNil(t, current.LastSeenAt)
+	assert.Equal(t, "online", current.Connectivity)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/heartbeat/", gin.H{"serial_id": "PMD-missing"})
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/decommission/", gin.H{"serial_id": "PMD-000001"})
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/heartbeat/", gin.H{"serial_id": "PMD-000001"})
+	assert.Equal(t, http.StatusConflict, response.Code)
+}
+
+func TestAccessoryEndpoints(t *testing.T) {
+	app, _ := newTestApi(t)
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "ACC-000001", "device_type": repository.Accessory})
+
+	// Not attached yet, so it can't publish
+	response := doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/", gin.H{"serial_id": "ACC-000001", "m_value": "21"})
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/accessories/attach/", gin.H{
+		"serial_id": "ACC-000001", "accessory_serial_id": "PMD-000001",
+	})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/accessories/attach/", gin.H{
+		"serial_id": "PMD-000001", "accessory_serial_id": "ACC-000001",
+	})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/accessories/attach/", gin.H{
+		"serial_id": "PMD-000001", "accessory_serial_id": "ACC-000001",
+	})
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/accessories/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var attached AttachedAccessories
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &attached))
+	if assert.Len(t, attached.Accessories, 1) {
+		assert.Equal(t, "ACC-000001", attached.Accessories[0].SerialId)
+	}
+
+	// Published by the accessory, attributed to the PMD
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/", gin.H{"serial_id": "ACC-000001", "m_value": "21"})
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	flushMeasurements(t, app)
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/data/?serial_id=ACC-000001", nil)
+	var page MeasurementsPage
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &page))
+	assert.Equal(t, "raw", page.Resolution)
+	assert.Len(t, page.Measurements, 1)
+
+	// Suspending the PMD with cascade suspends the accessory too
+	response = doJSON(app, http.MethodPut, "/api/v1/devices/pmd/status/", gin.H{
+		"serial_id": "PMD-000001", "device_status": repository.Suspended, "cascade_accessories": true,
+	})
+	assert.Equal(t, http.StatusOK, response.Code)
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/status/?serial_id=ACC-000001", nil)
+	var status DeviceStatusUpdate
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &status))
+	assert.Equal(t, repository.Suspended, status.DeviceStatus)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/accessories/detach/", gin.H{"accessory_serial_id": "ACC-000001"})
+	assert.Equal(t, http.StatusOK, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/accessories/detach/", gin.H{"accessory_serial_id": "ACC-000001"})
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/accessories/history/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var history AttachmentHistory
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &history))
+	if assert.Len(t, history.Attachments, 1) {
+		assert.Equal(t, testAdmin, history.Attachments[0].AttachedBy)
+		assert.Equal(t, testAdmin, history.Attachments[0].DetachedBy.String)
+	}
+}
+
+func TestDeviceTypeEndpoints(t *testing.T) {
+	app, _ := newTestApi(t)
+
+	response := doJSON(app, http.MethodPost, "/api/v1/devices/types/", gin.H{
+		"name":              "air-sensor",
+		"serial_pattern":    "^AIR-[0-9]{6}$",
+		"value_types":       []uint{1},
+		"heartbeat_timeout": 60_000,
+		"default_status":    repository.Suspended,
+	})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var created repository.DeviceTypeDefinition
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &created))
+	assert.Equal(t, repository.DeviceType(2), created.ID)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/types/", gin.H{"name": "air-sensor", "serial_pattern": ".*"})
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/types/", gin.H{"name": "broken", "serial_pattern": "("})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	// The serial id must match the pattern of the type, and the status defaults to the one of the type
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001", "device_type": created.ID})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "AIR-000001", "device_type": created.ID})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/status/?serial_id=AIR-000001", nil)
+	assert.JSONEq(t, `{"serial_id":"AIR-000001","device_status":2}`, response.Body.String())
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "UNKNOWN-1", "device_type": 9})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	// Only the measurement types of the type are accepted
+	doJSON(app, http.MethodPut, "/api/v1/devices/pmd/status/", gin.H{"serial_id": "AIR-000001", "device_status": repository.Ok})
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/", gin.H{"serial_id": "AIR-000001", "m_value": "21.5", "m_value_type": 2})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/", gin.H{"serial_id": "AIR-000001", "m_value": "21.5", "m_value_type": 1})
+	assert.Equal(t, http.StatusAccepted, response.Code)
+
+	response = doJSON(app, http.MethodPut, "/api/v1/devices/types/", gin.H{
+		"id": created.ID, "name": "renamed", "serial_pattern": "^AIR-.+$", "value_types": []uint{1, 2},
+	})
+	assert.Equal(t, http.StatusOK, response.Code)
+	var updated repository.DeviceTypeDefinition
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &updated))
+	assert.Equal(t, "air-sensor", updated.Name)
+	assert.False(t, updated.HeartbeatTimeout.Valid)
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/types/", nil)
+	var deviceTypes []repository.DeviceTypeDefinition
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &deviceTypes))
+	assert.Len(t, deviceTypes, 3)
+
+	response = doJSON(app, http.MethodDelete, fmt.Sprintf("/api/v1/devices/types/?id=%d", created.ID), nil)
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSON(app, http.MethodDelete, "/api/v1/devices/types/?id=0", nil)
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSON(app, http.MethodDelete, "/api/v1/devices/types/", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+func TestMeasurementTypeEndpoints(t *testing.T) {
+	app, _ := newTestApi(t)
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+
+	response := doJSON(app, http.MethodPost, "/api/v1/measurements/types/", gin.H{
+		"name": "acceleration", "encoding": repository.VectorEncoding, "unit": "m/s²", "min": -20, "max": 20,
+	})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var acceleration repository.MeasurementTypeDefinition
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &acceleration))
+
+	response = doJSON(app, http.MethodPost, "/api/v1/measurements/types/", gin.H{"name": "acceleration"})
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/measurements/types/", gin.H{"name": "broken", "min": 2, "max": 1})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	for _, invalid := range []gin.H{
+		{"serial_id": "PMD-000001", "m_value": "warm", "m_value_type": 1},
+		{"serial_id": "PMD-000001", "m_value": []float64{1, 25}, "m_value_type": acceleration.ID},
+		{"serial_id": "PMD-000001", "m_value": 1, "m_value_type": 99},
+		{"serial_id": "PMD-000001", "m_value": nil},
+	} {
+		response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/", invalid)
+		assert.Equal(t, http.StatusBadRequest, response.Code, invalid)
+	}
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/",
+		gin.H{"serial_id": "PMD-000001", "m_value": []float64{0.5, -9.81, 0}, "m_value_type": acceleration.ID})
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	var published TypedMeasurement
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &published))
+	assert.Equal(t, []any{0.5, -9.81, 0.0}, published.Value)
+	assert.Equal(t, "m/s²", published.Unit)
+	flushMeasurements(t, app)
+
+	// Vectors are never rolled up, so even a long range is read from the raw measurements
+	from := time.Now().Add(-7 * 24 * time.Hour).UnixMilli()
+	response = doJSON(app, http.MethodGet,
+		fmt.Sprintf("/api/v1/devices/pmd/data/?serial_id=PMD-000001&from=%d&m_value_type=%d", from, acceleration.ID), nil)
+	var page MeasurementsPage
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &page))
+	assert.Equal(t, "raw", page.Resolution)
+	if assert.Len(t, page.Measurements, 1) {
+		assert.Equal(t, []any{0.5, -9.81, 0.0}, page.Measurements[0].Value)
+	}
+
+	response = doJSON(app, http.MethodPut, "/api/v1/measurements/types/",
+		gin.H{"id": acceleration.ID, "encoding": repository.FloatEncoding, "unit": "g"})
+	assert.Equal(t, http.StatusOK, response.Code)
+	var updated repository.MeasurementTypeDefinition
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &updated))
+	assert.Equal(t, repository.VectorEncoding, updated.Encoding)
+	assert.False(t, updated.Max.Valid)
+
+	response = doJSON(app, http.MethodGet, "/api/v1/measurements/types/", nil)
+	var measurementTypes []repository.MeasurementTypeDefinition
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &measurementTypes))
+	assert.Len(t, measurementTypes, 3)
+
+	response = doJSON(app, http.MethodDelete, fmt.Sprintf("/api/v1/measurements/types/?id=%d", acceleration.ID), nil)
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSON(app, http.MethodDelete, "/api/v1/measurements/types/?id=0", nil)
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSON(app, http.MethodDelete, "/api/v1/measurements/types/?id=1", nil)
+	assert.Equal(t, http.StatusNoContent, response.Code)
+}
+
+// doSigned sends the request signed with the secret of the device, as of now
+func doSigned(app *gin.Engine, method, path, serialId, secret, nonce string, body any) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	timestamp := time.Now().UnixMilli()
+
+	request := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(deviceauth.DeviceHeader, serialId)
+	request.Header.Set(deviceauth.TimestampHeader, fmt.Sprint(timestamp))
+	request.Header.Set(deviceauth.NonceHeader, nonce)
+	request.Header.Set(deviceauth.SignatureHeader,
+		deviceauth.Sign(deviceauth.HashSecret(secret), method, path, timestamp, nonce, payload))
+	recorder := httptest.NewRecorder()
+	app.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestSignedDeviceRequests(t *testing.T) {
+	app, _ := newTestApiWith(t, func(deps *Dependencies) {
+		deps.DeviceAuth = newTestDeviceAuth(t, deps.Repositories.Credentials, deviceauth.Config{})
+	})
+
+	response := doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var registered RegisteredDevice
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &registered))
+	assert.NotEmpty(t, registered.Secret)
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000002"})
+
+	published := gin.H{"m_value": 21.5, "m_value_type": 1}
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/data/", gin.H{"serial_id": "PMD-000001", "m_value": 21.5})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	response = doSigned(app, http.MethodPost, "/api/v1/devices/pmd/data/", "PMD-000001", registered.Secret, "n-1", published)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	flushMeasurements(t, app)
+
+	// Replayed, wrongly signed, or about another device
+	response = doSigned(app, http.MethodPost, "/api/v1/devices/pmd/data/", "PMD-000001", registered.Secret, "n-1", published)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	response = doSigned(app, http.MethodPost, "/api/v1/devices/pmd/data/", "PMD-000001", "wrong", "n-2", published)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	response = doSigned(app, http.MethodPost, "/api/v1/devices/pmd/data/", "PMD-missing", "wrong", "n-2", published)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	response = doSigned(app, http.MethodPost, "/api/v1/devices/pmd/heartbeat/", "PMD-000001", registered.Secret, "n-3",
+		gin.H{"serial_id": "PMD-000002"})
+	assert.Equal(t, http.StatusForbidden, response.Code)
+	response = doSigned(app, http.MethodPost, "/api/v1/devices/pmd/heartbeat/", "PMD-000001", registered.Secret, "n-4", gin.H{})
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	// Read whole for the signature, a body past the limit is refused before it is checked
+	response = doSigned(app, http.MethodPost, "/api/v1/devices/pmd/data/", "PMD-000001", registered.Secret, "n-big",
+		gin.H{"m_value": strings.Repeat("1", maxSignedBodySize), "m_value_type": 1})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.Code)
+
+	// The previous secret stays valid for the rotation grace
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/credentials/rotate/", gin.H{"serial_id": "PMD-000001"})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var rotated IssuedCredential
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &rotated))
+	assert.NotEqual(t, registered.Secret, rotated.Secret)
+	response = doSigned(app, http.MethodPost, "/api/v1/devices/pmd/heartbeat/", "PMD-000001", registered.Secret, "n-5", gin.H{})
+	assert.Equal(t, http.StatusNoContent, response.Code)
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/credentials/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NotContains(t, response.Body.String(), deviceauth.HashSecret(rotated.Secret))
+	var credentials DeviceCredentials
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &credentials))
+	if assert.Len(t, credentials.Credentials, 2) {
+		assert.True(t, credentials.Credentials[0].ExpiresAt.Valid)
+		assert.False(t, credentials.Credentials[1].ExpiresAt.Valid)
+	}
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/credentials/revoke/", gin.H{"serial_id": "PMD-000001"})
+	assert.JSONEq(t, `{"serial_id":"PMD-000001","revoked_credentials":2}`, response.Body.String())
+	response = doSigned(app, http.MethodPost, "/api/v1/devices/pmd/heartbeat/", "PMD-000001", rotated.Secret, "n-6", gin.H{})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+}
+
+// doWithCertificate sends the request as if made over TLS with the verified client certificate
+func doWithCertificate(app *gin.Engine, method, path string, certificate *x509.Certificate, body any) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	request := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	request.Header.Set("Content-Type", "application/json")
+	request.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{certificate},
+		VerifiedChains:   [][]*x509.Certificate{{certificate}},
+	}
+	recorder := httptest.NewRecorder()
+	app.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestCertificateDeviceRequests(t *testing.T) {
+	app, _ := newTestApiWith(t, func(deps *Dependencies) {
+		deps.DeviceAuth = newTestDeviceAuth(t, deps.Repositories.Credentials, deviceauth.Config{RequireClientCert: true})
+	})
+	now := time.Now()
+	ca, err := certs.NewCA("test CA", time.Hour, now)
+	assert.NoError(t, err)
+	device, _ := ca.IssueDevice("PMD-000001", time.Hour, now)
+	unknown, _ := ca.IssueDevice("PMD-000009", time.Hour, now)
+
+	response := doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var registered RegisteredDevice
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &registered))
+
+	// A signature is not enough once the certificates are required
+	response = doSigned(app, http.MethodPost, "/api/v1/devices/pmd/heartbeat/", "PMD-000001", registered.Secret, "n-1", gin.H{})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	response = doWithCertificate(app, http.MethodPost, "/api/v1/devices/pmd/heartbeat/", unknown.Certificate, gin.H{})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	response = doWithCertificate(app, http.MethodPost, "/api/v1/devices/pmd/heartbeat/", device.Certificate, gin.H{})
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	response = doWithCertificate(app, http.MethodPost, "/api/v1/devices/pmd/data/", device.Certificate,
+		gin.H{"m_value": 21.5, "m_value_type": 1})
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	// The certificate is of the device it publishes for
+	response = doWithCertificate(app, http.MethodPost, "/api/v1/devices/pmd/data/", device.Certificate,
+		gin.H{"serial_id": "PMD-000002", "m_value": 21.5, "m_value_type": 1})
+	assert.Equal(t, http.StatusForbidden, response.Code)
+}
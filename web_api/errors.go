@@ -0,0 +1,48 @@
+package web_api
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TomascpMarques/maestro/ingest"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+)
+
+/*
+abortWithRepositoryError answers the request with the status code that matches
+the repository error variant, anything unexpected is reported as a server error,
+without leaking the underlying cause to the client.
+*/
+func abortWithRepositoryError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, repository.NotFound):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not found"})
+	case errors.Is(err, repository.AlreadyExists):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "already exists"})
+	case errors.Is(err, repository.InUse):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "in use"})
+	default:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+	}
+}
+
+/*
+abortWithIngestError answers a publish that could not be queued, a full queue is
+a 429, telling the client when to try again, a stopped pipeline means the app is
+shutting down.
+*/
+func abortWithIngestError(c *gin.Context, err error, retryAfter time.Duration) {
+	switch {
+	case errors.Is(err, ingest.ErrQueueFull):
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many measurements, retry later"})
+	case errors.Is(err, ingest.ErrStopped):
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "shutting down"})
+	default:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+	}
+}
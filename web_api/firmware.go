@@ -0,0 +1,371 @@
+package web_api
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/firmware"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// The form fields of an upload, and the multipart headers, on top of the image
+	uploadFormMargin = 1 << 20
+	uploadFieldSize  = 1024
+)
+
+type FirmwareResolver struct {
+	firmware *firmware.Service
+	devices  repository.DeviceRepository
+}
+
+func NewFirmwareResolver(firmware *firmware.Service, devices repository.DeviceRepository) FirmwareResolver {
+	return FirmwareResolver{firmware, devices}
+}
+
+func (resolver *FirmwareResolver) routes(v1 *gin.RouterGroup, guards routeGuards) {
+	// /v1/devices/pmd/firmware
+	updates := v1.Group("/devices/pmd/firmware")
+	// The device checks for the update it is offered, downloads its image, with range requests, and reports its install
+	updates.GET("/update/", guards.signed, resolver.CheckForUpdate)
+	updates.GET("/download/", guards.signed, resolver.DownloadFirmware)
+	updates.POST("/report/", guards.signed, resolver.ReportUpdate)
+
+	// /v1/firmware
+	firmwareRoutes := v1.Group("/firmware")
+	// Retrieve every firmware uploaded
+	firmwareRoutes.GET("/", guards.viewer, resolver.ListFirmware)
+	// Upload an image for a device type, as a multipart form
+	firmwareRoutes.POST("/", guards.admin, resolver.UploadFirmware)
+	// Delete a firmware without a rollout in progress
+	firmwareRoutes.DELETE("/", guards.admin, resolver.DeleteFirmware)
+
+	// /v1/firmware/rollouts
+	rollouts := firmwareRoutes.Group("/rollouts")
+	// Retrieve every rollout, the newest first
+	rollouts.GET("/", guards.viewer, resolver.ListRollouts)
+	// Roll a firmware out to a percentage of the devices of its type, or to the devices listed
+	rollouts.POST("/", guards.admin, resolver.CreateRollout)
+	// Retrieve the devices of a rollout, and where each is in its update
+	rollouts.GET("/devices/", guards.viewer, resolver.GetRolloutDevices)
+	// Pause or resume offering the update, a rollout is also paused once too many installs failed
+	rollouts.POST("/pause/", guards.admin, resolver.PauseRollout)
+	rollouts.POST("/resume/", guards.admin, resolver.ResumeRollout)
+	// End a rollout, a cancelled one stops serving its image
+	rollouts.POST("/complete/", guards.admin, resolver.CompleteRollout)
+	rollouts.POST("/cancel/", guards.admin, resolver.CancelRollout)
+}
+
+func abortWithFirmwareError(c *gin.Context, err error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, firmware.ErrTooLarge), errors.As(err, &tooLarge):
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, firmware.ErrChecksumMismatch), errors.Is(err, firmware.ErrInvalidSignature),
+		errors.Is(err, firmware.ErrInvalidTarget), errors.Is(err, firmware.ErrInvalidThreshold),
+		errors.Is(err, firmware.ErrInvalidReport), errors.Is(err, devicetypes.ErrUnknownType):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, firmware.ErrRolloutInProgress), errors.Is(err, firmware.ErrRolloutStatus),
+		errors.Is(err, firmware.ErrNotOffered):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		abortWithRepositoryError(c, err)
+	}
+}
+
+func (resolver *FirmwareResolver) ListFirmware(c *gin.Context) {
+	firmware, err := resolver.firmware.List(c.Request.Context())
+	if err != nil {
+		abortWithFirmwareError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, firmware)
+}
+
+/*
+UploadFirmware stores an image sent as a multipart form, its fields device_type, version,
+description, sha256 and signature first, followed by the image in the "image" part. The
+image is streamed to disk as it is read, never held in memory.
+*/
+func (resolver *FirmwareResolver) UploadFirmware(c *gin.Context) {
+	mediaType, params, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the image is uploaded as multipart/form-data"})
+		return
+	}
+	// An image takes longer to upload than the server's read timeout allows
+	_ = http.NewResponseController(c.Writer).SetReadDeadline(time.Time{})
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, resolver.firmware.MaxSize()+uploadFormMargin)
+	reader := multipart.NewReader(body, params["boundary"])
+
+	var upload firmware.Upload
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "the image part is missing"})
+			return
+		}
+		if part.FormName() == "image" {
+			if upload.Version == "" || len(upload.Version) > 64 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "version is required, at most 64 characters, before the image"})
+				return
+			}
+			stored, err := resolver.firmware.Upload(c.Request.Context(), upload, part, actorOf(c), time.Now())
+			if err != nil {
+				abortWithFirmwareError(c, err)
+				return
+			}
+			c.JSON(http.StatusCreated, stored)
+			return
+		}
+
+		// The fields are small, read whole, the image is the only large part
+		value, err := io.ReadAll(io.LimitReader(part, uploadFieldSize+1))
+		if err != nil {
+			abortWithFirmwareError(c, err)
+			return
+		}
+		if len(value) > uploadFieldSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": part.FormName() + " is too long"})
+			return
+		}
+		switch part.FormName() {
+		case "device_type":
+			deviceType, err := strconv.ParseUint(string(value), 10, 8)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "device_type should be the id of a device type"})
+				return
+			}
+			upload.DeviceType = repository.DeviceType(deviceType)
+		case "version":
+			upload.Version = string(value)
+		case "description":
+			upload.Description = string(value)
+		case "sha256":
+			upload.SHA256 = string(value)
+		case "signature":
+			upload.Signature = string(value)
+		}
+	}
+}
+
+type FirmwareSelector struct {
+	ID *uint `binding:"required" form:"id"`
+}
+
+// DeleteFirmware removes a firmware without a rollout in progress, along with its finished rollouts
+func (resolver *FirmwareResolver) DeleteFirmware(c *gin.Context) {
+	var selector FirmwareSelector
+	if err := c.ShouldBindQuery(&selector); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := resolver.firmware.Delete(c.Request.Context(), *selector.ID, actorOf(c)); err != nil {
+		abortWithFirmwareError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (resolver *FirmwareResolver) ListRollouts(c *gin.Context) {
+	rollouts, err := resolver.firmware.Rollouts(c.Request.Context())
+	if err != nil {
+		abortWithFirmwareError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rollouts)
+}
+
+/*
+NewRolloutRequest rolls a firmware out to a percentage of the devices of its type, or to
+the devices listed, the failure threshold and min reports left out take the configured ones.
+*/
+type NewRolloutRequest struct {
+	FirmwareID       uint     `binding:"required" json:"firmware_id"`
+	Percentage       uint     `binding:"lte=100" json:"percentage"`
+	SerialIds        []string `json:"serial_ids"`
+	FailureThreshold float64  `binding:"gte=0,lte=1" json:"failure_threshold"`
+	MinReports       uint     `json:"min_reports"`
+}
+
+func (resolver *FirmwareResolver) CreateRollout(c *gin.Context) {
+	var request NewRolloutRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rollout, err := resolver.firmware.CreateRollout(c.Request.Context(), firmware.RolloutRequest{
+		FirmwareID:       request.FirmwareID,
+		Percentage:       request.Percentage,
+		SerialIds:        request.SerialIds,
+		FailureThreshold: request.FailureThreshold,
+		MinReports:       request.MinReports,
+	}, actorOf(c), time.Now())
+	if err != nil {
+		abortWithFirmwareError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, rollout)
+}
+
+// GetRolloutDevices answers with the devices of the rollout, and where each is in its update
+func (resolver *FirmwareResolver) GetRolloutDevices(c *gin.Context) {
+	var selector FirmwareSelector
+	if err := c.ShouldBindQuery(&selector); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	devices, err := resolver.firmware.RolloutDevices(c.Request.Context(), *selector.ID)
+	if err != nil {
+		abortWithFirmwareError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, devices)
+}
+
+type RolloutChangeRequest struct {
+	ID     uint   `binding:"required" json:"id"`
+	Reason string `json:"reason"`
+}
+
+// changeRollout binds the rollout and the reason, and answers with the rollout changed by the handler
+func (resolver *FirmwareResolver) changeRollout(c *gin.Context, change func(RolloutChangeRequest) (repository.Rollout, error)) {
+	var request RolloutChangeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rollout, err := change(request)
+	if err != nil {
+		abortWithFirmwareError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rollout)
+}
+
+func (resolver *FirmwareResolver) PauseRollout(c *gin.Context) {
+	resolver.changeRollout(c, func(request RolloutChangeRequest) (repository.Rollout, error) {
+		return resolver.firmware.Pause(c.Request.Context(), request.ID, actorOf(c), request.Reason, time.Now())
+	})
+}
+
+func (resolver *FirmwareResolver) ResumeRollout(c *gin.Context) {
+	resolver.changeRollout(c, func(request RolloutChangeRequest) (repository.Rollout, error) {
+		return resolver.firmware.Resume(c.Request.Context(), request.ID, actorOf(c), request.Reason, time.Now())
+	})
+}
+
+func (resolver *FirmwareResolver) CompleteRollout(c *gin.Context) {
+	resolver.changeRollout(c, func(request RolloutChangeRequest) (repository.Rollout, error) {
+		return resolver.firmware.Complete(c.Request.Context(), request.ID, actorOf(c), request.Reason, time.Now())
+	})
+}
+
+func (resolver *FirmwareResolver) CancelRollout(c *gin.Context) {
+	resolver.changeRollout(c, func(request RolloutChangeRequest) (repository.Rollout, error) {
+		return resolver.firmware.Cancel(c.Request.Context(), request.ID, actorOf(c), request.Reason, time.Now())
+	})
+}
+
+type UpdateCheck struct {
+	SerialId string `form:"serial_id"`
+	// The version the device runs, it isn't offered the same one
+	Version string `form:"version"`
+}
+
+// CheckForUpdate answers the device with the update it is offered, or with no content when there is none
+func (resolver *FirmwareResolver) CheckForUpdate(c *gin.Context) {
+	var check UpdateCheck
+	if err := c.ShouldBindQuery(&check); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	device, found := requestDevice(c, resolver.devices, check.SerialId)
+	if !found {
+		return
+	}
+
+	update, offered, err := resolver.firmware.Check(c.Request.Context(), device, check.Version, time.Now())
+	if err != nil {
+		abortWithFirmwareError(c, err)
+		return
+	}
+	if !offered {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, update)
+}
+
+type FirmwareDownload struct {
+	SerialId string `form:"serial_id"`
+	ID       *uint  `binding:"required" form:"id"`
+}
+
+// DownloadFirmware serves the image offered to the device, a download cut short is resumed with a range request
+func (resolver *FirmwareResolver) DownloadFirmware(c *gin.Context) {
+	var download FirmwareDownload
+	if err := c.ShouldBindQuery(&download); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	device, found := requestDevice(c, resolver.devices, download.SerialId)
+	if !found {
+		return
+	}
+
+	image, stored, err := resolver.firmware.Open(c.Request.Context(), device, *download.ID)
+	if err != nil {
+		abortWithFirmwareError(c, err)
+		return
+	}
+	defer image.Close()
+
+	// A slow link takes longer to download an image than the server's write timeout allows
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("ETag", `"`+stored.SHA256+`"`)
+	http.ServeContent(c.Writer, c.Request, stored.SHA256+".bin", time.UnixMilli(stored.UploadedAt), image)
+}
+
+type UpdateReport struct {
+	SerialId  string                  `json:"serial_id"`
+	RolloutID uint                    `binding:"required" json:"rollout_id"`
+	Status    repository.UpdateStatus `json:"status"`
+	Detail    string                  `binding:"max=1024" json:"detail"`
+}
+
+// ReportUpdate records the device downloading the update, or the outcome of its install
+func (resolver *FirmwareResolver) ReportUpdate(c *gin.Context) {
+	var report UpdateReport
+	if err := c.ShouldBindJSON(&report); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	device, found := requestDevice(c, resolver.devices, report.SerialId)
+	if !found {
+		return
+	}
+	if device.DeviceStatus == repository.Decommissioned {
+		c.JSON(http.StatusConflict, gin.H{"error": "device is decommissioned"})
+		return
+	}
+
+	record, err := resolver.firmware.Report(c.Request.Context(), device, report.RolloutID, report.Status, report.Detail, time.Now())
+	if err != nil {
+		abortWithFirmwareError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, record)
+}
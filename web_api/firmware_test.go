@@ -0,0 +1,130 @@
+package web_api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/TomascpMarques/maestro/firmware"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// doUpload sends the fields, and the image after them, as a multipart form
+func doUpload(app *gin.Engine, fields map[string]string, image string) *httptest.ResponseRecorder {
+	var payload bytes.Buffer
+	form := multipart.NewWriter(&payload)
+	for _, name := range []string{"device_type", "version", "description", "sha256", "signature"} {
+		if value, found := fields[name]; found {
+			_ = form.WriteField(name, value)
+		}
+	}
+	part, _ := form.CreateFormFile("image", "image.bin")
+	_, _ = part.Write([]byte(image))
+	_ = form.Close()
+
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/firmware/", &payload)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	recorder := httptest.NewRecorder()
+	app.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestFirmwareEndpoints(t *testing.T) {
+	app, _ := newTestApi(t)
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000002"})
+	image := "firmware-1.1.0-image"
+
+	response := doJSON(app, http.MethodPost, "/api/v1/firmware/", gin.H{"version": "1.1.0"})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doUpload(app, map[string]string{"description": "no version"}, image)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doUpload(app, map[string]string{"device_type": "42", "version": "1.1.0"}, image)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doUpload(app, map[string]string{"version": "1.1.0", "description": "faster sampling"}, image)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var stored repository.Firmware
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &stored))
+	assert.Equal(t, int64(len(image)), stored.Size)
+	assert.Equal(t, testAdmin, stored.UploadedBy)
+	response = doUpload(app, map[string]string{"version": "1.1.0"}, image)
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/firmware/rollouts/", gin.H{"firmware_id": stored.ID})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/firmware/rollouts/",
+		gin.H{"firmware_id": stored.ID, "serial_ids": []string{"PMD-000001"}})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var rollout repository.Rollout
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &rollout))
+	response = doJSON(app, http.MethodPost, "/api/v1/firmware/rollouts/", gin.H{"firmware_id": stored.ID, "percentage": 100})
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSON(app, http.MethodDelete, fmt.Sprintf("/api/v1/firmware/?id=%d", stored.ID), nil)
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	// Only the device listed is offered the update, and downloads it
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/firmware/update/?serial_id=PMD-000002&version=1.0.0", nil)
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/firmware/update/?serial_id=PMD-000001&version=1.0.0", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var update firmware.Update
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &update))
+	assert.Equal(t, rollout.ID, update.RolloutID)
+	assert.Equal(t, stored.SHA256, update.SHA256)
+
+	download := fmt.Sprintf("/api/v1/devices/pmd/firmware/download/?serial_id=PMD-000001&id=%d", stored.ID)
+	response = doJSON(app, http.MethodGet, download, nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, image, response.Body.String())
+	request := httptest.NewRequest(http.MethodGet, download, nil)
+	request.Header.Set("Range", "bytes=9-")
+	response = httptest.NewRecorder()
+	app.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusPartialContent, response.Code)
+	assert.Equal(t, image[9:], response.Body.String())
+	response = doJSON(app, http.MethodGet, fmt.Sprintf("/api/v1/devices/pmd/firmware/download/?serial_id=PMD-000002&id=%d", stored.ID), nil)
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	report := "/api/v1/devices/pmd/firmware/report/"
+	response = doJSON(app, http.MethodPost, report, gin.H{"serial_id": "PMD-000001", "rollout_id": rollout.ID, "status": repository.UpdateOffered})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doJSON(app, http.MethodPost, report, gin.H{"serial_id": "PMD-000002", "rollout_id": rollout.ID, "status": repository.UpdateInstalled})
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSON(app, http.MethodPost, report,
+		gin.H{"serial_id": "PMD-000001", "rollout_id": rollout.ID, "status": repository.UpdateFailed, "detail": "boot loop"})
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	// Every device listed reported, the rollout is completed
+	response = doJSON(app, http.MethodGet, fmt.Sprintf("/api/v1/firmware/rollouts/devices/?id=%d", rollout.ID), nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var devices []repository.RolloutDevice
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &devices))
+	if assert.Len(t, devices, 1) {
+		assert.Equal(t, repository.UpdateFailed, devices[0].Status)
+		assert.Equal(t, "boot loop", devices[0].Detail.String)
+	}
+	response = doJSON(app, http.MethodGet, "/api/v1/firmware/rollouts/", nil)
+	var rollouts []repository.Rollout
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &rollouts))
+	if assert.Len(t, rollouts, 1) {
+		assert.Equal(t, repository.RolloutCompleted, rollouts[0].Status)
+		assert.Equal(t, uint(1), rollouts[0].Failed)
+	}
+	response = doJSON(app, http.MethodPost, "/api/v1/firmware/rollouts/pause/", gin.H{"id": rollout.ID})
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/firmware/rollouts/cancel/", gin.H{"id": 42})
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = doJSON(app, http.MethodDelete, fmt.Sprintf("/api/v1/firmware/?id=%d", stored.ID), nil)
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	response = doJSON(app, http.MethodGet, "/api/v1/firmware/", nil)
+	assert.Equal(t, "[]", response.Body.String())
+	response = doJSONAs(app, "", http.MethodGet, "/api/v1/firmware/", nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+}
@@ -0,0 +1,23 @@
+package web_api
+
+import (
+	"net/http"
+
+	"github.com/TomascpMarques/maestro/health"
+	"github.com/gin-gonic/gin"
+)
+
+/*
+HealthHandler reports every health check of the app, a degraded app is still
+able to serve requests, so only a failing one answers with 503.
+*/
+func HealthHandler(registry *health.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := registry.Report()
+		if report.Status == health.Failing {
+			c.JSON(http.StatusServiceUnavailable, report)
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	}
+}
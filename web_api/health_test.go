@@ -0,0 +1,23 @@
+package web_api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/TomascpMarques/maestro/health"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	registry := health.NewRegistry()
+	app := gin.New()
+	app.GET("/health", HealthHandler(registry))
+
+	registry.Set(health.Check{Name: "database", Status: health.Degraded})
+	assert.Equal(t, http.StatusOK, doJSON(app, http.MethodGet, "/health", nil).Code)
+
+	registry.Set(health.Check{Name: "database", Status: health.Failing})
+	assert.Equal(t, http.StatusServiceUnavailable, doJSON(app, http.MethodGet, "/health", nil).Code)
+}
@@ -0,0 +1,62 @@
+package web_api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+)
+
+// DeviceHeartbeat is sent by a device that is still alive, the serial id is optional when signed
+type DeviceHeartbeat struct {
+	SerialId string `json:"serial_id"`
+}
+
+func (resolver *PmdResolver) Heartbeat(c *gin.Context) {
+	var heartbeat DeviceHeartbeat
+	if err := c.ShouldBindJSON(&heartbeat); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, found := requestDevice(c, resolver.devices, heartbeat.SerialId)
+	if !found {
+		return
+	}
+	if device.DeviceStatus == repository.Decommissioned {
+		c.JSON(http.StatusConflict, gin.H{"error": "device is decommissioned"})
+		return
+	}
+
+	resolver.presence.Seen(device, time.Now())
+	c.Status(http.StatusNoContent)
+}
+
+// DevicePresence is when the device was last seen, null if never, and its connectivity
+type DevicePresence struct {
+	SerialId     string `json:"serial_id"`
+	LastSeenAt   *int64 `json:"last_seen_at"`
+	Connectivity string `json:"connectivity"`
+}
+
+func (resolver *PmdResolver) GetPresence(c *gin.Context) {
+	serialId := c.Query("serial_id")
+	if serialId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "serial_id is required"})
+		return
+	}
+
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), serialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	lastSeen, seen, connectivity := resolver.presence.Presence(device)
+	current := DevicePresence{SerialId: device.SerialId, Connectivity: connectivity.String()}
+	if seen {
+		current.LastSeenAt = &lastSeen
+	}
+	c.JSON(http.StatusOK, current)
+}
@@ -0,0 +1,140 @@
+package web_api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/TomascpMarques/maestro/measurementtypes"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+)
+
+type MeasurementTypeResolver struct {
+	registry *measurementtypes.Registry
+}
+
+func NewMeasurementTypeResolver(registry *measurementtypes.Registry) MeasurementTypeResolver {
+	return MeasurementTypeResolver{registry}
+}
+
+func (resolver *MeasurementTypeResolver) routes(v1 *gin.RouterGroup, guards routeGuards) {
+	// /v1/measurements/types
+	measurementTypes := v1.Group("/measurements/types")
+	// Retrieve every measurement type
+	measurementTypes.GET("/", guards.viewer, resolver.ListMeasurementTypes)
+	// Define a new measurement type
+	measurementTypes.POST("/", guards.admin, resolver.CreateMeasurementType)
+	// Update a measurement type, its name and encoding can't change
+	measurementTypes.PUT("/", guards.admin, resolver.UpdateMeasurementType)
+	// Delete a measurement type no measurement uses, the built-in type is never deleted
+	measurementTypes.DELETE("/", guards.admin, resolver.DeleteMeasurementType)
+}
+
+/*
+MeasurementTypeRequest defines a measurement type, the id is only read by updates, which
+keep the name and encoding of the type. Encoding is one of 0 (float), 1 (int), 2 (bool)
+or 3 (vector), and Min and Max bound the values, or every element of a vector.
+*/
+type MeasurementTypeRequest struct {
+	ID          uint                     `json:"id"`
+	Name        string                   `binding:"omitempty,max=64" json:"name"`
+	Encoding    repository.ValueEncoding `binding:"lte=3" json:"encoding"`
+	Unit        string                   `binding:"omitempty,max=32" json:"unit"`
+	Min         *float64                 `json:"min"`
+	Max         *float64                 `json:"max"`
+	Description string                   `binding:"omitempty,max=256" json:"description"`
+}
+
+func (request MeasurementTypeRequest) definition() repository.MeasurementTypeDefinition {
+	definition := repository.MeasurementTypeDefinition{
+		ID: request.ID,
+		NewMeasurementType: repository.NewMeasurementType{
+			Name:        request.Name,
+			Encoding:    request.Encoding,
+			Unit:        request.Unit,
+			Description: sql.NullString{String: request.Description, Valid: request.Description != ""},
+		},
+	}
+	if request.Min != nil {
+		definition.Min = sql.NullFloat64{Float64: *request.Min, Valid: true}
+	}
+	if request.Max != nil {
+		definition.Max = sql.NullFloat64{Float64: *request.Max, Valid: true}
+	}
+	return definition
+}
+
+/*
+abortWithMeasurementTypeError answers a registry change that failed, the errors of the
+registry itself are client errors, anything else is left to abortWithRepositoryError.
+*/
+func abortWithMeasurementTypeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, measurementtypes.ErrInvalidType):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, measurementtypes.ErrUnknownType):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, measurementtypes.ErrBuiltinType):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "the built-in measurement type can't be deleted"})
+	case errors.Is(err, repository.InUse):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "measurement type is used by measurements"})
+	default:
+		abortWithRepositoryError(c, err)
+	}
+}
+
+func (resolver *MeasurementTypeResolver) ListMeasurementTypes(c *gin.Context) {
+	c.JSON(http.StatusOK, resolver.registry.List())
+}
+
+func (resolver *MeasurementTypeResolver) CreateMeasurementType(c *gin.Context) {
+	var request MeasurementTypeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	created, err := resolver.registry.Create(c.Request.Context(), request.definition().NewMeasurementType)
+	if err != nil {
+		abortWithMeasurementTypeError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, created)
+}
+
+func (resolver *MeasurementTypeResolver) UpdateMeasurementType(c *gin.Context) {
+	var request MeasurementTypeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updated, err := resolver.registry.Update(c.Request.Context(), request.definition())
+	if err != nil {
+		abortWithMeasurementTypeError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
+type MeasurementTypeSelector struct {
+	ID *uint `binding:"required" form:"id"`
+}
+
+func (resolver *MeasurementTypeResolver) DeleteMeasurementType(c *gin.Context) {
+	var selector MeasurementTypeSelector
+	if err := c.ShouldBindQuery(&selector); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := resolver.registry.Delete(c.Request.Context(), *selector.ID); err != nil {
+		abortWithMeasurementTypeError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,278 @@
+package web_api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/TomascpMarques/maestro/measurementtypes"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+)
+
+/*
+PublishedMeasurement is a measurement sent by a device, the value is written with the
+encoding of its measurement type, either as is or inside a string, like 21.5 or "21.5".
+The serial id is optional when the request is signed. MeasuredAt, in unix milliseconds
+by the clock of the device, is when it took the measurement, corrected by the offset of
+its last clock sync.
+*/
+type PublishedMeasurement struct {
+	SerialId   string          `json:"serial_id"`
+	Value      json.RawMessage `binding:"required" json:"m_value"`
+	ValueType  uint            `json:"m_value_type"`
+	MeasuredAt *int64          `json:"measured_at"`
+}
+
+// TypedMeasurement is a measurement with its value decoded by its type, and the unit of the type
+type TypedMeasurement struct {
+	Value      any    `json:"m_value"`
+	ValueType  uint   `json:"m_value_type"`
+	Unit       string `json:"unit"`
+	ReceivedAt int64  `json:"received_at"`
+	MeasuredAt *int64 `json:"measured_at,omitempty"`
+	// The clock of the device was skewed, the measured_at is less certain
+	ClockSkewed bool `json:"clock_skewed,omitempty"`
+}
+
+func (resolver *PmdResolver) typed(measurement repository.NewMeasurement) TypedMeasurement {
+	typed := TypedMeasurement{
+		Value:       resolver.measurementTypes.Decode(measurement.ValueType, measurement.Value),
+		ValueType:   measurement.ValueType,
+		Unit:        resolver.measurementTypes.Unit(measurement.ValueType),
+		ReceivedAt:  measurement.ReceivedAt,
+		ClockSkewed: measurement.ClockSkewed,
+	}
+	if measurement.MeasuredAt.Valid {
+		typed.MeasuredAt = &measurement.MeasuredAt.Int64
+	}
+	return typed
+}
+
+// TypedRollup is a rollup with the unit of its measurement type
+type TypedRollup struct {
+	repository.Rollup
+	Unit string `json:"unit"`
+}
+
+func (resolver *PmdResolver) PublishMeasurement(c *gin.Context) {
+	var published PublishedMeasurement
+	if err := c.ShouldBindJSON(&published); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, found := requestDevice(c, resolver.devices, published.SerialId)
+	if !found {
+		return
+	}
+	if device.DeviceStatus == repository.Decommissioned {
+		c.JSON(http.StatusConflict, gin.H{"error": "device is decommissioned"})
+		return
+	}
+	if device.DeviceStatus == repository.Pending {
+		c.JSON(http.StatusConflict, gin.H{"error": "device is pending approval"})
+		return
+	}
+	if !resolver.deviceTypes.AllowsValueType(device.DeviceType, published.ValueType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "m_value_type is not allowed for the device type"})
+		return
+	}
+	value, err := resolver.measurementTypes.Parse(published.ValueType, published.Value)
+	if errors.Is(err, measurementtypes.ErrUnknownType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "m_value_type is not a known measurement type"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The measurements of an accessory are attributed to the PMD it is attached to
+	parent, err := resolver.publisher(c.Request.Context(), device)
+	if errors.Is(err, repository.NotFound) {
+		c.JSON(http.StatusConflict, gin.H{"error": "accessory is not attached to a pmd"})
+		return
+	}
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	if parent.DeviceStatus == repository.Decommissioned {
+		c.JSON(http.StatusConflict, gin.H{"error": "parent pmd is decommissioned"})
+		return
+	}
+	if parent.DeviceStatus == repository.Pending {
+		c.JSON(http.StatusConflict, gin.H{"error": "parent pmd is pending approval"})
+		return
+	}
+
+	receivedAt := time.Now()
+	measurement := repository.NewMeasurement{
+		PublishingDeviceFk: parent.ID,
+		Value:              value,
+		ValueType:          published.ValueType,
+		ReceivedAt:         receivedAt.UnixMilli(),
+	}
+	if published.MeasuredAt != nil {
+		// Timed by the clock of the device publishing, an accessory syncs its own
+		measuredAt, skewed, err := resolver.clocks.Stamp(c.Request.Context(), device, time.UnixMilli(*published.MeasuredAt), receivedAt)
+		if err != nil {
+			abortWithClockError(c, err)
+			return
+		}
+		measurement.MeasuredAt = sql.NullInt64{Int64: measuredAt.UnixMilli(), Valid: true}
+		measurement.ClockSkewed = skewed
+	}
+	if parent.ID != device.ID {
+		measurement.AccessoryFk = sql.NullInt64{Int64: int64(device.ID), Valid: true}
+	}
+	// Accepted once queued, the measurement is written with the next batch
+	if err = resolver.ingest.Submit(measurement); err != nil {
+		abortWithIngestError(c, err, resolver.ingest.RetryAfter())
+		return
+	}
+	// A publishing device is alive, it doesn't need to send heartbeats as well, nor the PMD it is attached to
+	resolver.presence.Seen(device, receivedAt)
+	if parent.ID != device.ID {
+		resolver.presence.Seen(parent, receivedAt)
+	}
+	// Scoped to the device publishing, an accessory has rules of its own
+	resolver.alerts.Observe(device, measurement)
+
+	c.JSON(http.StatusAccepted, resolver.typed(measurement))
+}
+
+const (
+	defaultMeasurementWindow = 24 * time.Hour
+	defaultMeasurementLimit  = 1000
+)
+
+/*
+MeasurementsFilter is read from the query string, From and To are unix milliseconds,
+when left out, the last 24 hours of measurements are returned.
+Resolution is one of raw, 1m or 1h, by default (auto) it is chosen from the
+requested range and the retention policy of the measurement type.
+Axis is the time filtered and ordered by, received (the default) or measured, the
+latter falling back to the time received for the measurements not timed by the device.
+The measurements of a PMD include those published by its accessories.
+*/
+type MeasurementsFilter struct {
+	SerialId   string `binding:"required" form:"serial_id"`
+	From       int64  `form:"from"`
+	To         int64  `form:"to"`
+	ValueType  *uint  `form:"m_value_type"`
+	Limit      uint   `binding:"lte=10000" form:"limit"`
+	Resolution string `binding:"omitempty,oneof=auto raw 1m 1h" form:"resolution"`
+	Axis       string `binding:"omitempty,oneof=received measured" form:"axis"`
+}
+
+/*
+MeasurementsPage holds the result of a measurement query, the raw measurements
+when read at the raw resolution, and the rollups otherwise.
+*/
+type MeasurementsPage struct {
+	Resolution   string             `json:"resolution"`
+	Measurements []TypedMeasurement `json:"measurements"`
+	Rollups      []TypedRollup      `json:"rollups"`
+}
+
+// resolution returns the resolution the filter asked for, or chooses one when left to auto
+func (resolver *PmdResolver) resolution(filter MeasurementsFilter) repository.Resolution {
+	for _, resolution := range []repository.Resolution{
+		repository.RawResolution, repository.MinuteResolution, repository.HourResolution,
+	} {
+		if filter.Resolution == resolution.String() {
+			return resolution
+		}
+	}
+	return resolver.retention.ResolutionFor(
+		filter.ValueType,
+		time.UnixMilli(filter.From),
+		time.UnixMilli(filter.To),
+		time.Now(),
+	)
+}
+
+func (resolver *PmdResolver) QueryMeasurements(c *gin.Context) {
+	var filter MeasurementsFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.To == 0 {
+		filter.To = time.Now().UnixMilli()
+	}
+	if filter.From == 0 {
+		filter.From = filter.To - defaultMeasurementWindow.Milliseconds()
+	}
+	if filter.Limit == 0 {
+		filter.Limit = defaultMeasurementLimit
+	}
+
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), filter.SerialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	query := repository.MeasurementQuery{
+		DeviceID:    device.ID,
+		ByAccessory: resolver.deviceTypes.Role(device.DeviceType) == repository.AccessoryRole,
+		ValueType:   filter.ValueType,
+		From:        filter.From,
+		To:          filter.To,
+		Limit:       filter.Limit,
+	}
+	if filter.Axis == repository.MeasuredAxis.String() {
+		query.Axis = repository.MeasuredAxis
+	}
+	resolution := resolver.resolution(filter)
+	/*
+		Rollups are kept per PMD, and never for vectors, an accessory or a vector type
+		is read at the raw resolution unless asked otherwise.
+	*/
+	vector := filter.ValueType != nil && !resolver.measurementTypes.Aggregated(*filter.ValueType)
+	if (query.ByAccessory || vector) && filter.Resolution != resolution.String() {
+		resolution = repository.RawResolution
+	}
+	// Rollups are bucketed by the time received, the measured axis is only read raw
+	if query.Axis == repository.MeasuredAxis && resolution != repository.RawResolution {
+		if filter.Resolution == resolution.String() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "the measured axis is only read at the raw resolution"})
+			return
+		}
+		resolution = repository.RawResolution
+	}
+	page := MeasurementsPage{
+		Resolution:   resolution.String(),
+		Measurements: []TypedMeasurement{},
+		Rollups:      []TypedRollup{},
+	}
+
+	if resolution == repository.RawResolution {
+		measurements, err := resolver.measurements.Query(c.Request.Context(), query)
+		if err != nil {
+			abortWithRepositoryError(c, err)
+			return
+		}
+		for _, measurement := range measurements {
+			page.Measurements = append(page.Measurements, resolver.typed(measurement.NewMeasurement))
+		}
+	} else {
+		// Rollups are matched by the start of their bucket, so the one holding From is kept
+		query.From = resolution.Floor(query.From)
+		rollups, err := resolver.measurements.QueryRollups(c.Request.Context(), query, resolution)
+		if err != nil {
+			abortWithRepositoryError(c, err)
+			return
+		}
+		for _, rollup := range rollups {
+			page.Rollups = append(page.Rollups, TypedRollup{rollup, resolver.measurementTypes.Unit(rollup.ValueType)})
+		}
+	}
+
+	c.JSON(http.StatusOK, page)
+}
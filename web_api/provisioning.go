@@ -0,0 +1,235 @@
+package web_api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/TomascpMarques/maestro/deviceauth"
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/presence"
+	"github.com/TomascpMarques/maestro/provisioning"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+)
+
+type ProvisioningResolver struct {
+	provisioner *provisioning.Provisioner
+	devices     repository.DeviceRepository
+	deviceTypes *devicetypes.Registry
+	presence    *presence.Monitor
+	auth        *deviceauth.Authenticator
+	access      AccessControl
+}
+
+func NewProvisioningResolver(
+	provisioner *provisioning.Provisioner,
+	devices repository.DeviceRepository,
+	deviceTypes *devicetypes.Registry,
+	presence *presence.Monitor,
+	auth *deviceauth.Authenticator,
+	access AccessControl,
+) ProvisioningResolver {
+	return ProvisioningResolver{provisioner, devices, deviceTypes, presence, auth, access}
+}
+
+func (resolver *ProvisioningResolver) routes(v1 *gin.RouterGroup, guards routeGuards) {
+	// /v1/devices/claims
+	claims := v1.Group("/devices/claims", guards.admin)
+	// Retrieve every claim code, never the codes themselves
+	claims.GET("/", resolver.ListClaimCodes)
+	// Generate a one-time claim code for a device type, answering with the code
+	claims.POST("/", resolver.CreateClaimCode)
+	// Revoke a claim code not yet used
+	claims.POST("/revoke/", resolver.RevokeClaimCode)
+
+	// /v1/devices/provision, a device registers itself with a claim code, answering with its secret and config
+	v1.POST("/devices/provision/", resolver.Provision)
+
+	// /v1/devices/pmd/approve
+	// Approve a device provisioned with a code that requires it, moving it to the default status of its type
+	v1.POST("/devices/pmd/approve/", guards.operator, resolver.ApproveDevice)
+}
+
+/*
+ClaimCodeRequest is a claim code to generate for a device type, ExpiresIn is in
+milliseconds, when left out the default expiry of the provisioning config is used.
+*/
+type ClaimCodeRequest struct {
+	DeviceType       repository.DeviceType `json:"device_type"`
+	RequiresApproval bool                  `json:"requires_approval"`
+	Description      string                `binding:"omitempty,max=256" json:"description"`
+	ExpiresIn        int64                 `binding:"gte=0" json:"expires_in"`
+}
+
+// GeneratedClaimCode holds a code just generated, the only time it is ever shown
+type GeneratedClaimCode struct {
+	Code string `json:"code"`
+	repository.ClaimCode
+}
+
+func abortWithProvisioningError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, provisioning.ErrInvalidCode):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, provisioning.ErrExpiry), errors.Is(err, devicetypes.ErrUnknownType),
+		errors.Is(err, devicetypes.ErrSerialPattern):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, repository.AlreadyExists):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "device already registered"})
+	default:
+		abortWithRepositoryError(c, err)
+	}
+}
+
+func (resolver *ProvisioningResolver) ListClaimCodes(c *gin.Context) {
+	codes, err := resolver.provisioner.List(c.Request.Context())
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, codes)
+}
+
+func (resolver *ProvisioningResolver) CreateClaimCode(c *gin.Context) {
+	var request ClaimCodeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	code, created, err := resolver.provisioner.Generate(c.Request.Context(), provisioning.CodeRequest{
+		DeviceType:       request.DeviceType,
+		RequiresApproval: request.RequiresApproval,
+		Description:      sql.NullString{String: request.Description, Valid: request.Description != ""},
+		ExpiresIn:        time.Duration(request.ExpiresIn) * time.Millisecond,
+	}, actorOf(c), time.Now())
+	if err != nil {
+		abortWithProvisioningError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, GeneratedClaimCode{code, created})
+}
+
+type ClaimCodeSelector struct {
+	ID uint `binding:"required" json:"id"`
+}
+
+// RevokeClaimCode revokes a code not yet used, a used, expired or revoked code is not found
+func (resolver *ProvisioningResolver) RevokeClaimCode(c *gin.Context) {
+	var selector ClaimCodeSelector
+	if err := c.ShouldBindJSON(&selector); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	revoked, err := resolver.provisioner.Revoke(c.Request.Context(), selector.ID, time.Now())
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, revoked)
+}
+
+// ProvisionRequest is sent by a device provisioning itself, with the claim code it was given
+type ProvisionRequest struct {
+	ClaimCode   string `binding:"required,max=64" json:"claim_code"`
+	SerialId    string `binding:"required,max=128" json:"serial_id"`
+	Description string `binding:"omitempty,max=256" json:"description"`
+}
+
+/*
+DeviceConfig is what a device needs to start working, sent when it is provisioned.
+The durations are in milliseconds, the device should send a heartbeat at least every
+HeartbeatInterval, and sign its requests with a clock no further than MaxSkew from the
+server's. Until approved, a pending device may send heartbeats, but not publish.
+*/
+type DeviceConfig struct {
+	SerialId          string `json:"serial_id"`
+	DeviceType        string `json:"device_type"`
+	HeartbeatInterval int64  `json:"heartbeat_interval"`
+	MaxSkew           int64  `json:"max_skew"`
+	// The measurement types the device may publish, empty when it may publish any
+	ValueTypes []uint `json:"value_types"`
+	Pending    bool   `json:"pending"`
+}
+
+// ProvisionedDevice is a device just provisioned, with its secret, the only time it is ever shown
+type ProvisionedDevice struct {
+	RegisteredDevice
+	Config DeviceConfig `json:"config"`
+}
+
+/*
+Provision registers the device presenting a claim code, answering with its secret and
+its config. Every attempt is recorded in the audit log, with the serial id as the actor.
+*/
+func (resolver *ProvisioningResolver) Provision(c *gin.Context) {
+	var request ProvisionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, secret, code, err := resolver.provisioner.Provision(c.Request.Context(), request.ClaimCode, request.SerialId,
+		sql.NullString{String: request.Description, Valid: request.Description != ""}, time.Now())
+	if err != nil {
+		abortWithProvisioningError(c, err)
+		resolver.access.record(c, request.SerialId, sql.NullInt64{}, c.Writer.Status(), "")
+		return
+	}
+
+	c.JSON(http.StatusCreated, ProvisionedDevice{RegisteredDevice{device, secret}, resolver.deviceConfig(device)})
+	resolver.access.record(c, device.SerialId, sql.NullInt64{}, http.StatusCreated, fmt.Sprintf("claim_code=%d", code.ID))
+}
+
+func (resolver *ProvisioningResolver) deviceConfig(device repository.Device) DeviceConfig {
+	deviceType, _ := resolver.deviceTypes.Get(device.DeviceType)
+	valueTypes := []uint(deviceType.ValueTypes)
+	if valueTypes == nil {
+		valueTypes = []uint{}
+	}
+	// Halfway to stale, so a single lost heartbeat doesn't flag the device
+	interval := resolver.presence.Timeouts(device.DeviceType).StaleAfter / 2
+	return DeviceConfig{
+		SerialId:          device.SerialId,
+		DeviceType:        deviceType.Name,
+		HeartbeatInterval: interval.Milliseconds(),
+		MaxSkew:           resolver.auth.MaxSkew().Milliseconds(),
+		ValueTypes:        valueTypes,
+		Pending:           device.DeviceStatus == repository.Pending,
+	}
+}
+
+// ApproveDevice moves a pending device to the default status of its type, letting it publish
+func (resolver *ProvisioningResolver) ApproveDevice(c *gin.Context) {
+	var selector DeviceSelector
+	if err := c.ShouldBindJSON(&selector); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), selector.SerialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	if device.DeviceStatus != repository.Pending {
+		c.JSON(http.StatusConflict, gin.H{"error": "device is not pending approval"})
+		return
+	}
+
+	deviceType, _ := resolver.deviceTypes.Get(device.DeviceType)
+	device, err = resolver.devices.UpdateStatus(c.Request.Context(), device.SerialId,
+		selector.change(actorOf(c), deviceType.DefaultStatus))
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, device)
+}
@@ -0,0 +1,100 @@
+package web_api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/TomascpMarques/maestro/deviceauth"
+	"github.com/TomascpMarques/maestro/provisioning"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvisioningEndpoints(t *testing.T) {
+	app, _ := newTestApiWith(t, func(deps *Dependencies) {
+		deps.DeviceAuth = newTestDeviceAuth(t, deps.Repositories.Credentials, deviceauth.Config{})
+		deps.Provisioner = provisioning.NewProvisioner(deps.Repositories.ClaimCodes, deps.Repositories.Devices,
+			deps.DeviceTypes, deps.DeviceAuth, provisioning.Config{})
+	})
+
+	response := doJSON(app, http.MethodPost, "/api/v1/devices/claims/", gin.H{"device_type": 99})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/claims/", gin.H{"device_type": repository.PMD, "requires_approval": true})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var generated GeneratedClaimCode
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &generated))
+	assert.NotEmpty(t, generated.Code)
+	assert.Equal(t, testAdmin, generated.CreatedBy)
+
+	// Only the admins manage the codes, the listing never holds the codes
+	response = doJSONAs(app, "", http.MethodGet, "/api/v1/devices/claims/", nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/claims/", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NotContains(t, response.Body.String(), generated.Code)
+	assert.NotContains(t, response.Body.String(), provisioning.HashCode(generated.Code))
+
+	// The device provisions itself without a user
+	response = doJSONAs(app, "", http.MethodPost, "/api/v1/devices/provision/", gin.H{"claim_code": "0000-0000-0000-0000", "serial_id": "PMD-000001"})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	response = doJSONAs(app, "", http.MethodPost, "/api/v1/devices/provision/", gin.H{"claim_code": generated.Code, "serial_id": "PMD-1"})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doJSONAs(app, "", http.MethodPost, "/api/v1/devices/provision/", gin.H{"claim_code": generated.Code, "serial_id": "PMD-000001"})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var provisioned ProvisionedDevice
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &provisioned))
+	assert.NotEmpty(t, provisioned.Secret)
+	assert.Equal(t, repository.Pending, provisioned.DeviceStatus)
+	assert.Equal(t, DeviceConfig{
+		SerialId: "PMD-000001", DeviceType: "pmd", HeartbeatInterval: 60_000, MaxSkew: 300_000,
+		ValueTypes: []uint{}, Pending: true,
+	}, provisioned.Config)
+	response = doJSONAs(app, "", http.MethodPost, "/api/v1/devices/provision/", gin.H{"claim_code": generated.Code, "serial_id": "PMD-000002"})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// A pending device may send heartbeats, but not publish, nor have its status changed
+	published := gin.H{"m_value": 21.5, "m_value_type": 1}
+	response = doSigned(app, http.MethodPost, "/api/v1/devices/pmd/heartbeat/", "PMD-000001", provisioned.Secret, "n-1", gin.H{})
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	response = doSigned(app, http.MethodPost, "/api/v1/devices/pmd/data/", "PMD-000001", provisioned.Secret, "n-2", published)
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSON(app, http.MethodPut, "/api/v1/devices/pmd/status/", gin.H{"serial_id": "PMD-000001", "device_status": repository.Ok})
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/approve/", gin.H{"serial_id": "PMD-000001", "reason": "installed"})
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"device_status":0`)
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/approve/", gin.H{"serial_id": "PMD-000001"})
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doSigned(app, http.MethodPost, "/api/v1/devices/pmd/data/", "PMD-000001", provisioned.Secret, "n-3", published)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/status/history/?serial_id=PMD-000001", nil)
+	var timeline StatusHistory
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &timeline))
+	if assert.Len(t, timeline.History, 2) {
+		assert.Equal(t, testAdmin, timeline.History[1].Actor)
+		assert.Equal(t, "installed", timeline.History[1].Reason.String)
+	}
+
+	// A revoked code can't be used, and a used one can't be revoked
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/claims/", gin.H{"device_type": repository.PMD})
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &generated))
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/claims/revoke/", gin.H{"id": generated.ID})
+	assert.Equal(t, http.StatusOK, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/claims/revoke/", gin.H{"id": generated.ID})
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	response = doJSONAs(app, "", http.MethodPost, "/api/v1/devices/provision/", gin.H{"claim_code": generated.Code, "serial_id": "PMD-000002"})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// Every attempt is audited, with the serial id as the actor
+	response = doJSON(app, http.MethodGet, "/api/v1/audit/?actor=PMD-000001", nil)
+	var entries []repository.AuditEntry
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &entries))
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "claim_code=1", entries[0].Target.String)
+		assert.Equal(t, http.StatusUnauthorized, entries[1].StatusCode)
+	}
+}
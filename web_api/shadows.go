@@ -0,0 +1,208 @@
+package web_api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/TomascpMarques/maestro/devicetypes"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/TomascpMarques/maestro/shadow"
+	"github.com/gin-gonic/gin"
+)
+
+type ShadowResolver struct {
+	shadows *shadow.Service
+	devices repository.DeviceRepository
+}
+
+func NewShadowResolver(shadows *shadow.Service, devices repository.DeviceRepository) ShadowResolver {
+	return ShadowResolver{shadows, devices}
+}
+
+func (resolver *ShadowResolver) routes(v1 *gin.RouterGroup, guards routeGuards) {
+	// /v1/devices/types/shadow
+	shadowTemplates := v1.Group("/devices/types/shadow")
+	// Retrieve the config template of every device type
+	shadowTemplates.GET("/", guards.viewer, resolver.ListShadowTemplates)
+	// Replace the config template of a device type, the devices of the type drift until they apply it
+	shadowTemplates.PUT("/", guards.admin, resolver.UpdateShadowTemplate)
+
+	// /v1/devices/pmd/shadow
+	shadows := v1.Group("/devices/pmd/shadow")
+	// Retrieve the desired and reported config of a device, with its delta
+	shadows.GET("/", guards.viewer, resolver.GetShadow)
+	// Update the desired config of a device with a merge patch
+	shadows.PUT("/desired/", guards.operator, resolver.UpdateDesiredConfig)
+	// Retrieve every device whose reported config drifted from the desired one
+	shadows.GET("/drift/", guards.viewer, resolver.GetDriftedShadows)
+	// The device fetches the settings to apply, and reports the config it applied
+	shadows.GET("/delta/", guards.signed, resolver.GetShadowDelta)
+	shadows.POST("/reported/", guards.signed, resolver.ReportConfig)
+}
+
+func abortWithShadowError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, shadow.ErrNotObject), errors.Is(err, shadow.ErrTooLarge), errors.Is(err, devicetypes.ErrUnknownType):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, shadow.ErrVersionConflict):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		abortWithRepositoryError(c, err)
+	}
+}
+
+func (resolver *ShadowResolver) GetShadow(c *gin.Context) {
+	serialId := c.Query("serial_id")
+	if serialId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "serial_id is required"})
+		return
+	}
+
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), serialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	state, err := resolver.shadows.Get(c.Request.Context(), device)
+	if err != nil {
+		abortWithShadowError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, state)
+}
+
+/*
+DesiredConfig is a merge patch of the desired config of a device, a key set to null is
+removed. When Version is given, the patch only applies if the config is still at it.
+*/
+type DesiredConfig struct {
+	SerialId string             `binding:"required" json:"serial_id"`
+	Desired  repository.RawJSON `binding:"required" json:"desired"`
+	Version  *uint              `json:"version"`
+}
+
+func (resolver *ShadowResolver) UpdateDesiredConfig(c *gin.Context) {
+	var update DesiredConfig
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), update.SerialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	if device.DeviceStatus == repository.Decommissioned {
+		c.JSON(http.StatusConflict, gin.H{"error": "device is decommissioned"})
+		return
+	}
+
+	state, err := resolver.shadows.UpdateDesired(c.Request.Context(), device, update.Desired, update.Version, actorOf(c), time.Now())
+	if err != nil {
+		abortWithShadowError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, state)
+}
+
+// GetDriftedShadows answers with the devices whose reported config doesn't match the desired one
+func (resolver *ShadowResolver) GetDriftedShadows(c *gin.Context) {
+	drifted, err := resolver.shadows.Drifted(c.Request.Context())
+	if err != nil {
+		abortWithShadowError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, drifted)
+}
+
+// GetShadowDelta answers the device with the desired settings it doesn't report yet
+func (resolver *ShadowResolver) GetShadowDelta(c *gin.Context) {
+	device, found := requestDevice(c, resolver.devices, c.Query("serial_id"))
+	if !found {
+		return
+	}
+
+	state, err := resolver.shadows.Get(c.Request.Context(), device)
+	if err != nil {
+		abortWithShadowError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, state.DeviceDelta())
+}
+
+/*
+ReportedConfig is a merge patch of the config a device reports, usually the settings
+of the delta it just applied. When Version is given, the patch only applies if the
+reported config is still at it.
+*/
+type ReportedConfig struct {
+	SerialId string             `json:"serial_id"`
+	Reported repository.RawJSON `binding:"required" json:"reported"`
+	Version  *uint              `json:"version"`
+}
+
+// ReportConfig records the config reported by the device, answering with what is left of the delta
+func (resolver *ShadowResolver) ReportConfig(c *gin.Context) {
+	var report ReportedConfig
+	if err := c.ShouldBindJSON(&report); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	device, found := requestDevice(c, resolver.devices, report.SerialId)
+	if !found {
+		return
+	}
+	if device.DeviceStatus == repository.Decommissioned {
+		c.JSON(http.StatusConflict, gin.H{"error": "device is decommissioned"})
+		return
+	}
+
+	state, err := resolver.shadows.Report(c.Request.Context(), device, report.Reported, report.Version, time.Now())
+	if err != nil {
+		abortWithShadowError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, state.DeviceDelta())
+}
+
+func (resolver *ShadowResolver) ListShadowTemplates(c *gin.Context) {
+	templates, err := resolver.shadows.Templates(c.Request.Context())
+	if err != nil {
+		abortWithShadowError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, templates)
+}
+
+/*
+ShadowTemplateUpdate replaces the template of a device type, an empty document removes it.
+When Version is given, the template is only replaced if it is still at it.
+*/
+type ShadowTemplateUpdate struct {
+	DeviceType repository.DeviceType `json:"device_type"`
+	Document   repository.RawJSON    `json:"document"`
+	Version    *uint                 `json:"version"`
+}
+
+func (resolver *ShadowResolver) UpdateShadowTemplate(c *gin.Context) {
+	var update ShadowTemplateUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	template, err := resolver.shadows.SetTemplate(c.Request.Context(), update.DeviceType, update.Document, update.Version,
+		actorOf(c), time.Now())
+	if err != nil {
+		abortWithShadowError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, template)
+}
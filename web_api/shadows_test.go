@@ -0,0 +1,81 @@
+package web_api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/TomascpMarques/maestro/shadow"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShadowEndpoints(t *testing.T) {
+	app, _ := newTestApi(t)
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000002"})
+
+	response := doJSON(app, http.MethodPut, "/api/v1/devices/types/shadow/",
+		gin.H{"device_type": repository.PMD, "document": gin.H{"interval_ms": 1000, "display": "on"}})
+	assert.Equal(t, http.StatusOK, response.Code)
+	response = doJSON(app, http.MethodPut, "/api/v1/devices/types/shadow/", gin.H{"device_type": 42, "document": gin.H{}})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doJSON(app, http.MethodPut, "/api/v1/devices/types/shadow/",
+		gin.H{"device_type": repository.PMD, "document": gin.H{}, "version": 0})
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	response = doJSON(app, http.MethodPut, "/api/v1/devices/pmd/shadow/desired/", gin.H{"serial_id": "PMD-000001", "desired": []int{1}})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doJSON(app, http.MethodPut, "/api/v1/devices/pmd/shadow/desired/", gin.H{"serial_id": "PMD-000009", "desired": gin.H{}})
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	response = doJSON(app, http.MethodPut, "/api/v1/devices/pmd/shadow/desired/",
+		gin.H{"serial_id": "PMD-000001", "desired": gin.H{"interval_ms": 500}, "version": 0})
+	assert.Equal(t, http.StatusOK, response.Code)
+	var state shadow.State
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &state))
+	assert.Equal(t, uint(1), state.DesiredVersion)
+	assert.Equal(t, testAdmin, state.DesiredBy.String)
+	assert.JSONEq(t, `{"interval_ms":500,"display":"on"}`, string(state.Effective))
+	response = doJSON(app, http.MethodPut, "/api/v1/devices/pmd/shadow/desired/",
+		gin.H{"serial_id": "PMD-000001", "desired": gin.H{"interval_ms": 200}, "version": 0})
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	// The device fetches its delta, applies part of it and reports it back
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/shadow/delta/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var delta shadow.DeviceDelta
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &delta))
+	assert.JSONEq(t, `{"interval_ms":500,"display":"on"}`, string(delta.Delta))
+	assert.Equal(t, uint(1), delta.TemplateVersion)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/shadow/reported/",
+		gin.H{"serial_id": "PMD-000001", "reported": gin.H{"interval_ms": 500}})
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &delta))
+	assert.JSONEq(t, `{"display":"on"}`, string(delta.Delta))
+	assert.Equal(t, uint(1), delta.ReportedVersion)
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/shadow/drift/", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var drifted []shadow.State
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &drifted))
+	assert.Len(t, drifted, 2)
+
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/shadow/reported/",
+		gin.H{"serial_id": "PMD-000001", "reported": gin.H{"display": "on"}, "version": 1})
+	doJSON(app, http.MethodPost, "/api/v1/devices/pmd/decommission/", gin.H{"serial_id": "PMD-000002"})
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/shadow/drift/", nil)
+	assert.Equal(t, "[]", response.Body.String())
+
+	response = doJSON(app, http.MethodGet, "/api/v1/devices/pmd/shadow/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &state))
+	assert.True(t, state.InSync)
+	assert.Equal(t, uint(2), state.ReportedVersion)
+
+	response = doJSON(app, http.MethodPut, "/api/v1/devices/pmd/shadow/desired/", gin.H{"serial_id": "PMD-000002", "desired": gin.H{}})
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSONAs(app, "", http.MethodGet, "/api/v1/devices/pmd/shadow/drift/", nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+}
@@ -0,0 +1,169 @@
+package web_api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+)
+
+const defaultHistoryWindow = 30 * 24 * time.Hour
+
+/*
+StatusHistoryFilter is read from the query string, From and To are unix milliseconds,
+when left out, the changes of the last 30 days are returned.
+*/
+type StatusHistoryFilter struct {
+	SerialId string `binding:"required" form:"serial_id"`
+	From     int64  `form:"from"`
+	To       int64  `form:"to"`
+	Limit    uint   `binding:"lte=10000" form:"limit"`
+}
+
+type StatusHistory struct {
+	SerialId string                          `json:"serial_id"`
+	History  []repository.StatusHistoryEntry `json:"history"`
+}
+
+func (resolver *PmdResolver) GetStatusHistory(c *gin.Context) {
+	var filter StatusHistoryFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.To == 0 {
+		filter.To = time.Now().UnixMilli()
+	}
+	if filter.From == 0 {
+		filter.From = filter.To - defaultHistoryWindow.Milliseconds()
+	}
+	if filter.Limit == 0 {
+		filter.Limit = defaultMeasurementLimit
+	}
+
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), filter.SerialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	history, err := resolver.history.List(c.Request.Context(), repository.StatusHistoryQuery{
+		DeviceID: device.ID,
+		From:     filter.From,
+		To:       filter.To,
+		Limit:    filter.Limit,
+	})
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, StatusHistory{device.SerialId, history})
+}
+
+/*
+UptimeFilter is read from the query string, From and To are unix milliseconds,
+when left out, the last 24 hours are used. A To in the future is cut to now.
+*/
+type UptimeFilter struct {
+	SerialId string `binding:"required" form:"serial_id"`
+	From     int64  `form:"from"`
+	To       int64  `form:"to"`
+}
+
+/*
+DeviceUptime holds how many milliseconds the device spent in each status within
+the range, the time before its first known status is left out. Availability is the
+fraction of the known time spent Ok, null when no status is known in the range.
+*/
+type DeviceUptime struct {
+	SerialId     string           `json:"serial_id"`
+	From         int64            `json:"from"`
+	To           int64            `json:"to"`
+	Durations    map[string]int64 `json:"durations"`
+	Availability *float64         `json:"availability"`
+}
+
+func (resolver *PmdResolver) GetDeviceUptime(c *gin.Context) {
+	var filter UptimeFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now().UnixMilli()
+	if filter.To == 0 || filter.To > now {
+		filter.To = now
+	}
+	if filter.From == 0 {
+		filter.From = filter.To - defaultMeasurementWindow.Milliseconds()
+	}
+	if filter.From >= filter.To {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	device, err := resolver.devices.GetBySerial(c.Request.Context(), filter.SerialId)
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	// The status the device had when the range starts, if it existed by then
+	var initial *repository.DeviceStatus
+	before, err := resolver.history.Before(c.Request.Context(), device.ID, filter.From)
+	if err == nil {
+		initial = &before.NewStatus
+	} else if !errors.Is(err, repository.NotFound) {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	changes, err := resolver.history.List(c.Request.Context(), repository.StatusHistoryQuery{
+		DeviceID: device.ID,
+		From:     filter.From,
+		To:       filter.To,
+	})
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+
+	uptime := DeviceUptime{SerialId: device.SerialId, From: filter.From, To: filter.To}
+	uptime.Durations, uptime.Availability = statusDurations(initial, changes, filter.From, filter.To)
+	c.JSON(http.StatusOK, uptime)
+}
+
+/*
+statusDurations sums the time spent in each status between from and to, starting in
+the initial status, nil if unknown, and moving through the changes, ordered by date.
+*/
+func statusDurations(
+	initial *repository.DeviceStatus,
+	changes []repository.StatusHistoryEntry,
+	from, to int64,
+) (map[string]int64, *float64) {
+	durations := map[string]int64{}
+	current, since := initial, from
+	var known int64
+
+	add := func(until int64) {
+		if current != nil && until > since {
+			durations[current.String()] += until - since
+			known += until - since
+		}
+	}
+	for _, change := range changes {
+		add(change.ChangedAt)
+		status := change.NewStatus
+		current, since = &status, change.ChangedAt
+	}
+	add(to)
+
+	if known == 0 {
+		return durations, nil
+	}
+	availability := float64(durations[repository.Ok.String()]) / float64(known)
+	return durations, &availability
+}
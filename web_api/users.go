@@ -0,0 +1,237 @@
+package web_api
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/TomascpMarques/maestro/adminauth"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+)
+
+type UserResolver struct {
+	auth   *adminauth.Authenticator
+	users  repository.UserRepository
+	audit  repository.AuditRepository
+	access AccessControl
+}
+
+func NewUserResolver(auth *adminauth.Authenticator, users repository.UserRepository, audit repository.AuditRepository, access AccessControl) UserResolver {
+	return UserResolver{auth, users, audit, access}
+}
+
+func (resolver *UserResolver) routes(v1 *gin.RouterGroup, guards routeGuards) {
+	// /v1/auth
+	auth := v1.Group("/auth")
+	// Log in with a username and password, answering with a bearer token
+	auth.POST("/login/", resolver.Login)
+	// Revoke the token of the request
+	auth.POST("/logout/", guards.viewer, resolver.Logout)
+	// Retrieve the user of the token
+	auth.GET("/me/", guards.viewer, resolver.CurrentUser)
+	// Change the password of the user of the token, given its current one
+	auth.POST("/password/", guards.viewer, resolver.ChangePassword)
+
+	// /v1/users
+	users := v1.Group("/users", guards.admin)
+	// Retrieve every user
+	users.GET("/", resolver.ListUsers)
+	// Create a user with a role
+	users.POST("/", resolver.CreateUser)
+	// Change the role of a user, or disable it
+	users.PUT("/", resolver.UpdateUser)
+	// Replace the password of a user
+	users.POST("/password/", resolver.ResetPassword)
+
+	// /v1/audit, who did what through the api
+	v1.GET("/audit/", guards.admin, resolver.GetAuditLog)
+}
+
+type LoginRequest struct {
+	Username string `binding:"required,max=64" json:"username"`
+	Password string `binding:"required,max=256" json:"password"`
+}
+
+// LoginSession is the bearer token of a new session, sent as "Authorization: Bearer <token>"
+type LoginSession struct {
+	Token string `json:"token"`
+	// Unix milliseconds
+	ExpiresAt int64           `json:"expires_at"`
+	User      repository.User `json:"user"`
+}
+
+// Login issues a token to the user, every attempt is recorded in the audit log, the failed ones too
+func (resolver *UserResolver) Login(c *gin.Context) {
+	var request LoginRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, session, user, err := resolver.auth.Login(c.Request.Context(), request.Username, request.Password, time.Now())
+	if err != nil {
+		abortWithAdminAuthError(c, err)
+		resolver.access.record(c, request.Username, sql.NullInt64{}, c.Writer.Status(), "")
+		return
+	}
+
+	c.JSON(http.StatusOK, LoginSession{token, session.ExpiresAt, user})
+	resolver.access.record(c, user.Username, sql.NullInt64{Int64: int64(user.Role), Valid: true}, http.StatusOK, "")
+}
+
+func (resolver *UserResolver) Logout(c *gin.Context) {
+	token := adminauth.BearerToken(c.GetHeader("Authorization"))
+	if err := resolver.auth.Logout(c.Request.Context(), token, time.Now()); err != nil {
+		abortWithAdminAuthError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// CurrentUser answers with the user of the token
+func (resolver *UserResolver) CurrentUser(c *gin.Context) {
+	user, _ := authenticatedUser(c)
+	c.JSON(http.StatusOK, user)
+}
+
+type PasswordChange struct {
+	CurrentPassword string `binding:"required,max=256" json:"current_password"`
+	NewPassword     string `binding:"required,max=256" json:"new_password"`
+}
+
+// ChangePassword replaces the password of the user of the token, which is logged out everywhere
+func (resolver *UserResolver) ChangePassword(c *gin.Context) {
+	var change PasswordChange
+	if err := c.ShouldBindJSON(&change); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, _ := authenticatedUser(c)
+	err := resolver.auth.ChangePassword(c.Request.Context(), user.Username, change.CurrentPassword, change.NewPassword, time.Now())
+	if err != nil {
+		abortWithAdminAuthError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (resolver *UserResolver) ListUsers(c *gin.Context) {
+	users, err := resolver.users.List(c.Request.Context())
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+// NewUserRequest creates a user, Role is one of 0 (viewer), 1 (operator) or 2 (admin)
+type NewUserRequest struct {
+	Username string              `binding:"required,max=64" json:"username"`
+	Password string              `binding:"required,max=256" json:"password"`
+	Role     repository.UserRole `binding:"lte=2" json:"role"`
+}
+
+func (resolver *UserResolver) CreateUser(c *gin.Context) {
+	var request NewUserRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := resolver.auth.CreateUser(c.Request.Context(), request.Username, request.Password, request.Role, time.Now())
+	if err != nil {
+		abortWithAdminAuthError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, user)
+}
+
+// UserUpdate changes the role of a user, a disabled user can't log in, and is logged out everywhere
+type UserUpdate struct {
+	ID       uint                `binding:"required" json:"id"`
+	Role     repository.UserRole `binding:"lte=2" json:"role"`
+	Disabled bool                `json:"disabled"`
+}
+
+func (resolver *UserResolver) UpdateUser(c *gin.Context) {
+	var update UserUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Or the last admin could lock everyone out
+	if current, _ := authenticatedUser(c); current.ID == update.ID {
+		c.JSON(http.StatusConflict, gin.H{"error": "an admin can't change its own role, or disable itself"})
+		return
+	}
+
+	user, err := resolver.auth.UpdateUser(c.Request.Context(), update.ID, update.Role, update.Disabled, time.Now())
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+type PasswordReset struct {
+	ID       uint   `binding:"required" json:"id"`
+	Password string `binding:"required,max=256" json:"password"`
+}
+
+// ResetPassword replaces the password of any user, without its current one
+func (resolver *UserResolver) ResetPassword(c *gin.Context) {
+	var reset PasswordReset
+	if err := c.ShouldBindJSON(&reset); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := resolver.auth.SetPassword(c.Request.Context(), reset.ID, reset.Password, time.Now()); err != nil {
+		abortWithAdminAuthError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+/*
+AuditFilter is read from the query string, From and To are unix milliseconds,
+when left out, the entries of the last 30 days are returned.
+*/
+type AuditFilter struct {
+	Actor string `form:"actor"`
+	From  int64  `form:"from"`
+	To    int64  `form:"to"`
+	Limit uint   `binding:"lte=10000" form:"limit"`
+}
+
+// GetAuditLog answers with the entries of the audit log matching the filter, the most recent first
+func (resolver *UserResolver) GetAuditLog(c *gin.Context) {
+	var filter AuditFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.To == 0 {
+		filter.To = time.Now().UnixMilli()
+	}
+	if filter.From == 0 {
+		filter.From = filter.To - defaultHistoryWindow.Milliseconds()
+	}
+	if filter.Limit == 0 {
+		filter.Limit = defaultMeasurementLimit
+	}
+
+	entries, err := resolver.audit.List(c.Request.Context(), repository.AuditQuery{
+		Actor: filter.Actor,
+		From:  filter.From,
+		To:    filter.To,
+		Limit: filter.Limit,
+	})
+	if err != nil {
+		abortWithRepositoryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
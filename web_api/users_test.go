@@ -0,0 +1,205 @@
+package web_api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/TomascpMarques/maestro/adminauth"
+	"github.com/TomascpMarques/maestro/backup"
+	"github.com/TomascpMarques/maestro/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// doJSONAs sends the request with the token, an empty token sends an empty Authorization header
+func doJSONAs(app *gin.Engine, token, method, path string, body any) *httptest.ResponseRecorder {
+	var payload bytes.Buffer
+	if body != nil {
+		_ = json.NewEncoder(&payload).Encode(body)
+	}
+
+	request := httptest.NewRequest(method, path, &payload)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	app.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// login logs the user in, returning its token
+func login(t *testing.T, app *gin.Engine, username, password string) string {
+	response := doJSONAs(app, "", http.MethodPost, "/api/v1/auth/login/", gin.H{"username": username, "password": password})
+	assert.Equal(t, http.StatusOK, response.Code)
+	var session LoginSession
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &session))
+	return session.Token
+}
+
+func TestUserRoles(t *testing.T) {
+	app, _ := newTestApi(t)
+
+	response := doJSONAs(app, "", http.MethodPost, "/api/v1/auth/login/", gin.H{"username": testAdmin, "password": "wrong-password"})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	response = doJSONAs(app, "", http.MethodGet, "/api/v1/devices/pmd/status/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	response = doJSONAs(app, "invalid", http.MethodGet, "/api/v1/devices/pmd/status/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	// The health check stays open
+	response = doJSONAs(app, "", http.MethodGet, "/api/v1/health", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/users/", gin.H{"username": "viewer", "password": "short", "role": repository.ViewerRole})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	// Past what bcrypt hashes
+	response = doJSON(app, http.MethodPost, "/api/v1/users/", gin.H{
+		"username": "viewer", "password": strings.Repeat("p", adminauth.MaxPasswordLength+1), "role": repository.ViewerRole,
+	})
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	// Read to name the target, a body past the limit is refused before the handler
+	response = doJSON(app, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": strings.Repeat("x", maxAuditedBodySize)})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/users/", gin.H{"username": "viewer", "password": "viewer-password", "role": repository.ViewerRole})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	assert.NotContains(t, response.Body.String(), "password")
+	var viewer repository.User
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &viewer))
+	response = doJSON(app, http.MethodPost, "/api/v1/users/", gin.H{"username": "operator", "password": "operator-password", "role": repository.OperatorRole})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	response = doJSON(app, http.MethodPost, "/api/v1/users/", gin.H{"username": "operator", "password": "operator-password"})
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	viewerToken := login(t, app, "viewer", "viewer-password")
+	operatorToken := login(t, app, "operator", "operator-password")
+
+	response = doJSONAs(app, viewerToken, http.MethodGet, "/api/v1/auth/me/", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"username":"viewer"`)
+
+	// Every role may do what the ones below it do
+	response = doJSONAs(app, viewerToken, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+	assert.Equal(t, http.StatusForbidden, response.Code)
+	response = doJSONAs(app, operatorToken, http.MethodPost, "/api/v1/devices/pmd/register/", gin.H{"serial_id": "PMD-000001"})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	response = doJSONAs(app, viewerToken, http.MethodGet, "/api/v1/devices/pmd/status/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	response = doJSONAs(app, operatorToken, http.MethodDelete, "/api/v1/devices/pmd/?serial_id=PMD-000001", nil)
+	assert.Equal(t, http.StatusForbidden, response.Code)
+	response = doJSONAs(app, operatorToken, http.MethodPost, "/api/v1/devices/pmd/credentials/rotate/", gin.H{"serial_id": "PMD-000001"})
+	assert.Equal(t, http.StatusForbidden, response.Code)
+	response = doJSONAs(app, operatorToken, http.MethodGet, "/api/v1/users/", nil)
+	assert.Equal(t, http.StatusForbidden, response.Code)
+
+	// Who did what, the most recent first
+	response = doJSON(app, http.MethodGet, "/api/v1/audit/?actor=operator", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var entries []repository.AuditEntry
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &entries))
+	// Refused requests are recorded, reads included
+	if assert.Len(t, entries, 5) {
+		assert.Equal(t, "GET /api/v1/users/", entries[0].Action)
+		assert.Equal(t, http.StatusForbidden, entries[0].StatusCode)
+		assert.Equal(t, "serial_id=PMD-000001", entries[1].Target.String)
+		assert.Equal(t, "POST /api/v1/devices/pmd/register/", entries[3].Action)
+		assert.Equal(t, "serial_id=PMD-000001", entries[3].Target.String)
+		assert.Equal(t, http.StatusCreated, entries[3].StatusCode)
+		assert.Equal(t, "POST /api/v1/auth/login/", entries[4].Action)
+	}
+	response = doJSON(app, http.MethodGet, "/api/v1/audit/?actor="+testAdmin, nil)
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &entries))
+	assert.NotEmpty(t, entries)
+	for _, entry := range entries {
+		assert.NotContains(t, entry.Target.String, "password")
+	}
+
+	// An admin can't lock itself out, but can disable the others, which are logged out
+	response = doJSON(app, http.MethodGet, "/api/v1/auth/me/", nil)
+	var admin repository.User
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &admin))
+	response = doJSON(app, http.MethodPut, "/api/v1/users/", gin.H{"id": admin.ID, "role": repository.ViewerRole})
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doJSON(app, http.MethodPut, "/api/v1/users/", gin.H{"id": viewer.ID, "role": repository.ViewerRole, "disabled": true})
+	assert.Equal(t, http.StatusOK, response.Code)
+	response = doJSONAs(app, viewerToken, http.MethodGet, "/api/v1/auth/me/", nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// Changing the password logs the user out everywhere
+	response = doJSONAs(app, operatorToken, http.MethodPost, "/api/v1/auth/password/", gin.H{
+		"current_password": "wrong-password", "new_password": "another-password",
+	})
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	response = doJSONAs(app, operatorToken, http.MethodPost, "/api/v1/auth/password/", gin.H{
+		"current_password": "operator-password", "new_password": "another-password",
+	})
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	response = doJSONAs(app, operatorToken, http.MethodGet, "/api/v1/auth/me/", nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	operatorToken = login(t, app, "operator", "another-password")
+	response = doJSONAs(app, operatorToken, http.MethodPost, "/api/v1/auth/logout/", nil)
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	response = doJSONAs(app, operatorToken, http.MethodGet, "/api/v1/auth/me/", nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+}
+
+func TestBackupAndConfigEndpoints(t *testing.T) {
+	app, _ := newTestApi(t)
+	response := doJSON(app, http.MethodPost, "/api/v1/users/", gin.H{"username": "operator", "password": "operator-password", "role": repository.OperatorRole})
+	assert.Equal(t, http.StatusCreated, response.Code)
+	operatorToken := login(t, app, "operator", "operator-password")
+
+	response = doJSONAs(app, operatorToken, http.MethodGet, "/api/v1/backup/", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"paused":false,"integrity_blocked":false,"skipping":false,"ended":false,"last_backup_at":0,"last_failure_at":0}`, response.Body.String())
+	response = doJSONAs(app, operatorToken, http.MethodPost, "/api/v1/backup/pause/", nil)
+	assert.Equal(t, http.StatusForbidden, response.Code)
+
+	response = doJSON(app, http.MethodPost, "/api/v1/backup/pause/", nil)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	// Nothing takes the signals out in the test, the queue of one is full
+	response = doJSON(app, http.MethodPost, "/api/v1/backup/resume/", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+
+	response = doJSONAs(app, operatorToken, http.MethodGet, "/api/v1/config/", nil)
+	assert.Equal(t, http.StatusForbidden, response.Code)
+	response = doJSON(app, http.MethodGet, "/api/v1/config/", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"admin_auth":{"bootstrap_password":"env:MAESTRO_ADMIN_PASSWORD"}}`, response.Body.String())
+	response = doJSON(app, http.MethodPost, "/api/v1/config/reload/", nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+}
+
+func TestResumeBackupsWhileIntegrityBlocked(t *testing.T) {
+	gate := &backup.Gate{}
+	taskHandle := make(chan backup.TaskHandleSignal, 1)
+	app, _ := newTestApiWith(t, func(deps *Dependencies) {
+		deps.Backups = backup.NewController(taskHandle, make(chan backup.BackupTaskSignal), gate)
+	})
+
+	response := doJSON(app, http.MethodPost, "/api/v1/backup/resume/", nil)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Equal(t, backup.ResumeBackupTask, <-taskHandle)
+
+	// The pause of an operator is theirs to lift, not while the integrity checks fail
+	gate.Block(true)
+	response = doJSON(app, http.MethodGet, "/api/v1/backup/", nil)
+	var state backup.TaskState
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &state))
+	assert.True(t, state.IntegrityBlocked)
+	response = doJSON(app, http.MethodPost, "/api/v1/backup/pause/", nil)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Equal(t, backup.PauseBackupTask, <-taskHandle)
+	response = doJSON(app, http.MethodPost, "/api/v1/backup/resume/", nil)
+	assert.Equal(t, http.StatusConflict, response.Code)
+	assert.Empty(t, taskHandle)
+
+	gate.Block(false)
+	response = doJSON(app, http.MethodPost, "/api/v1/backup/resume/", nil)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+}